@@ -0,0 +1,212 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package activesync
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+
+	"github.com/superkkt/logger"
+)
+
+// RequestAuthenticator authenticates an HTTP request using a specific
+// authentication scheme of the Authorization header.
+type RequestAuthenticator interface {
+	// Scheme returns the name of the authentication scheme, e.g., Basic.
+	Scheme() string
+	// Challenge returns a value of the WWW-Authenticate header that will be
+	// sent with 401 Unauthorized responses.
+	Challenge() string
+	// Authenticate returns a credential of the request whose Authorization
+	// header has the scheme. Authenticate should return an unauthorized
+	// credential, not an error, if the request has an invalid credential.
+	Authenticate(req *http.Request) (backend.Credential, error)
+}
+
+// BasicAuth authenticates requests using the basic authentication scheme. If
+// Authenticator implements backend.DeviceAuthenticator, the DeviceId of the
+// request is passed to it to verify device-specific passwords.
+type BasicAuth struct {
+	Authenticator backend.Authenticator
+	// Realm is used in the challenge. Empty means ActiveSync.
+	Realm string
+}
+
+func (r *BasicAuth) Scheme() string {
+	return "Basic"
+}
+
+func (r *BasicAuth) Challenge() string {
+	return `Basic realm="` + realm(r.Realm) + `"`
+}
+
+func (r *BasicAuth) Authenticate(req *http.Request) (backend.Credential, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return backend.Unauthorized, nil
+	}
+	if v, ok := r.Authenticator.(backend.DeviceAuthenticator); ok {
+		return v.AuthDevice(username, password, req.URL.Query().Get("DeviceId"))
+	}
+
+	return r.Authenticator.Auth(username, password)
+}
+
+// TokenVerifier validates a bearer token and returns a credential of its owner.
+type TokenVerifier interface {
+	// Verify returns an unauthorized credential if token is not acceptable.
+	Verify(token string) (backend.Credential, error)
+}
+
+// BearerAuth authenticates requests using OAuth2 bearer tokens (RFC 6750).
+type BearerAuth struct {
+	Verifier TokenVerifier
+	// Realm is used in the challenge. Empty means ActiveSync.
+	Realm string
+}
+
+func (r *BearerAuth) Scheme() string {
+	return "Bearer"
+}
+
+func (r *BearerAuth) Challenge() string {
+	return `Bearer realm="` + realm(r.Realm) + `"`
+}
+
+func (r *BearerAuth) Authenticate(req *http.Request) (backend.Credential, error) {
+	_, token := parseAuthorization(req)
+	if len(token) == 0 {
+		return backend.Unauthorized, nil
+	}
+
+	return r.Verifier.Verify(token)
+}
+
+func realm(v string) string {
+	if len(v) == 0 {
+		return "ActiveSync"
+	}
+
+	return v
+}
+
+// parseAuthorization returns the scheme and the credentials of the Authorization header.
+func parseAuthorization(req *http.Request) (scheme, credentials string) {
+	v := strings.TrimSpace(req.Header.Get("Authorization"))
+	i := strings.IndexByte(v, ' ')
+	if i < 0 {
+		return v, ""
+	}
+
+	return v[:i], strings.TrimSpace(v[i+1:])
+}
+
+type ClientCertPolicy int
+
+const (
+	// Authenticate requests using the Authorization header only. Client
+	// certificates are not requested.
+	PolicyPasswordOnly ClientCertPolicy = iota
+	// Authenticate requests using client certificates only. The Authorization
+	// header is ignored.
+	PolicyCertOnly
+	// Authenticate requests using both of client certificates and the
+	// Authorization header, which should belong to the same user.
+	PolicyCertAndPassword
+)
+
+// CertificateAuthenticator maps a verified client certificate to a user.
+type CertificateAuthenticator interface {
+	// AuthCertificate returns an unauthorized credential if there is no user
+	// for the certificate.
+	AuthCertificate(cert *x509.Certificate) (backend.Credential, error)
+}
+
+// ClientCertConfig configures the mutual TLS authentication.
+type ClientCertConfig struct {
+	Policy ClientCertPolicy
+	// CAs are trusted to issue client certificates. It is mandatory unless
+	// Policy is PolicyPasswordOnly.
+	CAs           *x509.CertPool
+	Authenticator CertificateAuthenticator
+}
+
+func (r *Listener) auth(req *http.Request) (backend.Credential, error) {
+	switch r.config.ClientCert.Policy {
+	case PolicyCertOnly:
+		return r.authCert(req)
+	case PolicyCertAndPassword:
+		c, err := r.authCert(req)
+		if err != nil || !c.IsAuthorized() {
+			return c, err
+		}
+		p, err := r.authHeader(req)
+		if err != nil || !p.IsAuthorized() {
+			return p, err
+		}
+		if c.UserUID() != p.UserUID() {
+			logger.Warning(fmt.Sprintf("activesync: client certificate of %v is used with the password of %v", c.UserID(), p.UserID()))
+			return backend.Unauthorized, nil
+		}
+		return p, nil
+	default:
+		return r.authHeader(req)
+	}
+}
+
+// authCert returns a credential of the client certificate of req, which has
+// been verified by the TLS stack.
+func (r *Listener) authCert(req *http.Request) (backend.Credential, error) {
+	// Plain HTTP requests or TLS connections without certificates.
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return backend.Unauthorized, nil
+	}
+
+	return r.config.ClientCert.Authenticator.AuthCertificate(req.TLS.VerifiedChains[0][0])
+}
+
+// authHeader returns a credential of the Authorization header of req.
+func (r *Listener) authHeader(req *http.Request) (backend.Credential, error) {
+	scheme, _ := parseAuthorization(req)
+	for _, v := range r.config.Auth {
+		// The scheme is case-insensitive.
+		if strings.EqualFold(scheme, v.Scheme()) {
+			return v.Authenticate(req)
+		}
+	}
+
+	return backend.Unauthorized, nil
+}
+
+// challenge sets the WWW-Authenticate header fields of all the available schemes.
+func (r *Listener) challenge(w http.ResponseWriter) {
+	// Clients cannot do anything with the Authorization header.
+	if r.config.ClientCert.Policy == PolicyCertOnly {
+		return
+	}
+	for _, v := range r.config.Auth {
+		w.Header().Add("WWW-Authenticate", v.Challenge())
+	}
+}
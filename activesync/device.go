@@ -0,0 +1,206 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package activesync
+
+import (
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+)
+
+// DeviceStorage is an optional interface implemented by Storage that keeps the
+// security policies and the remote wipe requests of devices.
+//
+// NOTE: All methods of DeviceManager should return database.TransactionError if an error occurrs.
+type DeviceStorage interface {
+	NewDeviceManager(queryer database.Queryer) DeviceManager
+}
+
+type DeviceManager interface {
+	// GetDevices returns devices of a user whose UID is userUID, which have
+	// synchronization states. Zero userUID means all users. GetDevices does
+	// not acquire any lock, and it can return nil if there is no device.
+	GetDevices(userUID uint64) ([]Device, error)
+	// GetDeviceFolders returns the folders of a device that have been
+	// synchronized. GetDeviceFolders does not acquire any lock, and it can
+	// return nil if there is no folder.
+	GetDeviceFolders(userUID uint64, deviceID string) ([]DeviceFolder, error)
+
+	// GetPolicy returns the security policy of a user whose UID is userUID.
+	// Zero userUID means the default policy for users who have no policy.
+	// GetPolicy returns database.ErrNotFound if there is no policy. It is
+	// necessary to acquire a read or write lock depending on the lock mode
+	// for the policy to prevent any concurrent updates from another
+	// transaction.
+	GetPolicy(userUID uint64, lock database.LockMode) (Policy, error)
+	// SetPolicy sets the security policy of a user, which replaces the
+	// previous one if it exists.
+	SetPolicy(userUID uint64, policy Policy) error
+	// RemovePolicy removes the security policy of a user. RemovePolicy
+	// returns database.ErrNotFound if the user has no policy.
+	RemovePolicy(userUID uint64) error
+	// GetGroupPolicy returns the security policy of a group whose name is
+	// group. GetGroupPolicy returns database.ErrNotFound if there is no
+	// policy. It is necessary to acquire a read or write lock depending on
+	// the lock mode for the policy to prevent any concurrent updates from
+	// another transaction.
+	GetGroupPolicy(group string, lock database.LockMode) (Policy, error)
+	// SetGroupPolicy sets the security policy of a group, which replaces the
+	// previous one if it exists.
+	SetGroupPolicy(group string, policy Policy) error
+	// RemoveGroupPolicy removes the security policy of a group.
+	// RemoveGroupPolicy returns database.ErrNotFound if the group has no
+	// policy.
+	RemoveGroupPolicy(group string) error
+
+	// GetWipes returns the remote wipe requests of a user whose UID is
+	// userUID. Zero userUID means all users. GetWipes can return nil if there
+	// is no request.
+	GetWipes(userUID uint64, lock database.LockMode) ([]Wipe, error)
+	// GetWipe returns the remote wipe request of a device. GetWipe returns
+	// database.ErrNotFound if there is no request. It is necessary to acquire
+	// a read or write lock depending on the lock mode for the request to
+	// prevent any concurrent updates from another transaction.
+	GetWipe(userUID uint64, deviceID string, lock database.LockMode) (Wipe, error)
+	// RequestWipe adds a pending remote wipe request of a device, which
+	// replaces the previous one if it exists.
+	RequestWipe(userUID uint64, deviceID string) error
+	// AcknowledgeWipe marks the remote wipe request of a device as wiped.
+	// AcknowledgeWipe returns database.ErrNotFound if there is no request.
+	AcknowledgeWipe(userUID uint64, deviceID string) error
+	// RemoveWipe removes the remote wipe request of a device. RemoveWipe
+	// returns database.ErrNotFound if there is no request.
+	RemoveWipe(userUID uint64, deviceID string) error
+}
+
+type Device struct {
+	UserUID  uint64
+	DeviceID string
+	// LastSync is the last time when the device was issued a sync key.
+	LastSync time.Time
+}
+
+// DeviceFolder is a folder that a device has synchronized. Name, ParentID, and
+// LastHistoryID are empty if the folder hierarchy of the device does not have
+// the folder.
+type DeviceFolder struct {
+	ID            uint64
+	Name          string
+	ParentID      uint64
+	LastHistoryID uint64
+	// SyncKey is the last email sync key issued for the folder. Zero means
+	// the emails have not been synchronized.
+	SyncKey uint64
+	// Emails is the number of emails that the device has.
+	Emails uint64
+}
+
+// Policy is a security policy that devices are required to enforce.
+type Policy struct {
+	PasswordRequired  bool
+	MinPasswordLength uint
+	// AlphanumericPassword requires passwords to have both letters and digits.
+	AlphanumericPassword bool
+	// InactivityTimeout is the idle duration before devices are locked. Zero
+	// disables it.
+	InactivityTimeout time.Duration
+	// MaxFailedAttempts is the number of failed unlock attempts before
+	// devices wipe themselves. Zero disables it.
+	MaxFailedAttempts uint
+}
+
+// DefaultPolicy is applied to users if neither they, their groups, nor the
+// default policy of the storage has a policy.
+var DefaultPolicy = Policy{
+	MinPasswordLength: 1,
+	MaxFailedAttempts: 16,
+}
+
+// PolicySource is where an effective policy comes from.
+type PolicySource int
+
+const (
+	PolicyUser PolicySource = iota
+	PolicyGroup
+	PolicyDefault
+	PolicyBuiltIn
+)
+
+// GetEffectivePolicy returns the policy of the user of c, the policy of the
+// first group of the user that has one if c is a backend.GroupCredential, the
+// default policy of m, or DefaultPolicy in order of precedence. group is the
+// name of the group if source is PolicyGroup.
+func GetEffectivePolicy(m DeviceManager, c backend.Credential, lock database.LockMode) (policy Policy, source PolicySource, group string, err error) {
+	policy, err = m.GetPolicy(c.UserUID(), lock)
+	if !isNotFound(err) {
+		return policy, PolicyUser, "", err
+	}
+	if gc, ok := c.(backend.GroupCredential); ok {
+		for _, v := range gc.Groups() {
+			policy, err = m.GetGroupPolicy(v, lock)
+			if !isNotFound(err) {
+				return policy, PolicyGroup, v, err
+			}
+		}
+	}
+	policy, err = m.GetPolicy(0, lock)
+	if !isNotFound(err) {
+		return policy, PolicyDefault, "", err
+	}
+
+	return DefaultPolicy, PolicyBuiltIn, "", nil
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(database.NotFoundError)
+	return ok && e.IsNotFound()
+}
+
+type WipeStatus int
+
+const (
+	// WipePending means that the device will be wiped on its next request.
+	WipePending WipeStatus = iota
+	// WipeDone means that the device has acknowledged the request.
+	WipeDone
+)
+
+func (r WipeStatus) String() string {
+	switch r {
+	case WipePending:
+		return "pending"
+	case WipeDone:
+		return "wiped"
+	default:
+		return "unknown"
+	}
+}
+
+// Wipe is a remote wipe request of a device.
+type Wipe struct {
+	UserUID   uint64
+	DeviceID  string
+	Status    WipeStatus
+	Requested time.Time
+	// Acknowledged is zero if the device has not acknowledged the request.
+	Acknowledged time.Time
+}
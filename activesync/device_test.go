@@ -0,0 +1,113 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+package activesync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/superkkt/omega/database"
+)
+
+// groupCredential is a testCredential that knows the user's groups.
+type groupCredential struct {
+	testCredential
+	groups []string
+}
+
+func (r groupCredential) Groups() []string { return r.groups }
+
+type notFoundError struct{}
+
+func (r notFoundError) Error() string    { return "not found" }
+func (r notFoundError) IsNotFound() bool { return true }
+
+// testDeviceManager only implements the policy methods of DeviceManager.
+type testDeviceManager struct {
+	DeviceManager
+	users  map[uint64]Policy
+	groups map[string]Policy
+	err    error
+}
+
+func (r *testDeviceManager) GetPolicy(userUID uint64, lock database.LockMode) (Policy, error) {
+	if r.err != nil {
+		return Policy{}, r.err
+	}
+	p, ok := r.users[userUID]
+	if !ok {
+		return Policy{}, notFoundError{}
+	}
+	return p, nil
+}
+
+func (r *testDeviceManager) GetGroupPolicy(group string, lock database.LockMode) (Policy, error) {
+	p, ok := r.groups[group]
+	if !ok {
+		return Policy{}, notFoundError{}
+	}
+	return p, nil
+}
+
+func TestGetEffectivePolicy(t *testing.T) {
+	user := Policy{MinPasswordLength: 8}
+	staff := Policy{MinPasswordLength: 6}
+	admins := Policy{MinPasswordLength: 12}
+	def := Policy{MinPasswordLength: 4}
+	alice := groupCredential{testCredential{userID: "alice"}, []string{"users", "staff", "admins"}}
+
+	tests := []struct {
+		name   string
+		c      groupCredential
+		users  map[uint64]Policy
+		groups map[string]Policy
+		policy Policy
+		source PolicySource
+		group  string
+	}{
+		{"user", alice, map[uint64]Policy{1: user, 0: def}, map[string]Policy{"staff": staff}, user, PolicyUser, ""},
+		// The first group of the user that has a policy wins.
+		{"group", alice, map[uint64]Policy{0: def}, map[string]Policy{"staff": staff, "admins": admins}, staff, PolicyGroup, "staff"},
+		{"default", alice, map[uint64]Policy{0: def}, map[string]Policy{"others": staff}, def, PolicyDefault, ""},
+		{"no groups", groupCredential{testCredential: testCredential{userID: "bob"}}, map[uint64]Policy{0: def}, map[string]Policy{"staff": staff}, def, PolicyDefault, ""},
+		{"builtin", alice, nil, nil, DefaultPolicy, PolicyBuiltIn, ""},
+	}
+	for _, test := range tests {
+		m := &testDeviceManager{users: test.users, groups: test.groups}
+		policy, source, group, err := GetEffectivePolicy(m, test.c, database.LockNone)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.name, err)
+		}
+		if policy != test.policy || source != test.source || group != test.group {
+			t.Errorf("%v: expected %+v from %v %q, got %+v from %v %q", test.name, test.policy, test.source, test.group, policy, source, group)
+		}
+	}
+
+	// Credentials that do not know the groups skip the group policies.
+	m := &testDeviceManager{users: map[uint64]Policy{0: def}, groups: map[string]Policy{"staff": staff}}
+	if policy, source, _, err := GetEffectivePolicy(m, testCredential{userID: "carol"}, database.LockNone); err != nil || policy != def || source != PolicyDefault {
+		t.Errorf("expected the default policy, got %+v from %v: %v", policy, source, err)
+	}
+
+	m = &testDeviceManager{err: errors.New("connection lost")}
+	if _, _, _, err := GetEffectivePolicy(m, alice, database.LockNone); err != m.err {
+		t.Errorf("expected the storage error, got %v", err)
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/superkkt/omega/activesync"
 	"github.com/superkkt/omega/backend"
 	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/scanner"
 
 	"github.com/superkkt/logger"
 )
@@ -48,9 +49,14 @@ func (r *handler) handleFolderSync(tx database.Transaction) error {
 
 	fs := r.param.ASStorage.NewFolderSync(tx, r.credential.UserUID(), getDeviceID(r.req))
 	manager := r.param.BackendStorage.NewFolderManager(tx, r.credential)
+	// Create the Junk folder in advance so that users can report spam by moving
+	// emails into it. The new folder is synced in this request.
+	if _, err := scanner.GetJunkFolder(manager); err != nil {
+		return fmt.Errorf("failed to get the junk folder: %v", err)
+	}
 
-	var err error
 	var response FolderSyncResp
+	var err error
 	if reqBody.SyncKey == 0 {
 		response, err = r.initialFolderSync(fs, manager)
 	} else {
@@ -178,7 +184,8 @@ func getASFolderType(f backend.Folder) int {
 		return 5
 	case backend.EmailOutbox:
 		return 6
-	case backend.EmailFolder:
+	// ActiveSync has no type for the Junk folder.
+	case backend.EmailFolder, backend.EmailJunk:
 		return 12
 	default:
 		return 1 // User-created folder (generic)
@@ -33,6 +33,7 @@ import (
 	"github.com/superkkt/omega/database"
 
 	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -67,14 +68,19 @@ func (r *randomSource) Seed(seed int64) {
 }
 
 type handler struct {
+	ctx        context.Context
 	param      activesync.Parameter
 	credential backend.Credential
 	req        *http.Request
 	resp       *activesync.ResponseWriter
 	badRequest bool // A client sent a bad request?
+	// committed is called in order after the transaction of the request has
+	// been committed, e.g., to start a slow job that needs the committed data.
+	committed []func()
 }
 
-func (r *handler) Handle(c backend.Credential, w http.ResponseWriter, req *http.Request) {
+func (r *handler) Handle(ctx context.Context, c backend.Credential, w http.ResponseWriter, req *http.Request) {
+	r.ctx = ctx
 	r.credential = c
 	r.req = req
 	r.resp = activesync.NewResponseWriter(w)
@@ -90,8 +96,9 @@ func (r *handler) Handle(c backend.Credential, w http.ResponseWriter, req *http.
 
 	deadlockRetries := 0
 	for {
-		// Clear the buffered response to avoid duplication.
+		// Clear the buffered response and the jobs of the previous attempt to avoid duplication.
 		r.resp.Clear()
+		r.committed = nil
 		tx, err := r.newTransaction()
 		if err != nil {
 			logger.Error(fmt.Sprintf("Failed to create a DB transaction: %v", err))
@@ -110,6 +117,11 @@ func (r *handler) Handle(c backend.Credential, w http.ResponseWriter, req *http.
 			return
 		}
 		// We got an error!
+		if r.ctx.Err() != nil {
+			// The client went away or the server is shutting down. Nobody will receive the response.
+			logger.Info(fmt.Sprintf("Canceled the %v request from %v: %v", cmd, r.req.RemoteAddr, err))
+			return
+		}
 		txErr := tx.Error()
 		// Too many deadlocks or non-deadlock error?
 		if txErr == nil || !txErr.IsDeadlock() || deadlockRetries >= maxDeadlockRetries {
@@ -123,7 +135,10 @@ func (r *handler) Handle(c backend.Credential, w http.ResponseWriter, req *http.
 		}
 
 		// A deadlock occurrs, but we still have a retry chance.
-		time.Sleep(time.Duration(random.Int31n(500)) * time.Millisecond)
+		if !sleep(r.ctx, time.Duration(random.Int31n(500))*time.Millisecond) {
+			logger.Info(fmt.Sprintf("Canceled the %v request from %v while waiting for a deadlock retry", cmd, r.req.RemoteAddr))
+			return
+		}
 		deadlockRetries++
 		logger.Error(fmt.Sprintf("DB deadlock occurrs: deadlockRetries=%v", deadlockRetries))
 	}
@@ -135,10 +150,23 @@ func (r *handler) Handle(c backend.Credential, w http.ResponseWriter, req *http.
 func (r *handler) handle(tx database.Transaction, cmd string) error {
 	defer tx.Rollback()
 
+	if strings.ToUpper(cmd) != "PROVISION" {
+		ok, err := r.checkProvision(tx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			logger.Debug(fmt.Sprintf("Device should be provisioned: UserUID=%v, DeviceID=%v", r.credential.UserUID(), getDeviceID(r.req)))
+			// 449 Retry With asks the device to send the Provision command first.
+			r.resp.WriteHeader(449)
+			return nil
+		}
+	}
+
 	var err error
 	switch strings.ToUpper(cmd) {
 	case "PROVISION":
-		err = r.handleProvision()
+		err = r.handleProvision(tx)
 	case "FOLDERSYNC":
 		err = r.handleFolderSync(tx)
 	case "FOLDERCREATE":
@@ -173,8 +201,14 @@ func (r *handler) handle(tx database.Transaction, cmd string) error {
 	if err != nil {
 		return err
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, f := range r.committed {
+		f()
+	}
 
-	return tx.Commit()
+	return nil
 }
 
 func getDeviceID(req *http.Request) string {
@@ -187,8 +221,22 @@ func getDeviceID(req *http.Request) string {
 	return id
 }
 
+// sleep pauses the current goroutine for at least the duration d. It returns
+// false if ctx is canceled before the duration elapses.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func (r *handler) newTransaction() (database.Transaction, error) {
-	tx := r.param.Transaction.NewTransaction()
+	tx := r.param.Transaction.NewTransaction(r.ctx)
 	if err := tx.Begin(); err != nil {
 		return nil, err
 	}
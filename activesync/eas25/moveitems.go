@@ -27,6 +27,7 @@ import (
 	"github.com/superkkt/omega/activesync"
 	"github.com/superkkt/omega/backend"
 	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/scanner"
 
 	"github.com/superkkt/logger"
 )
@@ -82,6 +83,7 @@ func (r *handler) moveItems(tx database.Transaction, items []MoveItem) error {
 		NS: "Move:",
 	}
 	fm := r.param.BackendStorage.NewFolderManager(tx, r.credential)
+	samples := []trainingSample{}
 	for _, v := range items {
 		// Validate folder IDs
 		if v.SrcFldId == v.DstFldId {
@@ -90,7 +92,7 @@ func (r *handler) moveItems(tx database.Transaction, items []MoveItem) error {
 			continue
 		}
 		// Check the source folder
-		ok, err := r.isExistFolder(fm, v.SrcFldId)
+		src, ok, err := r.getExistFolder(fm, v.SrcFldId)
 		if err != nil {
 			return err
 		}
@@ -100,7 +102,7 @@ func (r *handler) moveItems(tx database.Transaction, items []MoveItem) error {
 			continue
 		}
 		// Check the destination folder
-		ok, err = r.isExistFolder(fm, v.DstFldId)
+		dst, ok, err := r.getExistFolder(fm, v.DstFldId)
 		if err != nil {
 			return err
 		}
@@ -128,6 +130,14 @@ func (r *handler) moveItems(tx database.Transaction, items []MoveItem) error {
 			continue
 		}
 
+		if spam, ok := getTrainingClass(src, dst); ok && r.param.Scanner.Trainer != nil {
+			raw, err := r.getRawEmail(tx, v.DstFldId, newMsgID)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, trainingSample{raw: raw, spam: spam})
+		}
+
 		// Success
 		dstMsgID := fmt.Sprintf("%v:%v", v.DstFldId, newMsgID)
 		resp.Response = append(resp.Response, Response{SrcMsgId: v.SrcMsgId, Status: 3, DstMsgId: dstMsgID})
@@ -138,20 +148,56 @@ func (r *handler) moveItems(tx database.Transaction, items []MoveItem) error {
 		return err
 	}
 	r.resp.Write(output)
+	// Training can be slow, so it should not delay the response. Start it
+	// only after the moves have been committed because the transaction can
+	// be rolled back and retried on a deadlock.
+	if len(samples) > 0 {
+		trainer, userID := r.param.Scanner.Trainer, r.credential.UserID()
+		r.committed = append(r.committed, func() { go train(trainer, userID, samples) })
+	}
 
 	return nil
 }
 
-func (r *handler) isExistFolder(manager backend.FolderManager, folderID uint64) (ok bool, err error) {
+func (r *handler) getExistFolder(manager backend.FolderManager, folderID uint64) (folder backend.Folder, ok bool, err error) {
 	// Use the read lock to preserve the folder until the move is finished.
-	_, err = manager.GetFolderByID(folderID, database.LockRead)
+	folder, err = manager.GetFolderByID(folderID, database.LockRead)
 	if err != nil {
 		if !isNotFound(err) {
-			return false, err
+			return backend.Folder{}, false, err
 		}
 		// Not found
-		return false, nil
+		return backend.Folder{}, false, nil
 	}
 
-	return true, nil
+	return folder, true, nil
+}
+
+type trainingSample struct {
+	raw  []byte
+	spam bool
+}
+
+// getTrainingClass returns whether an email moved from src to dst has been
+// reported as spam or ham. ok is false if the move is not a report, e.g.,
+// deleting a junk email by moving it into the Trash folder.
+func getTrainingClass(src, dst backend.Folder) (spam bool, ok bool) {
+	switch {
+	case dst.Type == backend.EmailJunk && src.Type != backend.EmailJunk:
+		return true, true
+	case src.Type == backend.EmailJunk && dst.Type != backend.EmailJunk && dst.Type != backend.EmailTrash:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func train(t scanner.Trainer, userID string, samples []trainingSample) {
+	for _, v := range samples {
+		if err := t.Train(v.raw, v.spam); err != nil {
+			logger.Error(fmt.Sprintf("Failed to train the content scanner: user=%v, spam=%v, err=%v", userID, v.spam, err))
+			continue
+		}
+		logger.Debug(fmt.Sprintf("Trained the content scanner: user=%v, spam=%v", userID, v.spam))
+	}
 }
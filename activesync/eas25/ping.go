@@ -189,7 +189,19 @@ again:
 		gap = time.Duration(pollInterval) * time.Second
 	}
 	logger.Debug(fmt.Sprintf("Sleeping for %v..", gap))
-	time.Sleep(gap)
+	timer := time.NewTimer(gap)
+	select {
+	case <-timer.C:
+	case <-activesync.DrainNotify(r.ctx):
+		timer.Stop()
+		logger.Debug("Finishing the Ping early because the server is shutting down")
+		// Pretend that no changes during the Ping period so that the client reconnects to another node.
+		return PingResp{Status: 1}, nil
+	case <-r.ctx.Done():
+		timer.Stop()
+		// The client went away or the server is aborting in-flight requests.
+		return PingResp{}, fmt.Errorf("ping canceled: %v", r.ctx.Err())
+	}
 
 	// Restart the transaction to see new DB records.
 	if err := restartTx(tx); err != nil {
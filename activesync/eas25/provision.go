@@ -23,19 +23,37 @@ package eas25
 import (
 	"encoding/xml"
 	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/database"
 
 	"github.com/superkkt/logger"
 )
 
-// Initial provision response that does not require any security policy
-var initResponse = `<Provision xmlns="Provision:"><Policies><Policy><PolicyType>MS-WAP-Provisioning-XML</PolicyType><Status>1</Status><Data>&lt;wap-provisioningdoc&gt;&lt;characteristic type="SecurityPolicy"&gt;&lt;parm name="4131" value="1"/&gt;&lt;/characteristic&gt;&lt;characteristic type="Registry"&gt;&lt;characteristic type="HKLM\Comm\Security\Policy\LASSD\AE\{50C13377-C66D-400C-889E-C316FC4AB374}"&gt;&lt;parm name="AEFrequencyType" value="0"/&gt;&lt;parm name="AEFrequencyValue" value="0"/&gt;&lt;/characteristic&gt;&lt;characteristic type="HKLM\Comm\Security\Policy\LASSD"&gt;&lt;parm name="DeviceWipeThreshold" value="16"/&gt;&lt;parm name="CodewordFrequency" value="-1"/&gt;&lt;/characteristic&gt;&lt;characteristic type="HKLM\Comm\Security\Policy\LASSD\LAP\lap_pw"&gt;&lt;parm name="MinimumPasswordLength" value="1"/&gt;&lt;parm name="PasswordComplexity" value="2"/&gt;&lt;/characteristic&gt;&lt;/characteristic&gt;&lt;/wap-provisioningdoc&gt;</Data><PolicyKey>1</PolicyKey></Policy></Policies></Provision>`
+const (
+	// temporaryPolicyKey is given to devices until they acknowledge the policy.
+	temporaryPolicyKey = 1
+)
+
+// Initial provision response that has the security policy to be acknowledged
+var initResponse = `<Provision xmlns="Provision:"><Policies><Policy><PolicyType>MS-WAP-Provisioning-XML</PolicyType><Status>1</Status><Data>%v</Data><PolicyKey>%v</PolicyKey></Policy></Policies></Provision>`
 
 // Second provision response that always succeed
-var secondResponse = `<Provision xmlns="Provision:"><Status>1</Status><Policies><Policy><PolicyType>MS-WAP-Provisioning-XML</PolicyType><Status>1</Status><PolicyKey>2</PolicyKey></Policy></Policies></Provision>`
+var secondResponse = `<Provision xmlns="Provision:"><Status>1</Status><Policies><Policy><PolicyType>MS-WAP-Provisioning-XML</PolicyType><Status>1</Status><PolicyKey>%v</PolicyKey></Policy></Policies></Provision>`
+
+// Provision response that requests the device to wipe itself
+var wipeResponse = `<Provision xmlns="Provision:"><Status>1</Status><RemoteWipe/></Provision>`
 
-func (r *handler) handleProvision() error {
+// Provision response to the acknowledgment of a remote wipe
+var wipeAckResponse = `<Provision xmlns="Provision:"><Status>1</Status></Provision>`
+
+var provisioningDoc = `<wap-provisioningdoc><characteristic type="SecurityPolicy"><parm name="4131" value="%v"/></characteristic><characteristic type="Registry"><characteristic type="HKLM\Comm\Security\Policy\LASSD\AE\{50C13377-C66D-400C-889E-C316FC4AB374}"><parm name="AEFrequencyType" value="%v"/><parm name="AEFrequencyValue" value="%v"/></characteristic><characteristic type="HKLM\Comm\Security\Policy\LASSD"><parm name="DeviceWipeThreshold" value="%v"/><parm name="CodewordFrequency" value="-1"/></characteristic><characteristic type="HKLM\Comm\Security\Policy\LASSD\LAP\lap_pw"><parm name="MinimumPasswordLength" value="%v"/><parm name="PasswordComplexity" value="%v"/></characteristic></characteristic></wap-provisioningdoc>`
+
+func (r *handler) handleProvision(tx database.Transaction) error {
 	// Provision response is given in WBXML encoding.
 	r.resp.SetWBXML(true)
 
@@ -48,6 +66,9 @@ func (r *handler) handleProvision() error {
 				Status     int
 			}
 		}
+		RemoteWipe *struct {
+			Status int
+		}
 	}{}
 
 	if err := activesync.ParseWBXMLRequest(r.req, &reqBody); err != nil {
@@ -56,20 +77,151 @@ func (r *handler) handleProvision() error {
 	}
 	logger.Debug(fmt.Sprintf("Provision request: %+v", reqBody))
 
+	devices := r.newDeviceManager(tx)
+	// Acknowledgment of a remote wipe?
+	if reqBody.RemoteWipe != nil {
+		if devices != nil {
+			if err := devices.AcknowledgeWipe(r.credential.UserUID(), getDeviceID(r.req)); err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+		logger.Info(fmt.Sprintf("Remote wipe acknowledged: UserUID=%v, DeviceID=%v, Status=%v", r.credential.UserUID(), getDeviceID(r.req), reqBody.RemoteWipe.Status))
+		r.resp.Write([]byte(wipeAckResponse))
+		return nil
+	}
+	wipe, err := r.isWipePending(devices)
+	if err != nil {
+		return err
+	}
+	if wipe {
+		logger.Info(fmt.Sprintf("Requesting a remote wipe: UserUID=%v, DeviceID=%v", r.credential.UserUID(), getDeviceID(r.req)))
+		r.resp.Write([]byte(wipeResponse))
+		return nil
+	}
+
 	// Validation
 	if reqBody.Policies.Policy.PolicyType != "MS-WAP-Provisioning-XML" {
 		r.badRequest = true
 		return fmt.Errorf("invalid Provision PolicyType: %v", reqBody.Policies.Policy.PolicyType)
 	}
 
+	doc, err := r.provisioningDoc(devices)
+	if err != nil {
+		return err
+	}
 	var xml string
 	// Initial request?
 	if reqBody.Policies.Policy.PolicyKey == "" {
-		xml = initResponse
+		xml = fmt.Sprintf(initResponse, escapeXML(doc), temporaryPolicyKey)
 	} else {
-		xml = secondResponse
+		xml = fmt.Sprintf(secondResponse, policyKey(doc))
 	}
 	r.resp.Write([]byte(xml))
 
 	return nil
 }
+
+// checkProvision returns false if the device should send the Provision command
+// before the others because it has a pending remote wipe request, or its policy
+// key is outdated. Devices that have never been provisioned are not checked.
+func (r *handler) checkProvision(tx database.Transaction) (ok bool, err error) {
+	devices := r.newDeviceManager(tx)
+	if devices == nil {
+		return true, nil
+	}
+	wipe, err := r.isWipePending(devices)
+	if err != nil {
+		return false, err
+	}
+	if wipe {
+		return false, nil
+	}
+
+	key := r.req.Header.Get("X-MS-PolicyKey")
+	if key == "" || key == "0" {
+		return true, nil
+	}
+	doc, err := r.provisioningDoc(devices)
+	if err != nil {
+		return false, err
+	}
+
+	return key == strconv.FormatUint(uint64(policyKey(doc)), 10), nil
+}
+
+// newDeviceManager returns nil if the storage does not keep policies and remote
+// wipe requests.
+func (r *handler) newDeviceManager(tx database.Transaction) activesync.DeviceManager {
+	s, ok := r.param.ASStorage.(activesync.DeviceStorage)
+	if !ok {
+		return nil
+	}
+
+	return s.NewDeviceManager(tx)
+}
+
+func (r *handler) isWipePending(devices activesync.DeviceManager) (bool, error) {
+	if devices == nil {
+		return false, nil
+	}
+	wipe, err := devices.GetWipe(r.credential.UserUID(), getDeviceID(r.req), database.LockNone)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return wipe.Status == activesync.WipePending, nil
+}
+
+// provisioningDoc returns the MS-WAP-Provisioning-XML document of the security
+// policy of the user.
+func (r *handler) provisioningDoc(devices activesync.DeviceManager) (string, error) {
+	policy := activesync.DefaultPolicy
+	if devices != nil {
+		var err error
+		policy, _, _, err = activesync.GetEffectivePolicy(devices, r.credential, database.LockNone)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// 4131 is whether the password is NOT required.
+	passwordNotRequired := 1
+	if policy.PasswordRequired {
+		passwordNotRequired = 0
+	}
+	// AEFrequencyValue is the inactivity timeout in minutes.
+	timeoutEnabled, timeout := 0, 0
+	if policy.InactivityTimeout > 0 {
+		timeoutEnabled = 1
+		timeout = int((policy.InactivityTimeout + time.Minute - 1) / time.Minute)
+	}
+	wipeThreshold := -1
+	if policy.MaxFailedAttempts > 0 {
+		wipeThreshold = int(policy.MaxFailedAttempts)
+	}
+	// PasswordComplexity 0 requires alphanumeric passwords, and 2 allows simple PINs.
+	complexity := 2
+	if policy.AlphanumericPassword {
+		complexity = 0
+	}
+
+	return fmt.Sprintf(provisioningDoc, passwordNotRequired, timeoutEnabled, timeout, wipeThreshold, policy.MinPasswordLength, complexity), nil
+}
+
+// policyKey returns the key of a provisioning document, which changes whenever
+// the policy changes so that devices are provisioned again.
+func policyKey(doc string) uint32 {
+	key := crc32.ChecksumIEEE([]byte(doc))
+	if key <= temporaryPolicyKey {
+		key += temporaryPolicyKey + 1
+	}
+
+	return key
+}
+
+func escapeXML(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
@@ -0,0 +1,72 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package eas25
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/scanner"
+
+	"github.com/superkkt/logger"
+)
+
+// scanOutgoing inspects an outgoing email, and returns whether it should be
+// queued. A rejected email is responded with 403 Forbidden. A quarantined
+// email is held without being sent, but the request succeeds so that the
+// client does not retry it. Spam is only logged because the user can be a
+// victim of false positives.
+func (r *handler) scanOutgoing(tx database.Transaction, from string, to []string, msg []byte) (send bool, err error) {
+	if r.param.Scanner.Scanner == nil {
+		return true, nil
+	}
+
+	result, err := r.param.Scanner.Scanner.Scan(msg)
+	if err != nil {
+		return false, fmt.Errorf("failed to scan an outgoing email: %v", err)
+	}
+	switch result.Verdict {
+	case scanner.VerdictAccept:
+		return true, nil
+	case scanner.VerdictJunk:
+		logger.Warning(fmt.Sprintf("Sending an email judged as spam: user=%v, reason=%v", r.credential.UserID(), result.Reason))
+		return true, nil
+	case scanner.VerdictQuarantine:
+		id, err := r.param.Scanner.Quarantine.NewQuarantine(tx).AddMessage(scanner.QuarantinedMessage{
+			UserUID:   r.credential.UserUID(),
+			Direction: scanner.Outbound,
+			From:      from,
+			To:        to,
+			Reason:    result.Reason,
+			Raw:       msg,
+		})
+		if err != nil {
+			return false, err
+		}
+		logger.Info(fmt.Sprintf("Quarantined an outgoing email: id=%v, user=%v, reason=%v", id, r.credential.UserID(), result.Reason))
+		return false, nil
+	default:
+		logger.Info(fmt.Sprintf("Rejected an outgoing email by the content scanner: user=%v, reason=%v", r.credential.UserID(), result.Reason))
+		r.resp.WriteHeader(http.StatusForbidden)
+		return false, nil
+	}
+}
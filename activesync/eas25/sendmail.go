@@ -21,13 +21,12 @@
 package eas25
 
 import (
-	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"strings"
 	"time"
 
-	"github.com/superkkt/omega/backend"
 	"github.com/superkkt/omega/database"
 
 	"github.com/superkkt/logger"
@@ -48,16 +47,21 @@ func (r *handler) handleSendMail(tx database.Transaction) error {
 	}
 	logger.Debug(fmt.Sprintf("Sendmail request: %+v", req))
 
-	if req.saveInSent {
-		email, err := r.saveSentEmail(tx, req.body.norm)
-		if err != nil {
-			return err
-		}
-		logger.Debug(fmt.Sprintf("Stored a new sent email: ID=%v", email.ID))
+	from, msg, ok, err := r.param.Sender.Check(r.credential, req.body.parsed.header, req.body.norm)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		r.resp.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	send, err := r.scanOutgoing(tx, from, req.body.rcpts, msg)
+	if err != nil || !send {
+		return err
 	}
 
-	logger.Debug("Sending an outgoing email..")
-	return r.param.Mailer.Send(r.credential.UserID(), req.body.rcpts, req.body.norm)
+	logger.Debug("Queueing an outgoing email..")
+	return r.param.Outbox.Enqueue(tx, r.credential, from, req.body.rcpts, msg, req.saveInSent)
 }
 
 type sendmailReq struct {
@@ -98,25 +102,3 @@ func (r *handler) parseSendmailRequest() (sendmailReq, error) {
 
 	return out, nil
 }
-
-func (r *handler) saveSentEmail(tx database.Transaction, msg []byte) (*backend.Email, error) {
-	fm := r.param.BackendStorage.NewFolderManager(tx, r.credential)
-	sent, err := fm.GetFolderByType(backend.EmailSent, database.LockRead)
-	if err != nil {
-		return nil, err
-	}
-	if len(sent) == 0 {
-		return nil, errors.New("not found a sent item folder")
-	}
-
-	em := r.param.BackendStorage.NewEmailManager(tx, r.credential, sent[0].ID)
-	email, err := em.AddEmail(msg)
-	if err != nil {
-		return nil, fmt.Errorf("AddEmail: %v", err)
-	}
-	if err := em.UpdateEmail(email.ID, true); err != nil {
-		return nil, fmt.Errorf("UpdateEmail: %v", err)
-	}
-
-	return email, nil
-}
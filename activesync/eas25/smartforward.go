@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
+	"net/http"
 	"net/mail"
 	"net/textproto"
 	"strconv"
@@ -120,21 +121,20 @@ func (r *handler) forward(tx database.Transaction, req smartForwardReq) error {
 	mime := []byte(fmt.Sprintf("%v\r\n%v", newHeader(req.body.parsed.header, w.Boundary()), buf.String()))
 	logger.Debug(fmt.Sprintf("Reconstructed a new MIME message for SmartForward: size=%v", len(mime)))
 
-	if err := r.param.Mailer.Send(r.credential.UserID(), req.body.rcpts, mime); err != nil {
+	from, msg, ok, err := r.param.Sender.Check(r.credential, req.body.parsed.header, mime)
+	if err != nil {
 		return err
 	}
-
-	// Do we need to save the send email into the "Sent Messages" folder?
-	if !req.saveInSent {
+	if !ok {
+		r.resp.WriteHeader(http.StatusForbidden)
 		return nil
 	}
-	email, err := r.saveSentEmail(tx, mime)
-	if err != nil {
+	send, err := r.scanOutgoing(tx, from, req.body.rcpts, msg)
+	if err != nil || !send {
 		return err
 	}
-	logger.Debug(fmt.Sprintf("Stored a new SmartForward email: ID=%v", email.ID))
 
-	return nil
+	return r.param.Outbox.Enqueue(tx, r.credential, from, req.body.rcpts, msg, req.saveInSent)
 }
 
 func (r *handler) getRawEmail(tx database.Transaction, folderID uint64, emailID uint64) ([]byte, error) {
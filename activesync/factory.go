@@ -28,6 +28,8 @@ import (
 
 	"github.com/superkkt/omega/backend"
 	"github.com/superkkt/omega/database"
+
+	"golang.org/x/net/context"
 )
 
 var (
@@ -47,15 +49,26 @@ type Parameter struct {
 	ASStorage      Storage
 	BackendStorage backend.Storage
 	Transaction    database.TransactionManager
-	Mailer         Mailer
+	Outbox         Outbox
+	Sender         SenderConfig
+	Scanner        ScannerConfig
 }
 
-type Mailer interface {
-	Send(from string, to []string, msg []byte) error
+// Outbox queues outgoing emails, which will be sent out in the background.
+type Outbox interface {
+	// Enqueue stores msg of the user identified by c into the queue using
+	// queryer, so the email is queued only if the transaction is committed.
+	// The email will be moved to the Sent folder after it has been sent out
+	// if saveInSent is true.
+	Enqueue(queryer database.Queryer, c backend.Credential, from string, to []string, msg []byte, saveInSent bool) error
 }
 
 type Handler interface {
-	Handle(c backend.Credential, w http.ResponseWriter, req *http.Request)
+	// Handle processes an ActiveSync request. Handle should stop processing
+	// and release all resources related with the request as soon as ctx is
+	// canceled, which happens when the client goes away or the server shuts
+	// down.
+	Handle(ctx context.Context, c backend.Credential, w http.ResponseWriter, req *http.Request)
 }
 
 type factoryMap map[string]Factory
@@ -21,9 +21,12 @@ package activesync
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/superkkt/omega/backend"
 
@@ -31,15 +34,34 @@ import (
 	"golang.org/x/net/context"
 )
 
+const (
+	defaultDrainTimeout = 30 * time.Second
+)
+
 type Listener struct {
-	config Config
+	config   Config
+	throttle *Throttle
+	// abort will be canceled if in-flight requests are not finished within
+	// the drain timeout while the server is shutting down.
+	abort context.Context
+	// draining will be closed when the server starts shutting down.
+	draining chan struct{}
 }
 
 type Config struct {
 	Port      uint16
 	Cert      CertLoader
 	AllowHTTP bool
-	Param     Parameter
+	// DrainTimeout is the maximum duration to wait for in-flight requests to
+	// be finished while the server is shutting down. Zero means the default
+	// timeout, which is 30 seconds.
+	DrainTimeout time.Duration
+	// Auth is a list of authentication schemes that the listener accepts. Empty
+	// means the basic authentication scheme with Param.Authenticator.
+	Auth       []RequestAuthenticator
+	ClientCert ClientCertConfig
+	Throttle   ThrottleConfig
+	Param      Parameter
 }
 
 type CertLoader interface {
@@ -47,71 +69,139 @@ type CertLoader interface {
 }
 
 func NewListener(conf Config) *Listener {
+	if conf.DrainTimeout == 0 {
+		conf.DrainTimeout = defaultDrainTimeout
+	}
+	if len(conf.Auth) == 0 {
+		conf.Auth = []RequestAuthenticator{&BasicAuth{Authenticator: conf.Param.Authenticator}}
+	}
+
 	return &Listener{
-		config: conf,
+		config:   conf,
+		throttle: NewThrottle("activesync", conf.Throttle),
 	}
 }
 
-// TODO: Use ctx for graceful shutdown, but how can we use it with http.ListenAndServeTLS?
+// Run serves ActiveSync requests until ctx is canceled. On cancelation, Run stops
+// accepting new connections, asks pending Ping requests to respond immediately,
+// and then waits for in-flight requests to be finished up to the drain timeout.
+// Run returns nil if the server has been shut down by ctx.
 func (r *Listener) Run(ctx context.Context) error {
 	if len(factories) == 0 {
 		panic("empty factories")
 	}
+	if r.config.ClientCert.Policy != PolicyPasswordOnly {
+		if r.config.ClientCert.CAs == nil || r.config.ClientCert.Authenticator == nil {
+			return errors.New("client certificate authentication requires CAs and an authenticator")
+		}
+	}
+	abort, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.abort = abort
+	r.draining = make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Microsoft-Server-ActiveSync", r.dispatcher)
+	servers := make([]*http.Server, 0)
 
-	http.HandleFunc("/Microsoft-Server-ActiveSync", r.dispatcher)
 	// Allow non-secured HTTP connection for debugging purpose only
 	if r.config.AllowHTTP {
+		srv := &http.Server{
+			Addr:    ":http",
+			Handler: mux,
+		}
+		servers = append(servers, srv)
 		go func() {
-			if err := http.ListenAndServe(":http", nil); err != nil {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				logger.Error(fmt.Sprintf("Failed to listen on HTTP: %v", err))
 			}
 		}()
 	}
 	// TLS listener
 	srv := &http.Server{
-		Addr: fmt.Sprintf(":%v", r.config.Port),
+		Addr:    fmt.Sprintf(":%v", r.config.Port),
+		Handler: mux,
 		TLSConfig: &tls.Config{
 			GetCertificate: r.config.Cert.GetCertificate,
 		},
 	}
-	return srv.ListenAndServeTLS("", "")
-}
-
-func (r *Listener) auth(req *http.Request) (backend.Credential, error) {
-	username, password, ok := req.BasicAuth()
-	if !ok {
-		return unauthorized{}, nil
+	if r.config.ClientCert.Policy != PolicyPasswordOnly {
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		srv.TLSConfig.ClientCAs = r.config.ClientCert.CAs
 	}
+	servers = append(servers, srv)
+	c := make(chan error, 1)
+	go func() {
+		c <- srv.ListenAndServeTLS("", "")
+	}()
 
-	return r.config.Param.Authenticator.Auth(username, password)
+	select {
+	case err := <-c:
+		// The TLS listener has been failed before shutting down.
+		r.shutdown(servers, cancel)
+		return err
+	case <-ctx.Done():
+		r.shutdown(servers, cancel)
+		return nil
+	}
 }
 
-type unauthorized struct{}
+// shutdown gracefully shuts down servers. abort will be called to cancel in-flight
+// requests if they are not finished within the drain timeout.
+func (r *Listener) shutdown(servers []*http.Server, abort context.CancelFunc) {
+	logger.Info(fmt.Sprintf("activesync: draining in-flight requests (timeout=%v)..", r.config.DrainTimeout))
+	// Answer pending Ping requests early so that devices reconnect to another node.
+	close(r.draining)
 
-func (r unauthorized) IsAuthorized() bool {
-	return false
-}
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.DrainTimeout)
+	defer cancel()
 
-func (r unauthorized) UserID() string {
-	return ""
+	var wg sync.WaitGroup
+	for _, v := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Warning(fmt.Sprintf("activesync: failed to drain in-flight requests on %v: %v", srv.Addr, err))
+				// Cancel the remaining requests and close their connections.
+				abort()
+				srv.Close()
+			}
+		}(v)
+	}
+	wg.Wait()
+	logger.Info("activesync: the listener has been shut down")
 }
 
-func (r unauthorized) UserUID() uint64 {
-	return 0
+type drainingKey struct{}
+
+// DrainNotify returns a channel that is closed when the server starts shutting
+// down. Long-running requests, such as Ping, should finish as soon as possible
+// once the channel is closed. DrainNotify returns nil if ctx is not derived from
+// the Listener.
+func DrainNotify(ctx context.Context) <-chan struct{} {
+	c, _ := ctx.Value(drainingKey{}).(chan struct{})
+	return c
 }
 
 func (r *Listener) dispatcher(w http.ResponseWriter, req *http.Request) {
 	logger.Debug(fmt.Sprintf("Total number of goroutines = %v", runtime.NumGoroutine()))
 	logger.Debug(fmt.Sprintf("Client: %v, Method: %v, URL: %v, Header: %v", req.RemoteAddr, req.Method, req.URL, removeAuthInfo(req.Header)))
 
+	attempt := NewRequestAttempt(req)
+	if !r.throttle.CheckRequest(w, attempt) {
+		return
+	}
 	c, err := r.auth(req)
 	if err != nil {
 		logger.Error(fmt.Sprintf("activesync: failed to authorize a new request: %v", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	r.throttle.Update(attempt, c.IsAuthorized())
 	if c.IsAuthorized() == false {
-		logger.Info(fmt.Sprintf("Unauthorized: username=%v", c.UserID()))
+		logger.Warning(fmt.Sprintf("Unauthorized: username=%v, client=%v", c.UserID(), req.RemoteAddr))
+		r.challenge(w)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -181,6 +271,23 @@ func (r *Listener) dispatch(c backend.Credential, w http.ResponseWriter, req *ht
 		return
 	}
 	h := f.New(r.config.Param)
+	ctx, cancel := r.newRequestContext(req)
+	defer cancel()
 	// Process the request
-	h.Handle(c, w, req)
+	h.Handle(ctx, c, w, req)
+}
+
+// newRequestContext returns a new context that will be canceled when the client
+// goes away or in-flight requests are aborted during the server shutdown.
+func (r *Listener) newRequestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithValue(req.Context(), drainingKey{}, r.draining))
+	go func() {
+		select {
+		case <-r.abort.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
 }
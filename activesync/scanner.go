@@ -0,0 +1,36 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package activesync
+
+import (
+	"github.com/superkkt/omega/scanner"
+)
+
+type ScannerConfig struct {
+	// Scanner inspects outgoing emails before they are queued if it is not nil.
+	Scanner scanner.ContentScanner
+	// Quarantine holds emails that the scanner has quarantined, which is
+	// required with Scanner.
+	Quarantine scanner.Storage
+	// Trainer learns from emails moved into or out of the Junk folder if it is
+	// not nil.
+	Trainer scanner.Trainer
+}
@@ -0,0 +1,200 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package activesync
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+
+	"github.com/superkkt/logger"
+)
+
+// SenderPolicy decides what to do with an outgoing email whose From or Sender
+// header has an address that the user is not allowed to send as.
+type SenderPolicy int
+
+const (
+	// Reject the email.
+	SenderReject SenderPolicy = iota
+	// Replace the From header with the user's primary address, and remove the
+	// Sender header.
+	SenderRewrite
+	// Send the email as it is, which is only logged.
+	SenderAllow
+)
+
+// SendAsChecker checks rights delegated to users to send emails as addresses
+// of others, e.g., shared mailboxes.
+type SendAsChecker interface {
+	// CanSendAs returns whether the user whose UID is uid can send emails as address.
+	CanSendAs(uid uint64, address string) (bool, error)
+}
+
+type SenderConfig struct {
+	// Policy for emails from addresses other than the user's primary, alias,
+	// and delegated addresses. The zero value is SenderReject.
+	Policy SenderPolicy
+	// SendAs is an optional checker of delegated addresses.
+	SendAs SendAsChecker
+	// AllowUnverified lets emails of users whose addresses are unknown, e.g.,
+	// users of an authenticator that returns no email address, through without
+	// the sender validation. Otherwise, such emails are rejected regardless of
+	// Policy because there is no address to validate or rewrite the sender with.
+	AllowUnverified bool
+}
+
+// Check validates the From and Sender headers of an outgoing email of the user
+// identified by cred against the addresses that the user can send as, and
+// applies the sender policy to msg. Check returns the envelope sender and msg,
+// which can be rewritten. ok will be false if the email is rejected.
+func (r SenderConfig) Check(cred backend.Credential, header mail.Header, msg []byte) (from string, out []byte, ok bool, err error) {
+	c, isAddr := cred.(backend.AddressCredential)
+	if !isAddr || len(c.Address()) == 0 {
+		if !r.AllowUnverified {
+			logger.Warning(fmt.Sprintf("Rejected an email without the sender validation: the credential of %v has no email address", cred.UserID()))
+			return "", nil, false, nil
+		}
+		logger.Warning(fmt.Sprintf("Sending an email without the sender validation: the credential of %v has no email address", cred.UserID()))
+		return cred.UserID(), msg, true, nil
+	}
+	own := append([]string{c.Address()}, c.Aliases()...)
+
+	// Envelope sender is the From address if it is one of the user's own
+	// addresses for the alignment with SPF and DMARC, or the primary address.
+	from = c.Address()
+	var invalid []string
+	fromList, fromErr := header.AddressList("From")
+	if fromErr != nil {
+		invalid = append(invalid, fmt.Sprintf("From: %q", strings.TrimSpace(header.Get("From"))))
+	}
+	for i, v := range fromList {
+		if i == 0 && hasAddress(own, v.Address) {
+			from = v.Address
+		}
+		ok, err := r.canSendAs(c, own, v.Address)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if !ok {
+			invalid = append(invalid, v.Address)
+		}
+	}
+	if len(header.Get("Sender")) > 0 {
+		sender, err := mail.ParseAddress(header.Get("Sender"))
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("Sender: %q", strings.TrimSpace(header.Get("Sender"))))
+		} else {
+			ok, err := r.canSendAs(c, own, sender.Address)
+			if err != nil {
+				return "", nil, false, err
+			}
+			if !ok {
+				invalid = append(invalid, sender.Address)
+			}
+		}
+	}
+	if len(invalid) == 0 {
+		return from, msg, true, nil
+	}
+
+	switch r.Policy {
+	case SenderAllow:
+		logger.Info(fmt.Sprintf("Allowed an email from unauthorized sender addresses: user=%v, addresses=%v", c.UserID(), invalid))
+		return from, msg, true, nil
+	case SenderRewrite:
+		logger.Info(fmt.Sprintf("Rewriting unauthorized sender addresses: user=%v, addresses=%v", c.UserID(), invalid))
+		addr := &mail.Address{Address: c.Address()}
+		// Keep the display name.
+		if len(fromList) > 0 {
+			addr.Name = fromList[0].Name
+		}
+		out = setHeader(msg, "From", addr.String())
+		out = setHeader(out, "Sender", "")
+		return c.Address(), out, true, nil
+	default:
+		logger.Warning(fmt.Sprintf("Rejected an email from unauthorized sender addresses: user=%v, addresses=%v", c.UserID(), invalid))
+		return "", nil, false, nil
+	}
+}
+
+func (r SenderConfig) canSendAs(c backend.Credential, own []string, address string) (bool, error) {
+	if hasAddress(own, address) {
+		return true, nil
+	}
+	if r.SendAs == nil {
+		return false, nil
+	}
+
+	return r.SendAs.CanSendAs(c.UserUID(), address)
+}
+
+func hasAddress(addresses []string, address string) bool {
+	for _, v := range addresses {
+		if strings.EqualFold(v, address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setHeader replaces all fields whose name is name in the header of msg with
+// a new field whose value is value. Empty value just removes the fields. msg
+// should have CRLF line endings.
+func setHeader(msg []byte, name, value string) []byte {
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(msg)
+	} else {
+		// Include the CRLF of the last header field.
+		end += 2
+	}
+
+	var out bytes.Buffer
+	if len(value) > 0 {
+		out.WriteString(fmt.Sprintf("%v: %v\r\n", name, value))
+	}
+	skip := false
+	for _, line := range bytes.SplitAfter(msg[:end], []byte("\r\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		// Continuation line of the previous field?
+		if line[0] == ' ' || line[0] == '\t' {
+			if !skip {
+				out.Write(line)
+			}
+			continue
+		}
+		i := bytes.IndexByte(line, ':')
+		skip = i > 0 && strings.EqualFold(strings.TrimSpace(string(line[:i])), name)
+		if !skip {
+			out.Write(line)
+		}
+	}
+	out.Write(msg[end:])
+
+	return out.Bytes()
+}
@@ -0,0 +1,115 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package activesync
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/superkkt/omega/backend"
+)
+
+type testCredential struct {
+	userID  string
+	address string
+	aliases []string
+}
+
+func (r testCredential) IsAuthorized() bool { return true }
+func (r testCredential) UserID() string     { return r.userID }
+func (r testCredential) UserUID() uint64    { return 1 }
+
+// addressCredential is a testCredential that knows the user's addresses.
+type addressCredential struct {
+	testCredential
+}
+
+func (r addressCredential) Address() string   { return r.address }
+func (r addressCredential) Aliases() []string { return r.aliases }
+
+func readHeader(t *testing.T, msg string) mail.Header {
+	m, err := mail.ReadMessage(bytes.NewReader([]byte(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Header
+}
+
+func TestSenderCheck(t *testing.T) {
+	alice := addressCredential{testCredential{userID: "alice", address: "alice@example.com", aliases: []string{"a@example.com"}}}
+	noAddress := addressCredential{testCredential{userID: "bob"}}
+	unknown := testCredential{userID: "carol"}
+	own := "From: Alice <a@example.com>\r\nSubject: test\r\n\r\nHello.\r\n"
+	forged := "From: Boss <boss@example.com>\r\nSubject: test\r\n\r\nHello.\r\n"
+
+	tests := []struct {
+		name       string
+		config     SenderConfig
+		credential backend.Credential
+		msg        string
+		ok         bool
+		from       string
+		// rewritten is the expected From header if the message is rewritten.
+		rewritten string
+	}{
+		{"own alias", SenderConfig{Policy: SenderReject}, alice, own, true, "a@example.com", ""},
+		{"forged rejected", SenderConfig{Policy: SenderReject}, alice, forged, false, "", ""},
+		{"forged rewritten", SenderConfig{Policy: SenderRewrite}, alice, forged, true, "alice@example.com", `"Boss" <alice@example.com>`},
+		{"forged allowed", SenderConfig{Policy: SenderAllow}, alice, forged, true, "alice@example.com", ""},
+		// Users without addresses are rejected unless AllowUnverified is set.
+		{"no address rejected", SenderConfig{Policy: SenderReject}, noAddress, forged, false, "", ""},
+		{"no address rewrite", SenderConfig{Policy: SenderRewrite}, noAddress, forged, false, "", ""},
+		{"no address allow policy", SenderConfig{Policy: SenderAllow}, noAddress, forged, false, "", ""},
+		{"no address allowed", SenderConfig{Policy: SenderReject, AllowUnverified: true}, noAddress, forged, true, "bob", ""},
+		{"not an address credential", SenderConfig{Policy: SenderRewrite}, unknown, own, false, "", ""},
+		{"not an address credential allowed", SenderConfig{AllowUnverified: true}, unknown, own, true, "carol", ""},
+	}
+
+	for _, test := range tests {
+		from, out, ok, err := test.config.Check(test.credential, readHeader(t, test.msg), []byte(test.msg))
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("%v: expected ok=%v, got %v", test.name, test.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if from != test.from {
+			t.Errorf("%v: expected the envelope sender %v, got %v", test.name, test.from, from)
+		}
+		header := readHeader(t, string(out))
+		if len(test.rewritten) > 0 {
+			if v := header.Get("From"); v != test.rewritten {
+				t.Errorf("%v: expected the rewritten From %v, got %v", test.name, test.rewritten, v)
+			}
+			continue
+		}
+		if string(out) != test.msg {
+			t.Errorf("%v: expected the message to be unchanged: %v", test.name, strings.TrimSpace(string(out)))
+		}
+	}
+}
@@ -0,0 +1,372 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package activesync
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superkkt/logger"
+)
+
+const (
+	defaultUserLockoutThreshold = 10
+	defaultIPLockoutThreshold   = 100
+	defaultBaseDelay            = 1 * time.Second
+	defaultMaxDelay             = 5 * time.Minute
+	// DefaultLockoutDuration is the lockout duration used if ThrottleConfig.LockoutDuration is zero.
+	DefaultLockoutDuration = 15 * time.Minute
+	// The memory failure store purges expired counters when it grows more than this.
+	purgeThreshold = 4096
+)
+
+// Failure is a counter of consecutive authentication failures.
+type Failure struct {
+	Count uint
+	// Last is the time of the last failure.
+	Last time.Time
+}
+
+// FailureStore keeps counters of authentication failures. A key is either
+// "user:" followed by a lowercase user name, or "ip:" followed by an IP address.
+type FailureStore interface {
+	// GetFailure returns the counter of key. The zero value is returned if
+	// there is no counter.
+	GetFailure(key string) (Failure, error)
+	// AddFailure increments the counter of key, and returns the updated
+	// counter. The counter restarts from 1 if its last failure is older than
+	// expiry.
+	AddFailure(key string, expiry time.Duration) (Failure, error)
+	// ClearFailure removes the counter of key.
+	ClearFailure(key string) error
+}
+
+// ThrottleConfig configures the brute-force protection of the listener. Each
+// failure of a user or a client IP address doubles the delay before the next
+// attempt is allowed, starting from BaseDelay up to MaxDelay. Once the number
+// of consecutive failures reaches its lockout threshold, the user or the IP
+// address is locked out for LockoutDuration since the last failure. Counters
+// expire if there has been no failure for LockoutDuration, and a successful
+// login clears the counter of the user.
+type ThrottleConfig struct {
+	// Store keeps the failure counters. Nil disables the brute-force protection.
+	Store FailureStore
+	// Zero values mean the default thresholds, which are 10 for users and 100
+	// for IP addresses.
+	UserLockoutThreshold uint
+	IPLockoutThreshold   uint
+	// Zero values mean the defaults, which are 1 second, 5 minutes, and 15 minutes.
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+}
+
+// SetDefaults replaces the zero values of r with the defaults.
+func (r *ThrottleConfig) SetDefaults() {
+	if r.UserLockoutThreshold == 0 {
+		r.UserLockoutThreshold = defaultUserLockoutThreshold
+	}
+	if r.IPLockoutThreshold == 0 {
+		r.IPLockoutThreshold = defaultIPLockoutThreshold
+	}
+	if r.BaseDelay == 0 {
+		r.BaseDelay = defaultBaseDelay
+	}
+	if r.MaxDelay == 0 {
+		r.MaxDelay = defaultMaxDelay
+	}
+	if r.LockoutDuration == 0 {
+		r.LockoutDuration = DefaultLockoutDuration
+	}
+}
+
+// UserFailureKey returns the failure store key of a user.
+func UserFailureKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// IPFailureKey returns the failure store key of an IP address.
+func IPFailureKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Throttle implements the brute-force protection of ThrottleConfig. It is
+// shared by the listeners of all protocols: call Check before authentication,
+// and Update with the result.
+type Throttle struct {
+	config ThrottleConfig
+	// name is the prefix of log messages, e.g., imap.
+	name string
+}
+
+// NewThrottle returns a Throttle of conf whose zero values are replaced with
+// the defaults. name is the prefix of its log messages.
+func NewThrottle(name string, conf ThrottleConfig) *Throttle {
+	conf.SetDefaults()
+
+	return &Throttle{
+		config: conf,
+		name:   name,
+	}
+}
+
+// Attempt is an authentication attempt from a client.
+type Attempt struct {
+	IP string
+	// Username is empty if the user is not known before authentication, e.g.,
+	// in the bearer authentication scheme.
+	Username string
+	// Anonymous is whether the attempt has no credentials at all. Its failure
+	// is not counted because HTTP clients usually send the first request
+	// without credentials to get the challenge.
+	Anonymous bool
+	// Retry is the duration until the attempt is allowed, and Locked is whether
+	// the client is locked out rather than throttled. Check sets both if the
+	// attempt is not allowed.
+	Retry  time.Duration
+	Locked bool
+	// counted is the keys that have unexpired failure counters.
+	counted []string
+}
+
+// NewRequestAttempt returns the authentication attempt of req. The user name is
+// only available in the basic authentication scheme.
+func NewRequestAttempt(req *http.Request) *Attempt {
+	a := &Attempt{
+		IP:        RequestIP(req),
+		Anonymous: len(req.Header.Get("Authorization")) == 0,
+	}
+	if username, _, ok := req.BasicAuth(); ok {
+		a.Username = username
+	}
+
+	return a
+}
+
+// RequestIP returns the client IP address of req.
+func RequestIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return ip
+}
+
+// keys returns the failure store keys of a and their lockout thresholds.
+func (r *Throttle) keys(a *Attempt) (keys []string, thresholds []uint) {
+	keys = append(keys, IPFailureKey(a.IP))
+	thresholds = append(thresholds, r.config.IPLockoutThreshold)
+	if len(a.Username) > 0 {
+		keys = append(keys, UserFailureKey(a.Username))
+		thresholds = append(thresholds, r.config.UserLockoutThreshold)
+	}
+
+	return keys, thresholds
+}
+
+// Check returns whether a is allowed to try authentication. If it is not
+// allowed, Check sets a.Retry and a.Locked. Store errors do not block attempts.
+func (r *Throttle) Check(a *Attempt) bool {
+	a.counted = nil
+	if r.config.Store == nil {
+		return true
+	}
+
+	now := time.Now()
+	keys, thresholds := r.keys(a)
+	for i, key := range keys {
+		f, err := r.config.Store.GetFailure(key)
+		if err != nil {
+			logger.Error(fmt.Sprintf("%v: failed to get the authentication failure counter of %v: %v", r.name, key, err))
+			continue
+		}
+		// Expired?
+		if f.Count == 0 || now.Sub(f.Last) >= r.config.LockoutDuration {
+			continue
+		}
+		a.counted = append(a.counted, key)
+
+		if f.Count >= thresholds[i] {
+			a.Retry = f.Last.Add(r.config.LockoutDuration).Sub(now)
+			a.Locked = true
+			logger.Warning(fmt.Sprintf("%v: rejected an authentication attempt from a locked out %v (failures=%v, retry=%v)", r.name, key, f.Count, a.Retry))
+			return false
+		}
+		if retry := f.Last.Add(r.config.Backoff(f.Count)).Sub(now); retry > 0 {
+			a.Retry = retry
+			logger.Info(fmt.Sprintf("%v: throttled an authentication attempt from %v (failures=%v, retry=%v)", r.name, key, f.Count, retry))
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckRequest is Check for HTTP listeners. If a is not allowed, CheckRequest
+// writes a 429 Too Many Requests response for the backoff delay, or a 503
+// Service Unavailable response for the lockout. Both responses have the
+// Retry-After header.
+func (r *Throttle) CheckRequest(w http.ResponseWriter, a *Attempt) bool {
+	if r.Check(a) {
+		return true
+	}
+
+	status := http.StatusTooManyRequests
+	if a.Locked {
+		// Devices usually retry later without asking the user for a new password on 503.
+		status = http.StatusServiceUnavailable
+	}
+	// Round up to seconds.
+	sec := int64((a.Retry + time.Second - 1) / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(sec, 10))
+	w.WriteHeader(status)
+
+	return false
+}
+
+// Update updates the failure counters of a, which has been passed to Check,
+// according to the authentication result.
+func (r *Throttle) Update(a *Attempt, authorized bool) {
+	if r.config.Store == nil {
+		return
+	}
+
+	if authorized {
+		for _, key := range a.counted {
+			// Keep the counter of the IP address because it may be shared by an attacker.
+			if !strings.HasPrefix(key, "user:") {
+				continue
+			}
+			r.clear(key)
+		}
+		return
+	}
+	if a.Anonymous {
+		return
+	}
+
+	keys, _ := r.keys(a)
+	for _, key := range keys {
+		f, err := r.config.Store.AddFailure(key, r.config.LockoutDuration)
+		if err != nil {
+			logger.Error(fmt.Sprintf("%v: failed to increase the authentication failure counter of %v: %v", r.name, key, err))
+			continue
+		}
+		logger.Debug(fmt.Sprintf("%v: authentication failure counter of %v = %v", r.name, key, f.Count))
+	}
+}
+
+// Reset clears the failure counter of a user, e.g., after an administrator
+// changes the password of the user. Counters of IP addresses are kept.
+func (r *Throttle) Reset(username string) {
+	if r.config.Store == nil {
+		return
+	}
+	r.clear(UserFailureKey(username))
+}
+
+func (r *Throttle) clear(key string) {
+	if err := r.config.Store.ClearFailure(key); err != nil {
+		logger.Error(fmt.Sprintf("%v: failed to clear the authentication failure counter of %v: %v", r.name, key, err))
+	}
+}
+
+// Backoff returns the delay that should pass after count consecutive failures.
+func (r *ThrottleConfig) Backoff(count uint) time.Duration {
+	d := float64(r.BaseDelay) * math.Pow(2, float64(count-1))
+	if d > float64(r.MaxDelay) {
+		return r.MaxDelay
+	}
+
+	return time.Duration(d)
+}
+
+// MemoryFailureStore is a FailureStore that keeps counters in memory. It is only
+// suitable for a single server because counters are not shared among servers.
+type MemoryFailureStore struct {
+	mu       sync.Mutex
+	failures map[string]Failure
+	// expiry is the largest expiry given to AddFailure, which is used to purge expired counters.
+	expiry time.Duration
+}
+
+func NewMemoryFailureStore() *MemoryFailureStore {
+	return &MemoryFailureStore{
+		failures: make(map[string]Failure),
+	}
+}
+
+func (r *MemoryFailureStore) GetFailure(key string) (Failure, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.failures[key], nil
+}
+
+func (r *MemoryFailureStore) AddFailure(key string, expiry time.Duration) (Failure, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if expiry > r.expiry {
+		r.expiry = expiry
+	}
+	if len(r.failures) >= purgeThreshold {
+		r.purge(now)
+	}
+
+	f := r.failures[key]
+	if now.Sub(f.Last) >= expiry {
+		f.Count = 0
+	}
+	f.Count++
+	f.Last = now
+	r.failures[key] = f
+
+	return f, nil
+}
+
+func (r *MemoryFailureStore) ClearFailure(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.failures, key)
+	return nil
+}
+
+// purge removes expired counters. The caller should hold the lock.
+func (r *MemoryFailureStore) purge(now time.Time) {
+	for k, v := range r.failures {
+		if now.Sub(v.Last) >= r.expiry {
+			delete(r.failures, k)
+		}
+	}
+}
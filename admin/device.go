@@ -0,0 +1,481 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/database"
+)
+
+const (
+	maxPasswordLength    = 16
+	minFailedAttempts    = 4
+	maxFailedAttempts    = 16
+	maxInactivityTimeout = 9999 * time.Minute
+	policySourceUser     = "user"
+	policySourceGroup    = "group"
+	policySourceDefault  = "default"
+	policySourceBuiltIn  = "builtin"
+)
+
+var policySources = map[activesync.PolicySource]string{
+	activesync.PolicyUser:    policySourceUser,
+	activesync.PolicyGroup:   policySourceGroup,
+	activesync.PolicyDefault: policySourceDefault,
+	activesync.PolicyBuiltIn: policySourceBuiltIn,
+}
+
+type deviceObject struct {
+	UserUID uint64 `json:"userUid"`
+	// User is the user name, which is empty if the user accounts are not
+	// managed by this server.
+	User     string `json:"user,omitempty"`
+	DeviceID string `json:"deviceId"`
+	LastSync string `json:"lastSync"`
+}
+
+type deviceFolderObject struct {
+	ID uint64 `json:"id"`
+	// Name and ParentID are empty if the folder hierarchy of the device does
+	// not have the folder.
+	Name          string `json:"name"`
+	ParentID      uint64 `json:"parentId"`
+	LastHistoryID uint64 `json:"lastHistoryId"`
+	SyncKey       uint64 `json:"syncKey"`
+	Emails        uint64 `json:"emails"`
+}
+
+type deviceStateObject struct {
+	deviceObject
+	Folders []deviceFolderObject `json:"folders"`
+	Wipe    *wipeObject          `json:"wipe"`
+}
+
+type wipeObject struct {
+	UserUID      uint64  `json:"userUid"`
+	DeviceID     string  `json:"deviceId"`
+	Status       string  `json:"status"`
+	Requested    string  `json:"requested"`
+	Acknowledged *string `json:"acknowledged"`
+}
+
+func newWipeObject(w activesync.Wipe) *wipeObject {
+	return &wipeObject{
+		UserUID:      w.UserUID,
+		DeviceID:     w.DeviceID,
+		Status:       w.Status.String(),
+		Requested:    formatTime(w.Requested),
+		Acknowledged: formatOptionalTime(w.Acknowledged),
+	}
+}
+
+type policyObject struct {
+	PasswordRequired     bool `json:"passwordRequired"`
+	MinPasswordLength    uint `json:"minPasswordLength"`
+	AlphanumericPassword bool `json:"alphanumericPassword"`
+	// InactivityTimeout is in seconds.
+	InactivityTimeout uint64 `json:"inactivityTimeout"`
+	MaxFailedAttempts uint   `json:"maxFailedAttempts"`
+	// Source is where the policy comes from: user, group, default, or
+	// builtin. It is ignored in requests.
+	Source string `json:"source,omitempty"`
+	// Group is the name of the group that the policy comes from if Source is
+	// group. It is ignored in requests.
+	Group string `json:"group,omitempty"`
+}
+
+func newPolicyObject(p activesync.Policy, source string) policyObject {
+	return policyObject{
+		PasswordRequired:     p.PasswordRequired,
+		MinPasswordLength:    p.MinPasswordLength,
+		AlphanumericPassword: p.AlphanumericPassword,
+		InactivityTimeout:    uint64(p.InactivityTimeout / time.Second),
+		MaxFailedAttempts:    p.MaxFailedAttempts,
+		Source:               source,
+	}
+}
+
+// device returns the device of the device parameter that belongs to a user
+// whose UID is userUID.
+func (r *call) device(m activesync.DeviceManager, userUID uint64) (activesync.Device, error) {
+	devices, err := m.GetDevices(userUID)
+	if err != nil {
+		return activesync.Device{}, err
+	}
+	for _, v := range devices {
+		if v.DeviceID == r.params["device"] {
+			return v, nil
+		}
+	}
+
+	return activesync.Device{}, newError(http.StatusNotFound, "unknown device: %v", r.params["device"])
+}
+
+// userNames returns the names of all users, which is nil if the user accounts
+// are not managed by this server.
+func (r *call) userNames() (map[uint64]string, error) {
+	if r.server.config.Users == nil {
+		return nil, nil
+	}
+	users, err := r.server.config.Users(r.tx).GetUsers(database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[uint64]string)
+	for _, v := range users {
+		result[v.UID] = v.Name
+	}
+
+	return result, nil
+}
+
+func (r *call) showDevices(userUID uint64) (interface{}, error) {
+	devices, err := r.devices().GetDevices(userUID)
+	if err != nil {
+		return nil, err
+	}
+	names, err := r.userNames()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]deviceObject, len(devices))
+	for i, v := range devices {
+		result[i] = deviceObject{
+			UserUID:  v.UserUID,
+			User:     names[v.UserUID],
+			DeviceID: v.DeviceID,
+			LastSync: formatTime(v.LastSync),
+		}
+	}
+
+	return result, nil
+}
+
+func listAllDevices(c *call) (interface{}, error) {
+	return c.showDevices(0)
+}
+
+func listDevices(c *call) (interface{}, error) {
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.showDevices(cred.UserUID())
+}
+
+func getDevice(c *call) (interface{}, error) {
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+	m := c.devices()
+	d, err := c.device(m, cred.UserUID())
+	if err != nil {
+		return nil, err
+	}
+	folders, err := m.GetDeviceFolders(d.UserUID, d.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := deviceStateObject{
+		deviceObject: deviceObject{
+			UserUID:  d.UserUID,
+			User:     cred.UserID(),
+			DeviceID: d.DeviceID,
+			LastSync: formatTime(d.LastSync),
+		},
+		Folders: make([]deviceFolderObject, len(folders)),
+	}
+	for i, v := range folders {
+		result.Folders[i] = deviceFolderObject{
+			ID:            v.ID,
+			Name:          v.Name,
+			ParentID:      v.ParentID,
+			LastHistoryID: v.LastHistoryID,
+			SyncKey:       v.SyncKey,
+			Emails:        v.Emails,
+		}
+	}
+	w, err := m.GetWipe(d.UserUID, d.DeviceID, database.LockNone)
+	if err == nil {
+		result.Wipe = newWipeObject(w)
+	} else if !isNotFound(err) {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// resetDevice clears the synchronization state of a device so that it
+// synchronizes all the folders and emails again from the beginning.
+func resetDevice(c *call) (interface{}, error) {
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+	m := c.devices()
+	d, err := c.device(m, cred.UserUID())
+	if err != nil {
+		return nil, err
+	}
+	folders, err := m.GetDeviceFolders(d.UserUID, d.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := c.server.config.ASStorage
+	for _, v := range folders {
+		sync := storage.NewSync(c.tx, d.UserUID, d.DeviceID, v.ID)
+		if err := sync.ClearSyncKeys(); err != nil {
+			return nil, err
+		}
+		if err := sync.ClearVirtualEmails(); err != nil {
+			return nil, err
+		}
+	}
+	folderSync := storage.NewFolderSync(c.tx, d.UserUID, d.DeviceID)
+	if err := folderSync.ClearSyncKeys(); err != nil {
+		return nil, err
+	}
+	if err := folderSync.ClearVirtualFolders(); err != nil {
+		return nil, err
+	}
+	if err := m.RemoveWipe(d.UserUID, d.DeviceID); err != nil && !isNotFound(err) {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func listWipes(c *call) (interface{}, error) {
+	wipes, err := c.devices().GetWipes(0, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*wipeObject, len(wipes))
+	for i, v := range wipes {
+		result[i] = newWipeObject(v)
+	}
+
+	return result, nil
+}
+
+func getWipe(c *call) (interface{}, error) {
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+	w, err := c.devices().GetWipe(cred.UserUID(), c.params["device"], database.LockNone)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, newError(http.StatusNotFound, "no remote wipe request: %v", c.params["device"])
+		}
+		return nil, err
+	}
+
+	return newWipeObject(w), nil
+}
+
+func requestWipe(c *call) (interface{}, error) {
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+	m := c.devices()
+	// Only devices that have synchronized can be wiped.
+	d, err := c.device(m, cred.UserUID())
+	if err != nil {
+		return nil, err
+	}
+	if err := m.RequestWipe(d.UserUID, d.DeviceID); err != nil {
+		return nil, err
+	}
+	w, err := m.GetWipe(d.UserUID, d.DeviceID, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWipeObject(w), nil
+}
+
+func removeWipe(c *call) (interface{}, error) {
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.devices().RemoveWipe(cred.UserUID(), c.params["device"]); err != nil {
+		if isNotFound(err) {
+			return nil, newError(http.StatusNotFound, "no remote wipe request: %v", c.params["device"])
+		}
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func getDefaultPolicy(c *call) (interface{}, error) {
+	p, err := c.devices().GetPolicy(0, database.LockNone)
+	if err != nil {
+		if isNotFound(err) {
+			return newPolicyObject(activesync.DefaultPolicy, policySourceBuiltIn), nil
+		}
+		return nil, err
+	}
+
+	return newPolicyObject(p, policySourceDefault), nil
+}
+
+func setDefaultPolicy(c *call) (interface{}, error) {
+	return c.setPolicy(0, policySourceDefault)
+}
+
+func removeDefaultPolicy(c *call) (interface{}, error) {
+	return nil, c.removePolicy(0)
+}
+
+func getPolicy(c *call) (interface{}, error) {
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+	p, source, group, err := activesync.GetEffectivePolicy(c.devices(), cred, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	result := newPolicyObject(p, policySources[source])
+	result.Group = group
+
+	return result, nil
+}
+
+func setPolicy(c *call) (interface{}, error) {
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.setPolicy(cred.UserUID(), policySourceUser)
+}
+
+func removePolicy(c *call) (interface{}, error) {
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, c.removePolicy(cred.UserUID())
+}
+
+func getGroupPolicy(c *call) (interface{}, error) {
+	p, err := c.devices().GetGroupPolicy(c.params["group"], database.LockNone)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, newError(http.StatusNotFound, "no policy of the group: %v", c.params["group"])
+		}
+		return nil, err
+	}
+	result := newPolicyObject(p, policySourceGroup)
+	result.Group = c.params["group"]
+
+	return result, nil
+}
+
+func setGroupPolicy(c *call) (interface{}, error) {
+	p, err := c.decodePolicy()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.devices().SetGroupPolicy(c.params["group"], p); err != nil {
+		return nil, err
+	}
+	result := newPolicyObject(p, policySourceGroup)
+	result.Group = c.params["group"]
+
+	return result, nil
+}
+
+func removeGroupPolicy(c *call) (interface{}, error) {
+	if err := c.devices().RemoveGroupPolicy(c.params["group"]); err != nil {
+		if isNotFound(err) {
+			return nil, newError(http.StatusNotFound, "no policy to remove")
+		}
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (r *call) setPolicy(userUID uint64, source string) (interface{}, error) {
+	p, err := r.decodePolicy()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.devices().SetPolicy(userUID, p); err != nil {
+		return nil, err
+	}
+
+	return newPolicyObject(p, source), nil
+}
+
+// decodePolicy decodes and validates the policy in the request body.
+func (r *call) decodePolicy() (activesync.Policy, error) {
+	req := policyObject{}
+	if err := r.decode(&req); err != nil {
+		return activesync.Policy{}, err
+	}
+	if req.MinPasswordLength < 1 || req.MinPasswordLength > maxPasswordLength {
+		return activesync.Policy{}, newError(http.StatusBadRequest, "minPasswordLength should be between 1 and %v", maxPasswordLength)
+	}
+	if req.MaxFailedAttempts != 0 && (req.MaxFailedAttempts < minFailedAttempts || req.MaxFailedAttempts > maxFailedAttempts) {
+		return activesync.Policy{}, newError(http.StatusBadRequest, "maxFailedAttempts should be zero, or between %v and %v", minFailedAttempts, maxFailedAttempts)
+	}
+	timeout := time.Duration(req.InactivityTimeout) * time.Second
+	if req.InactivityTimeout > uint64(maxInactivityTimeout/time.Second) {
+		return activesync.Policy{}, newError(http.StatusBadRequest, "inactivityTimeout should not exceed %v seconds", uint64(maxInactivityTimeout/time.Second))
+	}
+
+	return activesync.Policy{
+		PasswordRequired:     req.PasswordRequired,
+		MinPasswordLength:    req.MinPasswordLength,
+		AlphanumericPassword: req.AlphanumericPassword,
+		InactivityTimeout:    timeout,
+		MaxFailedAttempts:    req.MaxFailedAttempts,
+	}, nil
+}
+
+func (r *call) removePolicy(userUID uint64) error {
+	if err := r.devices().RemovePolicy(userUID); err != nil {
+		if isNotFound(err) {
+			return newError(http.StatusNotFound, "no policy to remove")
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+)
+
+var folderTypes = map[backend.FolderType]string{
+	backend.EmailInbox:  "inbox",
+	backend.EmailDraft:  "drafts",
+	backend.EmailTrash:  "trash",
+	backend.EmailSent:   "sent",
+	backend.EmailFolder: "folder",
+	backend.EmailOutbox: "outbox",
+	backend.EmailJunk:   "junk",
+}
+
+type folderObject struct {
+	ID uint64 `json:"id"`
+	// ParentID is zero if the folder is on the top level.
+	ParentID uint64 `json:"parentId"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+}
+
+func newFolderObject(f backend.Folder) folderObject {
+	t, ok := folderTypes[f.Type]
+	if !ok {
+		t = fmt.Sprintf("unknown(%v)", int(f.Type))
+	}
+
+	return folderObject{
+		ID:       f.ID,
+		ParentID: f.ParentID,
+		Name:     f.Name,
+		Type:     t,
+	}
+}
+
+func (r *call) folders() (backend.FolderManager, error) {
+	c, err := r.credential()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.server.config.Storage.NewFolderManager(r.tx, c), nil
+}
+
+// folder returns the folder of the folder parameter.
+func (r *call) folder(m backend.FolderManager, lock database.LockMode) (backend.Folder, error) {
+	id, err := r.uintParam("folder")
+	if err != nil {
+		return backend.Folder{}, err
+	}
+	f, err := m.GetFolderByID(id, lock)
+	if err != nil {
+		if isNotFound(err) {
+			return backend.Folder{}, newError(http.StatusNotFound, "unknown folder: %v", id)
+		}
+		return backend.Folder{}, err
+	}
+
+	return f, nil
+}
+
+func listFolders(c *call) (interface{}, error) {
+	m, err := c.folders()
+	if err != nil {
+		return nil, err
+	}
+	folders, err := m.GetFolders(database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]folderObject, len(folders))
+	for i, v := range folders {
+		result[i] = newFolderObject(v)
+	}
+
+	return result, nil
+}
+
+func getFolder(c *call) (interface{}, error) {
+	m, err := c.folders()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.folder(m, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFolderObject(f), nil
+}
+
+func addFolder(c *call) (interface{}, error) {
+	m, err := c.folders()
+	if err != nil {
+		return nil, err
+	}
+	req := struct {
+		ParentID uint64 `json:"parentId"`
+		Name     string `json:"name"`
+	}{}
+	if err := c.decode(&req); err != nil {
+		return nil, err
+	}
+	if err := validateFolder(m, 0, req.ParentID, req.Name); err != nil {
+		return nil, err
+	}
+
+	// Only normal folders can be added because the others are created with
+	// the account.
+	id, err := m.AddFolder(req.ParentID, req.Name, backend.EmailFolder)
+	if err != nil {
+		return nil, err
+	}
+	c.location = c.child(strconv.FormatUint(id, 10))
+
+	return folderObject{
+		ID:       id,
+		ParentID: req.ParentID,
+		Name:     req.Name,
+		Type:     folderTypes[backend.EmailFolder],
+	}, nil
+}
+
+func updateFolder(c *call) (interface{}, error) {
+	m, err := c.folders()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.folder(m, database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+	if f.Type != backend.EmailFolder {
+		return nil, newError(http.StatusForbidden, "special folder cannot be changed: %v", f.ID)
+	}
+	req := struct {
+		ParentID *uint64 `json:"parentId"`
+		Name     *string `json:"name"`
+	}{}
+	if err := c.decode(&req); err != nil {
+		return nil, err
+	}
+	if req.ParentID != nil {
+		f.ParentID = *req.ParentID
+	}
+	if req.Name != nil {
+		f.Name = *req.Name
+	}
+	if err := validateFolder(m, f.ID, f.ParentID, f.Name); err != nil {
+		return nil, err
+	}
+
+	if err := m.UpdateFolder(f.ID, f.ParentID, f.Name); err != nil {
+		return nil, err
+	}
+
+	return newFolderObject(f), nil
+}
+
+func deleteFolder(c *call) (interface{}, error) {
+	m, err := c.folders()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.folder(m, database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+	if f.Type != backend.EmailFolder {
+		return nil, newError(http.StatusForbidden, "special folder cannot be deleted: %v", f.ID)
+	}
+
+	return nil, m.DeleteFolder(f.ID)
+}
+
+// validateFolder checks the name and the parent of a folder whose ID is
+// folderID. Zero folderID means a new folder.
+func validateFolder(m backend.FolderManager, folderID, parentID uint64, name string) error {
+	if len(strings.TrimSpace(name)) == 0 {
+		return newError(http.StatusBadRequest, "empty folder name")
+	}
+	if parentID == 0 {
+		return nil
+	}
+
+	folders, err := m.GetFolders(database.LockNone)
+	if err != nil {
+		return err
+	}
+	parents := make(map[uint64]uint64)
+	for _, v := range folders {
+		parents[v.ID] = v.ParentID
+	}
+	if _, ok := parents[parentID]; !ok {
+		return newError(http.StatusBadRequest, "unknown parent folder: %v", parentID)
+	}
+	// A folder cannot be moved under itself or its descendants.
+	for id := parentID; id != 0; id = parents[id] {
+		if id == folderID {
+			return newError(http.StatusBadRequest, "folder cannot be moved under itself: %v", folderID)
+		}
+	}
+
+	return nil
+}
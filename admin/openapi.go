@@ -0,0 +1,341 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/superkkt/omega/sieve"
+)
+
+// parameters describes the path parameters of the routes.
+var parameters = map[string]string{
+	"user":    "User name",
+	"address": "Email address",
+	"id":      "App password ID",
+	"folder":  "Folder ID",
+	"device":  "ActiveSync device ID",
+	"group":   "Group name of the user directory",
+}
+
+func object(required []string, properties map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		result["required"] = required
+	}
+
+	return result
+}
+
+func array(schema string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "array",
+		"items": ref(schema),
+	}
+}
+
+func ref(schema string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + schema}
+}
+
+func typed(t, format string) map[string]interface{} {
+	result := map[string]interface{}{"type": t}
+	if len(format) > 0 {
+		result["format"] = format
+	}
+
+	return result
+}
+
+func nullable(t, format string) map[string]interface{} {
+	result := typed(t, format)
+	result["nullable"] = true
+
+	return result
+}
+
+var (
+	integer   = typed("integer", "int64")
+	str       = typed("string", "")
+	boolean   = typed("boolean", "")
+	email     = typed("string", "email")
+	timestamp = typed("string", "date-time")
+)
+
+var schemas = map[string]interface{}{
+	"Error": object([]string{"error"}, map[string]interface{}{
+		"error": str,
+	}),
+	"User": object([]string{"uid", "name", "address", "aliases", "enabled"}, map[string]interface{}{
+		"uid":     integer,
+		"name":    str,
+		"address": email,
+		"aliases": map[string]interface{}{"type": "array", "items": email},
+		"enabled": boolean,
+		"sendAs":  map[string]interface{}{"type": "array", "items": email},
+	}),
+	"UserList": array("User"),
+	"UserCreate": object([]string{"name", "password", "address"}, map[string]interface{}{
+		"name":     str,
+		"password": typed("string", "password"),
+		"address":  email,
+	}),
+	"UserUpdate": object(nil, map[string]interface{}{
+		"password": typed("string", "password"),
+		"address":  email,
+		"enabled":  boolean,
+	}),
+	"Address": object([]string{"address"}, map[string]interface{}{
+		"address": email,
+	}),
+	"AddressList": map[string]interface{}{"type": "array", "items": email},
+	"AppPassword": object([]string{"id", "label", "deviceId", "created", "lastUsed"}, map[string]interface{}{
+		"id":       integer,
+		"label":    str,
+		"deviceId": str,
+		"created":  timestamp,
+		"lastUsed": nullable("string", "date-time"),
+	}),
+	"AppPasswordList": array("AppPassword"),
+	"AppPasswordCreate": object([]string{"label"}, map[string]interface{}{
+		"label":    str,
+		"deviceId": str,
+	}),
+	"AppPasswordCreated": object([]string{"id", "password"}, map[string]interface{}{
+		"id":       integer,
+		"password": typed("string", "password"),
+	}),
+	"Folder": object([]string{"id", "parentId", "name", "type"}, map[string]interface{}{
+		"id":       integer,
+		"parentId": integer,
+		"name":     str,
+		"type": map[string]interface{}{
+			"type": "string",
+			"enum": []string{"inbox", "drafts", "trash", "sent", "folder", "outbox", "junk"},
+		},
+	}),
+	"FolderList": array("Folder"),
+	"FolderCreate": object([]string{"name"}, map[string]interface{}{
+		"parentId": integer,
+		"name":     str,
+	}),
+	"FolderUpdate": object(nil, map[string]interface{}{
+		"parentId": integer,
+		"name":     str,
+	}),
+	"Device": object([]string{"userUid", "deviceId", "lastSync"}, map[string]interface{}{
+		"userUid":  integer,
+		"user":     str,
+		"deviceId": str,
+		"lastSync": timestamp,
+	}),
+	"DeviceList": array("Device"),
+	"DeviceFolder": object([]string{"id", "name", "parentId", "lastHistoryId", "syncKey", "emails"}, map[string]interface{}{
+		"id":            integer,
+		"name":          str,
+		"parentId":      integer,
+		"lastHistoryId": integer,
+		"syncKey":       integer,
+		"emails":        integer,
+	}),
+	"DeviceState": map[string]interface{}{
+		"allOf": []interface{}{
+			ref("Device"),
+			object([]string{"folders", "wipe"}, map[string]interface{}{
+				"folders": array("DeviceFolder"),
+				"wipe": map[string]interface{}{
+					"allOf":    []interface{}{ref("Wipe")},
+					"nullable": true,
+				},
+			}),
+		},
+	},
+	"Wipe": object([]string{"userUid", "deviceId", "status", "requested", "acknowledged"}, map[string]interface{}{
+		"userUid":  integer,
+		"deviceId": str,
+		"status": map[string]interface{}{
+			"type": "string",
+			"enum": []string{"pending", "wiped"},
+		},
+		"requested":    timestamp,
+		"acknowledged": nullable("string", "date-time"),
+	}),
+	"WipeList": array("Wipe"),
+	"Sieve": object([]string{"script"}, map[string]interface{}{
+		"script": map[string]interface{}{
+			"type":        "string",
+			"description": "Sieve (RFC 5228) script, which can require " + strings.Join(sieve.Extensions(), ", ") + ".",
+		},
+	}),
+	"Policy": object([]string{"minPasswordLength"}, map[string]interface{}{
+		"passwordRequired": boolean,
+		"minPasswordLength": map[string]interface{}{
+			"type":    "integer",
+			"minimum": 1,
+			"maximum": maxPasswordLength,
+		},
+		"alphanumericPassword": boolean,
+		"inactivityTimeout": map[string]interface{}{
+			"type":        "integer",
+			"minimum":     0,
+			"maximum":     int64(maxInactivityTimeout.Seconds()),
+			"description": "Seconds before devices are locked. Zero disables it.",
+		},
+		"maxFailedAttempts": map[string]interface{}{
+			"type":        "integer",
+			"minimum":     0,
+			"maximum":     maxFailedAttempts,
+			"description": "Failed unlock attempts before devices wipe themselves. Zero disables it.",
+		},
+		"source": map[string]interface{}{
+			"type":        "string",
+			"enum":        []string{policySourceUser, policySourceGroup, policySourceDefault, policySourceBuiltIn},
+			"readOnly":    true,
+			"description": "Where the policy comes from.",
+		},
+		"group": map[string]interface{}{
+			"type":        "string",
+			"readOnly":    true,
+			"description": "Group that the policy comes from if the source is group.",
+		},
+	}),
+}
+
+// OpenAPI returns the OpenAPI 3.0 document of the API.
+func OpenAPI() map[string]interface{} {
+	paths := make(map[string]interface{})
+	for _, v := range routes {
+		item, ok := paths[v.path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			if p := pathParameters(v.path); len(p) > 0 {
+				item["parameters"] = p
+			}
+			paths[v.path] = item
+		}
+		item[strings.ToLower(v.method)] = operation(v)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Omega Admin API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"basic": map[string]interface{}{
+					"type":   "http",
+					"scheme": "basic",
+				},
+			},
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Error",
+					"content":     content("Error"),
+				},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"basic": []string{}},
+		},
+	}
+}
+
+func pathParameters(path string) []interface{} {
+	result := []interface{}{}
+	for _, v := range strings.Split(path, "/") {
+		if !strings.HasPrefix(v, "{") {
+			continue
+		}
+		name := strings.Trim(v, "{}")
+		result = append(result, map[string]interface{}{
+			"name":        name,
+			"in":          "path",
+			"required":    true,
+			"description": parameters[name],
+			"schema":      str,
+		})
+	}
+
+	return result
+}
+
+func operation(r route) map[string]interface{} {
+	success := map[string]interface{}{
+		"description": http.StatusText(r.status),
+	}
+	if len(r.response) > 0 {
+		success["content"] = content(r.response)
+	}
+	errorResponse := map[string]interface{}{"$ref": "#/components/responses/Error"}
+
+	result := map[string]interface{}{
+		"tags":        []string{r.tag},
+		"summary":     r.summary,
+		"operationId": operationID(r),
+		"responses": map[string]interface{}{
+			strconv.Itoa(r.status): success,
+			"401":                  errorResponse,
+			"404":                  errorResponse,
+			"default":              errorResponse,
+		},
+	}
+	if len(r.request) > 0 {
+		result["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  content(r.request),
+		}
+	}
+
+	return result
+}
+
+func content(schema string) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": ref(schema),
+		},
+	}
+}
+
+// operationID returns a unique identifier of r, e.g., DELETE /users/{user}
+// becomes deleteUsersUser.
+func operationID(r route) string {
+	id := strings.ToLower(r.method)
+	for _, v := range strings.Split(r.path, "/") {
+		v = strings.Trim(v, "{}")
+		for _, w := range strings.Split(v, "-") {
+			if len(w) > 0 {
+				id += strings.ToUpper(w[:1]) + w[1:]
+			}
+		}
+	}
+
+	return id
+}
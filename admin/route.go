@@ -0,0 +1,257 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql/user"
+)
+
+// route is a resource of the API, which is also described in the OpenAPI document.
+type route struct {
+	method string
+	// path consists of segments, and a segment enclosed in braces is a
+	// parameter that matches any segment, e.g., /users/{user}.
+	path    string
+	tag     string
+	summary string
+	// request and response are the schema names of the bodies. Empty means
+	// no body.
+	request  string
+	response string
+	// status is the status code of a successful response.
+	status  int
+	handler func(c *call) (interface{}, error)
+}
+
+var routes = []route{
+	{"GET", "/users", "users", "List all users", "", "UserList", http.StatusOK, listUsers},
+	{"POST", "/users", "users", "Add a new user", "UserCreate", "User", http.StatusCreated, addUser},
+	{"GET", "/users/{user}", "users", "Show a user", "", "User", http.StatusOK, getUser},
+	{"PATCH", "/users/{user}", "users", "Change the password, the primary address, or the status of a user", "UserUpdate", "User", http.StatusOK, updateUser},
+	{"DELETE", "/users/{user}", "users", "Delete a user account without removing its emails", "", "", http.StatusNoContent, deleteUser},
+	{"POST", "/users/{user}/aliases", "users", "Add an alias address", "Address", "", http.StatusNoContent, addAlias},
+	{"DELETE", "/users/{user}/aliases/{address}", "users", "Remove an alias address", "", "", http.StatusNoContent, removeAlias},
+	{"GET", "/users/{user}/send-as", "users", "List addresses that a user can send emails as", "", "AddressList", http.StatusOK, listSendAs},
+	{"POST", "/users/{user}/send-as", "users", "Grant a right to send emails as an address", "Address", "", http.StatusNoContent, addSendAs},
+	{"DELETE", "/users/{user}/send-as/{address}", "users", "Revoke a right to send emails as an address", "", "", http.StatusNoContent, removeSendAs},
+	{"GET", "/users/{user}/app-passwords", "users", "List app passwords", "", "AppPasswordList", http.StatusOK, listAppPasswords},
+	{"POST", "/users/{user}/app-passwords", "users", "Generate a new app password", "AppPasswordCreate", "AppPasswordCreated", http.StatusCreated, addAppPassword},
+	{"DELETE", "/users/{user}/app-passwords/{id}", "users", "Revoke an app password", "", "", http.StatusNoContent, removeAppPassword},
+
+	{"GET", "/users/{user}/folders", "folders", "List mailbox folders", "", "FolderList", http.StatusOK, listFolders},
+	{"POST", "/users/{user}/folders", "folders", "Add a new mailbox folder", "FolderCreate", "Folder", http.StatusCreated, addFolder},
+	{"GET", "/users/{user}/folders/{folder}", "folders", "Show a mailbox folder", "", "Folder", http.StatusOK, getFolder},
+	{"PATCH", "/users/{user}/folders/{folder}", "folders", "Rename or move a mailbox folder", "FolderUpdate", "Folder", http.StatusOK, updateFolder},
+	{"DELETE", "/users/{user}/folders/{folder}", "folders", "Delete a mailbox folder", "", "", http.StatusNoContent, deleteFolder},
+
+	{"GET", "/users/{user}/sieve", "sieve", "Show the Sieve script of a user", "", "Sieve", http.StatusOK, getSieve},
+	{"PUT", "/users/{user}/sieve", "sieve", "Replace the Sieve script of a user, which is compiled before it is stored", "Sieve", "Sieve", http.StatusOK, setSieve},
+	{"DELETE", "/users/{user}/sieve", "sieve", "Remove the Sieve script of a user to deliver emails to the Inbox", "", "", http.StatusNoContent, removeSieve},
+
+	{"GET", "/devices", "devices", "List devices of all users", "", "DeviceList", http.StatusOK, listAllDevices},
+	{"GET", "/users/{user}/devices", "devices", "List devices of a user", "", "DeviceList", http.StatusOK, listDevices},
+	{"GET", "/users/{user}/devices/{device}", "devices", "Show the synchronization state of a device", "", "DeviceState", http.StatusOK, getDevice},
+	{"DELETE", "/users/{user}/devices/{device}", "devices", "Reset the synchronization state of a device, and remove its remote wipe request", "", "", http.StatusNoContent, resetDevice},
+	{"GET", "/wipes", "devices", "List remote wipe requests of all users", "", "WipeList", http.StatusOK, listWipes},
+	{"GET", "/users/{user}/devices/{device}/wipe", "devices", "Show the remote wipe request of a device", "", "Wipe", http.StatusOK, getWipe},
+	{"PUT", "/users/{user}/devices/{device}/wipe", "devices", "Request a device to wipe itself on its next request", "", "Wipe", http.StatusOK, requestWipe},
+	{"DELETE", "/users/{user}/devices/{device}/wipe", "devices", "Cancel or remove the remote wipe request of a device", "", "", http.StatusNoContent, removeWipe},
+
+	{"GET", "/policies/default", "policies", "Show the default security policy", "", "Policy", http.StatusOK, getDefaultPolicy},
+	{"PUT", "/policies/default", "policies", "Replace the default security policy", "Policy", "Policy", http.StatusOK, setDefaultPolicy},
+	{"DELETE", "/policies/default", "policies", "Restore the built-in default security policy", "", "", http.StatusNoContent, removeDefaultPolicy},
+	{"GET", "/policies/groups/{group}", "policies", "Show the security policy of a group", "", "Policy", http.StatusOK, getGroupPolicy},
+	{"PUT", "/policies/groups/{group}", "policies", "Replace the security policy of a group, which applies to its members who have no policy", "Policy", "Policy", http.StatusOK, setGroupPolicy},
+	{"DELETE", "/policies/groups/{group}", "policies", "Remove the security policy of a group", "", "", http.StatusNoContent, removeGroupPolicy},
+	{"GET", "/users/{user}/policy", "policies", "Show the effective security policy of a user", "", "Policy", http.StatusOK, getPolicy},
+	{"PUT", "/users/{user}/policy", "policies", "Replace the security policy of a user", "Policy", "Policy", http.StatusOK, setPolicy},
+	{"DELETE", "/users/{user}/policy", "policies", "Remove the security policy of a user to apply the one of the groups or the default one", "", "", http.StatusNoContent, removePolicy},
+}
+
+// match returns the route of method and the escaped path, and its parameters.
+// If there is no route of method, match returns nil route and the allowed
+// methods of the path, which are empty if the path is unknown.
+func match(method, path string) (result *route, params map[string]string, allowed string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	methods := []string{}
+	for i := range routes {
+		p, ok := matchPath(routes[i].path, segments)
+		if !ok {
+			continue
+		}
+		if routes[i].method == method {
+			return &routes[i], p, ""
+		}
+		methods = append(methods, routes[i].method)
+	}
+	sort.Strings(methods)
+
+	return nil, nil, strings.Join(methods, ", ")
+}
+
+func matchPath(pattern string, segments []string) (params map[string]string, ok bool) {
+	p := strings.Split(strings.Trim(pattern, "/"), "/")
+	if len(p) != len(segments) {
+		return nil, false
+	}
+
+	params = make(map[string]string)
+	for i, v := range p {
+		if !strings.HasPrefix(v, "{") {
+			if v != segments[i] {
+				return nil, false
+			}
+			continue
+		}
+		value, err := url.PathUnescape(segments[i])
+		if err != nil || len(value) == 0 {
+			return nil, false
+		}
+		params[strings.Trim(v, "{}")] = value
+	}
+
+	return params, true
+}
+
+// call is the context of a request.
+type call struct {
+	server *Server
+	tx     database.Transaction
+	req    *http.Request
+	params map[string]string
+	// status is the status code of the response, and location is the URL of
+	// a created resource.
+	status   int
+	location string
+}
+
+// decode decodes the JSON request body into v.
+func (r *call) decode(v interface{}) error {
+	body, err := ioutil.ReadAll(io.LimitReader(r.req.Body, maxRequestSize+1))
+	if err != nil {
+		return newError(http.StatusBadRequest, "failed to read the request body: %v", err)
+	}
+	if len(body) > maxRequestSize {
+		return newError(http.StatusRequestEntityTooLarge, "too large request body")
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return newError(http.StatusBadRequest, "invalid request body: %v", err)
+	}
+
+	return nil
+}
+
+func (r *call) uintParam(name string) (uint64, error) {
+	v, err := strconv.ParseUint(r.params[name], 10, 64)
+	if err != nil {
+		return 0, newError(http.StatusNotFound, "invalid %v: %v", name, r.params[name])
+	}
+
+	return v, nil
+}
+
+// child returns the URL of a resource named name under the request path.
+func (r *call) child(name string) string {
+	return strings.TrimSuffix(r.req.URL.EscapedPath(), "/") + "/" + url.PathEscape(name)
+}
+
+func (r *call) users() (UserManager, error) {
+	if r.server.config.Users == nil {
+		return nil, newError(http.StatusNotImplemented, "user accounts are not managed by this server")
+	}
+
+	return r.server.config.Users(r.tx), nil
+}
+
+// account returns the user account of the user parameter.
+func (r *call) account(lock database.LockMode) (UserManager, user.User, error) {
+	m, err := r.users()
+	if err != nil {
+		return nil, user.User{}, err
+	}
+	u, err := m.GetUser(r.params["user"], lock)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, user.User{}, newError(http.StatusNotFound, "unknown user: %v", r.params["user"])
+		}
+		return nil, user.User{}, err
+	}
+
+	return m, u, nil
+}
+
+// credential returns a credential of the user parameter, which is looked up
+// in the user accounts, or in the directory if the accounts are not managed.
+// Disabled users can be found only in the user accounts.
+func (r *call) credential() (backend.Credential, error) {
+	if r.server.config.Users != nil {
+		_, u, err := r.account(database.LockNone)
+		if err != nil {
+			return nil, err
+		}
+		return &credential{uid: u.UID, name: u.Name}, nil
+	}
+
+	c, err := r.server.config.Directory.LookupUser(r.params["user"])
+	if err != nil {
+		return nil, err
+	}
+	if !c.IsAuthorized() {
+		return nil, newError(http.StatusNotFound, "unknown user: %v", r.params["user"])
+	}
+
+	return c, nil
+}
+
+func (r *call) devices() activesync.DeviceManager {
+	// NewServer has checked that it implements the interface.
+	return r.server.config.ASStorage.(activesync.DeviceStorage).NewDeviceManager(r.tx)
+}
+
+// credential is a credential of a user that the administrator manages.
+type credential struct {
+	uid  uint64
+	name string
+}
+
+func (r *credential) IsAuthorized() bool {
+	return true
+}
+
+func (r *credential) UserID() string {
+	return r.name
+}
+
+func (r *credential) UserUID() uint64 {
+	return r.uid
+}
@@ -0,0 +1,312 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql/user"
+	"github.com/superkkt/omega/sieve"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	// maxRequestSize is the maximum size of a request body.
+	maxRequestSize = 1024 * 1024
+	realm          = "Omega Admin"
+)
+
+type Config struct {
+	// Username and Password are the credential of the administrator, which is
+	// verified by the basic authentication scheme.
+	Username string
+	Password string
+	// Users returns a manager of the user accounts. Nil disables the user
+	// account resources, e.g., if the accounts are not stored in the database.
+	Users func(queryer database.Queryer) UserManager
+	// Directory looks up the users of the other resources if Users is nil.
+	Directory backend.Directory
+	Storage   backend.Storage
+	// ASStorage should implement the activesync.DeviceStorage interface.
+	ASStorage activesync.Storage
+	DB        database.TransactionManager
+	// Sieve manages the Sieve scripts of the users. Nil disables the Sieve
+	// resources.
+	Sieve sieve.Storage
+	// DrainTimeout is the maximum duration to wait for in-flight requests on
+	// shutdown. Zero means 30 seconds.
+	DrainTimeout time.Duration
+	// Throttle is the brute-force protection against the client IP addresses.
+	// Its store should be shared with the listeners, so that the lockout of a
+	// user is cleared when the administrator changes the credentials.
+	Throttle activesync.ThrottleConfig
+}
+
+// UserManager manages the user accounts, which is implemented by user.Manager.
+// The methods that change the password, the addresses, whether the user is
+// enabled, or the app passwords should record the change of the credentials,
+// so that the listeners invalidate the cached authentication results of the user.
+type UserManager interface {
+	GetUsers(lock database.LockMode) ([]user.User, error)
+	GetUser(name string, lock database.LockMode) (user.User, error)
+	AddUser(name, password, address string) (uid uint64, err error)
+	UpdatePassword(uid uint64, password string) error
+	UpdateAddress(uid uint64, address string) error
+	SetEnabled(uid uint64, enabled bool) error
+	DeleteUser(uid uint64) error
+	AddAlias(uid uint64, address string) error
+	RemoveAlias(uid uint64, address string) error
+	GetSendAs(uid uint64, lock database.LockMode) ([]string, error)
+	AddSendAs(uid uint64, address string) error
+	RemoveSendAs(uid uint64, address string) error
+	GetAppPasswords(uid uint64, lock database.LockMode) ([]user.AppPassword, error)
+	AddAppPassword(uid uint64, label, deviceID string) (id uint64, password string, err error)
+	RemoveAppPassword(uid, id uint64) error
+}
+
+// Server is an HTTP/JSON API for the administrators to manage users, their
+// folders, devices, security policies, and remote wipe requests. The schema of
+// the API is served as an OpenAPI document at /openapi.json.
+type Server struct {
+	config   Config
+	throttle *activesync.Throttle
+}
+
+func NewServer(conf Config) (*Server, error) {
+	if len(conf.Username) == 0 || len(conf.Password) == 0 {
+		return nil, errors.New("empty username or password")
+	}
+	if conf.Users == nil && conf.Directory == nil {
+		return nil, errors.New("nil users and directory")
+	}
+	if conf.Storage == nil || conf.DB == nil {
+		return nil, errors.New("nil storage or DB")
+	}
+	if _, ok := conf.ASStorage.(activesync.DeviceStorage); !ok {
+		return nil, errors.New("ActiveSync storage does not manage devices")
+	}
+	if conf.DrainTimeout == 0 {
+		conf.DrainTimeout = defaultDrainTimeout
+	}
+
+	return &Server{
+		config:   conf,
+		throttle: activesync.NewThrottle("admin", conf.Throttle),
+	}, nil
+}
+
+// Serve serves the API on l until ctx is canceled. On cancelation, Serve stops
+// accepting new connections, and then waits for in-flight requests to be
+// finished up to the drain timeout. Serve returns nil if the server has been
+// shut down by ctx.
+func (r *Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: r}
+	c := make(chan error, 1)
+	go func() {
+		c <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), r.config.DrainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		logger.Warning(fmt.Sprintf("admin: failed to drain in-flight requests on %v: %v", l.Addr(), err))
+		srv.Close()
+	}
+
+	return nil
+}
+
+func (r *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logger.Debug(fmt.Sprintf("admin: client=%v, method=%v, URL=%v", req.RemoteAddr, req.Method, req.URL))
+
+	// The schema is public.
+	if req.URL.Path == "/openapi.json" && req.Method == "GET" {
+		writeJSON(w, http.StatusOK, OpenAPI())
+		return
+	}
+
+	// The user name is not counted because there is only one administrator.
+	attempt := &activesync.Attempt{IP: activesync.RequestIP(req)}
+	if !r.throttle.CheckRequest(w, attempt) {
+		return
+	}
+	authorized := r.auth(req)
+	r.throttle.Update(attempt, authorized)
+	if !authorized {
+		username, _, _ := req.BasicAuth()
+		logger.Warning(fmt.Sprintf("admin: unauthorized: username=%v, client=%v", username, req.RemoteAddr))
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	route, params, allowed := match(req.Method, req.URL.EscapedPath())
+	if route == nil {
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", allowed)
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeError(w, http.StatusNotFound, "unknown resource")
+		return
+	}
+	r.handle(w, req, route, params)
+}
+
+func (r *Server) handle(w http.ResponseWriter, req *http.Request, route *route, params map[string]string) {
+	c := &call{
+		server: r,
+		req:    req,
+		params: params,
+		status: route.status,
+	}
+	var result interface{}
+	err := r.query(func(tx database.Transaction) (err error) {
+		c.tx = tx
+		result, err = route.handler(c)
+		return err
+	})
+	if err != nil {
+		if e, ok := err.(*apiError); ok {
+			writeError(w, e.status, e.message)
+			return
+		}
+		if isNotFound(err) {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if isDuplicated(err) {
+			writeError(w, http.StatusConflict, "already exists")
+			return
+		}
+		logger.Error(fmt.Sprintf("admin: failed to process %v %v: %v", req.Method, req.URL.Path, err))
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	logger.Info(fmt.Sprintf("admin: %v %v from %v", req.Method, req.URL.Path, req.RemoteAddr))
+	if len(c.location) > 0 {
+		w.Header().Set("Location", c.location)
+	}
+	if c.status == http.StatusNoContent {
+		w.WriteHeader(c.status)
+		return
+	}
+	writeJSON(w, c.status, result)
+}
+
+// auth returns whether req has the credential of the administrator.
+func (r *Server) auth(req *http.Request) bool {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Compare both of them to take the same time regardless of the username.
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(r.config.Username))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(r.config.Password))
+
+	return u&p == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Error(fmt.Sprintf("admin: failed to encode a response: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorObject{Error: message})
+}
+
+type errorObject struct {
+	Error string `json:"error"`
+}
+
+// apiError is an error that is reported to the client with its status code.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (r *apiError) Error() string {
+	return fmt.Sprintf("%v: %v", r.status, r.message)
+}
+
+func newError(status int, format string, args ...interface{}) error {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+func (r *Server) query(f func(tx database.Transaction) error) error {
+	tx := r.config.DB.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(database.NotFoundError)
+	if !ok {
+		return false
+	}
+
+	return e.IsNotFound()
+}
+
+func isDuplicated(err error) bool {
+	e, ok := err.(database.DuplicatedError)
+	if !ok {
+		return false
+	}
+
+	return e.IsDuplicated()
+}
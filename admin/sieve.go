@@ -0,0 +1,105 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+package admin
+
+import (
+	"net/http"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/sieve"
+)
+
+type sieveObject struct {
+	Script string `json:"script"`
+}
+
+// scripts returns the manager of the Sieve scripts, or an error if they are
+// not managed by this server.
+func (r *call) scripts() (sieve.ScriptManager, error) {
+	if r.server.config.Sieve == nil {
+		return nil, newError(http.StatusNotImplemented, "sieve scripts are not managed by this server")
+	}
+
+	return r.server.config.Sieve.NewScriptManager(r.tx), nil
+}
+
+func getSieve(c *call) (interface{}, error) {
+	m, err := c.scripts()
+	if err != nil {
+		return nil, err
+	}
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+	script, err := m.GetScript(cred.UserUID(), database.LockNone)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, newError(http.StatusNotFound, "no sieve script")
+		}
+		return nil, err
+	}
+
+	return sieveObject{Script: script}, nil
+}
+
+func setSieve(c *call) (interface{}, error) {
+	m, err := c.scripts()
+	if err != nil {
+		return nil, err
+	}
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+	req := sieveObject{}
+	if err := c.decode(&req); err != nil {
+		return nil, err
+	}
+	// Reject invalid scripts here because they are ignored on delivery.
+	if _, err := sieve.Parse(req.Script); err != nil {
+		return nil, newError(http.StatusBadRequest, "invalid sieve script: %v", err)
+	}
+
+	if err := m.SetScript(cred.UserUID(), req.Script); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func removeSieve(c *call) (interface{}, error) {
+	m, err := c.scripts()
+	if err != nil {
+		return nil, err
+	}
+	cred, err := c.credential()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.RemoveScript(cred.UserUID()); err != nil {
+		if isNotFound(err) {
+			return nil, newError(http.StatusNotFound, "no sieve script to remove")
+		}
+		return nil, err
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,367 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql/user"
+)
+
+type userObject struct {
+	UID     uint64   `json:"uid"`
+	Name    string   `json:"name"`
+	Address string   `json:"address"`
+	Aliases []string `json:"aliases"`
+	Enabled bool     `json:"enabled"`
+}
+
+// userDetailObject is a single user that also has the send-as addresses.
+type userDetailObject struct {
+	userObject
+	SendAs []string `json:"sendAs"`
+}
+
+func newUserObject(u user.User) userObject {
+	aliases := u.Aliases
+	if aliases == nil {
+		aliases = []string{}
+	}
+
+	return userObject{
+		UID:     u.UID,
+		Name:    u.Name,
+		Address: u.Address,
+		Aliases: aliases,
+		Enabled: u.Enabled,
+	}
+}
+
+func listUsers(c *call) (interface{}, error) {
+	m, err := c.users()
+	if err != nil {
+		return nil, err
+	}
+	users, err := m.GetUsers(database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]userObject, len(users))
+	for i, v := range users {
+		result[i] = newUserObject(v)
+	}
+
+	return result, nil
+}
+
+func getUser(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+
+	return showUser(m, u)
+}
+
+func showUser(m UserManager, u user.User) (interface{}, error) {
+	sendAs, err := m.GetSendAs(u.UID, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	if sendAs == nil {
+		sendAs = []string{}
+	}
+
+	return userDetailObject{userObject: newUserObject(u), SendAs: sendAs}, nil
+}
+
+func addUser(c *call) (interface{}, error) {
+	m, err := c.users()
+	if err != nil {
+		return nil, err
+	}
+	req := struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Address  string `json:"address"`
+	}{}
+	if err := c.decode(&req); err != nil {
+		return nil, err
+	}
+	if len(req.Name) == 0 || len(req.Password) == 0 || !isAddress(req.Address) {
+		return nil, newError(http.StatusBadRequest, "empty name or password, or invalid address")
+	}
+
+	if _, err := m.AddUser(req.Name, req.Password, req.Address); err != nil {
+		return nil, err
+	}
+	u, err := m.GetUser(req.Name, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	c.location = c.child(u.Name)
+
+	return showUser(m, u)
+}
+
+func updateUser(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+	req := struct {
+		Password *string `json:"password"`
+		Address  *string `json:"address"`
+		Enabled  *bool   `json:"enabled"`
+	}{}
+	if err := c.decode(&req); err != nil {
+		return nil, err
+	}
+
+	if req.Password != nil {
+		if len(*req.Password) == 0 {
+			return nil, newError(http.StatusBadRequest, "empty password")
+		}
+		if err := m.UpdatePassword(u.UID, *req.Password); err != nil {
+			return nil, err
+		}
+	}
+	if req.Address != nil {
+		if !isAddress(*req.Address) {
+			return nil, newError(http.StatusBadRequest, "invalid address: %v", *req.Address)
+		}
+		if err := m.UpdateAddress(u.UID, *req.Address); err != nil {
+			return nil, err
+		}
+	}
+	if req.Enabled != nil {
+		if err := m.SetEnabled(u.UID, *req.Enabled); err != nil {
+			return nil, err
+		}
+	}
+	if req.Password != nil || req.Enabled != nil {
+		// The user may have been locked out with the old credentials.
+		c.server.throttle.Reset(u.Name)
+	}
+	if u, err = m.GetUser(u.Name, database.LockNone); err != nil {
+		return nil, err
+	}
+
+	return showUser(m, u)
+}
+
+func deleteUser(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.DeleteUser(u.UID); err != nil {
+		return nil, err
+	}
+	// A new user of the same name should not inherit the lockout.
+	c.server.throttle.Reset(u.Name)
+
+	return nil, nil
+}
+
+// decodeAddress decodes a request body that has an email address.
+func (r *call) decodeAddress() (string, error) {
+	req := struct {
+		Address string `json:"address"`
+	}{}
+	if err := r.decode(&req); err != nil {
+		return "", err
+	}
+	if !isAddress(req.Address) {
+		return "", newError(http.StatusBadRequest, "invalid address: %v", req.Address)
+	}
+
+	return req.Address, nil
+}
+
+func addAlias(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+	address, err := c.decodeAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, m.AddAlias(u.UID, address)
+}
+
+func removeAlias(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, m.RemoveAlias(u.UID, c.params["address"])
+}
+
+func listSendAs(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := m.GetSendAs(u.UID, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	if addresses == nil {
+		addresses = []string{}
+	}
+
+	return addresses, nil
+}
+
+func addSendAs(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+	address, err := c.decodeAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, m.AddSendAs(u.UID, address)
+}
+
+func removeSendAs(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, m.RemoveSendAs(u.UID, c.params["address"])
+}
+
+type appPasswordObject struct {
+	ID    uint64 `json:"id"`
+	Label string `json:"label"`
+	// DeviceID is empty if any device can use the password.
+	DeviceID string  `json:"deviceId"`
+	Created  string  `json:"created"`
+	LastUsed *string `json:"lastUsed"`
+}
+
+func listAppPasswords(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	passwords, err := m.GetAppPasswords(u.UID, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]appPasswordObject, len(passwords))
+	for i, v := range passwords {
+		result[i] = appPasswordObject{
+			ID:       v.ID,
+			Label:    v.Label,
+			DeviceID: v.DeviceID,
+			Created:  formatTime(v.Created),
+			LastUsed: formatOptionalTime(v.LastUsed),
+		}
+	}
+
+	return result, nil
+}
+
+func addAppPassword(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+	req := struct {
+		Label    string `json:"label"`
+		DeviceID string `json:"deviceId"`
+	}{}
+	if err := c.decode(&req); err != nil {
+		return nil, err
+	}
+	if len(req.Label) == 0 {
+		return nil, newError(http.StatusBadRequest, "empty label")
+	}
+
+	id, password, err := m.AddAppPassword(u.UID, req.Label, req.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.location = c.child(strconv.FormatUint(id, 10))
+
+	// The plain text password cannot be retrieved later.
+	return map[string]interface{}{
+		"id":       id,
+		"password": password,
+	}, nil
+}
+
+func removeAppPassword(c *call) (interface{}, error) {
+	m, u, err := c.account(database.LockWrite)
+	if err != nil {
+		return nil, err
+	}
+	id, err := c.uintParam("id")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.RemoveAppPassword(u.UID, id); err != nil {
+		return nil, err
+	}
+	// The failures of the revoked password should not lock out the user.
+	c.server.throttle.Reset(u.Name)
+
+	return nil, nil
+}
+
+// isAddress returns whether s looks like an email address. The user manager
+// normalizes and validates it further.
+func isAddress(s string) bool {
+	i := strings.LastIndexByte(s, '@')
+	return i > 0 && i < len(s)-1 && !strings.ContainsAny(s, " \t\r\n<>")
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// formatOptionalTime returns nil if t is zero.
+func formatOptionalTime(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	v := formatTime(t)
+
+	return &v
+}
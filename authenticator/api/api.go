@@ -0,0 +1,180 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package api implements the backend.Authenticator interface using an external
+// authentication service that speaks HTTP/JSON.
+//
+// The authenticator sends a POST request whose body is a JSON object, such as
+// {"username": "alice", "password": "secret"}, to the configured endpoint. The
+// service account credential of the authenticator is given in the Authorization
+// header using the basic authentication scheme. The service should respond with
+// 200 OK and a JSON object, such as {"authorized": true, "uid": 1, "address":
+// "alice@example.com", "aliases": ["al@example.com"]}, regardless of whether
+// the user credential is correct or not. Any other status code is treated as
+// an error.
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+
+	"github.com/superkkt/logger"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	// Maximum size of a response body we read from the service.
+	maxResponseSize = 64 * 1024
+)
+
+type Config struct {
+	// URL is the endpoint of the authentication service, e.g., https://auth.example.com:8443/auth.
+	URL string
+	// Username and Password are the service account credential for the authentication service.
+	Username string
+	Password string
+	// Timeout is the maximum duration of a request to the service. Zero means the default timeout, which is 5 seconds.
+	Timeout time.Duration
+	// Transport is used to send requests to the service. Nil means http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+type Authenticator struct {
+	config Config
+	client *http.Client
+}
+
+func New(conf Config) (*Authenticator, error) {
+	if len(conf.URL) == 0 {
+		return nil, errors.New("empty URL")
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultTimeout
+	}
+
+	return &Authenticator{
+		config: conf,
+		client: &http.Client{
+			Timeout:   conf.Timeout,
+			Transport: conf.Transport,
+		},
+	}, nil
+}
+
+func (r *Authenticator) Auth(userID, password string) (backend.Credential, error) {
+	return r.request(userID, password)
+}
+
+type authRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type authResponse struct {
+	Authorized bool     `json:"authorized"`
+	UID        uint64   `json:"uid"`
+	Address    string   `json:"address"`
+	Aliases    []string `json:"aliases"`
+}
+
+func (r *Authenticator) request(userID, password string) (*credential, error) {
+	body, err := json.Marshal(authRequest{Username: userID, Password: password})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", r.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(r.config.Username, r.config.Password)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("api: failed to query the authentication service: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("api: failed to read the response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("api: unexpected response status from the authentication service: %v", resp.Status)
+	}
+
+	v := authResponse{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("api: invalid response: %v", err)
+	}
+	if !v.Authorized {
+		logger.Debug(fmt.Sprintf("api: unauthorized user: %v", userID))
+		return &credential{userID: userID}, nil
+	}
+	if v.UID == 0 {
+		return nil, fmt.Errorf("api: invalid user UID from the authentication service: username=%v", userID)
+	}
+
+	return &credential{
+		auth:    true,
+		userID:  userID,
+		userUID: v.UID,
+		address: v.Address,
+		aliases: v.Aliases,
+	}, nil
+}
+
+type credential struct {
+	auth    bool
+	userID  string
+	userUID uint64
+	address string
+	aliases []string
+}
+
+func (r *credential) IsAuthorized() bool {
+	return r.auth
+}
+
+func (r *credential) UserID() string {
+	return r.userID
+}
+
+func (r *credential) UserUID() uint64 {
+	return r.userUID
+}
+
+// Address returns the user's primary email address.
+func (r *credential) Address() string {
+	return r.address
+}
+
+// Aliases returns the user's alias email addresses.
+func (r *credential) Aliases() []string {
+	return r.aliases
+}
@@ -0,0 +1,150 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newService returns a stand-in of the authentication service that checks the
+// service account credential and answers alice/secret.
+func newService(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != "omega" || password != "service" {
+			t.Errorf("invalid service account credential: %v/%v", username, password)
+		}
+		if req.Method != "POST" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("invalid request: method=%v, content-type=%v", req.Method, req.Header.Get("Content-Type"))
+		}
+		handler(w, req)
+	}))
+}
+
+func answer(w http.ResponseWriter, req *http.Request) {
+	v := authRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v.Username != "alice" || v.Password != "secret" {
+		fmt.Fprint(w, `{"authorized": false}`)
+		return
+	}
+	fmt.Fprint(w, `{"authorized": true, "uid": 7, "address": "alice@example.com", "aliases": ["al@example.com"]}`)
+}
+
+func newAuthenticator(t *testing.T, url string, timeout time.Duration) *Authenticator {
+	auth, err := New(Config{URL: url, Username: "omega", Password: "service", Timeout: timeout})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	return auth
+}
+
+func TestAuthSuccess(t *testing.T) {
+	s := newService(t, answer)
+	defer s.Close()
+
+	c, err := newAuthenticator(t, s.URL, 0).Auth("alice", "secret")
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if !c.IsAuthorized() || c.UserID() != "alice" || c.UserUID() != 7 {
+		t.Fatalf("unexpected credential: authorized=%v, userID=%v, userUID=%v", c.IsAuthorized(), c.UserID(), c.UserUID())
+	}
+	v := c.(*credential)
+	if v.Address() != "alice@example.com" || len(v.Aliases()) != 1 || v.Aliases()[0] != "al@example.com" {
+		t.Fatalf("unexpected addresses: address=%v, aliases=%v", v.Address(), v.Aliases())
+	}
+}
+
+func TestAuthWrongPassword(t *testing.T) {
+	s := newService(t, answer)
+	defer s.Close()
+
+	c, err := newAuthenticator(t, s.URL, 0).Auth("alice", "wrong")
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if c.IsAuthorized() {
+		t.Fatal("authorized with a wrong password")
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"non-200 status", func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, `{"authorized": true, "uid": 7}`, http.StatusInternalServerError)
+		}},
+		{"malformed JSON", func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, `{"authorized": true, "uid": `)
+		}},
+		{"oversized JSON", func(w http.ResponseWriter, req *http.Request) {
+			// The body is truncated at the size limit, which breaks the JSON object.
+			fmt.Fprintf(w, `{"authorized": true, "uid": 7, "address": "%v@example.com"}`, strings.Repeat("a", maxResponseSize))
+		}},
+		{"zero UID", func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, `{"authorized": true, "uid": 0}`)
+		}},
+	}
+
+	for _, test := range tests {
+		s := newService(t, test.handler)
+		c, err := newAuthenticator(t, s.URL, 0).Auth("alice", "secret")
+		s.Close()
+		if err == nil {
+			t.Errorf("%v: expected an error, got a credential: authorized=%v", test.name, c.IsAuthorized())
+		}
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	done := make(chan struct{})
+	s := newService(t, func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		answer(w, req)
+	})
+	defer s.Close()
+	defer close(done)
+
+	start := time.Now()
+	_, err := newAuthenticator(t, s.URL, 100*time.Millisecond).Auth("alice", "secret")
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the request took %v despite the timeout", elapsed)
+	}
+}
@@ -0,0 +1,304 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package cache implements a decorator of backend.Authenticator that caches
+// authentication results to reduce the load of the underlying authenticator.
+//
+// ActiveSync clients send credentials with every request, including each Ping,
+// so most of the authentications are repeated with the same credentials. The
+// cache is keyed by a salted hash of the credentials, so plain text passwords
+// are never kept in memory. Successful results are cached for PositiveTTL and
+// failed results for NegativeTTL, which should be shorter so that a user who has
+// just changed the password can log in right away. Errors are never cached.
+//
+// Cached results of a user are invalidated as soon as the change of the user's
+// credentials is reported by a ChangeSource, e.g., the user table of the local
+// user database, which records the changes made by useradm and the admin API.
+package cache
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultPositiveTTL = 1 * time.Minute
+	defaultNegativeTTL = 10 * time.Second
+	defaultMaxEntries  = 65536
+	defaultWatchPeriod = 5 * time.Second
+)
+
+type Config struct {
+	// PositiveTTL is the lifetime of a cached successful authentication. Zero
+	// means the default TTL, which is 1 minute.
+	PositiveTTL time.Duration
+	// NegativeTTL is the lifetime of a cached failed authentication. Zero
+	// means the default TTL, which is 10 seconds.
+	NegativeTTL time.Duration
+	// MaxEntries is the maximum number of cached results. All entries are
+	// flushed if the cache is still full after purging expired entries. Zero
+	// means the default, which is 65536.
+	MaxEntries int
+	// WatchPeriod is the interval to poll the ChangeSource given to Watch.
+	// Zero means the default, which is 5 seconds.
+	WatchPeriod time.Duration
+}
+
+// ChangeSource reports users whose credentials, such as passwords and whether
+// they are enabled, have been changed.
+type ChangeSource interface {
+	// CredentialChanges returns the names of users whose credentials have been
+	// changed after cursor, and the cursor of the last change. The zero cursor
+	// means the beginning. last is cursor if there is no change.
+	CredentialChanges(cursor uint64) (names []string, last uint64, err error)
+}
+
+// Authenticator implements the backend.Authenticator and backend.DeviceAuthenticator
+// interfaces by caching the results of another authenticator.
+type Authenticator struct {
+	next   backend.Authenticator
+	config Config
+	// salt is a random value to hash credentials for the cache key.
+	salt []byte
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]entry
+	// users has cache keys of each user to invalidate them.
+	users map[string]map[[sha256.Size]byte]struct{}
+}
+
+type entry struct {
+	userID     string
+	credential backend.Credential
+	expiration time.Time
+}
+
+func New(next backend.Authenticator, conf Config) (*Authenticator, error) {
+	if next == nil {
+		return nil, errors.New("nil authenticator")
+	}
+	if conf.PositiveTTL == 0 {
+		conf.PositiveTTL = defaultPositiveTTL
+	}
+	if conf.NegativeTTL == 0 {
+		conf.NegativeTTL = defaultNegativeTTL
+	}
+	if conf.MaxEntries == 0 {
+		conf.MaxEntries = defaultMaxEntries
+	}
+	if conf.WatchPeriod == 0 {
+		conf.WatchPeriod = defaultWatchPeriod
+	}
+
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	return &Authenticator{
+		next:    next,
+		config:  conf,
+		salt:    salt,
+		entries: make(map[[sha256.Size]byte]entry),
+		users:   make(map[string]map[[sha256.Size]byte]struct{}),
+	}, nil
+}
+
+func (r *Authenticator) Auth(userID, password string) (backend.Credential, error) {
+	return r.auth(userID, password, "", func() (backend.Credential, error) {
+		return r.next.Auth(userID, password)
+	})
+}
+
+// AuthDevice passes deviceID to the underlying authenticator if it implements
+// backend.DeviceAuthenticator. Otherwise, AuthDevice is same as Auth.
+func (r *Authenticator) AuthDevice(userID, password, deviceID string) (backend.Credential, error) {
+	next, ok := r.next.(backend.DeviceAuthenticator)
+	if !ok {
+		return r.Auth(userID, password)
+	}
+
+	return r.auth(userID, password, deviceID, func() (backend.Credential, error) {
+		return next.AuthDevice(userID, password, deviceID)
+	})
+}
+
+func (r *Authenticator) auth(userID, password, deviceID string, f func() (backend.Credential, error)) (backend.Credential, error) {
+	key := r.key(userID, password, deviceID)
+	if c, ok := r.load(key); ok {
+		return c, nil
+	}
+
+	c, err := f()
+	if err != nil {
+		return nil, err
+	}
+	r.store(key, userID, c)
+
+	return c, nil
+}
+
+func (r *Authenticator) key(userID, password, deviceID string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(r.salt)
+	// Separators to distinguish ("ab", "c") from ("a", "bc").
+	h.Write([]byte(userID))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	h.Write([]byte{0})
+	h.Write([]byte(deviceID))
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+func (r *Authenticator) load(key [sha256.Size]byte) (backend.Credential, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(v.expiration) {
+		r.remove(key)
+		return nil, false
+	}
+
+	return v.credential, true
+}
+
+func (r *Authenticator) store(key [sha256.Size]byte, userID string, c backend.Credential) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if len(r.entries) >= r.config.MaxEntries {
+		r.purge(now)
+	}
+
+	ttl := r.config.NegativeTTL
+	if c.IsAuthorized() {
+		ttl = r.config.PositiveTTL
+	}
+	// User names are usually case-insensitive.
+	userID = strings.ToLower(userID)
+	r.entries[key] = entry{userID: userID, credential: c, expiration: now.Add(ttl)}
+	keys, ok := r.users[userID]
+	if !ok {
+		keys = make(map[[sha256.Size]byte]struct{})
+		r.users[userID] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// remove removes an entry whose key is key. The caller should hold the lock.
+func (r *Authenticator) remove(key [sha256.Size]byte) {
+	v, ok := r.entries[key]
+	if !ok {
+		return
+	}
+	delete(r.entries, key)
+
+	keys := r.users[v.userID]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(r.users, v.userID)
+	}
+}
+
+// purge removes expired entries, and then flushes all the entries if the cache
+// is still full. The caller should hold the lock.
+func (r *Authenticator) purge(now time.Time) {
+	for k, v := range r.entries {
+		if now.After(v.expiration) {
+			r.remove(k)
+		}
+	}
+	if len(r.entries) >= r.config.MaxEntries {
+		r.entries = make(map[[sha256.Size]byte]entry)
+		r.users = make(map[string]map[[sha256.Size]byte]struct{})
+	}
+}
+
+// Watch polls src every WatchPeriod, and invalidates the cached results of the
+// users reported by src until ctx is canceled. Changes made before Watch is
+// called are also reported, which is harmless because they just invalidate
+// nothing or stale results.
+func (r *Authenticator) Watch(ctx context.Context, src ChangeSource) {
+	ticker := time.NewTicker(r.config.WatchPeriod)
+	defer ticker.Stop()
+
+	var cursor uint64
+	for {
+		names, last, err := src.CredentialChanges(cursor)
+		if err != nil {
+			// Flush everything because we cannot know which users have been changed.
+			logger.Error(fmt.Sprintf("cache: failed to get the credential changes: %v", err))
+			r.Flush()
+		} else {
+			for _, v := range names {
+				logger.Debug(fmt.Sprintf("cache: invalidating the cached authentication results of %v", v))
+				r.Invalidate(v)
+			}
+			cursor = last
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Invalidate removes all the cached results of a user whose name is userID. It
+// is called by Watch when the user's credentials have been changed.
+func (r *Authenticator) Invalidate(userID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	userID = strings.ToLower(userID)
+	for k := range r.users[userID] {
+		delete(r.entries, k)
+	}
+	delete(r.users, userID)
+}
+
+// Flush removes all the cached results.
+func (r *Authenticator) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = make(map[[sha256.Size]byte]entry)
+	r.users = make(map[string]map[[sha256.Size]byte]struct{})
+}
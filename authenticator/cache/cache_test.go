@@ -0,0 +1,159 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+
+	"golang.org/x/net/context"
+)
+
+type credential struct {
+	userID string
+	auth   bool
+}
+
+func (r credential) IsAuthorized() bool { return r.auth }
+func (r credential) UserID() string     { return r.userID }
+func (r credential) UserUID() uint64    { return 1 }
+
+// countingAuth accepts the password "secret", and counts the calls.
+type countingAuth struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *countingAuth) Auth(userID, password string) (backend.Credential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls++
+	return credential{userID: userID, auth: password == "secret"}, nil
+}
+
+func (r *countingAuth) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.calls
+}
+
+// changes is a ChangeSource whose changes are appended by the test.
+type changes struct {
+	mu    sync.Mutex
+	names []string
+	// polled receives the cursor of each poll.
+	polled chan uint64
+}
+
+func (r *changes) add(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.names = append(r.names, name)
+}
+
+func (r *changes) CredentialChanges(cursor uint64) ([]string, uint64, error) {
+	r.polled <- cursor
+
+	r.mu.Lock()
+	names := r.names[cursor:]
+	last := uint64(len(r.names))
+	r.mu.Unlock()
+
+	return names, last, nil
+}
+
+func TestCache(t *testing.T) {
+	next := new(countingAuth)
+	c, err := New(next, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		v, err := c.Auth("alice", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !v.IsAuthorized() {
+			t.Fatal("expected an authorized credential")
+		}
+	}
+	if n := next.count(); n != 1 {
+		t.Fatalf("expected 1 call of the underlying authenticator, got %v", n)
+	}
+	// Different passwords are different entries.
+	if v, _ := c.Auth("alice", "wrong"); v.IsAuthorized() {
+		t.Fatal("expected an unauthorized credential")
+	}
+	if n := next.count(); n != 2 {
+		t.Fatalf("expected 2 calls of the underlying authenticator, got %v", n)
+	}
+
+	c.Invalidate("ALICE")
+	c.Auth("alice", "secret")
+	c.Auth("alice", "wrong")
+	if n := next.count(); n != 4 {
+		t.Fatalf("expected 4 calls of the underlying authenticator after invalidation, got %v", n)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	next := new(countingAuth)
+	c, err := New(next, Config{WatchPeriod: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Auth("alice", "secret")
+	c.Auth("bob", "secret")
+	src := &changes{polled: make(chan uint64)}
+	src.add("Alice")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Watch(ctx, src)
+		close(done)
+	}()
+	if cursor := <-src.polled; cursor != 0 {
+		t.Fatalf("expected the first poll from the beginning, got %v", cursor)
+	}
+	// The second poll starts after the first changes have been applied.
+	if cursor := <-src.polled; cursor != 1 {
+		t.Fatalf("expected the cursor 1, got %v", cursor)
+	}
+	cancel()
+	select {
+	case <-src.polled:
+	case <-done:
+	}
+
+	c.Auth("alice", "secret")
+	c.Auth("bob", "secret")
+	if n := next.count(); n != 3 {
+		t.Fatalf("expected only alice to be invalidated, got %v calls", n)
+	}
+}
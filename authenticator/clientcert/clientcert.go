@@ -0,0 +1,125 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package clientcert maps verified TLS client certificates to users. The
+// certificates should have been verified against trusted CAs by the TLS stack
+// before they are given to the authenticator.
+package clientcert
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+
+	"github.com/superkkt/logger"
+)
+
+type Mapping int
+
+const (
+	// Map the email addresses in the subject alternative names (SAN), or the
+	// emailAddress attribute of the subject if there is no email SAN, to the
+	// user who owns the address.
+	MappingEmail Mapping = iota
+	// Map the common name of the subject to the user whose name is the CN.
+	MappingCommonName
+)
+
+// OID of the emailAddress attribute (PKCS #9), which is deprecated but still
+// used by many CAs.
+var oidEmailAddress = []int{1, 2, 840, 113549, 1, 9, 1}
+
+// Authenticator implements the activesync.CertificateAuthenticator interface.
+type Authenticator struct {
+	dir     backend.Directory
+	mapping Mapping
+}
+
+func New(dir backend.Directory, mapping Mapping) (*Authenticator, error) {
+	if dir == nil {
+		return nil, errors.New("nil directory")
+	}
+	if mapping != MappingEmail && mapping != MappingCommonName {
+		return nil, fmt.Errorf("unknown mapping: %v", mapping)
+	}
+
+	return &Authenticator{
+		dir:     dir,
+		mapping: mapping,
+	}, nil
+}
+
+// AuthCertificate returns a credential of the user that the certificate is
+// mapped to. AuthCertificate returns an unauthorized credential if there is
+// no such user, or the certificate is mapped to multiple users.
+func (r *Authenticator) AuthCertificate(cert *x509.Certificate) (backend.Credential, error) {
+	if r.mapping == MappingCommonName {
+		name := cert.Subject.CommonName
+		if len(name) == 0 {
+			logger.Info(fmt.Sprintf("clientcert: empty common name: serial=%v", cert.SerialNumber))
+			return backend.Unauthorized, nil
+		}
+		return r.dir.LookupUser(name)
+	}
+
+	var result backend.Credential = backend.Unauthorized
+	for _, v := range addresses(cert) {
+		c, err := r.dir.LookupAddress(v)
+		if err != nil {
+			return nil, err
+		}
+		if !c.IsAuthorized() {
+			continue
+		}
+		// All the addresses should belong to the same user.
+		if result.IsAuthorized() && result.UserUID() != c.UserUID() {
+			logger.Warning(fmt.Sprintf("clientcert: a certificate is mapped to multiple users: serial=%v, users=%v,%v", cert.SerialNumber, result.UserID(), c.UserID()))
+			return backend.Unauthorized, nil
+		}
+		result = c
+	}
+	if !result.IsAuthorized() {
+		logger.Info(fmt.Sprintf("clientcert: no user for a certificate: serial=%v, subject=%v", cert.SerialNumber, cert.Subject.CommonName))
+	}
+
+	return result, nil
+}
+
+// addresses returns the email addresses of cert.
+func addresses(cert *x509.Certificate) []string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses
+	}
+
+	result := make([]string, 0)
+	for _, v := range cert.Subject.Names {
+		if !v.Type.Equal(oidEmailAddress) {
+			continue
+		}
+		if s, ok := v.Value.(string); ok && len(strings.TrimSpace(s)) > 0 {
+			result = append(result, strings.TrimSpace(s))
+		}
+	}
+
+	return result
+}
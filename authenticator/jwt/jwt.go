@@ -0,0 +1,294 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package jwt verifies JSON Web Tokens (RFC 7519) used as OAuth2 bearer access
+// tokens, and maps them to backend credentials.
+//
+// Tokens are validated offline against the configured keys. So, the keys should
+// be refreshed out of band when the identity provider rotates its signing keys.
+// Only the compact serialization of JWS is supported, and encrypted tokens (JWE)
+// and unsigned tokens (alg=none) are always rejected.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+
+	"github.com/superkkt/logger"
+)
+
+const (
+	defaultUserClaim = "sub"
+	defaultLeeway    = 1 * time.Minute
+)
+
+var (
+	errMalformed = errors.New("malformed token")
+	errSignature = errors.New("invalid signature")
+	errExpired   = errors.New("expired token")
+)
+
+type Config struct {
+	Keys *KeySet
+	// Issuer is the expected value of the iss claim.
+	Issuer string
+	// Audience is the value that the aud claim should contain. It prevents
+	// tokens issued for other services by the same identity provider.
+	Audience string
+	// UserClaim is the name of the claim that identifies the user, e.g.,
+	// preferred_username, upn, or email. Empty means the sub claim.
+	UserClaim string
+	// LookupAddress should be true if the user claim is an email address rather
+	// than a user name.
+	LookupAddress bool
+	// Directory is used to map the user claim to a backend credential.
+	Directory backend.Directory
+	// Leeway is the allowed clock skew for exp and nbf claims. Zero means the
+	// default leeway, which is 1 minute.
+	Leeway time.Duration
+}
+
+// Verifier verifies bearer tokens and returns credentials of their owners.
+type Verifier struct {
+	config Config
+}
+
+func New(conf Config) (*Verifier, error) {
+	if conf.Keys == nil || len(conf.Keys.keys) == 0 {
+		return nil, errors.New("empty key set")
+	}
+	if conf.Directory == nil {
+		return nil, errors.New("nil directory")
+	}
+	if len(conf.Issuer) == 0 || len(conf.Audience) == 0 {
+		return nil, errors.New("empty issuer or audience")
+	}
+	if len(conf.UserClaim) == 0 {
+		conf.UserClaim = defaultUserClaim
+	}
+	if conf.Leeway == 0 {
+		conf.Leeway = defaultLeeway
+	}
+
+	return &Verifier{
+		config: conf,
+	}, nil
+}
+
+type header struct {
+	Algorithm string   `json:"alg"`
+	KeyID     string   `json:"kid"`
+	Critical  []string `json:"crit"`
+}
+
+// Verify validates token and returns a credential of the user identified by
+// the token. Verify returns an unauthorized credential if the token is not
+// acceptable or the user does not exist in the directory. An error is returned
+// only if the directory fails.
+func (r *Verifier) Verify(token string) (backend.Credential, error) {
+	claims, err := r.parse(token)
+	if err != nil {
+		logger.Info(fmt.Sprintf("jwt: rejected a token: %v", err))
+		return backend.Unauthorized, nil
+	}
+	if err := r.validate(claims); err != nil {
+		logger.Info(fmt.Sprintf("jwt: rejected a token: %v", err))
+		return backend.Unauthorized, nil
+	}
+
+	user, ok := claims[r.config.UserClaim].(string)
+	if !ok || len(user) == 0 {
+		logger.Info(fmt.Sprintf("jwt: rejected a token: missing %v claim", r.config.UserClaim))
+		return backend.Unauthorized, nil
+	}
+	if r.config.LookupAddress {
+		return r.config.Directory.LookupAddress(user)
+	}
+
+	return r.config.Directory.LookupUser(user)
+}
+
+// parse verifies the signature of token and returns its claims.
+func (r *Verifier) parse(token string) (map[string]interface{}, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, errMalformed
+	}
+
+	h := header{}
+	if err := decodeJSON(segments[0], &h); err != nil {
+		return nil, errMalformed
+	}
+	// We do not understand any extension.
+	if len(h.Critical) > 0 {
+		return nil, fmt.Errorf("unsupported critical header: %v", h.Critical)
+	}
+	signature, err := decodeSegment(segments[2])
+	if err != nil {
+		return nil, errMalformed
+	}
+	if err := r.verify(h, []byte(segments[0]+"."+segments[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJSON(segments[1], &claims); err != nil {
+		return nil, errMalformed
+	}
+
+	return claims, nil
+}
+
+func (r *Verifier) verify(h header, input, signature []byte) error {
+	if len(h.Algorithm) != 5 {
+		return fmt.Errorf("unsupported algorithm: %v", h.Algorithm)
+	}
+
+	var hash crypto.Hash
+	switch h.Algorithm[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm: %v", h.Algorithm)
+	}
+	family := h.Algorithm[:2]
+
+	for _, k := range r.config.Keys.candidates(h.KeyID) {
+		if verifySignature(family, hash, k, input, signature) {
+			return nil
+		}
+	}
+
+	return errSignature
+}
+
+func verifySignature(family string, hash crypto.Hash, k key, input, signature []byte) bool {
+	switch family {
+	case "HS":
+		if k.secret == nil {
+			return false
+		}
+		mac := hmac.New(hash.New, k.secret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	switch family {
+	case "RS", "PS":
+		pub, ok := k.public.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		if family == "RS" {
+			return rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+		}
+		return rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		pub, ok := k.public.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		// The signature is the concatenation of R and S, each of which has the curve size.
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != size*2 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	default:
+		return false
+	}
+}
+
+func (r *Verifier) validate(claims map[string]interface{}) error {
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(r.config.Leeway)) {
+		return errExpired
+	}
+	if v, ok := claims["nbf"]; ok {
+		nbf, ok := v.(float64)
+		if !ok {
+			return errors.New("invalid nbf claim")
+		}
+		if now.Add(r.config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("token is not valid yet")
+		}
+	}
+	if iss, _ := claims["iss"].(string); iss != r.config.Issuer {
+		return fmt.Errorf("unexpected issuer: %v", iss)
+	}
+	if !hasAudience(claims["aud"], r.config.Audience) {
+		return fmt.Errorf("unexpected audience: %v", claims["aud"])
+	}
+
+	return nil
+}
+
+// hasAudience returns whether aud, which is either a string or an array of
+// strings, contains audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func decodeJSON(segment string, v interface{}) error {
+	data, err := decodeSegment(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,282 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+)
+
+const (
+	testIssuer   = "https://login.example.com/"
+	testAudience = "omega"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+type testCredential struct {
+	userID string
+	uid    uint64
+}
+
+func (r testCredential) IsAuthorized() bool { return r.uid > 0 }
+func (r testCredential) UserID() string     { return r.userID }
+func (r testCredential) UserUID() uint64    { return r.uid }
+
+type testDirectory struct{}
+
+func (r testDirectory) LookupUser(userID string) (backend.Credential, error) {
+	if userID != "alice" {
+		return backend.Unauthorized, nil
+	}
+	return testCredential{userID: "alice", uid: 1}, nil
+}
+
+func (r testDirectory) LookupAddress(address string) (backend.Credential, error) {
+	if address != "alice@example.com" {
+		return backend.Unauthorized, nil
+	}
+	return testCredential{userID: "alice", uid: 1}, nil
+}
+
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	ecdsa *ecdsa.PrivateKey
+	set   *KeySet
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+
+	set := new(KeySet)
+	if err := set.AddPublicKey("rsa", &rsaKey.PublicKey); err != nil {
+		t.Fatalf("AddPublicKey: %v", err)
+	}
+	if err := set.AddPublicKey("ec", &ecKey.PublicKey); err != nil {
+		t.Fatalf("AddPublicKey: %v", err)
+	}
+	set.AddSecret("hmac", testSecret)
+
+	return &testKeys{rsa: rsaKey, ecdsa: ecKey, set: set}
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// sign returns a token of claims whose header has alg and kid, and whose
+// signature is made by signer over the header and the claims.
+func sign(t *testing.T, alg, kid string, claims map[string]interface{}, signer func(input []byte) []byte) string {
+	input := encodeSegment(t, map[string]string{"alg": alg, "kid": kid}) + "." + encodeSegment(t, claims)
+	return input + "." + base64.RawURLEncoding.EncodeToString(signer([]byte(input)))
+}
+
+func (r *testKeys) signRS256(t *testing.T) func([]byte) []byte {
+	return func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, r.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("SignPKCS1v15: %v", err)
+		}
+		return sig
+	}
+}
+
+func (r *testKeys) signES256(t *testing.T) func([]byte) []byte {
+	return func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		x, y, err := ecdsa.Sign(rand.Reader, r.ecdsa, digest[:])
+		if err != nil {
+			t.Fatalf("ecdsa.Sign: %v", err)
+		}
+		sig := make([]byte, 64)
+		xb, yb := x.Bytes(), y.Bytes()
+		copy(sig[32-len(xb):32], xb)
+		copy(sig[64-len(yb):], yb)
+		return sig
+	}
+}
+
+func signHS256(secret []byte) func([]byte) []byte {
+	return func(input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+// validClaims returns the claims of a token that should be accepted.
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"sub": "alice",
+		"iss": testIssuer,
+		"aud": testAudience,
+		"exp": now.Add(time.Hour).Unix(),
+		"nbf": now.Add(-time.Minute).Unix(),
+	}
+}
+
+func withClaim(name string, value interface{}) map[string]interface{} {
+	c := validClaims()
+	if value == nil {
+		delete(c, name)
+	} else {
+		c[name] = value
+	}
+	return c
+}
+
+func TestNew(t *testing.T) {
+	keys := newTestKeys(t)
+	tests := []struct {
+		name string
+		conf Config
+	}{
+		{"empty keys", Config{Keys: new(KeySet), Directory: testDirectory{}, Issuer: testIssuer, Audience: testAudience}},
+		{"nil directory", Config{Keys: keys.set, Issuer: testIssuer, Audience: testAudience}},
+		{"empty issuer", Config{Keys: keys.set, Directory: testDirectory{}, Audience: testAudience}},
+		{"empty audience", Config{Keys: keys.set, Directory: testDirectory{}, Issuer: testIssuer}},
+	}
+	for _, test := range tests {
+		if _, err := New(test.conf); err == nil {
+			t.Errorf("%v: expected an error", test.name)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	v, err := New(Config{
+		Keys:      keys.set,
+		Issuer:    testIssuer,
+		Audience:  testAudience,
+		Directory: testDirectory{},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	now := time.Now()
+	unsigned := encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, validClaims()) + "."
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", sign(t, "RS256", "rsa", validClaims(), keys.signRS256(t)), true},
+		{"ES256", sign(t, "ES256", "ec", validClaims(), keys.signES256(t)), true},
+		{"HS256", sign(t, "HS256", "hmac", validClaims(), signHS256(testSecret)), true},
+		{"no key ID", sign(t, "RS256", "", validClaims(), keys.signRS256(t)), true},
+		{"audience array", sign(t, "RS256", "rsa", withClaim("aud", []string{"other", testAudience}), keys.signRS256(t)), true},
+		{"within leeway", sign(t, "RS256", "rsa", withClaim("exp", now.Add(-30*time.Second).Unix()), keys.signRS256(t)), true},
+		{"unknown user", sign(t, "RS256", "rsa", withClaim("sub", "bob"), keys.signRS256(t)), false},
+		{"bad signature", sign(t, "RS256", "rsa", validClaims(), func(input []byte) []byte {
+			sig := keys.signRS256(t)(input)
+			sig[0] ^= 0xff
+			return sig
+		}), false},
+		{"wrong secret", sign(t, "HS256", "hmac", validClaims(), signHS256([]byte("wrong"))), false},
+		// Extended claims with the signature of the original claims.
+		{"tampered claims", func() string {
+			orig := strings.Split(sign(t, "RS256", "rsa", validClaims(), keys.signRS256(t)), ".")
+			orig[1] = encodeSegment(t, withClaim("exp", now.Add(24*time.Hour).Unix()))
+			return strings.Join(orig, ".")
+		}(), false},
+		// An RSA signature labeled as another algorithm.
+		{"alg mismatch ES256", sign(t, "ES256", "rsa", validClaims(), keys.signRS256(t)), false},
+		{"alg mismatch PS256", sign(t, "PS256", "rsa", validClaims(), keys.signRS256(t)), false},
+		// The public key used as an HMAC secret.
+		{"alg mismatch HS256", sign(t, "HS256", "rsa", validClaims(), signHS256(keys.rsa.PublicKey.N.Bytes())), false},
+		{"none", unsigned, false},
+		{"none with signature", sign(t, "none", "", validClaims(), signHS256(testSecret)), false},
+		{"malformed", "abc.def", false},
+		{"expired", sign(t, "RS256", "rsa", withClaim("exp", now.Add(-time.Hour).Unix()), keys.signRS256(t)), false},
+		{"missing exp", sign(t, "RS256", "rsa", withClaim("exp", nil), keys.signRS256(t)), false},
+		{"not valid yet", sign(t, "RS256", "rsa", withClaim("nbf", now.Add(time.Hour).Unix()), keys.signRS256(t)), false},
+		{"invalid nbf", sign(t, "RS256", "rsa", withClaim("nbf", "now"), keys.signRS256(t)), false},
+		{"wrong issuer", sign(t, "RS256", "rsa", withClaim("iss", "https://evil.example.com/"), keys.signRS256(t)), false},
+		{"missing issuer", sign(t, "RS256", "rsa", withClaim("iss", nil), keys.signRS256(t)), false},
+		{"wrong audience", sign(t, "RS256", "rsa", withClaim("aud", "other"), keys.signRS256(t)), false},
+		{"wrong audience array", sign(t, "RS256", "rsa", withClaim("aud", []string{"other"}), keys.signRS256(t)), false},
+		{"missing audience", sign(t, "RS256", "rsa", withClaim("aud", nil), keys.signRS256(t)), false},
+		{"missing user claim", sign(t, "RS256", "rsa", withClaim("sub", nil), keys.signRS256(t)), false},
+	}
+	for _, test := range tests {
+		c, err := v.Verify(test.token)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+		if c.IsAuthorized() != test.ok {
+			t.Errorf("%v: expected authorized=%v, got %v", test.name, test.ok, c.IsAuthorized())
+			continue
+		}
+		if test.ok && c.UserID() != "alice" {
+			t.Errorf("%v: expected alice, got %v", test.name, c.UserID())
+		}
+	}
+}
+
+func TestVerifyLookupAddress(t *testing.T) {
+	keys := newTestKeys(t)
+	v, err := New(Config{
+		Keys:          keys.set,
+		Issuer:        testIssuer,
+		Audience:      testAudience,
+		UserClaim:     "email",
+		LookupAddress: true,
+		Directory:     testDirectory{},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	c, err := v.Verify(sign(t, "RS256", "rsa", withClaim("email", "alice@example.com"), keys.signRS256(t)))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !c.IsAuthorized() || c.UserID() != "alice" {
+		t.Fatalf("expected alice, got authorized=%v, user=%v", c.IsAuthorized(), c.UserID())
+	}
+}
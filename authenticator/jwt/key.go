@@ -0,0 +1,253 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// KeySet is a set of keys used to verify token signatures. The zero value is an empty set.
+type KeySet struct {
+	// keys with their key IDs. An empty key ID means a key that can be used for any token.
+	keys []key
+}
+
+type key struct {
+	id     string
+	public crypto.PublicKey
+	// secret is a shared secret for the HMAC algorithms.
+	secret []byte
+}
+
+// LoadKeySet reads keys from a file, which is either a JSON Web Key Set (RFC
+// 7517) or PEM encoded public keys and certificates.
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set := new(KeySet)
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		err = set.AddJWKS(data)
+	} else {
+		err = set.AddPEM(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	return set, nil
+}
+
+// AddSecret adds a shared secret for the HMAC algorithms.
+func (r *KeySet) AddSecret(id string, secret []byte) {
+	r.keys = append(r.keys, key{id: id, secret: secret})
+}
+
+// AddPublicKey adds an RSA or ECDSA public key.
+func (r *KeySet) AddPublicKey(id string, pub crypto.PublicKey) error {
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return fmt.Errorf("unsupported public key type: %T", pub)
+	}
+	r.keys = append(r.keys, key{id: id, public: pub})
+
+	return nil
+}
+
+// AddPEM adds public keys and certificates in PEM encoded data. The keys have
+// empty key IDs.
+func (r *KeySet) AddPEM(data []byte) error {
+	n := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var pub crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				pub = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := r.AddPublicKey("", pub); err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("no public key found")
+	}
+
+	return nil
+}
+
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+	// Symmetric
+	K string `json:"k"`
+}
+
+// AddJWKS adds keys in a JSON Web Key Set. Keys whose use is not "sig" and
+// keys of unsupported types are ignored.
+func (r *KeySet) AddJWKS(data []byte) error {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	n := 0
+	for _, v := range set.Keys {
+		if len(v.Use) > 0 && v.Use != "sig" {
+			continue
+		}
+		switch v.KeyType {
+		case "RSA":
+			pub, err := v.rsaPublicKey()
+			if err != nil {
+				return fmt.Errorf("invalid RSA key (kid=%v): %v", v.KeyID, err)
+			}
+			r.AddPublicKey(v.KeyID, pub)
+		case "EC":
+			pub, err := v.ecdsaPublicKey()
+			if err != nil {
+				return fmt.Errorf("invalid EC key (kid=%v): %v", v.KeyID, err)
+			}
+			r.AddPublicKey(v.KeyID, pub)
+		case "oct":
+			k, err := decodeSegment(v.K)
+			if err != nil || len(k) == 0 {
+				return fmt.Errorf("invalid symmetric key (kid=%v)", v.KeyID)
+			}
+			r.AddSecret(v.KeyID, k)
+		default:
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("no signing key found")
+	}
+
+	return nil
+}
+
+func (r jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := decodeSegment(r.N)
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("invalid modulus")
+	}
+	e, err := decodeSegment(r.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+func (r jwk) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch r.Curve {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve: %v", r.Curve)
+	}
+	x, err := decodeSegment(r.X)
+	if err != nil || len(x) == 0 {
+		return nil, errors.New("invalid x coordinate")
+	}
+	y, err := decodeSegment(r.Y)
+	if err != nil || len(y) == 0 {
+		return nil, errors.New("invalid y coordinate")
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("the point is not on the curve")
+	}
+
+	return pub, nil
+}
+
+// candidates returns keys that may have been used to sign a token whose key ID is id.
+func (r *KeySet) candidates(id string) []key {
+	result := make([]key, 0)
+	for _, v := range r.keys {
+		if len(id) == 0 || len(v.id) == 0 || v.id == id {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,436 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package ldap implements the backend.Authenticator and backend.Directory
+// interfaces using an LDAP directory, such as OpenLDAP and Active Directory.
+//
+// The authenticator first binds with the service account to search a user entry,
+// and then binds again with the user's DN and password to verify the password.
+// The user's UID is read from a numeric attribute of the entry, such as uidNumber.
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+
+	"github.com/superkkt/logger"
+	goldap "gopkg.in/ldap.v2"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+)
+
+type Security int
+
+const (
+	// Plain LDAP without any encryption. Use it for debugging purpose only.
+	SecurityNone Security = iota
+	// Upgrade a plain LDAP connection to TLS using the StartTLS extended operation.
+	SecurityStartTLS
+	// LDAP over TLS, which is also known as LDAPS.
+	SecurityTLS
+)
+
+type Config struct {
+	// Address is the LDAP server address in host:port form.
+	Address  string
+	Security Security
+	// TLSConfig is used for the StartTLS and TLS connections. Nil means the
+	// default configuration whose ServerName is the host part of Address.
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the service account credential to search users.
+	BindDN       string
+	BindPassword string
+	// BaseDN is the search base of user entries.
+	BaseDN string
+	// UserFilter is an LDAP filter to search a user entry by its login name.
+	// %s in the filter will be replaced with the escaped login name, e.g.,
+	// (&(objectClass=inetOrgPerson)(uid=%s)).
+	UserFilter string
+	// UIDAttribute is a numeric attribute of the user entry that is used as
+	// the user UID, e.g., uidNumber.
+	UIDAttribute string
+	// NameAttribute is an attribute of the user entry that has the login name,
+	// e.g., uid or sAMAccountName.
+	NameAttribute string
+	// MailAttribute is an attribute of the user entry that has the primary
+	// email address, e.g., mail.
+	MailAttribute string
+	// AliasAttribute is an optional attribute of the user entry that has
+	// alias email addresses, e.g., mailAlternateAddress or proxyAddresses.
+	AliasAttribute string
+	// EnabledFilter is an optional LDAP filter that enabled users should
+	// match, e.g., (!(userAccountControl:1.2.840.113556.1.4.803:=2)) for
+	// Active Directory.
+	EnabledFilter string
+	// GroupAttribute is an optional attribute of the user entry that has DNs of
+	// the groups which the user belongs to, e.g., memberOf. The name of a group
+	// is the value of the first RDN of its DN, e.g., cn.
+	GroupAttribute string
+	// GroupBaseDN and GroupFilter are optionally used to search groups which
+	// the user belongs to if the directory does not support GroupAttribute.
+	// %s in GroupFilter will be replaced with the escaped user DN, e.g.,
+	// (&(objectClass=groupOfNames)(member=%s)). The names of the groups are
+	// read from GroupNameAttribute, e.g., cn.
+	GroupBaseDN        string
+	GroupFilter        string
+	GroupNameAttribute string
+	// Timeout is the maximum duration of each LDAP operation. Zero means the
+	// default timeout, which is 5 seconds.
+	Timeout time.Duration
+}
+
+func (r *Config) validate() error {
+	if len(r.Address) == 0 {
+		return errors.New("empty address")
+	}
+	if len(r.BaseDN) == 0 {
+		return errors.New("empty base DN")
+	}
+	if strings.Count(r.UserFilter, "%s") != 1 {
+		return errors.New("user filter should have a single %s")
+	}
+	if len(r.UIDAttribute) == 0 || len(r.NameAttribute) == 0 || len(r.MailAttribute) == 0 {
+		return errors.New("empty UID, name, or mail attribute")
+	}
+	if len(r.GroupFilter) > 0 {
+		if strings.Count(r.GroupFilter, "%s") != 1 {
+			return errors.New("group filter should have a single %s")
+		}
+		if len(r.GroupBaseDN) == 0 || len(r.GroupNameAttribute) == 0 {
+			return errors.New("empty group base DN or group name attribute")
+		}
+	}
+
+	return nil
+}
+
+// Authenticator implements the backend.Authenticator and backend.Directory interfaces.
+type Authenticator struct {
+	config Config
+}
+
+func New(conf Config) (*Authenticator, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultTimeout
+	}
+	if conf.TLSConfig == nil {
+		host, _, err := net.SplitHostPort(conf.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %v", err)
+		}
+		conf.TLSConfig = &tls.Config{ServerName: host}
+	}
+
+	return &Authenticator{
+		config: conf,
+	}, nil
+}
+
+func (r *Authenticator) Auth(userID, password string) (backend.Credential, error) {
+	// An empty password means an unauthenticated bind that always succeeds.
+	if len(userID) == 0 || len(password) == 0 {
+		return &credential{userID: userID}, nil
+	}
+
+	conn, err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf(r.config.UserFilter, goldap.EscapeFilter(userID))
+	entry, err := r.search(conn, filter)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		logger.Debug(fmt.Sprintf("ldap: unknown user: %v", userID))
+		return &credential{userID: userID}, nil
+	}
+
+	// Verify the password by binding as the user.
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			logger.Debug(fmt.Sprintf("ldap: password mismatched: %v", userID))
+			return &credential{userID: userID}, nil
+		}
+		return nil, fmt.Errorf("ldap: failed to bind as %v: %v", entry.DN, err)
+	}
+	// Rebind as the service account because the user may not have a permission to search groups.
+	if err := r.bind(conn); err != nil {
+		return nil, err
+	}
+
+	return r.newCredential(conn, entry)
+}
+
+func (r *Authenticator) LookupUser(userID string) (backend.Credential, error) {
+	return r.lookup(userID, fmt.Sprintf(r.config.UserFilter, goldap.EscapeFilter(userID)))
+}
+
+func (r *Authenticator) LookupAddress(address string) (backend.Credential, error) {
+	v := goldap.EscapeFilter(address)
+	filter := fmt.Sprintf("(%v=%v)", r.config.MailAttribute, v)
+	if len(r.config.AliasAttribute) > 0 {
+		filter = fmt.Sprintf("(|%v(%v=%v))", filter, r.config.AliasAttribute, v)
+	}
+	// Only search the entries that match the user filter.
+	filter = fmt.Sprintf("(&%v%v)", strings.Replace(r.config.UserFilter, "%s", "*", 1), filter)
+
+	return r.lookup(address, filter)
+}
+
+func (r *Authenticator) lookup(key, filter string) (backend.Credential, error) {
+	conn, err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := r.search(conn, filter)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return &credential{userID: key}, nil
+	}
+
+	return r.newCredential(conn, entry)
+}
+
+// connect returns a new LDAP connection bound with the service account.
+func (r *Authenticator) connect() (*goldap.Conn, error) {
+	d := net.Dialer{Timeout: r.config.Timeout}
+	c, err := d.Dial("tcp", r.config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: failed to connect to %v: %v", r.config.Address, err)
+	}
+	if r.config.Security == SecurityTLS {
+		tc := tls.Client(c, r.config.TLSConfig)
+		tc.SetDeadline(time.Now().Add(r.config.Timeout))
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("ldap: TLS handshake with %v: %v", r.config.Address, err)
+		}
+		tc.SetDeadline(time.Time{})
+		c = tc
+	}
+
+	conn := goldap.NewConn(c, r.config.Security == SecurityTLS)
+	conn.Start()
+	conn.SetTimeout(r.config.Timeout)
+	if r.config.Security == SecurityStartTLS {
+		if err := conn.StartTLS(r.config.TLSConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: StartTLS with %v: %v", r.config.Address, err)
+		}
+	}
+	if err := r.bind(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (r *Authenticator) bind(conn *goldap.Conn) error {
+	// Anonymous search?
+	if len(r.config.BindDN) == 0 {
+		return nil
+	}
+	if err := conn.Bind(r.config.BindDN, r.config.BindPassword); err != nil {
+		return fmt.Errorf("ldap: failed to bind with the service account: %v", err)
+	}
+
+	return nil
+}
+
+// search returns a user entry that matches filter. search returns nil if there
+// is no matched entry, or the entry does not match the enabled filter.
+func (r *Authenticator) search(conn *goldap.Conn, filter string) (*goldap.Entry, error) {
+	if len(r.config.EnabledFilter) > 0 {
+		filter = fmt.Sprintf("(&%v%v)", filter, r.config.EnabledFilter)
+	}
+	attrs := []string{r.config.UIDAttribute, r.config.NameAttribute, r.config.MailAttribute}
+	if len(r.config.AliasAttribute) > 0 {
+		attrs = append(attrs, r.config.AliasAttribute)
+	}
+	if len(r.config.GroupAttribute) > 0 {
+		attrs = append(attrs, r.config.GroupAttribute)
+	}
+
+	// Size limit 2 to detect ambiguous entries.
+	req := goldap.NewSearchRequest(r.config.BaseDN, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		2, int(r.config.Timeout/time.Second), false, filter, attrs, nil)
+	result, err := conn.Search(req)
+	if err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+			return nil, fmt.Errorf("ldap: multiple entries matched with %v", filter)
+		}
+		return nil, fmt.Errorf("ldap: failed to search %v: %v", filter, err)
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, nil
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, fmt.Errorf("ldap: multiple entries matched with %v", filter)
+	}
+}
+
+func (r *Authenticator) newCredential(conn *goldap.Conn, entry *goldap.Entry) (*credential, error) {
+	uid, err := strconv.ParseUint(entry.GetAttributeValue(r.config.UIDAttribute), 10, 64)
+	if err != nil || uid == 0 {
+		return nil, fmt.Errorf("ldap: invalid %v attribute of %v", r.config.UIDAttribute, entry.DN)
+	}
+	c := &credential{
+		auth:    true,
+		userID:  entry.GetAttributeValue(r.config.NameAttribute),
+		userUID: uid,
+		address: strings.ToLower(entry.GetAttributeValue(r.config.MailAttribute)),
+	}
+	if len(r.config.AliasAttribute) > 0 {
+		for _, v := range entry.GetAttributeValues(r.config.AliasAttribute) {
+			c.aliases = append(c.aliases, normalizeAlias(v))
+		}
+	}
+	c.groups, err = r.getGroups(conn, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// normalizeAlias removes the "smtp:" prefix of Active Directory's proxyAddresses.
+func normalizeAlias(v string) string {
+	if i := strings.Index(v, ":"); i >= 0 && strings.EqualFold(v[:i], "smtp") {
+		v = v[i+1:]
+	}
+
+	return strings.ToLower(v)
+}
+
+// getGroups returns the names of the groups which the user of entry belongs
+// to. The name of a group DN in GroupAttribute is the value of its first RDN,
+// e.g., staff of cn=staff,ou=groups,dc=example,dc=com, so that it has the same
+// form as GroupNameAttribute.
+func (r *Authenticator) getGroups(conn *goldap.Conn, entry *goldap.Entry) ([]string, error) {
+	groups := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if len(name) == 0 || seen[strings.ToLower(name)] {
+			return
+		}
+		seen[strings.ToLower(name)] = true
+		groups = append(groups, name)
+	}
+
+	if len(r.config.GroupAttribute) > 0 {
+		for _, v := range entry.GetAttributeValues(r.config.GroupAttribute) {
+			name, err := groupName(v)
+			if err != nil {
+				logger.Warning(fmt.Sprintf("ldap: ignored an invalid group DN of %v: %v", entry.DN, err))
+				continue
+			}
+			add(name)
+		}
+	}
+	if len(r.config.GroupFilter) == 0 {
+		return groups, nil
+	}
+
+	filter := fmt.Sprintf(r.config.GroupFilter, goldap.EscapeFilter(entry.DN))
+	req := goldap.NewSearchRequest(r.config.GroupBaseDN, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, int(r.config.Timeout/time.Second), false, filter, []string{r.config.GroupNameAttribute}, nil)
+	result, err := conn.Search(req)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: failed to search groups of %v: %v", entry.DN, err)
+	}
+	for _, v := range result.Entries {
+		add(v.GetAttributeValue(r.config.GroupNameAttribute))
+	}
+
+	return groups, nil
+}
+
+// groupName returns the value of the first RDN of a group DN.
+func groupName(dn string) (string, error) {
+	v, err := goldap.ParseDN(dn)
+	if err != nil {
+		return "", err
+	}
+	if len(v.RDNs) == 0 || len(v.RDNs[0].Attributes) == 0 {
+		return "", fmt.Errorf("empty DN: %v", dn)
+	}
+
+	return v.RDNs[0].Attributes[0].Value, nil
+}
+
+type credential struct {
+	auth    bool
+	userID  string
+	userUID uint64
+	address string
+	aliases []string
+	groups  []string
+}
+
+func (r *credential) IsAuthorized() bool {
+	return r.auth
+}
+
+func (r *credential) UserID() string {
+	return r.userID
+}
+
+func (r *credential) UserUID() uint64 {
+	return r.userUID
+}
+
+// Address returns the user's primary email address.
+func (r *credential) Address() string {
+	return r.address
+}
+
+// Aliases returns the user's alias email addresses.
+func (r *credential) Aliases() []string {
+	return r.aliases
+}
+
+func (r *credential) Groups() []string {
+	return r.groups
+}
@@ -0,0 +1,370 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package ldap
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/superkkt/omega/backend"
+
+	ber "gopkg.in/asn1-ber.v1"
+	goldap "gopkg.in/ldap.v2"
+)
+
+const (
+	serviceDN       = "cn=omega,dc=example,dc=com"
+	servicePassword = "service"
+	aliceDN         = "uid=alice,ou=people,dc=example,dc=com"
+	alicePassword   = "secret"
+)
+
+type entry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// server is an in-process LDAP stand-in that answers simple binds, and
+// searches whose filters exactly match the keys of entries.
+type server struct {
+	t         *testing.T
+	listener  net.Listener
+	passwords map[string]string
+	entries   map[string][]entry
+
+	mutex   sync.Mutex
+	filters []string
+}
+
+func newServer(t *testing.T, entries map[string][]entry) *server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := &server{
+		t:        t,
+		listener: l,
+		passwords: map[string]string{
+			serviceDN: servicePassword,
+			aliceDN:   alicePassword,
+		},
+		entries: entries,
+	}
+	go s.serve()
+
+	return s
+}
+
+func (r *server) close() {
+	r.listener.Close()
+}
+
+func (r *server) serve() {
+	for {
+		c, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(c)
+	}
+}
+
+func (r *server) handle(c net.Conn) {
+	defer c.Close()
+
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case goldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			code := goldap.LDAPResultSuccess
+			if password, ok := r.passwords[dn]; !ok || password != op.Children[2].Data.String() {
+				code = goldap.LDAPResultInvalidCredentials
+			}
+			r.write(c, id, result(goldap.ApplicationBindResponse, code))
+		case goldap.ApplicationSearchRequest:
+			filter, err := goldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				r.t.Errorf("invalid filter: %v", err)
+				return
+			}
+			r.mutex.Lock()
+			r.filters = append(r.filters, filter)
+			r.mutex.Unlock()
+			for _, v := range r.entries[filter] {
+				r.write(c, id, v.packet())
+			}
+			r.write(c, id, result(goldap.ApplicationSearchResultDone, goldap.LDAPResultSuccess))
+		case goldap.ApplicationUnbindRequest:
+			return
+		default:
+			r.t.Errorf("unexpected LDAP operation: %v", op.Tag)
+			return
+		}
+	}
+}
+
+func (r *server) write(c net.Conn, id int64, op *ber.Packet) {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	p.AppendChild(op)
+	c.Write(p.Bytes())
+}
+
+func result(tag ber.Tag, code int) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+
+	return p
+}
+
+func (r entry) packet() *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, r.dn, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range r.attributes {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	p.AppendChild(attrs)
+
+	return p
+}
+
+var alice = entry{
+	dn: aliceDN,
+	attributes: map[string][]string{
+		"uidNumber":   {"1001"},
+		"uid":         {"alice"},
+		"mail":        {"Alice@Example.com"},
+		"mailAlias":   {"smtp:Al@Example.com", "alice.smith@example.com"},
+		"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com", "cn=Admins,ou=groups,dc=example,dc=com"},
+		"objectClass": {"person"},
+	},
+}
+
+var groups = []entry{
+	{dn: "cn=admins,ou=groups,dc=example,dc=com", attributes: map[string][]string{"cn": {"admins"}}},
+	{dn: "cn=mail,ou=groups,dc=example,dc=com", attributes: map[string][]string{"cn": {"mail"}}},
+}
+
+func newAuthenticator(t *testing.T, s *server, f func(*Config)) *Authenticator {
+	conf := Config{
+		Address:        s.listener.Addr().String(),
+		Security:       SecurityNone,
+		BindDN:         serviceDN,
+		BindPassword:   servicePassword,
+		BaseDN:         "dc=example,dc=com",
+		UserFilter:     "(&(objectClass=person)(uid=%s))",
+		UIDAttribute:   "uidNumber",
+		NameAttribute:  "uid",
+		MailAttribute:  "mail",
+		AliasAttribute: "mailAlias",
+	}
+	if f != nil {
+		f(&conf)
+	}
+	auth, err := New(conf)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	return auth
+}
+
+func TestAuth(t *testing.T) {
+	s := newServer(t, map[string][]entry{
+		"(&(objectClass=person)(uid=alice))": {alice},
+	})
+	defer s.close()
+	auth := newAuthenticator(t, s, nil)
+
+	c, err := auth.Auth("alice", alicePassword)
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if !c.IsAuthorized() || c.UserID() != "alice" || c.UserUID() != 1001 {
+		t.Fatalf("unexpected credential: authorized=%v, userID=%v, userUID=%v", c.IsAuthorized(), c.UserID(), c.UserUID())
+	}
+	v := c.(backend.AddressCredential)
+	if v.Address() != "alice@example.com" {
+		t.Errorf("unexpected address: %v", v.Address())
+	}
+	if aliases := []string{"al@example.com", "alice.smith@example.com"}; !reflect.DeepEqual(v.Aliases(), aliases) {
+		t.Errorf("unexpected aliases: %v", v.Aliases())
+	}
+
+	for _, test := range []struct{ userID, password string }{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"bob", "secret"},
+	} {
+		c, err := auth.Auth(test.userID, test.password)
+		if err != nil {
+			t.Fatalf("Auth(%v, %v): %v", test.userID, test.password, err)
+		}
+		if c.IsAuthorized() {
+			t.Errorf("Auth(%v, %v) is authorized", test.userID, test.password)
+		}
+	}
+}
+
+func TestEnabledFilter(t *testing.T) {
+	s := newServer(t, map[string][]entry{
+		"(&(objectClass=person)(uid=alice))": {alice},
+	})
+	defer s.close()
+	auth := newAuthenticator(t, s, func(c *Config) {
+		c.EnabledFilter = "(!(locked=TRUE))"
+	})
+
+	// The stand-in returns nothing for the filter with the enabled filter.
+	c, err := auth.Auth("alice", alicePassword)
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if c.IsAuthorized() {
+		t.Fatal("authorized a user who does not match the enabled filter")
+	}
+	if expected := "(&(&(objectClass=person)(uid=alice))(!(locked=TRUE)))"; len(s.filters) != 1 || s.filters[0] != expected {
+		t.Fatalf("unexpected filters: %v", s.filters)
+	}
+}
+
+func TestAmbiguousUser(t *testing.T) {
+	s := newServer(t, map[string][]entry{
+		"(&(objectClass=person)(uid=alice))": {alice, alice},
+	})
+	defer s.close()
+
+	if _, err := newAuthenticator(t, s, nil).Auth("alice", alicePassword); err == nil {
+		t.Fatal("expected an error for multiple entries")
+	}
+}
+
+func TestLookupAddress(t *testing.T) {
+	s := newServer(t, map[string][]entry{
+		"(&(&(objectClass=person)(uid=*))(|(mail=al@example.com)(mailAlias=al@example.com)))": {alice},
+	})
+	defer s.close()
+	auth := newAuthenticator(t, s, nil)
+
+	c, err := auth.LookupAddress("al@example.com")
+	if err != nil {
+		t.Fatalf("LookupAddress: %v", err)
+	}
+	if !c.IsAuthorized() || c.UserID() != "alice" {
+		t.Fatalf("unexpected credential: authorized=%v, userID=%v", c.IsAuthorized(), c.UserID())
+	}
+
+	c, err = auth.LookupAddress("nobody@example.com")
+	if err != nil {
+		t.Fatalf("LookupAddress: %v", err)
+	}
+	if c.IsAuthorized() {
+		t.Fatal("found an unknown address")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	s := newServer(t, map[string][]entry{
+		"(&(objectClass=person)(uid=alice))":                    {alice},
+		"(&(objectClass=groupOfNames)(member=" + aliceDN + "))": groups,
+	})
+	defer s.close()
+
+	tests := []struct {
+		name     string
+		config   func(*Config)
+		expected []string
+	}{
+		{
+			"attribute",
+			func(c *Config) { c.GroupAttribute = "memberOf" },
+			[]string{"staff", "Admins"},
+		},
+		{
+			"filter",
+			func(c *Config) {
+				c.GroupBaseDN = "ou=groups,dc=example,dc=com"
+				c.GroupFilter = "(&(objectClass=groupOfNames)(member=%s))"
+				c.GroupNameAttribute = "cn"
+			},
+			[]string{"admins", "mail"},
+		},
+		{
+			// Both of them are names, and the duplicated admins is removed.
+			"both",
+			func(c *Config) {
+				c.GroupAttribute = "memberOf"
+				c.GroupBaseDN = "ou=groups,dc=example,dc=com"
+				c.GroupFilter = "(&(objectClass=groupOfNames)(member=%s))"
+				c.GroupNameAttribute = "cn"
+			},
+			[]string{"staff", "Admins", "mail"},
+		},
+	}
+	for _, test := range tests {
+		c, err := newAuthenticator(t, s, test.config).LookupUser("alice")
+		if err != nil {
+			t.Fatalf("%v: LookupUser: %v", test.name, err)
+		}
+		groups := c.(backend.GroupCredential).Groups()
+		if !reflect.DeepEqual(groups, test.expected) {
+			t.Errorf("%v: unexpected groups: %v", test.name, groups)
+		}
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	tests := []struct {
+		dn       string
+		expected string
+		valid    bool
+	}{
+		{"cn=staff,ou=groups,dc=example,dc=com", "staff", true},
+		{"CN=Domain Admins,CN=Users,DC=example,DC=com", "Domain Admins", true},
+		{`cn=a\,b,ou=groups`, "a,b", true},
+		{"", "", false},
+		{"invalid", "", false},
+	}
+	for _, test := range tests {
+		name, err := groupName(test.dn)
+		if (err == nil) != test.valid || name != test.expected {
+			t.Errorf("groupName(%q) = %q, %v", test.dn, name, err)
+		}
+	}
+}
@@ -23,6 +23,16 @@ type Authenticator interface {
 	Auth(userID, password string) (Credential, error)
 }
 
+// DeviceAuthenticator is an optional interface implemented by authenticators
+// that support device-specific passwords. The ActiveSync listener uses it, if
+// available, to pass the DeviceId of the request.
+type DeviceAuthenticator interface {
+	Authenticator
+	// AuthDevice is same as Auth except that password can be an app password
+	// bound to the device whose ActiveSync DeviceId is deviceID.
+	AuthDevice(userID, password, deviceID string) (Credential, error)
+}
+
 type Credential interface {
 	// IsAuthorized returns true only if this credential is correct.
 	IsAuthorized() bool
@@ -31,3 +41,56 @@ type Credential interface {
 	// UserUID returns user's unique identifier.
 	UserUID() uint64
 }
+
+// Unauthorized is a credential that is not authorized, which is returned if
+// the user cannot be identified.
+var Unauthorized Credential = unauthorized{}
+
+type unauthorized struct{}
+
+func (r unauthorized) IsAuthorized() bool {
+	return false
+}
+
+func (r unauthorized) UserID() string {
+	return ""
+}
+
+func (r unauthorized) UserUID() uint64 {
+	return 0
+}
+
+// AddressCredential is an optional interface implemented by credentials that
+// know the email addresses of the user. The addresses are used to validate the
+// sender of outgoing emails.
+type AddressCredential interface {
+	Credential
+	// Address returns the user's primary email address.
+	Address() string
+	// Aliases returns the user's alias email addresses.
+	Aliases() []string
+}
+
+// GroupCredential is an optional interface implemented by credentials that
+// know the groups which the user belongs to. The groups can be used to assign
+// policies to the user.
+type GroupCredential interface {
+	Credential
+	// Groups returns names of the groups which the user belongs to.
+	Groups() []string
+}
+
+// Directory looks up users without verifying their passwords. A credential
+// returned by Directory is authorized if the user exists and is allowed to log
+// in, but it does not mean that the user has been authenticated. So, use it
+// only after the user has been authenticated in another way, e.g., a client
+// certificate, or to deliver emails to the user.
+type Directory interface {
+	// LookupUser returns a credential of a user whose name is userID. LookupUser
+	// returns an unauthorized credential if there is no such user.
+	LookupUser(userID string) (Credential, error)
+	// LookupAddress returns a credential of a user who owns the email address,
+	// which can be either a primary or an alias address. LookupAddress returns
+	// an unauthorized credential if there is no such user.
+	LookupAddress(address string) (Credential, error)
+}
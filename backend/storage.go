@@ -55,7 +55,8 @@ type FolderManager interface {
 	// the path. For example, "/a/b/c" should be represented as []string{"a",
 	// "b", "c"}. It is necessary to acquire a read or write lock depending
 	// on the lock mode for the fetched folder to prevent any concurrent
-	// updates from another transaction.
+	// updates from another transaction. GetFolderByPath returns
+	// database.ErrNotFound if there is no folder on the path.
 	GetFolderByPath(path []string, lock database.LockMode) (folder Folder, err error)
 
 	// GetFolderByType returns folders whose type is same with t. It is 
@@ -117,6 +118,8 @@ const (
 	// Emails waiting to be sent out will be placed in the OUTBOX, and after
 	// its sent out, it would be in the SENT folder.
 	EmailOutbox
+	// Emails judged as spam by a content scanner.
+	EmailJunk
 )
 
 type FolderHistory interface {
@@ -24,7 +24,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"strings"
+	"time"
+
+	"github.com/superkkt/omega/cmd/internal/daemon"
 
 	"github.com/dlintw/goconf"
 	"github.com/superkkt/logger"
@@ -43,20 +47,131 @@ type Config struct {
 		KeyFile  string
 	}
 	AllowHTTP bool
-	SMTP      SMTP
-	Auth      AuthAPI
+	// Maximum duration to wait for in-flight requests while shutting down.
+	DrainTimeout time.Duration
+	SMTP         SMTP
+	DKIM         DKIM
+	Outbox       Outbox
+	// SenderPolicy is one of "reject", "rewrite", and "allow", which is applied
+	// to emails from addresses that the user cannot send as.
+	SenderPolicy string
+	// SenderAllowUnverified allows emails of users who have no email address
+	// without the sender validation.
+	SenderAllowUnverified bool
+	Delivery              Delivery
+	Scanner               Scanner
+	Auth                  daemon.AuthConfig
+	HTTPAuth              HTTPAuth
+	ClientCert            ClientCert
+	Throttle              daemon.ThrottleConfig
 }
 
-type AuthAPI struct {
-	Host     string
-	Port     uint16
+type ClientCert struct {
+	// Policy is one of "password", "cert", and "cert+password".
+	Policy string
+	// CAFile is a PEM file that has CA certificates to verify client certificates.
+	CAFile string
+	// Mapping is one of "email" and "cn".
+	Mapping string
+}
+
+type HTTPAuth struct {
+	// Basic and Bearer represent whether the listener accepts the basic and the bearer authentication schemes.
+	Basic  bool
+	Bearer bool
+	// KeyFile is a JWKS or PEM file that has keys to verify bearer tokens.
+	KeyFile  string
+	Issuer   string
+	Audience string
+	// UserClaim is the name of the token claim that identifies the user.
+	UserClaim string
+	// LookupAddress is true if the user claim is an email address.
+	LookupAddress bool
+	Leeway        time.Duration
+}
+
+type SMTP struct {
+	// Mode is "relay" to send emails through Host, or "mx" to deliver them
+	// directly to the MX hosts of the recipient domains.
+	Mode string
+	// HELO is the hostname sent to MX hosts. Empty means the system hostname.
+	HELO string
+	// Resolvers are the DNS servers (host:port) to look up MX records. Empty
+	// means the servers in /etc/resolv.conf.
+	Resolvers []string
+	// VerifyTLS requires valid certificates of MX hosts that support STARTTLS.
+	VerifyTLS bool
+	Host      string
+	Port      uint16
+	// Security is one of "none", "starttls", and "tls".
+	Security string
+	// Skip verification of the server certificate? Use it for debugging purpose only.
+	InsecureSkipVerify bool
+	// CAFile is an optional PEM file that has CA certificates to verify the server certificate.
+	CAFile   string
 	Username string
 	Password string
+	// Mechanism is the SMTP AUTH mechanism. Empty means the automatic selection.
+	Mechanism string
 }
 
-type SMTP struct {
-	Host string
-	Port uint16
+type Delivery struct {
+	// LMTP and SMTP are the addresses to receive emails. An LMTP address can
+	// be an absolute path of a UNIX domain socket. Empty disables it.
+	LMTP string
+	SMTP string
+	// Hostname is used in greetings and Received headers. Empty means the system hostname.
+	Hostname string
+	// MaxSize is the maximum size of a message in bytes. Zero means the default.
+	MaxSize int64
+	// StartTLS offers STARTTLS using the certificate of the ActiveSync listener.
+	StartTLS bool
+	// Sieve runs the Sieve scripts of users on delivery.
+	Sieve bool
+	// Authenticate verifies SPF, DKIM, and DMARC of inbound emails.
+	Authenticate bool
+	// EnforceDMARC applies the DMARC policies of sender domains.
+	EnforceDMARC bool
+	// Resolvers are the name servers for the authentication. Empty means the
+	// name servers in /etc/resolv.conf.
+	Resolvers []string
+}
+
+type Scanner struct {
+	// Spamd and Clamd are the addresses of the daemons. Empty disables it.
+	Spamd string
+	// SpamdUser is the user whose preferences spamd uses.
+	SpamdUser string
+	// SpamdRejectScore is the spam score from which emails are rejected. Zero disables it.
+	SpamdRejectScore float64
+	Clamd            string
+	// ClamdVerdict is either "reject" or "quarantine", which is applied to infected emails.
+	ClamdVerdict string
+	// Inbound and Outbound decide the directions of emails to scan.
+	Inbound  bool
+	Outbound bool
+}
+
+type DKIM struct {
+	Keys []DKIMKey
+	// Headers are the header fields to sign. Empty means the default fields.
+	Headers []string
+}
+
+type DKIMKey struct {
+	Domain   string
+	Selector string
+	// KeyFile is a PEM file that has the RSA private key.
+	KeyFile string
+}
+
+type Outbox struct {
+	// Hostname is used in bounce messages. Empty means the system hostname.
+	Hostname         string
+	PollInterval     time.Duration
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	MaxAge           time.Duration
 }
 
 type DSN struct {
@@ -105,6 +220,33 @@ func (r *Config) Read(configFile string) error {
 	if err := r.readSMTPSection(c); err != nil {
 		return err
 	}
+	if err := r.readDKIMSection(c); err != nil {
+		return err
+	}
+	if err := r.readOutboxSection(c); err != nil {
+		return err
+	}
+	if err := r.readDeliverySection(c); err != nil {
+		return err
+	}
+	if err := r.readSenderSection(c); err != nil {
+		return err
+	}
+	if err := r.readScannerSection(c); err != nil {
+		return err
+	}
+	if err := r.Auth.Read(c); err != nil {
+		return err
+	}
+	if err := r.readHTTPAuthSection(c); err != nil {
+		return err
+	}
+	if err := r.readClientCertSection(c); err != nil {
+		return err
+	}
+	if err := r.Throttle.Read(c); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -147,6 +289,15 @@ func (r *Config) readDefaultSection(c *goconf.ConfigFile) error {
 		return errors.New("invalid default/allow_http value")
 	}
 
+	// drain_timeout is optional.
+	if c.HasOption("default", "drain_timeout") {
+		timeout, err := c.GetInt("default", "drain_timeout")
+		if err != nil || timeout <= 0 {
+			return errors.New("invalid default/drain_timeout value")
+		}
+		r.DrainTimeout = time.Duration(timeout) * time.Second
+	}
+
 	return nil
 }
 
@@ -190,6 +341,22 @@ func (r *Config) readDatabaseSection(c *goconf.ConfigFile) error {
 func (r *Config) readSMTPSection(c *goconf.ConfigFile) error {
 	var err error
 
+	r.SMTP.Mode = "relay"
+	if c.HasOption("smtp", "mode") {
+		mode, err := c.GetString("smtp", "mode")
+		if err != nil {
+			return errors.New("invalid smtp/mode value")
+		}
+		r.SMTP.Mode = strings.ToLower(mode)
+		switch r.SMTP.Mode {
+		case "relay":
+		case "mx":
+			return r.readSMTPMXOptions(c)
+		default:
+			return fmt.Errorf("invalid smtp/mode value: %v", mode)
+		}
+	}
+
 	r.SMTP.Host, err = c.GetString("smtp", "host")
 	if err != nil || len(r.SMTP.Host) == 0 {
 		return errors.New("empty smtp/host value")
@@ -201,5 +368,434 @@ func (r *Config) readSMTPSection(c *goconf.ConfigFile) error {
 	}
 	r.SMTP.Port = uint16(port)
 
+	// Others are optional.
+	r.SMTP.Security = "none"
+	if c.HasOption("smtp", "security") {
+		security, err := c.GetString("smtp", "security")
+		if err != nil {
+			return errors.New("invalid smtp/security value")
+		}
+		r.SMTP.Security = strings.ToLower(security)
+		switch r.SMTP.Security {
+		case "none", "starttls", "tls":
+		default:
+			return fmt.Errorf("invalid smtp/security value: %v", security)
+		}
+	}
+	if c.HasOption("smtp", "insecure_skip_verify") {
+		r.SMTP.InsecureSkipVerify, err = c.GetBool("smtp", "insecure_skip_verify")
+		if err != nil {
+			return errors.New("invalid smtp/insecure_skip_verify value")
+		}
+	}
+	if c.HasOption("smtp", "ca_file") {
+		r.SMTP.CAFile, err = c.GetString("smtp", "ca_file")
+		if err != nil || len(r.SMTP.CAFile) == 0 || r.SMTP.CAFile[0] != '/' {
+			return errors.New("smtp/ca_file should be specified as an absolute path")
+		}
+	}
+	if c.HasOption("smtp", "username") {
+		r.SMTP.Username, err = c.GetString("smtp", "username")
+		if err != nil {
+			return errors.New("invalid smtp/username value")
+		}
+		r.SMTP.Password, err = c.GetString("smtp", "password")
+		if err != nil {
+			return errors.New("invalid smtp/password value")
+		}
+	}
+	if c.HasOption("smtp", "auth") {
+		r.SMTP.Mechanism, err = c.GetString("smtp", "auth")
+		if err != nil {
+			return errors.New("invalid smtp/auth value")
+		}
+		r.SMTP.Mechanism = strings.ToUpper(r.SMTP.Mechanism)
+		switch r.SMTP.Mechanism {
+		case "AUTO":
+			r.SMTP.Mechanism = ""
+		case "PLAIN", "LOGIN", "CRAM-MD5":
+		default:
+			return fmt.Errorf("invalid smtp/auth value: %v", r.SMTP.Mechanism)
+		}
+	}
+
+	return nil
+}
+
+func (r *Config) readSMTPMXOptions(c *goconf.ConfigFile) error {
+	var err error
+
+	// All options are optional.
+	if c.HasOption("smtp", "helo") {
+		r.SMTP.HELO, err = c.GetString("smtp", "helo")
+		if err != nil || len(r.SMTP.HELO) == 0 {
+			return errors.New("invalid smtp/helo value")
+		}
+	}
+	if c.HasOption("smtp", "resolvers") {
+		resolvers, err := c.GetString("smtp", "resolvers")
+		if err != nil {
+			return errors.New("invalid smtp/resolvers value")
+		}
+		r.SMTP.Resolvers = parseResolvers(resolvers)
+	}
+	if c.HasOption("smtp", "verify_tls") {
+		r.SMTP.VerifyTLS, err = c.GetBool("smtp", "verify_tls")
+		if err != nil {
+			return errors.New("invalid smtp/verify_tls value")
+		}
+	}
+
+	return nil
+}
+
+// parseResolvers parses a comma separated list of name servers whose port is 53
+// by default.
+func parseResolvers(s string) []string {
+	result := []string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			v = net.JoinHostPort(v, "53")
+		}
+		result = append(result, v)
+	}
+
+	return result
+}
+
+func (r *Config) readDKIMSection(c *goconf.ConfigFile) error {
+	// DKIM signing is optional.
+	if !c.HasOption("dkim", "keys") {
+		return nil
+	}
+
+	keys, err := c.GetString("dkim", "keys")
+	if err != nil {
+		return errors.New("invalid dkim/keys value")
+	}
+	for _, v := range strings.Split(keys, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		// DOMAIN:SELECTOR:KEY_FILE
+		token := strings.SplitN(v, ":", 3)
+		if len(token) != 3 || len(token[0]) == 0 || len(token[1]) == 0 || len(token[2]) == 0 || token[2][0] != '/' {
+			return fmt.Errorf("invalid dkim/keys value: %v", v)
+		}
+		r.DKIM.Keys = append(r.DKIM.Keys, DKIMKey{Domain: token[0], Selector: token[1], KeyFile: token[2]})
+	}
+
+	if c.HasOption("dkim", "headers") {
+		headers, err := c.GetString("dkim", "headers")
+		if err != nil {
+			return errors.New("invalid dkim/headers value")
+		}
+		for _, v := range strings.Split(headers, ",") {
+			if v = strings.TrimSpace(v); len(v) > 0 {
+				r.DKIM.Headers = append(r.DKIM.Headers, v)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Config) readOutboxSection(c *goconf.ConfigFile) error {
+	var err error
+
+	// All options are optional.
+	if c.HasOption("outbox", "hostname") {
+		r.Outbox.Hostname, err = c.GetString("outbox", "hostname")
+		if err != nil {
+			return errors.New("invalid outbox/hostname value")
+		}
+	}
+
+	durations := []struct {
+		name  string
+		unit  time.Duration
+		value *time.Duration
+	}{
+		{"poll_interval", time.Second, &r.Outbox.PollInterval},
+		{"retry_interval", time.Second, &r.Outbox.RetryInterval},
+		{"max_retry_interval", time.Second, &r.Outbox.MaxRetryInterval},
+		{"max_age", time.Hour, &r.Outbox.MaxAge},
+	}
+	for _, v := range durations {
+		if !c.HasOption("outbox", v.name) {
+			continue
+		}
+		n, err := c.GetInt("outbox", v.name)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid outbox/%v value", v.name)
+		}
+		*v.value = time.Duration(n) * v.unit
+	}
+
+	return nil
+}
+
+func (r *Config) readDeliverySection(c *goconf.ConfigFile) error {
+	var err error
+
+	r.Delivery.Sieve = true
+	r.Delivery.Authenticate = true
+
+	// All options are optional.
+	addresses := []struct {
+		name  string
+		value *string
+	}{
+		{"lmtp", &r.Delivery.LMTP},
+		{"smtp", &r.Delivery.SMTP},
+		{"hostname", &r.Delivery.Hostname},
+	}
+	for _, v := range addresses {
+		if !c.HasOption("delivery", v.name) {
+			continue
+		}
+		*v.value, err = c.GetString("delivery", v.name)
+		if err != nil || len(*v.value) == 0 {
+			return fmt.Errorf("invalid delivery/%v value", v.name)
+		}
+	}
+	if len(r.Delivery.SMTP) > 0 && r.Delivery.SMTP[0] == '/' {
+		return errors.New("delivery/smtp should be a TCP address")
+	}
+	if c.HasOption("delivery", "max_size") {
+		size, err := c.GetInt("delivery", "max_size")
+		if err != nil || size <= 0 {
+			return errors.New("invalid delivery/max_size value")
+		}
+		// In megabytes.
+		r.Delivery.MaxSize = int64(size) * 1024 * 1024
+	}
+	if c.HasOption("delivery", "starttls") {
+		r.Delivery.StartTLS, err = c.GetBool("delivery", "starttls")
+		if err != nil {
+			return errors.New("invalid delivery/starttls value")
+		}
+	}
+	bools := []struct {
+		name  string
+		value *bool
+	}{
+		{"sieve", &r.Delivery.Sieve},
+		{"authenticate", &r.Delivery.Authenticate},
+		{"enforce_dmarc", &r.Delivery.EnforceDMARC},
+	}
+	for _, v := range bools {
+		if !c.HasOption("delivery", v.name) {
+			continue
+		}
+		*v.value, err = c.GetBool("delivery", v.name)
+		if err != nil {
+			return fmt.Errorf("invalid delivery/%v value", v.name)
+		}
+	}
+	if c.HasOption("delivery", "resolvers") {
+		resolvers, err := c.GetString("delivery", "resolvers")
+		if err != nil {
+			return errors.New("invalid delivery/resolvers value")
+		}
+		r.Delivery.Resolvers = parseResolvers(resolvers)
+	}
+
+	return nil
+}
+
+func (r *Config) readScannerSection(c *goconf.ConfigFile) error {
+	var err error
+
+	// All options are optional.
+	r.Scanner.ClamdVerdict = "reject"
+	r.Scanner.Inbound = true
+	r.Scanner.Outbound = true
+	strs := []struct {
+		name  string
+		value *string
+	}{
+		{"spamd", &r.Scanner.Spamd},
+		{"spamd_user", &r.Scanner.SpamdUser},
+		{"clamd", &r.Scanner.Clamd},
+		{"clamd_verdict", &r.Scanner.ClamdVerdict},
+	}
+	for _, v := range strs {
+		if !c.HasOption("scanner", v.name) {
+			continue
+		}
+		*v.value, err = c.GetString("scanner", v.name)
+		if err != nil || len(*v.value) == 0 {
+			return fmt.Errorf("invalid scanner/%v value", v.name)
+		}
+	}
+	if r.Scanner.ClamdVerdict != "reject" && r.Scanner.ClamdVerdict != "quarantine" {
+		return errors.New("invalid scanner/clamd_verdict value")
+	}
+	if c.HasOption("scanner", "spamd_reject_score") {
+		r.Scanner.SpamdRejectScore, err = c.GetFloat64("scanner", "spamd_reject_score")
+		if err != nil || r.Scanner.SpamdRejectScore < 0 {
+			return errors.New("invalid scanner/spamd_reject_score value")
+		}
+	}
+	bools := []struct {
+		name  string
+		value *bool
+	}{
+		{"inbound", &r.Scanner.Inbound},
+		{"outbound", &r.Scanner.Outbound},
+	}
+	for _, v := range bools {
+		if !c.HasOption("scanner", v.name) {
+			continue
+		}
+		*v.value, err = c.GetBool("scanner", v.name)
+		if err != nil {
+			return fmt.Errorf("invalid scanner/%v value", v.name)
+		}
+	}
+
+	return nil
+}
+
+func (r *Config) readSenderSection(c *goconf.ConfigFile) error {
+	// Reject emails from unauthorized addresses by default.
+	r.SenderPolicy = "reject"
+	if c.HasOption("sender", "policy") {
+		policy, err := c.GetString("sender", "policy")
+		if err != nil {
+			return errors.New("invalid sender/policy value")
+		}
+		switch strings.ToLower(policy) {
+		case "reject", "rewrite", "allow":
+			r.SenderPolicy = strings.ToLower(policy)
+		default:
+			return fmt.Errorf("invalid sender/policy value: %v", policy)
+		}
+	}
+	if c.HasOption("sender", "allow_unverified") {
+		v, err := c.GetBool("sender", "allow_unverified")
+		if err != nil {
+			return errors.New("invalid sender/allow_unverified value")
+		}
+		r.SenderAllowUnverified = v
+	}
+
+	return nil
+}
+
+func (r *Config) readHTTPAuthSection(c *goconf.ConfigFile) error {
+	// Only allow the basic authentication scheme by default.
+	r.HTTPAuth.Basic = true
+	if !c.HasOption("http_auth", "schemes") {
+		return nil
+	}
+
+	schemes, err := c.GetString("http_auth", "schemes")
+	if err != nil || len(schemes) == 0 {
+		return errors.New("empty http_auth/schemes value")
+	}
+	r.HTTPAuth.Basic = false
+	for _, v := range strings.Split(schemes, ",") {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "basic":
+			r.HTTPAuth.Basic = true
+		case "bearer":
+			r.HTTPAuth.Bearer = true
+		default:
+			return fmt.Errorf("invalid http_auth/schemes value: %v", v)
+		}
+	}
+	if !r.HTTPAuth.Bearer {
+		return nil
+	}
+
+	r.HTTPAuth.KeyFile, err = c.GetString("http_auth", "key_file")
+	if err != nil || len(r.HTTPAuth.KeyFile) == 0 {
+		return errors.New("empty http_auth/key_file value")
+	}
+	if r.HTTPAuth.KeyFile[0] != '/' {
+		return errors.New("http_auth/key_file should be specified as an absolute path")
+	}
+
+	r.HTTPAuth.Issuer, err = c.GetString("http_auth", "issuer")
+	if err != nil || len(r.HTTPAuth.Issuer) == 0 {
+		return errors.New("empty http_auth/issuer value")
+	}
+	r.HTTPAuth.Audience, err = c.GetString("http_auth", "audience")
+	if err != nil || len(r.HTTPAuth.Audience) == 0 {
+		return errors.New("empty http_auth/audience value")
+	}
+
+	// Others are optional.
+	if c.HasOption("http_auth", "user_claim") {
+		r.HTTPAuth.UserClaim, err = c.GetString("http_auth", "user_claim")
+		if err != nil {
+			return errors.New("invalid http_auth/user_claim value")
+		}
+	}
+	if c.HasOption("http_auth", "lookup_address") {
+		r.HTTPAuth.LookupAddress, err = c.GetBool("http_auth", "lookup_address")
+		if err != nil {
+			return errors.New("invalid http_auth/lookup_address value")
+		}
+	}
+	if c.HasOption("http_auth", "leeway") {
+		leeway, err := c.GetInt("http_auth", "leeway")
+		if err != nil || leeway <= 0 {
+			return errors.New("invalid http_auth/leeway value")
+		}
+		r.HTTPAuth.Leeway = time.Duration(leeway) * time.Second
+	}
+
+	return nil
+}
+
+func (r *Config) readClientCertSection(c *goconf.ConfigFile) error {
+	// Do not request client certificates by default.
+	r.ClientCert.Policy = "password"
+	if !c.HasOption("client_cert", "policy") {
+		return nil
+	}
+
+	policy, err := c.GetString("client_cert", "policy")
+	if err != nil {
+		return errors.New("invalid client_cert/policy value")
+	}
+	r.ClientCert.Policy = strings.ToLower(policy)
+	switch r.ClientCert.Policy {
+	case "password":
+		return nil
+	case "cert", "cert+password":
+	default:
+		return fmt.Errorf("invalid client_cert/policy value: %v", policy)
+	}
+
+	r.ClientCert.CAFile, err = c.GetString("client_cert", "ca_file")
+	if err != nil || len(r.ClientCert.CAFile) == 0 {
+		return errors.New("empty client_cert/ca_file value")
+	}
+	if r.ClientCert.CAFile[0] != '/' {
+		return errors.New("client_cert/ca_file should be specified as an absolute path")
+	}
+
+	// Map the email addresses by default.
+	r.ClientCert.Mapping = "email"
+	if c.HasOption("client_cert", "mapping") {
+		mapping, err := c.GetString("client_cert", "mapping")
+		if err != nil {
+			return errors.New("invalid client_cert/mapping value")
+		}
+		r.ClientCert.Mapping = strings.ToLower(mapping)
+		if r.ClientCert.Mapping != "email" && r.ClientCert.Mapping != "cn" {
+			return fmt.Errorf("invalid client_cert/mapping value: %v", mapping)
+		}
+	}
+
 	return nil
 }
@@ -21,23 +21,34 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
-	"log/syslog"
+	"io/ioutil"
+	"net"
 	"os"
-	"os/signal"
 	"runtime"
 	"strings"
-	"syscall"
-	"time"
+	"sync"
 
 	"github.com/superkkt/omega/activesync"
 	"github.com/superkkt/omega/activesync/eas25"
+	"github.com/superkkt/omega/authenticator/clientcert"
+	"github.com/superkkt/omega/authenticator/jwt"
+	omega "github.com/superkkt/omega/backend"
 	"github.com/superkkt/omega/cert"
+	"github.com/superkkt/omega/cmd/internal/daemon"
 	"github.com/superkkt/omega/database/mysql"
 	"github.com/superkkt/omega/database/mysql/backend"
 	"github.com/superkkt/omega/database/mysql/eas"
-	"github.com/superkkt/omega/mockup/authenticator"
+	"github.com/superkkt/omega/database/mysql/user"
+	"github.com/superkkt/omega/delivery"
+	"github.com/superkkt/omega/dkim"
+	"github.com/superkkt/omega/mailauth"
+	"github.com/superkkt/omega/outbox"
+	"github.com/superkkt/omega/scanner"
+	"github.com/superkkt/omega/sieve"
 	"github.com/superkkt/omega/smtp"
 
 	"github.com/pkg/profile"
@@ -91,23 +102,76 @@ func main() {
 	if err != nil {
 		logger.Fatal(fmt.Sprintf("Failed to load the certification: %v", err))
 	}
-	// TODO: Implement a real authenticator.
-	auth := &authenticator.MockAuth{Username: "test", Password: "test"}
+	dir, err := daemon.NewAuthenticator(config.Auth, db, config.DB.BackendDB)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the authenticator: %v", err))
+	}
+	auth, flushAuthCache, err := daemon.NewAuthCache(config.Auth, dir)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the authentication cache: %v", err))
+	}
+	reqAuth, err := newRequestAuthenticators(config, auth, dir)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the request authenticators: %v", err))
+	}
+	mailer, err := newMailer(config)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the mailer: %v", err))
+	}
+	backendStorage := backend.New(config.DB.BackendDB)
+	worker, err := outbox.NewWorker(outbox.Config{
+		DB:               db,
+		Backend:          backendStorage,
+		Storage:          backendStorage,
+		Mailer:           mailer,
+		Hostname:         config.Outbox.Hostname,
+		PollInterval:     config.Outbox.PollInterval,
+		RetryInterval:    config.Outbox.RetryInterval,
+		MaxRetryInterval: config.Outbox.MaxRetryInterval,
+		MaxAge:           config.Outbox.MaxAge,
+	})
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the outbox worker: %v", err))
+	}
+	clientCert, err := newClientCertConfig(config, dir)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the client certificate authentication: %v", err))
+	}
+	contentScanner, err := newContentScanner(config)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the content scanners: %v", err))
+	}
+	deliveryServers, err := newDeliveryServers(config, db, dir, backendStorage, cert, newScannerConfig(contentScanner, config.Scanner.Inbound, backendStorage))
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the delivery servers: %v", err))
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	go signalHandler(cancel)
+	go daemon.SignalHandler(cancel, flushAuthCache)
 
-	initSyslog(config)
+	daemon.InitSyslog(config.LogLevel)
 	logger.Info(fmt.Sprintf("%v is initialized..", programName))
+	workerDone := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(workerDone)
+	}()
+	deliveryDone := runDeliveryServers(ctx, deliveryServers)
 	asConfig := activesync.Config{
-		Port:      config.Port,
-		Cert:      cert,
-		AllowHTTP: config.AllowHTTP,
+		Port:         config.Port,
+		Cert:         cert,
+		AllowHTTP:    config.AllowHTTP,
+		DrainTimeout: config.DrainTimeout,
+		Auth:         reqAuth,
+		ClientCert:   clientCert,
+		Throttle:     daemon.NewThrottleConfig(config.Throttle, db, config.DB.ActiveSyncDB),
 		Param: activesync.Parameter{
 			Authenticator:  auth,
 			ASStorage:      eas.New(config.DB.ActiveSyncDB),
-			BackendStorage: backend.New(config.DB.BackendDB),
+			BackendStorage: backendStorage,
 			Transaction:    db,
-			Mailer:         smtp.New(config.SMTP.Host, config.SMTP.Port),
+			Outbox:         outbox.NewEnqueuer(backendStorage, backendStorage),
+			Sender:         newSenderConfig(config, db),
+			Scanner:        newScannerConfig(contentScanner, config.Scanner.Outbound, backendStorage),
 		},
 	}
 	// ActiveSync Protocol Version 2.5
@@ -116,50 +180,349 @@ func main() {
 	if err := as.Run(ctx); err != nil {
 		logger.Fatal(fmt.Sprintf("Failed to run the listener: %v", err))
 	}
+	// Wait for the email being sent and received.
+	<-workerDone
+	deliveryDone.Wait()
+	if *profileMode != "" {
+		profiler.Stop()
+	}
 	logger.Info(fmt.Sprintf("%v is finished..", programName))
 }
 
-func signalHandler(shutdown context.CancelFunc) {
-	c := make(chan os.Signal, 5)
-	// Following signals will be transferred to the channel c.
-	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGPIPE)
-
-	for {
-		switch <-c {
-		case syscall.SIGTERM, syscall.SIGINT:
-			logger.Info("Shutting down...")
-			shutdown()
-			// Timeout for cancelation
-			time.Sleep(3 * time.Second)
-			if *profileMode != "" {
-				profiler.Stop()
-			}
-			os.Exit(0)
-		default:
-			logger.Warning(fmt.Sprintf("Received %v signal!", c))
+func initDatabase(config *Config) (db *mysql.MySQL, err error) {
+	// NOTE: Enable clientFoundRows to cause an UPDATE to return the number of matching rows instead of the number of rows changed.
+	return mysql.NewMySQL(config.DB.Host, config.DB.Username, config.DB.Password, config.DB.Port, true)
+}
+
+// newRequestAuthenticators returns the authentication schemes of the listener.
+// auth verifies passwords, and dir, which is the underlying authenticator of
+// auth, is used to look up users of the bearer tokens.
+func newRequestAuthenticators(config *Config, auth, dir omega.Authenticator) ([]activesync.RequestAuthenticator, error) {
+	result := make([]activesync.RequestAuthenticator, 0)
+	if config.HTTPAuth.Basic {
+		result = append(result, &activesync.BasicAuth{Authenticator: auth})
+	}
+	if !config.HTTPAuth.Bearer {
+		return result, nil
+	}
+
+	directory, ok := dir.(omega.Directory)
+	if !ok {
+		return nil, fmt.Errorf("the %v authenticator backend does not support the bearer authentication scheme", config.Auth.Backend)
+	}
+	keys, err := jwt.LoadKeySet(config.HTTPAuth.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := jwt.New(jwt.Config{
+		Keys:          keys,
+		Issuer:        config.HTTPAuth.Issuer,
+		Audience:      config.HTTPAuth.Audience,
+		UserClaim:     config.HTTPAuth.UserClaim,
+		LookupAddress: config.HTTPAuth.LookupAddress,
+		Directory:     directory,
+		Leeway:        config.HTTPAuth.Leeway,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(result, &activesync.BearerAuth{Verifier: verifier}), nil
+}
+
+func newMailer(config *Config) (outbox.Mailer, error) {
+	mailer, err := newSMTPMailer(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.DKIM.Keys) == 0 {
+		return mailer, nil
+	}
+
+	keys := make([]dkim.Key, len(config.DKIM.Keys))
+	for i, v := range config.DKIM.Keys {
+		keys[i], err = dkim.LoadKey(v.Domain, v.Selector, v.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dkim.New(mailer, dkim.Config{
+		Keys:    keys,
+		Headers: config.DKIM.Headers,
+	})
+}
+
+func newSMTPMailer(config *Config) (outbox.Mailer, error) {
+	if config.SMTP.Mode == "mx" {
+		return smtp.NewMX(smtp.MXConfig{
+			Hostname:  config.SMTP.HELO,
+			Resolvers: config.SMTP.Resolvers,
+			VerifyTLS: config.SMTP.VerifyTLS,
+		})
+	}
+
+	security := map[string]smtp.Security{
+		"none":     smtp.SecurityNone,
+		"starttls": smtp.SecurityStartTLS,
+		"tls":      smtp.SecurityTLS,
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         config.SMTP.Host,
+		InsecureSkipVerify: config.SMTP.InsecureSkipVerify,
+	}
+	if len(config.SMTP.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(config.SMTP.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificate found in %v", config.SMTP.CAFile)
 		}
 	}
+
+	return smtp.New(smtp.Config{
+		Host:      config.SMTP.Host,
+		Port:      config.SMTP.Port,
+		Security:  security[config.SMTP.Security],
+		TLSConfig: tlsConfig,
+		Username:  config.SMTP.Username,
+		Password:  config.SMTP.Password,
+		Mechanism: config.SMTP.Mechanism,
+	}), nil
 }
 
-func initSyslog(conf *Config) {
-	log, err := syslog.NewLogger(syslog.LOG_ERR|syslog.LOG_DAEMON, 0)
+func newSenderConfig(config *Config, db *mysql.MySQL) activesync.SenderConfig {
+	policy := map[string]activesync.SenderPolicy{
+		"reject":  activesync.SenderReject,
+		"rewrite": activesync.SenderRewrite,
+		"allow":   activesync.SenderAllow,
+	}
+	result := activesync.SenderConfig{
+		Policy:          policy[config.SenderPolicy],
+		AllowUnverified: config.SenderAllowUnverified,
+	}
+	// Send-as delegations are stored with users of the sql backend.
+	if config.Auth.Backend == "sql" {
+		result.SendAs = user.NewAuthenticator(db, config.DB.BackendDB)
+	}
+
+	return result
+}
+
+type deliveryServer struct {
+	server   *delivery.Server
+	listener net.Listener
+}
+
+func newDeliveryServers(config *Config, db *mysql.MySQL, dir omega.Authenticator, storage deliveryStorage, cert *cert.Loader, sc activesync.ScannerConfig) ([]deliveryServer, error) {
+	if len(config.Delivery.LMTP) == 0 && len(config.Delivery.SMTP) == 0 {
+		return nil, nil
+	}
+	directory, ok := dir.(omega.Directory)
+	if !ok {
+		return nil, fmt.Errorf("the %v authenticator backend does not support the email delivery", config.Auth.Backend)
+	}
+	deliverer, err := newDeliverer(config, storage)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := newVerifier(config)
 	if err != nil {
-		log.Fatalf("Failed to init syslog: %v\n", err)
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if config.Delivery.StartTLS {
+		tlsConfig = &tls.Config{GetCertificate: cert.GetCertificate}
+	}
+
+	result := []deliveryServer{}
+	listeners := []struct {
+		protocol delivery.Protocol
+		address  string
+	}{
+		{delivery.ProtocolLMTP, config.Delivery.LMTP},
+		{delivery.ProtocolSMTP, config.Delivery.SMTP},
+	}
+	for _, v := range listeners {
+		if len(v.address) == 0 {
+			continue
+		}
+		server, err := delivery.NewServer(delivery.Config{
+			Protocol:     v.protocol,
+			Hostname:     config.Delivery.Hostname,
+			Directory:    directory,
+			DB:           db,
+			Deliverer:    deliverer,
+			TLSConfig:    tlsConfig,
+			MaxSize:      config.Delivery.MaxSize,
+			Scanner:      sc.Scanner,
+			Quarantine:   sc.Quarantine,
+			Verifier:     verifier,
+			EnforceDMARC: config.Delivery.EnforceDMARC,
+		})
+		if err != nil {
+			return nil, err
+		}
+		network := "tcp"
+		if v.address[0] == '/' {
+			network = "unix"
+			// Remove the stale socket file of the previous run.
+			os.Remove(v.address)
+		}
+		l, err := net.Listen(network, v.address)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, deliveryServer{server: server, listener: l})
+	}
+
+	return result, nil
+}
+
+// deliveryStorage is the backend storage used to deliver inbound emails.
+type deliveryStorage interface {
+	omega.Storage
+	sieve.Storage
+	outbox.Storage
+}
+
+func newDeliverer(config *Config, storage deliveryStorage) (delivery.Deliverer, error) {
+	if !config.Delivery.Sieve {
+		return delivery.NewAgent(storage), nil
 	}
-	logger.SetLogger(log)
-	logger.SetLogLevel(conf.LogLevel)
-	logger.SetPrefix(func() string {
-		return fmt.Sprintf("TID=%v, ", getGoRoutineID())
+
+	return sieve.NewDeliverer(sieve.Config{
+		Backend:  storage,
+		Storage:  storage,
+		Outbox:   outbox.NewEnqueuer(storage, storage),
+		Hostname: config.Delivery.Hostname,
 	})
 }
 
-func getGoRoutineID() string {
-	var buf [64]byte
-	n := runtime.Stack(buf[:], false)
-	return strings.Fields(strings.TrimPrefix(string(buf[:n]), "goroutine "))[0]
+func newVerifier(config *Config) (*mailauth.Verifier, error) {
+	if !config.Delivery.Authenticate {
+		return nil, nil
+	}
+	resolver, err := mailauth.NewDNSResolver(config.Delivery.Resolvers)
+	if err != nil {
+		return nil, err
+	}
+	hostname := config.Delivery.Hostname
+	if len(hostname) == 0 {
+		if hostname, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	return mailauth.NewVerifier(mailauth.Config{
+		Hostname: hostname,
+		Resolver: resolver,
+	})
 }
 
-func initDatabase(config *Config) (db *mysql.MySQL, err error) {
-	// NOTE: Enable clientFoundRows to cause an UPDATE to return the number of matching rows instead of the number of rows changed.
-	return mysql.NewMySQL(config.DB.Host, config.DB.Username, config.DB.Password, config.DB.Port, true)
+// newContentScanner returns a chain of the configured content scanners, or nil
+// if there is no scanner.
+func newContentScanner(config *Config) (scanner.ContentScanner, error) {
+	chain := scanner.Chain{}
+	if len(config.Scanner.Clamd) > 0 {
+		verdict := scanner.VerdictReject
+		if config.Scanner.ClamdVerdict == "quarantine" {
+			verdict = scanner.VerdictQuarantine
+		}
+		clamd, err := scanner.NewClamd(scanner.ClamdConfig{
+			Address: config.Scanner.Clamd,
+			Verdict: verdict,
+		})
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, clamd)
+	}
+	if len(config.Scanner.Spamd) > 0 {
+		spamd, err := scanner.NewSpamd(scanner.SpamdConfig{
+			Address:     config.Scanner.Spamd,
+			User:        config.Scanner.SpamdUser,
+			RejectScore: config.Scanner.SpamdRejectScore,
+		})
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, spamd)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+
+	return chain, nil
+}
+
+// newScannerConfig returns a configuration that scans emails using s only if
+// enabled is true. The trainer is set regardless of enabled.
+func newScannerConfig(s scanner.ContentScanner, enabled bool, storage scanner.Storage) activesync.ScannerConfig {
+	c := activesync.ScannerConfig{}
+	if s == nil {
+		return c
+	}
+	if enabled {
+		c.Scanner = s
+		c.Quarantine = storage
+	}
+	if t, ok := s.(scanner.Trainer); ok {
+		c.Trainer = t
+	}
+
+	return c
+}
+
+func runDeliveryServers(ctx context.Context, servers []deliveryServer) *sync.WaitGroup {
+	wg := new(sync.WaitGroup)
+	for _, v := range servers {
+		wg.Add(1)
+		go func(v deliveryServer) {
+			defer wg.Done()
+			if err := v.server.Serve(ctx, v.listener); err != nil {
+				logger.Error(fmt.Sprintf("Failed to serve the email delivery on %v: %v", v.listener.Addr(), err))
+			}
+		}(v)
+	}
+
+	return wg
+}
+
+func newClientCertConfig(config *Config, dir omega.Authenticator) (activesync.ClientCertConfig, error) {
+	c := activesync.ClientCertConfig{}
+	switch config.ClientCert.Policy {
+	case "cert":
+		c.Policy = activesync.PolicyCertOnly
+	case "cert+password":
+		c.Policy = activesync.PolicyCertAndPassword
+	default:
+		c.Policy = activesync.PolicyPasswordOnly
+		return c, nil
+	}
+
+	directory, ok := dir.(omega.Directory)
+	if !ok {
+		return c, fmt.Errorf("the %v authenticator backend does not support the client certificate authentication", config.Auth.Backend)
+	}
+	pem, err := ioutil.ReadFile(config.ClientCert.CAFile)
+	if err != nil {
+		return c, err
+	}
+	c.CAs = x509.NewCertPool()
+	if !c.CAs.AppendCertsFromPEM(pem) {
+		return c, fmt.Errorf("no CA certificate found in %v", config.ClientCert.CAFile)
+	}
+	mapping := clientcert.MappingEmail
+	if config.ClientCert.Mapping == "cn" {
+		mapping = clientcert.MappingCommonName
+	}
+	c.Authenticator, err = clientcert.New(directory, mapping)
+	if err != nil {
+		return c, err
+	}
+
+	return c, nil
 }
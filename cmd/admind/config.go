@@ -0,0 +1,227 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/cmd/internal/daemon"
+
+	"github.com/dlintw/goconf"
+	"github.com/superkkt/logger"
+)
+
+// Config is a subset of the activesyncd configurations that admind needs, and
+// the admin section.
+type Config struct {
+	LogLevel logger.Level
+	DB       DSN
+	// TLS is the certificate of the ActiveSync listener, which is also used by
+	// the TLS listener of the admin API.
+	TLS struct {
+		CertFile string
+		KeyFile  string
+	}
+	Auth     daemon.AuthConfig
+	Throttle daemon.ThrottleConfig
+	Admin    Admin
+}
+
+type DSN struct {
+	Host         string
+	Port         uint16
+	Username     string
+	Password     string
+	ActiveSyncDB string
+	BackendDB    string
+}
+
+type Admin struct {
+	// Address accepts plain HTTP connections, and TLSAddress accepts HTTPS
+	// connections. Empty disables it.
+	Address    string
+	TLSAddress string
+	// Username and Password are the credential of the administrator.
+	Username string
+	Password string
+	// DrainTimeout is the maximum duration to wait for in-flight requests on shutdown. Zero means the default.
+	DrainTimeout time.Duration
+}
+
+func (r *Config) parseLogLevel(l string) error {
+	switch strings.ToUpper(l) {
+	case "DEBUG":
+		r.LogLevel = logger.LevelDebug
+	case "INFO":
+		r.LogLevel = logger.LevelInfo
+	case "WARNING":
+		r.LogLevel = logger.LevelWarning
+	case "ERROR":
+		r.LogLevel = logger.LevelError
+	case "FATAL":
+		r.LogLevel = logger.LevelFatal
+	default:
+		return fmt.Errorf("invalid log level: %v", l)
+	}
+
+	return nil
+}
+
+func (r *Config) Read(configFile string) error {
+	c, err := goconf.ReadConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	if err := r.readDefaultSection(c); err != nil {
+		return err
+	}
+	if err := r.readDatabaseSection(c); err != nil {
+		return err
+	}
+	if err := r.Auth.Read(c); err != nil {
+		return err
+	}
+	if err := r.Throttle.Read(c); err != nil {
+		return err
+	}
+	if err := r.readAdminSection(c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Config) readDefaultSection(c *goconf.ConfigFile) error {
+	var err error
+
+	logLevel, err := c.GetString("default", "log_level")
+	if err != nil || len(logLevel) == 0 {
+		return errors.New("invalid default/log_level in the config file")
+	}
+	if err := r.parseLogLevel(logLevel); err != nil {
+		return err
+	}
+
+	r.TLS.CertFile, err = c.GetString("default", "cert_file")
+	if err != nil || len(r.TLS.CertFile) == 0 {
+		return errors.New("empty default/cert_file value")
+	}
+	if r.TLS.CertFile[0] != '/' {
+		return errors.New("default/cert_file should be specified as an absolute path")
+	}
+
+	r.TLS.KeyFile, err = c.GetString("default", "key_file")
+	if err != nil || len(r.TLS.KeyFile) == 0 {
+		return errors.New("empty default/key_file value")
+	}
+	if r.TLS.KeyFile[0] != '/' {
+		return errors.New("default/key_file should be specified as an absolute path")
+	}
+
+	return nil
+}
+
+func (r *Config) readDatabaseSection(c *goconf.ConfigFile) error {
+	var err error
+
+	r.DB.Host, err = c.GetString("database", "host")
+	if err != nil || len(r.DB.Host) == 0 {
+		return errors.New("empty database/host value")
+	}
+
+	port, err := c.GetInt("database", "port")
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("empty or invalid database/port value")
+	}
+	r.DB.Port = uint16(port)
+
+	r.DB.Username, err = c.GetString("database", "username")
+	if err != nil || len(r.DB.Username) == 0 {
+		return errors.New("empty database/username value")
+	}
+
+	r.DB.Password, err = c.GetString("database", "password")
+	if err != nil || len(r.DB.Password) == 0 {
+		return errors.New("empty database/password value")
+	}
+
+	r.DB.ActiveSyncDB, err = c.GetString("database", "activesync_db")
+	if err != nil || len(r.DB.ActiveSyncDB) == 0 {
+		return errors.New("empty database/activesync_db value")
+	}
+
+	r.DB.BackendDB, err = c.GetString("database", "backend_db")
+	if err != nil || len(r.DB.BackendDB) == 0 {
+		return errors.New("empty database/backend_db value")
+	}
+
+	return nil
+}
+
+func (r *Config) readAdminSection(c *goconf.ConfigFile) error {
+	var err error
+
+	// Listen only on the loopback interface by default.
+	r.Admin.Address = "127.0.0.1:8081"
+
+	addresses := []struct {
+		name  string
+		value *string
+	}{
+		{"address", &r.Admin.Address},
+		{"tls_address", &r.Admin.TLSAddress},
+	}
+	for _, v := range addresses {
+		if !c.HasOption("admin", v.name) {
+			continue
+		}
+		*v.value, err = c.GetString("admin", v.name)
+		if err != nil {
+			return fmt.Errorf("invalid admin/%v value", v.name)
+		}
+	}
+	if len(r.Admin.Address) == 0 && len(r.Admin.TLSAddress) == 0 {
+		return errors.New("both of admin/address and admin/tls_address are disabled")
+	}
+
+	r.Admin.Username, err = c.GetString("admin", "username")
+	if err != nil || len(r.Admin.Username) == 0 {
+		return errors.New("empty admin/username value")
+	}
+
+	r.Admin.Password, err = c.GetString("admin", "password")
+	if err != nil || len(r.Admin.Password) == 0 {
+		return errors.New("empty admin/password value")
+	}
+
+	if c.HasOption("admin", "drain_timeout") {
+		timeout, err := c.GetInt("admin", "drain_timeout")
+		if err != nil || timeout <= 0 {
+			return errors.New("invalid admin/drain_timeout value")
+		}
+		r.Admin.DrainTimeout = time.Duration(timeout) * time.Second
+	}
+
+	return nil
+}
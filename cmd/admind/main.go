@@ -0,0 +1,186 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/superkkt/omega/admin"
+	omega "github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/cert"
+	"github.com/superkkt/omega/cmd/internal/daemon"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql"
+	"github.com/superkkt/omega/database/mysql/backend"
+	"github.com/superkkt/omega/database/mysql/eas"
+	"github.com/superkkt/omega/database/mysql/user"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	programVersion = "0.1.0"
+	programName    = "admind"
+)
+
+var (
+	configFile  = flag.String("config", "/usr/local/etc/activesyncd.conf", "absolute path of the activesyncd configuration file")
+	showVersion = flag.Bool("version", false, "show program version and exit")
+	openAPIFile = flag.String("openapi", "", "write the OpenAPI document of the admin API into the file and exit")
+)
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("%v (Version: %v)\n", programName, programVersion)
+		os.Exit(0)
+	}
+	if len(*openAPIFile) > 0 {
+		if err := writeOpenAPI(*openAPIFile); err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to write the OpenAPI document: %v", err))
+		}
+		os.Exit(0)
+	}
+
+	config := new(Config)
+	if err := config.Read(*configFile); err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to read configurations: %v", err))
+	}
+	// NOTE: Enable clientFoundRows to cause an UPDATE to return the number of matching rows instead of the number of rows changed.
+	db, err := mysql.NewMySQL(config.DB.Host, config.DB.Username, config.DB.Password, config.DB.Port, true)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init database: %v", err))
+	}
+	cert, err := cert.NewLoader(config.TLS.CertFile, config.TLS.KeyFile)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to load the certification: %v", err))
+	}
+	dir, err := newDirectory(config, db)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the user directory: %v", err))
+	}
+	storage := backend.New(config.DB.BackendDB)
+	server, err := admin.NewServer(admin.Config{
+		Username:     config.Admin.Username,
+		Password:     config.Admin.Password,
+		Users:        newUserManager(config),
+		Directory:    dir,
+		Storage:      storage,
+		Sieve:        storage,
+		ASStorage:    eas.New(config.DB.ActiveSyncDB),
+		DB:           db,
+		DrainTimeout: config.Admin.DrainTimeout,
+		Throttle:     daemon.NewThrottleConfig(config.Throttle, db, config.DB.ActiveSyncDB),
+	})
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the admin server: %v", err))
+	}
+	tlsConfig := &tls.Config{GetCertificate: cert.GetCertificate}
+	listeners, err := newListeners(config, tlsConfig)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to listen: %v", err))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go daemon.SignalHandler(cancel, nil)
+
+	daemon.InitSyslog(config.LogLevel)
+	logger.Info(fmt.Sprintf("%v is initialized..", programName))
+	wg := new(sync.WaitGroup)
+	for _, v := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			if err := server.Serve(ctx, l); err != nil {
+				logger.Fatal(fmt.Sprintf("Failed to serve the admin API on %v: %v", l.Addr(), err))
+			}
+		}(v)
+	}
+	wg.Wait()
+	logger.Info(fmt.Sprintf("%v is finished..", programName))
+}
+
+func writeOpenAPI(path string) error {
+	doc, err := json.MarshalIndent(admin.OpenAPI(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(doc, '\n'), 0644)
+}
+
+// newListeners returns the listeners of the configured addresses. Connections
+// accepted from the TLS address are secured by tlsConfig.
+func newListeners(config *Config, tlsConfig *tls.Config) ([]net.Listener, error) {
+	result := []net.Listener{}
+	if len(config.Admin.Address) > 0 {
+		l, err := net.Listen("tcp", config.Admin.Address)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, l)
+	}
+	if len(config.Admin.TLSAddress) > 0 {
+		l, err := net.Listen("tcp", config.Admin.TLSAddress)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, tls.NewListener(l, tlsConfig))
+	}
+
+	return result, nil
+}
+
+// newDirectory returns the directory that looks up the users of the configured
+// authenticator backend.
+func newDirectory(config *Config, db *mysql.MySQL) (omega.Directory, error) {
+	switch config.Auth.Backend {
+	case "sql":
+		return user.NewAuthenticator(db, config.DB.BackendDB), nil
+	case "ldap":
+		return daemon.NewLDAP(config.Auth.LDAP)
+	default:
+		// The API and the mockup authenticators cannot look up users.
+		return nil, fmt.Errorf("unsupported authenticator backend: %v", config.Auth.Backend)
+	}
+}
+
+// newUserManager returns nil if the user accounts are not stored in the
+// database, which disables the user account resources of the admin API.
+func newUserManager(config *Config) func(database.Queryer) admin.UserManager {
+	if config.Auth.Backend != "sql" {
+		return nil
+	}
+
+	return func(q database.Queryer) admin.UserManager {
+		return user.NewManager(q, config.DB.BackendDB)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/cmd/internal/daemon"
+
+	"github.com/dlintw/goconf"
+	"github.com/superkkt/logger"
+)
+
+// Config is a subset of the activesyncd configurations that imapd needs, and
+// the imap section.
+type Config struct {
+	LogLevel logger.Level
+	DB       DSN
+	// TLS is the certificate of the ActiveSync listener.
+	TLS struct {
+		CertFile string
+		KeyFile  string
+	}
+	Auth     daemon.AuthConfig
+	Throttle daemon.ThrottleConfig
+	IMAP     IMAP
+}
+
+type DSN struct {
+	Host         string
+	Port         uint16
+	Username     string
+	Password     string
+	ActiveSyncDB string
+	BackendDB    string
+}
+
+type IMAP struct {
+	// Address accepts connections that can be secured by STARTTLS, and
+	// TLSAddress accepts TLS connections. Empty disables it.
+	Address    string
+	TLSAddress string
+	// AllowPlaintext allows authentication over insecure connections.
+	AllowPlaintext bool
+	// MaxSize is the maximum size of an appended message in bytes. Zero means the default.
+	MaxSize int64
+	// PollInterval is the interval to check changes of the mailbox while idling. Zero means the default.
+	PollInterval time.Duration
+}
+
+func (r *Config) parseLogLevel(l string) error {
+	switch strings.ToUpper(l) {
+	case "DEBUG":
+		r.LogLevel = logger.LevelDebug
+	case "INFO":
+		r.LogLevel = logger.LevelInfo
+	case "WARNING":
+		r.LogLevel = logger.LevelWarning
+	case "ERROR":
+		r.LogLevel = logger.LevelError
+	case "FATAL":
+		r.LogLevel = logger.LevelFatal
+	default:
+		return fmt.Errorf("invalid log level: %v", l)
+	}
+
+	return nil
+}
+
+func (r *Config) Read(configFile string) error {
+	c, err := goconf.ReadConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	if err := r.readDefaultSection(c); err != nil {
+		return err
+	}
+	if err := r.readDatabaseSection(c); err != nil {
+		return err
+	}
+	if err := r.Auth.Read(c); err != nil {
+		return err
+	}
+	if err := r.Throttle.Read(c); err != nil {
+		return err
+	}
+	if err := r.readIMAPSection(c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Config) readDefaultSection(c *goconf.ConfigFile) error {
+	var err error
+
+	logLevel, err := c.GetString("default", "log_level")
+	if err != nil || len(logLevel) == 0 {
+		return errors.New("invalid default/log_level in the config file")
+	}
+	if err := r.parseLogLevel(logLevel); err != nil {
+		return err
+	}
+
+	r.TLS.CertFile, err = c.GetString("default", "cert_file")
+	if err != nil || len(r.TLS.CertFile) == 0 {
+		return errors.New("empty default/cert_file value")
+	}
+	if r.TLS.CertFile[0] != '/' {
+		return errors.New("default/cert_file should be specified as an absolute path")
+	}
+
+	r.TLS.KeyFile, err = c.GetString("default", "key_file")
+	if err != nil || len(r.TLS.KeyFile) == 0 {
+		return errors.New("empty default/key_file value")
+	}
+	if r.TLS.KeyFile[0] != '/' {
+		return errors.New("default/key_file should be specified as an absolute path")
+	}
+
+	return nil
+}
+
+func (r *Config) readDatabaseSection(c *goconf.ConfigFile) error {
+	var err error
+
+	r.DB.Host, err = c.GetString("database", "host")
+	if err != nil || len(r.DB.Host) == 0 {
+		return errors.New("empty database/host value")
+	}
+
+	port, err := c.GetInt("database", "port")
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("empty or invalid database/port value")
+	}
+	r.DB.Port = uint16(port)
+
+	r.DB.Username, err = c.GetString("database", "username")
+	if err != nil || len(r.DB.Username) == 0 {
+		return errors.New("empty database/username value")
+	}
+
+	r.DB.Password, err = c.GetString("database", "password")
+	if err != nil || len(r.DB.Password) == 0 {
+		return errors.New("empty database/password value")
+	}
+
+	r.DB.ActiveSyncDB, err = c.GetString("database", "activesync_db")
+	if err != nil || len(r.DB.ActiveSyncDB) == 0 {
+		return errors.New("empty database/activesync_db value")
+	}
+
+	r.DB.BackendDB, err = c.GetString("database", "backend_db")
+	if err != nil || len(r.DB.BackendDB) == 0 {
+		return errors.New("empty database/backend_db value")
+	}
+
+	return nil
+}
+
+func (r *Config) readIMAPSection(c *goconf.ConfigFile) error {
+	var err error
+
+	r.IMAP.Address = ":143"
+	r.IMAP.TLSAddress = ":993"
+
+	// All options are optional.
+	addresses := []struct {
+		name  string
+		value *string
+	}{
+		{"address", &r.IMAP.Address},
+		{"tls_address", &r.IMAP.TLSAddress},
+	}
+	for _, v := range addresses {
+		if !c.HasOption("imap", v.name) {
+			continue
+		}
+		*v.value, err = c.GetString("imap", v.name)
+		if err != nil {
+			return fmt.Errorf("invalid imap/%v value", v.name)
+		}
+	}
+	if len(r.IMAP.Address) == 0 && len(r.IMAP.TLSAddress) == 0 {
+		return errors.New("both of imap/address and imap/tls_address are disabled")
+	}
+	if c.HasOption("imap", "allow_plaintext") {
+		r.IMAP.AllowPlaintext, err = c.GetBool("imap", "allow_plaintext")
+		if err != nil {
+			return errors.New("invalid imap/allow_plaintext value")
+		}
+	}
+	if c.HasOption("imap", "max_size") {
+		size, err := c.GetInt("imap", "max_size")
+		if err != nil || size <= 0 {
+			return errors.New("invalid imap/max_size value")
+		}
+		// In megabytes.
+		r.IMAP.MaxSize = int64(size) * 1024 * 1024
+	}
+	if c.HasOption("imap", "poll_interval") {
+		interval, err := c.GetInt("imap", "poll_interval")
+		if err != nil || interval <= 0 {
+			return errors.New("invalid imap/poll_interval value")
+		}
+		r.IMAP.PollInterval = time.Duration(interval) * time.Second
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/superkkt/omega/cert"
+	"github.com/superkkt/omega/cmd/internal/daemon"
+	"github.com/superkkt/omega/database/mysql"
+	"github.com/superkkt/omega/database/mysql/backend"
+	"github.com/superkkt/omega/imap"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	programVersion = "0.1.0"
+	programName    = "imapd"
+)
+
+var (
+	configFile  = flag.String("config", "/usr/local/etc/activesyncd.conf", "absolute path of the activesyncd configuration file")
+	showVersion = flag.Bool("version", false, "show program version and exit")
+)
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("%v (Version: %v)\n", programName, programVersion)
+		os.Exit(0)
+	}
+
+	config := new(Config)
+	if err := config.Read(*configFile); err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to read configurations: %v", err))
+	}
+	// NOTE: Enable clientFoundRows to cause an UPDATE to return the number of matching rows instead of the number of rows changed.
+	db, err := mysql.NewMySQL(config.DB.Host, config.DB.Username, config.DB.Password, config.DB.Port, true)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init database: %v", err))
+	}
+	cert, err := cert.NewLoader(config.TLS.CertFile, config.TLS.KeyFile)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to load the certification: %v", err))
+	}
+	dir, err := daemon.NewAuthenticator(config.Auth, db, config.DB.BackendDB)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the authenticator: %v", err))
+	}
+	auth, flushAuthCache, err := daemon.NewAuthCache(config.Auth, dir)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the authentication cache: %v", err))
+	}
+	tlsConfig := &tls.Config{GetCertificate: cert.GetCertificate}
+	server, err := imap.NewServer(imap.Config{
+		Authenticator:  auth,
+		Storage:        backend.New(config.DB.BackendDB),
+		DB:             db,
+		TLSConfig:      tlsConfig,
+		AllowPlaintext: config.IMAP.AllowPlaintext,
+		MaxSize:        config.IMAP.MaxSize,
+		PollInterval:   config.IMAP.PollInterval,
+		Throttle:       daemon.NewThrottleConfig(config.Throttle, db, config.DB.ActiveSyncDB),
+	})
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the IMAP server: %v", err))
+	}
+	listeners, err := newListeners(config, tlsConfig)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to listen: %v", err))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go daemon.SignalHandler(cancel, flushAuthCache)
+
+	daemon.InitSyslog(config.LogLevel)
+	logger.Info(fmt.Sprintf("%v is initialized..", programName))
+	wg := new(sync.WaitGroup)
+	for _, v := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			if err := server.Serve(ctx, l); err != nil {
+				logger.Fatal(fmt.Sprintf("Failed to serve IMAP on %v: %v", l.Addr(), err))
+			}
+		}(v)
+	}
+	wg.Wait()
+	logger.Info(fmt.Sprintf("%v is finished..", programName))
+}
+
+// newListeners returns the listeners of the configured addresses. Connections
+// accepted from the TLS address are secured by tlsConfig.
+func newListeners(config *Config, tlsConfig *tls.Config) ([]net.Listener, error) {
+	result := []net.Listener{}
+	if len(config.IMAP.Address) > 0 {
+		l, err := net.Listen("tcp", config.IMAP.Address)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, l)
+	}
+	if len(config.IMAP.TLSAddress) > 0 {
+		l, err := net.Listen("tcp", config.IMAP.TLSAddress)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, tls.NewListener(l, tlsConfig))
+	}
+
+	return result, nil
+}
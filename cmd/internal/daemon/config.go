@@ -0,0 +1,331 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package daemon has the configurations and the initializations that are
+// shared by the daemons, which read the same activesyncd configuration file.
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+// AuthConfig is the auth section.
+type AuthConfig struct {
+	// Backend is the name of the authenticator, which is one of "sql", "api", "ldap", and "mock".
+	Backend string
+	// Cache has lifetimes of cached authentication results. Zero PositiveTTL disables the cache.
+	Cache struct {
+		PositiveTTL time.Duration
+		NegativeTTL time.Duration
+	}
+	API  AuthAPI
+	LDAP AuthLDAP
+}
+
+type AuthAPI struct {
+	Host     string
+	Port     uint16
+	Username string
+	Password string
+	Path     string
+	// Use HTTPS to communicate with the authentication service?
+	TLS     bool
+	Timeout time.Duration
+}
+
+type AuthLDAP struct {
+	Host string
+	Port uint16
+	// Security is one of "none", "starttls", and "tls".
+	Security           string
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string
+	UIDAttribute       string
+	NameAttribute      string
+	MailAttribute      string
+	AliasAttribute     string
+	EnabledFilter      string
+	GroupAttribute     string
+	GroupBaseDN        string
+	GroupFilter        string
+	GroupNameAttribute string
+	Timeout            time.Duration
+}
+
+// ThrottleConfig is the throttle section.
+type ThrottleConfig struct {
+	// Store is the name of the failure store, which is one of "none", "memory", and "mysql".
+	Store                string
+	UserLockoutThreshold uint
+	IPLockoutThreshold   uint
+	BaseDelay            time.Duration
+	MaxDelay             time.Duration
+	LockoutDuration      time.Duration
+}
+
+// Read reads the auth section of c.
+func (r *AuthConfig) Read(c *goconf.ConfigFile) error {
+	if err := r.readCache(c); err != nil {
+		return err
+	}
+
+	// Use the SQL authenticator by default.
+	r.Backend = "sql"
+	if !c.HasOption("auth", "backend") {
+		return nil
+	}
+
+	backend, err := c.GetString("auth", "backend")
+	if err != nil {
+		return errors.New("invalid auth/backend value")
+	}
+	switch strings.ToLower(backend) {
+	case "sql", "mock":
+		r.Backend = strings.ToLower(backend)
+	case "api":
+		r.Backend = "api"
+		return r.readAPI(c)
+	case "ldap":
+		r.Backend = "ldap"
+		return r.readLDAP(c)
+	default:
+		return fmt.Errorf("invalid auth/backend value: %v", backend)
+	}
+
+	return nil
+}
+
+func (r *AuthConfig) readCache(c *goconf.ConfigFile) error {
+	// Cache successful results for 60 seconds and failed results for 10 seconds by default.
+	r.Cache.PositiveTTL = 60 * time.Second
+	r.Cache.NegativeTTL = 10 * time.Second
+
+	if c.HasOption("auth", "cache_ttl") {
+		ttl, err := c.GetInt("auth", "cache_ttl")
+		if err != nil || ttl < 0 {
+			return errors.New("invalid auth/cache_ttl value")
+		}
+		r.Cache.PositiveTTL = time.Duration(ttl) * time.Second
+	}
+	if c.HasOption("auth", "negative_cache_ttl") {
+		ttl, err := c.GetInt("auth", "negative_cache_ttl")
+		if err != nil || ttl <= 0 {
+			return errors.New("invalid auth/negative_cache_ttl value")
+		}
+		r.Cache.NegativeTTL = time.Duration(ttl) * time.Second
+	}
+
+	return nil
+}
+
+func (r *AuthConfig) readAPI(c *goconf.ConfigFile) error {
+	var err error
+
+	r.API.Host, err = c.GetString("auth", "host")
+	if err != nil || len(r.API.Host) == 0 {
+		return errors.New("empty auth/host value")
+	}
+
+	port, err := c.GetInt("auth", "port")
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("empty or invalid auth/port value")
+	}
+	r.API.Port = uint16(port)
+
+	r.API.Username, err = c.GetString("auth", "username")
+	if err != nil || len(r.API.Username) == 0 {
+		return errors.New("empty auth/username value")
+	}
+
+	r.API.Password, err = c.GetString("auth", "password")
+	if err != nil || len(r.API.Password) == 0 {
+		return errors.New("empty auth/password value")
+	}
+
+	r.API.Path, err = c.GetString("auth", "path")
+	if err != nil || len(r.API.Path) == 0 || r.API.Path[0] != '/' {
+		return errors.New("empty or invalid auth/path value")
+	}
+
+	r.API.TLS, err = c.GetBool("auth", "tls")
+	if err != nil {
+		return errors.New("invalid auth/tls value")
+	}
+
+	// timeout is optional.
+	if c.HasOption("auth", "timeout") {
+		timeout, err := c.GetInt("auth", "timeout")
+		if err != nil || timeout <= 0 {
+			return errors.New("invalid auth/timeout value")
+		}
+		r.API.Timeout = time.Duration(timeout) * time.Second
+	}
+
+	return nil
+}
+
+func (r *AuthConfig) readLDAP(c *goconf.ConfigFile) error {
+	var err error
+
+	r.LDAP.Host, err = c.GetString("auth", "host")
+	if err != nil || len(r.LDAP.Host) == 0 {
+		return errors.New("empty auth/host value")
+	}
+
+	port, err := c.GetInt("auth", "port")
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("empty or invalid auth/port value")
+	}
+	r.LDAP.Port = uint16(port)
+
+	r.LDAP.Security, err = c.GetString("auth", "security")
+	if err != nil {
+		return errors.New("empty auth/security value")
+	}
+	r.LDAP.Security = strings.ToLower(r.LDAP.Security)
+	switch r.LDAP.Security {
+	case "none", "starttls", "tls":
+	default:
+		return fmt.Errorf("invalid auth/security value: %v", r.LDAP.Security)
+	}
+
+	r.LDAP.BaseDN, err = c.GetString("auth", "base_dn")
+	if err != nil || len(r.LDAP.BaseDN) == 0 {
+		return errors.New("empty auth/base_dn value")
+	}
+
+	r.LDAP.UserFilter, err = c.GetString("auth", "user_filter")
+	if err != nil || len(r.LDAP.UserFilter) == 0 {
+		return errors.New("empty auth/user_filter value")
+	}
+
+	r.LDAP.UIDAttribute, err = c.GetString("auth", "uid_attribute")
+	if err != nil || len(r.LDAP.UIDAttribute) == 0 {
+		return errors.New("empty auth/uid_attribute value")
+	}
+
+	r.LDAP.NameAttribute, err = c.GetString("auth", "name_attribute")
+	if err != nil || len(r.LDAP.NameAttribute) == 0 {
+		return errors.New("empty auth/name_attribute value")
+	}
+
+	r.LDAP.MailAttribute, err = c.GetString("auth", "mail_attribute")
+	if err != nil || len(r.LDAP.MailAttribute) == 0 {
+		return errors.New("empty auth/mail_attribute value")
+	}
+
+	// Others are optional.
+	options := []struct {
+		name  string
+		value *string
+	}{
+		{"bind_dn", &r.LDAP.BindDN},
+		{"bind_password", &r.LDAP.BindPassword},
+		{"alias_attribute", &r.LDAP.AliasAttribute},
+		{"enabled_filter", &r.LDAP.EnabledFilter},
+		{"group_attribute", &r.LDAP.GroupAttribute},
+		{"group_base_dn", &r.LDAP.GroupBaseDN},
+		{"group_filter", &r.LDAP.GroupFilter},
+		{"group_name_attribute", &r.LDAP.GroupNameAttribute},
+	}
+	for _, v := range options {
+		if !c.HasOption("auth", v.name) {
+			continue
+		}
+		*v.value, err = c.GetString("auth", v.name)
+		if err != nil {
+			return fmt.Errorf("invalid auth/%v value", v.name)
+		}
+	}
+	if c.HasOption("auth", "timeout") {
+		timeout, err := c.GetInt("auth", "timeout")
+		if err != nil || timeout <= 0 {
+			return errors.New("invalid auth/timeout value")
+		}
+		r.LDAP.Timeout = time.Duration(timeout) * time.Second
+	}
+
+	return nil
+}
+
+// Read reads the throttle section of c.
+func (r *ThrottleConfig) Read(c *goconf.ConfigFile) error {
+	// Keep the counters in memory by default.
+	r.Store = "memory"
+	if c.HasOption("throttle", "store") {
+		store, err := c.GetString("throttle", "store")
+		if err != nil {
+			return errors.New("invalid throttle/store value")
+		}
+		switch strings.ToLower(store) {
+		case "none", "memory", "mysql":
+			r.Store = strings.ToLower(store)
+		default:
+			return fmt.Errorf("invalid throttle/store value: %v", store)
+		}
+	}
+
+	// Others are optional.
+	thresholds := []struct {
+		name  string
+		value *uint
+	}{
+		{"user_lockout_threshold", &r.UserLockoutThreshold},
+		{"ip_lockout_threshold", &r.IPLockoutThreshold},
+	}
+	for _, v := range thresholds {
+		if !c.HasOption("throttle", v.name) {
+			continue
+		}
+		n, err := c.GetInt("throttle", v.name)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid throttle/%v value", v.name)
+		}
+		*v.value = uint(n)
+	}
+
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"base_delay", &r.BaseDelay},
+		{"max_delay", &r.MaxDelay},
+		{"lockout_duration", &r.LockoutDuration},
+	}
+	for _, v := range durations {
+		if !c.HasOption("throttle", v.name) {
+			continue
+		}
+		n, err := c.GetInt("throttle", v.name)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid throttle/%v value", v.name)
+		}
+		*v.value = time.Duration(n) * time.Second
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package daemon
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dlintw/goconf"
+)
+
+func readConfig(t *testing.T, content string) *goconf.ConfigFile {
+	path := filepath.Join(t.TempDir(), "activesyncd.conf")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write the config file: %v", err)
+	}
+	c, err := goconf.ReadConfigFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the config file: %v", err)
+	}
+
+	return c
+}
+
+func TestAuthConfig(t *testing.T) {
+	var conf AuthConfig
+	if err := conf.Read(readConfig(t, "[default]\nlog_level = debug\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conf.Backend != "sql" || conf.Cache.PositiveTTL != 60*time.Second || conf.Cache.NegativeTTL != 10*time.Second {
+		t.Errorf("unexpected defaults: %+v", conf)
+	}
+
+	conf = AuthConfig{}
+	err := conf.Read(readConfig(t, `[auth]
+backend = LDAP
+cache_ttl = 0
+host = ldap.example.com
+port = 636
+security = TLS
+base_dn = dc=example,dc=com
+user_filter = (uid=%s)
+uid_attribute = uidNumber
+name_attribute = uid
+mail_attribute = mail
+group_attribute = memberOf
+timeout = 3
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conf.Backend != "ldap" || conf.Cache.PositiveTTL != 0 {
+		t.Errorf("unexpected backend or cache: %+v", conf)
+	}
+	if conf.LDAP.Host != "ldap.example.com" || conf.LDAP.Port != 636 || conf.LDAP.Security != "tls" || conf.LDAP.GroupAttribute != "memberOf" || conf.LDAP.Timeout != 3*time.Second {
+		t.Errorf("unexpected LDAP config: %+v", conf.LDAP)
+	}
+
+	conf = AuthConfig{}
+	err = conf.Read(readConfig(t, `[auth]
+backend = api
+host = auth.example.com
+port = 443
+username = omega
+password = secret
+path = /auth
+tls = true
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conf.Backend != "api" || conf.API.Host != "auth.example.com" || conf.API.Port != 443 || !conf.API.TLS || conf.API.Path != "/auth" {
+		t.Errorf("unexpected API config: %+v", conf)
+	}
+
+	invalid := []string{
+		"[auth]\nbackend = kerberos\n",
+		"[auth]\ncache_ttl = -1\n",
+		"[auth]\nnegative_cache_ttl = 0\n",
+		"[auth]\nbackend = api\nhost = auth.example.com\nport = 443\nusername = omega\npassword = secret\npath = auth\ntls = true\n",
+		"[auth]\nbackend = ldap\nhost = ldap.example.com\nport = 389\nsecurity = ssl\n",
+		"[auth]\nbackend = ldap\nhost = ldap.example.com\nport = 70000\n",
+	}
+	for _, v := range invalid {
+		conf = AuthConfig{}
+		if err := conf.Read(readConfig(t, v)); err == nil {
+			t.Errorf("expected an error: %q", v)
+		}
+	}
+}
+
+func TestThrottleConfig(t *testing.T) {
+	var conf ThrottleConfig
+	if err := conf.Read(readConfig(t, "[default]\nlog_level = debug\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conf != (ThrottleConfig{Store: "memory"}) {
+		t.Errorf("unexpected defaults: %+v", conf)
+	}
+
+	conf = ThrottleConfig{}
+	err := conf.Read(readConfig(t, `[throttle]
+store = MySQL
+user_lockout_threshold = 5
+ip_lockout_threshold = 50
+base_delay = 2
+max_delay = 60
+lockout_duration = 600
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := ThrottleConfig{
+		Store:                "mysql",
+		UserLockoutThreshold: 5,
+		IPLockoutThreshold:   50,
+		BaseDelay:            2 * time.Second,
+		MaxDelay:             time.Minute,
+		LockoutDuration:      10 * time.Minute,
+	}
+	if conf != expected {
+		t.Errorf("expected %+v, got %+v", expected, conf)
+	}
+
+	for _, v := range []string{"[throttle]\nstore = redis\n", "[throttle]\nuser_lockout_threshold = 0\n", "[throttle]\nbase_delay = -1\n"} {
+		conf = ThrottleConfig{}
+		if err := conf.Read(readConfig(t, v)); err == nil {
+			t.Errorf("expected an error: %q", v)
+		}
+	}
+}
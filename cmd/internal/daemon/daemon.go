@@ -0,0 +1,209 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package daemon
+
+import (
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/authenticator/api"
+	"github.com/superkkt/omega/authenticator/cache"
+	"github.com/superkkt/omega/authenticator/ldap"
+	omega "github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database/mysql"
+	"github.com/superkkt/omega/database/mysql/eas"
+	"github.com/superkkt/omega/database/mysql/user"
+	"github.com/superkkt/omega/mockup/authenticator"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+// NewAuthenticator returns the authenticator of conf. The sql authenticator
+// uses the users in backendDB.
+func NewAuthenticator(conf AuthConfig, db *mysql.MySQL, backendDB string) (omega.Authenticator, error) {
+	switch conf.Backend {
+	case "sql":
+		return user.NewAuthenticator(db, backendDB), nil
+	case "api":
+		scheme := "http"
+		if conf.API.TLS {
+			scheme = "https"
+		}
+		return api.New(api.Config{
+			URL:      fmt.Sprintf("%v://%v%v", scheme, net.JoinHostPort(conf.API.Host, strconv.Itoa(int(conf.API.Port))), conf.API.Path),
+			Username: conf.API.Username,
+			Password: conf.API.Password,
+			Timeout:  conf.API.Timeout,
+		})
+	case "ldap":
+		return NewLDAP(conf.LDAP)
+	case "mock":
+		logger.Warning("Using the mockup authenticator that only allows the test user. DO NOT USE IT IN PRODUCTION!")
+		return &authenticator.MockAuth{Username: "test", Password: "test"}, nil
+	default:
+		return nil, fmt.Errorf("unknown authenticator backend: %v", conf.Backend)
+	}
+}
+
+// NewLDAP returns the LDAP directory of conf.
+func NewLDAP(conf AuthLDAP) (*ldap.Authenticator, error) {
+	security := map[string]ldap.Security{
+		"none":     ldap.SecurityNone,
+		"starttls": ldap.SecurityStartTLS,
+		"tls":      ldap.SecurityTLS,
+	}
+	return ldap.New(ldap.Config{
+		Address:            net.JoinHostPort(conf.Host, strconv.Itoa(int(conf.Port))),
+		Security:           security[conf.Security],
+		BindDN:             conf.BindDN,
+		BindPassword:       conf.BindPassword,
+		BaseDN:             conf.BaseDN,
+		UserFilter:         conf.UserFilter,
+		UIDAttribute:       conf.UIDAttribute,
+		NameAttribute:      conf.NameAttribute,
+		MailAttribute:      conf.MailAttribute,
+		AliasAttribute:     conf.AliasAttribute,
+		EnabledFilter:      conf.EnabledFilter,
+		GroupAttribute:     conf.GroupAttribute,
+		GroupBaseDN:        conf.GroupBaseDN,
+		GroupFilter:        conf.GroupFilter,
+		GroupNameAttribute: conf.GroupNameAttribute,
+		Timeout:            conf.Timeout,
+	})
+}
+
+// NewAuthCache returns an authenticator that caches the results of auth, and a
+// function that flushes the cache. auth is returned as is if the cache is disabled.
+func NewAuthCache(conf AuthConfig, auth omega.Authenticator) (omega.Authenticator, func(), error) {
+	if conf.Cache.PositiveTTL == 0 {
+		return auth, func() {}, nil
+	}
+
+	c, err := cache.New(auth, cache.Config{
+		PositiveTTL: conf.Cache.PositiveTTL,
+		NegativeTTL: conf.Cache.NegativeTTL,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// The local user database reports the changes made by useradm and the admin API.
+	if src, ok := auth.(cache.ChangeSource); ok {
+		go c.Watch(context.Background(), src)
+	}
+
+	return c, c.Flush, nil
+}
+
+// NewThrottleConfig returns the brute-force protection of conf. The mysql
+// store keeps the counters in activeSyncDB, which is shared by all daemons.
+func NewThrottleConfig(conf ThrottleConfig, db *mysql.MySQL, activeSyncDB string) activesync.ThrottleConfig {
+	c := activesync.ThrottleConfig{
+		UserLockoutThreshold: conf.UserLockoutThreshold,
+		IPLockoutThreshold:   conf.IPLockoutThreshold,
+		BaseDelay:            conf.BaseDelay,
+		MaxDelay:             conf.MaxDelay,
+		LockoutDuration:      conf.LockoutDuration,
+	}
+	switch conf.Store {
+	case "memory":
+		c.Store = activesync.NewMemoryFailureStore()
+	case "mysql":
+		store := eas.NewFailureStore(db, activeSyncDB)
+		go purgeFailures(store, conf.LockoutDuration)
+		c.Store = store
+	}
+
+	return c
+}
+
+// purgeFailures periodically removes expired authentication failure counters.
+func purgeFailures(store *eas.FailureStore, expiry time.Duration) {
+	if expiry == 0 {
+		expiry = activesync.DefaultLockoutDuration
+	}
+
+	for range time.Tick(time.Hour) {
+		if err := store.Purge(expiry); err != nil {
+			logger.Error(fmt.Sprintf("Failed to purge expired authentication failures: %v", err))
+		}
+	}
+}
+
+// SignalHandler calls shutdown on SIGTERM and SIGINT, and flushAuthCache on
+// SIGHUP. flushAuthCache can be nil if there is no cache.
+func SignalHandler(shutdown context.CancelFunc, flushAuthCache func()) {
+	c := make(chan os.Signal, 5)
+	// Following signals will be transferred to the channel c.
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGPIPE)
+
+	shuttingDown := false
+	for {
+		switch sig := <-c; sig {
+		case syscall.SIGTERM, syscall.SIGINT:
+			// Exit immediately if we receive the signal again while waiting for the running sessions and requests.
+			if shuttingDown {
+				logger.Warning("Received the shutdown signal again, exiting without waiting...")
+				os.Exit(1)
+			}
+			logger.Info("Shutting down...")
+			shuttingDown = true
+			shutdown()
+		case syscall.SIGHUP:
+			if flushAuthCache == nil {
+				logger.Warning(fmt.Sprintf("Received %v signal!", sig))
+				continue
+			}
+			logger.Info("Flushing the authentication cache...")
+			flushAuthCache()
+		default:
+			logger.Warning(fmt.Sprintf("Received %v signal!", sig))
+		}
+	}
+}
+
+// InitSyslog sends the log messages of level or higher to syslog.
+func InitSyslog(level logger.Level) {
+	log, err := syslog.NewLogger(syslog.LOG_ERR|syslog.LOG_DAEMON, 0)
+	if err != nil {
+		log.Fatalf("Failed to init syslog: %v\n", err)
+	}
+	logger.SetLogger(log)
+	logger.SetLogLevel(level)
+	logger.SetPrefix(func() string {
+		return fmt.Sprintf("TID=%v, ", getGoRoutineID())
+	})
+}
+
+func getGoRoutineID() string {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	return strings.Fields(strings.TrimPrefix(string(buf[:n]), "goroutine "))[0]
+}
@@ -0,0 +1,429 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/cmd/internal/daemon"
+
+	"github.com/dlintw/goconf"
+	"github.com/superkkt/logger"
+)
+
+// Config is a subset of the activesyncd configurations that jmapd needs, and
+// the jmap section.
+type Config struct {
+	LogLevel logger.Level
+	DB       DSN
+	// TLS is the certificate of the ActiveSync listener.
+	TLS struct {
+		CertFile string
+		KeyFile  string
+	}
+	// SenderPolicy is one of "reject", "rewrite", and "allow", which is applied
+	// to emails from addresses that the user cannot send as.
+	SenderPolicy string
+	// SenderAllowUnverified allows emails of users who have no email address
+	// without the sender validation.
+	SenderAllowUnverified bool
+	Scanner               Scanner
+	Auth                  daemon.AuthConfig
+	HTTPAuth              HTTPAuth
+	Throttle              daemon.ThrottleConfig
+	JMAP                  JMAP
+}
+
+type DSN struct {
+	Host         string
+	Port         uint16
+	Username     string
+	Password     string
+	ActiveSyncDB string
+	BackendDB    string
+}
+
+type HTTPAuth struct {
+	// Basic and Bearer represent whether the listener accepts the basic and the bearer authentication schemes.
+	Basic  bool
+	Bearer bool
+	// KeyFile is a JWKS or PEM file that has keys to verify bearer tokens.
+	KeyFile  string
+	Issuer   string
+	Audience string
+	// UserClaim is the name of the token claim that identifies the user.
+	UserClaim string
+	// LookupAddress is true if the user claim is an email address.
+	LookupAddress bool
+	Leeway        time.Duration
+}
+
+type Scanner struct {
+	// Spamd and Clamd are the addresses of the daemons. Empty disables it.
+	Spamd string
+	// SpamdUser is the user whose preferences spamd uses.
+	SpamdUser string
+	// SpamdRejectScore is the spam score from which emails are rejected. Zero disables it.
+	SpamdRejectScore float64
+	Clamd            string
+	// ClamdVerdict is either "reject" or "quarantine", which is applied to infected emails.
+	ClamdVerdict string
+	// Inbound and Outbound decide the directions of emails to scan.
+	Inbound  bool
+	Outbound bool
+}
+
+type JMAP struct {
+	// Address accepts plain HTTP connections, which should be used behind a
+	// TLS terminating proxy, and TLSAddress accepts HTTPS connections. Empty
+	// disables it.
+	Address    string
+	TLSAddress string
+	// MaxSize is the maximum size of a request or an uploaded blob in bytes. Zero means the default.
+	MaxSize int64
+	// PollInterval is the interval to check changes for the event source connections. Zero means the default.
+	PollInterval time.Duration
+	// Maximum duration to wait for in-flight requests while shutting down. Zero means the default.
+	DrainTimeout time.Duration
+}
+
+func (r *Config) parseLogLevel(l string) error {
+	switch strings.ToUpper(l) {
+	case "DEBUG":
+		r.LogLevel = logger.LevelDebug
+	case "INFO":
+		r.LogLevel = logger.LevelInfo
+	case "WARNING":
+		r.LogLevel = logger.LevelWarning
+	case "ERROR":
+		r.LogLevel = logger.LevelError
+	case "FATAL":
+		r.LogLevel = logger.LevelFatal
+	default:
+		return fmt.Errorf("invalid log level: %v", l)
+	}
+
+	return nil
+}
+
+func (r *Config) Read(configFile string) error {
+	c, err := goconf.ReadConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	if err := r.readDefaultSection(c); err != nil {
+		return err
+	}
+	if err := r.readDatabaseSection(c); err != nil {
+		return err
+	}
+	if err := r.readSenderSection(c); err != nil {
+		return err
+	}
+	if err := r.readScannerSection(c); err != nil {
+		return err
+	}
+	if err := r.Auth.Read(c); err != nil {
+		return err
+	}
+	if err := r.readHTTPAuthSection(c); err != nil {
+		return err
+	}
+	if err := r.Throttle.Read(c); err != nil {
+		return err
+	}
+	if err := r.readJMAPSection(c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Config) readDefaultSection(c *goconf.ConfigFile) error {
+	var err error
+
+	logLevel, err := c.GetString("default", "log_level")
+	if err != nil || len(logLevel) == 0 {
+		return errors.New("invalid default/log_level in the config file")
+	}
+	if err := r.parseLogLevel(logLevel); err != nil {
+		return err
+	}
+
+	r.TLS.CertFile, err = c.GetString("default", "cert_file")
+	if err != nil || len(r.TLS.CertFile) == 0 {
+		return errors.New("empty default/cert_file value")
+	}
+	if r.TLS.CertFile[0] != '/' {
+		return errors.New("default/cert_file should be specified as an absolute path")
+	}
+
+	r.TLS.KeyFile, err = c.GetString("default", "key_file")
+	if err != nil || len(r.TLS.KeyFile) == 0 {
+		return errors.New("empty default/key_file value")
+	}
+	if r.TLS.KeyFile[0] != '/' {
+		return errors.New("default/key_file should be specified as an absolute path")
+	}
+
+	return nil
+}
+
+func (r *Config) readDatabaseSection(c *goconf.ConfigFile) error {
+	var err error
+
+	r.DB.Host, err = c.GetString("database", "host")
+	if err != nil || len(r.DB.Host) == 0 {
+		return errors.New("empty database/host value")
+	}
+
+	port, err := c.GetInt("database", "port")
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("empty or invalid database/port value")
+	}
+	r.DB.Port = uint16(port)
+
+	r.DB.Username, err = c.GetString("database", "username")
+	if err != nil || len(r.DB.Username) == 0 {
+		return errors.New("empty database/username value")
+	}
+
+	r.DB.Password, err = c.GetString("database", "password")
+	if err != nil || len(r.DB.Password) == 0 {
+		return errors.New("empty database/password value")
+	}
+
+	r.DB.ActiveSyncDB, err = c.GetString("database", "activesync_db")
+	if err != nil || len(r.DB.ActiveSyncDB) == 0 {
+		return errors.New("empty database/activesync_db value")
+	}
+
+	r.DB.BackendDB, err = c.GetString("database", "backend_db")
+	if err != nil || len(r.DB.BackendDB) == 0 {
+		return errors.New("empty database/backend_db value")
+	}
+
+	return nil
+}
+
+func (r *Config) readScannerSection(c *goconf.ConfigFile) error {
+	var err error
+
+	// All options are optional.
+	r.Scanner.ClamdVerdict = "reject"
+	r.Scanner.Inbound = true
+	r.Scanner.Outbound = true
+	strs := []struct {
+		name  string
+		value *string
+	}{
+		{"spamd", &r.Scanner.Spamd},
+		{"spamd_user", &r.Scanner.SpamdUser},
+		{"clamd", &r.Scanner.Clamd},
+		{"clamd_verdict", &r.Scanner.ClamdVerdict},
+	}
+	for _, v := range strs {
+		if !c.HasOption("scanner", v.name) {
+			continue
+		}
+		*v.value, err = c.GetString("scanner", v.name)
+		if err != nil || len(*v.value) == 0 {
+			return fmt.Errorf("invalid scanner/%v value", v.name)
+		}
+	}
+	if r.Scanner.ClamdVerdict != "reject" && r.Scanner.ClamdVerdict != "quarantine" {
+		return errors.New("invalid scanner/clamd_verdict value")
+	}
+	if c.HasOption("scanner", "spamd_reject_score") {
+		r.Scanner.SpamdRejectScore, err = c.GetFloat64("scanner", "spamd_reject_score")
+		if err != nil || r.Scanner.SpamdRejectScore < 0 {
+			return errors.New("invalid scanner/spamd_reject_score value")
+		}
+	}
+	bools := []struct {
+		name  string
+		value *bool
+	}{
+		{"inbound", &r.Scanner.Inbound},
+		{"outbound", &r.Scanner.Outbound},
+	}
+	for _, v := range bools {
+		if !c.HasOption("scanner", v.name) {
+			continue
+		}
+		*v.value, err = c.GetBool("scanner", v.name)
+		if err != nil {
+			return fmt.Errorf("invalid scanner/%v value", v.name)
+		}
+	}
+
+	return nil
+}
+
+func (r *Config) readSenderSection(c *goconf.ConfigFile) error {
+	// Reject emails from unauthorized addresses by default.
+	r.SenderPolicy = "reject"
+	if c.HasOption("sender", "policy") {
+		policy, err := c.GetString("sender", "policy")
+		if err != nil {
+			return errors.New("invalid sender/policy value")
+		}
+		switch strings.ToLower(policy) {
+		case "reject", "rewrite", "allow":
+			r.SenderPolicy = strings.ToLower(policy)
+		default:
+			return fmt.Errorf("invalid sender/policy value: %v", policy)
+		}
+	}
+	if c.HasOption("sender", "allow_unverified") {
+		v, err := c.GetBool("sender", "allow_unverified")
+		if err != nil {
+			return errors.New("invalid sender/allow_unverified value")
+		}
+		r.SenderAllowUnverified = v
+	}
+
+	return nil
+}
+
+func (r *Config) readHTTPAuthSection(c *goconf.ConfigFile) error {
+	// Only allow the basic authentication scheme by default.
+	r.HTTPAuth.Basic = true
+	if !c.HasOption("http_auth", "schemes") {
+		return nil
+	}
+
+	schemes, err := c.GetString("http_auth", "schemes")
+	if err != nil || len(schemes) == 0 {
+		return errors.New("empty http_auth/schemes value")
+	}
+	r.HTTPAuth.Basic = false
+	for _, v := range strings.Split(schemes, ",") {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "basic":
+			r.HTTPAuth.Basic = true
+		case "bearer":
+			r.HTTPAuth.Bearer = true
+		default:
+			return fmt.Errorf("invalid http_auth/schemes value: %v", v)
+		}
+	}
+	if !r.HTTPAuth.Bearer {
+		return nil
+	}
+
+	r.HTTPAuth.KeyFile, err = c.GetString("http_auth", "key_file")
+	if err != nil || len(r.HTTPAuth.KeyFile) == 0 {
+		return errors.New("empty http_auth/key_file value")
+	}
+	if r.HTTPAuth.KeyFile[0] != '/' {
+		return errors.New("http_auth/key_file should be specified as an absolute path")
+	}
+
+	r.HTTPAuth.Issuer, err = c.GetString("http_auth", "issuer")
+	if err != nil || len(r.HTTPAuth.Issuer) == 0 {
+		return errors.New("empty http_auth/issuer value")
+	}
+	r.HTTPAuth.Audience, err = c.GetString("http_auth", "audience")
+	if err != nil || len(r.HTTPAuth.Audience) == 0 {
+		return errors.New("empty http_auth/audience value")
+	}
+
+	// Others are optional.
+	if c.HasOption("http_auth", "user_claim") {
+		r.HTTPAuth.UserClaim, err = c.GetString("http_auth", "user_claim")
+		if err != nil {
+			return errors.New("invalid http_auth/user_claim value")
+		}
+	}
+	if c.HasOption("http_auth", "lookup_address") {
+		r.HTTPAuth.LookupAddress, err = c.GetBool("http_auth", "lookup_address")
+		if err != nil {
+			return errors.New("invalid http_auth/lookup_address value")
+		}
+	}
+	if c.HasOption("http_auth", "leeway") {
+		leeway, err := c.GetInt("http_auth", "leeway")
+		if err != nil || leeway <= 0 {
+			return errors.New("invalid http_auth/leeway value")
+		}
+		r.HTTPAuth.Leeway = time.Duration(leeway) * time.Second
+	}
+
+	return nil
+}
+
+func (r *Config) readJMAPSection(c *goconf.ConfigFile) error {
+	var err error
+
+	r.JMAP.TLSAddress = ":8443"
+
+	// All options are optional.
+	addresses := []struct {
+		name  string
+		value *string
+	}{
+		{"address", &r.JMAP.Address},
+		{"tls_address", &r.JMAP.TLSAddress},
+	}
+	for _, v := range addresses {
+		if !c.HasOption("jmap", v.name) {
+			continue
+		}
+		*v.value, err = c.GetString("jmap", v.name)
+		if err != nil {
+			return fmt.Errorf("invalid jmap/%v value", v.name)
+		}
+	}
+	if len(r.JMAP.Address) == 0 && len(r.JMAP.TLSAddress) == 0 {
+		return errors.New("both of jmap/address and jmap/tls_address are disabled")
+	}
+	if c.HasOption("jmap", "max_size") {
+		size, err := c.GetInt("jmap", "max_size")
+		if err != nil || size <= 0 {
+			return errors.New("invalid jmap/max_size value")
+		}
+		// In megabytes.
+		r.JMAP.MaxSize = int64(size) * 1024 * 1024
+	}
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"poll_interval", &r.JMAP.PollInterval},
+		{"drain_timeout", &r.JMAP.DrainTimeout},
+	}
+	for _, v := range durations {
+		if !c.HasOption("jmap", v.name) {
+			continue
+		}
+		n, err := c.GetInt("jmap", v.name)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid jmap/%v value", v.name)
+		}
+		*v.value = time.Duration(n) * time.Second
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/authenticator/jwt"
+	omega "github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/cert"
+	"github.com/superkkt/omega/cmd/internal/daemon"
+	"github.com/superkkt/omega/database/mysql"
+	"github.com/superkkt/omega/database/mysql/backend"
+	"github.com/superkkt/omega/database/mysql/user"
+	"github.com/superkkt/omega/jmap"
+	"github.com/superkkt/omega/outbox"
+	"github.com/superkkt/omega/scanner"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	programVersion = "0.1.0"
+	programName    = "jmapd"
+)
+
+var (
+	configFile  = flag.String("config", "/usr/local/etc/activesyncd.conf", "absolute path of the activesyncd configuration file")
+	showVersion = flag.Bool("version", false, "show program version and exit")
+)
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("%v (Version: %v)\n", programName, programVersion)
+		os.Exit(0)
+	}
+
+	config := new(Config)
+	if err := config.Read(*configFile); err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to read configurations: %v", err))
+	}
+	// NOTE: Enable clientFoundRows to cause an UPDATE to return the number of matching rows instead of the number of rows changed.
+	db, err := mysql.NewMySQL(config.DB.Host, config.DB.Username, config.DB.Password, config.DB.Port, true)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init database: %v", err))
+	}
+	cert, err := cert.NewLoader(config.TLS.CertFile, config.TLS.KeyFile)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to load the certification: %v", err))
+	}
+	dir, err := daemon.NewAuthenticator(config.Auth, db, config.DB.BackendDB)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the authenticator: %v", err))
+	}
+	auth, flushAuthCache, err := daemon.NewAuthCache(config.Auth, dir)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the authentication cache: %v", err))
+	}
+	reqAuth, err := newRequestAuthenticators(config, auth, dir)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the request authenticators: %v", err))
+	}
+	contentScanner, err := newContentScanner(config)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the content scanners: %v", err))
+	}
+	backendStorage := backend.New(config.DB.BackendDB)
+	server, err := jmap.NewServer(jmap.Config{
+		Auth:         reqAuth,
+		Storage:      backendStorage,
+		DB:           db,
+		Outbox:       outbox.NewEnqueuer(backendStorage, backendStorage),
+		Sender:       newSenderConfig(config, db),
+		Scanner:      newScannerConfig(contentScanner, config.Scanner.Outbound, backendStorage),
+		MaxSize:      config.JMAP.MaxSize,
+		PollInterval: config.JMAP.PollInterval,
+		DrainTimeout: config.JMAP.DrainTimeout,
+		Throttle:     daemon.NewThrottleConfig(config.Throttle, db, config.DB.ActiveSyncDB),
+	})
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to init the JMAP server: %v", err))
+	}
+	tlsConfig := &tls.Config{GetCertificate: cert.GetCertificate}
+	listeners, err := newListeners(config, tlsConfig)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Failed to listen: %v", err))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go daemon.SignalHandler(cancel, flushAuthCache)
+
+	daemon.InitSyslog(config.LogLevel)
+	logger.Info(fmt.Sprintf("%v is initialized..", programName))
+	wg := new(sync.WaitGroup)
+	for _, v := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			if err := server.Serve(ctx, l); err != nil {
+				logger.Fatal(fmt.Sprintf("Failed to serve JMAP on %v: %v", l.Addr(), err))
+			}
+		}(v)
+	}
+	wg.Wait()
+	logger.Info(fmt.Sprintf("%v is finished..", programName))
+}
+
+// newListeners returns the listeners of the configured addresses. Connections
+// accepted from the TLS address are secured by tlsConfig, and others are plain
+// HTTP connections.
+func newListeners(config *Config, tlsConfig *tls.Config) ([]net.Listener, error) {
+	result := []net.Listener{}
+	if len(config.JMAP.Address) > 0 {
+		l, err := net.Listen("tcp", config.JMAP.Address)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, l)
+	}
+	if len(config.JMAP.TLSAddress) > 0 {
+		l, err := net.Listen("tcp", config.JMAP.TLSAddress)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, tls.NewListener(l, tlsConfig))
+	}
+
+	return result, nil
+}
+
+// newRequestAuthenticators returns the authentication schemes of the listener.
+// auth verifies passwords, and dir, which is the underlying authenticator of
+// auth, is used to look up users of the bearer tokens.
+func newRequestAuthenticators(config *Config, auth, dir omega.Authenticator) ([]activesync.RequestAuthenticator, error) {
+	result := make([]activesync.RequestAuthenticator, 0)
+	if config.HTTPAuth.Basic {
+		result = append(result, &activesync.BasicAuth{Authenticator: auth, Realm: "JMAP"})
+	}
+	if !config.HTTPAuth.Bearer {
+		return result, nil
+	}
+
+	directory, ok := dir.(omega.Directory)
+	if !ok {
+		return nil, fmt.Errorf("the %v authenticator backend does not support the bearer authentication scheme", config.Auth.Backend)
+	}
+	keys, err := jwt.LoadKeySet(config.HTTPAuth.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := jwt.New(jwt.Config{
+		Keys:          keys,
+		Issuer:        config.HTTPAuth.Issuer,
+		Audience:      config.HTTPAuth.Audience,
+		UserClaim:     config.HTTPAuth.UserClaim,
+		LookupAddress: config.HTTPAuth.LookupAddress,
+		Directory:     directory,
+		Leeway:        config.HTTPAuth.Leeway,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(result, &activesync.BearerAuth{Verifier: verifier, Realm: "JMAP"}), nil
+}
+
+func newSenderConfig(config *Config, db *mysql.MySQL) activesync.SenderConfig {
+	policy := map[string]activesync.SenderPolicy{
+		"reject":  activesync.SenderReject,
+		"rewrite": activesync.SenderRewrite,
+		"allow":   activesync.SenderAllow,
+	}
+	result := activesync.SenderConfig{
+		Policy:          policy[config.SenderPolicy],
+		AllowUnverified: config.SenderAllowUnverified,
+	}
+	// Send-as delegations are stored with users of the sql backend.
+	if config.Auth.Backend == "sql" {
+		result.SendAs = user.NewAuthenticator(db, config.DB.BackendDB)
+	}
+
+	return result
+}
+
+// newContentScanner returns a chain of the configured content scanners, or nil
+// if there is no scanner.
+func newContentScanner(config *Config) (scanner.ContentScanner, error) {
+	chain := scanner.Chain{}
+	if len(config.Scanner.Clamd) > 0 {
+		verdict := scanner.VerdictReject
+		if config.Scanner.ClamdVerdict == "quarantine" {
+			verdict = scanner.VerdictQuarantine
+		}
+		clamd, err := scanner.NewClamd(scanner.ClamdConfig{
+			Address: config.Scanner.Clamd,
+			Verdict: verdict,
+		})
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, clamd)
+	}
+	if len(config.Scanner.Spamd) > 0 {
+		spamd, err := scanner.NewSpamd(scanner.SpamdConfig{
+			Address:     config.Scanner.Spamd,
+			User:        config.Scanner.SpamdUser,
+			RejectScore: config.Scanner.SpamdRejectScore,
+		})
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, spamd)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+
+	return chain, nil
+}
+
+// newScannerConfig returns a configuration that scans emails using s only if
+// enabled is true. The trainer is set regardless of enabled.
+func newScannerConfig(s scanner.ContentScanner, enabled bool, storage scanner.Storage) activesync.ScannerConfig {
+	c := activesync.ScannerConfig{}
+	if s == nil {
+		return c
+	}
+	if enabled {
+		c.Scanner = s
+		c.Quarantine = storage
+	}
+	if t, ok := s.(scanner.Trainer); ok {
+		c.Trainer = t
+	}
+
+	return c
+}
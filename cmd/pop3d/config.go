@@ -0,0 +1,211 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/superkkt/omega/cmd/internal/daemon"
+
+	"github.com/dlintw/goconf"
+	"github.com/superkkt/logger"
+)
+
+// Config is a subset of the activesyncd configurations that pop3d needs, and
+// the pop3 section.
+type Config struct {
+	LogLevel logger.Level
+	DB       DSN
+	// TLS is the certificate of the ActiveSync listener.
+	TLS struct {
+		CertFile string
+		KeyFile  string
+	}
+	Auth     daemon.AuthConfig
+	Throttle daemon.ThrottleConfig
+	POP3     POP3
+}
+
+type DSN struct {
+	Host         string
+	Port         uint16
+	Username     string
+	Password     string
+	ActiveSyncDB string
+	BackendDB    string
+}
+
+type POP3 struct {
+	// Address accepts connections that can be secured by STLS, and TLSAddress
+	// accepts TLS connections. Empty disables it.
+	Address    string
+	TLSAddress string
+	// AllowPlaintext allows authentication over insecure connections.
+	AllowPlaintext bool
+}
+
+func (r *Config) parseLogLevel(l string) error {
+	switch strings.ToUpper(l) {
+	case "DEBUG":
+		r.LogLevel = logger.LevelDebug
+	case "INFO":
+		r.LogLevel = logger.LevelInfo
+	case "WARNING":
+		r.LogLevel = logger.LevelWarning
+	case "ERROR":
+		r.LogLevel = logger.LevelError
+	case "FATAL":
+		r.LogLevel = logger.LevelFatal
+	default:
+		return fmt.Errorf("invalid log level: %v", l)
+	}
+
+	return nil
+}
+
+func (r *Config) Read(configFile string) error {
+	c, err := goconf.ReadConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	if err := r.readDefaultSection(c); err != nil {
+		return err
+	}
+	if err := r.readDatabaseSection(c); err != nil {
+		return err
+	}
+	if err := r.Auth.Read(c); err != nil {
+		return err
+	}
+	if err := r.Throttle.Read(c); err != nil {
+		return err
+	}
+	if err := r.readPOP3Section(c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Config) readDefaultSection(c *goconf.ConfigFile) error {
+	var err error
+
+	logLevel, err := c.GetString("default", "log_level")
+	if err != nil || len(logLevel) == 0 {
+		return errors.New("invalid default/log_level in the config file")
+	}
+	if err := r.parseLogLevel(logLevel); err != nil {
+		return err
+	}
+
+	r.TLS.CertFile, err = c.GetString("default", "cert_file")
+	if err != nil || len(r.TLS.CertFile) == 0 {
+		return errors.New("empty default/cert_file value")
+	}
+	if r.TLS.CertFile[0] != '/' {
+		return errors.New("default/cert_file should be specified as an absolute path")
+	}
+
+	r.TLS.KeyFile, err = c.GetString("default", "key_file")
+	if err != nil || len(r.TLS.KeyFile) == 0 {
+		return errors.New("empty default/key_file value")
+	}
+	if r.TLS.KeyFile[0] != '/' {
+		return errors.New("default/key_file should be specified as an absolute path")
+	}
+
+	return nil
+}
+
+func (r *Config) readDatabaseSection(c *goconf.ConfigFile) error {
+	var err error
+
+	r.DB.Host, err = c.GetString("database", "host")
+	if err != nil || len(r.DB.Host) == 0 {
+		return errors.New("empty database/host value")
+	}
+
+	port, err := c.GetInt("database", "port")
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("empty or invalid database/port value")
+	}
+	r.DB.Port = uint16(port)
+
+	r.DB.Username, err = c.GetString("database", "username")
+	if err != nil || len(r.DB.Username) == 0 {
+		return errors.New("empty database/username value")
+	}
+
+	r.DB.Password, err = c.GetString("database", "password")
+	if err != nil || len(r.DB.Password) == 0 {
+		return errors.New("empty database/password value")
+	}
+
+	r.DB.ActiveSyncDB, err = c.GetString("database", "activesync_db")
+	if err != nil || len(r.DB.ActiveSyncDB) == 0 {
+		return errors.New("empty database/activesync_db value")
+	}
+
+	r.DB.BackendDB, err = c.GetString("database", "backend_db")
+	if err != nil || len(r.DB.BackendDB) == 0 {
+		return errors.New("empty database/backend_db value")
+	}
+
+	return nil
+}
+
+func (r *Config) readPOP3Section(c *goconf.ConfigFile) error {
+	var err error
+
+	r.POP3.Address = ":110"
+	r.POP3.TLSAddress = ":995"
+
+	// All options are optional.
+	addresses := []struct {
+		name  string
+		value *string
+	}{
+		{"address", &r.POP3.Address},
+		{"tls_address", &r.POP3.TLSAddress},
+	}
+	for _, v := range addresses {
+		if !c.HasOption("pop3", v.name) {
+			continue
+		}
+		*v.value, err = c.GetString("pop3", v.name)
+		if err != nil {
+			return fmt.Errorf("invalid pop3/%v value", v.name)
+		}
+	}
+	if len(r.POP3.Address) == 0 && len(r.POP3.TLSAddress) == 0 {
+		return errors.New("both of pop3/address and pop3/tls_address are disabled")
+	}
+	if c.HasOption("pop3", "allow_plaintext") {
+		r.POP3.AllowPlaintext, err = c.GetBool("pop3", "allow_plaintext")
+		if err != nil {
+			return errors.New("invalid pop3/allow_plaintext value")
+		}
+	}
+
+	return nil
+}
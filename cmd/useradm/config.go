@@ -0,0 +1,86 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dlintw/goconf"
+)
+
+// Config is a subset of the activesyncd configurations that useradm needs.
+type Config struct {
+	DB struct {
+		Host         string
+		Port         uint16
+		Username     string
+		Password     string
+		ActiveSyncDB string
+		BackendDB    string
+	}
+}
+
+func (r *Config) Read(configFile string) error {
+	c, err := goconf.ReadConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	return r.readDatabaseSection(c)
+}
+
+func (r *Config) readDatabaseSection(c *goconf.ConfigFile) error {
+	var err error
+
+	r.DB.Host, err = c.GetString("database", "host")
+	if err != nil || len(r.DB.Host) == 0 {
+		return errors.New("empty database/host value")
+	}
+
+	port, err := c.GetInt("database", "port")
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("empty or invalid database/port value")
+	}
+	r.DB.Port = uint16(port)
+
+	r.DB.Username, err = c.GetString("database", "username")
+	if err != nil || len(r.DB.Username) == 0 {
+		return errors.New("empty database/username value")
+	}
+
+	r.DB.Password, err = c.GetString("database", "password")
+	if err != nil || len(r.DB.Password) == 0 {
+		return errors.New("empty database/password value")
+	}
+
+	r.DB.ActiveSyncDB, err = c.GetString("database", "activesync_db")
+	if err != nil || len(r.DB.ActiveSyncDB) == 0 {
+		return errors.New("empty database/activesync_db value")
+	}
+
+	r.DB.BackendDB, err = c.GetString("database", "backend_db")
+	if err != nil || len(r.DB.BackendDB) == 0 {
+		return fmt.Errorf("empty database/backend_db value")
+	}
+
+	return nil
+}
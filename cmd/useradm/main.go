@@ -0,0 +1,394 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql"
+	"github.com/superkkt/omega/database/mysql/backend"
+	"github.com/superkkt/omega/database/mysql/eas"
+	"github.com/superkkt/omega/database/mysql/user"
+	"github.com/superkkt/omega/sieve"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	programVersion = "0.1.0"
+	programName    = "useradm"
+)
+
+var (
+	configFile  = flag.String("config", "/usr/local/etc/activesyncd.conf", "absolute path of the activesyncd configuration file")
+	showVersion = flag.Bool("version", false, "show program version and exit")
+	// failures is the authentication failure store shared by activesyncd servers.
+	failures *eas.FailureStore
+	// scripts is the Sieve script store in the same transaction as the user manager.
+	scripts sieve.ScriptManager
+)
+
+type command struct {
+	args  string
+	desc  string
+	nArgs int
+	// optArgs is the number of optional arguments that follow the mandatory ones.
+	optArgs int
+	run     func(m *user.Manager, args []string) error
+}
+
+var commands = map[string]command{
+	"list":    {"", "list all users", 0, 0, listUsers},
+	"show":    {"NAME", "show a user", 1, 0, showUser},
+	"add":     {"NAME ADDRESS", "add a new user whose password is read from stdin", 2, 0, addUser},
+	"passwd":  {"NAME", "change the password of a user, which is read from stdin", 1, 0, changePassword},
+	"address": {"NAME ADDRESS", "change the primary address of a user", 2, 0, changeAddress},
+	"enable":  {"NAME", "enable a user", 1, 0, enableUser},
+	"disable": {"NAME", "disable a user", 1, 0, disableUser},
+	"delete":  {"NAME", "delete a user account without removing its emails", 1, 0, deleteUser},
+	"alias":   {"add|del NAME ADDRESS", "add or remove an alias address", 3, 0, alias},
+	"unlock":  {"user NAME | ip ADDRESS", "clear authentication failures of a user or an IP address", 2, 0, unlock},
+	"apppass": {"list NAME | add NAME LABEL [DEVICEID] | del NAME ID", "list, generate, or revoke app passwords", 2, 2, appPassword},
+	"sendas":  {"list NAME | add|del NAME ADDRESS", "list, grant, or revoke rights to send emails as other addresses", 2, 1, sendAs},
+	"sieve":   {"get|set|del NAME", "show, replace, or remove the Sieve script of a user, which is read from stdin by set", 2, 0, sieveScript},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [OPTIONS] COMMAND [ARGS]\n\nCommands:\n", programName)
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, name := range []string{"list", "show", "add", "passwd", "address", "enable", "disable", "delete", "alias", "apppass", "sendas", "sieve", "unlock"} {
+		c := commands[name]
+		fmt.Fprintf(w, "  %v %v\t%v\n", name, c.args, c.desc)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("%v (Version: %v)\n", programName, programVersion)
+		os.Exit(0)
+	}
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if n := flag.NArg() - 1; !ok || n < cmd.nArgs || n > cmd.nArgs+cmd.optArgs {
+		usage()
+		os.Exit(2)
+	}
+
+	config := new(Config)
+	if err := config.Read(*configFile); err != nil {
+		fatal("failed to read configurations: %v", err)
+	}
+	db, err := mysql.NewMySQL(config.DB.Host, config.DB.Username, config.DB.Password, config.DB.Port, true)
+	if err != nil {
+		fatal("failed to init database: %v", err)
+	}
+	failures = eas.NewFailureStore(db, config.DB.ActiveSyncDB)
+
+	tx := db.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		fatal("failed to begin a DB transaction: %v", err)
+	}
+	defer tx.Rollback()
+	scripts = backend.New(config.DB.BackendDB).NewScriptManager(tx)
+	if err := cmd.run(user.NewManager(tx, config.DB.BackendDB), flag.Args()[1:]); err != nil {
+		fatal("%v: %v", flag.Arg(0), describe(err))
+	}
+	if err := tx.Commit(); err != nil {
+		fatal("failed to commit the DB transaction: %v", err)
+	}
+}
+
+func fatal(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%v: %v\n", programName, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func describe(err error) string {
+	if e, ok := err.(database.NotFoundError); ok && e.IsNotFound() {
+		return "not found"
+	}
+	if e, ok := err.(database.DuplicatedError); ok && e.IsDuplicated() {
+		return "already exists"
+	}
+
+	return err.Error()
+}
+
+// readPassword reads a password from the first line of stdin.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return "", fmt.Errorf("failed to read a password: %v", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func listUsers(m *user.Manager, args []string) error {
+	users, err := m.GetUsers(database.LockNone)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "UID\tNAME\tADDRESS\tENABLED\tALIASES")
+	for _, v := range users {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", v.UID, v.Name, v.Address, v.Enabled, strings.Join(v.Aliases, ","))
+	}
+
+	return w.Flush()
+}
+
+func showUser(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[0], database.LockNone)
+	if err != nil {
+		return err
+	}
+
+	sendAs, err := m.GetSendAs(u.UID, database.LockNone)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("UID: %v\nName: %v\nAddress: %v\nEnabled: %v\nAliases: %v\nSend As: %v\n", u.UID, u.Name, u.Address, u.Enabled, strings.Join(u.Aliases, ", "), strings.Join(sendAs, ", "))
+	return nil
+}
+
+func addUser(m *user.Manager, args []string) error {
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	uid, err := m.AddUser(args[0], password, args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added a new user: UID=%v\n", uid)
+
+	return nil
+}
+
+func changePassword(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[0], database.LockWrite)
+	if err != nil {
+		return err
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	return m.UpdatePassword(u.UID, password)
+}
+
+func changeAddress(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[0], database.LockWrite)
+	if err != nil {
+		return err
+	}
+
+	return m.UpdateAddress(u.UID, args[1])
+}
+
+func enableUser(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[0], database.LockWrite)
+	if err != nil {
+		return err
+	}
+
+	return m.SetEnabled(u.UID, true)
+}
+
+func disableUser(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[0], database.LockWrite)
+	if err != nil {
+		return err
+	}
+
+	return m.SetEnabled(u.UID, false)
+}
+
+func deleteUser(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[0], database.LockWrite)
+	if err != nil {
+		return err
+	}
+
+	return m.DeleteUser(u.UID)
+}
+
+func alias(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[1], database.LockWrite)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		return m.AddAlias(u.UID, args[2])
+	case "del":
+		return m.RemoveAlias(u.UID, args[2])
+	default:
+		return fmt.Errorf("unknown alias operation: %v", args[0])
+	}
+}
+
+func sendAs(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[1], database.LockWrite)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		addresses, err := m.GetSendAs(u.UID, database.LockNone)
+		if err != nil {
+			return err
+		}
+		for _, v := range addresses {
+			fmt.Println(v)
+		}
+		return nil
+	case args[0] == "add" && len(args) == 3:
+		return m.AddSendAs(u.UID, args[2])
+	case args[0] == "del" && len(args) == 3:
+		return m.RemoveSendAs(u.UID, args[2])
+	default:
+		return fmt.Errorf("invalid send-as operation: %v", strings.Join(args, " "))
+	}
+}
+
+func sieveScript(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[1], database.LockWrite)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "get":
+		script, err := scripts.GetScript(u.UID, database.LockNone)
+		if err != nil {
+			return err
+		}
+		fmt.Print(script)
+		return nil
+	case "set":
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read a script: %v", err)
+		}
+		// Reject invalid scripts here because they are ignored on delivery.
+		if _, err := sieve.Parse(string(src)); err != nil {
+			return fmt.Errorf("invalid script: %v", err)
+		}
+		return scripts.SetScript(u.UID, string(src))
+	case "del":
+		return scripts.RemoveScript(u.UID)
+	default:
+		return fmt.Errorf("unknown sieve operation: %v", args[0])
+	}
+}
+
+func appPassword(m *user.Manager, args []string) error {
+	u, err := m.GetUser(args[1], database.LockWrite)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		return listAppPasswords(m, u)
+	case args[0] == "add" && len(args) >= 3:
+		deviceID := ""
+		if len(args) == 4 {
+			deviceID = args[3]
+		}
+		id, password, err := m.AddAppPassword(u.UID, args[2], deviceID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Generated a new app password: ID=%v, Password=%v\n", id, password)
+		return nil
+	case args[0] == "del" && len(args) == 3:
+		id, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid app password ID: %v", args[2])
+		}
+		return m.RemoveAppPassword(u.UID, id)
+	default:
+		return fmt.Errorf("invalid app password operation: %v", strings.Join(args, " "))
+	}
+}
+
+func listAppPasswords(m *user.Manager, u user.User) error {
+	passwords, err := m.GetAppPasswords(u.UID, database.LockNone)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLABEL\tDEVICE\tCREATED\tLAST USED")
+	for _, v := range passwords {
+		device := v.DeviceID
+		if len(device) == 0 {
+			device = "*"
+		}
+		lastUsed := "never"
+		if !v.LastUsed.IsZero() {
+			lastUsed = v.LastUsed.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", v.ID, v.Label, device, v.Created.Format("2006-01-02 15:04:05"), lastUsed)
+	}
+
+	return w.Flush()
+}
+
+// unlock clears the authentication failure counters kept in the mysql failure
+// store. It does not affect activesyncd servers using the memory store.
+func unlock(m *user.Manager, args []string) error {
+	switch args[0] {
+	case "user":
+		return failures.ClearFailure(activesync.UserFailureKey(args[1]))
+	case "ip":
+		return failures.ClearFailure(activesync.IPFailureKey(args[1]))
+	default:
+		return fmt.Errorf("unknown unlock target: %v", args[0])
+	}
+}
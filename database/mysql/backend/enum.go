@@ -32,6 +32,10 @@ func ConvToBackendFolderType(t string) backend.FolderType {
 		return backend.EmailTrash
 	case "SENT":
 		return backend.EmailSent
+	case "OUTBOX":
+		return backend.EmailOutbox
+	case "JUNK":
+		return backend.EmailJunk
 	default:
 		return backend.EmailFolder
 	}
@@ -49,6 +53,10 @@ func ConvToFolderTypeString(t backend.FolderType) string {
 		return "SENT"
 	case backend.EmailFolder:
 		return "FOLDER"
+	case backend.EmailOutbox:
+		return "OUTBOX"
+	case backend.EmailJunk:
+		return "JUNK"
 	default:
 		panic("Invalid folder type")
 	}
@@ -24,6 +24,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/superkkt/omega/backend"
 	"github.com/superkkt/omega/database"
@@ -155,8 +156,107 @@ func (r *FolderStorage) GetFolderByType(t backend.FolderType, lock database.Lock
 	return folders, nil
 }
 
+// GetFolderByPath walks down the folder tree from the root along path. A name
+// on the path is compared exactly first, and then case-insensitively if there
+// is no exact one. The first name "INBOX" always means the Inbox folder in any
+// case, as in IMAP. Ancestor folders are read-locked, unless lock is
+// database.LockNone, so that the path cannot be changed until the end of the
+// transaction.
 func (r *FolderStorage) GetFolderByPath(path []string, lock database.LockMode) (folder backend.Folder, err error) {
-	return backend.Folder{}, errors.New("unimplemented function")
+	if len(path) == 0 {
+		return backend.Folder{}, database.ErrNotFound
+	}
+
+	f := func(tx *sql.Tx) error {
+		var parentID uint64
+		for i, name := range path {
+			if len(name) == 0 {
+				return database.ErrNotFound
+			}
+			l := lock
+			if i < len(path)-1 && lock != database.LockNone {
+				l = database.LockRead
+			}
+
+			var err error
+			if i == 0 && strings.EqualFold(name, "INBOX") {
+				folder, err = r.getInbox(tx, l)
+			} else {
+				folder, err = r.getChildFolder(tx, parentID, name, l)
+			}
+			if err != nil {
+				return err
+			}
+			parentID = folder.ID
+		}
+
+		return nil
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return backend.Folder{}, err
+	}
+	return folder, nil
+}
+
+func (r *FolderStorage) getInbox(tx *sql.Tx, lock database.LockMode) (v backend.Folder, err error) {
+	qry := "SELECT `id`, `parent_id`, `name`, `type` "
+	qry += fmt.Sprintf("FROM `%v`.`folder` ", r.dbName)
+	qry += "WHERE user_id = ? AND `type` = ? AND available = true "
+	qry += "ORDER BY `id` ASC LIMIT 1"
+	qry += mysql.GetLockCmd(lock)
+
+	var t string
+	if err := tx.QueryRow(qry, r.c.UserUID(), ConvToFolderTypeString(backend.EmailInbox)).Scan(&v.ID, &v.ParentID, &v.Name, &t); err != nil {
+		return backend.Folder{}, err
+	}
+	v.Type = ConvToBackendFolderType(t)
+
+	return v, nil
+}
+
+// getChildFolder returns a folder whose parent is parentID and name is name.
+// The name column uses a case-insensitive collation, so the candidates are
+// filtered again here to prefer an exact match.
+func (r *FolderStorage) getChildFolder(tx *sql.Tx, parentID uint64, name string, lock database.LockMode) (backend.Folder, error) {
+	qry := "SELECT `id`, `parent_id`, `name`, `type` "
+	qry += fmt.Sprintf("FROM `%v`.`folder` ", r.dbName)
+	qry += "WHERE user_id = ? AND parent_id = ? AND name = ? AND available = true"
+	qry += mysql.GetLockCmd(lock)
+
+	rows, err := tx.Query(qry, r.c.UserUID(), parentID, name)
+	if err != nil {
+		return backend.Folder{}, err
+	}
+	defer rows.Close()
+
+	candidates := []backend.Folder{}
+	for rows.Next() {
+		var t string
+		v := backend.Folder{}
+		if err := rows.Scan(&v.ID, &v.ParentID, &v.Name, &t); err != nil {
+			return backend.Folder{}, err
+		}
+		v.Type = ConvToBackendFolderType(t)
+		if v.Name == name {
+			return v, nil
+		}
+		if strings.EqualFold(v.Name, name) {
+			candidates = append(candidates, v)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return backend.Folder{}, err
+	}
+
+	switch len(candidates) {
+	case 0:
+		return backend.Folder{}, database.ErrNotFound
+	case 1:
+		return candidates[0], nil
+	default:
+		return backend.Folder{}, fmt.Errorf("ambiguous folder name: parentID=%v, name=%v", parentID, name)
+	}
 }
 
 //AddFolder should add a new folder history.
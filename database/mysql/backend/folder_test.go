@@ -0,0 +1,348 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package backend
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql"
+
+	"golang.org/x/net/context"
+)
+
+// testFolder is a row of the folder table of testDriver.
+type testFolder struct {
+	id       int64
+	userID   int64
+	parentID int64
+	name     string
+	typ      string
+}
+
+var testFolders = []testFolder{
+	{1, 1, 0, "INBOX", "INBOX"},
+	{2, 1, 0, "Work", "FOLDER"},
+	{3, 1, 0, "work", "FOLDER"},
+	{4, 1, 2, "Projects", "FOLDER"},
+	{5, 1, 4, "2017", "FOLDER"},
+	{6, 1, 1, "Sub", "FOLDER"},
+	{7, 1, 0, "Archive", "FOLDER"},
+	{8, 1, 0, "Trash", "TRASH"},
+	{9, 2, 0, "Inbox", "INBOX"},
+	{10, 2, 0, "Personal", "FOLDER"},
+}
+
+func init() {
+	sql.Register("omega_folder_test", &testDriver{})
+}
+
+// testDriver is a database/sql driver that answers the SELECT queries of
+// FolderStorage.GetFolderByPath from testFolders. Names are compared
+// case-insensitively like the collation of the name column.
+type testDriver struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (r *testDriver) Open(name string) (driver.Conn, error) {
+	return &testConn{driver: r}, nil
+}
+
+// reset clears and returns the queries executed so far.
+func (r *testDriver) reset() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q := r.queries
+	r.queries = nil
+	return q
+}
+
+type testConn struct {
+	driver *testDriver
+}
+
+func (r *testConn) Prepare(query string) (driver.Stmt, error) {
+	return &testStmt{conn: r, query: query}, nil
+}
+
+func (r *testConn) Close() error {
+	return nil
+}
+
+func (r *testConn) Begin() (driver.Tx, error) {
+	return r, nil
+}
+
+func (r *testConn) Commit() error {
+	return nil
+}
+
+func (r *testConn) Rollback() error {
+	return nil
+}
+
+type testStmt struct {
+	conn  *testConn
+	query string
+}
+
+func (r *testStmt) Close() error {
+	return nil
+}
+
+func (r *testStmt) NumInput() int {
+	return -1
+}
+
+func (r *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("unexpected exec")
+}
+
+func (r *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	d := r.conn.driver
+	d.mu.Lock()
+	d.queries = append(d.queries, r.query)
+	d.mu.Unlock()
+
+	rows := &testRows{}
+	switch {
+	case strings.Contains(r.query, "`type` = ?") && len(args) == 2:
+		for _, v := range testFolders {
+			if v.userID == args[0].(int64) && v.typ == args[1].(string) {
+				rows.folders = append(rows.folders, v)
+				// ORDER BY `id` ASC LIMIT 1
+				break
+			}
+		}
+	case strings.Contains(r.query, "parent_id = ? AND name = ?") && len(args) == 3:
+		for _, v := range testFolders {
+			if v.userID == args[0].(int64) && v.parentID == args[1].(int64) && strings.EqualFold(v.name, args[2].(string)) {
+				rows.folders = append(rows.folders, v)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected query: %v", r.query)
+	}
+
+	return rows, nil
+}
+
+type testRows struct {
+	folders []testFolder
+}
+
+func (r *testRows) Columns() []string {
+	return []string{"id", "parent_id", "name", "type"}
+}
+
+func (r *testRows) Close() error {
+	return nil
+}
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if len(r.folders) == 0 {
+		return io.EOF
+	}
+	v := r.folders[0]
+	r.folders = r.folders[1:]
+	dest[0], dest[1], dest[2], dest[3] = v.id, v.parentID, v.name, v.typ
+
+	return nil
+}
+
+type testCredential uint64
+
+func (r testCredential) IsAuthorized() bool { return true }
+func (r testCredential) UserID() string     { return fmt.Sprintf("user%v", uint64(r)) }
+func (r testCredential) UserUID() uint64    { return uint64(r) }
+
+// getFolderByPath calls GetFolderByPath of uid in a new transaction, and
+// returns the queries executed by it.
+func getFolderByPath(t *testing.T, db *sql.DB, uid uint64, path []string, lock database.LockMode) (backend.Folder, []string, error) {
+	tx := mysql.NewMySQLWithDB(db).NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		t.Fatalf("failed to begin a transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	db.Driver().(*testDriver).reset()
+	s := &FolderStorage{c: testCredential(uid), queryer: tx, dbName: "omega"}
+	folder, err := s.GetFolderByPath(path, lock)
+
+	return folder, db.Driver().(*testDriver).reset(), err
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("omega_folder_test", "")
+	if err != nil {
+		t.Fatalf("failed to open the test database: %v", err)
+	}
+
+	return db
+}
+
+func TestGetFolderByPath(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	tests := []struct {
+		uid  uint64
+		path []string
+		id   uint64
+		typ  backend.FolderType
+	}{
+		// Nested paths.
+		{1, []string{"Work", "Projects"}, 4, backend.EmailFolder},
+		{1, []string{"Work", "Projects", "2017"}, 5, backend.EmailFolder},
+		// Exact matches are preferred to case-insensitive ones.
+		{1, []string{"Work"}, 2, backend.EmailFolder},
+		{1, []string{"work"}, 3, backend.EmailFolder},
+		// A single case-insensitive match.
+		{1, []string{"ARCHIVE"}, 7, backend.EmailFolder},
+		{1, []string{"work", "projects", "2017"}, 0, 0},
+		{1, []string{"Work", "PROJECTS", "2017"}, 5, backend.EmailFolder},
+		{1, []string{"trash"}, 8, backend.EmailTrash},
+		// INBOX in any case.
+		{1, []string{"INBOX"}, 1, backend.EmailInbox},
+		{1, []string{"inbox"}, 1, backend.EmailInbox},
+		{1, []string{"InBox", "sub"}, 6, backend.EmailFolder},
+		{2, []string{"INBOX"}, 9, backend.EmailInbox},
+		{2, []string{"personal"}, 10, backend.EmailFolder},
+	}
+	for _, v := range tests {
+		folder, _, err := getFolderByPath(t, db, v.uid, v.path, database.LockNone)
+		if v.id == 0 {
+			if err == nil || !err.(database.NotFoundError).IsNotFound() {
+				t.Errorf("uid=%v, path=%q: expected not found, got folder=%+v, err=%v", v.uid, v.path, folder, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("uid=%v, path=%q: unexpected error: %v", v.uid, v.path, err)
+			continue
+		}
+		if folder.ID != v.id || folder.Type != v.typ {
+			t.Errorf("uid=%v, path=%q: expected id=%v, type=%v, got %+v", v.uid, v.path, v.id, v.typ, folder)
+		}
+	}
+}
+
+func TestGetFolderByPathNotFound(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	if _, _, err := getFolderByPath(t, db, 1, nil, database.LockNone); err != database.ErrNotFound {
+		t.Errorf("empty path: expected database.ErrNotFound, got %v", err)
+	}
+
+	paths := [][]string{
+		{"Missing"},
+		{"Work", "Missing"},
+		{"Work", "Projects", "2017", "Missing"},
+		// Empty segments.
+		{""},
+		{"Work", "", "Projects"},
+		{"Work", "Projects", ""},
+		// Folders of another user.
+		{"Personal"},
+		// Sub is not on the root.
+		{"Sub"},
+	}
+	for _, v := range paths {
+		folder, _, err := getFolderByPath(t, db, 1, v, database.LockNone)
+		if err == nil {
+			t.Errorf("path=%q: expected not found, got %+v", v, folder)
+			continue
+		}
+		e, ok := err.(database.NotFoundError)
+		if !ok || !e.IsNotFound() {
+			t.Errorf("path=%q: expected a not found error, got %v", v, err)
+		}
+	}
+}
+
+func TestGetFolderByPathAmbiguous(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	for _, v := range [][]string{{"WORK"}, {"wOrK", "Projects"}} {
+		folder, _, err := getFolderByPath(t, db, 1, v, database.LockNone)
+		if err == nil {
+			t.Errorf("path=%q: expected an ambiguous name error, got %+v", v, folder)
+			continue
+		}
+		if err.(database.NotFoundError).IsNotFound() {
+			t.Errorf("path=%q: expected an ambiguous name error, got not found: %v", v, err)
+		}
+		if !strings.Contains(err.Error(), "ambiguous") {
+			t.Errorf("path=%q: unexpected error: %v", v, err)
+		}
+	}
+}
+
+func TestGetFolderByPathLock(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	tests := []struct {
+		lock     database.LockMode
+		ancestor string
+		last     string
+	}{
+		{database.LockNone, "", ""},
+		{database.LockRead, "LOCK IN SHARE MODE", "LOCK IN SHARE MODE"},
+		{database.LockWrite, "LOCK IN SHARE MODE", "FOR UPDATE"},
+	}
+	for _, v := range tests {
+		_, queries, err := getFolderByPath(t, db, 1, []string{"inbox", "Sub"}, v.lock)
+		if err != nil {
+			t.Errorf("lock=%v: unexpected error: %v", v.lock, err)
+			continue
+		}
+		if len(queries) != 2 {
+			t.Errorf("lock=%v: expected 2 queries, got %q", v.lock, queries)
+			continue
+		}
+		check := func(query, expected string) {
+			if expected == "" {
+				if strings.Contains(query, "LOCK IN SHARE MODE") || strings.Contains(query, "FOR UPDATE") {
+					t.Errorf("lock=%v: unexpected lock: %v", v.lock, query)
+				}
+				return
+			}
+			if !strings.Contains(query, expected) {
+				t.Errorf("lock=%v: expected %v: %v", v.lock, expected, query)
+			}
+		}
+		check(queries[0], v.ancestor)
+		check(queries[1], v.last)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/outbox"
+)
+
+// NewQueue implements the outbox.Storage interface.
+func (r *storage) NewQueue(queryer database.Queryer) outbox.Queue {
+	return &OutboxQueue{
+		queryer: queryer,
+		dbName:  r.dbName,
+	}
+}
+
+// OutboxQueue implements the outbox.Queue interface using the outbox_queue table.
+type OutboxQueue struct {
+	queryer database.Queryer
+	dbName  string
+}
+
+func (r *OutboxQueue) AddEntry(e outbox.Entry) (id uint64, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("INSERT INTO `%v`.`outbox_queue`", r.dbName)
+		qry += "(`user_id`, `user_name`, `folder_id`, `email_id`, `sender`, `recipients`, `save_in_sent`, `next_attempt`) "
+		qry += "VALUES(?, ?, ?, ?, ?, ?, ?, ?)"
+		// Recipients are separated by newlines, which cannot be a part of an email address.
+		result, err := tx.Exec(qry, e.UserUID, e.UserName, e.FolderID, e.EmailID, e.From, strings.Join(e.To, "\n"), e.SaveInSent, e.NextAttempt)
+		if err != nil {
+			return err
+		}
+		v, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = uint64(v)
+
+		return nil
+	}
+	if err := r.queryer.Query(f); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (r *OutboxQueue) GetDueEntries(limit uint) (entries []outbox.Entry, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `id`, `user_id`, `user_name`, `folder_id`, `email_id`, `sender`, `recipients`, `save_in_sent`, "
+		qry += "`attempts`, `next_attempt`, `last_error`, `timestamp` "
+		qry += fmt.Sprintf("FROM `%v`.`outbox_queue` ", r.dbName)
+		qry += "WHERE `next_attempt` <= NOW() "
+		qry += "ORDER BY `next_attempt` ASC LIMIT ?"
+
+		rows, err := tx.Query(qry, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			v := outbox.Entry{}
+			var rcpts string
+			if err := rows.Scan(&v.ID, &v.UserUID, &v.UserName, &v.FolderID, &v.EmailID, &v.From, &rcpts, &v.SaveInSent,
+				&v.Attempts, &v.NextAttempt, &v.LastError, &v.Created); err != nil {
+				return err
+			}
+			v.To = strings.Split(rcpts, "\n")
+			entries = append(entries, v)
+		}
+
+		return rows.Err()
+	}
+	if err := r.queryer.Query(f); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (r *OutboxQueue) ClaimEntry(id uint64, attempts uint, lease time.Duration) (ok bool, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("UPDATE `%v`.`outbox_queue` ", r.dbName)
+		qry += "SET `attempts` = `attempts` + 1, `next_attempt` = NOW() + INTERVAL ? SECOND "
+		qry += "WHERE `id` = ? AND `attempts` = ?"
+		result, err := tx.Exec(qry, int64(lease/time.Second), id, attempts)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		ok = n > 0
+
+		return nil
+	}
+	if err := r.queryer.Query(f); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (r *OutboxQueue) RescheduleEntry(id uint64, to []string, next time.Time, lastError string) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("UPDATE `%v`.`outbox_queue` ", r.dbName)
+		qry += "SET `recipients` = ?, `next_attempt` = ?, `last_error` = ? WHERE `id` = ?"
+		_, err := tx.Exec(qry, strings.Join(to, "\n"), next, lastError, id)
+		return err
+	}
+
+	return r.queryer.Query(f)
+}
+
+func (r *OutboxQueue) RemoveEntry(id uint64) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("DELETE FROM `%v`.`outbox_queue` WHERE `id` = ?", r.dbName)
+		_, err := tx.Exec(qry, id)
+		return err
+	}
+
+	return r.queryer.Query(f)
+}
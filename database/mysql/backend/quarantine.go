@@ -0,0 +1,80 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/scanner"
+)
+
+// NewQuarantine implements the scanner.Storage interface.
+func (r *storage) NewQuarantine(queryer database.Queryer) scanner.Quarantine {
+	return &QuarantineStorage{
+		queryer: queryer,
+		dbName:  r.dbName,
+	}
+}
+
+// QuarantineStorage implements the scanner.Quarantine interface using the
+// quarantine table.
+type QuarantineStorage struct {
+	queryer database.Queryer
+	dbName  string
+}
+
+func (r *QuarantineStorage) AddMessage(m scanner.QuarantinedMessage) (id uint64, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("INSERT INTO `%v`.`quarantine`", r.dbName)
+		qry += "(`user_id`, `direction`, `sender`, `recipients`, `reason`, `data`) "
+		qry += "VALUES(?, ?, ?, ?, ?, ?)"
+		// Recipients are separated by newlines as in the outbox_queue table.
+		result, err := tx.Exec(qry, m.UserUID, ConvToDirectionString(m.Direction), m.From, strings.Join(m.To, "\n"), m.Reason, m.Raw)
+		if err != nil {
+			return err
+		}
+		v, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = uint64(v)
+
+		return nil
+	}
+	if err := r.queryer.Query(f); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func ConvToDirectionString(d scanner.Direction) string {
+	switch d {
+	case scanner.Inbound:
+		return "INBOUND"
+	case scanner.Outbound:
+		return "OUTBOUND"
+	default:
+		panic("Invalid direction")
+	}
+}
@@ -3,7 +3,7 @@ CREATE TABLE `folder` (
   `user_id` bigint(20) unsigned NOT NULL,
   `parent_id` bigint(20) unsigned NOT NULL DEFAULT 0,
   `name` varchar(64) NOT NULL,
-  `type` enum('INBOX', 'DRAFT', 'TRASH', 'SENT', 'FOLDER') NOT NULL default 'INBOX',
+  `type` enum('INBOX', 'DRAFT', 'TRASH', 'SENT', 'FOLDER', 'OUTBOX', 'JUNK') NOT NULL default 'INBOX',
   `available` tinyint(1) default true,
   `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (`id`),
@@ -83,3 +83,53 @@ CREATE TABLE `attachment` (
   KEY `email_id` (`email_id`),
   CONSTRAINT `attachment_ibfk_1` FOREIGN KEY (`email_id`) REFERENCES `email` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `outbox_queue` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` bigint(20) unsigned NOT NULL,
+  `user_name` varchar(128) NOT NULL,
+  `folder_id` bigint(20) unsigned NOT NULL,
+  `email_id` bigint(20) unsigned NOT NULL,
+  `sender` varchar(255) NOT NULL,
+  `recipients` text NOT NULL,
+  `save_in_sent` tinyint(1) NOT NULL,
+  `attempts` int(10) unsigned NOT NULL DEFAULT 0,
+  `next_attempt` datetime NOT NULL,
+  `last_error` varchar(1024) NOT NULL DEFAULT '',
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `next_attempt` (`next_attempt`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `sieve_script` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` bigint(20) unsigned NOT NULL,
+  `script` mediumtext NOT NULL,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `vacation_response` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` bigint(20) unsigned NOT NULL,
+  `handle` varchar(64) NOT NULL,
+  `sender` varchar(255) NOT NULL,
+  `expiry` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `sender` (`user_id`, `handle`, `sender`),
+  KEY `expiry` (`expiry`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `quarantine` (
+  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` bigint(20) unsigned NOT NULL,
+  `direction` enum('INBOUND', 'OUTBOUND') NOT NULL,
+  `sender` varchar(255) NOT NULL,
+  `recipients` text NOT NULL,
+  `reason` varchar(1024) NOT NULL DEFAULT '',
+  `data` LONGBLOB NOT NULL,
+  `timestamp` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,118 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql"
+	"github.com/superkkt/omega/sieve"
+)
+
+// NewScriptManager implements the sieve.Storage interface.
+func (r *storage) NewScriptManager(queryer database.Queryer) sieve.ScriptManager {
+	return &SieveStorage{
+		queryer: queryer,
+		dbName:  r.dbName,
+	}
+}
+
+// SieveStorage implements the sieve.ScriptManager interface using the
+// sieve_script and vacation_response tables.
+type SieveStorage struct {
+	queryer database.Queryer
+	dbName  string
+}
+
+func (r *SieveStorage) GetScript(uid uint64, lock database.LockMode) (script string, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("SELECT `script` FROM `%v`.`sieve_script` WHERE `user_id` = ? ", r.dbName)
+		qry += mysql.GetLockCmd(lock)
+		return tx.QueryRow(qry, uid).Scan(&script)
+	}
+	if err := r.queryer.Query(f); err != nil {
+		return "", err
+	}
+	return script, nil
+}
+
+func (r *SieveStorage) SetScript(uid uint64, script string) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("INSERT INTO `%v`.`sieve_script`(`user_id`, `script`) VALUES(?, ?) ", r.dbName)
+		qry += "ON DUPLICATE KEY UPDATE `script` = VALUES(`script`)"
+		_, err := tx.Exec(qry, uid, script)
+		return err
+	}
+
+	return r.queryer.Query(f)
+}
+
+func (r *SieveStorage) RemoveScript(uid uint64) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("DELETE FROM `%v`.`sieve_script` WHERE `user_id` = ?", r.dbName)
+		result, err := tx.Exec(qry, uid)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return database.ErrNotFound
+		}
+
+		return nil
+	}
+
+	return r.queryer.Query(f)
+}
+
+func (r *SieveStorage) AddVacationResponse(uid uint64, handle, sender string, period time.Duration) (ok bool, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("DELETE FROM `%v`.`vacation_response` WHERE `user_id` = ? AND `expiry` < NOW()", r.dbName)
+		if _, err := tx.Exec(qry, uid); err != nil {
+			return err
+		}
+
+		// INSERT IGNORE affects no row if there is a record that has not expired.
+		qry = fmt.Sprintf("INSERT IGNORE INTO `%v`.`vacation_response`(`user_id`, `handle`, `sender`, `expiry`) ", r.dbName)
+		qry += "VALUES(?, ?, ?, NOW() + INTERVAL ? SECOND)"
+		result, err := tx.Exec(qry, uid, handle, sender, int64(period/time.Second))
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		ok = n > 0
+
+		return nil
+	}
+	if err := r.queryer.Query(f); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
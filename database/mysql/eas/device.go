@@ -0,0 +1,346 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package eas
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql"
+)
+
+// NewDeviceManager implements the activesync.DeviceStorage interface.
+func (r *storage) NewDeviceManager(queryer database.Queryer) activesync.DeviceManager {
+	return &deviceManager{
+		queryer: queryer,
+		dbName:  r.dbName,
+	}
+}
+
+// deviceManager implements the activesync.DeviceManager interface using the
+// synchronization state tables, and the device_policy,
+// device_group_policy, and device_wipe tables.
+type deviceManager struct {
+	queryer database.Queryer
+	dbName  string
+}
+
+// GetDevices finds the devices from the folder and email sync keys because
+// there is no table of the devices.
+func (r *deviceManager) GetDevices(userUID uint64) (devices []activesync.Device, err error) {
+	f := func(tx *sql.Tx) error {
+		cond := ""
+		args := []interface{}{}
+		if userUID > 0 {
+			cond = "WHERE `user_uid` = ? "
+			args = append(args, userUID, userUID)
+		}
+		qry := "SELECT `user_uid`, `device_id`, MAX(`timestamp`) FROM ("
+		qry += fmt.Sprintf("SELECT `user_uid`, `device_id`, `timestamp` FROM `%v`.`folder_synckey` %v", r.dbName, cond)
+		qry += "UNION ALL "
+		qry += fmt.Sprintf("SELECT `user_uid`, `device_id`, `timestamp` FROM `%v`.`email_synckey` %v", r.dbName, cond)
+		qry += ") AS `synckey` GROUP BY `user_uid`, `device_id` ORDER BY `user_uid` ASC, `device_id` ASC"
+
+		rows, err := tx.Query(qry, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			v := activesync.Device{}
+			if err := rows.Scan(&v.UserUID, &v.DeviceID, &v.LastSync); err != nil {
+				return err
+			}
+			devices = append(devices, v)
+		}
+
+		return rows.Err()
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (r *deviceManager) GetDeviceFolders(userUID uint64, deviceID string) (folders []activesync.DeviceFolder, err error) {
+	result := make(map[uint64]*activesync.DeviceFolder)
+	get := func(id uint64) *activesync.DeviceFolder {
+		v, ok := result[id]
+		if !ok {
+			v = &activesync.DeviceFolder{ID: id}
+			result[id] = v
+		}
+		return v
+	}
+
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `folder_id`, `parent_folder_id`, `name`, `last_history_id` "
+		qry += fmt.Sprintf("FROM `%v`.`virtual_folder` ", r.dbName)
+		qry += "WHERE `user_uid` = ? AND `device_id` = ?"
+		rows, err := tx.Query(qry, userUID, deviceID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, parentID, historyID uint64
+			var name string
+			if err := rows.Scan(&id, &parentID, &name, &historyID); err != nil {
+				return err
+			}
+			v := get(id)
+			v.ParentID, v.Name, v.LastHistoryID = parentID, name, historyID
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		qry = fmt.Sprintf("SELECT `folder_id`, MAX(`id`) FROM `%v`.`email_synckey` ", r.dbName)
+		qry += "WHERE `user_uid` = ? AND `device_id` = ? GROUP BY `folder_id`"
+		if err := scanCounts(tx, qry, userUID, deviceID, func(id, n uint64) { get(id).SyncKey = n }); err != nil {
+			return err
+		}
+
+		qry = fmt.Sprintf("SELECT `folder_id`, COUNT(*) FROM `%v`.`virtual_email` ", r.dbName)
+		qry += "WHERE `user_uid` = ? AND `device_id` = ? GROUP BY `folder_id`"
+		return scanCounts(tx, qry, userUID, deviceID, func(id, n uint64) { get(id).Emails = n })
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return nil, err
+	}
+	for _, v := range result {
+		folders = append(folders, *v)
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].ID < folders[j].ID })
+
+	return folders, nil
+}
+
+// scanCounts calls set with each pair of a folder ID and a number returned by qry.
+func scanCounts(tx *sql.Tx, qry string, userUID uint64, deviceID string, set func(folderID, n uint64)) error {
+	rows, err := tx.Query(qry, userUID, deviceID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, n uint64
+		if err := rows.Scan(&id, &n); err != nil {
+			return err
+		}
+		set(id, n)
+	}
+
+	return rows.Err()
+}
+
+func (r *deviceManager) GetPolicy(userUID uint64, lock database.LockMode) (policy activesync.Policy, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `password_required`, `min_password_length`, `alphanumeric_password`, `inactivity_timeout`, `max_failed_attempts` "
+		qry += fmt.Sprintf("FROM `%v`.`device_policy` WHERE `user_uid` = ? ", r.dbName)
+		qry += mysql.GetLockCmd(lock)
+		var timeout int64
+		if err := tx.QueryRow(qry, userUID).Scan(&policy.PasswordRequired, &policy.MinPasswordLength, &policy.AlphanumericPassword, &timeout, &policy.MaxFailedAttempts); err != nil {
+			return err
+		}
+		policy.InactivityTimeout = time.Duration(timeout) * time.Second
+
+		return nil
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return activesync.Policy{}, err
+	}
+	return policy, nil
+}
+
+func (r *deviceManager) SetPolicy(userUID uint64, policy activesync.Policy) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("INSERT INTO `%v`.`device_policy` ", r.dbName)
+		qry += "(`user_uid`, `password_required`, `min_password_length`, `alphanumeric_password`, `inactivity_timeout`, `max_failed_attempts`, `timestamp`) "
+		qry += "VALUES(?, ?, ?, ?, ?, ?, NOW()) "
+		qry += "ON DUPLICATE KEY UPDATE `password_required` = VALUES(`password_required`), "
+		qry += "`min_password_length` = VALUES(`min_password_length`), "
+		qry += "`alphanumeric_password` = VALUES(`alphanumeric_password`), "
+		qry += "`inactivity_timeout` = VALUES(`inactivity_timeout`), "
+		qry += "`max_failed_attempts` = VALUES(`max_failed_attempts`), "
+		qry += "`timestamp` = NOW()"
+		_, err := tx.Exec(qry, userUID, policy.PasswordRequired, policy.MinPasswordLength, policy.AlphanumericPassword, int64(policy.InactivityTimeout/time.Second), policy.MaxFailedAttempts)
+		return err
+	}
+
+	return r.queryer.Query(f)
+}
+
+func (r *deviceManager) RemovePolicy(userUID uint64) error {
+	return r.exec(fmt.Sprintf("DELETE FROM `%v`.`device_policy` WHERE `user_uid` = ?", r.dbName), userUID)
+}
+
+func (r *deviceManager) GetGroupPolicy(group string, lock database.LockMode) (policy activesync.Policy, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `password_required`, `min_password_length`, `alphanumeric_password`, `inactivity_timeout`, `max_failed_attempts` "
+		qry += fmt.Sprintf("FROM `%v`.`device_group_policy` WHERE `group` = ? ", r.dbName)
+		qry += mysql.GetLockCmd(lock)
+		var timeout int64
+		if err := tx.QueryRow(qry, group).Scan(&policy.PasswordRequired, &policy.MinPasswordLength, &policy.AlphanumericPassword, &timeout, &policy.MaxFailedAttempts); err != nil {
+			return err
+		}
+		policy.InactivityTimeout = time.Duration(timeout) * time.Second
+
+		return nil
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return activesync.Policy{}, err
+	}
+	return policy, nil
+}
+
+func (r *deviceManager) SetGroupPolicy(group string, policy activesync.Policy) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("INSERT INTO `%v`.`device_group_policy` ", r.dbName)
+		qry += "(`group`, `password_required`, `min_password_length`, `alphanumeric_password`, `inactivity_timeout`, `max_failed_attempts`, `timestamp`) "
+		qry += "VALUES(?, ?, ?, ?, ?, ?, NOW()) "
+		qry += "ON DUPLICATE KEY UPDATE `password_required` = VALUES(`password_required`), "
+		qry += "`min_password_length` = VALUES(`min_password_length`), "
+		qry += "`alphanumeric_password` = VALUES(`alphanumeric_password`), "
+		qry += "`inactivity_timeout` = VALUES(`inactivity_timeout`), "
+		qry += "`max_failed_attempts` = VALUES(`max_failed_attempts`), "
+		qry += "`timestamp` = NOW()"
+		_, err := tx.Exec(qry, group, policy.PasswordRequired, policy.MinPasswordLength, policy.AlphanumericPassword, int64(policy.InactivityTimeout/time.Second), policy.MaxFailedAttempts)
+		return err
+	}
+
+	return r.queryer.Query(f)
+}
+
+func (r *deviceManager) RemoveGroupPolicy(group string) error {
+	return r.exec(fmt.Sprintf("DELETE FROM `%v`.`device_group_policy` WHERE `group` = ?", r.dbName), group)
+}
+
+func (r *deviceManager) GetWipes(userUID uint64, lock database.LockMode) (wipes []activesync.Wipe, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `user_uid`, `device_id`, `status`, `requested`, IFNULL(UNIX_TIMESTAMP(`acknowledged`), 0) "
+		qry += fmt.Sprintf("FROM `%v`.`device_wipe` ", r.dbName)
+		args := []interface{}{}
+		if userUID > 0 {
+			qry += "WHERE `user_uid` = ? "
+			args = append(args, userUID)
+		}
+		qry += "ORDER BY `user_uid` ASC, `device_id` ASC"
+		qry += mysql.GetLockCmd(lock)
+
+		rows, err := tx.Query(qry, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			v := activesync.Wipe{}
+			var acknowledged int64
+			if err := rows.Scan(&v.UserUID, &v.DeviceID, &v.Status, &v.Requested, &acknowledged); err != nil {
+				return err
+			}
+			if acknowledged > 0 {
+				v.Acknowledged = time.Unix(acknowledged, 0)
+			}
+			wipes = append(wipes, v)
+		}
+
+		return rows.Err()
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return nil, err
+	}
+	return wipes, nil
+}
+
+func (r *deviceManager) GetWipe(userUID uint64, deviceID string, lock database.LockMode) (wipe activesync.Wipe, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `status`, `requested`, IFNULL(UNIX_TIMESTAMP(`acknowledged`), 0) "
+		qry += fmt.Sprintf("FROM `%v`.`device_wipe` WHERE `user_uid` = ? AND `device_id` = ? ", r.dbName)
+		qry += mysql.GetLockCmd(lock)
+		var acknowledged int64
+		if err := tx.QueryRow(qry, userUID, deviceID).Scan(&wipe.Status, &wipe.Requested, &acknowledged); err != nil {
+			return err
+		}
+		wipe.UserUID = userUID
+		wipe.DeviceID = deviceID
+		if acknowledged > 0 {
+			wipe.Acknowledged = time.Unix(acknowledged, 0)
+		}
+
+		return nil
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return activesync.Wipe{}, err
+	}
+	return wipe, nil
+}
+
+func (r *deviceManager) RequestWipe(userUID uint64, deviceID string) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("INSERT INTO `%v`.`device_wipe`(`user_uid`, `device_id`, `status`, `requested`) VALUES(?, ?, ?, NOW()) ", r.dbName)
+		qry += "ON DUPLICATE KEY UPDATE `status` = VALUES(`status`), `requested` = NOW(), `acknowledged` = NULL"
+		_, err := tx.Exec(qry, userUID, deviceID, activesync.WipePending)
+		return err
+	}
+
+	return r.queryer.Query(f)
+}
+
+func (r *deviceManager) AcknowledgeWipe(userUID uint64, deviceID string) error {
+	qry := fmt.Sprintf("UPDATE `%v`.`device_wipe` SET `status` = ?, `acknowledged` = NOW() WHERE `user_uid` = ? AND `device_id` = ?", r.dbName)
+	return r.exec(qry, activesync.WipeDone, userUID, deviceID)
+}
+
+func (r *deviceManager) RemoveWipe(userUID uint64, deviceID string) error {
+	return r.exec(fmt.Sprintf("DELETE FROM `%v`.`device_wipe` WHERE `user_uid` = ? AND `device_id` = ?", r.dbName), userUID, deviceID)
+}
+
+// exec executes qry, and returns database.ErrNotFound if there is no affected row.
+func (r *deviceManager) exec(qry string, args ...interface{}) error {
+	f := func(tx *sql.Tx) error {
+		result, err := tx.Exec(qry, args...)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return database.ErrNotFound
+		}
+
+		return nil
+	}
+
+	return r.queryer.Query(f)
+}
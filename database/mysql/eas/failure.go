@@ -0,0 +1,119 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package eas
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/database"
+
+	"golang.org/x/net/context"
+)
+
+// FailureStore implements the activesync.FailureStore interface using the
+// auth_failure table, which allows multiple servers to share the counters.
+type FailureStore struct {
+	db     database.TransactionManager
+	dbName string
+}
+
+func NewFailureStore(db database.TransactionManager, dbName string) *FailureStore {
+	return &FailureStore{
+		db:     db,
+		dbName: dbName,
+	}
+}
+
+func (r *FailureStore) GetFailure(key string) (failure activesync.Failure, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("SELECT `count`, `last` FROM `%v`.`auth_failure` WHERE `key` = ?", r.dbName)
+		err := tx.QueryRow(qry, key).Scan(&failure.Count, &failure.Last)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	if err := r.query(f); err != nil {
+		return activesync.Failure{}, err
+	}
+	return failure, nil
+}
+
+func (r *FailureStore) AddFailure(key string, expiry time.Duration) (failure activesync.Failure, err error) {
+	f := func(tx *sql.Tx) error {
+		// NOTE: MySQL evaluates the assignments from left to right, so the
+		// count should be updated before the last failure time.
+		qry := fmt.Sprintf("INSERT INTO `%v`.`auth_failure`(`key`, `count`, `last`) VALUES(?, 1, NOW()) ", r.dbName)
+		qry += "ON DUPLICATE KEY UPDATE "
+		qry += "`count` = IF(`last` <= NOW() - INTERVAL ? SECOND, 1, `count` + 1), "
+		qry += "`last` = NOW()"
+		if _, err := tx.Exec(qry, key, int64(expiry/time.Second)); err != nil {
+			return err
+		}
+
+		qry = fmt.Sprintf("SELECT `count`, `last` FROM `%v`.`auth_failure` WHERE `key` = ?", r.dbName)
+		return tx.QueryRow(qry, key).Scan(&failure.Count, &failure.Last)
+	}
+
+	if err := r.query(f); err != nil {
+		return activesync.Failure{}, err
+	}
+	return failure, nil
+}
+
+func (r *FailureStore) ClearFailure(key string) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("DELETE FROM `%v`.`auth_failure` WHERE `key` = ?", r.dbName)
+		_, err := tx.Exec(qry, key)
+		return err
+	}
+
+	return r.query(f)
+}
+
+// Purge removes counters whose last failure is older than expiry.
+func (r *FailureStore) Purge(expiry time.Duration) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("DELETE FROM `%v`.`auth_failure` WHERE `last` <= NOW() - INTERVAL ? SECOND", r.dbName)
+		_, err := tx.Exec(qry, int64(expiry/time.Second))
+		return err
+	}
+
+	return r.query(f)
+}
+
+func (r *FailureStore) query(f func(*sql.Tx) error) error {
+	tx := r.db.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.Query(f); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
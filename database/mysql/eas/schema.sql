@@ -44,3 +44,41 @@ CREATE TABLE `virtual_email` (
   PRIMARY KEY (`id`),
   UNIQUE KEY (`user_uid`, `device_id`, `folder_id`, `email_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `auth_failure` (
+  `key` varchar(255) NOT NULL,
+  `count` int(10) unsigned NOT NULL,
+  `last` datetime NOT NULL,
+  PRIMARY KEY (`key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `device_policy` (
+  `user_uid` bigint(20) NOT NULL,
+  `password_required` bool NOT NULL,
+  `min_password_length` int(10) unsigned NOT NULL,
+  `alphanumeric_password` bool NOT NULL,
+  `inactivity_timeout` int(10) unsigned NOT NULL,
+  `max_failed_attempts` int(10) unsigned NOT NULL,
+  `timestamp` datetime NOT NULL,
+  PRIMARY KEY (`user_uid`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `device_group_policy` (
+  `group` varchar(255) NOT NULL,
+  `password_required` bool NOT NULL,
+  `min_password_length` int(10) unsigned NOT NULL,
+  `alphanumeric_password` bool NOT NULL,
+  `inactivity_timeout` int(10) unsigned NOT NULL,
+  `max_failed_attempts` int(10) unsigned NOT NULL,
+  `timestamp` datetime NOT NULL,
+  PRIMARY KEY (`group`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `device_wipe` (
+  `user_uid` bigint(20) NOT NULL,
+  `device_id` varchar(64) NOT NULL,
+  `status` int(10) unsigned NOT NULL,
+  `requested` datetime NOT NULL,
+  `acknowledged` datetime DEFAULT NULL,
+  PRIMARY KEY (`user_uid`, `device_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
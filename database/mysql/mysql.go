@@ -58,6 +58,14 @@ func NewMySQL(host, username, password string, port uint16, clientFoundRows bool
 	}, nil
 }
 
+// NewMySQLWithDB returns a MySQL that uses db, which is already opened, e.g.,
+// by a fake driver in tests.
+func NewMySQLWithDB(db *sql.DB) *MySQL {
+	return &MySQL{
+		handle: db,
+	}
+}
+
 func isDeadlock(err error) bool {
 	e, ok := err.(*mysql.MySQLError)
 	if !ok {
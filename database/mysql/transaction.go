@@ -26,22 +26,26 @@ import (
 	"sync"
 
 	"github.com/superkkt/omega/database"
+
+	"golang.org/x/net/context"
 )
 
-func (r *MySQL) NewTransaction() database.Transaction {
-	return newTransaction(r.handle)
+func (r *MySQL) NewTransaction(ctx context.Context) database.Transaction {
+	return newTransaction(ctx, r.handle)
 }
 
 type transaction struct {
 	mu       sync.Mutex
+	ctx      context.Context
 	handle   *sql.DB
 	tx       *sql.Tx
 	finished bool
 	lastErr  txError
 }
 
-func newTransaction(handle *sql.DB) database.Transaction {
+func newTransaction(ctx context.Context, handle *sql.DB) database.Transaction {
 	return &transaction{
+		ctx:    ctx,
 		handle: handle,
 	}
 }
@@ -59,7 +63,8 @@ func (r *transaction) Begin() error {
 
 // The mutex should be locked by the caller.
 func (r *transaction) begin() error {
-	tx, err := r.handle.Begin()
+	// The database/sql package automatically rolls back tx when r.ctx is canceled.
+	tx, err := r.handle.BeginTx(r.ctx, nil)
 	if err != nil {
 		return newTxError(err)
 	}
@@ -79,6 +84,11 @@ func (r *transaction) Query(f func(*sql.Tx) error) error {
 	if r.finished {
 		return newTxError(errors.New("query on an already finished transaction"))
 	}
+	// Do not start a new query if the client already went away.
+	if err := r.ctx.Err(); err != nil {
+		r.lastErr = newTxError(err)
+		return r.lastErr
+	}
 
 	if err := f(r.tx); err != nil {
 		r.lastErr = newTxError(err)
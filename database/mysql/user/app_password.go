@@ -0,0 +1,278 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package user
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql"
+)
+
+const (
+	// Generated app passwords consist of appPasswordLength lowercase letters.
+	// The first appPasswordPrefixLength letters are stored in plain text as
+	// the lookup key of the password, and the others are the secret.
+	appPasswordLength       = 20
+	appPasswordPrefixLength = 4
+	// maxPrefixAttempts is the maximum number of generated passwords to find
+	// a prefix that the user does not have.
+	maxPrefixAttempts = 16
+)
+
+// AppPassword is an application-specific password of a user. Users can log in
+// with an app password in place of their primary password, and each of them can
+// be revoked individually. An app password bound to a device can only be used
+// by the device.
+type AppPassword struct {
+	ID    uint64
+	UID   uint64 // UID of the owner.
+	Label string
+	// DeviceID is the ActiveSync DeviceId that can use this password. Empty
+	// means any device.
+	DeviceID string
+	// LastUsed is the last time this password has been used to log in. The
+	// zero value means it has never been used.
+	LastUsed time.Time
+	Created  time.Time
+	// password is a hashed password.
+	password string
+}
+
+// GetAppPasswords returns all app passwords of a user whose UID is uid.
+// GetAppPasswords can return nil if there is no app password.
+func (r *Manager) GetAppPasswords(uid uint64, lock database.LockMode) (passwords []AppPassword, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `id`, `user_id`, `label`, `password`, IFNULL(`device_id`, ''), IFNULL(UNIX_TIMESTAMP(`last_used`), 0), `timestamp` "
+		qry += fmt.Sprintf("FROM `%v`.`app_password` ", r.dbName)
+		qry += "WHERE `user_id` = ? ORDER BY `id` ASC"
+		qry += mysql.GetLockCmd(lock)
+
+		rows, err := tx.Query(qry, uid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			v := AppPassword{}
+			var lastUsed int64
+			if err := rows.Scan(&v.ID, &v.UID, &v.Label, &v.password, &v.DeviceID, &lastUsed, &v.Created); err != nil {
+				return err
+			}
+			if lastUsed > 0 {
+				v.LastUsed = time.Unix(lastUsed, 0)
+			}
+			passwords = append(passwords, v)
+		}
+
+		return rows.Err()
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return nil, err
+	}
+	return passwords, nil
+}
+
+// AddAppPassword generates a new app password of a user whose UID is uid, and
+// returns the plain text password that cannot be retrieved later. deviceID binds
+// the password to a device, and empty deviceID means any device. AddAppPassword
+// returns database.ErrDuplicated if the user already has an app password whose
+// label is label.
+func (r *Manager) AddAppPassword(uid uint64, label, deviceID string) (id uint64, password string, err error) {
+	f := func(tx *sql.Tx) error {
+		// Check whether there is the user, and then return database.ErrNotFound if it doesn't exist.
+		qry := fmt.Sprintf("SELECT `id` FROM `%v`.`user` WHERE `id` = ? LOCK IN SHARE MODE", r.dbName)
+		var v uint64
+		if err := tx.QueryRow(qry, uid).Scan(&v); err != nil {
+			return err
+		}
+
+		qry = fmt.Sprintf("SELECT COUNT(*) FROM `%v`.`app_password` WHERE `user_id` = ? AND `label` = ? LOCK IN SHARE MODE", r.dbName)
+		var count uint64
+		if err := tx.QueryRow(qry, uid, label).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return database.ErrDuplicated
+		}
+
+		password, err = r.generateAppPassword(tx, uid)
+		if err != nil {
+			return err
+		}
+		hash, err := HashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		var device interface{}
+		if len(deviceID) > 0 {
+			device = deviceID
+		}
+		qry = fmt.Sprintf("INSERT INTO `%v`.`app_password`(`user_id`, `label`, `prefix`, `password`, `device_id`) ", r.dbName)
+		qry += "VALUES(?, ?, ?, ?, ?)"
+		result, err := tx.Exec(qry, uid, label, appPasswordPrefix(password), hash, device)
+		if err != nil {
+			return err
+		}
+		n, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = uint64(n)
+
+		return nil
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return 0, "", err
+	}
+	return id, password, nil
+}
+
+// generateAppPassword returns a new app password whose prefix is not used by
+// the other app passwords of a user whose UID is uid.
+func (r *Manager) generateAppPassword(tx *sql.Tx, uid uint64) (string, error) {
+	qry := fmt.Sprintf("SELECT `prefix` FROM `%v`.`app_password` WHERE `user_id` = ? LOCK IN SHARE MODE", r.dbName)
+	rows, err := tx.Query(qry, uid)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	prefixes := make(map[string]bool)
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return "", err
+		}
+		prefixes[v] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	for i := 0; i < maxPrefixAttempts; i++ {
+		password, err := generatePassword()
+		if err != nil {
+			return "", err
+		}
+		if !prefixes[appPasswordPrefix(password)] {
+			return password, nil
+		}
+	}
+
+	return "", errors.New("failed to generate an app password that has a unique prefix")
+}
+
+// RemoveAppPassword revokes an app password whose ID is id from a user whose UID is uid.
+func (r *Manager) RemoveAppPassword(uid, id uint64) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("DELETE FROM `%v`.`app_password` WHERE `id` = ? AND `user_id` = ?", r.dbName)
+		result, err := tx.Exec(qry, id, uid)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return database.ErrNotFound
+		}
+
+		return r.recordChange(tx, uid)
+	}
+
+	return r.queryer.Query(f)
+}
+
+// touchAppPassword records the current time as the last use of an app password whose ID is id.
+func (r *Manager) touchAppPassword(id uint64) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("UPDATE `%v`.`app_password` SET `last_used` = NOW() WHERE `id` = ?", r.dbName)
+		_, err := tx.Exec(qry, id)
+		return err
+	}
+
+	return r.queryer.Query(f)
+}
+
+// getAppPassword returns an app password of a user whose UID is uid, which
+// has the lookup key prefix. getAppPassword returns database.ErrNotFound if
+// there is no such password.
+func (r *Manager) getAppPassword(uid uint64, prefix string) (p AppPassword, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `id`, `user_id`, `label`, `password`, IFNULL(`device_id`, ''), IFNULL(UNIX_TIMESTAMP(`last_used`), 0), `timestamp` "
+		qry += fmt.Sprintf("FROM `%v`.`app_password` ", r.dbName)
+		qry += "WHERE `user_id` = ? AND `prefix` = ?"
+		var lastUsed int64
+		if err := tx.QueryRow(qry, uid, prefix).Scan(&p.ID, &p.UID, &p.Label, &p.password, &p.DeviceID, &lastUsed, &p.Created); err != nil {
+			return err
+		}
+		if lastUsed > 0 {
+			p.LastUsed = time.Unix(lastUsed, 0)
+		}
+
+		return nil
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return AppPassword{}, err
+	}
+	return p, nil
+}
+
+// appPasswordPrefix returns the lookup key of a plain text app password, which
+// is empty if password cannot be an app password.
+func appPasswordPrefix(password string) string {
+	if len(password) != appPasswordLength {
+		return ""
+	}
+
+	return password[:appPasswordPrefixLength]
+}
+
+func generatePassword() (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	// Discard random bytes equal to or greater than limit to avoid the modulo bias.
+	const limit = 256 - 256%len(letters)
+
+	result := make([]byte, 0, appPasswordLength)
+	buf := make([]byte, appPasswordLength)
+	for len(result) < appPasswordLength {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, v := range buf {
+			if int(v) >= limit || len(result) == appPasswordLength {
+				continue
+			}
+			result = append(result, letters[int(v)%len(letters)])
+		}
+	}
+
+	return string(result), nil
+}
@@ -0,0 +1,243 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package user
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+// Authenticator implements the backend.Authenticator and backend.Directory
+// interfaces using the user table.
+type Authenticator struct {
+	db     database.TransactionManager
+	dbName string
+}
+
+func NewAuthenticator(db database.TransactionManager, dbName string) *Authenticator {
+	return &Authenticator{
+		db:     db,
+		dbName: dbName,
+	}
+}
+
+func (r *Authenticator) Auth(userID, password string) (backend.Credential, error) {
+	return r.AuthDevice(userID, password, "")
+}
+
+// AuthDevice verifies password, which can be either the primary password or an
+// app password of the user. App passwords bound to a device other than deviceID
+// are not accepted.
+func (r *Authenticator) AuthDevice(userID, password, deviceID string) (backend.Credential, error) {
+	u, err := r.getUser(userID)
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, err
+		}
+		// Spend the same time with known users, which compare the primary
+		// password and an app password, to prevent user enumeration.
+		comparePassword(string(dummyHash), password)
+		comparePassword(string(dummyHash), password)
+		logger.Debug(fmt.Sprintf("user: unknown user: %v", userID))
+		return &Credential{userID: userID}, nil
+	}
+	if !comparePassword(u.password, password) {
+		ok, err := r.authAppPassword(u, password, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			logger.Debug(fmt.Sprintf("user: password mismatched: %v", userID))
+			return &Credential{userID: userID}, nil
+		}
+	}
+	if !u.Enabled {
+		logger.Info(fmt.Sprintf("user: disabled user tried to log in: %v", userID))
+		return &Credential{userID: userID}, nil
+	}
+
+	return newCredential(u), nil
+}
+
+// authAppPassword returns true if password is an app password of the user that
+// can be used by the device whose DeviceId is deviceID. The app password is
+// looked up by its prefix, so that only one hash is compared regardless of the
+// number of app passwords. The last use of the matched app password is
+// recorded.
+func (r *Authenticator) authAppPassword(u User, password, deviceID string) (ok bool, err error) {
+	tx := r.db.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	m := NewManager(tx, r.dbName)
+	hash := string(dummyHash)
+	p, err := m.getAppPassword(u.UID, appPasswordPrefix(password))
+	if err == nil {
+		hash = p.password
+	} else if !isNotFound(err) {
+		return false, err
+	}
+	// Always compare a hash so that the time does not tell whether the prefix exists.
+	if !comparePassword(hash, password) || p.ID == 0 {
+		return false, nil
+	}
+	if len(p.DeviceID) > 0 && !strings.EqualFold(p.DeviceID, deviceID) {
+		logger.Debug(fmt.Sprintf("user: app password bound to another device: user=%v, label=%v, deviceID=%v", u.Name, p.Label, deviceID))
+		return false, nil
+	}
+	if err := m.touchAppPassword(p.ID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	logger.Debug(fmt.Sprintf("user: authenticated with an app password: user=%v, label=%v, deviceID=%v", u.Name, p.Label, deviceID))
+
+	return true, nil
+}
+
+func (r *Authenticator) LookupUser(userID string) (backend.Credential, error) {
+	return r.lookup(userID, func(m *Manager) (User, error) {
+		return m.GetUser(userID, database.LockNone)
+	})
+}
+
+func (r *Authenticator) LookupAddress(address string) (backend.Credential, error) {
+	return r.lookup(address, func(m *Manager) (User, error) {
+		return m.GetUserByAddress(address, database.LockNone)
+	})
+}
+
+func (r *Authenticator) lookup(key string, f func(*Manager) (User, error)) (backend.Credential, error) {
+	u, err := r.query(f)
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, err
+		}
+		return &Credential{userID: key}, nil
+	}
+	if !u.Enabled {
+		return &Credential{userID: u.Name}, nil
+	}
+
+	return newCredential(u), nil
+}
+
+// CanSendAs returns whether a user whose UID is uid is delegated to send emails as address.
+func (r *Authenticator) CanSendAs(uid uint64, address string) (bool, error) {
+	tx := r.db.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	ok, err := NewManager(tx, r.dbName).hasSendAs(uid, address)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
+func (r *Authenticator) getUser(name string) (User, error) {
+	return r.query(func(m *Manager) (User, error) {
+		return m.GetUser(name, database.LockNone)
+	})
+}
+
+func (r *Authenticator) query(f func(*Manager) (User, error)) (User, error) {
+	tx := r.db.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	u, err := f(NewManager(tx, r.dbName))
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(database.NotFoundError)
+	if !ok {
+		return false
+	}
+
+	return e.IsNotFound()
+}
+
+// Credential implements the backend.Credential interface.
+type Credential struct {
+	auth    bool
+	userID  string
+	userUID uint64
+	address string
+	aliases []string
+}
+
+func newCredential(u User) *Credential {
+	return &Credential{
+		auth:    true,
+		userID:  u.Name,
+		userUID: u.UID,
+		address: u.Address,
+		aliases: u.Aliases,
+	}
+}
+
+func (r *Credential) IsAuthorized() bool {
+	return r.auth
+}
+
+func (r *Credential) UserID() string {
+	return r.userID
+}
+
+func (r *Credential) UserUID() uint64 {
+	return r.userUID
+}
+
+// Address returns the user's primary email address.
+func (r *Credential) Address() string {
+	return r.address
+}
+
+// Aliases returns the user's alias email addresses.
+func (r *Credential) Aliases() []string {
+	return r.aliases
+}
@@ -0,0 +1,122 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package user
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// Credential changes older than this are purged when a new change is recorded.
+	credentialChangeRetention = "1 DAY"
+	// Credential changes recorded within this interval are reported again
+	// regardless of the cursor, because a change can be committed after
+	// another one that has a larger ID.
+	credentialChangeOverlap = "1 MINUTE"
+)
+
+// recordChange records that the credentials of a user whose UID is uid have
+// been changed, so that processes caching authentication results of the user
+// can invalidate them. It should be called in the transaction that changes the
+// credentials, before the user is deleted.
+func (r *Manager) recordChange(tx *sql.Tx, uid uint64) error {
+	qry := fmt.Sprintf("INSERT INTO `%v`.`credential_change`(`name`) ", r.dbName)
+	qry += fmt.Sprintf("SELECT `name` FROM `%v`.`user` WHERE `id` = ?", r.dbName)
+	result, err := tx.Exec(qry, uid)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return database.ErrNotFound
+	}
+
+	qry = fmt.Sprintf("DELETE FROM `%v`.`credential_change` WHERE `timestamp` < NOW() - INTERVAL %v", r.dbName, credentialChangeRetention)
+	_, err = tx.Exec(qry)
+	return err
+}
+
+// GetCredentialChanges returns the login names of users whose credentials have
+// been changed after the change whose ID is cursor, and the ID of the last
+// change. last is cursor if there is no change. A name can be returned several
+// times if it has been changed several times, and the changes recorded in the
+// last minute are always returned so that a change committed later than the
+// ones with larger IDs is not skipped.
+func (r *Manager) GetCredentialChanges(cursor uint64, lock database.LockMode) (names []string, last uint64, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("SELECT `id`, `name` FROM `%v`.`credential_change` ", r.dbName)
+		qry += fmt.Sprintf("WHERE `id` > ? OR `timestamp` >= NOW() - INTERVAL %v ORDER BY `id` ASC", credentialChangeOverlap)
+		qry += mysql.GetLockCmd(lock)
+
+		rows, err := tx.Query(qry, cursor)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		last = cursor
+		for rows.Next() {
+			var id uint64
+			var name string
+			if err := rows.Scan(&id, &name); err != nil {
+				return err
+			}
+			names = append(names, name)
+			if id > last {
+				last = id
+			}
+		}
+
+		return rows.Err()
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return nil, 0, err
+	}
+	return names, last, nil
+}
+
+// CredentialChanges implements the cache.ChangeSource interface.
+func (r *Authenticator) CredentialChanges(cursor uint64) (names []string, last uint64, err error) {
+	tx := r.db.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	names, last, err = NewManager(tx, r.dbName).GetCredentialChanges(cursor, database.LockNone)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+
+	return names, last, nil
+}
@@ -0,0 +1,66 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package user
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Cost of the bcrypt hash. It should be adjusted along with CPU power.
+	bcryptCost = 11
+	// maxPasswordLength is the maximum length of a plain text password that
+	// bcrypt can handle. bcrypt only uses the first 72 bytes of a password.
+	maxPasswordLength = 72
+)
+
+var (
+	errEmptyPassword   = errors.New("empty password")
+	errTooLongPassword = errors.New("too long password")
+	// dummyHash is used to make the authentication of unknown users take as
+	// long as known users to prevent user enumeration by timing attacks.
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("omega-dummy-password"), bcryptCost)
+)
+
+// HashPassword returns a hashed password of a plain text password, which can
+// be verified by comparePassword.
+func HashPassword(password string) (string, error) {
+	if len(password) == 0 {
+		return "", errEmptyPassword
+	}
+	if len(password) > maxPasswordLength {
+		return "", errTooLongPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// comparePassword returns true if hash is a hashed password of a plain text password.
+func comparePassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,129 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package user
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql"
+)
+
+// GetSendAs returns addresses that a user whose UID is uid is delegated to send
+// emails as, e.g., addresses of shared mailboxes. GetSendAs can return nil if
+// there is no delegated address.
+func (r *Manager) GetSendAs(uid uint64, lock database.LockMode) (addresses []string, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("SELECT `address` FROM `%v`.`send_as` WHERE `user_id` = ? ORDER BY `id` ASC", r.dbName)
+		qry += mysql.GetLockCmd(lock)
+
+		rows, err := tx.Query(qry, uid)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var v string
+			if err := rows.Scan(&v); err != nil {
+				return err
+			}
+			addresses = append(addresses, v)
+		}
+
+		return rows.Err()
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// AddSendAs delegates a user whose UID is uid to send emails as address.
+// AddSendAs returns database.ErrDuplicated if the user already has the right.
+func (r *Manager) AddSendAs(uid uint64, address string) error {
+	address = normalizeAddress(address)
+	f := func(tx *sql.Tx) error {
+		// Check whether there is the user, and then return database.ErrNotFound if it doesn't exist.
+		qry := fmt.Sprintf("SELECT `id` FROM `%v`.`user` WHERE `id` = ? LOCK IN SHARE MODE", r.dbName)
+		var id uint64
+		if err := tx.QueryRow(qry, uid).Scan(&id); err != nil {
+			return err
+		}
+
+		qry = fmt.Sprintf("SELECT COUNT(*) FROM `%v`.`send_as` WHERE `user_id` = ? AND `address` = ? LOCK IN SHARE MODE", r.dbName)
+		var count uint64
+		if err := tx.QueryRow(qry, uid, address).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return database.ErrDuplicated
+		}
+
+		qry = fmt.Sprintf("INSERT INTO `%v`.`send_as`(`user_id`, `address`) VALUES(?, ?)", r.dbName)
+		_, err := tx.Exec(qry, uid, address)
+		return err
+	}
+
+	return r.queryer.Query(f)
+}
+
+// RemoveSendAs revokes the right of a user whose UID is uid to send emails as address.
+func (r *Manager) RemoveSendAs(uid uint64, address string) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("DELETE FROM `%v`.`send_as` WHERE `user_id` = ? AND `address` = ?", r.dbName)
+		result, err := tx.Exec(qry, uid, normalizeAddress(address))
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return database.ErrNotFound
+		}
+
+		return nil
+	}
+
+	return r.queryer.Query(f)
+}
+
+// hasSendAs returns whether a user whose UID is uid is delegated to send emails as address.
+func (r *Manager) hasSendAs(uid uint64, address string) (ok bool, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("SELECT COUNT(*) FROM `%v`.`send_as` WHERE `user_id` = ? AND `address` = ?", r.dbName)
+		var count uint64
+		if err := tx.QueryRow(qry, uid, normalizeAddress(address)).Scan(&count); err != nil {
+			return err
+		}
+		ok = count > 0
+
+		return nil
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
@@ -0,0 +1,401 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/database/mysql"
+)
+
+// User is a user account stored in the user table.
+type User struct {
+	UID     uint64 // Unique Identifier, which is used as the user ID of the backend storage.
+	Name    string // Login name.
+	Address string // Primary email address.
+	Aliases []string
+	Enabled bool
+	// password is a hashed password.
+	password string
+}
+
+// Manager provides methods to fetch and manipulate user accounts. All methods
+// of Manager return database.TransactionError if an error occurrs.
+type Manager struct {
+	queryer database.Queryer
+	dbName  string
+}
+
+func NewManager(queryer database.Queryer, dbName string) *Manager {
+	return &Manager{
+		queryer: queryer,
+		dbName:  dbName,
+	}
+}
+
+// GetUser returns a user whose login name is name. It is necessary to acquire
+// a read or write lock depending on the lock mode for the fetched user to
+// prevent any concurrent updates from another transaction.
+func (r *Manager) GetUser(name string, lock database.LockMode) (user User, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `id`, `name`, `password`, `address`, `enabled` "
+		qry += fmt.Sprintf("FROM `%v`.`user` ", r.dbName)
+		qry += "WHERE `name` = ?"
+		qry += mysql.GetLockCmd(lock)
+
+		if err := tx.QueryRow(qry, name).Scan(&user.UID, &user.Name, &user.password, &user.Address, &user.Enabled); err != nil {
+			return err
+		}
+		user.Aliases, err = r.getAliases(tx, user.UID, lock)
+		return err
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// GetUserByAddress returns a user who owns the email address, which can be
+// either a primary or an alias address. It is necessary to acquire a read or
+// write lock depending on the lock mode for the fetched user to prevent any
+// concurrent updates from another transaction.
+func (r *Manager) GetUserByAddress(address string, lock database.LockMode) (user User, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT A.`id`, A.`name`, A.`password`, A.`address`, A.`enabled` "
+		qry += fmt.Sprintf("FROM `%v`.`user` A LEFT JOIN `%v`.`user_alias` B ", r.dbName, r.dbName)
+		qry += "ON A.`id` = B.`user_id` "
+		qry += "WHERE A.`address` = ? OR B.`address` = ? "
+		qry += "LIMIT 1"
+		qry += mysql.GetLockCmd(lock)
+
+		address = normalizeAddress(address)
+		if err := tx.QueryRow(qry, address, address).Scan(&user.UID, &user.Name, &user.password, &user.Address, &user.Enabled); err != nil {
+			return err
+		}
+		user.Aliases, err = r.getAliases(tx, user.UID, lock)
+		return err
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// GetUserByUID returns a user whose unique identifier is uid. It is necessary
+// to acquire a read or write lock depending on the lock mode for the fetched
+// user to prevent any concurrent updates from another transaction.
+func (r *Manager) GetUserByUID(uid uint64, lock database.LockMode) (user User, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `id`, `name`, `password`, `address`, `enabled` "
+		qry += fmt.Sprintf("FROM `%v`.`user` ", r.dbName)
+		qry += "WHERE `id` = ?"
+		qry += mysql.GetLockCmd(lock)
+
+		if err := tx.QueryRow(qry, uid).Scan(&user.UID, &user.Name, &user.password, &user.Address, &user.Enabled); err != nil {
+			return err
+		}
+		user.Aliases, err = r.getAliases(tx, user.UID, lock)
+		return err
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// GetUsers returns all users ordered by their UID. GetUsers can return nil
+// if there is no user.
+func (r *Manager) GetUsers(lock database.LockMode) (users []User, err error) {
+	f := func(tx *sql.Tx) error {
+		qry := "SELECT `id`, `name`, `password`, `address`, `enabled` "
+		qry += fmt.Sprintf("FROM `%v`.`user` ", r.dbName)
+		qry += "ORDER BY `id` ASC"
+		qry += mysql.GetLockCmd(lock)
+
+		rows, err := tx.Query(qry)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			v := User{}
+			if err := rows.Scan(&v.UID, &v.Name, &v.password, &v.Address, &v.Enabled); err != nil {
+				return err
+			}
+			users = append(users, v)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i := range users {
+			users[i].Aliases, err = r.getAliases(tx, users[i].UID, lock)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (r *Manager) getAliases(tx *sql.Tx, uid uint64, lock database.LockMode) (aliases []string, err error) {
+	qry := fmt.Sprintf("SELECT `address` FROM `%v`.`user_alias` ", r.dbName)
+	qry += "WHERE `user_id` = ? ORDER BY `id` ASC"
+	qry += mysql.GetLockCmd(lock)
+
+	rows, err := tx.Query(qry, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, v)
+	}
+
+	return aliases, rows.Err()
+}
+
+// AddUser adds a new enabled user whose login name is name. password is a
+// plain text password that will be stored after hashing. AddUser returns
+// database.ErrDuplicated if name or address is already being used.
+func (r *Manager) AddUser(name, password, address string) (uid uint64, err error) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+	address = normalizeAddress(address)
+
+	f := func(tx *sql.Tx) error {
+		if err := r.checkAddress(tx, address); err != nil {
+			return err
+		}
+
+		qry := fmt.Sprintf("INSERT INTO `%v`.`user`(`name`, `password`, `address`, `enabled`) ", r.dbName)
+		qry += "VALUES(?, ?, ?, TRUE)"
+		result, err := tx.Exec(qry, name, hash, address)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		uid = uint64(id)
+
+		return nil
+	}
+
+	if err := r.queryer.Query(f); err != nil {
+		return 0, err
+	}
+	return uid, nil
+}
+
+// checkAddress returns database.ErrDuplicated if address is already being
+// used as a primary address or an alias. The unique keys of the user and
+// user_alias tables cannot prevent two transactions from adding the same
+// address into each of them, so checkAddress serializes all the changes of
+// addresses by locking the single row of the address_lock table first.
+func (r *Manager) checkAddress(tx *sql.Tx, address string) error {
+	// Create the row if it does not exist, and lock it in both cases.
+	qry := fmt.Sprintf("INSERT INTO `%v`.`address_lock`(`id`) VALUES(1) ON DUPLICATE KEY UPDATE `id` = `id`", r.dbName)
+	if _, err := tx.Exec(qry); err != nil {
+		return err
+	}
+
+	qry = fmt.Sprintf("SELECT COUNT(*) FROM `%v`.`user` WHERE `address` = ? LOCK IN SHARE MODE", r.dbName)
+	var count uint64
+	if err := tx.QueryRow(qry, address).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return database.ErrDuplicated
+	}
+
+	qry = fmt.Sprintf("SELECT COUNT(*) FROM `%v`.`user_alias` WHERE `address` = ? LOCK IN SHARE MODE", r.dbName)
+	if err := tx.QueryRow(qry, address).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return database.ErrDuplicated
+	}
+
+	return nil
+}
+
+// UpdatePassword replaces the password of a user whose UID is uid.
+func (r *Manager) UpdatePassword(uid uint64, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return r.updateCredential(uid, "`password` = ?", hash)
+}
+
+// UpdateAddress replaces the primary address of a user whose UID is uid.
+func (r *Manager) UpdateAddress(uid uint64, address string) error {
+	address = normalizeAddress(address)
+	f := func(tx *sql.Tx) error {
+		if err := r.checkAddress(tx, address); err != nil {
+			return err
+		}
+		if err := r.exec(tx, uid, "`address` = ?", address); err != nil {
+			return err
+		}
+		// Cached credentials have the addresses to validate senders.
+		return r.recordChange(tx, uid)
+	}
+
+	return r.queryer.Query(f)
+}
+
+// SetEnabled enables or disables a user whose UID is uid. A disabled user
+// cannot be authenticated.
+func (r *Manager) SetEnabled(uid uint64, enabled bool) error {
+	return r.updateCredential(uid, "`enabled` = ?", enabled)
+}
+
+// updateCredential updates a user whose UID is uid, and records the change of
+// the credentials.
+func (r *Manager) updateCredential(uid uint64, set string, value interface{}) error {
+	f := func(tx *sql.Tx) error {
+		if err := r.exec(tx, uid, set, value); err != nil {
+			return err
+		}
+		return r.recordChange(tx, uid)
+	}
+
+	return r.queryer.Query(f)
+}
+
+func (r *Manager) exec(tx *sql.Tx, uid uint64, set string, value interface{}) error {
+	qry := fmt.Sprintf("UPDATE `%v`.`user` SET %v WHERE `id` = ?", r.dbName, set)
+	result, err := tx.Exec(qry, value, uid)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return database.ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteUser removes a user account whose UID is uid. Note that DeleteUser does
+// not remove any folders and emails that belong to the user.
+func (r *Manager) DeleteUser(uid uint64) error {
+	f := func(tx *sql.Tx) error {
+		if err := r.recordChange(tx, uid); err != nil {
+			return err
+		}
+
+		qry := fmt.Sprintf("DELETE FROM `%v`.`user` WHERE `id` = ?", r.dbName)
+		result, err := tx.Exec(qry, uid)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return database.ErrNotFound
+		}
+
+		return nil
+	}
+
+	return r.queryer.Query(f)
+}
+
+// AddAlias adds a new alias address to a user whose UID is uid. AddAlias returns
+// database.ErrDuplicated if address is already being used.
+func (r *Manager) AddAlias(uid uint64, address string) error {
+	address = normalizeAddress(address)
+	f := func(tx *sql.Tx) error {
+		// Check whether there is the user, and then return database.ErrNotFound if it doesn't exist.
+		qry := fmt.Sprintf("SELECT `id` FROM `%v`.`user` WHERE `id` = ? LOCK IN SHARE MODE", r.dbName)
+		var id uint64
+		if err := tx.QueryRow(qry, uid).Scan(&id); err != nil {
+			return err
+		}
+		if err := r.checkAddress(tx, address); err != nil {
+			return err
+		}
+
+		qry = fmt.Sprintf("INSERT INTO `%v`.`user_alias`(`user_id`, `address`) VALUES(?, ?)", r.dbName)
+		if _, err := tx.Exec(qry, uid, address); err != nil {
+			return err
+		}
+
+		return r.recordChange(tx, uid)
+	}
+
+	return r.queryer.Query(f)
+}
+
+// RemoveAlias removes an alias address from a user whose UID is uid.
+func (r *Manager) RemoveAlias(uid uint64, address string) error {
+	f := func(tx *sql.Tx) error {
+		qry := fmt.Sprintf("DELETE FROM `%v`.`user_alias` WHERE `user_id` = ? AND `address` = ?", r.dbName)
+		result, err := tx.Exec(qry, uid, normalizeAddress(address))
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return database.ErrNotFound
+		}
+
+		return r.recordChange(tx, uid)
+	}
+
+	return r.queryer.Query(f)
+}
+
+// normalizeAddress returns address in lowercase because email addresses are
+// case-insensitive in practice.
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
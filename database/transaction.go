@@ -23,6 +23,8 @@ package database
 import (
 	"database/sql"
 	"errors"
+
+	"golang.org/x/net/context"
 )
 
 var (
@@ -31,7 +33,10 @@ var (
 )
 
 type TransactionManager interface {
-	NewTransaction() Transaction
+	// NewTransaction returns a new transaction bound to ctx. The transaction
+	// will be rolled back and its subsequent queries will fail if ctx is
+	// canceled before the transaction is committed.
+	NewTransaction(ctx context.Context) Transaction
 }
 
 // Transaction provides a database transaction. Transaction should return TransactionError
@@ -0,0 +1,105 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package delivery
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/scanner"
+)
+
+// Message is an inbound email.
+type Message struct {
+	// From is the envelope sender. Empty means the null reverse-path of
+	// bounce messages.
+	From string
+	// Header is the parsed header of Raw.
+	Header mail.Header
+	// Raw is the message with CRLF line endings, which includes the Received
+	// header added by this server.
+	Raw []byte
+	// Junk is true if a content scanner has judged the message as spam.
+	Junk bool
+}
+
+// Deliverer stores inbound emails into mailboxes of users.
+type Deliverer interface {
+	// Deliver stores msg into the mailbox of the user identified by c using
+	// queryer. rcpt is the envelope recipient address of the user.
+	Deliver(queryer database.Queryer, c backend.Credential, rcpt string, msg *Message) error
+}
+
+// Agent is a Deliverer that adds emails into the Inbox folders of users.
+type Agent struct {
+	storage backend.Storage
+}
+
+func NewAgent(storage backend.Storage) *Agent {
+	return &Agent{
+		storage: storage,
+	}
+}
+
+func (r *Agent) Deliver(queryer database.Queryer, c backend.Credential, rcpt string, msg *Message) error {
+	fm := r.storage.NewFolderManager(queryer, c)
+	var folderID uint64
+	var err error
+	if msg.Junk {
+		folderID, err = scanner.GetJunkFolder(fm)
+	} else {
+		folderID, err = getInbox(fm)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := r.storage.NewEmailManager(queryer, c, folderID).AddEmail(Envelope(rcpt, msg)); err != nil {
+		return fmt.Errorf("AddEmail: %v", err)
+	}
+
+	return nil
+}
+
+func getInbox(fm backend.FolderManager) (uint64, error) {
+	inbox, err := fm.GetFolderByType(backend.EmailInbox, database.LockRead)
+	if err != nil {
+		return 0, err
+	}
+	if len(inbox) == 0 {
+		return 0, fmt.Errorf("not found an inbox folder: user=%v", fm.Credential().UserID())
+	}
+
+	return inbox[0].ID, nil
+}
+
+// Envelope returns the raw message of msg prefixed with the Return-Path and
+// Delivered-To headers of rcpt.
+func Envelope(rcpt string, msg *Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%v>\r\n", msg.From)
+	fmt.Fprintf(&buf, "Delivered-To: %v\r\n", rcpt)
+	buf.Write(msg.Raw)
+
+	return buf.Bytes()
+}
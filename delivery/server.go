@@ -0,0 +1,695 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package delivery
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/mailauth"
+	"github.com/superkkt/omega/scanner"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultMaxSize       = 32 * 1024 * 1024
+	defaultMaxRecipients = 100
+	defaultTimeout       = 5 * time.Minute
+	// Maximum number of invalid commands in a session.
+	maxErrors = 10
+)
+
+type Protocol int
+
+const (
+	// SMTP (RFC 5321) for receiving emails from other MTAs. The DATA command
+	// has a single reply for all recipients, so a message is delivered to
+	// all recipients or to none of them in a single transaction.
+	ProtocolSMTP Protocol = iota
+	// LMTP (RFC 2033) for receiving emails from a local MTA such as Postfix.
+	// The DATA command has a reply for each recipient.
+	ProtocolLMTP
+)
+
+func (r Protocol) String() string {
+	if r == ProtocolLMTP {
+		return "LMTP"
+	}
+	return "SMTP"
+}
+
+type Config struct {
+	Protocol Protocol
+	// Hostname is the name of this server used in greetings and Received
+	// headers. Empty means the hostname of the system.
+	Hostname string
+	// Directory resolves recipient addresses to users.
+	Directory backend.Directory
+	DB        database.TransactionManager
+	Deliverer Deliverer
+	// TLSConfig enables the STARTTLS extension if it is not nil.
+	TLSConfig *tls.Config
+	// MaxSize is the maximum size of a message in bytes. Zero means 32 MiB.
+	MaxSize int64
+	// MaxRecipients is the maximum number of recipients of a message. Zero means 100.
+	MaxRecipients int
+	// Timeout is the maximum time to wait for a command from the client. Zero
+	// means 5 minutes.
+	Timeout time.Duration
+	// Scanner inspects messages before they are delivered if it is not nil.
+	// Quarantine is required with Scanner to hold quarantined messages.
+	Scanner    scanner.ContentScanner
+	Quarantine scanner.Storage
+	// Verifier authenticates messages if it is not nil, and the results are
+	// recorded in an Authentication-Results header. SPF and DMARC are only
+	// checked over SMTP because the client of LMTP is a local MTA.
+	Verifier *mailauth.Verifier
+	// EnforceDMARC rejects messages that fail DMARC of a sender domain whose
+	// policy is reject, and delivers them into the Junk folder if the policy
+	// is quarantine.
+	EnforceDMARC bool
+}
+
+// Server receives emails over SMTP or LMTP, and delivers them to the users
+// who own the recipient addresses. Emails to unknown addresses are rejected,
+// so it is never an open relay.
+type Server struct {
+	config Config
+
+	mutex sync.Mutex
+	// idle is the set of sessions waiting for a command, which can be closed
+	// at any time to shut down.
+	idle         map[*session]struct{}
+	shuttingDown bool
+	wg           sync.WaitGroup
+}
+
+func NewServer(conf Config) (*Server, error) {
+	if conf.Directory == nil || conf.DB == nil || conf.Deliverer == nil {
+		return nil, errors.New("nil directory, DB, or deliverer")
+	}
+	if conf.Scanner != nil && conf.Quarantine == nil {
+		return nil, errors.New("nil quarantine storage")
+	}
+	if len(conf.Hostname) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		conf.Hostname = hostname
+	}
+	if conf.MaxSize == 0 {
+		conf.MaxSize = defaultMaxSize
+	}
+	if conf.MaxRecipients == 0 {
+		conf.MaxRecipients = defaultMaxRecipients
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultTimeout
+	}
+
+	return &Server{
+		config: conf,
+		idle:   make(map[*session]struct{}),
+	}, nil
+}
+
+// Serve accepts connections on l until ctx is canceled. Serve closes l, and
+// waits for the sessions that are receiving or delivering messages before it
+// returns.
+func (r *Server) Serve(ctx context.Context, l net.Listener) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.shutdown()
+			l.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				r.wg.Wait()
+				return nil
+			}
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				logger.Warning(fmt.Sprintf("delivery: temporary error on accepting a connection: %v", err))
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			newSession(r, conn).serve()
+		}()
+	}
+}
+
+// shutdown closes the idle sessions, and makes the others close after they
+// finish the current command.
+func (r *Server) shutdown() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.shuttingDown = true
+	for s := range r.idle {
+		s.conn.Close()
+	}
+}
+
+// setIdle marks s as idle or busy. setIdle returns false if the server is shutting down.
+func (r *Server) setIdle(s *session, idle bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if idle {
+		r.idle[s] = struct{}{}
+	} else {
+		delete(r.idle, s)
+	}
+
+	return !r.shuttingDown
+}
+
+func (r *Server) query(f func(tx database.Transaction) error) error {
+	tx := r.config.DB.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type recipient struct {
+	address    string
+	credential backend.Credential
+}
+
+type session struct {
+	server *Server
+	config *Config
+	conn   net.Conn
+	text   *textproto.Conn
+	remote string
+	tls    bool
+	helo   string
+	// from is the envelope sender, which is nil before the MAIL command.
+	from   *string
+	rcpts  []recipient
+	errors int
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	remote := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	return &session{
+		server: server,
+		config: &server.config,
+		conn:   conn,
+		text:   textproto.NewConn(conn),
+		remote: remote,
+	}
+}
+
+func (r *session) serve() {
+	defer r.conn.Close()
+	logger.Debug(fmt.Sprintf("delivery: new %v session from %v", r.config.Protocol, r.remote))
+
+	if err := r.reply(220, "%v %v Omega ready", r.config.Hostname, r.config.Protocol); err != nil {
+		return
+	}
+	for {
+		if !r.server.setIdle(r, true) {
+			r.reply(421, "4.3.2 Service shutting down")
+			return
+		}
+		r.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+		line, err := r.text.ReadLine()
+		r.server.setIdle(r, false)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug(fmt.Sprintf("delivery: failed to read a command from %v: %v", r.remote, err))
+			}
+			return
+		}
+
+		quit, err := r.handle(line)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("delivery: session with %v has been closed: %v", r.remote, err))
+			return
+		}
+		if quit {
+			return
+		}
+		if r.errors >= maxErrors {
+			r.reply(421, "4.7.0 Too many errors")
+			return
+		}
+	}
+}
+
+// handle processes a command line. It returns true if the session should be
+// closed, or an error if the connection is broken.
+func (r *session) handle(line string) (quit bool, err error) {
+	cmd, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+
+	switch strings.ToUpper(cmd) {
+	case "HELO", "EHLO", "LHLO":
+		return false, r.handleHello(strings.ToUpper(cmd), arg)
+	case "STARTTLS":
+		return false, r.handleStartTLS()
+	case "MAIL":
+		return false, r.handleMail(arg)
+	case "RCPT":
+		return false, r.handleRcpt(arg)
+	case "DATA":
+		return false, r.handleData()
+	case "RSET":
+		r.reset()
+		return false, r.reply(250, "2.0.0 OK")
+	case "NOOP":
+		return false, r.reply(250, "2.0.0 OK")
+	case "VRFY":
+		return false, r.reply(252, "2.5.0 Cannot VRFY user")
+	case "QUIT":
+		r.reply(221, "2.0.0 Bye")
+		return true, nil
+	default:
+		r.errors++
+		return false, r.reply(500, "5.5.2 Command unrecognized")
+	}
+}
+
+func (r *session) reset() {
+	r.from = nil
+	r.rcpts = nil
+}
+
+func (r *session) handleHello(cmd, arg string) error {
+	// LMTP only has LHLO, and SMTP does not have it.
+	if (cmd == "LHLO") != (r.config.Protocol == ProtocolLMTP) {
+		r.errors++
+		return r.reply(500, "5.5.1 %v is not supported by %v", cmd, r.config.Protocol)
+	}
+	if len(arg) == 0 {
+		r.errors++
+		return r.reply(501, "5.5.4 Missing domain")
+	}
+	r.reset()
+	r.helo = arg
+
+	if cmd == "HELO" {
+		return r.reply(250, "%v", r.config.Hostname)
+	}
+	ext := []string{r.config.Hostname, "PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", fmt.Sprintf("SIZE %v", r.config.MaxSize)}
+	if r.config.TLSConfig != nil && !r.tls {
+		ext = append(ext, "STARTTLS")
+	}
+
+	return r.replyLines(250, ext)
+}
+
+func (r *session) handleStartTLS() error {
+	if r.config.TLSConfig == nil || r.tls {
+		r.errors++
+		return r.reply(502, "5.5.1 STARTTLS not available")
+	}
+	if err := r.reply(220, "2.0.0 Ready to start TLS"); err != nil {
+		return err
+	}
+
+	conn := tls.Server(r.conn, r.config.TLSConfig)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake: %v", err)
+	}
+	r.conn = conn
+	r.text = textproto.NewConn(conn)
+	r.tls = true
+	// The client should say hello again.
+	r.helo = ""
+	r.reset()
+
+	return nil
+}
+
+func (r *session) handleMail(arg string) error {
+	if len(r.helo) == 0 {
+		r.errors++
+		return r.reply(503, "5.5.1 Say hello first")
+	}
+	if r.from != nil {
+		r.errors++
+		return r.reply(503, "5.5.1 Nested MAIL command")
+	}
+	addr, params, err := parsePath(arg, "FROM:")
+	if err != nil {
+		r.errors++
+		return r.reply(501, "5.5.4 %v", err)
+	}
+	if v, ok := params["SIZE"]; ok {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			r.errors++
+			return r.reply(501, "5.5.4 Invalid SIZE parameter")
+		}
+		if size > r.config.MaxSize {
+			return r.reply(552, "5.3.4 Message size exceeds fixed limit")
+		}
+	}
+	r.from = &addr
+
+	return r.reply(250, "2.1.0 OK")
+}
+
+func (r *session) handleRcpt(arg string) error {
+	if r.from == nil {
+		r.errors++
+		return r.reply(503, "5.5.1 Need MAIL command")
+	}
+	addr, _, err := parsePath(arg, "TO:")
+	if err != nil || len(addr) == 0 {
+		r.errors++
+		return r.reply(501, "5.5.4 Invalid recipient address")
+	}
+	if len(r.rcpts) >= r.config.MaxRecipients {
+		return r.reply(452, "4.5.3 Too many recipients")
+	}
+
+	c, err := r.config.Directory.LookupAddress(addr)
+	if err != nil {
+		logger.Error(fmt.Sprintf("delivery: failed to look up a recipient address: address=%v, err=%v", addr, err))
+		return r.reply(451, "4.3.0 Temporary lookup failure")
+	}
+	if !c.IsAuthorized() {
+		logger.Info(fmt.Sprintf("delivery: rejected an unknown recipient: from=%v, address=%v, remote=%v", *r.from, addr, r.remote))
+		return r.reply(550, "5.1.1 <%v>: Recipient address rejected: User unknown", addr)
+	}
+	r.rcpts = append(r.rcpts, recipient{address: addr, credential: c})
+
+	return r.reply(250, "2.1.5 OK")
+}
+
+func (r *session) handleData() error {
+	if r.from == nil || len(r.rcpts) == 0 {
+		r.errors++
+		return r.reply(503, "5.5.1 Need valid RCPT command")
+	}
+	if err := r.reply(354, "Start mail input; end with <CRLF>.<CRLF>"); err != nil {
+		return err
+	}
+	defer r.reset()
+
+	// Read the message, and then discard the rest over the size limit.
+	r.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+	dot := r.text.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(dot, r.config.MaxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > r.config.MaxSize {
+		if _, err := io.Copy(ioutil.Discard, dot); err != nil {
+			return err
+		}
+		return r.replyEach(552, "5.3.4 Message size exceeds fixed limit")
+	}
+
+	msg, err := r.newMessage(data)
+	if err != nil {
+		logger.Info(fmt.Sprintf("delivery: rejected a malformed message: from=%v, remote=%v, err=%v", *r.from, r.remote, err))
+		return r.replyEach(554, "5.6.0 Malformed message")
+	}
+	if r.config.Verifier != nil {
+		if policy := r.authenticate(msg); policy == mailauth.DMARCPolicyReject {
+			return r.replyEach(550, "5.7.1 Rejected by the DMARC policy of the sender domain")
+		}
+	}
+	if r.config.Scanner != nil {
+		result, err := r.config.Scanner.Scan(msg.Raw)
+		if err != nil {
+			logger.Error(fmt.Sprintf("delivery: failed to scan a message: from=%v, remote=%v, err=%v", *r.from, r.remote, err))
+			return r.replyEach(451, "4.7.1 Temporary content scanning failure")
+		}
+		switch result.Verdict {
+		case scanner.VerdictReject:
+			logger.Info(fmt.Sprintf("delivery: rejected a message by the content scanner: from=%v, remote=%v, reason=%v", *r.from, r.remote, result.Reason))
+			return r.replyEach(550, "5.7.1 Message content rejected: %v", result.Reason)
+		case scanner.VerdictQuarantine:
+			return r.quarantine(msg, result.Reason)
+		case scanner.VerdictJunk:
+			msg.Junk = true
+		}
+	}
+
+	if r.config.Protocol == ProtocolLMTP {
+		for _, v := range r.rcpts {
+			err := r.server.query(func(tx database.Transaction) error {
+				return r.config.Deliverer.Deliver(tx, v.credential, v.address, msg)
+			})
+			if err := r.replyDelivery(err, v.address); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = r.server.query(func(tx database.Transaction) error {
+		for _, v := range r.rcpts {
+			if err := r.config.Deliverer.Deliver(tx, v.credential, v.address, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return r.replyDelivery(err, "")
+}
+
+// authenticate verifies msg, and adds an Authentication-Results header to msg.
+// It returns the DMARC policy to apply if EnforceDMARC is true.
+func (r *session) authenticate(msg *Message) mailauth.DMARCPolicy {
+	var ip net.IP
+	if r.config.Protocol == ProtocolSMTP {
+		ip = net.ParseIP(r.remote)
+	}
+	result := r.config.Verifier.Verify(ip, r.helo, msg.From, msg.Raw)
+	header := result.Header(r.config.Hostname)
+	logger.Debug(fmt.Sprintf("delivery: authenticated a message: from=%v, remote=%v, %v", *r.from, r.remote, strings.Join(strings.Fields(header), " ")))
+
+	// Remove forged results, and then add ours on the top.
+	raw := append([]byte(header), mailauth.StripResults(msg.Raw, r.config.Hostname)...)
+	if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		msg.Raw, msg.Header = raw, m.Header
+	}
+	if !r.config.EnforceDMARC || result.DMARC != mailauth.DMARCFail {
+		return mailauth.DMARCPolicyNone
+	}
+
+	switch result.DMARCPolicy {
+	case mailauth.DMARCPolicyReject:
+		logger.Info(fmt.Sprintf("delivery: rejected a message by the DMARC policy: from=%v, domain=%v, remote=%v", *r.from, result.FromDomain, r.remote))
+	case mailauth.DMARCPolicyQuarantine:
+		logger.Info(fmt.Sprintf("delivery: filing a message as junk by the DMARC policy: from=%v, domain=%v, remote=%v", *r.from, result.FromDomain, r.remote))
+		msg.Junk = true
+	}
+
+	return result.DMARCPolicy
+}
+
+// quarantine holds msg in the quarantine for each recipient instead of
+// delivering it. The client is told that the message has been delivered.
+func (r *session) quarantine(msg *Message, reason string) error {
+	err := r.server.query(func(tx database.Transaction) error {
+		q := r.config.Quarantine.NewQuarantine(tx)
+		for _, v := range r.rcpts {
+			_, err := q.AddMessage(scanner.QuarantinedMessage{
+				UserUID:   v.credential.UserUID(),
+				Direction: scanner.Inbound,
+				From:      msg.From,
+				To:        []string{v.address},
+				Reason:    reason,
+				Raw:       msg.Raw,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("delivery: failed to quarantine a message: from=%v, err=%v", *r.from, err))
+		return r.replyEach(451, "4.3.0 Temporary delivery failure")
+	}
+	logger.Info(fmt.Sprintf("delivery: quarantined a message: from=%v, to=%v recipients, remote=%v, reason=%v", *r.from, len(r.rcpts), r.remote, reason))
+
+	return r.replyEach(250, "2.0.0 Delivered")
+}
+
+// newMessage returns a message of data read by the DATA command.
+func (r *session) newMessage(data []byte) (*Message, error) {
+	// DotReader converts CRLF into LF.
+	data = bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	with := "ESMTP"
+	if r.config.Protocol == ProtocolLMTP {
+		with = "LMTP"
+	}
+	if r.tls {
+		with += "S"
+	}
+	fmt.Fprintf(&buf, "Received: from %v (%v)\r\n\tby %v with %v", r.helo, r.remote, r.config.Hostname, with)
+	if len(r.rcpts) == 1 {
+		fmt.Fprintf(&buf, "\r\n\tfor <%v>", r.rcpts[0].address)
+	}
+	fmt.Fprintf(&buf, "; %v\r\n", time.Now().Format(time.RFC1123Z))
+	buf.Write(data)
+
+	return &Message{
+		From:   *r.from,
+		Header: m.Header,
+		Raw:    buf.Bytes(),
+	}, nil
+}
+
+// replyDelivery replies the result of a delivery to rcpt. Empty rcpt means all recipients.
+func (r *session) replyDelivery(err error, rcpt string) error {
+	target, prefix := rcpt, fmt.Sprintf("<%v> ", rcpt)
+	if len(rcpt) == 0 {
+		target, prefix = fmt.Sprintf("%v recipients", len(r.rcpts)), ""
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("delivery: failed to deliver a message: from=%v, to=%v, err=%v", *r.from, target, err))
+		return r.reply(451, "4.3.0 %vTemporary delivery failure", prefix)
+	}
+	logger.Info(fmt.Sprintf("delivery: delivered a message: from=%v, to=%v, remote=%v", *r.from, target, r.remote))
+
+	return r.reply(250, "2.0.0 %vDelivered", prefix)
+}
+
+// replyEach sends a reply for each recipient in LMTP, or a single reply in SMTP.
+func (r *session) replyEach(code int, format string, args ...interface{}) error {
+	n := 1
+	if r.config.Protocol == ProtocolLMTP {
+		n = len(r.rcpts)
+	}
+	for i := 0; i < n; i++ {
+		if err := r.reply(code, format, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *session) reply(code int, format string, args ...interface{}) error {
+	r.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+	return r.text.PrintfLine("%03d %v", code, fmt.Sprintf(format, args...))
+}
+
+func (r *session) replyLines(code int, lines []string) error {
+	r.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+	for i, v := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if err := r.text.PrintfLine("%03d%v%v", code, sep, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parsePath parses the argument of MAIL or RCPT commands, such as
+// "FROM:<user@example.com> SIZE=1024", and returns the address and the
+// parameters whose keys are in uppercase.
+func parsePath(arg, prefix string) (addr string, params map[string]string, err error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, fmt.Errorf("syntax error: expected %v", prefix)
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if len(arg) == 0 || arg[0] != '<' {
+		return "", nil, errors.New("syntax error: expected <address>")
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", nil, errors.New("syntax error: unterminated <address>")
+	}
+	addr = arg[1:end]
+	// Ignore the obsolete source route.
+	if i := strings.IndexByte(addr, ':'); i >= 0 && strings.HasPrefix(addr, "@") {
+		addr = addr[i+1:]
+	}
+	if len(addr) > 0 && strings.LastIndex(addr, "@") <= 0 {
+		return "", nil, fmt.Errorf("invalid address: %v", addr)
+	}
+
+	params = make(map[string]string)
+	for _, v := range strings.Fields(arg[end+1:]) {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = kv[1]
+		} else {
+			params[strings.ToUpper(kv[0])] = ""
+		}
+	}
+
+	return addr, params, nil
+}
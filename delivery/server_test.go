@@ -0,0 +1,552 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package delivery
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"golang.org/x/net/context"
+)
+
+type testCredential struct {
+	userID string
+	uid    uint64
+}
+
+func (r testCredential) IsAuthorized() bool { return r.uid > 0 }
+func (r testCredential) UserID() string     { return r.userID }
+func (r testCredential) UserUID() uint64    { return r.uid }
+
+// testDirectory knows alice@example.com and bob@example.com.
+type testDirectory struct{}
+
+func (r testDirectory) LookupUser(userID string) (backend.Credential, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r testDirectory) LookupAddress(address string) (backend.Credential, error) {
+	switch strings.ToLower(address) {
+	case "alice@example.com":
+		return testCredential{userID: "alice", uid: 1}, nil
+	case "bob@example.com":
+		return testCredential{userID: "bob", uid: 2}, nil
+	case "broken@example.com":
+		return nil, errors.New("directory failure")
+	default:
+		return testCredential{userID: address}, nil
+	}
+}
+
+type delivered struct {
+	rcpt string
+	msg  *Message
+}
+
+// testDeliverer keeps the deliveries of a transaction until it is committed.
+// Deliveries to the users in fail fail.
+type testDeliverer struct {
+	fail map[string]bool
+
+	mu        sync.Mutex
+	pending   map[*testTx][]delivered
+	delivered []delivered
+}
+
+func (r *testDeliverer) Deliver(queryer database.Queryer, c backend.Credential, rcpt string, msg *Message) error {
+	if r.fail[c.UserID()] {
+		return errors.New("storage failure")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tx := queryer.(*testTx)
+	r.pending[tx] = append(r.pending[tx], delivered{rcpt, msg})
+	return nil
+}
+
+func (r *testDeliverer) commit(tx *testTx) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.delivered = append(r.delivered, r.pending[tx]...)
+	delete(r.pending, tx)
+}
+
+func (r *testDeliverer) rollback(tx *testTx) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.pending, tx)
+}
+
+func (r *testDeliverer) deliveries() []delivered {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]delivered(nil), r.delivered...)
+}
+
+type testDB struct {
+	deliverer *testDeliverer
+}
+
+func (r *testDB) NewTransaction(ctx context.Context) database.Transaction {
+	return &testTx{deliverer: r.deliverer}
+}
+
+type testTx struct {
+	deliverer *testDeliverer
+}
+
+func (r *testTx) Query(f func(*sql.Tx) error) error { return errors.New("not implemented") }
+func (r *testTx) Begin() error                      { return nil }
+func (r *testTx) Error() database.TransactionError  { return nil }
+
+func (r *testTx) Commit() error {
+	r.deliverer.commit(r)
+	return nil
+}
+
+func (r *testTx) Rollback() error {
+	r.deliverer.rollback(r)
+	return nil
+}
+
+func testTLSConfig(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:              []string{"mx.example.com"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{ServerName: "mx.example.com", RootCAs: pool}
+	return server, client
+}
+
+type testServer struct {
+	deliverer *testDeliverer
+	addr      string
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func startServer(t *testing.T, conf Config) *testServer {
+	if conf.Deliverer == nil {
+		conf.Deliverer = &testDeliverer{}
+	}
+	d := conf.Deliverer.(*testDeliverer)
+	d.pending = make(map[*testTx][]delivered)
+	conf.Hostname = "mx.example.com"
+	conf.Directory = testDirectory{}
+	conf.DB = &testDB{deliverer: d}
+
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := &testServer{deliverer: d, addr: l.Addr().String(), cancel: cancel, done: make(chan struct{})}
+	go func() {
+		s.Serve(ctx, l)
+		close(result.done)
+	}()
+
+	return result
+}
+
+func (r *testServer) stop() {
+	r.cancel()
+	<-r.done
+}
+
+func dialSMTP(t *testing.T, s *testServer) *smtp.Client {
+	c, err := smtp.Dial(s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func replyCode(err error) int {
+	if e, ok := err.(*textproto.Error); ok {
+		return e.Code
+	}
+	return 0
+}
+
+func sendData(c *smtp.Client, msg string) error {
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+const testMessage = "From: Carol <carol@example.org>\r\nTo: alice@example.com\r\nSubject: hello\r\n\r\nHello.\r\n"
+
+func TestSMTPDelivery(t *testing.T) {
+	s := startServer(t, Config{Protocol: ProtocolSMTP})
+	defer s.stop()
+
+	c := dialSMTP(t, s)
+	defer c.Close()
+	if err := c.Mail("carol@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Unknown users of a local domain.
+	if err := c.Rcpt("nobody@example.com"); replyCode(err) != 550 {
+		t.Errorf("expected 550 for an unknown recipient, got %v", err)
+	}
+	// It is never an open relay.
+	if err := c.Rcpt("dave@remote.example.net"); replyCode(err) != 550 {
+		t.Errorf("expected 550 for a non-local recipient, got %v", err)
+	}
+	if err := c.Rcpt("broken@example.com"); replyCode(err) != 451 {
+		t.Errorf("expected 451 for a directory failure, got %v", err)
+	}
+	if err := c.Rcpt("Bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendData(c, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	v := s.deliverer.deliveries()
+	if len(v) != 2 || v[0].rcpt != "alice@example.com" || v[1].rcpt != "Bob@example.com" {
+		t.Fatalf("expected deliveries to alice and bob, got %+v", v)
+	}
+	msg := v[0].msg
+	if msg.From != "carol@example.org" {
+		t.Errorf("unexpected envelope sender: %v", msg.From)
+	}
+	if !strings.HasPrefix(string(msg.Raw), "Received: from client.example.org (127.0.0.1)\r\n\tby mx.example.com with ESMTP;") {
+		t.Errorf("unexpected Received header: %q", string(msg.Raw))
+	}
+	if !strings.HasSuffix(string(msg.Raw), testMessage) {
+		t.Errorf("unexpected message: %q", string(msg.Raw))
+	}
+	if msg.Header.Get("Subject") != "hello" {
+		t.Errorf("unexpected header: %v", msg.Header)
+	}
+}
+
+func TestSMTPNoRecipient(t *testing.T) {
+	s := startServer(t, Config{Protocol: ProtocolSMTP})
+	defer s.stop()
+
+	c := dialSMTP(t, s)
+	defer c.Close()
+	if err := c.Mail("carol@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("dave@remote.example.net"); replyCode(err) != 550 {
+		t.Errorf("expected 550 for a non-local recipient, got %v", err)
+	}
+	if _, err := c.Data(); replyCode(err) != 503 {
+		t.Errorf("expected 503 for DATA without recipients, got %v", err)
+	}
+	if len(s.deliverer.deliveries()) != 0 {
+		t.Error("expected no delivery")
+	}
+}
+
+// TestSMTPAtomic verifies that an SMTP message is delivered to all recipients
+// or to none of them.
+func TestSMTPAtomic(t *testing.T) {
+	s := startServer(t, Config{Protocol: ProtocolSMTP, Deliverer: &testDeliverer{fail: map[string]bool{"bob": true}}})
+	defer s.stop()
+
+	c := dialSMTP(t, s)
+	defer c.Close()
+	c.Mail("carol@example.org")
+	c.Rcpt("alice@example.com")
+	c.Rcpt("bob@example.com")
+	if err := sendData(c, testMessage); replyCode(err) != 451 {
+		t.Errorf("expected 451 for a delivery failure, got %v", err)
+	}
+	if v := s.deliverer.deliveries(); len(v) != 0 {
+		t.Errorf("expected no delivery, got %+v", v)
+	}
+}
+
+func TestSMTPSizeLimit(t *testing.T) {
+	s := startServer(t, Config{Protocol: ProtocolSMTP, MaxSize: 128})
+	defer s.stop()
+
+	c := dialSMTP(t, s)
+	defer c.Close()
+	if ok, v := c.Extension("SIZE"); !ok || v != "128" {
+		t.Errorf("expected the SIZE extension of 128, got %v", v)
+	}
+	// Declared size.
+	id, err := c.Text.Cmd("MAIL FROM:<carol@example.org> SIZE=129")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	if replyCode(err) != 552 {
+		t.Errorf("expected 552 for a declared size over the limit, got %v", err)
+	}
+
+	// Actual size.
+	if err := c.Mail("carol@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendData(c, testMessage+strings.Repeat("x", 128)+"\r\n"); replyCode(err) != 552 {
+		t.Errorf("expected 552 for a message over the limit, got %v", err)
+	}
+	// The session is still usable.
+	if err := c.Mail("carol@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendData(c, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if v := s.deliverer.deliveries(); len(v) != 1 {
+		t.Errorf("expected only the message under the limit to be delivered, got %v", len(v))
+	}
+}
+
+func TestSMTPStartTLS(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfig(t)
+	s := startServer(t, Config{Protocol: ProtocolSMTP, TLSConfig: serverTLS})
+	defer s.stop()
+
+	c := dialSMTP(t, s)
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("expected the STARTTLS extension")
+	}
+	if err := c.StartTLS(clientTLS); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("expected no STARTTLS extension after the TLS negotiation")
+	}
+	if err := c.Mail("carol@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendData(c, testMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	v := s.deliverer.deliveries()
+	if len(v) != 1 {
+		t.Fatalf("expected 1 delivery, got %v", len(v))
+	}
+	if !strings.Contains(string(v[0].msg.Raw), "by mx.example.com with ESMTPS\r\n\tfor <alice@example.com>;") {
+		t.Errorf("expected the Received header of ESMTPS: %q", string(v[0].msg.Raw))
+	}
+
+	// No STARTTLS without a TLS configuration.
+	s2 := startServer(t, Config{Protocol: ProtocolSMTP})
+	defer s2.stop()
+	c2 := dialSMTP(t, s2)
+	defer c2.Close()
+	if ok, _ := c2.Extension("STARTTLS"); ok {
+		t.Error("expected no STARTTLS extension without a TLS configuration")
+	}
+	if err := c2.StartTLS(clientTLS); replyCode(err) != 502 {
+		t.Errorf("expected 502 for STARTTLS, got %v", err)
+	}
+}
+
+// lmtpClient sends LMTP commands, which net/smtp does not support.
+type lmtpClient struct {
+	t    *testing.T
+	text *textproto.Conn
+}
+
+func dialLMTP(t *testing.T, s *testServer) *lmtpClient {
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &lmtpClient{t: t, text: textproto.NewConn(conn)}
+	c.expect(220)
+	return c
+}
+
+// cmd sends a command, and returns the reply code.
+func (r *lmtpClient) cmd(format string, args ...interface{}) int {
+	if err := r.text.PrintfLine(format, args...); err != nil {
+		r.t.Fatal(err)
+	}
+	return r.read()
+}
+
+func (r *lmtpClient) read() int {
+	code, _, err := r.text.ReadResponse(0)
+	if err != nil && replyCode(err) == 0 {
+		r.t.Fatal(err)
+	}
+	return code
+}
+
+func (r *lmtpClient) expect(code int) {
+	if v := r.read(); v != code {
+		r.t.Fatalf("expected %v, got %v", code, v)
+	}
+}
+
+// data sends msg after DATA, and returns the reply codes.
+func (r *lmtpClient) data(msg string, replies int) []int {
+	if code := r.cmd("DATA"); code != 354 {
+		r.t.Fatalf("expected 354 for DATA, got %v", code)
+	}
+	w := r.text.DotWriter()
+	fmt.Fprint(w, msg)
+	w.Close()
+
+	codes := []int{}
+	for i := 0; i < replies; i++ {
+		codes = append(codes, r.read())
+	}
+	return codes
+}
+
+func TestLMTPDelivery(t *testing.T) {
+	s := startServer(t, Config{Protocol: ProtocolLMTP, Deliverer: &testDeliverer{fail: map[string]bool{"bob": true}}})
+	defer s.stop()
+
+	c := dialLMTP(t, s)
+	defer c.text.Close()
+	if code := c.cmd("EHLO client.example.org"); code != 500 {
+		t.Errorf("expected 500 for EHLO in LMTP, got %v", code)
+	}
+	if code := c.cmd("LHLO client.example.org"); code != 250 {
+		t.Fatalf("expected 250 for LHLO, got %v", code)
+	}
+	if code := c.cmd("MAIL FROM:<carol@example.org>"); code != 250 {
+		t.Fatalf("expected 250 for MAIL, got %v", code)
+	}
+	if code := c.cmd("RCPT TO:<alice@example.com>"); code != 250 {
+		t.Fatalf("expected 250 for alice, got %v", code)
+	}
+	if code := c.cmd("RCPT TO:<nobody@example.com>"); code != 550 {
+		t.Errorf("expected 550 for an unknown recipient, got %v", code)
+	}
+	if code := c.cmd("RCPT TO:<bob@example.com>"); code != 250 {
+		t.Fatalf("expected 250 for bob, got %v", code)
+	}
+	// A reply for each accepted recipient in order.
+	codes := c.data(testMessage, 2)
+	if codes[0] != 250 || codes[1] != 451 {
+		t.Errorf("expected 250 for alice and 451 for bob, got %v", codes)
+	}
+	if code := c.cmd("QUIT"); code != 221 {
+		t.Errorf("expected 221 for QUIT, got %v", code)
+	}
+
+	v := s.deliverer.deliveries()
+	if len(v) != 1 || v[0].rcpt != "alice@example.com" {
+		t.Fatalf("expected a delivery to alice only, got %+v", v)
+	}
+	if !strings.Contains(string(v[0].msg.Raw), "by mx.example.com with LMTP;") {
+		t.Errorf("unexpected Received header: %q", string(v[0].msg.Raw))
+	}
+}
+
+func TestLMTPSizeLimit(t *testing.T) {
+	s := startServer(t, Config{Protocol: ProtocolLMTP, MaxSize: 128})
+	defer s.stop()
+
+	c := dialLMTP(t, s)
+	defer c.text.Close()
+	c.cmd("LHLO client.example.org")
+	c.cmd("MAIL FROM:<carol@example.org>")
+	c.cmd("RCPT TO:<alice@example.com>")
+	c.cmd("RCPT TO:<bob@example.com>")
+	codes := c.data(testMessage+strings.Repeat("x", 128)+"\r\n", 2)
+	if codes[0] != 552 || codes[1] != 552 {
+		t.Errorf("expected 552 for each recipient, got %v", codes)
+	}
+	if v := s.deliverer.deliveries(); len(v) != 0 {
+		t.Errorf("expected no delivery, got %+v", v)
+	}
+}
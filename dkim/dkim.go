@@ -0,0 +1,343 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/superkkt/logger"
+)
+
+// DefaultHeaders are the header fields signed by default.
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "In-Reply-To",
+	"References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+type Mailer interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// Key is a signing key of a domain.
+type Key struct {
+	Domain   string
+	Selector string
+	Private  *rsa.PrivateKey
+}
+
+// LoadKey reads a PEM encoded RSA private key in PKCS #1 or PKCS #8 format.
+func LoadKey(domain, selector, path string) (Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, fmt.Errorf("no PEM data found in %v", path)
+	}
+
+	var private *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return Key{}, err
+		}
+	case "PRIVATE KEY":
+		v, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return Key{}, err
+		}
+		var ok bool
+		if private, ok = v.(*rsa.PrivateKey); !ok {
+			return Key{}, fmt.Errorf("not a RSA private key: %v", path)
+		}
+	default:
+		return Key{}, fmt.Errorf("unexpected PEM type in %v: %v", path, block.Type)
+	}
+
+	return Key{
+		Domain:   strings.ToLower(domain),
+		Selector: selector,
+		Private:  private,
+	}, nil
+}
+
+type Config struct {
+	Keys []Key
+	// Headers are the header fields to sign. Empty means DefaultHeaders.
+	// From is always signed.
+	Headers []string
+}
+
+// Signer is a Mailer that adds a DKIM-Signature (RFC 6376) to emails using
+// the key of the domain of the From header, and passes them to the next Mailer.
+// Emails from domains without a key are passed as they are.
+type Signer struct {
+	next    Mailer
+	keys    map[string]Key
+	headers []string
+}
+
+func New(next Mailer, conf Config) (*Signer, error) {
+	if next == nil {
+		return nil, errors.New("nil next mailer")
+	}
+
+	keys := make(map[string]Key)
+	for _, v := range conf.Keys {
+		if len(v.Domain) == 0 || len(v.Selector) == 0 || v.Private == nil {
+			return nil, errors.New("empty domain, selector, or private key")
+		}
+		keys[strings.ToLower(v.Domain)] = v
+	}
+	headers := conf.Headers
+	if len(headers) == 0 {
+		headers = DefaultHeaders
+	}
+	hasFrom := false
+	for _, v := range headers {
+		if strings.EqualFold(v, "From") {
+			hasFrom = true
+		}
+	}
+	if !hasFrom {
+		headers = append([]string{"From"}, headers...)
+	}
+
+	return &Signer{
+		next:    next,
+		keys:    keys,
+		headers: headers,
+	}, nil
+}
+
+func (r *Signer) Send(from string, to []string, msg []byte) error {
+	msg = normalizeCRLF(msg)
+	domain := r.domain(from, msg)
+	key, ok := r.keys[domain]
+	if !ok {
+		return r.next.Send(from, to, msg)
+	}
+
+	signed, err := Sign(msg, key, r.headers, time.Now())
+	if err != nil {
+		// The receiver will decide what to do with an unsigned email.
+		logger.Warning(fmt.Sprintf("failed to sign an email: domain=%v, err=%v", domain, err))
+		return r.next.Send(from, to, msg)
+	}
+
+	return r.next.Send(from, to, signed)
+}
+
+// domain returns the domain of the From header, or the envelope sender if the
+// header is not available.
+func (r *Signer) domain(from string, msg []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err == nil {
+		if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+			from = addr.Address
+		}
+	}
+	i := strings.LastIndex(from, "@")
+	if i < 0 {
+		return ""
+	}
+
+	return strings.ToLower(from[i+1:])
+}
+
+// Sign returns msg prefixed with a DKIM-Signature header that signs headers
+// and the body of msg using relaxed/relaxed canonicalization and rsa-sha256.
+// msg should have CRLF line endings.
+func Sign(msg []byte, key Key, headers []string, now time.Time) ([]byte, error) {
+	fields, body, err := splitMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	bh := sha256.Sum256(RelaxedBody(body))
+	signed, names := selectHeaders(fields, headers)
+	if len(signed) == 0 {
+		return nil, errors.New("no header to sign")
+	}
+
+	tags := []string{
+		"v=1",
+		"a=rsa-sha256",
+		"c=relaxed/relaxed",
+		"d=" + key.Domain,
+		"s=" + key.Selector,
+		fmt.Sprintf("t=%v", now.Unix()),
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bh[:]),
+		"b=",
+	}
+	sig := "DKIM-Signature: " + strings.Join(tags, ";\r\n\t")
+
+	h := sha256.New()
+	for _, v := range signed {
+		h.Write([]byte(RelaxedHeader(v)))
+	}
+	// The signature header itself without the trailing CRLF.
+	h.Write([]byte(strings.TrimSuffix(RelaxedHeader(sig), "\r\n")))
+	b, err := rsa.SignPKCS1v15(rand.Reader, key.Private, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	var result bytes.Buffer
+	result.WriteString(sig)
+	result.WriteString(fold(base64.StdEncoding.EncodeToString(b), 72))
+	result.WriteString("\r\n")
+	result.Write(msg)
+
+	return result.Bytes(), nil
+}
+
+// splitMessage returns the header fields, including continuation lines and
+// the trailing CRLF, and the body of msg.
+func splitMessage(msg []byte) (fields []string, body []byte, err error) {
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		// Message without a body.
+		if !bytes.HasSuffix(msg, []byte("\r\n")) {
+			return nil, nil, errors.New("invalid message header")
+		}
+		i = len(msg) - 2
+	} else {
+		body = msg[i+4:]
+	}
+
+	for _, line := range strings.SplitAfter(string(msg[:i+2]), "\r\n") {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) == 0 {
+				return nil, nil, errors.New("invalid header continuation line")
+			}
+			fields[len(fields)-1] += line
+			continue
+		}
+		if !strings.Contains(line, ":") {
+			return nil, nil, fmt.Errorf("invalid header line: %v", strings.TrimSpace(line))
+		}
+		fields = append(fields, line)
+	}
+
+	return fields, body, nil
+}
+
+// selectHeaders returns the fields to sign in order of names, and their names.
+// Multiple instances of a field are selected from the bottom (RFC 6376 section 5.4.2).
+func selectHeaders(fields []string, names []string) (signed []string, signedNames []string) {
+	used := make(map[int]bool)
+	for _, name := range names {
+		// Each name signs all instances of the field.
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			signed = append(signed, fields[i])
+			signedNames = append(signedNames, strings.ToLower(name))
+		}
+	}
+
+	return signed, signedNames
+}
+
+func fieldName(field string) string {
+	return strings.TrimSpace(field[:strings.Index(field, ":")])
+}
+
+// RelaxedHeader returns the relaxed canonicalization of a header field (RFC 6376 section 3.4.2).
+func RelaxedHeader(field string) string {
+	i := strings.Index(field, ":")
+	if i < 0 {
+		return field
+	}
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+
+	return name + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ") + "\r\n"
+}
+
+// RelaxedBody returns the relaxed canonicalization of a body (RFC 6376 section 3.4.4).
+func RelaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, v := range lines {
+		lines[i] = strings.Join(strings.FieldsFunc(v, isWSP), " ")
+		// Leading WSP is reduced to a single SP, not removed.
+		if len(v) > 0 && isWSP(rune(v[0])) && len(lines[i]) > 0 {
+			lines[i] = " " + lines[i]
+		}
+	}
+	// Remove empty lines at the end of the body.
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func isWSP(c rune) bool {
+	return c == ' ' || c == '\t'
+}
+
+// fold splits s into lines of n characters for a header value.
+func fold(s string, n int) string {
+	var result []string
+	for len(s) > n {
+		result = append(result, s[:n])
+		s = s[n:]
+	}
+	result = append(result, s)
+
+	return strings.Join(result, "\r\n\t")
+}
+
+// normalizeCRLF converts bare LF line endings into CRLF.
+func normalizeCRLF(msg []byte) []byte {
+	if !bytes.Contains(msg, []byte("\n")) {
+		return msg
+	}
+	msg = bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)
+
+	return bytes.Replace(msg, []byte("\n"), []byte("\r\n"), -1)
+}
@@ -0,0 +1,396 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum number of signatures verified in a message.
+	maxSignatures = 5
+	// Minimum size of a public key in bits (RFC 8301).
+	minKeyBits = 1024
+)
+
+// Resolver looks up the DNS TXT records of public keys.
+type Resolver interface {
+	// LookupTXT returns the TXT records of name, whose strings are concatenated
+	// in each record. LookupTXT returns an empty slice without an error if name
+	// does not exist. An error that has the Temporary() method returning true
+	// means a temporary failure.
+	LookupTXT(name string) ([]string, error)
+}
+
+// Status is a result of a signature verification (RFC 8601 section 2.7.1).
+type Status string
+
+const (
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+// Verification is a result of a DKIM-Signature header.
+type Verification struct {
+	Status   Status
+	Domain   string
+	Selector string
+	// Err describes why the status is not StatusPass.
+	Err error
+}
+
+// Verify verifies the DKIM-Signature headers of msg, which should have CRLF
+// line endings. Verify returns nil if msg has no signature.
+func Verify(msg []byte, resolver Resolver, now time.Time) []Verification {
+	fields, body, err := splitMessage(normalizeCRLF(msg))
+	if err != nil {
+		return nil
+	}
+
+	result := []Verification{}
+	for _, v := range fields {
+		if !strings.EqualFold(fieldName(v), "DKIM-Signature") {
+			continue
+		}
+		if len(result) >= maxSignatures {
+			break
+		}
+		result = append(result, verify(v, fields, body, resolver, now))
+	}
+	if len(result) == 0 {
+		return nil
+	}
+
+	return result
+}
+
+type signature struct {
+	domain     string
+	selector   string
+	headers    []string
+	bodyHash   []byte
+	sig        []byte
+	relaxedHdr bool
+	relaxedBdy bool
+	// length is the number of body bytes to hash. Negative means the entire body.
+	length int64
+}
+
+func verify(field string, fields []string, body []byte, resolver Resolver, now time.Time) Verification {
+	s, err := parseSignature(field, now)
+	if err != nil {
+		return Verification{Status: StatusPermError, Domain: s.domain, Selector: s.selector, Err: err}
+	}
+	result := Verification{Domain: s.domain, Selector: s.selector}
+
+	key, err := lookupKey(resolver, s.domain, s.selector)
+	if err != nil {
+		result.Status, result.Err = StatusPermError, err
+		if isTemporary(err) {
+			result.Status = StatusTempError
+		}
+		return result
+	}
+
+	canonBody := simpleBody(body)
+	if s.relaxedBdy {
+		canonBody = RelaxedBody(body)
+	}
+	if s.length >= 0 {
+		if s.length > int64(len(canonBody)) {
+			result.Status, result.Err = StatusPermError, errors.New("body length tag exceeds the body")
+			return result
+		}
+		canonBody = canonBody[:s.length]
+	}
+	bh := sha256.Sum256(canonBody)
+	if !bytes.Equal(bh[:], s.bodyHash) {
+		result.Status, result.Err = StatusFail, errors.New("body hash did not verify")
+		return result
+	}
+
+	h := sha256.New()
+	for _, v := range verifiedHeaders(fields, s.headers) {
+		if s.relaxedHdr {
+			v = RelaxedHeader(v)
+		}
+		h.Write([]byte(v))
+	}
+	self := stripSignature(field)
+	if s.relaxedHdr {
+		self = RelaxedHeader(self)
+	}
+	h.Write([]byte(strings.TrimSuffix(self, "\r\n")))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, h.Sum(nil), s.sig); err != nil {
+		result.Status, result.Err = StatusFail, errors.New("signature did not verify")
+		return result
+	}
+	result.Status = StatusPass
+
+	return result
+}
+
+func parseSignature(field string, now time.Time) (signature, error) {
+	tags, err := parseTags(field[strings.Index(field, ":")+1:])
+	if err != nil {
+		return signature{}, err
+	}
+	s := signature{domain: strings.ToLower(tags["d"]), selector: tags["s"], length: -1}
+
+	for _, v := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[v]; !ok {
+			return s, fmt.Errorf("missing %v= tag", v)
+		}
+	}
+	if tags["v"] != "1" {
+		return s, fmt.Errorf("unsupported version: %v", tags["v"])
+	}
+	// RFC 8301 does not allow rsa-sha1.
+	if !strings.EqualFold(tags["a"], "rsa-sha256") {
+		return s, fmt.Errorf("unsupported algorithm: %v", tags["a"])
+	}
+	if s.sig, err = base64.StdEncoding.DecodeString(stripWSP(tags["b"])); err != nil {
+		return s, errors.New("invalid b= tag")
+	}
+	if s.bodyHash, err = base64.StdEncoding.DecodeString(stripWSP(tags["bh"])); err != nil {
+		return s, errors.New("invalid bh= tag")
+	}
+	for _, v := range strings.Split(tags["h"], ":") {
+		s.headers = append(s.headers, strings.TrimSpace(v))
+	}
+	if !hasName(s.headers, "From") {
+		return s, errors.New("From is not signed")
+	}
+	if i, ok := tags["i"]; ok {
+		domain := strings.ToLower(i[strings.LastIndex(i, "@")+1:])
+		if domain != s.domain && !strings.HasSuffix(domain, "."+s.domain) {
+			return s, errors.New("i= tag is not in the signing domain")
+		}
+	}
+	if v, ok := tags["c"]; ok {
+		c := strings.Split(strings.ToLower(v), "/")
+		if len(c) > 2 || !isCanon(c[0]) || (len(c) == 2 && !isCanon(c[1])) {
+			return s, fmt.Errorf("invalid canonicalization: %v", v)
+		}
+		s.relaxedHdr = c[0] == "relaxed"
+		s.relaxedBdy = len(c) == 2 && c[1] == "relaxed"
+	}
+	if v, ok := tags["l"]; ok {
+		if s.length, err = strconv.ParseInt(v, 10, 64); err != nil || s.length < 0 {
+			return s, errors.New("invalid l= tag")
+		}
+	}
+	if v, ok := tags["x"]; ok {
+		x, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return s, errors.New("invalid x= tag")
+		}
+		if x < now.Unix() {
+			return s, errors.New("signature expired")
+		}
+	}
+
+	return s, nil
+}
+
+// lookupKey returns the public key of a selector of a domain.
+func lookupKey(resolver Resolver, domain, selector string) (*rsa.PublicKey, error) {
+	records, err := resolver.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no key for signature")
+	}
+
+	// Use the first parsable record.
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key record: %v", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("invalid key version: %v", v)
+	}
+	if k, ok := tags["k"]; ok && !strings.EqualFold(k, "rsa") {
+		return nil, fmt.Errorf("unsupported key type: %v", k)
+	}
+	if h, ok := tags["h"]; ok && !hasName(strings.Split(h, ":"), "sha256") {
+		return nil, errors.New("key does not allow sha256")
+	}
+	p := stripWSP(tags["p"])
+	if len(p) == 0 {
+		return nil, errors.New("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("invalid public key encoding")
+	}
+	key, err := parsePublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if key.N.BitLen() < minKeyBits {
+		return nil, fmt.Errorf("too short key: %v bits", key.N.BitLen())
+	}
+
+	return key, nil
+}
+
+// parsePublicKey parses a DER encoded RSA public key in SubjectPublicKeyInfo or
+// PKCS #1 format.
+func parsePublicKey(der []byte) (*rsa.PublicKey, error) {
+	if v, err := x509.ParsePKIXPublicKey(der); err == nil {
+		key, ok := v.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA public key")
+		}
+		return key, nil
+	}
+
+	var pkcs1 struct {
+		N *big.Int
+		E int
+	}
+	if rest, err := asn1.Unmarshal(der, &pkcs1); err != nil || len(rest) > 0 || pkcs1.N == nil {
+		return nil, errors.New("invalid public key")
+	}
+
+	return &rsa.PublicKey{N: pkcs1.N, E: pkcs1.E}, nil
+}
+
+// parseTags parses a tag=value list (RFC 6376 section 3.2).
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, v := range strings.Split(s, ";") {
+		v = strings.TrimSpace(strings.Replace(v, "\r\n", "", -1))
+		if len(v) == 0 {
+			continue
+		}
+		i := strings.Index(v, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid tag: %v", v)
+		}
+		name := strings.TrimSpace(v[:i])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicated tag: %v", name)
+		}
+		tags[name] = strings.TrimSpace(v[i+1:])
+	}
+
+	return tags, nil
+}
+
+// verifiedHeaders returns the fields in order of names. Each name selects the
+// next unused instance of the field from the bottom, and a name that has no
+// instance selects nothing (RFC 6376 section 5.4.2).
+func verifiedHeaders(fields []string, names []string) []string {
+	result := []string{}
+	used := make(map[int]bool)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			result = append(result, fields[i])
+			break
+		}
+	}
+
+	return result
+}
+
+// stripSignature returns a DKIM-Signature field whose b= tag value is removed
+// without changing anything else.
+func stripSignature(field string) string {
+	i := strings.Index(field, ":") + 1
+	for i < len(field) {
+		end := strings.Index(field[i:], ";")
+		if end < 0 {
+			end = len(field) - i
+		}
+		tag := field[i : i+end]
+		if eq := strings.Index(tag, "="); eq >= 0 && strings.TrimSpace(tag[:eq]) == "b" {
+			// Keep the trailing CRLF of the last tag.
+			value := tag[eq+1:]
+			suffix := ""
+			if strings.HasSuffix(value, "\r\n") {
+				suffix = "\r\n"
+			}
+			return field[:i+eq+1] + suffix + field[i+end:]
+		}
+		i += end + 1
+	}
+
+	return field
+}
+
+// simpleBody returns the simple canonicalization of a body (RFC 6376 section 3.4.3).
+func simpleBody(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if !bytes.HasSuffix(body, []byte("\r\n")) {
+		body = append(append([]byte{}, body...), '\r', '\n')
+	}
+
+	return body
+}
+
+func isCanon(s string) bool {
+	return s == "simple" || s == "relaxed"
+}
+
+func hasName(names []string, name string) bool {
+	for _, v := range names {
+		if strings.EqualFold(strings.TrimSpace(v), name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func stripWSP(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(c rune) bool { return c == ' ' || c == '\t' || c == '\r' || c == '\n' }), "")
+}
+
+func isTemporary(err error) bool {
+	e, ok := err.(interface {
+		Temporary() bool
+	})
+
+	return ok && e.Temporary()
+}
@@ -0,0 +1,157 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/superkkt/omega/activesync"
+
+	"github.com/superkkt/logger"
+)
+
+func (r *session) handleLogin(req *request) error {
+	username, err := req.args.astring()
+	if err != nil {
+		return err
+	}
+	if err := req.args.space(); err != nil {
+		return err
+	}
+	password, err := req.args.astring()
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	if !r.secure() {
+		r.write("%v NO [PRIVACYREQUIRED] LOGIN is disabled over insecure connections\r\n", req.tag)
+		return nil
+	}
+
+	return r.login(req.tag, username, password)
+}
+
+// handleAuthenticate implements the AUTHENTICATE command with the PLAIN
+// mechanism (RFC 4616) and the initial response (RFC 4959).
+func (r *session) handleAuthenticate(req *request) error {
+	mechanism, err := req.args.atom()
+	if err != nil {
+		return err
+	}
+	response, initial := "", false
+	if !req.args.atEnd() {
+		if err := req.args.space(); err != nil {
+			return err
+		}
+		if response, err = req.args.atom(); err != nil {
+			return err
+		}
+		initial = true
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	if !strings.EqualFold(mechanism, "PLAIN") {
+		r.write("%v NO Unsupported authentication mechanism\r\n", req.tag)
+		return nil
+	}
+	if !r.secure() {
+		r.write("%v NO [PRIVACYREQUIRED] Authentication is disabled over insecure connections\r\n", req.tag)
+		return nil
+	}
+
+	if !initial {
+		r.write("+ \r\n")
+		if err := r.flush(); err != nil {
+			return err
+		}
+		if response, err = readLine(r.reader); err != nil {
+			r.err = err
+			return nil
+		}
+	}
+	if response == "*" {
+		r.write("%v BAD Authentication canceled\r\n", req.tag)
+		return nil
+	}
+	// = is an empty initial response.
+	if response == "=" {
+		response = ""
+	}
+	v, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return syntaxError("invalid base64 response")
+	}
+	// authzid NUL authcid NUL passwd
+	fields := bytes.Split(v, []byte{0})
+	if len(fields) != 3 {
+		return syntaxError("invalid PLAIN response")
+	}
+	if len(fields[0]) > 0 && !bytes.Equal(fields[0], fields[1]) {
+		r.write("%v NO [AUTHORIZATIONFAILED] Authorization identity is not allowed\r\n", req.tag)
+		return nil
+	}
+
+	return r.login(req.tag, string(fields[1]), string(fields[2]))
+}
+
+func (r *session) login(tag, username, password string) error {
+	attempt := &activesync.Attempt{IP: r.remote, Username: username}
+	if !r.server.throttle.Check(attempt) {
+		r.authFailed()
+		r.write("%v NO [UNAVAILABLE] Too many authentication failures, try again later\r\n", tag)
+		return nil
+	}
+
+	c, err := r.config.Authenticator.Auth(username, password)
+	if err != nil {
+		logger.Error(fmt.Sprintf("imap: failed to authenticate a user: user=%v, remote=%v, err=%v", username, r.remote, err))
+		r.write("%v NO [UNAVAILABLE] Temporary authentication failure\r\n", tag)
+		return nil
+	}
+	r.server.throttle.Update(attempt, c.IsAuthorized())
+	if !c.IsAuthorized() {
+		logger.Info(fmt.Sprintf("imap: authentication failed: user=%v, remote=%v", username, r.remote))
+		r.authFailed()
+		r.write("%v NO [AUTHENTICATIONFAILED] Authentication failed\r\n", tag)
+		return nil
+	}
+
+	logger.Debug(fmt.Sprintf("imap: user logged in: user=%v, remote=%v", c.UserID(), r.remote))
+	r.credential = c
+	r.write("%v OK [CAPABILITY %v] Logged in\r\n", tag, r.capability())
+
+	return nil
+}
+
+// authFailed counts a failed authentication, and closes the session after too
+// many failures.
+func (r *session) authFailed() {
+	r.authFailures++
+	if r.authFailures >= maxAuthFailures {
+		r.bye = "Too many authentication failures"
+	}
+}
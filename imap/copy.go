@@ -0,0 +1,157 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+)
+
+// handleCopy implements the COPY and MOVE commands.
+func (r *session) handleCopy(req *request) error {
+	set, err := req.args.seqSet()
+	if err != nil {
+		return err
+	}
+	if err := req.args.space(); err != nil {
+		return err
+	}
+	name, err := req.args.mailbox()
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	move := req.name == "MOVE"
+	mb := r.mailbox
+	if move && mb.readOnly {
+		r.write("%v NO [READ-ONLY] Mailbox is read-only\r\n", req.tag)
+		return nil
+	}
+	messages := []*message{}
+	for _, seq := range mb.seqNumbers(set, req.uid) {
+		if m := mb.message(seq); !m.expunged {
+			messages = append(messages, m)
+		}
+	}
+
+	result := ""
+	var uidValidity uint32
+	var src, dst []string
+	err = r.server.query(func(tx database.Transaction) error {
+		fm := r.config.Storage.NewFolderManager(tx, r.credential)
+		folder, ok, err := r.getFolder(fm, name, database.LockRead)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			result = "NO [TRYCREATE] Mailbox does not exist"
+			return nil
+		}
+		if move && folder.ID == mb.folder.ID {
+			result = "NO [CANNOT] Source and destination are the same"
+			return nil
+		}
+		if uidValidity, err = r.uidValidity(fm, folder); err != nil {
+			return err
+		}
+
+		from := r.config.Storage.NewEmailManager(tx, r.credential, mb.folder.ID)
+		to := r.config.Storage.NewEmailManager(tx, r.credential, folder.ID)
+		for _, m := range messages {
+			var uid uint64
+			if move {
+				uid, err = from.MoveEmail(m.uid, folder.ID)
+			} else {
+				uid, err = copyEmail(from, to, m.uid)
+			}
+			if err != nil {
+				// Removed by another session.
+				if isNotFound(err) {
+					continue
+				}
+				return err
+			}
+			if err := checkUID(uid); err != nil {
+				return err
+			}
+			src = append(src, strconv.FormatUint(m.uid, 10))
+			dst = append(dst, strconv.FormatUint(uid, 10))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(result) > 0 {
+		r.write("%v %v\r\n", req.tag, result)
+		return nil
+	}
+
+	code := ""
+	if len(src) > 0 {
+		code = "[COPYUID " + strconv.FormatUint(uint64(uidValidity), 10) + " " + strings.Join(src, ",") + " " + strings.Join(dst, ",") + "] "
+	}
+	if !move {
+		r.write("%v OK %vCOPY completed\r\n", req.tag, code)
+		return nil
+	}
+
+	// RFC 6851 sends COPYUID in an untagged response before the expunges.
+	if len(code) > 0 {
+		r.write("* OK %vMoved\r\n", code)
+	}
+	for _, m := range messages {
+		m.expunged = true
+	}
+	r.reportExpunged()
+	r.write("%v OK %v completed\r\n", req.tag, commandName(req))
+
+	return nil
+}
+
+// copyEmail copies an email from a folder into another, and returns the ID of
+// the new email.
+func copyEmail(from, to backend.EmailManager, emailID uint64) (uint64, error) {
+	email, err := from.GetEmail(emailID, database.LockRead)
+	if err != nil {
+		return 0, err
+	}
+	raw, err := from.GetRawEmail(emailID, database.LockRead)
+	if err != nil {
+		return 0, err
+	}
+	e, err := to.AddEmail(raw)
+	if err != nil {
+		return 0, err
+	}
+	if email.Seen {
+		if err := to.UpdateEmail(e.ID, true); err != nil {
+			return 0, err
+		}
+	}
+
+	return e.ID, nil
+}
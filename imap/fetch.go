@@ -0,0 +1,424 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/superkkt/omega/database"
+)
+
+type fetchItem struct {
+	// name is the upper-cased name of the item without the section.
+	name string
+	// label is the name of the item in the response.
+	label   string
+	section sectionSpec
+	peek    bool
+	partial bool
+	offset  int
+	length  int
+}
+
+// raw returns whether the item requires the raw message.
+func (r fetchItem) raw() bool {
+	switch r.name {
+	case "FLAGS", "UID", "INTERNALDATE":
+		return false
+	default:
+		return true
+	}
+}
+
+// seen returns whether fetching the item sets the \Seen flag.
+func (r fetchItem) seen() bool {
+	switch r.name {
+	case "RFC822", "RFC822.TEXT":
+		return true
+	case "BODY[]":
+		return !r.peek
+	default:
+		return false
+	}
+}
+
+var fetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+	"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+}
+
+func parseFetchItems(p *parser) ([]fetchItem, error) {
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	switch v := v.(type) {
+	case atom:
+		if macro, ok := fetchMacros[strings.ToUpper(string(v))]; ok {
+			names = macro
+		} else {
+			names = append(names, string(v))
+		}
+	case []interface{}:
+		for _, e := range v {
+			a, ok := e.(atom)
+			if !ok {
+				return nil, syntaxError("invalid fetch item")
+			}
+			names = append(names, string(a))
+		}
+	default:
+		return nil, syntaxError("invalid fetch item")
+	}
+
+	items := []fetchItem{}
+	for _, v := range names {
+		item, err := parseFetchItem(v)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func parseFetchItem(s string) (fetchItem, error) {
+	i := strings.IndexByte(s, '[')
+	if i < 0 {
+		name := strings.ToUpper(s)
+		switch name {
+		case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY", "BODYSTRUCTURE", "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+			return fetchItem{name: name, label: name}, nil
+		default:
+			return fetchItem{}, syntaxError(fmt.Sprintf("unknown fetch item: %v", s))
+		}
+	}
+
+	item := fetchItem{name: "BODY[]"}
+	switch strings.ToUpper(s[:i]) {
+	case "BODY":
+	case "BODY.PEEK":
+		item.peek = true
+	default:
+		return fetchItem{}, syntaxError(fmt.Sprintf("unknown fetch item: %v", s))
+	}
+	j := strings.LastIndexByte(s, ']')
+	if j < i {
+		return fetchItem{}, syntaxError("missing ]")
+	}
+	section, err := parseSection(s[i+1 : j])
+	if err != nil {
+		return fetchItem{}, err
+	}
+	item.section = section
+	item.label = "BODY[" + s[i+1:j] + "]"
+
+	// Partial fetch, e.g., BODY[]<0.1024>.
+	if partial := s[j+1:]; len(partial) > 0 {
+		if !strings.HasPrefix(partial, "<") || !strings.HasSuffix(partial, ">") {
+			return fetchItem{}, syntaxError("invalid partial")
+		}
+		v := strings.SplitN(partial[1:len(partial)-1], ".", 2)
+		if len(v) != 2 {
+			return fetchItem{}, syntaxError("invalid partial")
+		}
+		offset, err1 := strconv.ParseUint(v[0], 10, 31)
+		length, err2 := strconv.ParseUint(v[1], 10, 31)
+		if err1 != nil || err2 != nil || length == 0 {
+			return fetchItem{}, syntaxError("invalid partial")
+		}
+		item.partial = true
+		item.offset, item.length = int(offset), int(length)
+		item.label += fmt.Sprintf("<%v>", offset)
+	}
+
+	return item, nil
+}
+
+func (r *session) handleFetch(req *request) error {
+	set, err := req.args.seqSet()
+	if err != nil {
+		return err
+	}
+	if err := req.args.space(); err != nil {
+		return err
+	}
+	items, err := parseFetchItems(req.args)
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	// UID FETCH always returns UIDs.
+	if req.uid {
+		items = append([]fetchItem{{name: "UID", label: "UID"}}, items...)
+	}
+	needRaw, setSeen := false, false
+	for _, v := range items {
+		needRaw = needRaw || v.raw()
+		setSeen = setSeen || v.seen()
+	}
+	if r.mailbox.readOnly {
+		setSeen = false
+	}
+
+	mb := r.mailbox
+	for _, seq := range mb.seqNumbers(set, req.uid) {
+		m := mb.message(seq)
+		if m.expunged {
+			continue
+		}
+
+		var raw []byte
+		markSeen := setSeen && !m.seen
+		if needRaw || markSeen {
+			err := r.server.query(func(tx database.Transaction) error {
+				em := r.config.Storage.NewEmailManager(tx, r.credential, mb.folder.ID)
+				if needRaw {
+					var err error
+					if raw, err = em.GetRawEmail(m.uid, database.LockNone); err != nil {
+						return err
+					}
+				}
+				if markSeen {
+					return em.UpdateEmail(m.uid, true)
+				}
+				return nil
+			})
+			if err != nil {
+				// Removed by another session.
+				if isNotFound(err) {
+					continue
+				}
+				return err
+			}
+			raw = normalizeCRLF(raw)
+		}
+		if markSeen {
+			m.seen = true
+		}
+
+		values := r.fetch(m, items, raw)
+		if markSeen && !hasItem(items, "FLAGS") {
+			values = append(values, "FLAGS "+m.flagList())
+		}
+		r.write("* %v FETCH (%v)\r\n", seq, strings.Join(values, " "))
+	}
+	r.write("%v OK %v completed\r\n", req.tag, commandName(req))
+
+	return nil
+}
+
+func hasItem(items []fetchItem, name string) bool {
+	for _, v := range items {
+		if v.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func commandName(req *request) string {
+	if req.uid {
+		return "UID " + req.name
+	}
+	return req.name
+}
+
+func (r *session) fetch(m *message, items []fetchItem, raw []byte) []string {
+	var msg *part
+	if raw != nil {
+		msg = parseMessage(raw)
+	}
+
+	values := []string{}
+	done := map[string]bool{}
+	for _, v := range items {
+		// Skip duplicated items such as UID of UID FETCH.
+		if done[v.label] {
+			continue
+		}
+		done[v.label] = true
+
+		var value string
+		switch v.name {
+		case "FLAGS":
+			value = m.flagList()
+		case "UID":
+			value = strconv.FormatUint(m.uid, 10)
+		case "INTERNALDATE":
+			value = `"` + m.date.Format("02-Jan-2006 15:04:05 -0700") + `"`
+		case "RFC822.SIZE":
+			value = strconv.Itoa(len(raw))
+		case "ENVELOPE":
+			value = msg.envelope()
+		case "BODY":
+			value = msg.bodyStructure(false)
+		case "BODYSTRUCTURE":
+			value = msg.bodyStructure(true)
+		case "RFC822":
+			value = literal(string(raw))
+		case "RFC822.HEADER":
+			value = literal(string(msg.header))
+		case "RFC822.TEXT":
+			value = literal(string(msg.body))
+		case "BODY[]":
+			data := msg.extract(v.section, raw)
+			if data == nil {
+				value = "NIL"
+				break
+			}
+			if v.partial {
+				if v.offset >= len(data) {
+					data = nil
+				} else {
+					data = data[v.offset:]
+				}
+				if len(data) > v.length {
+					data = data[:v.length]
+				}
+			}
+			value = literal(string(data))
+		}
+		values = append(values, v.label+" "+value)
+	}
+
+	return values
+}
+
+func (r *session) handleStore(req *request) error {
+	set, err := req.args.seqSet()
+	if err != nil {
+		return err
+	}
+	if err := req.args.space(); err != nil {
+		return err
+	}
+	item, err := req.args.atom()
+	if err != nil {
+		return err
+	}
+	if err := req.args.space(); err != nil {
+		return err
+	}
+	flags, err := req.args.flags()
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+
+	item = strings.ToUpper(item)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		return syntaxError(fmt.Sprintf("invalid store item: %v", item))
+	}
+	if r.mailbox.readOnly {
+		r.write("%v NO [READ-ONLY] Mailbox is read-only\r\n", req.tag)
+		return nil
+	}
+	// Keywords and \Recent are ignored because they cannot be stored.
+	values := map[string]bool{}
+	for _, v := range flags {
+		for _, f := range systemFlags {
+			if strings.EqualFold(v, f) {
+				values[f] = true
+			}
+		}
+	}
+
+	mb := r.mailbox
+	seqs := []int{}
+	for _, seq := range mb.seqNumbers(set, req.uid) {
+		if !mb.message(seq).expunged {
+			seqs = append(seqs, seq)
+		}
+	}
+	// The \Seen flags are stored in the backend storage.
+	seen := map[uint64]bool{}
+	for _, seq := range seqs {
+		m := mb.message(seq)
+		v := m.seen
+		switch {
+		case item == "FLAGS":
+			v = values[`\Seen`]
+		case values[`\Seen`]:
+			v = item == "+FLAGS"
+		}
+		if v != m.seen {
+			seen[m.uid] = v
+		}
+	}
+	if len(seen) > 0 {
+		err := r.server.query(func(tx database.Transaction) error {
+			em := r.config.Storage.NewEmailManager(tx, r.credential, mb.folder.ID)
+			for uid, v := range seen {
+				if err := em.UpdateEmail(uid, v); err != nil && !isNotFound(err) {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, seq := range seqs {
+		m := mb.message(seq)
+		if v, ok := seen[m.uid]; ok {
+			m.seen = v
+		}
+		if m.flags == nil {
+			m.flags = make(map[string]bool)
+		}
+		for _, f := range systemFlags {
+			if f == `\Seen` {
+				continue
+			}
+			switch {
+			case item == "FLAGS":
+				m.flags[f] = values[f]
+			case values[f]:
+				m.flags[f] = item == "+FLAGS"
+			}
+		}
+		if !silent {
+			if req.uid {
+				r.write("* %v FETCH (UID %v FLAGS %v)\r\n", seq, m.uid, m.flagList())
+			} else {
+				r.write("* %v FETCH (FLAGS %v)\r\n", seq, m.flagList())
+			}
+		}
+	}
+	r.write("%v OK %v completed\r\n", req.tag, commandName(req))
+
+	return nil
+}
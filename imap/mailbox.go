@@ -0,0 +1,1011 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/superkkt/logger"
+)
+
+// delimiter separates the folder names of a mailbox name.
+const delimiter = "/"
+
+// Flags of messages. Only \Seen is stored in the backend storage.
+var systemFlags = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+
+type message struct {
+	uid  uint64
+	seen bool
+	date time.Time
+	// flags are the flags other than \Seen, which are kept in this session only.
+	flags map[string]bool
+	// expunged is true if the message has been removed, but the client has not
+	// been told yet.
+	expunged bool
+}
+
+func (r *message) flagList() string {
+	flags := []string{}
+	for _, v := range systemFlags {
+		if (v == `\Seen` && r.seen) || r.flags[v] {
+			flags = append(flags, v)
+		}
+	}
+
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+// mailbox is the state of a selected mailbox.
+type mailbox struct {
+	name        string
+	folder      backend.Folder
+	readOnly    bool
+	uidValidity uint32
+	uidNext     uint64
+	// uids are the UIDs of the messages in the order of their sequence numbers.
+	uids     []uint64
+	messages map[uint64]*message
+	// lastHistory is the ID of the last email history applied to the mailbox.
+	lastHistory uint64
+}
+
+// seqNumbers returns the sequence numbers of the messages in set.
+func (r *mailbox) seqNumbers(set seqSet, uid bool) []int {
+	result := []int{}
+	if !uid {
+		for i := range r.uids {
+			if set.contains(uint64(i+1), uint64(len(r.uids))) {
+				result = append(result, i+1)
+			}
+		}
+		return result
+	}
+
+	max := uint64(0)
+	for _, v := range r.uids {
+		if v > max {
+			max = v
+		}
+	}
+	for i, v := range r.uids {
+		if set.contains(v, max) {
+			result = append(result, i+1)
+		}
+	}
+
+	return result
+}
+
+func (r *mailbox) message(seq int) *message {
+	return r.messages[r.uids[seq-1]]
+}
+
+// canonicalName returns name whose INBOX is in upper case because INBOX is
+// case-insensitive.
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	if len(name) > 6 && strings.EqualFold(name[:6], "INBOX"+delimiter) {
+		return "INBOX" + name[5:]
+	}
+
+	return name
+}
+
+func splitName(name string) []string {
+	return strings.Split(name, delimiter)
+}
+
+// folderTree maps folders to mailbox names.
+type folderTree struct {
+	folders  map[uint64]backend.Folder
+	children map[uint64]int
+	inbox    uint64
+}
+
+func newFolderTree(folders []backend.Folder) *folderTree {
+	r := &folderTree{
+		folders:  make(map[uint64]backend.Folder),
+		children: make(map[uint64]int),
+	}
+	for _, v := range folders {
+		r.folders[v.ID] = v
+		r.children[v.ParentID]++
+		if v.Type == backend.EmailInbox && (r.inbox == 0 || v.ID < r.inbox) {
+			r.inbox = v.ID
+		}
+	}
+
+	return r
+}
+
+// name returns the mailbox name of a folder. ok is false if the folder cannot
+// be represented as a mailbox name.
+func (r *folderTree) name(id uint64) (name string, ok bool) {
+	path := []string{}
+	for id != 0 {
+		// Broken hierarchy?
+		if len(path) > len(r.folders) {
+			return "", false
+		}
+		f, ok := r.folders[id]
+		if !ok {
+			return "", false
+		}
+		if id == r.inbox {
+			path = append(path, "INBOX")
+			break
+		}
+		if len(f.Name) == 0 || strings.Contains(f.Name, delimiter) {
+			return "", false
+		}
+		// The name is reserved for the Inbox.
+		if f.ParentID == 0 && strings.EqualFold(f.Name, "INBOX") {
+			return "", false
+		}
+		path = append(path, f.Name)
+		id = f.ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+
+	return strings.Join(path, delimiter), true
+}
+
+func (r *folderTree) attributes(f backend.Folder) string {
+	attrs := []string{`\HasNoChildren`}
+	if r.children[f.ID] > 0 {
+		attrs[0] = `\HasChildren`
+	}
+	// RFC 6154 special-use attributes.
+	switch f.Type {
+	case backend.EmailDraft:
+		attrs = append(attrs, `\Drafts`)
+	case backend.EmailSent:
+		attrs = append(attrs, `\Sent`)
+	case backend.EmailTrash:
+		attrs = append(attrs, `\Trash`)
+	case backend.EmailJunk:
+		attrs = append(attrs, `\Junk`)
+	}
+
+	return "(" + strings.Join(attrs, " ") + ")"
+}
+
+// compilePattern returns a regular expression of a LIST pattern, where *
+// matches any characters and % matches any characters except the delimiter.
+func compilePattern(pattern string) *regexp.Regexp {
+	var buf bytes.Buffer
+	buf.WriteByte('^')
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			buf.WriteString(".*")
+		case '%':
+			buf.WriteString("[^" + regexp.QuoteMeta(delimiter) + "]*")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteByte('$')
+
+	return regexp.MustCompile(buf.String())
+}
+
+func (r *session) handleList(req *request) error {
+	reference, err := req.args.astring()
+	if err != nil {
+		return err
+	}
+	if err := req.args.space(); err != nil {
+		return err
+	}
+	pattern, err := req.args.astring()
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	if reference, err = decodeMailbox(reference); err != nil {
+		return syntaxError(err.Error())
+	}
+	if pattern, err = decodeMailbox(pattern); err != nil {
+		return syntaxError(err.Error())
+	}
+	// An empty pattern asks the hierarchy delimiter.
+	if len(pattern) == 0 {
+		r.write("* %v (\\Noselect) %v \"\"\r\n", req.name, quote(delimiter))
+		r.write("%v OK %v completed\r\n", req.tag, req.name)
+		return nil
+	}
+
+	var folders []backend.Folder
+	err = r.server.query(func(tx database.Transaction) error {
+		var err error
+		folders, err = r.config.Storage.NewFolderManager(tx, r.credential).GetFolders(database.LockNone)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	tree := newFolderTree(folders)
+	re := compilePattern(canonicalName(reference + pattern))
+	type entry struct {
+		name  string
+		attrs string
+	}
+	entries := []entry{}
+	for _, v := range folders {
+		name, ok := tree.name(v.ID)
+		if !ok || !re.MatchString(name) {
+			continue
+		}
+		entries = append(entries, entry{name, tree.attributes(v)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		// INBOX comes first.
+		if (entries[i].name == "INBOX") != (entries[j].name == "INBOX") {
+			return entries[i].name == "INBOX"
+		}
+		return entries[i].name < entries[j].name
+	})
+	for _, v := range entries {
+		r.write("* %v %v %v %v\r\n", req.name, v.attrs, quote(delimiter), quote(encodeMailbox(v.name)))
+	}
+	r.write("%v OK %v completed\r\n", req.tag, req.name)
+
+	return nil
+}
+
+// getFolder returns the folder of a mailbox name. ok is false if there is no
+// such folder.
+func (r *session) getFolder(fm backend.FolderManager, name string, lock database.LockMode) (folder backend.Folder, ok bool, err error) {
+	folder, err = fm.GetFolderByPath(splitName(name), lock)
+	if err != nil {
+		if isNotFound(err) {
+			return backend.Folder{}, false, nil
+		}
+		return backend.Folder{}, false, err
+	}
+
+	return folder, true, nil
+}
+
+// validName returns whether name can be a name of a new mailbox.
+func validName(name string) bool {
+	if name == "INBOX" {
+		return false
+	}
+	for _, v := range splitName(name) {
+		if len(v) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// createPath creates the folders on path that do not exist, and returns the
+// ID of the last folder.
+func (r *session) createPath(fm backend.FolderManager, path []string) (folderID uint64, err error) {
+	for i, v := range path {
+		folder, ok, err := r.getFolder(fm, strings.Join(path[:i+1], delimiter), database.LockRead)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			folderID = folder.ID
+			continue
+		}
+		if folderID, err = fm.AddFolder(folderID, v, backend.EmailFolder); err != nil {
+			return 0, err
+		}
+	}
+
+	return folderID, nil
+}
+
+func (r *session) handleCreate(req *request) error {
+	name, err := req.args.mailbox()
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	// A trailing delimiter means that the client intends to create children.
+	name = strings.TrimSuffix(name, delimiter)
+	if !validName(name) {
+		r.write("%v NO [CANNOT] Invalid mailbox name\r\n", req.tag)
+		return nil
+	}
+
+	exists := false
+	err = r.server.query(func(tx database.Transaction) error {
+		fm := r.config.Storage.NewFolderManager(tx, r.credential)
+		_, ok, err := r.getFolder(fm, name, database.LockRead)
+		if err != nil {
+			return err
+		}
+		if ok {
+			exists = true
+			return nil
+		}
+		_, err = r.createPath(fm, splitName(name))
+		return err
+	})
+	if exists || isDuplicated(err) {
+		r.write("%v NO [ALREADYEXISTS] Mailbox already exists\r\n", req.tag)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.write("%v OK CREATE completed\r\n", req.tag)
+
+	return nil
+}
+
+func (r *session) handleDelete(req *request) error {
+	name, err := req.args.mailbox()
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+
+	result := ""
+	err = r.server.query(func(tx database.Transaction) error {
+		fm := r.config.Storage.NewFolderManager(tx, r.credential)
+		folder, ok, err := r.getFolder(fm, name, database.LockWrite)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			result = "NO [NONEXISTENT] Mailbox does not exist"
+			return nil
+		}
+		if folder.Type != backend.EmailFolder {
+			result = "NO [CANNOT] Special mailboxes cannot be deleted"
+			return nil
+		}
+		folders, err := fm.GetFolders(database.LockRead)
+		if err != nil {
+			return err
+		}
+		for _, v := range folders {
+			if v.ParentID == folder.ID {
+				result = "NO [INUSE] Mailbox has children"
+				return nil
+			}
+		}
+		if err := fm.DeleteFolder(folder.ID); err != nil {
+			return err
+		}
+		if r.mailbox != nil && r.mailbox.folder.ID == folder.ID {
+			r.mailbox = nil
+		}
+		result = "OK DELETE completed"
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.write("%v %v\r\n", req.tag, result)
+
+	return nil
+}
+
+func (r *session) handleRename(req *request) error {
+	from, err := req.args.mailbox()
+	if err != nil {
+		return err
+	}
+	if err := req.args.space(); err != nil {
+		return err
+	}
+	to, err := req.args.mailbox()
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	to = strings.TrimSuffix(to, delimiter)
+	if from == "INBOX" {
+		r.write("%v NO [CANNOT] Renaming INBOX is not supported\r\n", req.tag)
+		return nil
+	}
+	if !validName(to) {
+		r.write("%v NO [CANNOT] Invalid mailbox name\r\n", req.tag)
+		return nil
+	}
+
+	result := ""
+	err = r.server.query(func(tx database.Transaction) error {
+		fm := r.config.Storage.NewFolderManager(tx, r.credential)
+		folder, ok, err := r.getFolder(fm, from, database.LockWrite)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			result = "NO [NONEXISTENT] Mailbox does not exist"
+			return nil
+		}
+		if folder.Type != backend.EmailFolder {
+			result = "NO [CANNOT] Special mailboxes cannot be renamed"
+			return nil
+		}
+		if _, ok, err := r.getFolder(fm, to, database.LockRead); err != nil {
+			return err
+		} else if ok {
+			result = "NO [ALREADYEXISTS] Mailbox already exists"
+			return nil
+		}
+		// A mailbox cannot be moved under itself.
+		if strings.HasPrefix(to+delimiter, from+delimiter) {
+			result = "NO [CANNOT] Mailbox cannot be moved under itself"
+			return nil
+		}
+
+		path := splitName(to)
+		parentID, err := r.createPath(fm, path[:len(path)-1])
+		if err != nil {
+			return err
+		}
+		if err := fm.UpdateFolder(folder.ID, parentID, path[len(path)-1]); err != nil {
+			return err
+		}
+		result = "OK RENAME completed"
+		return nil
+	})
+	if isDuplicated(err) {
+		result, err = "NO [ALREADYEXISTS] Mailbox already exists", nil
+	}
+	if err != nil {
+		return err
+	}
+	r.write("%v %v\r\n", req.tag, result)
+
+	return nil
+}
+
+// handleSubscribe accepts the SUBSCRIBE and UNSUBSCRIBE commands, but the
+// subscriptions are not stored. LSUB returns all mailboxes as LIST does.
+func (r *session) handleSubscribe(req *request) error {
+	if _, err := req.args.mailbox(); err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	r.write("%v OK %v completed\r\n", req.tag, req.name)
+
+	return nil
+}
+
+// uidValidity returns the UIDVALIDITY of a folder, which is the ID of the last
+// history of the folder. So, it changes whenever the folder is renamed, or
+// deleted and created again.
+func (r *session) uidValidity(fm backend.FolderManager, folder backend.Folder) (uint32, error) {
+	id := folder.ID
+	history, err := fm.GetLastFolderHistory(folder.ID, database.LockNone)
+	if err == nil {
+		id = history.ID()
+	} else if !isNotFound(err) {
+		return 0, err
+	}
+	// UIDVALIDITY is a non-zero 32-bit number.
+	if err := checkUID(id); err != nil {
+		return 0, err
+	}
+	if id == 0 {
+		return 1, nil
+	}
+
+	return uint32(id), nil
+}
+
+// uidOverflowError is an ID that cannot be used as a UID or UIDVALIDITY.
+type uidOverflowError uint64
+
+func (r uidOverflowError) Error() string {
+	return fmt.Sprintf("ID %v exceeds the 32-bit range of UIDs", uint64(r))
+}
+
+// checkUID returns an error if id, which is an email ID used as a UID or a
+// history ID used as a UIDVALIDITY, does not fit in 32 bits. Clients would
+// see wrapped UIDs that point to other messages otherwise.
+func checkUID(id uint64) error {
+	if id > math.MaxUint32 {
+		return uidOverflowError(id)
+	}
+
+	return nil
+}
+
+// loadMailbox returns the current state of a folder.
+func (r *session) loadMailbox(tx database.Transaction, name string, folder backend.Folder) (*mailbox, error) {
+	fm := r.config.Storage.NewFolderManager(tx, r.credential)
+	em := r.config.Storage.NewEmailManager(tx, r.credential, folder.ID)
+	emails, err := em.GetEmails(0, 0, false, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	mb := &mailbox{
+		name:     name,
+		folder:   folder,
+		uidNext:  1,
+		messages: make(map[uint64]*message),
+	}
+	for _, v := range emails {
+		if err := checkUID(v.ID); err != nil {
+			return nil, err
+		}
+		mb.uids = append(mb.uids, v.ID)
+		mb.messages[v.ID] = &message{uid: v.ID, seen: v.Seen, date: v.Date}
+		if v.ID >= mb.uidNext {
+			mb.uidNext = v.ID + 1
+		}
+	}
+
+	histories, err := em.GetEmailHistories(0, 1, true, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	if len(histories) > 0 {
+		mb.lastHistory = histories[0].ID()
+		// UIDNEXT should not decrease even if the last message has been removed.
+		if e, err := histories[0].Value(); err == nil && e.ID >= mb.uidNext {
+			if err := checkUID(e.ID); err != nil {
+				return nil, err
+			}
+			mb.uidNext = e.ID + 1
+		}
+	}
+	if mb.uidValidity, err = r.uidValidity(fm, folder); err != nil {
+		return nil, err
+	}
+
+	return mb, nil
+}
+
+func (r *session) handleStatus(req *request) error {
+	name, err := req.args.mailbox()
+	if err != nil {
+		return err
+	}
+	if err := req.args.space(); err != nil {
+		return err
+	}
+	items, err := req.args.list()
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+
+	var mb *mailbox
+	err = r.server.query(func(tx database.Transaction) error {
+		folder, ok, err := r.getFolder(r.config.Storage.NewFolderManager(tx, r.credential), name, database.LockNone)
+		if err != nil || !ok {
+			return err
+		}
+		mb, err = r.loadMailbox(tx, name, folder)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if mb == nil {
+		r.write("%v NO [NONEXISTENT] Mailbox does not exist\r\n", req.tag)
+		return nil
+	}
+
+	values := []string{}
+	for _, v := range items {
+		item, ok := v.(atom)
+		if !ok {
+			return syntaxError("invalid status item")
+		}
+		switch strings.ToUpper(string(item)) {
+		case "MESSAGES":
+			values = append(values, fmt.Sprintf("MESSAGES %v", len(mb.uids)))
+		case "RECENT":
+			values = append(values, "RECENT 0")
+		case "UIDNEXT":
+			values = append(values, fmt.Sprintf("UIDNEXT %v", mb.uidNext))
+		case "UIDVALIDITY":
+			values = append(values, fmt.Sprintf("UIDVALIDITY %v", mb.uidValidity))
+		case "UNSEEN":
+			n := 0
+			for _, m := range mb.messages {
+				if !m.seen {
+					n++
+				}
+			}
+			values = append(values, fmt.Sprintf("UNSEEN %v", n))
+		default:
+			return syntaxError(fmt.Sprintf("unknown status item: %v", item))
+		}
+	}
+	r.write("* STATUS %v (%v)\r\n", quote(encodeMailbox(name)), strings.Join(values, " "))
+	r.write("%v OK STATUS completed\r\n", req.tag)
+
+	return nil
+}
+
+func (r *session) handleSelect(req *request) error {
+	name, err := req.args.mailbox()
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	// The current mailbox is closed without expunging even if this fails.
+	r.mailbox = nil
+
+	var mb *mailbox
+	err = r.server.query(func(tx database.Transaction) error {
+		folder, ok, err := r.getFolder(r.config.Storage.NewFolderManager(tx, r.credential), name, database.LockNone)
+		if err != nil || !ok {
+			return err
+		}
+		mb, err = r.loadMailbox(tx, name, folder)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if mb == nil {
+		r.write("%v NO [NONEXISTENT] Mailbox does not exist\r\n", req.tag)
+		return nil
+	}
+	mb.readOnly = req.name == "EXAMINE"
+	r.mailbox = mb
+
+	r.write("* FLAGS (%v)\r\n", strings.Join(systemFlags, " "))
+	if mb.readOnly {
+		r.write("* OK [PERMANENTFLAGS ()] Read-only mailbox\r\n")
+	} else {
+		r.write("* OK [PERMANENTFLAGS (\\Seen)] Other flags are kept in this session only\r\n")
+	}
+	r.write("* %v EXISTS\r\n", len(mb.uids))
+	r.write("* 0 RECENT\r\n")
+	for i, v := range mb.uids {
+		if !mb.messages[v].seen {
+			r.write("* OK [UNSEEN %v] First unseen message\r\n", i+1)
+			break
+		}
+	}
+	r.write("* OK [UIDVALIDITY %v] UIDs valid\r\n", mb.uidValidity)
+	r.write("* OK [UIDNEXT %v] Predicted next UID\r\n", mb.uidNext)
+	if mb.readOnly {
+		r.write("%v OK [READ-ONLY] EXAMINE completed\r\n", req.tag)
+	} else {
+		r.write("%v OK [READ-WRITE] SELECT completed\r\n", req.tag)
+	}
+
+	return nil
+}
+
+func (r *session) handleAppend(req *request) error {
+	name, err := req.args.mailbox()
+	if err != nil {
+		return err
+	}
+	if err := req.args.space(); err != nil {
+		return err
+	}
+	flags := []string{}
+	if req.args.peek() == '(' {
+		if flags, err = req.args.flags(); err != nil {
+			return err
+		}
+		if err := req.args.space(); err != nil {
+			return err
+		}
+	}
+	// The internal date is ignored because the backend storage sets it.
+	if req.args.peek() == '"' {
+		if _, err := req.args.quoted(); err != nil {
+			return err
+		}
+		if err := req.args.space(); err != nil {
+			return err
+		}
+	}
+	msg, err := req.args.string(r.config.MaxSize)
+	if err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	raw := normalizeCRLF([]byte(msg))
+	if _, err := mail.ReadMessage(bytes.NewReader(raw)); err != nil {
+		r.write("%v NO Malformed message\r\n", req.tag)
+		return nil
+	}
+
+	var uidValidity uint32
+	var email *backend.Email
+	err = r.server.query(func(tx database.Transaction) error {
+		fm := r.config.Storage.NewFolderManager(tx, r.credential)
+		folder, ok, err := r.getFolder(fm, name, database.LockRead)
+		if err != nil || !ok {
+			return err
+		}
+		em := r.config.Storage.NewEmailManager(tx, r.credential, folder.ID)
+		if email, err = em.AddEmail(raw); err != nil {
+			return err
+		}
+		// Roll back the message that cannot have a UID.
+		if err := checkUID(email.ID); err != nil {
+			return err
+		}
+		if hasFlag(flags, `\Seen`) {
+			if err := em.UpdateEmail(email.ID, true); err != nil {
+				return err
+			}
+		}
+		uidValidity, err = r.uidValidity(fm, folder)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if email == nil {
+		r.write("%v NO [TRYCREATE] Mailbox does not exist\r\n", req.tag)
+		return nil
+	}
+	r.write("%v OK [APPENDUID %v %v] APPEND completed\r\n", req.tag, uidValidity, email.ID)
+
+	return nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, v := range flags {
+		if strings.EqualFold(v, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// update reports the changes of the selected mailbox made by other sessions
+// and protocols, which are read from the email histories. Removed messages are
+// reported only if expunge is true because EXPUNGE responses are not allowed
+// while the client is using sequence numbers.
+func (r *session) update(expunge bool) error {
+	mb := r.mailbox
+	var histories []backend.EmailHistory
+	err := r.server.query(func(tx database.Transaction) error {
+		var err error
+		histories, err = r.config.Storage.NewEmailManager(tx, r.credential, mb.folder.ID).GetEmailHistories(mb.lastHistory+1, 0, false, database.LockNone)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	added := []uint64{}
+	changed := map[uint64]bool{}
+	for _, h := range histories {
+		mb.lastHistory = h.ID()
+		e, err := h.Value()
+		if err != nil {
+			return err
+		}
+		m, ok := mb.messages[e.ID]
+		switch h.Operation() {
+		case backend.EmailAdd:
+			if ok {
+				// Moved out and back in.
+				m.expunged = false
+				continue
+			}
+			if err := checkUID(e.ID); err != nil {
+				return err
+			}
+			mb.messages[e.ID] = &message{uid: e.ID, seen: e.Seen, date: e.Date}
+			added = append(added, e.ID)
+		case backend.EmailDelete:
+			if !ok {
+				continue
+			}
+			// Forget the message that has not been reported yet.
+			if i := indexOf(added, e.ID); i >= 0 {
+				added = append(added[:i], added[i+1:]...)
+				delete(mb.messages, e.ID)
+				continue
+			}
+			m.expunged = true
+		case backend.EmailUpdateSeen:
+			if !ok || m.seen == e.Seen {
+				continue
+			}
+			m.seen = e.Seen
+			// New messages are fetched by the client anyway.
+			if indexOf(added, e.ID) < 0 {
+				changed[e.ID] = true
+			}
+		}
+	}
+
+	if expunge {
+		r.reportExpunged()
+	}
+	if len(added) > 0 {
+		// Concurrent deliveries can commit their histories in the opposite
+		// order to their email IDs, but UIDs should ascend with sequence numbers.
+		sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+		// A UID below UIDNEXT that the client has already seen would be missed
+		// by clients that only fetch UIDs from the last UIDNEXT.
+		late := added[0] < mb.uidNext
+		mb.uids = append(mb.uids, added...)
+		for _, v := range added {
+			if v >= mb.uidNext {
+				mb.uidNext = v + 1
+			}
+		}
+		r.write("* %v EXISTS\r\n", len(mb.uids))
+		if late {
+			logger.Warning(fmt.Sprintf("imap: UID %v is below the reported UIDNEXT: user=%v, mailbox=%v", added[0], r.userID(), mb.name))
+			r.write("* OK [UIDNEXT %v] Predicted next UID\r\n", mb.uidNext)
+		}
+	}
+	for i, v := range mb.uids {
+		m := mb.messages[v]
+		if changed[v] && !m.expunged {
+			r.write("* %v FETCH (FLAGS %v)\r\n", i+1, m.flagList())
+		}
+	}
+
+	return nil
+}
+
+func indexOf(list []uint64, v uint64) int {
+	for i := range list {
+		if list[i] == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// reportExpunged sends EXPUNGE responses of the removed messages, and forgets
+// them. The responses are sent in descending order so that the sequence
+// numbers of the other removed messages do not change.
+func (r *session) reportExpunged() {
+	mb := r.mailbox
+	for i := len(mb.uids) - 1; i >= 0; i-- {
+		uid := mb.uids[i]
+		if !mb.messages[uid].expunged {
+			continue
+		}
+		r.write("* %v EXPUNGE\r\n", i+1)
+		delete(mb.messages, uid)
+		mb.uids = append(mb.uids[:i], mb.uids[i+1:]...)
+	}
+}
+
+// expunge removes the messages that have the \Deleted flag. Only the messages
+// in set are removed if set is not nil.
+func (r *session) expunge(set seqSet) error {
+	mb := r.mailbox
+	seqs := []int{}
+	if set != nil {
+		seqs = mb.seqNumbers(set, true)
+	} else {
+		for i := range mb.uids {
+			seqs = append(seqs, i+1)
+		}
+	}
+	uids := []uint64{}
+	for _, v := range seqs {
+		m := mb.message(v)
+		if m.flags[`\Deleted`] && !m.expunged {
+			uids = append(uids, m.uid)
+		}
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+
+	err := r.server.query(func(tx database.Transaction) error {
+		em := r.config.Storage.NewEmailManager(tx, r.credential, mb.folder.ID)
+		for _, v := range uids {
+			// The message may have been removed by another session.
+			if err := em.DeleteEmail(v); err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, v := range uids {
+		mb.messages[v].expunged = true
+	}
+
+	return nil
+}
+
+func (r *session) handleExpunge(req *request) error {
+	var set seqSet
+	if req.uid {
+		var err error
+		if set, err = req.args.seqSet(); err != nil {
+			return err
+		}
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	if r.mailbox.readOnly {
+		r.write("%v NO [READ-ONLY] Mailbox is read-only\r\n", req.tag)
+		return nil
+	}
+	if err := r.expunge(set); err != nil {
+		return err
+	}
+	r.reportExpunged()
+	r.write("%v OK EXPUNGE completed\r\n", req.tag)
+
+	return nil
+}
+
+// handleClose implements the CLOSE and UNSELECT commands. CLOSE silently
+// removes the messages that have the \Deleted flag.
+func (r *session) handleClose(req *request) error {
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	if req.name == "CLOSE" && !r.mailbox.readOnly {
+		if err := r.expunge(nil); err != nil {
+			return err
+		}
+	}
+	r.mailbox = nil
+	r.write("%v OK %v completed\r\n", req.tag, req.name)
+
+	return nil
+}
@@ -0,0 +1,503 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Maximum depth of nested MIME parts to parse.
+const maxPartDepth = 16
+
+// part is a MIME entity of a message. The message itself is the root part.
+type part struct {
+	// header is the raw header including the blank line that ends it.
+	header    []byte
+	body      []byte
+	fields    textproto.MIMEHeader
+	mediaType string
+	params    map[string]string
+	// children are the body parts of a multipart entity.
+	children []*part
+	// message is the encapsulated message of a message/rfc822 entity.
+	message *part
+}
+
+func parseMessage(raw []byte) *part {
+	return parsePart(raw, "text/plain", 0)
+}
+
+func parsePart(data []byte, defaultType string, depth int) *part {
+	r := &part{}
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		r.header, r.body = data[:2], data[2:]
+	} else if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		r.header, r.body = data[:i+4], data[i+4:]
+	} else {
+		r.header = data
+	}
+	// ReadMIMEHeader returns the fields read before an error.
+	r.fields, _ = textproto.NewReader(bufio.NewReader(bytes.NewReader(r.header))).ReadMIMEHeader()
+	if r.fields == nil {
+		r.fields = textproto.MIMEHeader{}
+	}
+
+	r.mediaType, r.params = defaultType, map[string]string{}
+	if v := r.fields.Get("Content-Type"); len(v) > 0 {
+		if t, params, err := mime.ParseMediaType(v); err == nil {
+			r.mediaType, r.params = t, params
+		}
+	}
+	if r.mediaType == "text/plain" && len(r.params["charset"]) == 0 {
+		r.params["charset"] = "us-ascii"
+	}
+	if depth >= maxPartDepth {
+		return r
+	}
+
+	switch {
+	case r.isMultipart():
+		childType := "text/plain"
+		if r.mediaType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+		for _, v := range splitMultipart(r.body, r.params["boundary"]) {
+			r.children = append(r.children, parsePart(v, childType, depth+1))
+		}
+	case r.mediaType == "message/rfc822":
+		r.message = parsePart(r.body, "text/plain", depth+1)
+	}
+
+	return r
+}
+
+func (r *part) isMultipart() bool {
+	return strings.HasPrefix(r.mediaType, "multipart/") && len(r.params["boundary"]) > 0
+}
+
+// splitMultipart returns the body parts of a multipart body.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := []byte("--" + boundary)
+	result := [][]byte{}
+	start := -1
+	for i := 0; i < len(body); {
+		next := len(body)
+		if n := bytes.IndexByte(body[i:], '\n'); n >= 0 {
+			next = i + n + 1
+		}
+		line := body[i:next]
+		i = next
+		if !bytes.HasPrefix(line, delimiter) {
+			continue
+		}
+		rest := bytes.TrimRight(line[len(delimiter):], " \t\r\n")
+		last := bytes.Equal(rest, []byte("--"))
+		if len(rest) > 0 && !last {
+			continue
+		}
+
+		if start >= 0 {
+			// The CRLF preceding the delimiter belongs to the delimiter.
+			end := next - len(line)
+			end -= len(crlfSuffix(body[start:end]))
+			result = append(result, body[start:end])
+		}
+		if last {
+			return result
+		}
+		start = next
+	}
+	// The close delimiter is missing.
+	if start >= 0 {
+		result = append(result, body[start:])
+	}
+
+	return result
+}
+
+func crlfSuffix(b []byte) []byte {
+	if bytes.HasSuffix(b, []byte("\r\n")) {
+		return b[len(b)-2:]
+	}
+	if bytes.HasSuffix(b, []byte("\n")) {
+		return b[len(b)-1:]
+	}
+	return nil
+}
+
+// sectionSpec is a section of BODY[section] of the FETCH command.
+type sectionSpec struct {
+	// parts is the part numbers, e.g., 1.2 is [1, 2].
+	parts []int
+	// specifier is one of "", "HEADER", "HEADER.FIELDS", "HEADER.FIELDS.NOT",
+	// "TEXT", and "MIME".
+	specifier string
+	fields    []string
+}
+
+func parseSection(s string) (sectionSpec, error) {
+	r := sectionSpec{}
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '.')
+		v := s
+		if i >= 0 {
+			v = s[:i]
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			break
+		}
+		if n <= 0 {
+			return r, syntaxError("invalid section part")
+		}
+		r.parts = append(r.parts, n)
+		if i < 0 {
+			s = ""
+		} else {
+			s = s[i+1:]
+		}
+	}
+
+	spec, fields := s, ""
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		spec, fields = s[:i], strings.TrimSpace(s[i+1:])
+	}
+	r.specifier = strings.ToUpper(spec)
+	switch r.specifier {
+	case "":
+	case "HEADER", "TEXT":
+	case "MIME":
+		if len(r.parts) == 0 {
+			return r, syntaxError("MIME requires a part number")
+		}
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		if !strings.HasPrefix(fields, "(") || !strings.HasSuffix(fields, ")") {
+			return r, syntaxError("invalid header field list")
+		}
+		for _, v := range strings.Fields(fields[1 : len(fields)-1]) {
+			r.fields = append(r.fields, strings.Trim(v, "\""))
+		}
+		if len(r.fields) == 0 {
+			return r, syntaxError("empty header field list")
+		}
+		return r, nil
+	default:
+		return r, syntaxError(fmt.Sprintf("invalid section: %v", s))
+	}
+	if len(fields) > 0 {
+		return r, syntaxError("unexpected header field list")
+	}
+
+	return r, nil
+}
+
+// extract returns the data of the section of the message r, or nil if the
+// section does not exist.
+func (r *part) extract(s sectionSpec, raw []byte) []byte {
+	p := r
+	for i, n := range s.parts {
+		// Part numbers after a message/rfc822 part refer to the parts of the
+		// encapsulated message.
+		if i > 0 && p.message != nil {
+			p = p.message
+		}
+		if p.isMultipart() {
+			if n > len(p.children) {
+				return nil
+			}
+			p = p.children[n-1]
+		} else if n != 1 {
+			return nil
+		}
+	}
+
+	switch s.specifier {
+	case "MIME":
+		return p.header
+	case "":
+		if len(s.parts) == 0 {
+			return raw
+		}
+		return p.body
+	}
+	// HEADER and TEXT of a part refer to the encapsulated message.
+	if len(s.parts) > 0 {
+		if p.message == nil {
+			return nil
+		}
+		p = p.message
+	}
+	switch s.specifier {
+	case "TEXT":
+		return p.body
+	case "HEADER":
+		return p.header
+	default:
+		return filterHeader(p.header, s.fields, s.specifier == "HEADER.FIELDS.NOT")
+	}
+}
+
+// filterHeader returns the header fields whose names are in names, or not in
+// names if not is true, followed by a blank line.
+func filterHeader(header []byte, names []string, not bool) []byte {
+	var buf bytes.Buffer
+	match := false
+	for _, line := range splitLines(header) {
+		if len(line) == 0 || line[0] == '\r' || line[0] == '\n' {
+			break
+		}
+		// Continuation lines belong to the previous field.
+		if line[0] != ' ' && line[0] != '\t' {
+			match = false
+			if i := bytes.IndexByte(line, ':'); i > 0 {
+				match = hasField(names, string(bytes.TrimSpace(line[:i]))) != not
+			}
+		}
+		if match {
+			buf.Write(line)
+		}
+	}
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
+
+func hasField(names []string, name string) bool {
+	for _, v := range names {
+		if strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitLines splits b into lines that have their line endings.
+func splitLines(b []byte) [][]byte {
+	result := [][]byte{}
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			result = append(result, b)
+			break
+		}
+		result = append(result, b[:i+1])
+		b = b[i+1:]
+	}
+
+	return result
+}
+
+// envelope returns the ENVELOPE structure of the message r.
+func (r *part) envelope() string {
+	from := r.fields.Get("From")
+	sender, replyTo := r.fields.Get("Sender"), r.fields.Get("Reply-To")
+	// RFC 3501 Section 7.4.2: the sender and reply-to fields default to the from field.
+	if len(sender) == 0 {
+		sender = from
+	}
+	if len(replyTo) == 0 {
+		replyTo = from
+	}
+
+	values := []string{
+		nstring(r.fields.Get("Date")),
+		nstring(r.fields.Get("Subject")),
+		addressList(from),
+		addressList(sender),
+		addressList(replyTo),
+		addressList(r.fields.Get("To")),
+		addressList(r.fields.Get("Cc")),
+		addressList(r.fields.Get("Bcc")),
+		nstring(r.fields.Get("In-Reply-To")),
+		nstring(r.fields.Get("Message-Id")),
+	}
+
+	return "(" + strings.Join(values, " ") + ")"
+}
+
+func addressList(s string) string {
+	if len(s) == 0 {
+		return "NIL"
+	}
+	list, err := mail.ParseAddressList(s)
+	if err != nil || len(list) == 0 {
+		return "NIL"
+	}
+
+	result := []string{}
+	for _, v := range list {
+		mailbox, host := v.Address, ""
+		if i := strings.LastIndexByte(v.Address, '@'); i >= 0 {
+			mailbox, host = v.Address[:i], v.Address[i+1:]
+		}
+		// The parser decodes the encoded words of the name.
+		name := v.Name
+		if !isASCII(name) {
+			name = mime.QEncoding.Encode("utf-8", name)
+		}
+		result = append(result, fmt.Sprintf("(%v NIL %v %v)", nstring(name), nstring(mailbox), nstring(host)))
+	}
+
+	return "(" + strings.Join(result, "") + ")"
+}
+
+// bodyStructure returns the BODYSTRUCTURE of r, or BODY if extended is false.
+func (r *part) bodyStructure(extended bool) string {
+	var buf bytes.Buffer
+	buf.WriteByte('(')
+
+	mediaType, subtype := r.mediaType, ""
+	if i := strings.IndexByte(mediaType, '/'); i >= 0 {
+		mediaType, subtype = mediaType[:i], mediaType[i+1:]
+	}
+	if r.isMultipart() {
+		for _, v := range r.children {
+			buf.WriteString(v.bodyStructure(extended))
+		}
+		if len(r.children) == 0 {
+			// A multipart entity should have at least one part.
+			buf.WriteString(`("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 0 0)`)
+		}
+		buf.WriteString(" " + quote(strings.ToUpper(subtype)))
+		if extended {
+			fmt.Fprintf(&buf, " %v %v NIL NIL", parameters(r.params), r.disposition())
+		}
+		buf.WriteByte(')')
+		return buf.String()
+	}
+
+	encoding := strings.ToUpper(strings.TrimSpace(r.fields.Get("Content-Transfer-Encoding")))
+	if len(encoding) == 0 {
+		encoding = "7BIT"
+	}
+	fmt.Fprintf(&buf, "%v %v %v %v %v %v %v",
+		quote(strings.ToUpper(mediaType)), quote(strings.ToUpper(subtype)), parameters(r.params),
+		nstring(r.fields.Get("Content-Id")), nstring(r.fields.Get("Content-Description")),
+		quote(encoding), len(r.body))
+	switch {
+	case r.message != nil:
+		fmt.Fprintf(&buf, " %v %v %v", r.message.envelope(), r.message.bodyStructure(extended), countLines(r.body))
+	case mediaType == "text":
+		fmt.Fprintf(&buf, " %v", countLines(r.body))
+	}
+	if extended {
+		fmt.Fprintf(&buf, " %v %v %v %v", nstring(r.fields.Get("Content-Md5")), r.disposition(),
+			nstring(r.fields.Get("Content-Language")), nstring(r.fields.Get("Content-Location")))
+	}
+	buf.WriteByte(')')
+
+	return buf.String()
+}
+
+func (r *part) disposition() string {
+	v := r.fields.Get("Content-Disposition")
+	if len(v) == 0 {
+		return "NIL"
+	}
+	t, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return "NIL"
+	}
+
+	return fmt.Sprintf("(%v %v)", quote(strings.ToUpper(t)), parameters(params))
+}
+
+func parameters(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	values := []string{}
+	for _, k := range names {
+		values = append(values, quote(strings.ToUpper(k)), quote(params[k]))
+	}
+
+	return "(" + strings.Join(values, " ") + ")"
+}
+
+func countLines(b []byte) int {
+	n := bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// normalizeCRLF converts bare LFs of msg into CRLFs.
+func normalizeCRLF(msg []byte) []byte {
+	if !bytes.Contains(msg, []byte("\n")) || bytes.Count(msg, []byte("\n")) == bytes.Count(msg, []byte("\r\n")) {
+		return msg
+	}
+
+	var buf bytes.Buffer
+	for i, c := range msg {
+		if c == '\n' && (i == 0 || msg[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(c)
+	}
+
+	return buf.Bytes()
+}
+
+// quote returns s as a quoted string, or as a literal if s cannot be quoted.
+func quote(s string) string {
+	if !isASCII(s) || strings.ContainsAny(s, "\r\n\x00") {
+		return literal(s)
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+
+	return `"` + s + `"`
+}
+
+func nstring(s string) string {
+	if len(s) == 0 {
+		return "NIL"
+	}
+	return quote(s)
+}
+
+func literal(s string) string {
+	return fmt.Sprintf("{%v}\r\n%v", len(s), s)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,454 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum length of a command line except literals.
+	maxLineLength = 64 * 1024
+	// Maximum size of literals other than messages appended by clients.
+	maxLiteralSize = 64 * 1024
+)
+
+var errLineTooLong = errors.New("too long command line")
+
+// syntaxError is an invalid argument of a command, which is replied with BAD.
+type syntaxError string
+
+func (r syntaxError) Error() string {
+	return string(r)
+}
+
+// literalError is a literal rejected before it is read, which is replied with
+// NO because the client has not sent the literal.
+type literalError string
+
+func (r literalError) Error() string {
+	return string(r)
+}
+
+// atom is an atom argument, which is distinguished from a string argument
+// because NIL is an atom but "NIL" is a string.
+type atom string
+
+// parser reads arguments of a command. A command can span multiple lines if
+// it has literals, which are read from the connection on demand.
+type parser struct {
+	reader *bufio.Reader
+	// cont requests the client to send a synchronizing literal.
+	cont func() error
+	line string
+	pos  int
+}
+
+// readLine reads a line without the trailing CRLF.
+func readLine(reader *bufio.Reader) (string, error) {
+	line := []byte{}
+	for {
+		v, err := reader.ReadSlice('\n')
+		if len(line)+len(v) > maxLineLength {
+			return "", errLineTooLong
+		}
+		line = append(line, v...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (r *parser) atEnd() bool {
+	return r.pos >= len(r.line)
+}
+
+func (r *parser) peek() byte {
+	if r.atEnd() {
+		return 0
+	}
+	return r.line[r.pos]
+}
+
+// space consumes a single space between arguments.
+func (r *parser) space() error {
+	if r.peek() != ' ' {
+		return syntaxError("missing argument")
+	}
+	r.pos++
+
+	return nil
+}
+
+// end makes sure that there is no more argument.
+func (r *parser) end() error {
+	if !r.atEnd() {
+		return syntaxError("unexpected argument")
+	}
+	return nil
+}
+
+// discard skips the rest of the command, including non-synchronizing literals
+// that the client sends without waiting for our continuation request.
+func (r *parser) discard() error {
+	for {
+		n, sync, ok := literalSize(r.line)
+		if !ok || sync {
+			return nil
+		}
+		if _, err := io.CopyN(ioutil.Discard, r.reader, n); err != nil {
+			return err
+		}
+		line, err := readLine(r.reader)
+		if err != nil {
+			return err
+		}
+		r.line, r.pos = line, 0
+	}
+}
+
+// literalSize returns the size of the literal at the end of line.
+func literalSize(line string) (size int64, sync bool, ok bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false, false
+	}
+	i := strings.LastIndexByte(line, '{')
+	if i < 0 {
+		return 0, false, false
+	}
+	v := line[i+1 : len(line)-1]
+	sync = true
+	if strings.HasSuffix(v, "+") {
+		v, sync = v[:len(v)-1], false
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, false
+	}
+
+	return size, sync, true
+}
+
+// token reads a sequence of characters up to a space, a parenthesis, or the end
+// of the line. Brackets are read as a part of the token with the characters
+// inside them so that BODY[HEADER.FIELDS (From)] is a token.
+func (r *parser) token() (string, error) {
+	start := r.pos
+	for !r.atEnd() {
+		c := r.line[r.pos]
+		if c == ' ' || c == '(' || c == ')' {
+			break
+		}
+		if c == '[' {
+			i := strings.IndexByte(r.line[r.pos:], ']')
+			if i < 0 {
+				return "", syntaxError("missing ]")
+			}
+			r.pos += i
+		}
+		r.pos++
+	}
+	if r.pos == start {
+		return "", syntaxError("missing argument")
+	}
+
+	return r.line[start:r.pos], nil
+}
+
+func (r *parser) atom() (string, error) {
+	switch r.peek() {
+	case '"', '{':
+		return "", syntaxError("expected an atom")
+	}
+	return r.token()
+}
+
+// string reads a quoted string or a literal.
+func (r *parser) string(limit int64) (string, error) {
+	switch r.peek() {
+	case '"':
+		return r.quoted()
+	case '{':
+		return r.literal(limit)
+	default:
+		return "", syntaxError("expected a string")
+	}
+}
+
+func (r *parser) quoted() (string, error) {
+	r.pos++ // Skip the opening quote.
+	var buf []byte
+	for !r.atEnd() {
+		c := r.line[r.pos]
+		r.pos++
+		switch c {
+		case '"':
+			return string(buf), nil
+		case '\\':
+			if r.atEnd() {
+				return "", syntaxError("invalid quoted string")
+			}
+			c = r.line[r.pos]
+			r.pos++
+		}
+		buf = append(buf, c)
+	}
+
+	return "", syntaxError("missing closing quote")
+}
+
+func (r *parser) literal(limit int64) (string, error) {
+	size, sync, ok := literalSize(r.line[r.pos:])
+	if !ok {
+		return "", syntaxError("invalid literal")
+	}
+	if size > limit {
+		if sync {
+			return "", literalError("Literal too large")
+		}
+		// The client is sending the literal anyway.
+		if _, err := io.CopyN(ioutil.Discard, r.reader, size); err != nil {
+			return "", err
+		}
+		r.line, r.pos = "", 0
+		return "", syntaxError("literal too large")
+	}
+	if sync {
+		if err := r.cont(); err != nil {
+			return "", err
+		}
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		return "", err
+	}
+	line, err := readLine(r.reader)
+	if err != nil {
+		return "", err
+	}
+	r.line, r.pos = line, 0
+
+	return string(buf), nil
+}
+
+// astring reads an atom or a string.
+func (r *parser) astring() (string, error) {
+	switch r.peek() {
+	case '"', '{':
+		return r.string(maxLiteralSize)
+	}
+	return r.atom()
+}
+
+// mailbox reads a mailbox name, which is decoded from modified UTF-7.
+func (r *parser) mailbox() (string, error) {
+	v, err := r.astring()
+	if err != nil {
+		return "", err
+	}
+	name, err := decodeMailbox(v)
+	if err != nil {
+		return "", syntaxError(err.Error())
+	}
+
+	return canonicalName(name), nil
+}
+
+// value reads an atom, a string, or a parenthesized list of them.
+func (r *parser) value() (interface{}, error) {
+	switch r.peek() {
+	case '(':
+		return r.list()
+	case '"', '{':
+		return r.string(maxLiteralSize)
+	}
+	v, err := r.token()
+	if err != nil {
+		return nil, err
+	}
+
+	return atom(v), nil
+}
+
+func (r *parser) list() ([]interface{}, error) {
+	if r.peek() != '(' {
+		return nil, syntaxError("expected a list")
+	}
+	r.pos++
+
+	result := []interface{}{}
+	for {
+		if r.peek() == ')' {
+			r.pos++
+			return result, nil
+		}
+		if len(result) > 0 {
+			if err := r.space(); err != nil {
+				return nil, err
+			}
+		}
+		v, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+}
+
+// flags reads a parenthesized list of flags, or a single flag.
+func (r *parser) flags() ([]string, error) {
+	var values []interface{}
+	if r.peek() == '(' {
+		v, err := r.list()
+		if err != nil {
+			return nil, err
+		}
+		values = v
+	} else {
+		v, err := r.atom()
+		if err != nil {
+			return nil, err
+		}
+		values = []interface{}{atom(v)}
+	}
+
+	result := []string{}
+	for _, v := range values {
+		f, ok := v.(atom)
+		if !ok {
+			return nil, syntaxError("invalid flag")
+		}
+		result = append(result, string(f))
+	}
+
+	return result, nil
+}
+
+func (r *parser) number() (uint64, error) {
+	v, err := r.atom()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, syntaxError("invalid number")
+	}
+
+	return n, nil
+}
+
+func (r *parser) date() (time.Time, error) {
+	v, err := r.astring()
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse("2-Jan-2006", v)
+	if err != nil {
+		return time.Time{}, syntaxError("invalid date")
+	}
+
+	return t, nil
+}
+
+func (r *parser) seqSet() (seqSet, error) {
+	v, err := r.atom()
+	if err != nil {
+		return nil, err
+	}
+	return parseSeqSet(v)
+}
+
+// seqRange is a range of sequence numbers or UIDs. Zero means the largest
+// number in the mailbox, which is * in the command.
+type seqRange struct {
+	start, end uint64
+}
+
+type seqSet []seqRange
+
+func parseSeqSet(s string) (seqSet, error) {
+	result := seqSet{}
+	for _, v := range strings.Split(s, ",") {
+		var err error
+		r := seqRange{}
+		start, end := v, v
+		if i := strings.IndexByte(v, ':'); i >= 0 {
+			start, end = v[:i], v[i+1:]
+		}
+		if r.start, err = parseSeqNumber(start); err != nil {
+			return nil, err
+		}
+		if r.end, err = parseSeqNumber(end); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+
+	return result, nil
+}
+
+func parseSeqNumber(s string) (uint64, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 {
+		return 0, syntaxError(fmt.Sprintf("invalid sequence set: %v", s))
+	}
+
+	return n, nil
+}
+
+// contains returns whether n is in the set. max is the largest number in the
+// mailbox, which is used for *.
+func (r seqSet) contains(n, max uint64) bool {
+	for _, v := range r {
+		start, end := v.start, v.end
+		if start == 0 {
+			start = max
+		}
+		if end == 0 {
+			end = max
+		}
+		if start > end {
+			start, end = end, start
+		}
+		if n >= start && n <= end {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,411 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/go.enmime"
+	"github.com/superkkt/omega/database"
+)
+
+// searchKey is a search key of the SEARCH command.
+type searchKey struct {
+	// name is the upper-cased name of the key. Sequence sets and parenthesized
+	// lists are "SEQ" and "AND", respectively.
+	name     string
+	args     []string
+	date     time.Time
+	number   uint64
+	set      seqSet
+	children []*searchKey
+}
+
+func parseSearchKeys(p *parser) (*searchKey, error) {
+	key := &searchKey{name: "AND"}
+	for {
+		v, err := parseSearchKey(p)
+		if err != nil {
+			return nil, err
+		}
+		key.children = append(key.children, v)
+		if p.atEnd() {
+			return key, nil
+		}
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func parseSearchKey(p *parser) (*searchKey, error) {
+	if p.peek() == '(' {
+		p.pos++
+		key := &searchKey{name: "AND"}
+		for {
+			v, err := parseSearchKey(p)
+			if err != nil {
+				return nil, err
+			}
+			key.children = append(key.children, v)
+			if p.peek() == ')' {
+				p.pos++
+				return key, nil
+			}
+			if err := p.space(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	v, err := p.atom()
+	if err != nil {
+		return nil, err
+	}
+	if c := v[0]; c == '*' || (c >= '0' && c <= '9') {
+		set, err := parseSeqSet(v)
+		if err != nil {
+			return nil, err
+		}
+		return &searchKey{name: "SEQ", set: set}, nil
+	}
+
+	key := &searchKey{name: strings.ToUpper(v)}
+	switch key.name {
+	case "ALL", "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "NEW", "OLD", "RECENT", "SEEN",
+		"UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		return key, nil
+	}
+	if err := p.space(); err != nil {
+		return nil, err
+	}
+	switch key.name {
+	case "BCC", "BODY", "CC", "FROM", "KEYWORD", "SUBJECT", "TEXT", "TO", "UNKEYWORD":
+		s, err := p.astring()
+		if err != nil {
+			return nil, err
+		}
+		key.args = []string{s}
+	case "HEADER":
+		field, err := p.astring()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+		s, err := p.astring()
+		if err != nil {
+			return nil, err
+		}
+		key.args = []string{field, s}
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		if key.date, err = p.date(); err != nil {
+			return nil, err
+		}
+	case "LARGER", "SMALLER":
+		if key.number, err = p.number(); err != nil {
+			return nil, err
+		}
+	case "UID":
+		if key.set, err = p.seqSet(); err != nil {
+			return nil, err
+		}
+	case "NOT":
+		v, err := parseSearchKey(p)
+		if err != nil {
+			return nil, err
+		}
+		key.children = []*searchKey{v}
+	case "OR":
+		v1, err := parseSearchKey(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.space(); err != nil {
+			return nil, err
+		}
+		v2, err := parseSearchKey(p)
+		if err != nil {
+			return nil, err
+		}
+		key.children = []*searchKey{v1, v2}
+	default:
+		return nil, syntaxError(fmt.Sprintf("unknown search key: %v", v))
+	}
+
+	return key, nil
+}
+
+// searchContext is a message being tested by search keys. The raw message is
+// loaded only if a key requires it.
+type searchContext struct {
+	session *session
+	seq     int
+	message *message
+	maxUID  uint64
+	loaded  bool
+	raw     []byte
+	msg     *part
+	text    string
+}
+
+func (r *searchContext) load() error {
+	if r.loaded {
+		return nil
+	}
+	mb := r.session.mailbox
+	err := r.session.server.query(func(tx database.Transaction) error {
+		var err error
+		r.raw, err = r.session.config.Storage.NewEmailManager(tx, r.session.credential, mb.folder.ID).GetRawEmail(r.message.uid, database.LockNone)
+		return err
+	})
+	// Removed by another session.
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	r.raw = normalizeCRLF(r.raw)
+	r.msg = parseMessage(r.raw)
+	r.loaded = true
+
+	return nil
+}
+
+// header returns the decoded values of a header field.
+func (r *searchContext) header(name string) []string {
+	values := []string{}
+	for _, v := range r.msg.fields[textproto.CanonicalMIMEHeaderKey(name)] {
+		values = append(values, enmime.DecodeHeader(v))
+	}
+	return values
+}
+
+// body returns the decoded texts of the message.
+func (r *searchContext) body() string {
+	if len(r.text) > 0 {
+		return r.text
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(r.raw))
+	if err != nil {
+		return string(r.msg.body)
+	}
+	mime, err := enmime.ParseMIMEBody(m)
+	if err != nil {
+		return string(r.msg.body)
+	}
+	r.text = mime.Text + "\n" + mime.HTML
+
+	return r.text
+}
+
+func (r *searchContext) sentDate() (time.Time, bool) {
+	t, err := mail.ParseDate(r.msg.fields.Get("Date"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func (r *searchContext) match(key *searchKey) (bool, error) {
+	m := r.message
+	switch key.name {
+	case "ALL", "OLD":
+		return true, nil
+	case "NEW", "RECENT":
+		return false, nil
+	case "SEQ":
+		return key.set.contains(uint64(r.seq), uint64(len(r.session.mailbox.uids))), nil
+	case "UID":
+		return key.set.contains(m.uid, r.maxUID), nil
+	case "SEEN", "UNSEEN":
+		return m.seen == (key.name == "SEEN"), nil
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED":
+		return m.flags[`\`+strings.Title(strings.ToLower(key.name))], nil
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED":
+		return !m.flags[`\`+strings.Title(strings.ToLower(key.name[2:]))], nil
+	case "KEYWORD":
+		// Keywords are not stored.
+		return false, nil
+	case "UNKEYWORD":
+		return true, nil
+	case "BEFORE":
+		return compareDate(m.date, key.date) < 0, nil
+	case "ON":
+		return compareDate(m.date, key.date) == 0, nil
+	case "SINCE":
+		return compareDate(m.date, key.date) >= 0, nil
+	case "NOT":
+		ok, err := r.match(key.children[0])
+		return !ok, err
+	case "OR":
+		for _, v := range key.children {
+			if ok, err := r.match(v); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "AND":
+		for _, v := range key.children {
+			if ok, err := r.match(v); err != nil || !ok {
+				return ok, err
+			}
+		}
+		return true, nil
+	}
+
+	// The others require the raw message.
+	if err := r.load(); err != nil {
+		return false, err
+	}
+	switch key.name {
+	case "LARGER":
+		return uint64(len(r.raw)) > key.number, nil
+	case "SMALLER":
+		return uint64(len(r.raw)) < key.number, nil
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		t, ok := r.sentDate()
+		if !ok {
+			return false, nil
+		}
+		c := compareDate(t, key.date)
+		return (key.name == "SENTBEFORE" && c < 0) || (key.name == "SENTON" && c == 0) || (key.name == "SENTSINCE" && c >= 0), nil
+	case "BCC", "CC", "FROM", "SUBJECT", "TO":
+		return containsAny(r.header(key.name), key.args[0]), nil
+	case "HEADER":
+		values := r.header(key.args[0])
+		// An empty string matches all messages that have the field.
+		if len(key.args[1]) == 0 {
+			return len(values) > 0, nil
+		}
+		return containsAny(values, key.args[1]), nil
+	case "BODY":
+		return contains(r.body(), key.args[0]), nil
+	case "TEXT":
+		if contains(enmime.DecodeHeader(string(r.msg.header)), key.args[0]) {
+			return true, nil
+		}
+		return contains(r.body(), key.args[0]), nil
+	default:
+		panic(fmt.Sprintf("unexpected search key: %v", key.name))
+	}
+}
+
+// compareDate compares the dates of t1 and t2 disregarding the time and time
+// zone.
+func compareDate(t1, t2 time.Time) int {
+	y1, m1, d1 := t1.Date()
+	y2, m2, d2 := t2.Date()
+	v1 := time.Date(y1, m1, d1, 0, 0, 0, 0, time.UTC)
+	v2 := time.Date(y2, m2, d2, 0, 0, 0, 0, time.UTC)
+	switch {
+	case v1.Before(v2):
+		return -1
+	case v1.After(v2):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// contains reports whether substr is within s, ignoring case.
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func containsAny(values []string, substr string) bool {
+	for _, v := range values {
+		if contains(v, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *session) handleSearch(req *request) error {
+	// Only US-ASCII and UTF-8, which is a superset of US-ASCII, are supported.
+	start := req.args.pos
+	if v, err := req.args.token(); err == nil && strings.EqualFold(v, "CHARSET") {
+		if err := req.args.space(); err != nil {
+			return err
+		}
+		charset, err := req.args.astring()
+		if err != nil {
+			return err
+		}
+		if err := req.args.space(); err != nil {
+			return err
+		}
+		switch strings.ToUpper(charset) {
+		case "US-ASCII", "UTF-8":
+		default:
+			r.write("%v NO [BADCHARSET (US-ASCII UTF-8)] Unsupported charset\r\n", req.tag)
+			return req.args.discard()
+		}
+	} else {
+		req.args.pos = start
+	}
+	key, err := parseSearchKeys(req.args)
+	if err != nil {
+		return err
+	}
+
+	mb := r.mailbox
+	maxUID := uint64(0)
+	for _, v := range mb.uids {
+		if v > maxUID {
+			maxUID = v
+		}
+	}
+	result := []string{}
+	for i, uid := range mb.uids {
+		m := mb.messages[uid]
+		if m.expunged {
+			continue
+		}
+		c := &searchContext{session: r, seq: i + 1, message: m, maxUID: maxUID}
+		ok, err := c.match(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if req.uid {
+			result = append(result, strconv.FormatUint(uid, 10))
+		} else {
+			result = append(result, strconv.Itoa(i+1))
+		}
+	}
+	if len(result) > 0 {
+		r.write("* SEARCH %v\r\n", strings.Join(result, " "))
+	} else {
+		r.write("* SEARCH\r\n")
+	}
+	r.write("%v OK %v completed\r\n", req.tag, commandName(req))
+
+	return nil
+}
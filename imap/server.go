@@ -0,0 +1,205 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultMaxSize = 32 * 1024 * 1024
+	// RFC 3501 Section 5.4: the inactivity autologout timer must be at least
+	// 30 minutes.
+	defaultTimeout      = 30 * time.Minute
+	defaultPollInterval = 10 * time.Second
+	// Maximum number of invalid commands in a session.
+	maxErrors = 10
+	// Maximum number of failed authentications in a session.
+	maxAuthFailures = 3
+)
+
+type Config struct {
+	Authenticator backend.Authenticator
+	Storage       backend.Storage
+	DB            database.TransactionManager
+	// TLSConfig enables the STARTTLS command if it is not nil. Connections
+	// accepted from a TLS listener are already secure, so they do not need it.
+	TLSConfig *tls.Config
+	// AllowPlaintext allows the LOGIN and AUTHENTICATE commands over insecure
+	// connections. Use for only debugging purpose.
+	AllowPlaintext bool
+	// MaxSize is the maximum size of a message appended by clients in bytes.
+	// Zero means 32 MiB.
+	MaxSize int64
+	// Timeout is the maximum time to wait for a command from the client. Zero
+	// means 30 minutes.
+	Timeout time.Duration
+	// PollInterval is the interval to check changes of the selected mailbox
+	// while the client is idling. Zero means 10 seconds.
+	PollInterval time.Duration
+	// Throttle is the brute-force protection shared with the ActiveSync
+	// listener if they use the same failure store.
+	Throttle activesync.ThrottleConfig
+}
+
+// Server is an IMAP4rev1 (RFC 3501) server with the IDLE (RFC 2177), UIDPLUS
+// (RFC 4315), and MOVE (RFC 6851) extensions. Email IDs are used as UIDs, and
+// only the \Seen flag is stored in the backend storage. Other flags such as
+// \Deleted are kept until the client closes the mailbox.
+type Server struct {
+	config   Config
+	throttle *activesync.Throttle
+
+	mutex sync.Mutex
+	// idle is the set of sessions waiting for a command, which can be closed
+	// at any time to shut down.
+	idle         map[*session]struct{}
+	shuttingDown bool
+	wg           sync.WaitGroup
+}
+
+func NewServer(conf Config) (*Server, error) {
+	if conf.Authenticator == nil || conf.Storage == nil || conf.DB == nil {
+		return nil, errors.New("nil authenticator, storage, or DB")
+	}
+	if conf.MaxSize == 0 {
+		conf.MaxSize = defaultMaxSize
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultTimeout
+	}
+	if conf.PollInterval == 0 {
+		conf.PollInterval = defaultPollInterval
+	}
+
+	return &Server{
+		config:   conf,
+		throttle: activesync.NewThrottle("imap", conf.Throttle),
+		idle:     make(map[*session]struct{}),
+	}, nil
+}
+
+// Serve accepts connections on l until ctx is canceled. Serve closes l, and
+// waits for the sessions that are processing commands before it returns.
+func (r *Server) Serve(ctx context.Context, l net.Listener) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.shutdown()
+			l.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				r.wg.Wait()
+				return nil
+			}
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				logger.Warning(fmt.Sprintf("imap: temporary error on accepting a connection: %v", err))
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			newSession(r, conn).serve()
+		}()
+	}
+}
+
+// shutdown closes the idle sessions, and makes the others close after they
+// finish the current command.
+func (r *Server) shutdown() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.shuttingDown = true
+	for s := range r.idle {
+		s.conn.Close()
+	}
+}
+
+// setIdle marks s as idle or busy. setIdle returns false if the server is shutting down.
+func (r *Server) setIdle(s *session, idle bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if idle {
+		r.idle[s] = struct{}{}
+	} else {
+		delete(r.idle, s)
+	}
+
+	return !r.shuttingDown
+}
+
+func (r *Server) query(f func(tx database.Transaction) error) error {
+	tx := r.config.DB.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(database.NotFoundError)
+	if !ok {
+		return false
+	}
+
+	return e.IsNotFound()
+}
+
+func isDuplicated(err error) bool {
+	e, ok := err.(database.DuplicatedError)
+	if !ok {
+		return false
+	}
+
+	return e.IsDuplicated()
+}
@@ -0,0 +1,462 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+
+	"github.com/superkkt/logger"
+)
+
+type session struct {
+	server *Server
+	config *Config
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// err is the first error on writing to the connection.
+	err    error
+	remote string
+	tls    bool
+	// credential is nil before the client is authenticated.
+	credential backend.Credential
+	// mailbox is the selected mailbox, which is nil if there is no one.
+	mailbox      *mailbox
+	errors       int
+	authFailures int
+	// bye is the reason to close the session after the current command.
+	bye string
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	remote := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	_, secure := conn.(*tls.Conn)
+
+	return &session{
+		server: server,
+		config: &server.config,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		remote: remote,
+		tls:    secure,
+	}
+}
+
+func (r *session) serve() {
+	defer r.conn.Close()
+	logger.Debug(fmt.Sprintf("imap: new session from %v", r.remote))
+
+	r.write("* OK [CAPABILITY %v] Omega IMAP4rev1 ready\r\n", r.capability())
+	if r.flush() != nil {
+		return
+	}
+	for {
+		if !r.server.setIdle(r, true) {
+			r.write("* BYE Server shutting down\r\n")
+			r.flush()
+			return
+		}
+		r.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+		line, err := readLine(r.reader)
+		r.server.setIdle(r, false)
+		if err != nil {
+			if err == errLineTooLong {
+				r.write("* BYE Command line too long\r\n")
+				r.flush()
+			} else if err != io.EOF {
+				logger.Debug(fmt.Sprintf("imap: failed to read a command from %v: %v", r.remote, err))
+			}
+			return
+		}
+
+		r.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+		quit := r.handle(line)
+		if r.flush() != nil {
+			logger.Debug(fmt.Sprintf("imap: session with %v has been closed: %v", r.remote, r.err))
+			return
+		}
+		if quit {
+			return
+		}
+		if r.errors >= maxErrors {
+			r.bye = "Too many errors"
+		}
+		if len(r.bye) > 0 {
+			r.write("* BYE %v\r\n", r.bye)
+			r.flush()
+			return
+		}
+	}
+}
+
+// state is the set of states in which a command is allowed.
+type state int
+
+const (
+	stateNotAuthenticated state = 1 << iota
+	stateAuthenticated
+	stateSelected
+	stateAny = stateNotAuthenticated | stateAuthenticated | stateSelected
+)
+
+type command struct {
+	state state
+	// handler replies the tagged response of the command. The handler can
+	// return an error instead if the command is invalid or has failed.
+	handler func(r *session, req *request) error
+	// uid is true if the command can be prefixed by UID.
+	uid bool
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"CAPABILITY":   {stateAny, (*session).handleCapability, false},
+		"NOOP":         {stateAny, (*session).handleNoop, false},
+		"LOGOUT":       {stateAny, (*session).handleLogout, false},
+		"ID":           {stateAny, (*session).handleID, false},
+		"STARTTLS":     {stateNotAuthenticated, (*session).handleStartTLS, false},
+		"LOGIN":        {stateNotAuthenticated, (*session).handleLogin, false},
+		"AUTHENTICATE": {stateNotAuthenticated, (*session).handleAuthenticate, false},
+		"SELECT":       {stateAuthenticated | stateSelected, (*session).handleSelect, false},
+		"EXAMINE":      {stateAuthenticated | stateSelected, (*session).handleSelect, false},
+		"CREATE":       {stateAuthenticated | stateSelected, (*session).handleCreate, false},
+		"DELETE":       {stateAuthenticated | stateSelected, (*session).handleDelete, false},
+		"RENAME":       {stateAuthenticated | stateSelected, (*session).handleRename, false},
+		"SUBSCRIBE":    {stateAuthenticated | stateSelected, (*session).handleSubscribe, false},
+		"UNSUBSCRIBE":  {stateAuthenticated | stateSelected, (*session).handleSubscribe, false},
+		"LIST":         {stateAuthenticated | stateSelected, (*session).handleList, false},
+		"LSUB":         {stateAuthenticated | stateSelected, (*session).handleList, false},
+		"STATUS":       {stateAuthenticated | stateSelected, (*session).handleStatus, false},
+		"APPEND":       {stateAuthenticated | stateSelected, (*session).handleAppend, false},
+		"NAMESPACE":    {stateAuthenticated | stateSelected, (*session).handleNamespace, false},
+		"IDLE":         {stateAuthenticated | stateSelected, (*session).handleIdle, false},
+		"CHECK":        {stateSelected, (*session).handleNoop, false},
+		"CLOSE":        {stateSelected, (*session).handleClose, false},
+		"UNSELECT":     {stateSelected, (*session).handleClose, false},
+		"EXPUNGE":      {stateSelected, (*session).handleExpunge, true},
+		"SEARCH":       {stateSelected, (*session).handleSearch, true},
+		"FETCH":        {stateSelected, (*session).handleFetch, true},
+		"STORE":        {stateSelected, (*session).handleStore, true},
+		"COPY":         {stateSelected, (*session).handleCopy, true},
+		"MOVE":         {stateSelected, (*session).handleCopy, true},
+	}
+}
+
+func (r *session) state() state {
+	switch {
+	case r.credential == nil:
+		return stateNotAuthenticated
+	case r.mailbox == nil:
+		return stateAuthenticated
+	default:
+		return stateSelected
+	}
+}
+
+// request is a command from the client.
+type request struct {
+	tag  string
+	name string
+	// uid is true if the command is prefixed by UID.
+	uid  bool
+	args *parser
+}
+
+// handle processes a command line. It returns true if the session should be
+// closed.
+func (r *session) handle(line string) (quit bool) {
+	p := &parser{reader: r.reader, cont: r.continuation, line: line}
+	tag, err := p.atom()
+	if err != nil || strings.ContainsAny(tag, "+*%\"\\") {
+		r.errors++
+		r.write("* BAD Invalid tag\r\n")
+		p.discard()
+		return false
+	}
+	req := &request{tag: tag, args: p}
+	if err = p.space(); err == nil {
+		req.name, err = p.atom()
+	}
+	if err == nil && strings.EqualFold(req.name, "UID") {
+		req.uid = true
+		if err = p.space(); err == nil {
+			req.name, err = p.atom()
+		}
+	}
+	// Arguments follow a space.
+	if err == nil && !p.atEnd() {
+		err = p.space()
+	}
+	if err != nil {
+		r.errors++
+		r.write("%v BAD Invalid command\r\n", tag)
+		p.discard()
+		return false
+	}
+	req.name = strings.ToUpper(req.name)
+
+	cmd, ok := commands[req.name]
+	if !ok || (req.uid && !cmd.uid) {
+		r.errors++
+		r.write("%v BAD Unknown command\r\n", tag)
+		p.discard()
+		return false
+	}
+	if cmd.state&r.state() == 0 {
+		r.errors++
+		r.write("%v BAD %v is not allowed in this state\r\n", tag, req.name)
+		p.discard()
+		return false
+	}
+
+	err = cmd.handler(r, req)
+	switch e := err.(type) {
+	case nil:
+	case syntaxError:
+		r.errors++
+		r.write("%v BAD %v\r\n", tag, strings.Title(e.Error()))
+		p.discard()
+	case literalError:
+		r.write("%v NO %v\r\n", tag, e.Error())
+		p.discard()
+	default:
+		if r.err == nil {
+			logger.Error(fmt.Sprintf("imap: failed to process %v: user=%v, remote=%v, err=%v", req.name, r.userID(), r.remote, err))
+		}
+		r.write("%v NO [UNAVAILABLE] Temporary server failure\r\n", tag)
+	}
+
+	return req.name == "LOGOUT"
+}
+
+func (r *session) userID() string {
+	if r.credential == nil {
+		return ""
+	}
+	return r.credential.UserID()
+}
+
+// secure returns whether the client is allowed to send passwords.
+func (r *session) secure() bool {
+	return r.tls || r.config.AllowPlaintext
+}
+
+func (r *session) capability() string {
+	caps := []string{"IMAP4rev1", "LITERAL+", "SASL-IR", "ID", "IDLE", "NAMESPACE", "UIDPLUS", "MOVE", "UNSELECT", "CHILDREN", "SPECIAL-USE"}
+	if r.credential != nil {
+		return strings.Join(caps, " ")
+	}
+	if r.config.TLSConfig != nil && !r.tls {
+		caps = append(caps, "STARTTLS")
+	}
+	if r.secure() {
+		caps = append(caps, "AUTH=PLAIN")
+	} else {
+		caps = append(caps, "LOGINDISABLED")
+	}
+
+	return strings.Join(caps, " ")
+}
+
+func (r *session) write(format string, args ...interface{}) {
+	if r.err != nil {
+		return
+	}
+	if len(args) == 0 {
+		_, r.err = r.writer.WriteString(format)
+		return
+	}
+	_, r.err = fmt.Fprintf(r.writer, format, args...)
+}
+
+func (r *session) flush() error {
+	if r.err == nil {
+		r.err = r.writer.Flush()
+	}
+	return r.err
+}
+
+func (r *session) continuation() error {
+	r.write("+ Ready for literal data\r\n")
+	return r.flush()
+}
+
+func (r *session) handleCapability(req *request) error {
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	r.write("* CAPABILITY %v\r\n", r.capability())
+	r.write("%v OK CAPABILITY completed\r\n", req.tag)
+
+	return nil
+}
+
+func (r *session) handleNoop(req *request) error {
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	if r.mailbox != nil {
+		if err := r.update(true); err != nil {
+			return err
+		}
+	}
+	r.write("%v OK NOOP completed\r\n", req.tag)
+
+	return nil
+}
+
+func (r *session) handleLogout(req *request) error {
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	r.write("* BYE Logging out\r\n")
+	r.write("%v OK LOGOUT completed\r\n", req.tag)
+
+	return nil
+}
+
+// handleID implements the ID command (RFC 2971), which is sent by many clients
+// regardless of the capability.
+func (r *session) handleID(req *request) error {
+	if _, err := req.args.value(); err != nil {
+		return err
+	}
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	r.write("* ID (\"name\" \"Omega\")\r\n")
+	r.write("%v OK ID completed\r\n", req.tag)
+
+	return nil
+}
+
+func (r *session) handleNamespace(req *request) error {
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	r.write("* NAMESPACE ((\"\" \"/\")) NIL NIL\r\n")
+	r.write("%v OK NAMESPACE completed\r\n", req.tag)
+
+	return nil
+}
+
+func (r *session) handleStartTLS(req *request) error {
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	if r.config.TLSConfig == nil || r.tls {
+		r.write("%v NO STARTTLS not available\r\n", req.tag)
+		return nil
+	}
+	// Commands pipelined after STARTTLS could have been injected by an attacker.
+	if r.reader.Buffered() > 0 {
+		r.write("%v BAD Unexpected data after STARTTLS\r\n", req.tag)
+		r.bye = "Unexpected data after STARTTLS"
+		return nil
+	}
+	r.write("%v OK Begin TLS negotiation now\r\n", req.tag)
+	if err := r.flush(); err != nil {
+		return err
+	}
+
+	conn := tls.Server(r.conn, r.config.TLSConfig)
+	if err := conn.Handshake(); err != nil {
+		r.err = fmt.Errorf("TLS handshake: %v", err)
+		return nil
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+	r.writer = bufio.NewWriter(conn)
+	r.tls = true
+
+	return nil
+}
+
+func (r *session) handleIdle(req *request) error {
+	if err := req.args.end(); err != nil {
+		return err
+	}
+	r.write("+ idling\r\n")
+	if err := r.flush(); err != nil {
+		return err
+	}
+
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := readLine(r.reader)
+		done <- result{line, err}
+	}()
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+	// The server can close the idling session at any time to shut down.
+	r.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+	defer r.server.setIdle(r, false)
+
+	for {
+		if !r.server.setIdle(r, true) {
+			r.conn.Close()
+		}
+		select {
+		case v := <-done:
+			r.server.setIdle(r, false)
+			if v.err != nil {
+				r.err = v.err
+				return nil
+			}
+			if !strings.EqualFold(v.line, "DONE") {
+				r.errors++
+				r.write("%v BAD Expected DONE\r\n", req.tag)
+				return nil
+			}
+			r.write("%v OK IDLE terminated\r\n", req.tag)
+			return nil
+		case <-ticker.C:
+			if r.mailbox == nil {
+				continue
+			}
+			r.server.setIdle(r, false)
+			if err := r.update(true); err != nil {
+				logger.Error(fmt.Sprintf("imap: failed to check updates of a mailbox: user=%v, mailbox=%v, err=%v", r.userID(), r.mailbox.name, err))
+			}
+			if err := r.flush(); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package imap
+
+import (
+	"encoding/base64"
+	"errors"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Modified BASE64 of RFC 3501 Section 5.1.3, which uses , instead of /.
+var mutf7 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+var errInvalidMailbox = errors.New("invalid modified UTF-7 mailbox name")
+
+// encodeMailbox encodes a mailbox name in modified UTF-7.
+func encodeMailbox(name string) string {
+	result := []byte{}
+	var chars []rune
+	flush := func() {
+		if len(chars) == 0 {
+			return
+		}
+		b := []byte{}
+		for _, v := range utf16.Encode(chars) {
+			b = append(b, byte(v>>8), byte(v))
+		}
+		result = append(result, '&')
+		result = append(result, mutf7.EncodeToString(b)...)
+		result = append(result, '-')
+		chars = nil
+	}
+
+	for _, c := range name {
+		if c >= 0x20 && c <= 0x7e {
+			flush()
+			result = append(result, byte(c))
+			if c == '&' {
+				result = append(result, '-')
+			}
+			continue
+		}
+		chars = append(chars, c)
+	}
+	flush()
+
+	return string(result)
+}
+
+// decodeMailbox decodes a mailbox name in modified UTF-7.
+func decodeMailbox(name string) (string, error) {
+	result := []byte{}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 0x20 || c > 0x7e {
+			// Some clients send UTF-8 names as is.
+			if !utf8.ValidString(name) {
+				return "", errInvalidMailbox
+			}
+			result = append(result, c)
+			continue
+		}
+		if c != '&' {
+			result = append(result, c)
+			continue
+		}
+
+		end := i + 1
+		for end < len(name) && name[end] != '-' {
+			end++
+		}
+		if end == len(name) {
+			return "", errInvalidMailbox
+		}
+		if end == i+1 {
+			result = append(result, '&')
+			i = end
+			continue
+		}
+		b, err := mutf7.DecodeString(name[i+1 : end])
+		if err != nil || len(b)%2 != 0 {
+			return "", errInvalidMailbox
+		}
+		units := make([]uint16, len(b)/2)
+		for j := range units {
+			units[j] = uint16(b[2*j])<<8 | uint16(b[2*j+1])
+		}
+		for _, r := range utf16.Decode(units) {
+			if r == utf8.RuneError {
+				return "", errInvalidMailbox
+			}
+			result = append(result, string(r)...)
+		}
+		i = end
+	}
+
+	return string(result), nil
+}
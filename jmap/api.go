@@ -0,0 +1,401 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/superkkt/logger"
+)
+
+// sessionState never changes because the session resource only depends on the
+// server configuration.
+const sessionState = "0"
+
+type apiRequest struct {
+	Using       []string          `json:"using"`
+	MethodCalls []invocation      `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds"`
+}
+
+type invocation struct {
+	name   string
+	args   json.RawMessage
+	callID string
+}
+
+func (r *invocation) UnmarshalJSON(data []byte) error {
+	v := []json.RawMessage{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if len(v) != 3 {
+		return errors.New("invocation is not an array of 3 elements")
+	}
+	if err := json.Unmarshal(v[0], &r.name); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(v[1]), []byte("{")) {
+		return errors.New("arguments of an invocation is not an object")
+	}
+	r.args = v[1]
+
+	return json.Unmarshal(v[2], &r.callID)
+}
+
+type response struct {
+	name   string
+	args   interface{}
+	callID string
+}
+
+func (r response) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{r.name, r.args, r.callID})
+}
+
+type method struct {
+	// capability should be in the using property of a request to call the method.
+	capability string
+	handler    func(r *call, args json.RawMessage) (interface{}, error)
+}
+
+var methods = map[string]method{
+	"Core/echo":                    {capabilityCore, handleEcho},
+	"Mailbox/get":                  {capabilityMail, handleMailboxGet},
+	"Mailbox/changes":              {capabilityMail, handleMailboxChanges},
+	"Mailbox/query":                {capabilityMail, handleMailboxQuery},
+	"Mailbox/queryChanges":         {capabilityMail, handleQueryChanges},
+	"Mailbox/set":                  {capabilityMail, handleMailboxSet},
+	"Thread/get":                   {capabilityMail, handleThreadGet},
+	"Thread/changes":               {capabilityMail, handleThreadChanges},
+	"Email/get":                    {capabilityMail, handleEmailGet},
+	"Email/changes":                {capabilityMail, handleEmailChanges},
+	"Email/query":                  {capabilityMail, handleEmailQuery},
+	"Email/queryChanges":           {capabilityMail, handleQueryChanges},
+	"Email/set":                    {capabilityMail, handleEmailSet},
+	"Email/import":                 {capabilityMail, handleEmailImport},
+	"Identity/get":                 {capabilitySubmission, handleIdentityGet},
+	"EmailSubmission/get":          {capabilitySubmission, handleSubmissionGet},
+	"EmailSubmission/changes":      {capabilitySubmission, handleSubmissionChanges},
+	"EmailSubmission/query":        {capabilitySubmission, handleSubmissionQuery},
+	"EmailSubmission/queryChanges": {capabilitySubmission, handleQueryChanges},
+	"EmailSubmission/set":          {capabilitySubmission, handleSubmissionSet},
+}
+
+// call is the context of a method call, which is processed in a transaction.
+type call struct {
+	server     *Server
+	credential backend.Credential
+	tx         database.Transaction
+	// created maps creation IDs to the IDs of the objects that have been
+	// created in the request.
+	created map[string]string
+	// index is loaded on demand.
+	index *emailIndex
+	// extra is the responses following the response of the method, e.g., the
+	// implicit Email/set call of EmailSubmission/set.
+	extra []response
+}
+
+func (r *call) folderManager() backend.FolderManager {
+	return r.server.config.Storage.NewFolderManager(r.tx, r.credential)
+}
+
+// emailManager returns an email manager of the folder whose ID is folderID.
+// Zero folderID means all the folders, which should be used only to read.
+func (r *call) emailManager(folderID uint64) backend.EmailManager {
+	return r.server.config.Storage.NewEmailManager(r.tx, r.credential, folderID)
+}
+
+func (r *call) checkAccount(id string) error {
+	if id != accountID(r.credential) {
+		return &methodError{Type: "accountNotFound"}
+	}
+
+	return nil
+}
+
+// resolveID returns the ID of id, which can be a creation ID prefixed with #.
+func (r *call) resolveID(id string) (string, bool) {
+	if !strings.HasPrefix(id, "#") {
+		return id, true
+	}
+	v, ok := r.created[id[1:]]
+
+	return v, ok
+}
+
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (r *methodError) Error() string {
+	return fmt.Sprintf("%v: %v", r.Type, r.Description)
+}
+
+func invalidArguments(format string, args ...interface{}) error {
+	return &methodError{Type: "invalidArguments", Description: fmt.Sprintf(format, args...)}
+}
+
+// setError is an error of an object in the /set methods.
+type setError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+func (r *setError) Error() string {
+	return fmt.Sprintf("%v: %v", r.Type, r.Description)
+}
+
+func invalidProperties(description string, properties ...string) *setError {
+	return &setError{Type: "invalidProperties", Description: description, Properties: properties}
+}
+
+func (r *Server) handleAPI(c backend.Credential, w http.ResponseWriter, req *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, r.config.MaxSize))
+	if err != nil {
+		writeProblem(w, http.StatusRequestEntityTooLarge, "urn:ietf:params:jmap:error:limit", "maxSizeRequest")
+		return
+	}
+	areq := apiRequest{}
+	if err := json.Unmarshal(data, &areq); err != nil {
+		writeProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:notRequest", err.Error())
+		return
+	}
+	for _, v := range areq.Using {
+		if v != capabilityCore && v != capabilityMail && v != capabilitySubmission {
+			writeProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:unknownCapability", fmt.Sprintf("Unknown capability: %v", v))
+			return
+		}
+	}
+	if len(areq.MethodCalls) > maxCallsInRequest {
+		writeProblem(w, http.StatusBadRequest, "urn:ietf:params:jmap:error:limit", "maxCallsInRequest")
+		return
+	}
+
+	created := make(map[string]string)
+	for k, v := range areq.CreatedIDs {
+		created[k] = v
+	}
+	responses := make([]response, 0)
+	for _, v := range areq.MethodCalls {
+		responses = append(responses, r.invoke(c, areq.Using, v, created, responses)...)
+	}
+
+	result := map[string]interface{}{
+		"methodResponses": responses,
+		"sessionState":    sessionState,
+	}
+	if areq.CreatedIDs != nil {
+		result["createdIds"] = created
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// invoke processes a method call, and returns its responses. prev is the
+// responses of the previous method calls in the request, which can be
+// referred by the arguments.
+func (r *Server) invoke(c backend.Credential, using []string, inv invocation, created map[string]string, prev []response) []response {
+	errorResponse := func(err error) []response {
+		return []response{{name: "error", args: err, callID: inv.callID}}
+	}
+
+	m, ok := methods[inv.name]
+	if !ok || !hasString(using, m.capability) {
+		return errorResponse(&methodError{Type: "unknownMethod"})
+	}
+	args, err := resolveReferences(inv.args, prev)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	ctx := &call{server: r, credential: c, created: created}
+	var result interface{}
+	err = r.query(func(tx database.Transaction) error {
+		ctx.tx = tx
+		ctx.index = nil
+		ctx.extra = nil
+		result, err = m.handler(ctx, args)
+		return err
+	})
+	if err != nil {
+		if _, ok := err.(*methodError); ok {
+			return errorResponse(err)
+		}
+		logger.Error(fmt.Sprintf("jmap: failed to process %v of %v: %v", inv.name, c.UserID(), err))
+		return errorResponse(&methodError{Type: "serverFail", Description: "Internal server error"})
+	}
+
+	return append([]response{{name: inv.name, args: result, callID: inv.callID}}, ctx.extra...)
+}
+
+// resolveReferences replaces the arguments whose names are prefixed with #
+// with the results of the previous method calls (RFC 8620 Section 3.7).
+func resolveReferences(args json.RawMessage, prev []response) (json.RawMessage, error) {
+	m := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(args, &m); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+
+	resolved := false
+	for k, v := range m {
+		if !strings.HasPrefix(k, "#") {
+			continue
+		}
+		if _, ok := m[k[1:]]; ok {
+			return nil, invalidArguments("both of %v and %v are specified", k, k[1:])
+		}
+		ref := struct {
+			ResultOf string `json:"resultOf"`
+			Name     string `json:"name"`
+			Path     string `json:"path"`
+		}{}
+		if err := json.Unmarshal(v, &ref); err != nil {
+			return nil, invalidArguments("invalid result reference %v: %v", k, err)
+		}
+		value, ok := evaluateReference(prev, ref.ResultOf, ref.Name, ref.Path)
+		if !ok {
+			return nil, &methodError{Type: "invalidResultReference", Description: fmt.Sprintf("failed to resolve %v", k)}
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		delete(m, k)
+		m[k[1:]] = data
+		resolved = true
+	}
+	if !resolved {
+		return args, nil
+	}
+
+	return json.Marshal(m)
+}
+
+func evaluateReference(prev []response, callID, name, path string) (interface{}, bool) {
+	for _, v := range prev {
+		if v.callID != callID || v.name != name {
+			continue
+		}
+		// Convert the response into generic JSON values.
+		data, err := json.Marshal(v.args)
+		if err != nil {
+			return nil, false
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, false
+		}
+		if len(path) == 0 {
+			return value, true
+		}
+		if path[0] != '/' {
+			return nil, false
+		}
+		return evaluatePointer(value, strings.Split(path[1:], "/"))
+	}
+
+	return nil, false
+}
+
+// evaluatePointer evaluates the reference tokens of a JSON pointer (RFC 6901)
+// with the * extension of RFC 8620, which maps the rest of the pointer over
+// the elements of an array and flattens the results.
+func evaluatePointer(value interface{}, tokens []string) (interface{}, bool) {
+	if len(tokens) == 0 {
+		return value, true
+	}
+	token := strings.Replace(strings.Replace(tokens[0], "~1", "/", -1), "~0", "~", -1)
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, ok := v[token]
+		if !ok {
+			return nil, false
+		}
+		return evaluatePointer(child, tokens[1:])
+	case []interface{}:
+		if token == "*" {
+			result := make([]interface{}, 0)
+			for _, e := range v {
+				child, ok := evaluatePointer(e, tokens[1:])
+				if !ok {
+					return nil, false
+				}
+				if a, ok := child.([]interface{}); ok {
+					result = append(result, a...)
+				} else {
+					result = append(result, child)
+				}
+			}
+			return result, true
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, false
+		}
+		return evaluatePointer(v[i], tokens[1:])
+	default:
+		return nil, false
+	}
+}
+
+func handleEcho(r *call, args json.RawMessage) (interface{}, error) {
+	return args, nil
+}
+
+// handleQueryChanges implements the /queryChanges methods. Query results are
+// not cached, so clients have to query again.
+func handleQueryChanges(r *call, args json.RawMessage) (interface{}, error) {
+	req := struct {
+		AccountID string `json:"accountId"`
+	}{}
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+
+	return nil, &methodError{Type: "cannotCalculateChanges"}
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
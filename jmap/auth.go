@@ -0,0 +1,44 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+)
+
+// auth returns a credential of the Authorization header of req.
+func (r *Server) auth(req *http.Request) (backend.Credential, error) {
+	scheme := strings.TrimSpace(req.Header.Get("Authorization"))
+	if i := strings.IndexByte(scheme, ' '); i >= 0 {
+		scheme = scheme[:i]
+	}
+	for _, v := range r.config.Auth {
+		// The scheme is case-insensitive.
+		if strings.EqualFold(scheme, v.Scheme()) {
+			return v.Authenticate(req)
+		}
+	}
+
+	return backend.Unauthorized, nil
+}
@@ -0,0 +1,226 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/superkkt/logger"
+)
+
+const (
+	// Uploaded blobs are removed after this duration if they are not used.
+	uploadExpiry = 1 * time.Hour
+)
+
+// uploadStore keeps uploaded blobs in memory until they expire. Blobs are only
+// used to create emails, which store their own copies.
+type uploadStore struct {
+	mutex sync.Mutex
+	blobs map[string]*upload
+}
+
+type upload struct {
+	owner       uint64
+	contentType string
+	data        []byte
+	expires     time.Time
+}
+
+func newUploadStore() *uploadStore {
+	return &uploadStore{blobs: make(map[string]*upload)}
+}
+
+func (r *uploadStore) add(owner uint64, contentType string, data []byte) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := "U" + hex.EncodeToString(buf)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for k, v := range r.blobs {
+		if now.After(v.expires) {
+			delete(r.blobs, k)
+		}
+	}
+	r.blobs[id] = &upload{owner: owner, contentType: contentType, data: data, expires: now.Add(uploadExpiry)}
+
+	return id, nil
+}
+
+func (r *uploadStore) get(owner uint64, id string) (*upload, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	v, ok := r.blobs[id]
+	if !ok || v.owner != owner || time.Now().After(v.expires) {
+		return nil, false
+	}
+
+	return v, true
+}
+
+func (r *Server) handleUpload(c backend.Credential, w http.ResponseWriter, req *http.Request) {
+	account := strings.Trim(strings.TrimPrefix(req.URL.Path, "/jmap/upload/"), "/")
+	if account != accountID(c) {
+		writeProblem(w, http.StatusNotFound, "about:blank", "Unknown account")
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, r.config.MaxSize))
+	if err != nil {
+		writeProblem(w, http.StatusRequestEntityTooLarge, "urn:ietf:params:jmap:error:limit", "maxSizeUpload")
+		return
+	}
+	contentType := req.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	id, err := r.uploads.add(c.UserUID(), contentType, data)
+	if err != nil {
+		logger.Error(fmt.Sprintf("jmap: failed to add an uploaded blob: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"accountId": account,
+		"blobId":    id,
+		"type":      contentType,
+		"size":      len(data),
+	})
+}
+
+func (r *Server) handleDownload(c backend.Credential, w http.ResponseWriter, req *http.Request) {
+	// /jmap/download/{accountId}/{blobId}/{name}
+	v := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/jmap/download/"), "/", 3)
+	if len(v) != 3 || v[0] != accountID(c) {
+		writeProblem(w, http.StatusNotFound, "about:blank", "Unknown account or blob")
+		return
+	}
+
+	var data []byte
+	found := false
+	err := r.query(func(tx database.Transaction) error {
+		var err error
+		data, found, err = (&call{server: r, credential: c, tx: tx}).getBlob(v[1])
+		return err
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("jmap: failed to get a blob: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeProblem(w, http.StatusNotFound, "about:blank", "Unknown blob")
+		return
+	}
+
+	contentType := req.URL.Query().Get("type")
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": v[2]}))
+	// Blobs are immutable.
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	w.Write(data)
+}
+
+// getBlob returns the data of a blob. A blob ID is one of the followings:
+//
+//	M{emailID}: a raw email
+//	A{emailID}.{attachmentID}: a decoded attachment
+//	B{emailID}.{partID}: a decoded text or HTML body
+//	U{random}: an uploaded blob
+func (r *call) getBlob(id string) (data []byte, found bool, err error) {
+	if len(id) < 2 {
+		return nil, false, nil
+	}
+	if id[0] == 'U' {
+		v, ok := r.server.uploads.get(r.credential.UserUID(), id)
+		if !ok {
+			return nil, false, nil
+		}
+		return v.data, true, nil
+	}
+
+	v := strings.SplitN(id[1:], ".", 2)
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, false, err
+	}
+	e, ok := index.emails[parseID(v[0])]
+	if !ok {
+		return nil, false, nil
+	}
+	switch {
+	case id[0] == 'M' && len(v) == 1:
+		raw, err := r.emailManager(e.folderID).GetRawEmail(e.email.ID, database.LockNone)
+		if err != nil {
+			return nil, false, err
+		}
+		return raw, true, nil
+	case id[0] == 'A' && len(v) == 2:
+		attID, err := strconv.ParseUint(v[1], 10, 64)
+		if err != nil {
+			return nil, false, nil
+		}
+		for _, a := range e.email.Attachments {
+			if a.ID() != attID {
+				continue
+			}
+			data, err := a.Value()
+			if err != nil {
+				return nil, false, err
+			}
+			return data, true, nil
+		}
+	case id[0] == 'B' && len(v) == 2:
+		parsed, err := r.parseEmail(e)
+		if err != nil {
+			return nil, false, err
+		}
+		switch v[1] {
+		case textPartID:
+			return []byte(parsed.text()), len(parsed.text()) > 0, nil
+		case htmlPartID:
+			return []byte(parsed.html()), len(parsed.html()) > 0, nil
+		}
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,349 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// emailCreate is the properties of a new email of Email/set.
+type emailCreate struct {
+	MailboxIDs map[string]bool  `json:"mailboxIds"`
+	Keywords   map[string]bool  `json:"keywords"`
+	From       []emailAddress   `json:"from"`
+	Sender     []emailAddress   `json:"sender"`
+	To         []emailAddress   `json:"to"`
+	Cc         []emailAddress   `json:"cc"`
+	Bcc        []emailAddress   `json:"bcc"`
+	ReplyTo    []emailAddress   `json:"replyTo"`
+	Subject    string           `json:"subject"`
+	SentAt     *time.Time       `json:"sentAt"`
+	MessageID  []string         `json:"messageId"`
+	InReplyTo  []string         `json:"inReplyTo"`
+	References []string         `json:"references"`
+	TextBody   []bodyPartCreate `json:"textBody"`
+	HTMLBody   []bodyPartCreate `json:"htmlBody"`
+	BodyValues map[string]struct {
+		Value string `json:"value"`
+	} `json:"bodyValues"`
+	Attachments []attachmentCreate `json:"attachments"`
+}
+
+type emailAddress struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type bodyPartCreate struct {
+	PartID string `json:"partId"`
+}
+
+type attachmentCreate struct {
+	BlobID      string `json:"blobId"`
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Disposition string `json:"disposition"`
+	CID         string `json:"cid"`
+}
+
+// body returns the value of the first part of parts.
+func (r emailCreate) body(parts []bodyPartCreate) (value string, ok bool) {
+	if len(parts) == 0 {
+		return "", true
+	}
+	if len(parts) > 1 {
+		return "", false
+	}
+	v, ok := r.BodyValues[parts[0].PartID]
+
+	return v.Value, ok
+}
+
+// composeEmail returns a MIME message of v.
+func (r *call) composeEmail(v emailCreate) ([]byte, error) {
+	text, ok := v.body(v.TextBody)
+	if !ok {
+		return nil, invalidProperties("textBody should have a part in bodyValues", "textBody")
+	}
+	html, ok := v.body(v.HTMLBody)
+	if !ok {
+		return nil, invalidProperties("htmlBody should have a part in bodyValues", "htmlBody")
+	}
+
+	var msg bytes.Buffer
+	header := []struct {
+		name  string
+		value string
+	}{
+		{"From", formatAddresses(v.From)},
+		{"Sender", formatAddresses(v.Sender)},
+		{"To", formatAddresses(v.To)},
+		{"Cc", formatAddresses(v.Cc)},
+		{"Bcc", formatAddresses(v.Bcc)},
+		{"Reply-To", formatAddresses(v.ReplyTo)},
+		{"Subject", mime.QEncoding.Encode("utf-8", v.Subject)},
+		{"Date", date(v.SentAt)},
+		{"Message-ID", formatMessageIDs(v.MessageID)},
+		{"In-Reply-To", formatMessageIDs(v.InReplyTo)},
+		{"References", formatMessageIDs(v.References)},
+		{"MIME-Version", "1.0"},
+	}
+	for _, f := range header {
+		if len(f.value) == 0 {
+			if f.name != "Message-ID" {
+				continue
+			}
+			f.value = newMessageID(v.From)
+		}
+		msg.WriteString(fmt.Sprintf("%v: %v\r\n", f.name, f.value))
+	}
+
+	contentType, content, err := composeContent(text, html)
+	if err != nil {
+		return nil, err
+	}
+	if len(v.Attachments) == 0 {
+		msg.WriteString("Content-Type: " + contentType + "\r\n")
+		msg.Write(content)
+		return msg.Bytes(), nil
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err := writePart(w, contentType, content); err != nil {
+		return nil, err
+	}
+	for _, a := range v.Attachments {
+		data, found, err := r.getBlob(a.BlobID)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, &setError{Type: "blobNotFound", Description: fmt.Sprintf("Unknown blob: %v", a.BlobID), Properties: []string{"attachments"}}
+		}
+		if err := writeAttachment(w, a, data); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	msg.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%q\r\n\r\n", w.Boundary()))
+	msg.Write(buf.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+// composeContent returns the Content-Type and the rest of the header and the
+// body of the text and HTML bodies, which are alternatives if both exist.
+func composeContent(text, html string) (contentType string, content []byte, err error) {
+	if len(html) == 0 || len(text) == 0 {
+		contentType = "text/plain; charset=utf-8"
+		if len(html) > 0 {
+			contentType, text = "text/html; charset=utf-8", html
+		}
+		content, err = encodeText(text)
+		return contentType, content, err
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, v := range []struct {
+		contentType string
+		value       string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		content, err := encodeText(v.value)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := writePart(w, v.contentType, content); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+
+	return fmt.Sprintf("multipart/alternative; boundary=%q", w.Boundary()), append([]byte("\r\n"), buf.Bytes()...), nil
+}
+
+// encodeText returns the Content-Transfer-Encoding header, a blank line, and
+// the quoted-printable encoded value.
+func encodeText(value string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(value)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writePart writes a part whose content has the rest of the header after the
+// Content-Type.
+func writePart(w *multipart.Writer, contentType string, content []byte) error {
+	// The multipart writer writes the header by itself, so the header field
+	// in content, if any, is moved into the part header.
+	h := textproto.MIMEHeader{"Content-Type": {contentType}}
+	i := bytes.Index(content, []byte("\r\n"))
+	body := content[i+2:]
+	if i > 0 {
+		field := strings.SplitN(string(content[:i]), ":", 2)
+		h.Set(field[0], strings.TrimSpace(field[1]))
+		body = bytes.TrimPrefix(body, []byte("\r\n"))
+	}
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(body)
+
+	return err
+}
+
+func writeAttachment(w *multipart.Writer, a attachmentCreate, data []byte) error {
+	contentType := a.Type
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if a.Disposition == "inline" {
+		disposition = "inline"
+	}
+	if len(a.Name) > 0 {
+		params := map[string]string{"filename": a.Name}
+		if v := mime.FormatMediaType(disposition, params); len(v) > 0 {
+			disposition = v
+		}
+	}
+	h := textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Disposition":       {disposition},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+	if len(a.CID) > 0 {
+		h.Set("Content-ID", "<"+a.CID+">")
+	}
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	// Wrap lines at 76 characters.
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := part.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = part.Write([]byte(encoded + "\r\n"))
+
+	return err
+}
+
+func formatAddresses(list []emailAddress) string {
+	result := make([]string, len(list))
+	for i, v := range list {
+		result[i] = (&mail.Address{Name: v.Name, Address: v.Email}).String()
+	}
+
+	return strings.Join(result, ", ")
+}
+
+func formatMessageIDs(ids []string) string {
+	result := make([]string, len(ids))
+	for i, v := range ids {
+		result[i] = "<" + v + ">"
+	}
+
+	return strings.Join(result, " ")
+}
+
+func date(t *time.Time) string {
+	if t == nil {
+		return time.Now().Format(time.RFC1123Z)
+	}
+
+	return t.Format(time.RFC1123Z)
+}
+
+// newMessageID returns a new message ID whose domain is the domain of the first
+// sender.
+func newMessageID(from []emailAddress) string {
+	domain := "localhost"
+	if len(from) > 0 {
+		if i := strings.LastIndexByte(from[0].Email, '@'); i >= 0 {
+			domain = from[0].Email[i+1:]
+		}
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+
+	return fmt.Sprintf("<%v@%v>", hex.EncodeToString(buf), domain)
+}
+
+// parseMessage parses the header of raw, and returns false if raw is not an email.
+func parseMessage(raw []byte) (mail.Header, bool) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil || len(m.Header) == 0 {
+		return nil, false
+	}
+
+	return m.Header, true
+}
+
+// normalizeCRLF converts bare LFs of msg into CRLFs.
+func normalizeCRLF(msg []byte) []byte {
+	if !bytes.Contains(msg, []byte("\n")) || bytes.Count(msg, []byte("\n")) == bytes.Count(msg, []byte("\r\n")) {
+		return msg
+	}
+
+	var buf bytes.Buffer
+	for i, c := range msg {
+		if c == '\n' && (i == 0 || msg[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(c)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,562 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/jhillyerd/go.enmime"
+)
+
+const (
+	maxPreviewLength = 256
+	// Part IDs of the text and HTML bodies.
+	textPartID = "1"
+	htmlPartID = "2"
+)
+
+var (
+	emailProperties = []string{
+		"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+		"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+		"replyTo", "subject", "sentAt", "hasAttachment", "preview", "bodyValues",
+		"textBody", "htmlBody", "attachments",
+	}
+	// Properties that need the raw email.
+	emailRawProperties = []string{
+		"size", "messageId", "inReplyTo", "references", "sender", "bcc", "preview",
+		"bodyValues", "textBody", "htmlBody",
+	}
+)
+
+func threadID(emailID uint64) string {
+	return "T" + formatID(emailID)
+}
+
+// parsedEmail is a raw email and its parsed MIME structure, which can be nil
+// if the email is malformed.
+type parsedEmail struct {
+	raw    []byte
+	header mail.Header
+	mime   *enmime.MIMEBody
+}
+
+func (r *call) parseEmail(e *emailEntry) (*parsedEmail, error) {
+	raw, err := r.emailManager(e.folderID).GetRawEmail(e.email.ID, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &parsedEmail{raw: raw, header: mail.Header{}}
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return result, nil
+	}
+	result.header = m.Header
+	if result.mime, err = enmime.ParseMIMEBody(m); err != nil {
+		result.mime = nil
+	}
+
+	return result, nil
+}
+
+func (r *parsedEmail) text() string {
+	if r.mime == nil {
+		return ""
+	}
+
+	return r.mime.Text
+}
+
+func (r *parsedEmail) html() string {
+	if r.mime == nil {
+		return ""
+	}
+
+	return r.mime.HTML
+}
+
+func (r *parsedEmail) addresses(name string) interface{} {
+	list, err := r.header.AddressList(name)
+	if err != nil || len(list) == 0 {
+		return nil
+	}
+	result := make([]map[string]interface{}, len(list))
+	for i, v := range list {
+		result[i] = addressObject(v.Name, v.Address)
+	}
+
+	return result
+}
+
+// messageIDs returns the message IDs of the header field without the angle
+// brackets, or nil if there is no message ID.
+func (r *parsedEmail) messageIDs(name string) interface{} {
+	result := []string{}
+	v := r.header.Get(name)
+	for {
+		start := strings.IndexByte(v, '<')
+		end := strings.IndexByte(v, '>')
+		if start < 0 || end < start {
+			break
+		}
+		result = append(result, v[start+1:end])
+		v = v[end+1:]
+	}
+	if len(result) == 0 {
+		return nil
+	}
+
+	return result
+}
+
+func addressObject(name, address string) map[string]interface{} {
+	result := map[string]interface{}{"name": nil, "email": address}
+	if len(name) > 0 {
+		result["name"] = name
+	}
+
+	return result
+}
+
+func addressList(list []backend.EmailAddress) interface{} {
+	if len(list) == 0 {
+		return nil
+	}
+	result := make([]map[string]interface{}, len(list))
+	for i, v := range list {
+		result[i] = addressObject(v.Name, v.Address)
+	}
+
+	return result
+}
+
+func utcDate(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func preview(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= maxPreviewLength {
+		return text
+	}
+
+	return string([]rune(text)[:maxPreviewLength])
+}
+
+func keywords(index *emailIndex, e *emailEntry) map[string]bool {
+	result := map[string]bool{}
+	if e.email.Seen {
+		result["$seen"] = true
+	}
+	if f, ok := index.folder(e.folderID); ok && f.Type == backend.EmailDraft {
+		result["$draft"] = true
+	}
+
+	return result
+}
+
+type bodyOptions struct {
+	FetchTextBodyValues bool `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool `json:"fetchAllBodyValues"`
+	// Zero MaxBodyValueBytes means no limit.
+	MaxBodyValueBytes int `json:"maxBodyValueBytes"`
+}
+
+func bodyPart(emailID uint64, partID, contentType, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"partId":      partID,
+		"blobId":      fmt.Sprintf("B%v.%v", emailID, partID),
+		"size":        len(value),
+		"name":        nil,
+		"type":        contentType,
+		"charset":     "utf-8",
+		"disposition": nil,
+		"cid":         nil,
+	}
+}
+
+func bodyValue(value string, max int) map[string]interface{} {
+	truncated := false
+	if max > 0 && len(value) > max {
+		// Do not break a UTF-8 sequence.
+		for max > 0 && !utf8.RuneStart(value[max]) {
+			max--
+		}
+		value = value[:max]
+		truncated = true
+	}
+
+	return map[string]interface{}{
+		"value":             value,
+		"isEncodingProblem": false,
+		"isTruncated":       truncated,
+	}
+}
+
+func attachmentParts(e *emailEntry) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, v := range e.email.Attachments {
+		var name, cid interface{}
+		if len(v.Name()) > 0 {
+			name = v.Name()
+		}
+		if len(v.ContentID()) > 0 {
+			cid = v.ContentID()
+		}
+		disposition := "attachment"
+		if v.IsInline() {
+			disposition = "inline"
+		}
+		result = append(result, map[string]interface{}{
+			"partId":      fmt.Sprintf("a%v", v.ID()),
+			"blobId":      fmt.Sprintf("A%v.%v", e.email.ID, v.ID()),
+			"size":        v.Size(),
+			"name":        name,
+			"type":        v.ContentType(),
+			"charset":     nil,
+			"disposition": disposition,
+			"cid":         cid,
+		})
+	}
+
+	return result
+}
+
+func hasAttachment(e *emailEntry) bool {
+	for _, v := range e.email.Attachments {
+		if !v.IsInline() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emailObject returns the properties of e. The raw email is loaded only if
+// properties need it.
+func (r *call) emailObject(index *emailIndex, e *emailEntry, properties []string, opts bodyOptions) (map[string]interface{}, error) {
+	v := e.email
+	result := map[string]interface{}{
+		"id":            formatID(v.ID),
+		"blobId":        "M" + formatID(v.ID),
+		"threadId":      threadID(v.ID),
+		"mailboxIds":    map[string]bool{formatID(e.folderID): true},
+		"keywords":      keywords(index, e),
+		"receivedAt":    utcDate(v.Date),
+		"sentAt":        v.Date.Format(time.RFC3339),
+		"from":          addressList([]backend.EmailAddress{v.From}),
+		"to":            addressList(v.To),
+		"cc":            addressList(v.Cc),
+		"replyTo":       addressList(v.ReplyTo),
+		"subject":       v.Subject,
+		"hasAttachment": hasAttachment(e),
+		"attachments":   attachmentParts(e),
+	}
+	if len(v.From.Address) == 0 {
+		result["from"] = nil
+	}
+
+	needRaw := false
+	for _, p := range properties {
+		if hasString(emailRawProperties, p) {
+			needRaw = true
+		}
+	}
+	if !needRaw {
+		return result, nil
+	}
+
+	parsed, err := r.parseEmail(e)
+	if err != nil {
+		return nil, err
+	}
+	text, html := parsed.text(), parsed.html()
+	textBody := []map[string]interface{}{}
+	htmlBody := []map[string]interface{}{}
+	if len(text) > 0 {
+		textBody = append(textBody, bodyPart(v.ID, textPartID, "text/plain", text))
+	}
+	if len(html) > 0 {
+		htmlBody = append(htmlBody, bodyPart(v.ID, htmlPartID, "text/html", html))
+	}
+	// Each body falls back to the other if it does not exist.
+	if len(textBody) == 0 {
+		textBody = htmlBody
+	}
+	if len(htmlBody) == 0 {
+		htmlBody = textBody
+	}
+	values := map[string]interface{}{}
+	if len(text) > 0 && (opts.FetchTextBodyValues || opts.FetchAllBodyValues || (opts.FetchHTMLBodyValues && len(html) == 0)) {
+		values[textPartID] = bodyValue(text, opts.MaxBodyValueBytes)
+	}
+	if len(html) > 0 && (opts.FetchHTMLBodyValues || opts.FetchAllBodyValues || (opts.FetchTextBodyValues && len(text) == 0)) {
+		values[htmlPartID] = bodyValue(html, opts.MaxBodyValueBytes)
+	}
+
+	result["size"] = len(parsed.raw)
+	result["messageId"] = parsed.messageIDs("Message-Id")
+	result["inReplyTo"] = parsed.messageIDs("In-Reply-To")
+	result["references"] = parsed.messageIDs("References")
+	result["sender"] = parsed.addresses("Sender")
+	result["bcc"] = parsed.addresses("Bcc")
+	result["preview"] = preview(text)
+	result["textBody"] = textBody
+	result["htmlBody"] = htmlBody
+	result["bodyValues"] = values
+	if date, err := parsed.header.Date(); err == nil {
+		result["sentAt"] = date.Format(time.RFC3339)
+	}
+
+	return result, nil
+}
+
+func handleEmailGet(r *call, args json.RawMessage) (interface{}, error) {
+	req := struct {
+		getRequest
+		bodyOptions
+	}{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	if err := checkProperties(req.Properties, emailProperties); err != nil {
+		return nil, err
+	}
+	properties := emailProperties
+	if req.Properties != nil {
+		properties = *req.Properties
+	}
+
+	state, err := r.emailState()
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	if req.IDs != nil {
+		ids = *req.IDs
+	} else {
+		for _, v := range index.list {
+			ids = append(ids, formatID(v.email.ID))
+		}
+	}
+	if len(ids) > maxObjectsInGet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+
+	resp := getResponse{AccountID: req.AccountID, State: state, List: []map[string]interface{}{}, NotFound: []string{}}
+	for _, id := range ids {
+		e, ok := index.emails[parseID(id)]
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		obj, err := r.emailObject(index, e, properties, req.bodyOptions)
+		if err != nil {
+			return nil, err
+		}
+		resp.List = append(resp.List, selectProperties(obj, req.Properties, emailProperties))
+	}
+
+	return resp, nil
+}
+
+// emailChanges returns the changes of emails since req.SinceState, and the new
+// state. A moved email is reported as updated because its ID is not changed.
+func (r *call) emailChanges(req changesRequest) (changes *changeSet, newState string, hasMore bool, err error) {
+	since, err := strconv.ParseUint(req.SinceState, 10, 64)
+	if err != nil {
+		return nil, "", false, &methodError{Type: "cannotCalculateChanges"}
+	}
+	last, err := r.lastEmailHistory()
+	if err != nil {
+		return nil, "", false, err
+	}
+	if since > last {
+		return nil, "", false, &methodError{Type: "cannotCalculateChanges"}
+	}
+
+	// Query one more history not to split the pair of histories of a moved email.
+	n := uint64(0)
+	if req.MaxChanges > 0 {
+		n = req.MaxChanges + 2
+	}
+	histories, err := r.emailManager(0).GetEmailHistories(since+1, n, false, database.LockNone)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if req.MaxChanges > 0 && uint64(len(histories)) > req.MaxChanges {
+		end := req.MaxChanges
+		if isMove(histories[end-1], histories[end]) {
+			end++
+		}
+		hasMore = uint64(len(histories)) > end
+		histories = histories[:end]
+	}
+
+	changes = newChangeSet()
+	newState = req.SinceState
+	for _, v := range histories {
+		email, err := v.Value()
+		if err != nil {
+			return nil, "", false, err
+		}
+		id := formatID(email.ID)
+		switch v.Operation() {
+		case backend.EmailAdd:
+			// The email has been moved if it has been deleted before.
+			if changes.destroyed[id] {
+				delete(changes.destroyed, id)
+				changes.updated[id] = true
+			} else {
+				changes.add(id)
+			}
+		case backend.EmailDelete:
+			changes.remove(id)
+		default:
+			changes.update(id)
+		}
+		newState = formatID(v.ID())
+	}
+
+	return changes, newState, hasMore, nil
+}
+
+// isMove returns whether h1 and h2 are the histories of a moved email.
+func isMove(h1, h2 backend.EmailHistory) bool {
+	if h1.Operation() != backend.EmailDelete || h2.Operation() != backend.EmailAdd {
+		return false
+	}
+	e1, err1 := h1.Value()
+	e2, err2 := h2.Value()
+
+	return err1 == nil && err2 == nil && e1.ID == e2.ID
+}
+
+func handleEmailChanges(r *call, args json.RawMessage) (interface{}, error) {
+	req := changesRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	changes, state, hasMore, err := r.emailChanges(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := newChangesResponse(req)
+	changes.fill(&resp)
+	resp.NewState = state
+	resp.HasMoreChanges = hasMore
+
+	return resp, nil
+}
+
+func handleThreadGet(r *call, args json.RawMessage) (interface{}, error) {
+	req := getRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	if err := checkProperties(req.Properties, []string{"id", "emailIds"}); err != nil {
+		return nil, err
+	}
+	if req.IDs == nil {
+		return nil, invalidArguments("ids should be specified")
+	}
+	if len(*req.IDs) > maxObjectsInGet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+
+	state, err := r.emailState()
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	resp := getResponse{AccountID: req.AccountID, State: state, List: []map[string]interface{}{}, NotFound: []string{}}
+	for _, id := range *req.IDs {
+		emailID := uint64(0)
+		if strings.HasPrefix(id, "T") {
+			emailID = parseID(id[1:])
+		}
+		if _, ok := index.emails[emailID]; !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		obj := map[string]interface{}{"id": id, "emailIds": []string{formatID(emailID)}}
+		resp.List = append(resp.List, selectProperties(obj, req.Properties, []string{"emailIds"}))
+	}
+
+	return resp, nil
+}
+
+// handleThreadChanges reports the threads of created and destroyed emails.
+// Threads are never updated because each of them has only one email.
+func handleThreadChanges(r *call, args json.RawMessage) (interface{}, error) {
+	req := changesRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	changes, state, hasMore, err := r.emailChanges(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := newChangesResponse(req)
+	for _, v := range sortedKeys(changes.created) {
+		resp.Created = append(resp.Created, threadID(parseID(v)))
+	}
+	for _, v := range sortedKeys(changes.destroyed) {
+		resp.Destroyed = append(resp.Destroyed, threadID(parseID(v)))
+	}
+	resp.NewState = state
+	resp.HasMoreChanges = hasMore
+
+	return resp, nil
+}
@@ -0,0 +1,410 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+)
+
+var (
+	emailCreateProperties = []string{
+		"mailboxIds", "keywords", "from", "sender", "to", "cc", "bcc", "replyTo",
+		"subject", "sentAt", "messageId", "inReplyTo", "references", "textBody",
+		"htmlBody", "bodyValues", "attachments",
+	}
+)
+
+func handleEmailSet(r *call, args json.RawMessage) (interface{}, error) {
+	req := setRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+
+	return r.setEmails(req)
+}
+
+func (r *call) setEmails(req setRequest) (interface{}, error) {
+	state, err := r.emailState()
+	if err != nil {
+		return nil, err
+	}
+	if req.IfInState != nil && *req.IfInState != state {
+		return nil, &methodError{Type: "stateMismatch"}
+	}
+	resp := newSetResponse(req.AccountID, state)
+	if err := resp.checkSize(req); err != nil {
+		return nil, err
+	}
+
+	creates := make([]string, 0, len(req.Create))
+	for k := range req.Create {
+		creates = append(creates, k)
+	}
+	sort.Strings(creates)
+	for _, cid := range creates {
+		created, err := r.createEmail(req.Create[cid])
+		if err != nil {
+			e, ok := err.(*setError)
+			if !ok {
+				return nil, err
+			}
+			resp.NotCreated[cid] = e
+			continue
+		}
+		r.created[cid] = created["id"].(string)
+		resp.Created[cid] = created
+	}
+	if len(resp.Created) > 0 {
+		r.invalidate()
+	}
+	for id, patch := range req.Update {
+		if err := r.updateEmail(id, patch); err != nil {
+			e, ok := err.(*setError)
+			if !ok {
+				return nil, err
+			}
+			resp.NotUpdated[id] = e
+			continue
+		}
+		resp.Updated[id] = nil
+	}
+	for _, id := range req.Destroy {
+		if err := r.destroyEmail(id); err != nil {
+			e, ok := err.(*setError)
+			if !ok {
+				return nil, err
+			}
+			resp.NotDestroyed[id] = e
+			continue
+		}
+		resp.Destroyed = append(resp.Destroyed, id)
+	}
+
+	r.invalidate()
+	if resp.NewState, err = r.emailState(); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// mailboxID returns the ID of the only mailbox in mailboxIds because an email
+// belongs to only one folder.
+func (r *call) mailboxID(index *emailIndex, mailboxIDs map[string]bool) (uint64, error) {
+	ids := make([]string, 0)
+	for k, v := range mailboxIDs {
+		if v {
+			ids = append(ids, k)
+		}
+	}
+	if len(ids) != 1 {
+		return 0, invalidProperties("An email should be in exactly one mailbox", "mailboxIds")
+	}
+	id, ok := r.resolveID(ids[0])
+	if !ok {
+		return 0, invalidProperties("Mailbox does not exist", "mailboxIds")
+	}
+	f, ok := index.folder(parseID(id))
+	if !ok {
+		return 0, invalidProperties("Mailbox does not exist", "mailboxIds")
+	}
+	if f.Type == backend.EmailOutbox {
+		return 0, invalidProperties("Emails cannot be added to the outbox", "mailboxIds")
+	}
+
+	return f.ID, nil
+}
+
+// checkKeywords returns whether keywords has $seen. Other keywords except
+// $draft, which depends on the mailbox, are not supported.
+func checkKeywords(keywords map[string]bool) (seen bool, err error) {
+	for k, v := range keywords {
+		switch strings.ToLower(k) {
+		case "$seen":
+			seen = v
+		case "$draft":
+		default:
+			return false, invalidProperties(fmt.Sprintf("Unsupported keyword: %v", k), "keywords")
+		}
+	}
+
+	return seen, nil
+}
+
+// addEmail adds raw into the folder whose ID is folderID, and returns the
+// properties of the new email set by the server.
+func (r *call) addEmail(folderID uint64, raw []byte, seen bool) (map[string]interface{}, error) {
+	em := r.emailManager(folderID)
+	email, err := em.AddEmail(normalizeCRLF(raw))
+	if err != nil {
+		return nil, err
+	}
+	if seen {
+		if err := em.UpdateEmail(email.ID, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]interface{}{
+		"id":       formatID(email.ID),
+		"blobId":   "M" + formatID(email.ID),
+		"threadId": threadID(email.ID),
+		"size":     len(raw),
+	}, nil
+}
+
+func (r *call) createEmail(data json.RawMessage) (map[string]interface{}, error) {
+	props := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &props); err != nil {
+		return nil, invalidProperties(err.Error())
+	}
+	for k := range props {
+		// Header fields are not supported.
+		if !hasString(emailCreateProperties, k) {
+			return nil, invalidProperties(fmt.Sprintf("%v cannot be set", k), k)
+		}
+	}
+	v := emailCreate{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, invalidProperties(err.Error())
+	}
+
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	folderID, err := r.mailboxID(index, v.MailboxIDs)
+	if err != nil {
+		return nil, err
+	}
+	seen, err := checkKeywords(v.Keywords)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := r.composeEmail(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.addEmail(folderID, raw, seen)
+}
+
+// updateEmail applies patch to the email whose ID is id. Only mailboxIds and
+// the $seen keyword can be changed.
+func (r *call) updateEmail(id string, patch map[string]json.RawMessage) error {
+	resolved, ok := r.resolveID(id)
+	if !ok {
+		return &setError{Type: "notFound"}
+	}
+	index, err := r.loadIndex()
+	if err != nil {
+		return err
+	}
+	e, ok := index.emails[parseID(resolved)]
+	if !ok {
+		return &setError{Type: "notFound"}
+	}
+
+	mailboxIDs := map[string]bool{formatID(e.folderID): true}
+	keywords := keywords(index, e)
+	for k, value := range patch {
+		switch {
+		case k == "mailboxIds":
+			mailboxIDs = map[string]bool{}
+			if err := json.Unmarshal(value, &mailboxIDs); err != nil {
+				return invalidProperties("Invalid mailboxIds", "mailboxIds")
+			}
+		case strings.HasPrefix(k, "mailboxIds/"):
+			if err := patchSet(mailboxIDs, strings.TrimPrefix(k, "mailboxIds/"), value); err != nil {
+				return invalidProperties("Invalid mailboxIds", "mailboxIds")
+			}
+		case k == "keywords":
+			keywords = map[string]bool{}
+			if err := json.Unmarshal(value, &keywords); err != nil {
+				return invalidProperties("Invalid keywords", "keywords")
+			}
+		case strings.HasPrefix(k, "keywords/"):
+			if err := patchSet(keywords, strings.TrimPrefix(k, "keywords/"), value); err != nil {
+				return invalidProperties("Invalid keywords", "keywords")
+			}
+		default:
+			return invalidProperties(fmt.Sprintf("%v cannot be changed", k), k)
+		}
+	}
+	folderID := e.folderID
+	// The email can stay in the outbox.
+	if len(mailboxIDs) != 1 || !mailboxIDs[formatID(e.folderID)] {
+		if folderID, err = r.mailboxID(index, mailboxIDs); err != nil {
+			return err
+		}
+	}
+	seen, err := checkKeywords(keywords)
+	if err != nil {
+		return err
+	}
+
+	if folderID != e.folderID {
+		if from, _ := index.folder(e.folderID); from.Type == backend.EmailOutbox {
+			return &setError{Type: "forbidden", Description: "Emails in the outbox cannot be moved"}
+		}
+		if _, err := r.emailManager(e.folderID).MoveEmail(e.email.ID, folderID); err != nil {
+			return err
+		}
+		e.folderID = folderID
+	}
+	if seen != e.email.Seen {
+		if err := r.emailManager(e.folderID).UpdateEmail(e.email.ID, seen); err != nil {
+			return err
+		}
+		e.email.Seen = seen
+	}
+
+	return nil
+}
+
+// patchSet applies a patch of a set, whose value is true to add or null to
+// remove the key.
+func patchSet(set map[string]bool, key string, value json.RawMessage) error {
+	switch strings.TrimSpace(string(value)) {
+	case "true":
+		set[key] = true
+	case "null", "false":
+		delete(set, key)
+	default:
+		return fmt.Errorf("invalid patch value: %v", string(value))
+	}
+
+	return nil
+}
+
+func (r *call) destroyEmail(id string) error {
+	resolved, ok := r.resolveID(id)
+	if !ok {
+		return &setError{Type: "notFound"}
+	}
+	index, err := r.loadIndex()
+	if err != nil {
+		return err
+	}
+	e, ok := index.emails[parseID(resolved)]
+	if !ok {
+		return &setError{Type: "notFound"}
+	}
+	if f, _ := index.folder(e.folderID); f.Type == backend.EmailOutbox {
+		return &setError{Type: "forbidden", Description: "Emails in the outbox cannot be destroyed"}
+	}
+	if err := r.emailManager(e.folderID).DeleteEmail(e.email.ID); err != nil {
+		return err
+	}
+	delete(index.emails, e.email.ID)
+
+	return nil
+}
+
+func handleEmailImport(r *call, args json.RawMessage) (interface{}, error) {
+	req := struct {
+		AccountID string  `json:"accountId"`
+		IfInState *string `json:"ifInState"`
+		Emails    map[string]struct {
+			BlobID     string          `json:"blobId"`
+			MailboxIDs map[string]bool `json:"mailboxIds"`
+			Keywords   map[string]bool `json:"keywords"`
+		} `json:"emails"`
+	}{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	state, err := r.emailState()
+	if err != nil {
+		return nil, err
+	}
+	if req.IfInState != nil && *req.IfInState != state {
+		return nil, &methodError{Type: "stateMismatch"}
+	}
+	if len(req.Emails) > maxObjectsInSet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := newSetResponse(req.AccountID, state)
+	for cid, v := range req.Emails {
+		created, err := r.importEmail(index, v.BlobID, v.MailboxIDs, v.Keywords)
+		if err != nil {
+			e, ok := err.(*setError)
+			if !ok {
+				return nil, err
+			}
+			resp.NotCreated[cid] = e
+			continue
+		}
+		r.created[cid] = created["id"].(string)
+		resp.Created[cid] = created
+	}
+	r.invalidate()
+	if resp.NewState, err = r.emailState(); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"accountId":  resp.AccountID,
+		"oldState":   resp.OldState,
+		"newState":   resp.NewState,
+		"created":    resp.Created,
+		"notCreated": resp.NotCreated,
+	}, nil
+}
+
+func (r *call) importEmail(index *emailIndex, blobID string, mailboxIDs, keywords map[string]bool) (map[string]interface{}, error) {
+	folderID, err := r.mailboxID(index, mailboxIDs)
+	if err != nil {
+		return nil, err
+	}
+	seen, err := checkKeywords(keywords)
+	if err != nil {
+		return nil, err
+	}
+	raw, found, err := r.getBlob(blobID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &setError{Type: "blobNotFound"}
+	}
+	if _, ok := parseMessage(raw); !ok {
+		return nil, &setError{Type: "invalidEmail", Description: "Blob is not a valid email"}
+	}
+
+	return r.addEmail(folderID, raw, seen)
+}
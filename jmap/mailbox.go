@@ -0,0 +1,743 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+)
+
+const (
+	maxMailboxNameSize = 255
+)
+
+var (
+	mailboxProperties = []string{
+		"id", "name", "parentId", "role", "sortOrder", "totalEmails", "unreadEmails",
+		"totalThreads", "unreadThreads", "myRights", "isSubscribed",
+	}
+	// Properties that are changed by emails.
+	mailboxCountProperties = []string{"totalEmails", "unreadEmails", "totalThreads", "unreadThreads"}
+	mailboxRoles           = map[backend.FolderType]string{
+		backend.EmailInbox: "inbox",
+		backend.EmailDraft: "drafts",
+		backend.EmailTrash: "trash",
+		backend.EmailSent:  "sent",
+		backend.EmailJunk:  "junk",
+	}
+)
+
+// roles returns the roles of folders. A role is given to only the first folder
+// of each type because a role should be unique in an account.
+func roles(folders []backend.Folder) map[uint64]string {
+	result := make(map[uint64]string)
+	assigned := make(map[backend.FolderType]bool)
+	for _, v := range folders {
+		role, ok := mailboxRoles[v.Type]
+		if !ok || assigned[v.Type] {
+			continue
+		}
+		result[v.ID] = role
+		assigned[v.Type] = true
+	}
+
+	return result
+}
+
+func mailboxObject(index *emailIndex, f backend.Folder, roles map[uint64]string) map[string]interface{} {
+	var parentID, role interface{}
+	if f.ParentID != 0 {
+		parentID = formatID(f.ParentID)
+	}
+	if v, ok := roles[f.ID]; ok {
+		role = v
+	}
+	// Special folders cannot be renamed nor deleted, and emails in the
+	// outbox are managed by the outbox worker.
+	special := f.Type != backend.EmailFolder
+	outbox := f.Type == backend.EmailOutbox
+	count := index.counts[f.ID]
+
+	return map[string]interface{}{
+		"id":            formatID(f.ID),
+		"name":          f.Name,
+		"parentId":      parentID,
+		"role":          role,
+		"sortOrder":     0,
+		"totalEmails":   count.total,
+		"unreadEmails":  count.unseen,
+		"totalThreads":  count.total,
+		"unreadThreads": count.unseen,
+		"myRights": map[string]bool{
+			"mayReadItems":   true,
+			"mayAddItems":    !outbox,
+			"mayRemoveItems": !outbox,
+			"maySetSeen":     true,
+			"maySetKeywords": false,
+			"mayCreateChild": true,
+			"mayRename":      !special,
+			"mayDelete":      !special,
+			"maySubmit":      true,
+		},
+		"isSubscribed": true,
+	}
+}
+
+func handleMailboxGet(r *call, args json.RawMessage) (interface{}, error) {
+	req := getRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	if err := checkProperties(req.Properties, mailboxProperties); err != nil {
+		return nil, err
+	}
+	if req.IDs != nil && len(*req.IDs) > maxObjectsInGet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+
+	state, err := r.mailboxState()
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	roles := roles(index.folders)
+	resp := getResponse{AccountID: req.AccountID, State: state, List: []map[string]interface{}{}, NotFound: []string{}}
+	if req.IDs == nil {
+		for _, v := range index.folders {
+			resp.List = append(resp.List, selectProperties(mailboxObject(index, v, roles), req.Properties, mailboxProperties))
+		}
+		return resp, nil
+	}
+	for _, id := range *req.IDs {
+		f, ok := index.folder(parseID(id))
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		resp.List = append(resp.List, selectProperties(mailboxObject(index, f, roles), req.Properties, mailboxProperties))
+	}
+
+	return resp, nil
+}
+
+type mailboxChangesResponse struct {
+	changesResponse
+	UpdatedProperties []string `json:"updatedProperties"`
+}
+
+func handleMailboxChanges(r *call, args json.RawMessage) (interface{}, error) {
+	req := changesRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	sinceFolder, sinceEmail, ok := parseMailboxState(req.SinceState)
+	if !ok {
+		return nil, &methodError{Type: "cannotCalculateChanges"}
+	}
+	lastFolder, err := r.lastFolderHistory()
+	if err != nil {
+		return nil, err
+	}
+	lastEmail, err := r.lastEmailHistory()
+	if err != nil {
+		return nil, err
+	}
+	if sinceFolder > lastFolder || sinceEmail > lastEmail {
+		return nil, &methodError{Type: "cannotCalculateChanges"}
+	}
+
+	resp := mailboxChangesResponse{changesResponse: newChangesResponse(req)}
+	histories, err := r.folderManager().GetFolderHistories(sinceFolder+1, limit(req.MaxChanges), false, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	if req.MaxChanges > 0 && uint64(len(histories)) > req.MaxChanges {
+		histories = histories[:req.MaxChanges]
+		resp.HasMoreChanges = true
+	}
+	changes := newChangeSet()
+	newFolder := sinceFolder
+	for _, v := range histories {
+		f, err := v.Value()
+		if err != nil {
+			return nil, err
+		}
+		switch v.Operation() {
+		case backend.FolderAdd:
+			changes.add(formatID(f.ID))
+		case backend.FolderUpdate:
+			changes.update(formatID(f.ID))
+		case backend.FolderDelete:
+			changes.remove(formatID(f.ID))
+		}
+		newFolder = v.ID()
+	}
+
+	// The counts of all the mailboxes are reported as updated if any email
+	// has been changed since emails do not have their folder IDs.
+	newEmail := sinceEmail
+	if !resp.HasMoreChanges && lastEmail > sinceEmail {
+		index, err := r.loadIndex()
+		if err != nil {
+			return nil, err
+		}
+		countOnly := len(changes.updated) == 0
+		for _, f := range index.folders {
+			changes.touch(formatID(f.ID))
+		}
+		if req.MaxChanges > 0 && uint64(changes.size()) > req.MaxChanges {
+			return nil, &methodError{Type: "cannotCalculateChanges", Description: "too many mailboxes to report in maxChanges"}
+		}
+		if countOnly {
+			resp.UpdatedProperties = mailboxCountProperties
+		}
+		newEmail = lastEmail
+	}
+	changes.fill(&resp.changesResponse)
+	resp.NewState = formatMailboxState(newFolder, newEmail)
+
+	return resp, nil
+}
+
+// limit returns the number of histories to query for maxChanges. One more
+// history is queried to know whether there are more changes.
+func limit(maxChanges uint64) uint64 {
+	if maxChanges == 0 {
+		return 0
+	}
+
+	return maxChanges + 1
+}
+
+// changeSet accumulates changes of objects in order.
+type changeSet struct {
+	created   map[string]bool
+	updated   map[string]bool
+	destroyed map[string]bool
+	// touched has updated objects that are not created nor destroyed.
+	touched map[string]bool
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{
+		created:   make(map[string]bool),
+		updated:   make(map[string]bool),
+		destroyed: make(map[string]bool),
+		touched:   make(map[string]bool),
+	}
+}
+
+func (r *changeSet) add(id string) {
+	r.created[id] = true
+}
+
+func (r *changeSet) update(id string) {
+	if !r.created[id] {
+		r.updated[id] = true
+	}
+}
+
+func (r *changeSet) remove(id string) {
+	delete(r.updated, id)
+	// Objects created and destroyed in the changes are not reported at all.
+	if r.created[id] {
+		delete(r.created, id)
+		return
+	}
+	r.destroyed[id] = true
+}
+
+// touch marks id as updated if it exists and it is not created in the changes.
+func (r *changeSet) touch(id string) {
+	if r.created[id] || r.destroyed[id] {
+		return
+	}
+	r.touched[id] = true
+}
+
+func (r *changeSet) size() int {
+	n := len(r.created) + len(r.destroyed) + len(r.touched)
+	for id := range r.updated {
+		if !r.touched[id] {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (r *changeSet) fill(resp *changesResponse) {
+	for id := range r.touched {
+		r.updated[id] = true
+	}
+	resp.Created = sortedKeys(r.created)
+	resp.Updated = sortedKeys(r.updated)
+	resp.Destroyed = sortedKeys(r.destroyed)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+func handleMailboxQuery(r *call, args json.RawMessage) (interface{}, error) {
+	req := struct {
+		queryRequest
+		SortAsTree   bool `json:"sortAsTree"`
+		FilterAsTree bool `json:"filterAsTree"`
+	}{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	if req.SortAsTree {
+		return nil, &methodError{Type: "unsupportedSort", Description: "sortAsTree is not supported"}
+	}
+	if req.FilterAsTree {
+		return nil, &methodError{Type: "unsupportedFilter", Description: "filterAsTree is not supported"}
+	}
+	filter := struct {
+		ParentID     *json.RawMessage `json:"parentId"`
+		Name         *string          `json:"name"`
+		Role         *json.RawMessage `json:"role"`
+		HasAnyRole   *bool            `json:"hasAnyRole"`
+		IsSubscribed *bool            `json:"isSubscribed"`
+	}{}
+	if len(req.Filter) > 0 && string(req.Filter) != "null" {
+		if err := json.Unmarshal(req.Filter, &filter); err != nil {
+			return nil, &methodError{Type: "unsupportedFilter", Description: err.Error()}
+		}
+	}
+	for _, v := range req.Sort {
+		if v.Property != "name" && v.Property != "sortOrder" {
+			return nil, &methodError{Type: "unsupportedSort", Description: fmt.Sprintf("unsupported sort property: %v", v.Property)}
+		}
+	}
+
+	state, err := r.mailboxState()
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	roles := roles(index.folders)
+	folders := make([]backend.Folder, 0)
+	for _, v := range index.folders {
+		if filter.ParentID != nil {
+			parentID := ""
+			if err := json.Unmarshal(*filter.ParentID, &parentID); err != nil && string(*filter.ParentID) != "null" {
+				return nil, &methodError{Type: "unsupportedFilter", Description: "invalid parentId"}
+			}
+			if parentID != formatID(v.ParentID) && (len(parentID) > 0 || v.ParentID != 0) {
+				continue
+			}
+		}
+		if filter.Name != nil && !strings.Contains(strings.ToLower(v.Name), strings.ToLower(*filter.Name)) {
+			continue
+		}
+		role, hasRole := roles[v.ID]
+		if filter.Role != nil {
+			want := ""
+			if err := json.Unmarshal(*filter.Role, &want); err != nil && string(*filter.Role) != "null" {
+				return nil, &methodError{Type: "unsupportedFilter", Description: "invalid role"}
+			}
+			if want != role {
+				continue
+			}
+		}
+		if filter.HasAnyRole != nil && *filter.HasAnyRole != hasRole {
+			continue
+		}
+		if filter.IsSubscribed != nil && !*filter.IsSubscribed {
+			continue
+		}
+		folders = append(folders, v)
+	}
+	sort.SliceStable(folders, func(i, j int) bool {
+		for _, v := range req.Sort {
+			// sortOrder is always zero.
+			if v.Property != "name" || folders[i].Name == folders[j].Name {
+				continue
+			}
+			less := strings.ToLower(folders[i].Name) < strings.ToLower(folders[j].Name)
+			if !v.ascending() {
+				return !less
+			}
+			return less
+		}
+		return false
+	})
+
+	ids := make([]string, len(folders))
+	for i, v := range folders {
+		ids[i] = formatID(v.ID)
+	}
+
+	return paginate(ids, req.queryRequest, state)
+}
+
+type mailboxSetRequest struct {
+	setRequest
+	OnDestroyRemoveEmails bool `json:"onDestroyRemoveEmails"`
+}
+
+// mailboxValues is the properties of a mailbox that clients can set.
+type mailboxValues struct {
+	name     string
+	parentID uint64
+}
+
+func handleMailboxSet(r *call, args json.RawMessage) (interface{}, error) {
+	req := mailboxSetRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	state, err := r.mailboxState()
+	if err != nil {
+		return nil, err
+	}
+	if req.IfInState != nil && *req.IfInState != state {
+		return nil, &methodError{Type: "stateMismatch"}
+	}
+	resp := newSetResponse(req.AccountID, state)
+	if err := resp.checkSize(req.setRequest); err != nil {
+		return nil, err
+	}
+
+	if err := r.createMailboxes(req.Create, &resp); err != nil {
+		return nil, err
+	}
+	for id, patch := range req.Update {
+		if err := r.updateMailbox(id, patch); err != nil {
+			e, ok := err.(*setError)
+			if !ok {
+				return nil, err
+			}
+			resp.NotUpdated[id] = e
+			continue
+		}
+		resp.Updated[id] = nil
+	}
+	for _, id := range req.Destroy {
+		if err := r.destroyMailbox(id, req.OnDestroyRemoveEmails); err != nil {
+			e, ok := err.(*setError)
+			if !ok {
+				return nil, err
+			}
+			resp.NotDestroyed[id] = e
+			continue
+		}
+		resp.Destroyed = append(resp.Destroyed, id)
+	}
+
+	r.invalidate()
+	if resp.NewState, err = r.mailboxState(); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// createMailboxes creates mailboxes in the order of their parents because a
+// parent can be a mailbox created in the same call.
+func (r *call) createMailboxes(create map[string]json.RawMessage, resp *setResponse) error {
+	pending := make([]string, 0, len(create))
+	for k := range create {
+		pending = append(pending, k)
+	}
+	sort.Strings(pending)
+
+	for len(pending) > 0 {
+		next := make([]string, 0)
+		for _, cid := range pending {
+			v, e := parseMailboxCreate(create[cid])
+			if e != nil {
+				resp.NotCreated[cid] = e
+				continue
+			}
+			parentID, ok := r.resolveID(v.parentID)
+			if !ok {
+				// The parent can be created later.
+				next = append(next, cid)
+				continue
+			}
+			id, err := r.createMailbox(mailboxValues{name: v.name, parentID: parseID(parentID)}, len(parentID) > 0)
+			if err != nil {
+				e, ok := err.(*setError)
+				if !ok {
+					return err
+				}
+				resp.NotCreated[cid] = e
+				continue
+			}
+			r.created[cid] = formatID(id)
+			resp.Created[cid] = map[string]interface{}{
+				"id":            formatID(id),
+				"role":          nil,
+				"sortOrder":     0,
+				"totalEmails":   0,
+				"unreadEmails":  0,
+				"totalThreads":  0,
+				"unreadThreads": 0,
+				"isSubscribed":  true,
+			}
+		}
+		// No progress?
+		if len(next) == len(pending) {
+			for _, cid := range next {
+				resp.NotCreated[cid] = invalidProperties("Parent mailbox does not exist", "parentId")
+			}
+			break
+		}
+		pending = next
+	}
+
+	return nil
+}
+
+type mailboxCreate struct {
+	name     string
+	parentID string
+}
+
+func parseMailboxCreate(data json.RawMessage) (mailboxCreate, *setError) {
+	props := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &props); err != nil {
+		return mailboxCreate{}, invalidProperties(err.Error())
+	}
+	result := mailboxCreate{}
+	for k, v := range props {
+		switch k {
+		case "name":
+			if err := json.Unmarshal(v, &result.name); err != nil {
+				return mailboxCreate{}, invalidProperties("Invalid name", "name")
+			}
+		case "parentId":
+			if string(v) == "null" {
+				continue
+			}
+			if err := json.Unmarshal(v, &result.parentID); err != nil {
+				return mailboxCreate{}, invalidProperties("Invalid parentId", "parentId")
+			}
+		case "role", "sortOrder", "isSubscribed":
+			if !isDefaultMailboxValue(k, v) {
+				return mailboxCreate{}, invalidProperties(fmt.Sprintf("%v cannot be changed", k), k)
+			}
+		default:
+			return mailboxCreate{}, invalidProperties(fmt.Sprintf("%v cannot be set", k), k)
+		}
+	}
+
+	return result, nil
+}
+
+// isDefaultMailboxValue returns whether v is the fixed value of property k.
+func isDefaultMailboxValue(k string, v json.RawMessage) bool {
+	s := strings.TrimSpace(string(v))
+	switch k {
+	case "role":
+		return s == "null"
+	case "sortOrder":
+		return s == "0"
+	case "isSubscribed":
+		return s == "true"
+	default:
+		return false
+	}
+}
+
+// createMailbox adds a new folder. hasParent is false if the folder is created
+// at the top level.
+func (r *call) createMailbox(v mailboxValues, hasParent bool) (uint64, error) {
+	fm := r.folderManager()
+	folders, err := fm.GetFolders(database.LockWrite)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkMailboxValues(folders, 0, v, hasParent); err != nil {
+		return 0, err
+	}
+
+	return fm.AddFolder(v.parentID, v.name, backend.EmailFolder)
+}
+
+// checkMailboxValues validates the name and parent of the folder whose ID is
+// id, which is zero for a new folder.
+func checkMailboxValues(folders []backend.Folder, id uint64, v mailboxValues, hasParent bool) error {
+	if len(strings.TrimSpace(v.name)) == 0 || len(v.name) > maxMailboxNameSize {
+		return invalidProperties("Invalid mailbox name", "name")
+	}
+	if hasParent {
+		if !hasFolder(folders, v.parentID) {
+			return invalidProperties("Parent mailbox does not exist", "parentId")
+		}
+		// A mailbox cannot be moved under itself.
+		for p := v.parentID; p != 0; p = parentOf(folders, p) {
+			if p == id {
+				return invalidProperties("Mailbox cannot be moved under itself", "parentId")
+			}
+		}
+	}
+	for _, f := range folders {
+		if f.ID != id && f.ParentID == v.parentID && f.Name == v.name {
+			return &setError{Type: "alreadyExists", Description: "Mailbox already exists", Properties: []string{"name"}}
+		}
+	}
+
+	return nil
+}
+
+func hasFolder(folders []backend.Folder, id uint64) bool {
+	for _, v := range folders {
+		if v.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parentOf(folders []backend.Folder, id uint64) uint64 {
+	for _, v := range folders {
+		if v.ID == id {
+			return v.ParentID
+		}
+	}
+
+	return 0
+}
+
+func (r *call) updateMailbox(id string, patch map[string]json.RawMessage) error {
+	fm := r.folderManager()
+	folders, err := fm.GetFolders(database.LockWrite)
+	if err != nil {
+		return err
+	}
+	folderID := parseID(id)
+	var folder backend.Folder
+	for _, v := range folders {
+		if v.ID == folderID {
+			folder = v
+		}
+	}
+	if folder.ID == 0 {
+		return &setError{Type: "notFound"}
+	}
+
+	v := mailboxValues{name: folder.Name, parentID: folder.ParentID}
+	hasParent := folder.ParentID != 0
+	for k, value := range patch {
+		switch k {
+		case "name":
+			if err := json.Unmarshal(value, &v.name); err != nil {
+				return invalidProperties("Invalid name", "name")
+			}
+		case "parentId":
+			if string(value) == "null" {
+				v.parentID, hasParent = 0, false
+				continue
+			}
+			parentID := ""
+			if err := json.Unmarshal(value, &parentID); err != nil {
+				return invalidProperties("Invalid parentId", "parentId")
+			}
+			resolved, ok := r.resolveID(parentID)
+			if !ok {
+				return invalidProperties("Parent mailbox does not exist", "parentId")
+			}
+			v.parentID, hasParent = parseID(resolved), true
+		case "role", "sortOrder", "isSubscribed":
+			if !isDefaultMailboxValue(k, value) {
+				return invalidProperties(fmt.Sprintf("%v cannot be changed", k), k)
+			}
+		default:
+			return invalidProperties(fmt.Sprintf("%v cannot be set", k), k)
+		}
+	}
+	if v.name == folder.Name && v.parentID == folder.ParentID {
+		return nil
+	}
+	if folder.Type != backend.EmailFolder {
+		return &setError{Type: "forbidden", Description: "Special mailboxes cannot be renamed nor moved"}
+	}
+	if err := checkMailboxValues(folders, folder.ID, v, hasParent); err != nil {
+		return err
+	}
+
+	return fm.UpdateFolder(folder.ID, v.parentID, v.name)
+}
+
+func (r *call) destroyMailbox(id string, removeEmails bool) error {
+	fm := r.folderManager()
+	folders, err := fm.GetFolders(database.LockWrite)
+	if err != nil {
+		return err
+	}
+	folderID := parseID(id)
+	if !hasFolder(folders, folderID) {
+		return &setError{Type: "notFound"}
+	}
+	for _, v := range folders {
+		if v.ID == folderID && v.Type != backend.EmailFolder {
+			return &setError{Type: "forbidden", Description: "Special mailboxes cannot be destroyed"}
+		}
+		if v.ParentID == folderID {
+			return &setError{Type: "mailboxHasChild"}
+		}
+	}
+	if !removeEmails {
+		emails, err := r.emailManager(folderID).GetEmails(0, 1, false, database.LockRead)
+		if err != nil {
+			return err
+		}
+		if len(emails) > 0 {
+			return &setError{Type: "mailboxHasEmail"}
+		}
+	}
+
+	return fm.DeleteFolder(folderID)
+}
@@ -0,0 +1,159 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/superkkt/logger"
+)
+
+const (
+	// Minimum interval of the ping events in seconds.
+	minPingInterval = 30
+)
+
+// pushTypes is the data types whose changes are pushed.
+var pushTypes = []string{"Mailbox", "Email", "Thread"}
+
+// handleEventSource pushes the states of the data types over the event source
+// connection (RFC 8620 Section 7.3) whenever they are changed, which is
+// checked every poll interval.
+func (r *Server) handleEventSource(c backend.Credential, w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	query := req.URL.Query()
+	types := pushTypes
+	if v := query.Get("types"); len(v) > 0 && v != "*" {
+		types = strings.Split(v, ",")
+	}
+	closeAfterState := query.Get("closeafter") == "state"
+	ping := 0
+	if v := query.Get("ping"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeProblem(w, http.StatusBadRequest, "about:blank", "Invalid ping value")
+			return
+		}
+		ping = n
+		if ping > 0 && ping < minPingInterval {
+			ping = minPingInterval
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var pingC <-chan time.Time
+	if ping > 0 {
+		ticker := time.NewTicker(time.Duration(ping) * time.Second)
+		defer ticker.Stop()
+		pingC = ticker.C
+	}
+	poll := time.NewTicker(r.config.PollInterval)
+	defer poll.Stop()
+
+	// The first event has the current states.
+	last := map[string]string{}
+	for {
+		states, err := r.pushStates(c)
+		if err != nil {
+			logger.Error(fmt.Sprintf("jmap: failed to get the states of %v: %v", c.UserID(), err))
+			return
+		}
+		changed := map[string]string{}
+		for _, t := range types {
+			if v, ok := states[t]; ok && v != last[t] {
+				changed[t] = v
+			}
+		}
+		last = states
+		if len(changed) > 0 {
+			if err := writeEvent(w, "state", map[string]interface{}{
+				"@type":   "StateChange",
+				"changed": map[string]interface{}{accountID(c): changed},
+			}); err != nil {
+				return
+			}
+			flusher.Flush()
+			if closeAfterState {
+				return
+			}
+		}
+
+		// The states are also checked after a ping event, which is harmless.
+		select {
+		case <-poll.C:
+		case <-pingC:
+			if err := writeEvent(w, "ping", map[string]interface{}{"@type": "Ping", "interval": ping}); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-r.draining:
+			return
+		}
+	}
+}
+
+func (r *Server) pushStates(c backend.Credential) (map[string]string, error) {
+	result := make(map[string]string)
+	err := r.query(func(tx database.Transaction) error {
+		ctx := &call{server: r, credential: c, tx: tx}
+		mailbox, err := ctx.mailboxState()
+		if err != nil {
+			return err
+		}
+		email, err := ctx.emailState()
+		if err != nil {
+			return err
+		}
+		result["Mailbox"] = mailbox
+		result["Email"] = email
+		result["Thread"] = email
+		return nil
+	})
+
+	return result, err
+}
+
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	v, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(fmt.Sprintf("event: %v\ndata: %s\n\n", event, v)))
+
+	return err
+}
@@ -0,0 +1,446 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/go.enmime"
+)
+
+var (
+	emailSortProperties = []string{"receivedAt", "sentAt", "size", "from", "to", "subject"}
+)
+
+// emailFilter is either a FilterOperator or a FilterCondition of Email/query.
+type emailFilter struct {
+	operator   string
+	conditions []*emailFilter
+	condition  *emailCondition
+}
+
+type emailCondition struct {
+	InMailbox               *string    `json:"inMailbox"`
+	InMailboxOtherThan      []string   `json:"inMailboxOtherThan"`
+	Before                  *time.Time `json:"before"`
+	After                   *time.Time `json:"after"`
+	MinSize                 *int       `json:"minSize"`
+	MaxSize                 *int       `json:"maxSize"`
+	AllInThreadHaveKeyword  *string    `json:"allInThreadHaveKeyword"`
+	SomeInThreadHaveKeyword *string    `json:"someInThreadHaveKeyword"`
+	NoneInThreadHaveKeyword *string    `json:"noneInThreadHaveKeyword"`
+	HasKeyword              *string    `json:"hasKeyword"`
+	NotKeyword              *string    `json:"notKeyword"`
+	HasAttachment           *bool      `json:"hasAttachment"`
+	Text                    *string    `json:"text"`
+	From                    *string    `json:"from"`
+	To                      *string    `json:"to"`
+	Cc                      *string    `json:"cc"`
+	Bcc                     *string    `json:"bcc"`
+	Subject                 *string    `json:"subject"`
+	Body                    *string    `json:"body"`
+	Header                  []string   `json:"header"`
+}
+
+func parseEmailFilter(data json.RawMessage) (*emailFilter, error) {
+	m := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if _, ok := m["operator"]; !ok {
+		c := &emailCondition{}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, err
+		}
+		for k := range m {
+			if !hasString(emailFilterProperties, k) {
+				return nil, fmt.Errorf("unsupported filter property: %v", k)
+			}
+		}
+		if c.Header != nil && (len(c.Header) == 0 || len(c.Header) > 2) {
+			return nil, fmt.Errorf("invalid header filter: %v", c.Header)
+		}
+		return &emailFilter{condition: c}, nil
+	}
+
+	op := struct {
+		Operator   string            `json:"operator"`
+		Conditions []json.RawMessage `json:"conditions"`
+	}{}
+	if err := json.Unmarshal(data, &op); err != nil {
+		return nil, err
+	}
+	if op.Operator != "AND" && op.Operator != "OR" && op.Operator != "NOT" {
+		return nil, fmt.Errorf("invalid operator: %v", op.Operator)
+	}
+	result := &emailFilter{operator: op.Operator}
+	for _, v := range op.Conditions {
+		c, err := parseEmailFilter(v)
+		if err != nil {
+			return nil, err
+		}
+		result.conditions = append(result.conditions, c)
+	}
+
+	return result, nil
+}
+
+var emailFilterProperties = []string{
+	"inMailbox", "inMailboxOtherThan", "before", "after", "minSize", "maxSize",
+	"allInThreadHaveKeyword", "someInThreadHaveKeyword", "noneInThreadHaveKeyword",
+	"hasKeyword", "notKeyword", "hasAttachment", "text", "from", "to", "cc", "bcc",
+	"subject", "body", "header",
+}
+
+// queryContext loads the raw email of an entry only if a condition needs it.
+type queryContext struct {
+	call   *call
+	index  *emailIndex
+	entry  *emailEntry
+	parsed *parsedEmail
+}
+
+func (r *queryContext) load() (*parsedEmail, error) {
+	if r.parsed != nil {
+		return r.parsed, nil
+	}
+	parsed, err := r.call.parseEmail(r.entry)
+	if err != nil {
+		return nil, err
+	}
+	r.parsed = parsed
+
+	return parsed, nil
+}
+
+// header returns the decoded values of a header field.
+func (r *queryContext) header(name string) ([]string, error) {
+	parsed, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, v := range parsed.header[textproto.CanonicalMIMEHeaderKey(name)] {
+		values = append(values, enmime.DecodeHeader(v))
+	}
+
+	return values, nil
+}
+
+func (r *queryContext) match(f *emailFilter) (bool, error) {
+	switch f.operator {
+	case "AND":
+		for _, v := range f.conditions {
+			if ok, err := r.match(v); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case "OR":
+		for _, v := range f.conditions {
+			if ok, err := r.match(v); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "NOT":
+		for _, v := range f.conditions {
+			if ok, err := r.match(v); err != nil || ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	return r.matchCondition(f.condition)
+}
+
+func (r *queryContext) matchCondition(c *emailCondition) (bool, error) {
+	e := r.entry
+	if c.InMailbox != nil && *c.InMailbox != formatID(e.folderID) {
+		return false, nil
+	}
+	if hasString(c.InMailboxOtherThan, formatID(e.folderID)) {
+		return false, nil
+	}
+	if c.Before != nil && !e.email.Date.Before(*c.Before) {
+		return false, nil
+	}
+	if c.After != nil && e.email.Date.Before(*c.After) {
+		return false, nil
+	}
+	// Each email is a thread by itself.
+	keywords := keywords(r.index, e)
+	for _, v := range []*string{c.AllInThreadHaveKeyword, c.SomeInThreadHaveKeyword, c.HasKeyword} {
+		if v != nil && !keywords[*v] {
+			return false, nil
+		}
+	}
+	for _, v := range []*string{c.NoneInThreadHaveKeyword, c.NotKeyword} {
+		if v != nil && keywords[*v] {
+			return false, nil
+		}
+	}
+	if c.HasAttachment != nil && *c.HasAttachment != hasAttachment(e) {
+		return false, nil
+	}
+	if c.Subject != nil && !contains(e.email.Subject, *c.Subject) {
+		return false, nil
+	}
+
+	// The others require the raw email.
+	if c.MinSize != nil || c.MaxSize != nil {
+		parsed, err := r.load()
+		if err != nil {
+			return false, err
+		}
+		if c.MinSize != nil && len(parsed.raw) < *c.MinSize {
+			return false, nil
+		}
+		if c.MaxSize != nil && len(parsed.raw) >= *c.MaxSize {
+			return false, nil
+		}
+	}
+	fields := []struct {
+		value *string
+		name  string
+	}{
+		{c.From, "From"},
+		{c.To, "To"},
+		{c.Cc, "Cc"},
+		{c.Bcc, "Bcc"},
+	}
+	for _, v := range fields {
+		if v.value == nil {
+			continue
+		}
+		values, err := r.header(v.name)
+		if err != nil {
+			return false, err
+		}
+		if !containsAny(values, *v.value) {
+			return false, nil
+		}
+	}
+	if len(c.Header) > 0 {
+		values, err := r.header(c.Header[0])
+		if err != nil {
+			return false, err
+		}
+		if len(values) == 0 || (len(c.Header) == 2 && !containsAny(values, c.Header[1])) {
+			return false, nil
+		}
+	}
+	if c.Body != nil || c.Text != nil {
+		parsed, err := r.load()
+		if err != nil {
+			return false, err
+		}
+		body := parsed.text() + "\n" + parsed.html()
+		if c.Body != nil && !contains(body, *c.Body) {
+			return false, nil
+		}
+		if c.Text != nil && !contains(body, *c.Text) {
+			matched := contains(e.email.Subject, *c.Text)
+			for _, name := range []string{"From", "To", "Cc", "Bcc"} {
+				values, err := r.header(name)
+				if err != nil {
+					return false, err
+				}
+				matched = matched || containsAny(values, *c.Text)
+			}
+			if !matched {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// contains reports whether substr is within s, ignoring case.
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func containsAny(values []string, substr string) bool {
+	for _, v := range values {
+		if contains(v, substr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func handleEmailQuery(r *call, args json.RawMessage) (interface{}, error) {
+	req := struct {
+		queryRequest
+		CollapseThreads bool `json:"collapseThreads"`
+	}{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	var filter *emailFilter
+	if len(req.Filter) > 0 && string(req.Filter) != "null" {
+		var err error
+		if filter, err = parseEmailFilter(req.Filter); err != nil {
+			return nil, &methodError{Type: "unsupportedFilter", Description: err.Error()}
+		}
+	}
+	for _, v := range req.Sort {
+		if !hasString(emailSortProperties, v.Property) {
+			return nil, &methodError{Type: "unsupportedSort", Description: fmt.Sprintf("unsupported sort property: %v", v.Property)}
+		}
+	}
+
+	state, err := r.emailState()
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]*queryContext, 0)
+	for _, v := range index.list {
+		ctx := &queryContext{call: r, index: index, entry: v}
+		if filter != nil {
+			ok, err := ctx.match(filter)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		matched = append(matched, ctx)
+	}
+	if err := sortEmails(matched, req.Sort); err != nil {
+		return nil, err
+	}
+
+	// Threads do not need to be collapsed because each email is a thread.
+	ids := make([]string, len(matched))
+	for i, v := range matched {
+		ids[i] = formatID(v.entry.email.ID)
+	}
+
+	return paginate(ids, req.queryRequest, state)
+}
+
+// sortEmails sorts emails by the comparators. Emails are sorted by their IDs,
+// which are in the order of arrival, if they are equal.
+func sortEmails(emails []*queryContext, comparators []comparator) error {
+	keys := make([][]interface{}, len(emails))
+	for i, e := range emails {
+		for _, c := range comparators {
+			key, err := sortKey(e, c.Property)
+			if err != nil {
+				return err
+			}
+			keys[i] = append(keys[i], key)
+		}
+	}
+	order := make([]int, len(emails))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		ki, kj := keys[order[i]], keys[order[j]]
+		for n, c := range comparators {
+			cmp := compareKey(ki[n], kj[n])
+			if cmp == 0 {
+				continue
+			}
+			if c.ascending() {
+				return cmp < 0
+			}
+			return cmp > 0
+		}
+		return false
+	})
+
+	sorted := make([]*queryContext, len(emails))
+	for i, v := range order {
+		sorted[i] = emails[v]
+	}
+	copy(emails, sorted)
+
+	return nil
+}
+
+func sortKey(e *queryContext, property string) (interface{}, error) {
+	v := e.entry.email
+	switch property {
+	case "receivedAt":
+		return v.Date.Unix(), nil
+	case "sentAt":
+		parsed, err := e.load()
+		if err != nil {
+			return nil, err
+		}
+		if date, err := parsed.header.Date(); err == nil {
+			return date.Unix(), nil
+		}
+		return v.Date.Unix(), nil
+	case "size":
+		parsed, err := e.load()
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(parsed.raw)), nil
+	case "from":
+		return strings.ToLower(v.From.Name + " " + v.From.Address), nil
+	case "to":
+		if len(v.To) == 0 {
+			return "", nil
+		}
+		return strings.ToLower(v.To[0].Name + " " + v.To[0].Address), nil
+	default:
+		return strings.ToLower(v.Subject), nil
+	}
+}
+
+func compareKey(a, b interface{}) int {
+	switch v := a.(type) {
+	case int64:
+		w := b.(int64)
+		switch {
+		case v < w:
+			return -1
+		case v > w:
+			return 1
+		}
+	case string:
+		return strings.Compare(v, b.(string))
+	}
+
+	return 0
+}
@@ -0,0 +1,306 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superkkt/omega/activesync"
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultMaxSize      = 32 * 1024 * 1024
+	defaultPollInterval = 10 * time.Second
+	defaultDrainTimeout = 30 * time.Second
+	// Limits advertised in the session resource.
+	maxCallsInRequest = 16
+	maxObjectsInGet   = 500
+	maxObjectsInSet   = 500
+	maxConcurrent     = 4
+
+	capabilityCore       = "urn:ietf:params:jmap:core"
+	capabilityMail       = "urn:ietf:params:jmap:mail"
+	capabilitySubmission = "urn:ietf:params:jmap:submission"
+)
+
+type Config struct {
+	// Auth is a list of authentication schemes that the server accepts.
+	Auth    []activesync.RequestAuthenticator
+	Storage backend.Storage
+	DB      database.TransactionManager
+	// Outbox queues emails submitted by EmailSubmission/set.
+	Outbox  activesync.Outbox
+	Sender  activesync.SenderConfig
+	Scanner activesync.ScannerConfig
+	// MaxSize is the maximum size of a request or an uploaded blob in bytes.
+	// Zero means 32 MiB.
+	MaxSize int64
+	// PollInterval is the interval to check changes of the accounts that have
+	// event source connections. Zero means 10 seconds.
+	PollInterval time.Duration
+	// DrainTimeout is the maximum duration to wait for in-flight requests on
+	// shutdown. Zero means 30 seconds.
+	DrainTimeout time.Duration
+	// Throttle is the brute-force protection shared with the ActiveSync
+	// listener if they use the same failure store.
+	Throttle activesync.ThrottleConfig
+}
+
+// Server is a JMAP (RFC 8620) server for the mail (RFC 8621) data types, which
+// are Mailbox, Thread, Email, Identity, and EmailSubmission. IDs of the folder
+// and email histories are used as the states of the data types. Each email is
+// a thread by itself, and it has the $seen keyword only because other keywords
+// are not stored in the backend storage.
+type Server struct {
+	config   Config
+	uploads  *uploadStore
+	throttle *activesync.Throttle
+
+	// draining will be closed when the server starts shutting down, which
+	// finishes the event source connections.
+	draining     chan struct{}
+	drainingOnce sync.Once
+}
+
+func NewServer(conf Config) (*Server, error) {
+	if len(conf.Auth) == 0 || conf.Storage == nil || conf.DB == nil || conf.Outbox == nil {
+		return nil, errors.New("empty authenticators, or nil storage, DB, or outbox")
+	}
+	if conf.MaxSize == 0 {
+		conf.MaxSize = defaultMaxSize
+	}
+	if conf.PollInterval == 0 {
+		conf.PollInterval = defaultPollInterval
+	}
+	if conf.DrainTimeout == 0 {
+		conf.DrainTimeout = defaultDrainTimeout
+	}
+
+	return &Server{
+		config:   conf,
+		throttle: activesync.NewThrottle("jmap", conf.Throttle),
+		uploads:  newUploadStore(),
+		draining: make(chan struct{}),
+	}, nil
+}
+
+// Serve serves JMAP requests on l until ctx is canceled. On cancelation, Serve
+// stops accepting new connections, closes the event source connections, and
+// then waits for in-flight requests to be finished up to the drain timeout.
+// Serve returns nil if the server has been shut down by ctx.
+func (r *Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: r}
+	c := make(chan error, 1)
+	go func() {
+		c <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+	}
+
+	r.drainingOnce.Do(func() { close(r.draining) })
+	shutdown, cancel := context.WithTimeout(context.Background(), r.config.DrainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		logger.Warning(fmt.Sprintf("jmap: failed to drain in-flight requests on %v: %v", l.Addr(), err))
+		srv.Close()
+	}
+
+	return nil
+}
+
+func (r *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logger.Debug(fmt.Sprintf("jmap: client=%v, method=%v, URL=%v", req.RemoteAddr, req.Method, req.URL))
+
+	// RFC 8620 Section 2.2: the well-known URL redirects to the session resource.
+	if req.URL.Path == "/.well-known/jmap" {
+		http.Redirect(w, req, "/jmap/session", http.StatusMovedPermanently)
+		return
+	}
+
+	attempt := activesync.NewRequestAttempt(req)
+	if !r.throttle.CheckRequest(w, attempt) {
+		return
+	}
+	c, err := r.auth(req)
+	if err != nil {
+		logger.Error(fmt.Sprintf("jmap: failed to authorize a new request: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.throttle.Update(attempt, c.IsAuthorized())
+	if !c.IsAuthorized() {
+		logger.Warning(fmt.Sprintf("jmap: unauthorized: username=%v, client=%v", c.UserID(), req.RemoteAddr))
+		for _, v := range r.config.Auth {
+			w.Header().Add("WWW-Authenticate", v.Challenge())
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	path := req.URL.Path
+	switch {
+	case path == "/jmap/session" && req.Method == "GET":
+		r.handleSession(c, w, req)
+	case path == "/jmap/api" && req.Method == "POST":
+		r.handleAPI(c, w, req)
+	case path == "/jmap/eventsource" && req.Method == "GET":
+		r.handleEventSource(c, w, req)
+	case strings.HasPrefix(path, "/jmap/download/") && req.Method == "GET":
+		r.handleDownload(c, w, req)
+	case strings.HasPrefix(path, "/jmap/upload/") && req.Method == "POST":
+		r.handleUpload(c, w, req)
+	default:
+		writeProblem(w, http.StatusNotFound, "about:blank", "Unknown resource or method")
+	}
+}
+
+// accountID returns the ID of the account of the user identified by c. Each
+// user has only its own account.
+func accountID(c backend.Credential) string {
+	return strconv.FormatUint(c.UserUID(), 10)
+}
+
+func (r *Server) handleSession(c backend.Credential, w http.ResponseWriter, req *http.Request) {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + req.Host
+	account := accountID(c)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			capabilityCore: map[string]interface{}{
+				"maxSizeUpload":         r.config.MaxSize,
+				"maxConcurrentUpload":   maxConcurrent,
+				"maxSizeRequest":        r.config.MaxSize,
+				"maxConcurrentRequests": maxConcurrent,
+				"maxCallsInRequest":     maxCallsInRequest,
+				"maxObjectsInGet":       maxObjectsInGet,
+				"maxObjectsInSet":       maxObjectsInSet,
+				"collationAlgorithms":   []string{"i;ascii-casemap"},
+			},
+			capabilityMail:       map[string]interface{}{},
+			capabilitySubmission: map[string]interface{}{},
+		},
+		"accounts": map[string]interface{}{
+			account: map[string]interface{}{
+				"name":       c.UserID(),
+				"isPersonal": true,
+				"isReadOnly": false,
+				"accountCapabilities": map[string]interface{}{
+					capabilityMail: map[string]interface{}{
+						// An email belongs to only one folder.
+						"maxMailboxesPerEmail":       1,
+						"maxMailboxDepth":            nil,
+						"maxSizeMailboxName":         maxMailboxNameSize,
+						"maxSizeAttachmentsPerEmail": r.config.MaxSize,
+						"emailQuerySortOptions":      emailSortProperties,
+						"mayCreateTopLevelMailbox":   true,
+					},
+					capabilitySubmission: map[string]interface{}{
+						"maxDelayedSend":       0,
+						"submissionExtensions": map[string]interface{}{},
+					},
+				},
+			},
+		},
+		"primaryAccounts": map[string]string{
+			capabilityMail:       account,
+			capabilitySubmission: account,
+		},
+		"username":       c.UserID(),
+		"apiUrl":         base + "/jmap/api",
+		"downloadUrl":    base + "/jmap/download/{accountId}/{blobId}/{name}?type={type}",
+		"uploadUrl":      base + "/jmap/upload/{accountId}/",
+		"eventSourceUrl": base + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		"state":          sessionState,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Error(fmt.Sprintf("jmap: failed to encode a response: %v", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeProblem writes a problem details object (RFC 7807) that is used for the
+// request-level errors.
+func writeProblem(w http.ResponseWriter, status int, t, detail string) {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":   t,
+		"status": status,
+		"detail": detail,
+	})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (r *Server) query(f func(tx database.Transaction) error) error {
+	tx := r.config.DB.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(database.NotFoundError)
+	if !ok {
+		return false
+	}
+
+	return e.IsNotFound()
+}
@@ -0,0 +1,369 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+)
+
+type getRequest struct {
+	AccountID string `json:"accountId"`
+	// Nil IDs means all the objects.
+	IDs        *[]string `json:"ids"`
+	Properties *[]string `json:"properties"`
+}
+
+type getResponse struct {
+	AccountID string                   `json:"accountId"`
+	State     string                   `json:"state"`
+	List      []map[string]interface{} `json:"list"`
+	NotFound  []string                 `json:"notFound"`
+}
+
+type changesRequest struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	// Zero MaxChanges means no limit.
+	MaxChanges uint64 `json:"maxChanges"`
+}
+
+type changesResponse struct {
+	AccountID      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+func newChangesResponse(req changesRequest) changesResponse {
+	return changesResponse{
+		AccountID: req.AccountID,
+		OldState:  req.SinceState,
+		Created:   []string{},
+		Updated:   []string{},
+		Destroyed: []string{},
+	}
+}
+
+type queryRequest struct {
+	AccountID      string          `json:"accountId"`
+	Filter         json.RawMessage `json:"filter"`
+	Sort           []comparator    `json:"sort"`
+	Position       int             `json:"position"`
+	Anchor         *string         `json:"anchor"`
+	AnchorOffset   int             `json:"anchorOffset"`
+	Limit          *uint           `json:"limit"`
+	CalculateTotal bool            `json:"calculateTotal"`
+}
+
+type comparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Collation   string `json:"collation"`
+}
+
+func (r comparator) ascending() bool {
+	return r.IsAscending == nil || *r.IsAscending
+}
+
+type queryResponse struct {
+	AccountID           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	IDs                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+}
+
+// paginate returns the window of ids requested by req (RFC 8620 Section 5.5).
+func paginate(ids []string, req queryRequest, state string) (queryResponse, error) {
+	resp := queryResponse{AccountID: req.AccountID, QueryState: state, IDs: []string{}}
+	if req.CalculateTotal {
+		total := len(ids)
+		resp.Total = &total
+	}
+
+	position := req.Position
+	if req.Anchor != nil {
+		position = -1
+		for i, v := range ids {
+			if v == *req.Anchor {
+				position = i
+				break
+			}
+		}
+		if position < 0 {
+			return queryResponse{}, &methodError{Type: "anchorNotFound"}
+		}
+		position += req.AnchorOffset
+	} else if position < 0 {
+		position += len(ids)
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > len(ids) {
+		position = len(ids)
+	}
+	end := len(ids)
+	if req.Limit != nil && position+int(*req.Limit) < end {
+		end = position + int(*req.Limit)
+	}
+	resp.Position = position
+	resp.IDs = append(resp.IDs, ids[position:end]...)
+
+	return resp, nil
+}
+
+type setRequest struct {
+	AccountID string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+type setResponse struct {
+	AccountID    string                            `json:"accountId"`
+	OldState     string                            `json:"oldState"`
+	NewState     string                            `json:"newState"`
+	Created      map[string]map[string]interface{} `json:"created"`
+	Updated      map[string]interface{}            `json:"updated"`
+	Destroyed    []string                          `json:"destroyed"`
+	NotCreated   map[string]*setError              `json:"notCreated"`
+	NotUpdated   map[string]*setError              `json:"notUpdated"`
+	NotDestroyed map[string]*setError              `json:"notDestroyed"`
+}
+
+func newSetResponse(accountID, state string) setResponse {
+	return setResponse{
+		AccountID:    accountID,
+		OldState:     state,
+		Created:      map[string]map[string]interface{}{},
+		Updated:      map[string]interface{}{},
+		Destroyed:    []string{},
+		NotCreated:   map[string]*setError{},
+		NotUpdated:   map[string]*setError{},
+		NotDestroyed: map[string]*setError{},
+	}
+}
+
+func (r *setResponse) checkSize(req setRequest) error {
+	if len(req.Create)+len(req.Update)+len(req.Destroy) > maxObjectsInSet {
+		return &methodError{Type: "requestTooLarge"}
+	}
+
+	return nil
+}
+
+func decodeArgs(args json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(args, v); err != nil {
+		return invalidArguments("%v", err)
+	}
+
+	return nil
+}
+
+// selectProperties returns the properties of obj listed in properties. Nil
+// properties means defaults. The id property is always returned.
+func selectProperties(obj map[string]interface{}, properties *[]string, defaults []string) map[string]interface{} {
+	list := defaults
+	if properties != nil {
+		list = *properties
+	}
+	result := map[string]interface{}{"id": obj["id"]}
+	for _, v := range list {
+		result[v] = obj[v]
+	}
+
+	return result
+}
+
+// checkProperties returns an error if properties has a name not in supported.
+func checkProperties(properties *[]string, supported []string) error {
+	if properties == nil {
+		return nil
+	}
+	for _, v := range *properties {
+		if !hasString(supported, v) {
+			return invalidArguments("unknown property: %v", v)
+		}
+	}
+
+	return nil
+}
+
+func formatID(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+// parseID returns zero if id is not a valid ID.
+func parseID(id string) uint64 {
+	v, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return v
+}
+
+func (r *call) lastFolderHistory() (uint64, error) {
+	histories, err := r.folderManager().GetFolderHistories(0, 1, true, database.LockNone)
+	if err != nil || len(histories) == 0 {
+		return 0, err
+	}
+
+	return histories[0].ID(), nil
+}
+
+func (r *call) lastEmailHistory() (uint64, error) {
+	histories, err := r.emailManager(0).GetEmailHistories(0, 1, true, database.LockNone)
+	if err != nil || len(histories) == 0 {
+		return 0, err
+	}
+
+	return histories[0].ID(), nil
+}
+
+// mailboxState returns the state of the mailboxes, which consists of the last
+// folder and email history IDs because the number of emails in mailboxes are
+// also properties of them.
+func (r *call) mailboxState() (string, error) {
+	folder, err := r.lastFolderHistory()
+	if err != nil {
+		return "", err
+	}
+	email, err := r.lastEmailHistory()
+	if err != nil {
+		return "", err
+	}
+
+	return formatMailboxState(folder, email), nil
+}
+
+func formatMailboxState(folder, email uint64) string {
+	return fmt.Sprintf("%v-%v", folder, email)
+}
+
+func parseMailboxState(state string) (folder, email uint64, ok bool) {
+	v := strings.Split(state, "-")
+	if len(v) != 2 {
+		return 0, 0, false
+	}
+	folder, err1 := strconv.ParseUint(v[0], 10, 64)
+	email, err2 := strconv.ParseUint(v[1], 10, 64)
+
+	return folder, email, err1 == nil && err2 == nil
+}
+
+// emailState returns the state of the emails and threads, which is the last
+// email history ID.
+func (r *call) emailState() (string, error) {
+	id, err := r.lastEmailHistory()
+	if err != nil {
+		return "", err
+	}
+
+	return formatID(id), nil
+}
+
+type emailEntry struct {
+	email    *backend.Email
+	folderID uint64
+}
+
+type folderCount struct {
+	total  int
+	unseen int
+}
+
+// emailIndex is the folders and emails of a user, which is loaded once in a
+// method call because emails do not have their folder IDs.
+type emailIndex struct {
+	folders []backend.Folder
+	emails  map[uint64]*emailEntry
+	// list is sorted by the email ID in ascending order.
+	list   []*emailEntry
+	counts map[uint64]folderCount
+}
+
+func (r *emailIndex) folder(id uint64) (backend.Folder, bool) {
+	for _, v := range r.folders {
+		if v.ID == id {
+			return v, true
+		}
+	}
+
+	return backend.Folder{}, false
+}
+
+// loadIndex returns the index of the user's emails. Methods that update emails
+// or folders should call invalidate after the updates.
+func (r *call) loadIndex() (*emailIndex, error) {
+	if r.index != nil {
+		return r.index, nil
+	}
+
+	folders, err := r.folderManager().GetFolders(database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].ID < folders[j].ID })
+	index := &emailIndex{
+		folders: folders,
+		emails:  make(map[uint64]*emailEntry),
+		counts:  make(map[uint64]folderCount),
+	}
+	for _, f := range folders {
+		emails, err := r.emailManager(f.ID).GetEmails(0, 0, false, database.LockNone)
+		if err != nil {
+			return nil, err
+		}
+		count := folderCount{}
+		for _, v := range emails {
+			e := &emailEntry{email: v, folderID: f.ID}
+			index.emails[v.ID] = e
+			index.list = append(index.list, e)
+			count.total++
+			if !v.Seen {
+				count.unseen++
+			}
+		}
+		index.counts[f.ID] = count
+	}
+	sort.Slice(index.list, func(i, j int) bool { return index.list[i].email.ID < index.list[j].email.ID })
+	r.index = index
+
+	return index, nil
+}
+
+func (r *call) invalidate() {
+	r.index = nil
+}
@@ -0,0 +1,411 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package jmap
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/scanner"
+
+	"github.com/superkkt/logger"
+)
+
+const (
+	// Identities are derived from the user's addresses, and submissions are
+	// not kept after they are queued into the outbox, so their states never
+	// change.
+	identityState   = "0"
+	submissionState = "0"
+)
+
+type identity struct {
+	id      string
+	address string
+}
+
+// identities returns an identity of each address of the user. The ID of an
+// identity is derived from its address.
+func identities(c backend.Credential) []identity {
+	addresses := []string{c.UserID()}
+	if v, ok := c.(backend.AddressCredential); ok && len(v.Address()) > 0 {
+		addresses = append([]string{v.Address()}, v.Aliases()...)
+	}
+	result := make([]identity, len(addresses))
+	for i, v := range addresses {
+		result[i] = identity{
+			id:      base64.RawURLEncoding.EncodeToString([]byte(strings.ToLower(v))),
+			address: v,
+		}
+	}
+
+	return result
+}
+
+func handleIdentityGet(r *call, args json.RawMessage) (interface{}, error) {
+	req := getRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	properties := []string{"id", "name", "email", "replyTo", "bcc", "textSignature", "htmlSignature", "mayDelete"}
+	if err := checkProperties(req.Properties, properties); err != nil {
+		return nil, err
+	}
+
+	resp := getResponse{AccountID: req.AccountID, State: identityState, List: []map[string]interface{}{}, NotFound: []string{}}
+	list := identities(r.credential)
+	found := make(map[string]bool)
+	for _, v := range list {
+		if req.IDs != nil && !hasString(*req.IDs, v.id) {
+			continue
+		}
+		found[v.id] = true
+		resp.List = append(resp.List, selectProperties(map[string]interface{}{
+			"id":            v.id,
+			"name":          "",
+			"email":         v.address,
+			"replyTo":       nil,
+			"bcc":           nil,
+			"textSignature": "",
+			"htmlSignature": "",
+			"mayDelete":     false,
+		}, req.Properties, properties))
+	}
+	if req.IDs != nil {
+		for _, v := range *req.IDs {
+			if !found[v] {
+				resp.NotFound = append(resp.NotFound, v)
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+func handleSubmissionGet(r *call, args json.RawMessage) (interface{}, error) {
+	req := getRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+
+	resp := getResponse{AccountID: req.AccountID, State: submissionState, List: []map[string]interface{}{}, NotFound: []string{}}
+	if req.IDs != nil {
+		resp.NotFound = append(resp.NotFound, *req.IDs...)
+	}
+
+	return resp, nil
+}
+
+func handleSubmissionChanges(r *call, args json.RawMessage) (interface{}, error) {
+	req := changesRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	if req.SinceState != submissionState {
+		return nil, &methodError{Type: "cannotCalculateChanges"}
+	}
+
+	resp := newChangesResponse(req)
+	resp.NewState = submissionState
+
+	return resp, nil
+}
+
+func handleSubmissionQuery(r *call, args json.RawMessage) (interface{}, error) {
+	req := queryRequest{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+
+	return paginate(nil, req, submissionState)
+}
+
+type submissionCreate struct {
+	IdentityID string `json:"identityId"`
+	EmailID    string `json:"emailId"`
+	Envelope   *struct {
+		MailFrom struct {
+			Email string `json:"email"`
+		} `json:"mailFrom"`
+		RcptTo []struct {
+			Email string `json:"email"`
+		} `json:"rcptTo"`
+	} `json:"envelope"`
+}
+
+func handleSubmissionSet(r *call, args json.RawMessage) (interface{}, error) {
+	req := struct {
+		setRequest
+		OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+		OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+	}{}
+	if err := decodeArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if err := r.checkAccount(req.AccountID); err != nil {
+		return nil, err
+	}
+	if req.IfInState != nil && *req.IfInState != submissionState {
+		return nil, &methodError{Type: "stateMismatch"}
+	}
+	resp := newSetResponse(req.AccountID, submissionState)
+	if err := resp.checkSize(req.setRequest); err != nil {
+		return nil, err
+	}
+	resp.NewState = submissionState
+
+	creates := make([]string, 0, len(req.Create))
+	for k := range req.Create {
+		creates = append(creates, k)
+	}
+	sort.Strings(creates)
+	// Email IDs of the successful submissions.
+	submitted := make(map[string]string)
+	for _, cid := range creates {
+		v := submissionCreate{}
+		if err := json.Unmarshal(req.Create[cid], &v); err != nil {
+			resp.NotCreated[cid] = invalidProperties(err.Error())
+			continue
+		}
+		created, err := r.submit(v)
+		if err != nil {
+			e, ok := err.(*setError)
+			if !ok {
+				return nil, err
+			}
+			resp.NotCreated[cid] = e
+			continue
+		}
+		r.created[cid] = created["id"].(string)
+		resp.Created[cid] = created
+		submitted["#"+cid], _ = r.resolveID(v.EmailID)
+	}
+	// Submissions cannot be changed after they are queued.
+	for id := range req.Update {
+		resp.NotUpdated[id] = &setError{Type: "notFound"}
+	}
+	for _, id := range req.Destroy {
+		resp.NotDestroyed[id] = &setError{Type: "notFound"}
+	}
+
+	// The implicit Email/set call for the successful submissions.
+	update := make(map[string]map[string]json.RawMessage)
+	for k, v := range req.OnSuccessUpdateEmail {
+		if id, ok := submitted[k]; ok {
+			update[id] = v
+		} else if !strings.HasPrefix(k, "#") {
+			update[k] = v
+		}
+	}
+	destroy := make([]string, 0)
+	for _, k := range req.OnSuccessDestroyEmail {
+		if id, ok := submitted[k]; ok {
+			destroy = append(destroy, id)
+		} else if !strings.HasPrefix(k, "#") {
+			destroy = append(destroy, k)
+		}
+	}
+	if len(update) > 0 || len(destroy) > 0 {
+		result, err := r.setEmails(setRequest{AccountID: req.AccountID, Update: update, Destroy: destroy})
+		if err != nil {
+			return nil, err
+		}
+		r.extra = append(r.extra, response{name: "Email/set", args: result})
+	}
+
+	return resp, nil
+}
+
+// submit queues the email of v into the outbox after it validates the sender
+// and scans the email.
+func (r *call) submit(v submissionCreate) (map[string]interface{}, error) {
+	valid := false
+	for _, i := range identities(r.credential) {
+		if i.id == v.IdentityID {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, invalidProperties("Unknown identity", "identityId")
+	}
+	emailID, ok := r.resolveID(v.EmailID)
+	if !ok {
+		return nil, invalidProperties("Unknown email", "emailId")
+	}
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	e, ok := index.emails[parseID(emailID)]
+	if !ok {
+		return nil, invalidProperties("Unknown email", "emailId")
+	}
+	raw, err := r.emailManager(e.folderID).GetRawEmail(e.email.ID, database.LockNone)
+	if err != nil {
+		return nil, err
+	}
+	header, ok := parseMessage(raw)
+	if !ok {
+		return nil, &setError{Type: "invalidEmail", Description: "Email is malformed"}
+	}
+
+	rcpts := []string{}
+	if v.Envelope != nil {
+		for _, rcpt := range v.Envelope.RcptTo {
+			rcpts = append(rcpts, rcpt.Email)
+		}
+	} else {
+		for _, name := range []string{"To", "Cc", "Bcc"} {
+			list, err := header.AddressList(name)
+			if err != nil && err != mail.ErrHeaderNotPresent {
+				return nil, &setError{Type: "invalidEmail", Description: fmt.Sprintf("Invalid %v header", name)}
+			}
+			for _, addr := range list {
+				rcpts = append(rcpts, addr.Address)
+			}
+		}
+	}
+	if len(rcpts) == 0 {
+		return nil, &setError{Type: "noRecipients"}
+	}
+
+	msg := removeHeader(normalizeCRLF(raw), "Bcc")
+	from, msg, ok, err := r.server.config.Sender.Check(r.credential, header, msg)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &setError{Type: "forbiddenFrom"}
+	}
+	if v.Envelope != nil && !strings.EqualFold(v.Envelope.MailFrom.Email, from) {
+		return nil, &setError{Type: "forbiddenMailFrom", Description: fmt.Sprintf("Envelope sender should be %v", from)}
+	}
+	send, err := r.scanOutgoing(from, rcpts, msg)
+	if err != nil {
+		return nil, err
+	}
+	if send {
+		// The draft is not copied into the Sent folder because clients
+		// move it using onSuccessUpdateEmail.
+		if err := r.server.config.Outbox.Enqueue(r.tx, r.credential, from, rcpts, msg, false); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	return map[string]interface{}{
+		"id":         fmt.Sprintf("S%v-%v", e.email.ID, now.UnixNano()),
+		"sendAt":     utcDate(now),
+		"undoStatus": "final",
+	}, nil
+}
+
+// scanOutgoing inspects an outgoing email, and returns whether it should be
+// queued. A quarantined email is held without being sent, but the submission
+// succeeds as the ActiveSync SendMail command does.
+func (r *call) scanOutgoing(from string, to []string, msg []byte) (send bool, err error) {
+	conf := r.server.config.Scanner
+	if conf.Scanner == nil {
+		return true, nil
+	}
+
+	result, err := conf.Scanner.Scan(msg)
+	if err != nil {
+		return false, fmt.Errorf("failed to scan an outgoing email: %v", err)
+	}
+	switch result.Verdict {
+	case scanner.VerdictAccept:
+		return true, nil
+	case scanner.VerdictJunk:
+		logger.Warning(fmt.Sprintf("Sending an email judged as spam: user=%v, reason=%v", r.credential.UserID(), result.Reason))
+		return true, nil
+	case scanner.VerdictQuarantine:
+		id, err := conf.Quarantine.NewQuarantine(r.tx).AddMessage(scanner.QuarantinedMessage{
+			UserUID:   r.credential.UserUID(),
+			Direction: scanner.Outbound,
+			From:      from,
+			To:        to,
+			Reason:    result.Reason,
+			Raw:       msg,
+		})
+		if err != nil {
+			return false, err
+		}
+		logger.Info(fmt.Sprintf("Quarantined an outgoing email: id=%v, user=%v, reason=%v", id, r.credential.UserID(), result.Reason))
+		return false, nil
+	default:
+		logger.Info(fmt.Sprintf("Rejected an outgoing email by the content scanner: user=%v, reason=%v", r.credential.UserID(), result.Reason))
+		return false, &setError{Type: "forbiddenToSend", Description: "Email has been rejected by the content scanner"}
+	}
+}
+
+// removeHeader removes all fields whose name is name from the header of msg,
+// which should have CRLF line endings.
+func removeHeader(msg []byte, name string) []byte {
+	end := strings.Index(string(msg), "\r\n\r\n")
+	if end < 0 {
+		end = len(msg)
+	} else {
+		// Include the CRLF of the last header field.
+		end += 2
+	}
+
+	result := make([]byte, 0, len(msg))
+	skip := false
+	for _, line := range strings.SplitAfter(string(msg[:end]), "\r\n") {
+		if len(line) == 0 {
+			continue
+		}
+		// Continuation line of the previous field?
+		if line[0] == ' ' || line[0] == '\t' {
+			if !skip {
+				result = append(result, line...)
+			}
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		skip = i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), name)
+		if !skip {
+			result = append(result, line...)
+		}
+	}
+
+	return append(result, msg[end:]...)
+}
@@ -0,0 +1,228 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package mailauth
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// DMARCResult is a result of a DMARC evaluation (RFC 7489 section 11.2).
+type DMARCResult string
+
+const (
+	DMARCNone      DMARCResult = "none"
+	DMARCPass      DMARCResult = "pass"
+	DMARCFail      DMARCResult = "fail"
+	DMARCTempError DMARCResult = "temperror"
+	DMARCPermError DMARCResult = "permerror"
+)
+
+// DMARCPolicy is the requested handling of messages that fail DMARC.
+type DMARCPolicy string
+
+const (
+	DMARCPolicyNone       DMARCPolicy = "none"
+	DMARCPolicyQuarantine DMARCPolicy = "quarantine"
+	DMARCPolicyReject     DMARCPolicy = "reject"
+)
+
+// dmarcRecord is a parsed DMARC policy record.
+type dmarcRecord struct {
+	policy          DMARCPolicy
+	subdomainPolicy DMARCPolicy
+	strictDKIM      bool
+	strictSPF       bool
+	percent         int
+}
+
+// identifier is a domain authenticated by SPF or DKIM.
+type identifier struct {
+	domain string
+	pass   bool
+}
+
+// checkDMARC evaluates the DMARC policy of fromDomain, which is the domain of
+// the From header, with the authenticated domains by SPF and DKIM. The
+// returned policy is the one to apply, which is DMARCPolicyNone unless the
+// result is DMARCFail.
+func checkDMARC(resolver Resolver, fromDomain string, spf identifier, dkim []identifier) (DMARCResult, DMARCPolicy, error) {
+	org := orgDomain(fromDomain)
+	record, err := lookupDMARC(resolver, "_dmarc."+fromDomain)
+	if err == nil && record == nil && org != fromDomain {
+		// Fall back to the policy of the organizational domain.
+		record, err = lookupDMARC(resolver, "_dmarc."+org)
+		if record != nil && len(record.subdomainPolicy) > 0 {
+			record.policy = record.subdomainPolicy
+		}
+	}
+	if err != nil {
+		if isTemporary(err) {
+			return DMARCTempError, DMARCPolicyNone, err
+		}
+		return DMARCPermError, DMARCPolicyNone, err
+	}
+	if record == nil {
+		return DMARCNone, DMARCPolicyNone, nil
+	}
+
+	if spf.pass && isAligned(spf.domain, fromDomain, record.strictSPF) {
+		return DMARCPass, DMARCPolicyNone, nil
+	}
+	for _, v := range dkim {
+		if v.pass && isAligned(v.domain, fromDomain, record.strictDKIM) {
+			return DMARCPass, DMARCPolicyNone, nil
+		}
+	}
+
+	policy := record.policy
+	// The policy is applied to pct percent of the failed messages, and the
+	// others are handled by the next weaker policy (RFC 7489 section 6.6.4).
+	if record.percent < 100 && rand.Intn(100) >= record.percent {
+		switch policy {
+		case DMARCPolicyReject:
+			policy = DMARCPolicyQuarantine
+		case DMARCPolicyQuarantine:
+			policy = DMARCPolicyNone
+		}
+	}
+
+	return DMARCFail, policy, nil
+}
+
+// lookupDMARC returns the DMARC record of name, or nil if there is no record.
+func lookupDMARC(resolver Resolver, name string) (*dmarcRecord, error) {
+	records, err := resolver.LookupTXT(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	for _, v := range records {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(v)), "v=dmarc1") {
+			found = append(found, v)
+		}
+	}
+	// Multiple records mean no record.
+	if len(found) != 1 {
+		return nil, nil
+	}
+
+	return parseDMARC(found[0])
+}
+
+func parseDMARC(s string) (*dmarcRecord, error) {
+	record := &dmarcRecord{percent: 100}
+	for i, v := range strings.Split(s, ";") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid DMARC tag: %v", v)
+		}
+		name, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		if i == 0 {
+			// The v tag should be the first one.
+			if name != "v" || value != "DMARC1" {
+				return nil, fmt.Errorf("invalid DMARC version: %v", v)
+			}
+			continue
+		}
+
+		switch name {
+		case "p", "sp":
+			p := DMARCPolicy(strings.ToLower(value))
+			if p != DMARCPolicyNone && p != DMARCPolicyQuarantine && p != DMARCPolicyReject {
+				return nil, fmt.Errorf("invalid DMARC policy: %v", v)
+			}
+			if name == "p" {
+				record.policy = p
+			} else {
+				record.subdomainPolicy = p
+			}
+		case "adkim", "aspf":
+			strict := strings.EqualFold(value, "s")
+			if !strict && !strings.EqualFold(value, "r") {
+				return nil, fmt.Errorf("invalid DMARC alignment mode: %v", v)
+			}
+			if name == "adkim" {
+				record.strictDKIM = strict
+			} else {
+				record.strictSPF = strict
+			}
+		case "pct":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > 100 {
+				return nil, fmt.Errorf("invalid DMARC percentage: %v", v)
+			}
+			record.percent = n
+		}
+		// Other tags, e.g., rua, ruf, and fo, are about reports.
+	}
+	if len(record.policy) == 0 {
+		return nil, fmt.Errorf("missing DMARC policy: %v", s)
+	}
+
+	return record, nil
+}
+
+// isAligned returns whether an authenticated domain is aligned with the domain
+// of the From header.
+func isAligned(domain, fromDomain string, strict bool) bool {
+	domain, fromDomain = strings.ToLower(domain), strings.ToLower(fromDomain)
+	if strict {
+		return domain == fromDomain
+	}
+
+	return orgDomain(domain) == orgDomain(fromDomain)
+}
+
+// multiLabelSuffixes are public suffixes that have two labels. They are common
+// second-level domains of country code TLDs, which is a small subset of the
+// Public Suffix List.
+var multiLabelSuffixes = map[string]bool{
+	"co.uk": true, "org.uk": true, "ac.uk": true, "gov.uk": true, "me.uk": true, "net.uk": true,
+	"co.kr": true, "or.kr": true, "ne.kr": true, "ac.kr": true, "go.kr": true, "re.kr": true,
+	"co.jp": true, "or.jp": true, "ne.jp": true, "ac.jp": true, "go.jp": true,
+	"com.au": true, "net.au": true, "org.au": true, "edu.au": true, "gov.au": true,
+	"com.cn": true, "net.cn": true, "org.cn": true, "com.tw": true, "com.hk": true,
+	"com.br": true, "com.mx": true, "com.ar": true, "com.tr": true, "com.sg": true,
+	"co.nz": true, "co.za": true, "co.in": true, "co.id": true, "co.il": true, "co.th": true,
+}
+
+// orgDomain returns the organizational domain (RFC 7489 section 3.2) of domain
+// using the public suffixes of one label and the multiLabelSuffixes.
+func orgDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	n := 2
+	if len(labels) >= 3 && multiLabelSuffixes[strings.Join(labels[len(labels)-2:], ".")] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+
+	return strings.Join(labels[len(labels)-n:], ".")
+}
@@ -0,0 +1,113 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package mailauth
+
+import (
+	"testing"
+)
+
+func TestCheckDMARC(t *testing.T) {
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"_dmarc.example.com":        {"v=DMARC1; p=reject; sp=quarantine; rua=mailto:dmarc@example.com"},
+			"_dmarc.strict.example.com": {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+			"_dmarc.example.net":        {"v=DMARC1; p=quarantine"},
+			"_dmarc.none.example.net":   {"v=DMARC1; p=none"},
+			"_dmarc.pct0.example.net":   {"v=DMARC1; p=reject; pct=0"},
+			"_dmarc.pct0q.example.net":  {"v=DMARC1; p=quarantine; pct=0"},
+			"_dmarc.example.co.uk":      {"v=DMARC1; p=reject"},
+			"_dmarc.multiple.example":   {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+			"_dmarc.invalid.example":    {"v=DMARC1; p=drop"},
+			"_dmarc.version.example":    {"v=dmarc1; p=reject"},
+			"_dmarc.order.example":      {"p=reject; v=DMARC1"},
+		},
+		errs: map[string]bool{
+			"_dmarc.broken.example": true,
+		},
+	}
+	pass := func(domain string) identifier { return identifier{domain: domain, pass: true} }
+	fail := func(domain string) identifier { return identifier{domain: domain} }
+
+	tests := []struct {
+		name   string
+		from   string
+		spf    identifier
+		dkim   []identifier
+		result DMARCResult
+		policy DMARCPolicy
+	}{
+		// Relaxed alignment of SPF and DKIM.
+		{"SPF aligned", "example.com", pass("example.com"), nil, DMARCPass, DMARCPolicyNone},
+		{"SPF relaxed", "example.com", pass("bounce.example.com"), nil, DMARCPass, DMARCPolicyNone},
+		{"DKIM aligned", "example.com", fail("example.com"), []identifier{pass("example.com")}, DMARCPass, DMARCPolicyNone},
+		{"DKIM relaxed", "example.com", fail("example.com"), []identifier{fail("example.com"), pass("mail.EXAMPLE.com")}, DMARCPass, DMARCPolicyNone},
+		{"not aligned", "example.com", pass("example.org"), []identifier{pass("example.org")}, DMARCFail, DMARCPolicyReject},
+		{"aligned but failed", "example.com", fail("example.com"), []identifier{fail("example.com")}, DMARCFail, DMARCPolicyReject},
+		// Strict alignment.
+		{"SPF strict", "strict.example.com", pass("strict.example.com"), nil, DMARCPass, DMARCPolicyNone},
+		{"SPF strict subdomain", "strict.example.com", pass("example.com"), nil, DMARCFail, DMARCPolicyReject},
+		{"DKIM strict", "strict.example.com", fail(""), []identifier{pass("strict.example.com")}, DMARCPass, DMARCPolicyNone},
+		{"DKIM strict subdomain", "strict.example.com", fail(""), []identifier{pass("mail.strict.example.com")}, DMARCFail, DMARCPolicyReject},
+		// The subdomain policy of the organizational domain.
+		{"subdomain policy", "sub.example.com", fail(""), nil, DMARCFail, DMARCPolicyQuarantine},
+		{"no subdomain policy", "sub.example.net", fail(""), nil, DMARCFail, DMARCPolicyQuarantine},
+		{"own policy of a subdomain", "none.example.net", fail(""), nil, DMARCFail, DMARCPolicyNone},
+		{"multi-label public suffix", "mail.example.co.uk", fail(""), []identifier{pass("example.co.uk")}, DMARCPass, DMARCPolicyNone},
+		{"multi-label public suffix fail", "mail.example.co.uk", fail(""), []identifier{pass("other.co.uk")}, DMARCFail, DMARCPolicyReject},
+		// pct=0 applies the next weaker policy.
+		{"reject of pct=0", "pct0.example.net", fail(""), nil, DMARCFail, DMARCPolicyQuarantine},
+		{"quarantine of pct=0", "pct0q.example.net", fail(""), nil, DMARCFail, DMARCPolicyNone},
+		// No or broken records.
+		{"no record", "example.org", fail(""), nil, DMARCNone, DMARCPolicyNone},
+		{"multiple records", "multiple.example", fail(""), nil, DMARCNone, DMARCPolicyNone},
+		{"invalid policy", "invalid.example", fail(""), nil, DMARCPermError, DMARCPolicyNone},
+		{"invalid version", "version.example", fail(""), nil, DMARCPermError, DMARCPolicyNone},
+		{"version not first", "order.example", fail(""), nil, DMARCNone, DMARCPolicyNone},
+		{"temporary error", "broken.example", pass("broken.example"), nil, DMARCTempError, DMARCPolicyNone},
+	}
+	for _, v := range tests {
+		result, policy, err := checkDMARC(resolver, v.from, v.spf, v.dkim)
+		if result != v.result || policy != v.policy {
+			t.Errorf("%v: expected %v (p=%v), got %v (p=%v, err=%v)", v.name, v.result, v.policy, result, policy, err)
+		}
+		if (err != nil) != (result == DMARCPermError || result == DMARCTempError) {
+			t.Errorf("%v: unexpected error of %v: %v", v.name, result, err)
+		}
+	}
+}
+
+func TestOrgDomain(t *testing.T) {
+	tests := map[string]string{
+		"example.com":           "example.com",
+		"mail.Example.COM":      "example.com",
+		"a.b.mail.example.com.": "example.com",
+		"example.co.uk":         "example.co.uk",
+		"mail.example.co.uk":    "example.co.uk",
+		"co.uk":                 "co.uk",
+		"www.example.or.kr":     "example.or.kr",
+		"com":                   "com",
+	}
+	for domain, expected := range tests {
+		if v := orgDomain(domain); v != expected {
+			t.Errorf("%v: expected %v, got %v", domain, expected, v)
+		}
+	}
+}
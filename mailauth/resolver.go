@@ -0,0 +1,190 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package mailauth
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	resolvConf = "/etc/resolv.conf"
+	dnsTimeout = 5 * time.Second
+)
+
+// Resolver looks up DNS records for the verifications. Lookup methods return
+// an empty slice without an error if the name does not exist or has no record
+// of the type. Errors returned by them are temporary failures, which have the
+// Temporary() method returning true.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(name string) ([]net.IP, error)
+	LookupMX(name string) ([]string, error)
+	LookupAddr(ip net.IP) ([]string, error)
+}
+
+// DNSResolver is a Resolver that sends recursive queries to name servers.
+type DNSResolver struct {
+	servers []string
+}
+
+// NewDNSResolver returns a resolver that uses servers, each of which is
+// host:port. Empty servers means the name servers in /etc/resolv.conf.
+func NewDNSResolver(servers []string) (*DNSResolver, error) {
+	if len(servers) == 0 {
+		c, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range c.Servers {
+			servers = append(servers, net.JoinHostPort(v, c.Port))
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no name server in %v", resolvConf)
+		}
+	}
+
+	return &DNSResolver{servers: servers}, nil
+}
+
+type temporaryError struct {
+	error
+}
+
+func (r temporaryError) Temporary() bool {
+	return true
+}
+
+func isTemporary(err error) bool {
+	e, ok := err.(interface {
+		Temporary() bool
+	})
+
+	return ok && e.Temporary()
+}
+
+func (r *DNSResolver) LookupTXT(name string) ([]string, error) {
+	answers, err := r.query(name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, v := range answers {
+		if rr, ok := v.(*dns.TXT); ok {
+			// Strings of a record are concatenated without a separator.
+			result = append(result, strings.Join(rr.Txt, ""))
+		}
+	}
+
+	return result, nil
+}
+
+func (r *DNSResolver) LookupIP(name string) ([]net.IP, error) {
+	result := []net.IP{}
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answers, err := r.query(name, t)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range answers {
+			switch rr := v.(type) {
+			case *dns.A:
+				result = append(result, rr.A)
+			case *dns.AAAA:
+				result = append(result, rr.AAAA)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (r *DNSResolver) LookupMX(name string) ([]string, error) {
+	answers, err := r.query(name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, v := range answers {
+		if rr, ok := v.(*dns.MX); ok {
+			result = append(result, strings.TrimSuffix(rr.Mx, "."))
+		}
+	}
+
+	return result, nil
+}
+
+func (r *DNSResolver) LookupAddr(ip net.IP) ([]string, error) {
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	answers, err := r.query(name, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, v := range answers {
+		if rr, ok := v.(*dns.PTR); ok {
+			result = append(result, strings.TrimSuffix(rr.Ptr, "."))
+		}
+	}
+
+	return result, nil
+}
+
+// query sends a recursive query to the name servers in turn until one of them
+// answers, and returns the answer records.
+func (r *DNSResolver) query(name string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+
+	var lastErr error
+	for _, v := range r.servers {
+		resp, _, err := (&dns.Client{Timeout: dnsTimeout}).Exchange(m, v)
+		if err == nil && resp.Truncated {
+			resp, _, err = (&dns.Client{Net: "tcp", Timeout: dnsTimeout}).Exchange(m, v)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+			return resp.Answer, nil
+		case dns.RcodeNameError:
+			return nil, nil
+		default:
+			lastErr = fmt.Errorf("DNS query of %v failed: %v", name, dns.RcodeToString[resp.Rcode])
+		}
+	}
+
+	return nil, temporaryError{lastErr}
+}
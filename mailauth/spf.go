@@ -0,0 +1,649 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package mailauth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SPFResult is a result of an SPF evaluation (RFC 7208 section 2.6).
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+const (
+	// Maximum number of mechanisms and modifiers that cause DNS lookups.
+	maxSPFLookups = 10
+	// Maximum number of DNS lookups that return no record.
+	maxSPFVoidLookups = 2
+	// Maximum number of MX hosts of an mx mechanism.
+	maxSPFMXHosts = 10
+)
+
+// spfError is an error that terminates an SPF evaluation with its result.
+type spfError struct {
+	result SPFResult
+	err    error
+}
+
+func (r *spfError) Error() string {
+	return fmt.Sprintf("%v: %v", r.result, r.err)
+}
+
+func permError(format string, args ...interface{}) error {
+	return &spfError{result: SPFPermError, err: fmt.Errorf(format, args...)}
+}
+
+// spfChecker evaluates the check_host() function of RFC 7208 for a client.
+type spfChecker struct {
+	resolver Resolver
+	ip       net.IP
+	helo     string
+	// sender is the MAIL FROM address, or postmaster@helo if it is empty.
+	sender  string
+	lookups int
+	voids   int
+}
+
+// CheckSPF evaluates the SPF policy of the domain of sender for a client whose
+// IP address is ip. sender is the MAIL FROM address, or empty to check the HELO
+// identity. It returns the result and the domain that has been checked.
+func CheckSPF(resolver Resolver, ip net.IP, helo, sender string) (result SPFResult, domain string, err error) {
+	if len(sender) == 0 {
+		sender = "postmaster@" + helo
+	}
+	i := strings.LastIndex(sender, "@")
+	if i < 0 {
+		sender = "postmaster@" + sender
+		i = len("postmaster")
+	}
+	if i == 0 {
+		// RFC 7208 section 4.3: use "postmaster" if the local part is empty.
+		sender = "postmaster" + sender
+		i = len("postmaster")
+	}
+	domain = strings.ToLower(sender[i+1:])
+
+	c := &spfChecker{resolver: resolver, ip: ip, helo: helo, sender: sender}
+	result, err = c.checkHost(domain)
+	if e, ok := err.(*spfError); ok {
+		return e.result, domain, e.err
+	}
+
+	return result, domain, err
+}
+
+func (r *spfChecker) checkHost(domain string) (SPFResult, error) {
+	if !isValidDomain(domain) {
+		return SPFNone, nil
+	}
+	record, err := r.lookupRecord(domain)
+	if err != nil {
+		return "", err
+	}
+	if len(record) == 0 {
+		return SPFNone, nil
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, ok := splitModifier(term); ok {
+			if strings.EqualFold(name, "redirect") {
+				if len(redirect) > 0 {
+					return "", permError("duplicated redirect modifier")
+				}
+				redirect = value
+			}
+			// Other modifiers, e.g., exp, are ignored.
+			continue
+		}
+
+		result := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = SPFFail, term[1:]
+		case '~':
+			result, term = SPFSoftFail, term[1:]
+		case '?':
+			result, term = SPFNeutral, term[1:]
+		}
+		match, err := r.match(term, domain)
+		if err != nil {
+			return "", err
+		}
+		if match {
+			return result, nil
+		}
+	}
+
+	if len(redirect) > 0 {
+		if err := r.countLookup(); err != nil {
+			return "", err
+		}
+		target, err := r.expand(redirect, domain)
+		if err != nil {
+			return "", err
+		}
+		result, err := r.checkHost(target)
+		if err != nil {
+			return "", err
+		}
+		if result == SPFNone {
+			return "", permError("no SPF record of the redirect domain: %v", target)
+		}
+		return result, nil
+	}
+
+	return SPFNeutral, nil
+}
+
+// lookupRecord returns the SPF record of domain, or an empty string if there is no record.
+func (r *spfChecker) lookupRecord(domain string) (string, error) {
+	records, err := r.resolver.LookupTXT(domain)
+	if err != nil {
+		return "", &spfError{result: SPFTempError, err: err}
+	}
+
+	var result []string
+	for _, v := range records {
+		if strings.EqualFold(v, "v=spf1") || strings.HasPrefix(strings.ToLower(v), "v=spf1 ") {
+			result = append(result, v)
+		}
+	}
+	if len(result) > 1 {
+		return "", permError("multiple SPF records of %v", domain)
+	}
+	if len(result) == 0 {
+		return "", nil
+	}
+
+	return result[0], nil
+}
+
+// splitModifier returns the name and the value of a modifier term.
+func splitModifier(term string) (name, value string, ok bool) {
+	i := strings.Index(term, "=")
+	if i <= 0 {
+		return "", "", false
+	}
+	// The name of a modifier is an ALPHA followed by ALPHA, DIGIT, "-", "_", or ".".
+	for j, c := range term[:i] {
+		alpha := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !alpha && (j == 0 || !((c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.')) {
+			return "", "", false
+		}
+	}
+
+	return term[:i], term[i+1:], true
+}
+
+func (r *spfChecker) match(term, domain string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		if len(arg) > 0 {
+			return false, permError("invalid mechanism: %v", term)
+		}
+		return true, nil
+	case "include":
+		return r.matchInclude(arg, domain)
+	case "a":
+		return r.matchA(arg, domain)
+	case "mx":
+		return r.matchMX(arg, domain)
+	case "ptr":
+		return r.matchPTR(arg, domain)
+	case "ip4", "ip6":
+		return r.matchIP(strings.ToLower(name), arg)
+	case "exists":
+		return r.matchExists(arg, domain)
+	default:
+		return false, permError("unknown mechanism: %v", term)
+	}
+}
+
+func (r *spfChecker) matchInclude(arg, domain string) (bool, error) {
+	if !strings.HasPrefix(arg, ":") {
+		return false, permError("missing include domain")
+	}
+	if err := r.countLookup(); err != nil {
+		return false, err
+	}
+	target, err := r.expand(arg[1:], domain)
+	if err != nil {
+		return false, err
+	}
+	result, err := r.checkHost(target)
+	if err != nil {
+		return false, err
+	}
+
+	switch result {
+	case SPFPass:
+		return true, nil
+	case SPFNone:
+		return false, permError("no SPF record of the included domain: %v", target)
+	default:
+		return false, nil
+	}
+}
+
+func (r *spfChecker) matchA(arg, domain string) (bool, error) {
+	if err := r.countLookup(); err != nil {
+		return false, err
+	}
+	target, mask4, mask6, err := r.parseDomainCIDR(arg, domain)
+	if err != nil {
+		return false, err
+	}
+	ips, err := r.lookupIP(target)
+	if err != nil {
+		return false, err
+	}
+
+	return r.matchAny(ips, mask4, mask6), nil
+}
+
+func (r *spfChecker) matchMX(arg, domain string) (bool, error) {
+	if err := r.countLookup(); err != nil {
+		return false, err
+	}
+	target, mask4, mask6, err := r.parseDomainCIDR(arg, domain)
+	if err != nil {
+		return false, err
+	}
+	hosts, err := r.resolver.LookupMX(target)
+	if err != nil {
+		return false, &spfError{result: SPFTempError, err: err}
+	}
+	if err := r.countVoid(len(hosts)); err != nil {
+		return false, err
+	}
+	if len(hosts) > maxSPFMXHosts {
+		return false, permError("too many MX hosts of %v", target)
+	}
+	for _, v := range hosts {
+		ips, err := r.lookupIP(v)
+		if err != nil {
+			return false, err
+		}
+		if r.matchAny(ips, mask4, mask6) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchPTR implements the ptr mechanism, which is deprecated but still used.
+func (r *spfChecker) matchPTR(arg, domain string) (bool, error) {
+	if err := r.countLookup(); err != nil {
+		return false, err
+	}
+	target := domain
+	if strings.HasPrefix(arg, ":") {
+		var err error
+		if target, err = r.expand(arg[1:], domain); err != nil {
+			return false, err
+		}
+	} else if len(arg) > 0 {
+		return false, permError("invalid ptr mechanism: ptr%v", arg)
+	}
+
+	names, err := r.resolver.LookupAddr(r.ip)
+	if err != nil {
+		// Temporary errors are ignored in the ptr mechanism.
+		return false, nil
+	}
+	for i, v := range names {
+		// Only the first 10 names are checked.
+		if i >= 10 {
+			break
+		}
+		if !isSubdomain(strings.ToLower(v), target) {
+			continue
+		}
+		ips, err := r.resolver.LookupIP(v)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(r.ip) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (r *spfChecker) matchIP(name, arg string) (bool, error) {
+	if !strings.HasPrefix(arg, ":") {
+		return false, permError("invalid %v mechanism", name)
+	}
+	arg = arg[1:]
+	if !strings.Contains(arg, "/") {
+		if name == "ip4" {
+			arg += "/32"
+		} else {
+			arg += "/128"
+		}
+	}
+	ip, network, err := net.ParseCIDR(arg)
+	if err != nil || (name == "ip4") != (ip.To4() != nil) {
+		return false, permError("invalid %v network: %v", name, arg)
+	}
+
+	return network.Contains(r.ip), nil
+}
+
+func (r *spfChecker) matchExists(arg, domain string) (bool, error) {
+	if !strings.HasPrefix(arg, ":") {
+		return false, permError("missing exists domain")
+	}
+	if err := r.countLookup(); err != nil {
+		return false, err
+	}
+	target, err := r.expand(arg[1:], domain)
+	if err != nil {
+		return false, err
+	}
+	ips, err := r.lookupIP(target)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range ips {
+		// The exists mechanism only uses A records.
+		if v.To4() != nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (r *spfChecker) lookupIP(name string) ([]net.IP, error) {
+	ips, err := r.resolver.LookupIP(name)
+	if err != nil {
+		return nil, &spfError{result: SPFTempError, err: err}
+	}
+	if err := r.countVoid(len(ips)); err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+func (r *spfChecker) matchAny(ips []net.IP, mask4, mask6 int) bool {
+	for _, v := range ips {
+		bits, ones := 128, mask6
+		if v.To4() != nil {
+			bits, ones = 32, mask4
+		}
+		// Addresses of the other family never match.
+		if (v.To4() != nil) != (r.ip.To4() != nil) {
+			continue
+		}
+		network := net.IPNet{IP: v.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+		if network.Contains(r.ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseDomainCIDR parses [":" domain-spec] [ip4-cidr-length] ["/" ip6-cidr-length].
+func (r *spfChecker) parseDomainCIDR(arg, domain string) (target string, mask4, mask6 int, err error) {
+	target, mask4, mask6 = domain, 32, 128
+	if i := strings.Index(arg, "//"); i >= 0 {
+		if mask6, err = strconv.Atoi(arg[i+2:]); err != nil || mask6 < 0 || mask6 > 128 {
+			return "", 0, 0, permError("invalid IPv6 CIDR length: %v", arg)
+		}
+		arg = arg[:i]
+	}
+	if i := strings.LastIndex(arg, "/"); i >= 0 {
+		if mask4, err = strconv.Atoi(arg[i+1:]); err != nil || mask4 < 0 || mask4 > 32 {
+			return "", 0, 0, permError("invalid IPv4 CIDR length: %v", arg)
+		}
+		arg = arg[:i]
+	}
+	if strings.HasPrefix(arg, ":") {
+		if target, err = r.expand(arg[1:], domain); err != nil {
+			return "", 0, 0, err
+		}
+	} else if len(arg) > 0 {
+		return "", 0, 0, permError("invalid domain-spec: %v", arg)
+	}
+
+	return target, mask4, mask6, nil
+}
+
+func (r *spfChecker) countLookup() error {
+	r.lookups++
+	if r.lookups > maxSPFLookups {
+		return permError("too many DNS lookups")
+	}
+
+	return nil
+}
+
+func (r *spfChecker) countVoid(n int) error {
+	if n > 0 {
+		return nil
+	}
+	r.voids++
+	if r.voids > maxSPFVoidLookups {
+		return permError("too many void DNS lookups")
+	}
+
+	return nil
+}
+
+// expand expands the macros of a domain-spec (RFC 7208 section 7).
+func (r *spfChecker) expand(spec, domain string) (string, error) {
+	var result []byte
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		if c != '%' {
+			result = append(result, c)
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", permError("invalid macro: %v", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			result = append(result, '%')
+		case '_':
+			result = append(result, ' ')
+		case '-':
+			result = append(result, "%20"...)
+		case '{':
+			end := strings.Index(spec[i:], "}")
+			if end < 0 {
+				return "", permError("invalid macro: %v", spec)
+			}
+			v, err := r.expandMacro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			result = append(result, v...)
+			i += end
+		default:
+			return "", permError("invalid macro: %v", spec)
+		}
+	}
+
+	return truncateDomain(strings.TrimSuffix(string(result), ".")), nil
+}
+
+func (r *spfChecker) expandMacro(macro, domain string) (string, error) {
+	if len(macro) == 0 {
+		return "", errors.New("empty macro")
+	}
+	local, senderDomain := r.sender, r.sender
+	if i := strings.LastIndex(r.sender, "@"); i >= 0 {
+		local, senderDomain = r.sender[:i], r.sender[i+1:]
+	}
+
+	var value string
+	letter := macro[0]
+	switch letter | 0x20 {
+	case 's':
+		value = r.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = senderDomain
+	case 'd':
+		value = domain
+	case 'i':
+		value = dottedIP(r.ip)
+	case 'p':
+		value = "unknown"
+	case 'v':
+		value = "ip6"
+		if r.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case 'h':
+		value = r.helo
+	default:
+		return "", permError("unknown macro letter: %c", letter)
+	}
+
+	// Transformers: the number of the rightmost parts to keep, and reversal.
+	rest := macro[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", permError("invalid macro transformer: %v", macro)
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+	delimiters := "."
+	if len(rest) > 0 {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permError("invalid macro delimiter: %v", macro)
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(c rune) bool { return strings.ContainsRune(delimiters, c) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+	// Uppercase macro letters are URL escaped.
+	if letter >= 'A' && letter <= 'Z' {
+		value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	}
+
+	return value, nil
+}
+
+// dottedIP returns ip in the dotted format of the i macro, in which an IPv6
+// address is a dot separated nibbles.
+func dottedIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0x0f), 16))
+	}
+
+	return strings.Join(nibbles, ".")
+}
+
+// truncateDomain removes labels from the left of domain until it has 253
+// characters or less.
+func truncateDomain(domain string) string {
+	for len(domain) > 253 {
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return domain
+		}
+		domain = domain[i+1:]
+	}
+
+	return domain
+}
+
+func isValidDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, v := range labels {
+		if len(v) == 0 || len(v) > 63 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isSubdomain returns whether domain is parent or a subdomain of parent.
+func isSubdomain(domain, parent string) bool {
+	domain, parent = strings.ToLower(domain), strings.ToLower(parent)
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
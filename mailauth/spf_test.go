@@ -0,0 +1,254 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package mailauth
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func newSPFResolver() *fakeResolver {
+	return &fakeResolver{
+		txt: map[string][]string{
+			"example.com":          {"google-site-verification=abc", "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:mail.example.com mx/28 include:_spf.example.net -all"},
+			"_spf.example.net":     {"v=spf1 ip4:198.51.100.0/24 ~all"},
+			"redirect.example.com": {"v=spf1 ip4:203.0.113.1 redirect=example.com"},
+			"nowhere.example.com":  {"v=spf1 redirect=none.example.com"},
+			"include.example.com":  {"v=spf1 include:none.example.com -all"},
+			"soft.example.com":     {"v=spf1 ~all"},
+			"neutral.example.com":  {"v=spf1 ?all"},
+			"empty.example.com":    {"v=spf1"},
+			"multiple.example.com": {"v=spf1 -all", "v=spf1 +all"},
+			"unknown.example.com":  {"v=spf1 foo:bar -all"},
+			"invalid.example.com":  {"v=spf1 ip4:192.0.2.0/33 -all"},
+			"temp.example.com":     {"v=spf1 include:broken.example.com -all"},
+			"helo.example.com":     {"v=spf1 a -all"},
+			"macro.example.com":    {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+			"ptr.example.com":      {"v=spf1 ptr -all"},
+		},
+		ip: map[string][]string{
+			"mail.example.com":                          {"192.0.2.200", "203.0.113.10"},
+			"mx1.example.com":                           {"203.0.113.20"},
+			"mx2.example.com":                           {"2001:db8:ffff::1"},
+			"helo.example.com":                          {"203.0.113.30"},
+			"30.113.0.203.alice._spf.macro.example.com": {"127.0.0.2"},
+			"host.ptr.example.com":                      {"203.0.113.40"},
+		},
+		mx: map[string][]string{
+			"example.com": {"mx1.example.com", "mx2.example.com"},
+		},
+		ptr: map[string][]string{
+			"203.0.113.40": {"host.ptr.example.com"},
+			"203.0.113.41": {"host.ptr.example.com"},
+		},
+		errs: map[string]bool{
+			"broken.example.com": true,
+		},
+	}
+}
+
+func TestCheckSPF(t *testing.T) {
+	tests := []struct {
+		ip     string
+		helo   string
+		sender string
+		result SPFResult
+		domain string
+	}{
+		// ip4, ip6, a, and mx mechanisms.
+		{"192.0.2.1", "", "alice@example.com", SPFPass, "example.com"},
+		{"2001:db8::1", "", "alice@example.com", SPFPass, "example.com"},
+		{"203.0.113.10", "", "alice@example.com", SPFPass, "example.com"},
+		{"203.0.113.20", "", "alice@example.com", SPFPass, "example.com"},
+		{"203.0.113.31", "", "alice@EXAMPLE.COM", SPFPass, "example.com"},
+		{"203.0.113.47", "", "alice@example.com", SPFFail, "example.com"},
+		// include mechanism: a softfail of the included domain is not a match.
+		{"198.51.100.1", "", "alice@example.com", SPFPass, "example.com"},
+		{"2001:db9::1", "", "alice@example.com", SPFFail, "example.com"},
+		{"192.0.2.1", "", "alice@include.example.com", SPFPermError, "include.example.com"},
+		{"192.0.2.1", "", "alice@temp.example.com", SPFTempError, "temp.example.com"},
+		// redirect modifier is used only if no mechanism matches.
+		{"203.0.113.1", "", "alice@redirect.example.com", SPFPass, "redirect.example.com"},
+		{"192.0.2.1", "", "alice@redirect.example.com", SPFPass, "redirect.example.com"},
+		{"203.0.113.47", "", "alice@redirect.example.com", SPFFail, "redirect.example.com"},
+		{"192.0.2.1", "", "alice@nowhere.example.com", SPFPermError, "nowhere.example.com"},
+		// Default results.
+		{"192.0.2.1", "", "alice@soft.example.com", SPFSoftFail, "soft.example.com"},
+		{"192.0.2.1", "", "alice@neutral.example.com", SPFNeutral, "neutral.example.com"},
+		{"192.0.2.1", "", "alice@empty.example.com", SPFNeutral, "empty.example.com"},
+		{"192.0.2.1", "", "alice@none.example.com", SPFNone, "none.example.com"},
+		{"192.0.2.1", "", "alice@localhost", SPFNone, "localhost"},
+		// Broken records.
+		{"192.0.2.1", "", "alice@multiple.example.com", SPFPermError, "multiple.example.com"},
+		{"192.0.2.1", "", "alice@unknown.example.com", SPFPermError, "unknown.example.com"},
+		{"192.0.2.1", "", "alice@invalid.example.com", SPFPermError, "invalid.example.com"},
+		{"192.0.2.1", "", "alice@broken.example.com", SPFTempError, "broken.example.com"},
+		// HELO identity, and the postmaster of a sender without a local part.
+		{"203.0.113.30", "helo.example.com", "", SPFPass, "helo.example.com"},
+		{"203.0.113.31", "helo.example.com", "", SPFFail, "helo.example.com"},
+		{"203.0.113.30", "mail.example.net", "@helo.example.com", SPFPass, "helo.example.com"},
+		// Macros and the ptr mechanism.
+		{"203.0.113.30", "", "alice@macro.example.com", SPFPass, "macro.example.com"},
+		{"203.0.113.30", "", "bob@macro.example.com", SPFFail, "macro.example.com"},
+		{"203.0.113.40", "", "alice@ptr.example.com", SPFPass, "ptr.example.com"},
+		{"203.0.113.41", "", "alice@ptr.example.com", SPFFail, "ptr.example.com"},
+	}
+	for _, v := range tests {
+		result, domain, err := CheckSPF(newSPFResolver(), net.ParseIP(v.ip), v.helo, v.sender)
+		if result != v.result || domain != v.domain {
+			t.Errorf("ip=%v, helo=%v, sender=%v: expected %v of %v, got %v of %v (err=%v)", v.ip, v.helo, v.sender, v.result, v.domain, result, domain, err)
+		}
+		if (err != nil) != (result == SPFPermError || result == SPFTempError) {
+			t.Errorf("ip=%v, sender=%v: unexpected error of %v: %v", v.ip, v.sender, result, err)
+		}
+	}
+}
+
+// newChainResolver returns a resolver that has a record of example.com whose
+// n terms refer to other domains by mechanism, e.g., include, and the records
+// of the other domains.
+func newChainResolver(mechanism string, n int) *fakeResolver {
+	r := &fakeResolver{
+		txt: map[string][]string{},
+		ip:  map[string][]string{},
+		mx:  map[string][]string{},
+	}
+	terms := []string{"v=spf1"}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("d%v.example.com", i)
+		terms = append(terms, fmt.Sprintf("%v:%v", mechanism, name))
+		r.txt[name] = []string{"v=spf1 -all"}
+		r.ip[name] = []string{"203.0.113.1"}
+		r.mx[name] = []string{"mx.example.com"}
+	}
+	r.ip["mx.example.com"] = []string{"203.0.113.1"}
+	r.txt["example.com"] = []string{strings.Join(append(terms, "ip4:192.0.2.1", "-all"), " ")}
+
+	return r
+}
+
+func TestCheckSPFLookupLimit(t *testing.T) {
+	for _, mechanism := range []string{"include", "a", "mx"} {
+		result, _, err := CheckSPF(newChainResolver(mechanism, maxSPFLookups), net.ParseIP("192.0.2.1"), "", "alice@example.com")
+		if result != SPFPass {
+			t.Errorf("%v: expected pass with %v lookups, got %v (err=%v)", mechanism, maxSPFLookups, result, err)
+		}
+		result, _, err = CheckSPF(newChainResolver(mechanism, maxSPFLookups+1), net.ParseIP("192.0.2.1"), "", "alice@example.com")
+		if result != SPFPermError || err == nil {
+			t.Errorf("%v: expected permerror with %v lookups, got %v (err=%v)", mechanism, maxSPFLookups+1, result, err)
+		}
+	}
+
+	// Lookups of included records and redirects are counted together.
+	r := &fakeResolver{txt: map[string][]string{}}
+	for i := 0; i < maxSPFLookups; i++ {
+		r.txt[fmt.Sprintf("d%v.example.com", i)] = []string{fmt.Sprintf("v=spf1 redirect=d%v.example.com", i+1)}
+	}
+	r.txt[fmt.Sprintf("d%v.example.com", maxSPFLookups)] = []string{"v=spf1 +all"}
+	result, _, err := CheckSPF(r, net.ParseIP("192.0.2.1"), "", "alice@d0.example.com")
+	if result != SPFPass {
+		t.Errorf("expected pass with %v redirects, got %v (err=%v)", maxSPFLookups, result, err)
+	}
+	r.txt["example.com"] = []string{"v=spf1 include:d0.example.com -all"}
+	result, _, err = CheckSPF(r, net.ParseIP("192.0.2.1"), "", "alice@example.com")
+	if result != SPFPermError {
+		t.Errorf("expected permerror with %v lookups, got %v (err=%v)", maxSPFLookups+1, result, err)
+	}
+
+	// Mechanisms that do not cause lookups are not counted.
+	terms := []string{"v=spf1"}
+	for i := 0; i < maxSPFLookups*2; i++ {
+		terms = append(terms, fmt.Sprintf("ip4:203.0.113.%v", i))
+	}
+	r = &fakeResolver{txt: map[string][]string{"example.com": {strings.Join(append(terms, "ip4:192.0.2.1"), " ")}}}
+	if result, _, err := CheckSPF(r, net.ParseIP("192.0.2.1"), "", "alice@example.com"); result != SPFPass {
+		t.Errorf("expected pass with ip4 mechanisms, got %v (err=%v)", result, err)
+	}
+}
+
+func TestCheckSPFVoidLookupLimit(t *testing.T) {
+	for _, mechanism := range []string{"a", "mx", "exists"} {
+		for n := 1; n <= maxSPFVoidLookups+1; n++ {
+			r := newChainResolver(mechanism, n)
+			// Remove the records of all the referred domains.
+			r.ip = map[string][]string{}
+			r.mx = map[string][]string{}
+
+			result, _, err := CheckSPF(r, net.ParseIP("192.0.2.1"), "", "alice@example.com")
+			expected := SPFPass
+			if n > maxSPFVoidLookups {
+				expected = SPFPermError
+			}
+			if result != expected {
+				t.Errorf("%v: expected %v with %v void lookups, got %v (err=%v)", mechanism, expected, n, result, err)
+			}
+		}
+	}
+}
+
+func TestExpandMacro(t *testing.T) {
+	c := &spfChecker{
+		ip:     net.ParseIP("192.0.2.3"),
+		helo:   "mail.example.net",
+		sender: "strong-bad@email.example.com",
+	}
+	tests := map[string]string{
+		"%{s}":                  "strong-bad@email.example.com",
+		"%{o}":                  "email.example.com",
+		"%{d}":                  "email.example.com",
+		"%{d4}":                 "email.example.com",
+		"%{d3}":                 "email.example.com",
+		"%{d2}":                 "example.com",
+		"%{d1}":                 "com",
+		"%{dr}":                 "com.example.email",
+		"%{d2r}":                "example.email",
+		"%{l}":                  "strong-bad",
+		"%{l-}":                 "strong.bad",
+		"%{lr}":                 "strong-bad",
+		"%{lr-}":                "bad.strong",
+		"%{l1r-}":               "strong",
+		"%{ir}.%{v}._spf.%{d2}": "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":  "bad.strong.lp._spf.example.com",
+		"%{h}":                  "mail.example.net",
+		"%{S}":                  "strong-bad%40email.example.com",
+		"%%%_%-":                "% %20",
+	}
+	for spec, expected := range tests {
+		v, err := c.expand(spec, "email.example.com")
+		if err != nil || v != expected {
+			t.Errorf("%v: expected %v, got %v (err=%v)", spec, expected, v, err)
+		}
+	}
+
+	for _, spec := range []string{"%", "%{", "%{x}", "%{d0}", "%a"} {
+		if v, err := c.expand(spec, "email.example.com"); err == nil {
+			t.Errorf("%v: expected an error, got %v", spec, v)
+		}
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	expected := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if v, err := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com"); err != nil || v != expected {
+		t.Errorf("expected %v, got %v (err=%v)", expected, v, err)
+	}
+}
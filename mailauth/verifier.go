@@ -0,0 +1,199 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package mailauth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/dkim"
+)
+
+type Config struct {
+	// Hostname is the authserv-id of Authentication-Results headers.
+	Hostname string
+	Resolver Resolver
+}
+
+// Verifier authenticates inbound messages using SPF, DKIM, and DMARC.
+type Verifier struct {
+	config Config
+}
+
+func NewVerifier(conf Config) (*Verifier, error) {
+	if len(conf.Hostname) == 0 {
+		return nil, errors.New("empty hostname")
+	}
+	if conf.Resolver == nil {
+		return nil, errors.New("nil resolver")
+	}
+
+	return &Verifier{config: conf}, nil
+}
+
+// Results are the results of the verifications of a message.
+type Results struct {
+	// SPF is empty if SPF has not been checked.
+	SPF SPFResult
+	// SPFIdentity is either "mailfrom" or "helo".
+	SPFIdentity string
+	SPFDomain   string
+	DKIM        []dkim.Verification
+	// DMARC is empty if DMARC has not been evaluated.
+	DMARC DMARCResult
+	// DMARCPolicy is the policy to apply to the message, which is not
+	// DMARCPolicyNone only if DMARC is DMARCFail.
+	DMARCPolicy DMARCPolicy
+	FromDomain  string
+}
+
+// Verify authenticates msg sent by a client whose IP address is ip. helo is the
+// HELO or EHLO argument of the client, and from is the MAIL FROM address. SPF
+// and DMARC are skipped if ip is nil, e.g., for a message relayed by a local
+// MTA, because SPF of the relaying host is meaningless.
+func (r *Verifier) Verify(ip net.IP, helo, from string, msg []byte) *Results {
+	result := &Results{
+		DKIM: dkim.Verify(msg, r.config.Resolver, time.Now()),
+	}
+	if ip == nil {
+		return result
+	}
+
+	result.SPFIdentity = "mailfrom"
+	if len(from) == 0 {
+		result.SPFIdentity = "helo"
+	}
+	result.SPF, result.SPFDomain, _ = CheckSPF(r.config.Resolver, ip, helo, from)
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return result
+	}
+	// DMARC requires a single author address.
+	list, err := m.Header.AddressList("From")
+	if err != nil || len(list) != 1 {
+		return result
+	}
+	i := strings.LastIndex(list[0].Address, "@")
+	if i < 0 {
+		return result
+	}
+	result.FromDomain = strings.ToLower(list[0].Address[i+1:])
+
+	spf := identifier{domain: result.SPFDomain, pass: result.SPF == SPFPass}
+	ids := []identifier{}
+	for _, v := range result.DKIM {
+		ids = append(ids, identifier{domain: v.Domain, pass: v.Status == dkim.StatusPass})
+	}
+	result.DMARC, result.DMARCPolicy, _ = checkDMARC(r.config.Resolver, result.FromDomain, spf, ids)
+
+	return result
+}
+
+// Header returns the Authentication-Results header (RFC 8601) of r, which ends
+// with CRLF.
+func (r *Results) Header(authservID string) string {
+	results := []string{}
+	if len(r.SPF) > 0 {
+		results = append(results, fmt.Sprintf("spf=%v smtp.%v=%v", r.SPF, r.SPFIdentity, r.SPFDomain))
+	}
+	if len(r.DKIM) == 0 {
+		results = append(results, "dkim=none")
+	}
+	for _, v := range r.DKIM {
+		s := fmt.Sprintf("dkim=%v", v.Status)
+		if v.Err != nil {
+			s += fmt.Sprintf(" (%v)", comment(v.Err.Error()))
+		}
+		if len(v.Domain) > 0 {
+			s += fmt.Sprintf(" header.d=%v header.s=%v", v.Domain, v.Selector)
+		}
+		results = append(results, s)
+	}
+	if len(r.DMARC) > 0 {
+		s := fmt.Sprintf("dmarc=%v", r.DMARC)
+		if r.DMARC == DMARCFail {
+			s += fmt.Sprintf(" (p=%v)", r.DMARCPolicy)
+		}
+		results = append(results, s+fmt.Sprintf(" header.from=%v", r.FromDomain))
+	}
+
+	return fmt.Sprintf("Authentication-Results: %v;\r\n\t%v\r\n", authservID, strings.Join(results, ";\r\n\t"))
+}
+
+// comment removes characters that cannot be in a header comment.
+func comment(s string) string {
+	s = strings.Map(func(c rune) rune {
+		switch c {
+		case '(', ')', '\\', '\r', '\n':
+			return -1
+		}
+		return c
+	}, s)
+
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// StripResults removes the Authentication-Results headers whose authserv-id is
+// authservID from msg, which may have been forged by the sender (RFC 8601
+// section 5).
+func StripResults(msg []byte, authservID string) []byte {
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	if end < 0 {
+		return msg
+	}
+
+	var result bytes.Buffer
+	skip := false
+	for _, line := range strings.SplitAfter(string(msg[:end+2]), "\r\n") {
+		if len(line) == 0 {
+			continue
+		}
+		// Continuation lines belong to the previous field.
+		if line[0] != ' ' && line[0] != '\t' {
+			skip = isOwnResults(line, authservID)
+		}
+		if !skip {
+			result.WriteString(line)
+		}
+	}
+	result.Write(msg[end+2:])
+
+	return result.Bytes()
+}
+
+func isOwnResults(line, authservID string) bool {
+	i := strings.Index(line, ":")
+	if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "Authentication-Results") {
+		return false
+	}
+	id := line[i+1:]
+	if j := strings.IndexAny(id, ";("); j >= 0 {
+		id = id[:j]
+	}
+
+	return strings.EqualFold(strings.TrimSpace(id), authservID)
+}
@@ -0,0 +1,263 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package mailauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/superkkt/omega/dkim"
+)
+
+// fakeResolver has DNS records by lowercase name. Names in errs fail
+// temporarily.
+type fakeResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	errs map[string]bool
+}
+
+func (r *fakeResolver) lookup(records map[string][]string, name string) ([]string, error) {
+	name = strings.ToLower(name)
+	if r.errs[name] {
+		return nil, temporaryError{errors.New("SERVFAIL")}
+	}
+
+	return records[name], nil
+}
+
+func (r *fakeResolver) LookupTXT(name string) ([]string, error) {
+	return r.lookup(r.txt, name)
+}
+
+func (r *fakeResolver) LookupIP(name string) ([]net.IP, error) {
+	v, err := r.lookup(r.ip, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []net.IP{}
+	for _, s := range v {
+		result = append(result, net.ParseIP(s))
+	}
+	return result, nil
+}
+
+func (r *fakeResolver) LookupMX(name string) ([]string, error) {
+	return r.lookup(r.mx, name)
+}
+
+func (r *fakeResolver) LookupAddr(ip net.IP) ([]string, error) {
+	return r.lookup(r.ptr, ip.String())
+}
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testDKIMKey returns a signing key of example.com and its DNS record.
+func testDKIMKey(t *testing.T) (dkim.Key, string) {
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+			t.Fatalf("failed to generate a key: %v", err)
+		}
+	})
+	der, err := x509.MarshalPKIXPublicKey(&testKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal the public key: %v", err)
+	}
+
+	key := dkim.Key{Domain: "example.com", Selector: "test", Private: testKey}
+	return key, "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: Bob <bob@example.org>\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hello, Bob.\r\n"
+
+func newVerifierResolver(t *testing.T, dmarc string) *fakeResolver {
+	_, record := testDKIMKey(t)
+	return &fakeResolver{
+		txt: map[string][]string{
+			"example.com":                 {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"test._domainkey.example.com": {record},
+			"_dmarc.example.com":          {dmarc},
+			"mail.example.net":            {"v=spf1 ip4:198.51.100.0/24 -all"},
+			"test._domainkey.example.net": {record},
+		},
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key, _ := testDKIMKey(t)
+	signed, err := dkim.Sign([]byte(testMessage), key, dkim.DefaultHeaders, time.Now())
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	tampered := strings.Replace(string(signed), "Hello, Bob.", "Send me money.", 1)
+	other := key
+	other.Domain = "example.net"
+	thirdParty, err := dkim.Sign([]byte(testMessage), other, dkim.DefaultHeaders, time.Now())
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		ip     string
+		from   string
+		msg    string
+		spf    SPFResult
+		dkim   []dkim.Status
+		dmarc  DMARCResult
+		policy DMARCPolicy
+	}{
+		{"all pass", "192.0.2.1", "alice@example.com", string(signed), SPFPass, []dkim.Status{dkim.StatusPass}, DMARCPass, DMARCPolicyNone},
+		{"DKIM pass only", "203.0.113.1", "alice@example.com", string(signed), SPFFail, []dkim.Status{dkim.StatusPass}, DMARCPass, DMARCPolicyNone},
+		{"SPF pass only", "192.0.2.1", "alice@example.com", tampered, SPFPass, []dkim.Status{dkim.StatusFail}, DMARCPass, DMARCPolicyNone},
+		{"both fail", "203.0.113.1", "alice@example.com", tampered, SPFFail, []dkim.Status{dkim.StatusFail}, DMARCFail, DMARCPolicyReject},
+		{"unsigned", "203.0.113.1", "alice@example.com", testMessage, SPFFail, nil, DMARCFail, DMARCPolicyReject},
+		// SPF and DKIM of another domain pass, but they are not aligned.
+		{"not aligned", "198.51.100.1", "bounce@mail.example.net", string(thirdParty), SPFPass, []dkim.Status{dkim.StatusPass}, DMARCFail, DMARCPolicyReject},
+		{"HELO identity", "198.51.100.1", "", testMessage, SPFPass, nil, DMARCFail, DMARCPolicyReject},
+	}
+	for _, v := range tests {
+		verifier, err := NewVerifier(Config{Hostname: "mx.example.org", Resolver: newVerifierResolver(t, "v=DMARC1; p=reject")})
+		if err != nil {
+			t.Fatalf("failed to create a verifier: %v", err)
+		}
+		result := verifier.Verify(net.ParseIP(v.ip), "mail.example.net", v.from, []byte(v.msg))
+		if result.SPF != v.spf {
+			t.Errorf("%v: expected SPF %v, got %v", v.name, v.spf, result.SPF)
+		}
+		if len(result.DKIM) != len(v.dkim) {
+			t.Errorf("%v: expected DKIM %v, got %+v", v.name, v.dkim, result.DKIM)
+		} else {
+			for i, s := range v.dkim {
+				if result.DKIM[i].Status != s {
+					t.Errorf("%v: expected DKIM %v, got %+v", v.name, s, result.DKIM[i])
+				}
+			}
+		}
+		if result.DMARC != v.dmarc || result.DMARCPolicy != v.policy {
+			t.Errorf("%v: expected DMARC %v (p=%v), got %v (p=%v)", v.name, v.dmarc, v.policy, result.DMARC, result.DMARCPolicy)
+		}
+		if result.FromDomain != "example.com" {
+			t.Errorf("%v: unexpected From domain: %v", v.name, result.FromDomain)
+		}
+	}
+}
+
+func TestVerifyLocal(t *testing.T) {
+	key, _ := testDKIMKey(t)
+	signed, err := dkim.Sign([]byte(testMessage), key, dkim.DefaultHeaders, time.Now())
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	verifier, err := NewVerifier(Config{Hostname: "mx.example.org", Resolver: newVerifierResolver(t, "v=DMARC1; p=reject")})
+	if err != nil {
+		t.Fatalf("failed to create a verifier: %v", err)
+	}
+
+	// SPF and DMARC are skipped for a message relayed by a local MTA.
+	result := verifier.Verify(nil, "localhost", "alice@example.com", signed)
+	if len(result.SPF) > 0 || len(result.DMARC) > 0 {
+		t.Errorf("unexpected SPF or DMARC result: %+v", result)
+	}
+	if len(result.DKIM) != 1 || result.DKIM[0].Status != dkim.StatusPass {
+		t.Errorf("unexpected DKIM result: %+v", result.DKIM)
+	}
+}
+
+func TestResultsHeader(t *testing.T) {
+	r := &Results{
+		SPF:         SPFFail,
+		SPFIdentity: "mailfrom",
+		SPFDomain:   "example.com",
+		DKIM: []dkim.Verification{
+			{Status: dkim.StatusPass, Domain: "example.com", Selector: "test"},
+			{Status: dkim.StatusFail, Domain: "example.net", Selector: "s1", Err: errors.New("body hash (bh) mismatch\r\n")},
+		},
+		DMARC:       DMARCFail,
+		DMARCPolicy: DMARCPolicyReject,
+		FromDomain:  "example.com",
+	}
+	expected := "Authentication-Results: mx.example.org;\r\n" +
+		"\tspf=fail smtp.mailfrom=example.com;\r\n" +
+		"\tdkim=pass header.d=example.com header.s=test;\r\n" +
+		"\tdkim=fail (body hash bh mismatch) header.d=example.net header.s=s1;\r\n" +
+		"\tdmarc=fail (p=reject) header.from=example.com\r\n"
+	if v := r.Header("mx.example.org"); v != expected {
+		t.Errorf("expected %q, got %q", expected, v)
+	}
+
+	expected = "Authentication-Results: mx.example.org;\r\n\tdkim=none\r\n"
+	if v := (&Results{}).Header("mx.example.org"); v != expected {
+		t.Errorf("expected %q, got %q", expected, v)
+	}
+}
+
+func TestStripResults(t *testing.T) {
+	msg := "Received: from mail.example.net\r\n" +
+		"Authentication-Results: mx.example.org; spf=pass smtp.mailfrom=example.com\r\n" +
+		"Authentication-Results: other.example.net; dkim=pass header.d=example.com\r\n" +
+		"authentication-results:MX.EXAMPLE.ORG;\r\n" +
+		"\tdkim=pass header.d=example.com;\r\n" +
+		"\tdmarc=pass header.from=example.com\r\n" +
+		"Authentication-Results: mx.example.org (forged); dmarc=pass\r\n" +
+		"Authentication-Results : mx.example.org; spf=pass\r\n" +
+		"Authentication-Results: mx.example.org.example.net; spf=pass\r\n" +
+		"X-Authentication-Results: mx.example.org; spf=pass\r\n" +
+		"From: Alice <alice@example.com>\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.org; spf=pass\r\n"
+	expected := "Received: from mail.example.net\r\n" +
+		"Authentication-Results: other.example.net; dkim=pass header.d=example.com\r\n" +
+		"Authentication-Results: mx.example.org.example.net; spf=pass\r\n" +
+		"X-Authentication-Results: mx.example.org; spf=pass\r\n" +
+		"From: Alice <alice@example.com>\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.org; spf=pass\r\n"
+	if v := string(StripResults([]byte(msg), "mx.example.org")); v != expected {
+		t.Errorf("expected %q, got %q", expected, v)
+	}
+
+	// A message without a body is returned as it is.
+	if v := string(StripResults([]byte("Subject: Hello\r\n"), "mx.example.org")); v != "Subject: Hello\r\n" {
+		t.Errorf("unexpected result: %q", v)
+	}
+}
@@ -22,7 +22,8 @@ package authenticator
 
 import "github.com/superkkt/omega/backend"
 
-// TODO: remove this mockup and implement a real authenticator.
+// MockAuth is a mockup authenticator that only allows a single hard-coded
+// user. Use it for debugging purpose only.
 type MockAuth struct {
 	Username string
 	Password string
@@ -0,0 +1,119 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// newBounce returns a delivery status notification (RFC 3464) of an email that
+// has not been delivered to rcpts. The original email is attached in full so
+// that the user can send it again.
+func newBounce(hostname string, e Entry, rcpts []string, raw []byte, cause error, permanent bool) []byte {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	// Human readable explanation.
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	p, _ := w.CreatePart(h)
+	reason := "a permanent error"
+	if !permanent {
+		reason = fmt.Sprintf("repeated temporary failures for %v hours", int(time.Since(e.Created).Hours()))
+	}
+	fmt.Fprintf(p, "Your message could not be delivered to the following recipients due to %v.\r\n\r\n", reason)
+	for _, v := range rcpts {
+		fmt.Fprintf(p, "    %v\r\n", v)
+	}
+	fmt.Fprintf(p, "\r\nError: %v\r\n", oneLine(cause.Error()))
+
+	// Machine readable delivery status.
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Type", "message/delivery-status")
+	p, _ = w.CreatePart(h)
+	fmt.Fprintf(p, "Reporting-MTA: dns; %v\r\n", hostname)
+	fmt.Fprintf(p, "Arrival-Date: %v\r\n", e.Created.Format(time.RFC1123Z))
+	status := "5.0.0"
+	if !permanent {
+		// Delivery time expired.
+		status = "4.4.7"
+	}
+	for _, v := range rcpts {
+		fmt.Fprintf(p, "\r\nFinal-Recipient: rfc822; %v\r\n", v)
+		fmt.Fprintf(p, "Action: failed\r\n")
+		fmt.Fprintf(p, "Status: %v\r\n", status)
+		fmt.Fprintf(p, "Diagnostic-Code: smtp; %v\r\n", oneLine(cause.Error()))
+	}
+
+	// The original message.
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Type", "message/rfc822")
+	h.Set("Content-Disposition", `attachment; filename="original.eml"`)
+	p, _ = w.CreatePart(h)
+	p.Write(raw)
+	w.Close()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: Mail Delivery System <MAILER-DAEMON@%v>\r\n", hostname)
+	fmt.Fprintf(&msg, "To: %v\r\n", e.From)
+	fmt.Fprintf(&msg, "Subject: Undelivered Mail Returned to Sender%v\r\n", originalSubject(raw))
+	fmt.Fprintf(&msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%v@%v>\r\n", randomID(), hostname)
+	fmt.Fprintf(&msg, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%v\"\r\n\r\n", w.Boundary())
+	msg.Write(body.Bytes())
+
+	return msg.Bytes()
+}
+
+// originalSubject returns the subject of raw prefixed with ": ", or an empty
+// string if raw has no subject.
+func originalSubject(raw []byte) string {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+	subject := oneLine(header.Get("Subject"))
+	if len(subject) == 0 {
+		return ""
+	}
+
+	return ": " + subject
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func randomID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,176 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Package outbox implements a durable queue of outgoing emails. Emails are
+// stored in the user's Outbox folder along with a queue entry in the same
+// transaction as the request, and a background worker sends them out later.
+// On success, the worker moves the email to the Sent folder or removes it.
+// Temporary failures are retried with an exponential backoff until the email
+// gets too old, and a bounce message (DSN) is delivered into the user's Inbox
+// on permanent failures.
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/superkkt/logger"
+)
+
+const (
+	// Name of the Outbox folder created on demand.
+	folderName = "Outbox"
+)
+
+// Entry is an email waiting in the queue.
+type Entry struct {
+	ID       uint64
+	UserUID  uint64
+	UserName string
+	// FolderID and EmailID identify the email in the user's Outbox folder.
+	FolderID   uint64
+	EmailID    uint64
+	From       string
+	To         []string
+	SaveInSent bool
+	// Attempts is the number of delivery attempts so far.
+	Attempts    uint
+	NextAttempt time.Time
+	LastError   string
+	Created     time.Time
+}
+
+// NOTE: All methods of Storage should return database.TransactionError if an error occurrs.
+type Storage interface {
+	NewQueue(queryer database.Queryer) Queue
+}
+
+type Queue interface {
+	// AddEntry adds a new entry that will be attempted at e.NextAttempt.
+	AddEntry(e Entry) (id uint64, err error)
+	// GetDueEntries returns entries whose next attempt time has passed, ordered
+	// by the next attempt time. GetDueEntries can return nil if there is no
+	// such entry.
+	GetDueEntries(limit uint) ([]Entry, error)
+	// ClaimEntry increases the attempts of an entry and postpones its next
+	// attempt by lease, only if the attempts of the entry is still same with
+	// attempts. ClaimEntry returns false if another worker has claimed it.
+	ClaimEntry(id uint64, attempts uint, lease time.Duration) (ok bool, err error)
+	// RescheduleEntry sets the remaining recipients, the next attempt time,
+	// and the last error of an entry.
+	RescheduleEntry(id uint64, to []string, next time.Time, lastError string) error
+	// RemoveEntry removes an entry whose ID is id.
+	RemoveEntry(id uint64) error
+}
+
+// Enqueuer implements the activesync.Outbox interface.
+type Enqueuer struct {
+	backend backend.Storage
+	storage Storage
+}
+
+func NewEnqueuer(b backend.Storage, s Storage) *Enqueuer {
+	return &Enqueuer{
+		backend: b,
+		storage: s,
+	}
+}
+
+// Enqueue stores msg into the Outbox folder of the user, and then adds a new
+// queue entry so that the worker sends it out. The Outbox folder is created
+// if it does not exist. Enqueue should be called in a transaction that will be
+// committed by the caller.
+func (r *Enqueuer) Enqueue(queryer database.Queryer, c backend.Credential, from string, to []string, msg []byte, saveInSent bool) error {
+	if len(to) == 0 {
+		return errors.New("empty recipient address")
+	}
+
+	folderID, err := getOutboxFolder(r.backend.NewFolderManager(queryer, c))
+	if err != nil {
+		return err
+	}
+	email, err := r.backend.NewEmailManager(queryer, c, folderID).AddEmail(msg)
+	if err != nil {
+		return fmt.Errorf("AddEmail: %v", err)
+	}
+	id, err := r.storage.NewQueue(queryer).AddEntry(Entry{
+		UserUID:     c.UserUID(),
+		UserName:    c.UserID(),
+		FolderID:    folderID,
+		EmailID:     email.ID,
+		From:        from,
+		To:          to,
+		SaveInSent:  saveInSent,
+		NextAttempt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	logger.Debug(fmt.Sprintf("outbox: enqueued an email: queueID=%v, emailID=%v, user=%v", id, email.ID, c.UserID()))
+
+	return nil
+}
+
+// getOutboxFolder returns the ID of the Outbox folder, which will be created
+// under the root folder if it does not exist.
+func getOutboxFolder(fm backend.FolderManager) (uint64, error) {
+	folders, err := fm.GetFolderByType(backend.EmailOutbox, database.LockRead)
+	if err != nil {
+		return 0, err
+	}
+	if len(folders) > 0 {
+		return folders[0].ID, nil
+	}
+
+	name := folderName
+	for i := 1; ; i++ {
+		id, err := fm.AddFolder(0, name, backend.EmailOutbox)
+		if err == nil {
+			return id, nil
+		}
+		// The user may already have a normal folder whose name is Outbox.
+		if !isDuplicated(err) || i >= 10 {
+			return 0, err
+		}
+		name = fmt.Sprintf("%v (%v)", folderName, i)
+	}
+}
+
+func isDuplicated(err error) bool {
+	e, ok := err.(database.DuplicatedError)
+	if !ok {
+		return false
+	}
+
+	return e.IsDuplicated()
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(database.NotFoundError)
+	if !ok {
+		return false
+	}
+
+	return e.IsNotFound()
+}
@@ -0,0 +1,367 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+
+	"github.com/superkkt/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultPollInterval     = 10 * time.Second
+	defaultRetryInterval    = 1 * time.Minute
+	defaultMaxRetryInterval = 1 * time.Hour
+	defaultMaxAge           = 24 * time.Hour
+	defaultLease            = 10 * time.Minute
+	// Maximum number of entries fetched at once.
+	batchSize = 32
+	// Maximum length of the last error kept in the queue.
+	maxErrorLength = 1024
+)
+
+type Mailer interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// PermanentError is implemented by errors of Mailer that will never succeed
+// even if they are retried, e.g., invalid addresses. SMTP errors whose code is
+// 5xx are also regarded as permanent.
+type PermanentError interface {
+	IsPermanent() bool
+}
+
+// RecipientError is implemented by errors of Mailer that has delivered an
+// email to some recipients but failed for the others. Only the temporarily
+// failed recipients are retried, and the permanently failed ones bounce.
+type RecipientError interface {
+	TemporaryFailures() []string
+	PermanentFailures() []string
+}
+
+type Config struct {
+	DB      database.TransactionManager
+	Backend backend.Storage
+	Storage Storage
+	Mailer  Mailer
+	// Hostname is the name of this server used in bounce messages. Empty
+	// means the hostname of the system.
+	Hostname string
+	// PollInterval is the interval to check the queue. Zero means 10 seconds.
+	PollInterval time.Duration
+	// RetryInterval is the delay before the first retry, which is doubled on
+	// each failure up to MaxRetryInterval. Zero values mean 1 minute and 1 hour.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// MaxAge is the maximum time to retry an email before it bounces. Zero
+	// means 24 hours.
+	MaxAge time.Duration
+	// Lease is the maximum time to send an email. An entry claimed by a worker
+	// can be claimed again by another worker after the lease. Zero means 10 minutes.
+	Lease time.Duration
+}
+
+// Worker sends out emails in the queue. Multiple workers on different servers
+// can share the same queue.
+type Worker struct {
+	config Config
+}
+
+func NewWorker(conf Config) (*Worker, error) {
+	if conf.DB == nil || conf.Backend == nil || conf.Storage == nil || conf.Mailer == nil {
+		return nil, errors.New("nil DB, backend, storage, or mailer")
+	}
+	if len(conf.Hostname) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		conf.Hostname = hostname
+	}
+	if conf.PollInterval == 0 {
+		conf.PollInterval = defaultPollInterval
+	}
+	if conf.RetryInterval == 0 {
+		conf.RetryInterval = defaultRetryInterval
+	}
+	if conf.MaxRetryInterval == 0 {
+		conf.MaxRetryInterval = defaultMaxRetryInterval
+	}
+	if conf.MaxAge == 0 {
+		conf.MaxAge = defaultMaxAge
+	}
+	if conf.Lease == 0 {
+		conf.Lease = defaultLease
+	}
+
+	return &Worker{
+		config: conf,
+	}, nil
+}
+
+// Run processes the queue until ctx is canceled.
+func (r *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		r.process(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Worker) process(ctx context.Context) {
+	for {
+		var entries []Entry
+		err := r.query(func(tx database.Transaction) (err error) {
+			entries, err = r.config.Storage.NewQueue(tx).GetDueEntries(batchSize)
+			return err
+		})
+		if err != nil {
+			logger.Error(fmt.Sprintf("outbox: failed to get queue entries: %v", err))
+			return
+		}
+
+		for _, v := range entries {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := r.deliver(v); err != nil {
+				logger.Error(fmt.Sprintf("outbox: failed to process a queue entry: ID=%v, err=%v", v.ID, err))
+			}
+		}
+		// No more due entries?
+		if len(entries) < batchSize {
+			return
+		}
+	}
+}
+
+func (r *Worker) deliver(e Entry) error {
+	var ok bool
+	err := r.query(func(tx database.Transaction) (err error) {
+		ok, err = r.config.Storage.NewQueue(tx).ClaimEntry(e.ID, e.Attempts, r.config.Lease)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Another worker has claimed it.
+	if !ok {
+		return nil
+	}
+	e.Attempts++
+
+	c := &credential{uid: e.UserUID, name: e.UserName}
+	var raw []byte
+	err = r.query(func(tx database.Transaction) (err error) {
+		raw, err = r.config.Backend.NewEmailManager(tx, c, e.FolderID).GetRawEmail(e.EmailID, database.LockNone)
+		return err
+	})
+	if err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		// The user has removed the email from the Outbox folder.
+		logger.Info(fmt.Sprintf("outbox: canceled a removed email: ID=%v, user=%v", e.ID, e.UserName))
+		return r.query(func(tx database.Transaction) error {
+			return r.config.Storage.NewQueue(tx).RemoveEntry(e.ID)
+		})
+	}
+
+	sendErr := r.config.Mailer.Send(e.From, e.To, raw)
+	if sendErr == nil {
+		logger.Info(fmt.Sprintf("outbox: sent an email: ID=%v, user=%v, attempts=%v", e.ID, e.UserName, e.Attempts))
+		return r.query(func(tx database.Transaction) error {
+			return r.finish(tx, c, e)
+		})
+	}
+
+	var temporary, permanent []string
+	if v, ok := sendErr.(RecipientError); ok {
+		temporary, permanent = v.TemporaryFailures(), v.PermanentFailures()
+	} else if isPermanent(sendErr) {
+		permanent = e.To
+	} else {
+		temporary = e.To
+	}
+	expired := time.Since(e.Created) >= r.config.MaxAge
+	if expired {
+		permanent = append(permanent, temporary...)
+		temporary = nil
+	}
+
+	if len(permanent) > 0 {
+		logger.Warning(fmt.Sprintf("outbox: failed to send an email permanently: ID=%v, user=%v, attempts=%v, recipients=%v, err=%v", e.ID, e.UserName, e.Attempts, permanent, sendErr))
+	}
+	if len(temporary) == 0 {
+		return r.query(func(tx database.Transaction) error {
+			if err := r.bounce(tx, c, e, permanent, raw, sendErr, !expired); err != nil {
+				return err
+			}
+			// Nothing has been delivered?
+			if len(permanent) == len(e.To) {
+				return r.remove(tx, c, e)
+			}
+			return r.finish(tx, c, e)
+		})
+	}
+
+	next := time.Now().Add(r.backoff(e.Attempts))
+	logger.Info(fmt.Sprintf("outbox: failed to send an email temporarily: ID=%v, user=%v, attempts=%v, recipients=%v, next=%v, err=%v", e.ID, e.UserName, e.Attempts, temporary, next, sendErr))
+	return r.query(func(tx database.Transaction) error {
+		if len(permanent) > 0 {
+			if err := r.bounce(tx, c, e, permanent, raw, sendErr, true); err != nil {
+				return err
+			}
+		}
+		return r.config.Storage.NewQueue(tx).RescheduleEntry(e.ID, temporary, next, truncate(sendErr.Error(), maxErrorLength))
+	})
+}
+
+// finish moves a sent email to the Sent folder or removes it, and then removes its queue entry.
+func (r *Worker) finish(tx database.Transaction, c backend.Credential, e Entry) error {
+	em := r.config.Backend.NewEmailManager(tx, c, e.FolderID)
+	if err := r.config.Storage.NewQueue(tx).RemoveEntry(e.ID); err != nil {
+		return err
+	}
+	if !e.SaveInSent {
+		return em.DeleteEmail(e.EmailID)
+	}
+
+	sent, err := r.config.Backend.NewFolderManager(tx, c).GetFolderByType(backend.EmailSent, database.LockRead)
+	if err != nil {
+		return err
+	}
+	if len(sent) == 0 {
+		logger.Warning(fmt.Sprintf("outbox: not found a sent item folder: user=%v", e.UserName))
+		return em.DeleteEmail(e.EmailID)
+	}
+	id, err := em.MoveEmail(e.EmailID, sent[0].ID)
+	if err != nil {
+		return err
+	}
+
+	return r.config.Backend.NewEmailManager(tx, c, sent[0].ID).UpdateEmail(id, true)
+}
+
+// remove removes an email that has not been delivered to anyone and its queue entry.
+func (r *Worker) remove(tx database.Transaction, c backend.Credential, e Entry) error {
+	if err := r.config.Storage.NewQueue(tx).RemoveEntry(e.ID); err != nil {
+		return err
+	}
+
+	return r.config.Backend.NewEmailManager(tx, c, e.FolderID).DeleteEmail(e.EmailID)
+}
+
+// bounce delivers a bounce message of an email that has failed for rcpts into
+// the user's Inbox.
+func (r *Worker) bounce(tx database.Transaction, c backend.Credential, e Entry, rcpts []string, raw []byte, cause error, permanent bool) error {
+	inbox, err := r.config.Backend.NewFolderManager(tx, c).GetFolderByType(backend.EmailInbox, database.LockRead)
+	if err != nil {
+		return err
+	}
+	if len(inbox) == 0 {
+		return fmt.Errorf("not found an inbox folder: user=%v", e.UserName)
+	}
+	msg := newBounce(r.config.Hostname, e, rcpts, raw, cause, permanent)
+	if _, err := r.config.Backend.NewEmailManager(tx, c, inbox[0].ID).AddEmail(msg); err != nil {
+		return fmt.Errorf("AddEmail: %v", err)
+	}
+
+	return nil
+}
+
+// backoff returns the delay before the next attempt after attempts failures.
+func (r *Worker) backoff(attempts uint) time.Duration {
+	d := r.config.RetryInterval
+	for i := uint(1); i < attempts; i++ {
+		d *= 2
+		if d >= r.config.MaxRetryInterval {
+			return r.config.MaxRetryInterval
+		}
+	}
+
+	return d
+}
+
+func (r *Worker) query(f func(tx database.Transaction) error) error {
+	tx := r.config.DB.NewTransaction(context.Background())
+	if err := tx.Begin(); err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func isPermanent(err error) bool {
+	if e, ok := err.(PermanentError); ok {
+		return e.IsPermanent()
+	}
+	if e, ok := err.(*textproto.Error); ok {
+		return e.Code >= 500
+	}
+
+	return false
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n]
+}
+
+// credential is a credential of the owner of a queue entry.
+type credential struct {
+	uid  uint64
+	name string
+}
+
+func (r *credential) IsAuthorized() bool {
+	return true
+}
+
+func (r *credential) UserID() string {
+	return r.name
+}
+
+func (r *credential) UserUID() uint64 {
+	return r.uid
+}
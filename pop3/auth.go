@@ -0,0 +1,164 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pop3
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/superkkt/omega/activesync"
+
+	"github.com/superkkt/logger"
+)
+
+func (r *session) handleUser(args string) error {
+	if len(args) == 0 {
+		return syntaxError("missing user name")
+	}
+	if !r.secure() {
+		r.write("-ERR [AUTH] Plaintext authentication is disabled over insecure connections\r\n")
+		return nil
+	}
+	r.username = args
+	r.write("+OK Send your password\r\n")
+
+	return nil
+}
+
+// handlePass reads the rest of the line as the password, which can contain
+// spaces.
+func (r *session) handlePass(args string) error {
+	if len(r.username) == 0 {
+		r.write("-ERR USER first\r\n")
+		return nil
+	}
+	username := r.username
+	r.username = ""
+
+	return r.login(username, args)
+}
+
+// handleAuth implements the AUTH command (RFC 5034) with the PLAIN mechanism
+// (RFC 4616).
+func (r *session) handleAuth(args string) error {
+	// List the mechanisms if there is no argument.
+	if len(args) == 0 {
+		r.write("+OK\r\nPLAIN\r\n.\r\n")
+		return nil
+	}
+	fields := strings.Fields(args)
+	if len(fields) > 2 {
+		return syntaxError("too many arguments")
+	}
+	if !strings.EqualFold(fields[0], "PLAIN") {
+		r.write("-ERR Unsupported authentication mechanism\r\n")
+		return nil
+	}
+	if !r.secure() {
+		r.write("-ERR [AUTH] Authentication is disabled over insecure connections\r\n")
+		return nil
+	}
+
+	var response string
+	if len(fields) == 2 {
+		response = fields[1]
+	} else {
+		r.write("+ \r\n")
+		if err := r.flush(); err != nil {
+			return err
+		}
+		var err error
+		if response, err = readLine(r.reader); err != nil {
+			r.err = err
+			return nil
+		}
+	}
+	if response == "*" {
+		r.write("-ERR Authentication canceled\r\n")
+		return nil
+	}
+	// = is an empty initial response.
+	if response == "=" {
+		response = ""
+	}
+	v, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return syntaxError("invalid base64 response")
+	}
+	// authzid NUL authcid NUL passwd
+	credentials := bytes.Split(v, []byte{0})
+	if len(credentials) != 3 {
+		return syntaxError("invalid PLAIN response")
+	}
+	if len(credentials[0]) > 0 && !bytes.Equal(credentials[0], credentials[1]) {
+		r.write("-ERR [AUTH] Authorization identity is not allowed\r\n")
+		return nil
+	}
+
+	return r.login(string(credentials[1]), string(credentials[2]))
+}
+
+func (r *session) login(username, password string) error {
+	attempt := &activesync.Attempt{IP: r.remote, Username: username}
+	if !r.server.throttle.Check(attempt) {
+		r.authFailed()
+		r.write("-ERR [SYS/TEMP] Too many authentication failures, try again later\r\n")
+		return nil
+	}
+
+	c, err := r.config.Authenticator.Auth(username, password)
+	if err != nil {
+		logger.Error(fmt.Sprintf("pop3: failed to authenticate a user: user=%v, remote=%v, err=%v", username, r.remote, err))
+		r.write("-ERR [SYS/TEMP] Temporary authentication failure\r\n")
+		return nil
+	}
+	r.server.throttle.Update(attempt, c.IsAuthorized())
+	if !c.IsAuthorized() {
+		logger.Info(fmt.Sprintf("pop3: authentication failed: user=%v, remote=%v", username, r.remote))
+		r.authFailed()
+		r.write("-ERR [AUTH] Authentication failed\r\n")
+		return nil
+	}
+
+	m, err := r.loadMaildrop(c)
+	if err != nil {
+		logger.Error(fmt.Sprintf("pop3: failed to open the maildrop: user=%v, remote=%v, err=%v", c.UserID(), r.remote, err))
+		r.write("-ERR [SYS/TEMP] Failed to open the maildrop\r\n")
+		return nil
+	}
+	logger.Debug(fmt.Sprintf("pop3: user logged in: user=%v, remote=%v", c.UserID(), r.remote))
+	r.credential = c
+	r.maildrop = m
+	r.write("+OK Logged in, %v messages\r\n", len(m.messages))
+
+	return nil
+}
+
+// authFailed counts a failed authentication, and closes the session after too
+// many failures.
+func (r *session) authFailed() {
+	r.authFailures++
+	if r.authFailures >= maxAuthFailures {
+		r.bye = "Too many authentication failures"
+	}
+}
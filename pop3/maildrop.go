@@ -0,0 +1,321 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pop3
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+)
+
+type message struct {
+	id uint64
+	// size is the size of the message in octets, which is -1 until the raw
+	// message is loaded.
+	size    int
+	deleted bool
+}
+
+// maildrop is a snapshot of the Inbox folder taken when the user logged in.
+type maildrop struct {
+	folderID uint64
+	messages []*message
+}
+
+func (r *session) loadMaildrop(c backend.Credential) (*maildrop, error) {
+	result := &maildrop{}
+	err := r.server.query(func(tx database.Transaction) error {
+		folders, err := r.config.Storage.NewFolderManager(tx, c).GetFolderByType(backend.EmailInbox, database.LockNone)
+		if err != nil {
+			return err
+		}
+		if len(folders) == 0 {
+			return errors.New("no inbox folder")
+		}
+		result.folderID = folders[0].ID
+		for _, v := range folders[1:] {
+			if v.ID < result.folderID {
+				result.folderID = v.ID
+			}
+		}
+
+		emails, err := r.config.Storage.NewEmailManager(tx, c, result.folderID).GetEmails(0, 0, false, database.LockNone)
+		if err != nil {
+			return err
+		}
+		for _, v := range emails {
+			result.messages = append(result.messages, &message{id: v.ID, size: -1})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// message returns the message whose number is arg. It replies an error and
+// returns nil if there is no such message.
+func (r *session) message(arg string) *message {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n <= 0 || n > len(r.maildrop.messages) {
+		r.write("-ERR No such message\r\n")
+		return nil
+	}
+	m := r.maildrop.messages[n-1]
+	if m.deleted {
+		r.write("-ERR Message %v already deleted\r\n", n)
+		return nil
+	}
+
+	return m
+}
+
+// raw returns the raw message of m, or nil if the message has been removed by
+// another session or protocol.
+func (r *session) raw(m *message) ([]byte, error) {
+	var raw []byte
+	err := r.server.query(func(tx database.Transaction) error {
+		var err error
+		raw, err = r.config.Storage.NewEmailManager(tx, r.credential, r.maildrop.folderID).GetRawEmail(m.id, database.LockNone)
+		return err
+	})
+	if err != nil {
+		if isNotFound(err) {
+			m.size = 0
+			return nil, nil
+		}
+		return nil, err
+	}
+	raw = normalizeCRLF(raw)
+	m.size = len(raw)
+
+	return raw, nil
+}
+
+func (r *session) size(m *message) (int, error) {
+	if m.size < 0 {
+		if _, err := r.raw(m); err != nil {
+			return 0, err
+		}
+	}
+	return m.size, nil
+}
+
+// normalizeCRLF converts bare LFs of msg into CRLFs.
+func normalizeCRLF(msg []byte) []byte {
+	if !bytes.Contains(msg, []byte("\n")) || bytes.Count(msg, []byte("\n")) == bytes.Count(msg, []byte("\r\n")) {
+		return msg
+	}
+
+	var buf bytes.Buffer
+	for i, c := range msg {
+		if c == '\n' && (i == 0 || msg[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(c)
+	}
+
+	return buf.Bytes()
+}
+
+func (r *session) handleStat(args string) error {
+	if len(args) > 0 {
+		return syntaxError("unexpected arguments")
+	}
+	count, total := 0, 0
+	for _, v := range r.maildrop.messages {
+		if v.deleted {
+			continue
+		}
+		size, err := r.size(v)
+		if err != nil {
+			return err
+		}
+		count++
+		total += size
+	}
+	r.write("+OK %v %v\r\n", count, total)
+
+	return nil
+}
+
+func (r *session) handleList(args string) error {
+	return r.list(args, func(m *message) (string, error) {
+		size, err := r.size(m)
+		return strconv.Itoa(size), err
+	})
+}
+
+// handleUidl implements the UIDL command, whose unique-ids are the email IDs.
+func (r *session) handleUidl(args string) error {
+	return r.list(args, func(m *message) (string, error) {
+		return strconv.FormatUint(m.id, 10), nil
+	})
+}
+
+// list replies the values of a message, or all messages not marked as deleted
+// if args is empty.
+func (r *session) list(args string, value func(m *message) (string, error)) error {
+	if len(args) > 0 {
+		m := r.message(args)
+		if m == nil {
+			return nil
+		}
+		v, err := value(m)
+		if err != nil {
+			return err
+		}
+		r.write("+OK %v %v\r\n", args, v)
+		return nil
+	}
+
+	lines := []string{}
+	for i, m := range r.maildrop.messages {
+		if m.deleted {
+			continue
+		}
+		v, err := value(m)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, strconv.Itoa(i+1)+" "+v+"\r\n")
+	}
+	r.write("+OK %v messages\r\n", len(lines))
+	r.write("%v.\r\n", strings.Join(lines, ""))
+
+	return nil
+}
+
+func (r *session) handleRetr(args string) error {
+	m := r.message(args)
+	if m == nil {
+		return nil
+	}
+	raw, err := r.raw(m)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		r.write("-ERR Message has been removed\r\n")
+		return nil
+	}
+	r.write("+OK %v octets\r\n", len(raw))
+	r.writeMultiline(raw)
+
+	return nil
+}
+
+// handleTop implements the TOP command, which replies the header and the
+// given number of lines of the body.
+func (r *session) handleTop(args string) error {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		return syntaxError("invalid arguments")
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 0 {
+		return syntaxError("invalid number of lines")
+	}
+	m := r.message(fields[0])
+	if m == nil {
+		return nil
+	}
+	raw, err := r.raw(m)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		r.write("-ERR Message has been removed\r\n")
+		return nil
+	}
+
+	end := len(raw)
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		end = i + 4
+		for ; n > 0 && end < len(raw); n-- {
+			j := bytes.Index(raw[end:], []byte("\r\n"))
+			if j < 0 {
+				end = len(raw)
+				break
+			}
+			end += j + 2
+		}
+	}
+	r.write("+OK\r\n")
+	r.writeMultiline(raw[:end])
+
+	return nil
+}
+
+func (r *session) handleDele(args string) error {
+	m := r.message(args)
+	if m == nil {
+		return nil
+	}
+	m.deleted = true
+	r.write("+OK Message %v deleted\r\n", args)
+
+	return nil
+}
+
+func (r *session) handleRset(args string) error {
+	if len(args) > 0 {
+		return syntaxError("unexpected arguments")
+	}
+	for _, v := range r.maildrop.messages {
+		v.deleted = false
+	}
+	r.write("+OK %v messages\r\n", len(r.maildrop.messages))
+
+	return nil
+}
+
+// handleQuit removes the messages marked as deleted if the client has been
+// authenticated, which is the UPDATE state.
+func (r *session) handleQuit(args string) error {
+	if r.maildrop != nil {
+		err := r.server.query(func(tx database.Transaction) error {
+			em := r.config.Storage.NewEmailManager(tx, r.credential, r.maildrop.folderID)
+			for _, v := range r.maildrop.messages {
+				if !v.deleted {
+					continue
+				}
+				// The message may have been removed by another session.
+				if err := em.DeleteEmail(v.id); err != nil && !isNotFound(err) {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	r.write("+OK Logging out\r\n")
+
+	return nil
+}
@@ -0,0 +1,352 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+
+	"github.com/superkkt/logger"
+)
+
+// Maximum length of a command line, which is long enough for SASL responses.
+const maxLineLength = 8192
+
+var errLineTooLong = errors.New("too long command line")
+
+// syntaxError is an error of an invalid command, which is replied with -ERR
+// and counted as an error of the client.
+type syntaxError string
+
+func (r syntaxError) Error() string {
+	return string(r)
+}
+
+type session struct {
+	server *Server
+	config *Config
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// err is the first error on writing to the connection.
+	err    error
+	remote string
+	tls    bool
+	// username is the argument of the USER command.
+	username string
+	// credential is nil before the client is authenticated.
+	credential   backend.Credential
+	maildrop     *maildrop
+	errors       int
+	authFailures int
+	// bye is the reason to close the session after the current command.
+	bye string
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	remote := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	_, secure := conn.(*tls.Conn)
+
+	return &session{
+		server: server,
+		config: &server.config,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		remote: remote,
+		tls:    secure,
+	}
+}
+
+func (r *session) serve() {
+	defer r.conn.Close()
+	logger.Debug(fmt.Sprintf("pop3: new session from %v", r.remote))
+
+	r.write("+OK Omega POP3 server ready\r\n")
+	if r.flush() != nil {
+		return
+	}
+	for {
+		if !r.server.setIdle(r, true) {
+			r.write("-ERR [SYS/TEMP] Server shutting down\r\n")
+			r.flush()
+			return
+		}
+		r.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+		line, err := readLine(r.reader)
+		r.server.setIdle(r, false)
+		if err != nil {
+			if err == errLineTooLong {
+				r.write("-ERR Command line too long\r\n")
+				r.flush()
+			} else if err != io.EOF {
+				logger.Debug(fmt.Sprintf("pop3: failed to read a command from %v: %v", r.remote, err))
+			}
+			return
+		}
+
+		r.conn.SetDeadline(time.Now().Add(r.config.Timeout))
+		quit := r.handle(line)
+		if r.flush() != nil {
+			logger.Debug(fmt.Sprintf("pop3: session with %v has been closed: %v", r.remote, r.err))
+			return
+		}
+		if quit {
+			return
+		}
+		if r.errors >= maxErrors {
+			r.bye = "Too many errors"
+		}
+		if len(r.bye) > 0 {
+			r.write("-ERR %v\r\n", r.bye)
+			r.flush()
+			return
+		}
+	}
+}
+
+// readLine reads a line without the trailing CRLF.
+func readLine(reader *bufio.Reader) (string, error) {
+	line := []byte{}
+	for {
+		v, err := reader.ReadSlice('\n')
+		if len(line)+len(v) > maxLineLength {
+			return "", errLineTooLong
+		}
+		line = append(line, v...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// state is the set of states in which a command is allowed.
+type state int
+
+const (
+	stateAuthorization state = 1 << iota
+	stateTransaction
+	stateAny = stateAuthorization | stateTransaction
+)
+
+type command struct {
+	state state
+	// handler replies the response of the command. The handler can return an
+	// error instead if the command is invalid or has failed.
+	handler func(r *session, args string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"CAPA": {stateAny, (*session).handleCapa},
+		"QUIT": {stateAny, (*session).handleQuit},
+		"STLS": {stateAuthorization, (*session).handleSTLS},
+		"USER": {stateAuthorization, (*session).handleUser},
+		"PASS": {stateAuthorization, (*session).handlePass},
+		"AUTH": {stateAuthorization, (*session).handleAuth},
+		"NOOP": {stateTransaction, (*session).handleNoop},
+		"STAT": {stateTransaction, (*session).handleStat},
+		"LIST": {stateTransaction, (*session).handleList},
+		"UIDL": {stateTransaction, (*session).handleUidl},
+		"RETR": {stateTransaction, (*session).handleRetr},
+		"TOP":  {stateTransaction, (*session).handleTop},
+		"DELE": {stateTransaction, (*session).handleDele},
+		"RSET": {stateTransaction, (*session).handleRset},
+	}
+}
+
+func (r *session) state() state {
+	if r.credential == nil {
+		return stateAuthorization
+	}
+	return stateTransaction
+}
+
+// handle processes a command line. It returns true if the session should be
+// closed.
+func (r *session) handle(line string) (quit bool) {
+	name, args := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		name, args = line[:i], line[i+1:]
+	}
+	name = strings.ToUpper(name)
+
+	cmd, ok := commands[name]
+	if !ok {
+		r.errors++
+		r.write("-ERR Unknown command\r\n")
+		return false
+	}
+	if cmd.state&r.state() == 0 {
+		r.errors++
+		r.write("-ERR %v is not allowed in this state\r\n", name)
+		return false
+	}
+
+	err := cmd.handler(r, args)
+	switch e := err.(type) {
+	case nil:
+	case syntaxError:
+		r.errors++
+		r.write("-ERR %v\r\n", strings.Title(e.Error()))
+	default:
+		if r.err == nil {
+			logger.Error(fmt.Sprintf("pop3: failed to process %v: user=%v, remote=%v, err=%v", name, r.userID(), r.remote, err))
+		}
+		r.write("-ERR [SYS/TEMP] Temporary server failure\r\n")
+	}
+
+	return name == "QUIT"
+}
+
+func (r *session) userID() string {
+	if r.credential == nil {
+		return ""
+	}
+	return r.credential.UserID()
+}
+
+func (r *session) secure() bool {
+	return r.tls || r.config.AllowPlaintext
+}
+
+func (r *session) write(format string, args ...interface{}) {
+	if r.err != nil {
+		return
+	}
+	if len(args) == 0 {
+		_, r.err = r.writer.WriteString(format)
+		return
+	}
+	_, r.err = fmt.Fprintf(r.writer, format, args...)
+}
+
+// writeMultiline writes data as a multi-line response, whose lines beginning
+// with the termination octet are byte-stuffed.
+func (r *session) writeMultiline(data []byte) {
+	for len(data) > 0 {
+		line := data
+		if i := bytes.Index(data, []byte("\r\n")); i >= 0 {
+			line, data = data[:i+2], data[i+2:]
+		} else {
+			// The last line without CRLF.
+			line, data = append(line[:len(line):len(line)], '\r', '\n'), nil
+		}
+		if line[0] == '.' {
+			r.write(".")
+		}
+		if r.err == nil {
+			_, r.err = r.writer.Write(line)
+		}
+	}
+	r.write(".\r\n")
+}
+
+func (r *session) flush() error {
+	if r.err == nil {
+		r.err = r.writer.Flush()
+	}
+	return r.err
+}
+
+func (r *session) handleCapa(args string) error {
+	if len(args) > 0 {
+		return syntaxError("unexpected arguments")
+	}
+	caps := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING"}
+	if r.credential == nil {
+		if r.secure() {
+			caps = append(caps, "USER", "SASL PLAIN")
+		}
+		if r.config.TLSConfig != nil && !r.tls {
+			caps = append(caps, "STLS")
+		}
+	}
+	caps = append(caps, "IMPLEMENTATION Omega")
+
+	r.write("+OK Capability list follows\r\n")
+	r.write("%v\r\n.\r\n", strings.Join(caps, "\r\n"))
+
+	return nil
+}
+
+func (r *session) handleNoop(args string) error {
+	if len(args) > 0 {
+		return syntaxError("unexpected arguments")
+	}
+	r.write("+OK\r\n")
+
+	return nil
+}
+
+func (r *session) handleSTLS(args string) error {
+	if len(args) > 0 {
+		return syntaxError("unexpected arguments")
+	}
+	if r.config.TLSConfig == nil || r.tls {
+		r.write("-ERR STLS not available\r\n")
+		return nil
+	}
+	// Commands pipelined after STLS could have been injected by an attacker.
+	if r.reader.Buffered() > 0 {
+		r.write("-ERR Unexpected data after STLS\r\n")
+		r.bye = "Unexpected data after STLS"
+		return nil
+	}
+	r.write("+OK Begin TLS negotiation now\r\n")
+	if err := r.flush(); err != nil {
+		return err
+	}
+
+	conn := tls.Server(r.conn, r.config.TLSConfig)
+	if err := conn.Handshake(); err != nil {
+		r.err = fmt.Errorf("TLS handshake: %v", err)
+		return nil
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+	r.writer = bufio.NewWriter(conn)
+	r.tls = true
+	// The client should discard the information obtained before TLS.
+	r.username = ""
+
+	return nil
+}
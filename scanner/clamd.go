@@ -0,0 +1,121 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Size of a chunk of the INSTREAM command.
+const clamdChunkSize = 64 * 1024
+
+type ClamdConfig struct {
+	// Address is host:port or an absolute path of the UNIX domain socket of
+	// clamd of ClamAV.
+	Address string
+	// Verdict on infected messages, which should be either VerdictReject or
+	// VerdictQuarantine. Zero value means VerdictReject.
+	Verdict Verdict
+	// Timeout of a scan. Zero means 30 seconds.
+	Timeout time.Duration
+}
+
+// Clamd is a ContentScanner that asks clamd whether a message contains a virus
+// using the INSTREAM command.
+type Clamd struct {
+	config ClamdConfig
+}
+
+func NewClamd(conf ClamdConfig) (*Clamd, error) {
+	if len(conf.Address) == 0 {
+		return nil, errors.New("empty clamd address")
+	}
+	switch conf.Verdict {
+	case VerdictAccept:
+		conf.Verdict = VerdictReject
+	case VerdictReject, VerdictQuarantine:
+	default:
+		return nil, fmt.Errorf("invalid clamd verdict: %v", conf.Verdict)
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultTimeout
+	}
+
+	return &Clamd{config: conf}, nil
+}
+
+func (r *Clamd) Scan(msg []byte) (Result, error) {
+	conn, err := dial(r.config.Address, r.config.Timeout)
+	if err != nil {
+		return Result{}, fmt.Errorf("clamd: %v", err)
+	}
+	defer conn.Close()
+
+	// The z prefix means that the command and the reply are terminated by NULL.
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	size := make([]byte, 4)
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > clamdChunkSize {
+			n = clamdChunkSize
+		}
+		binary.BigEndian.PutUint32(size, uint32(n))
+		w.Write(size)
+		w.Write(msg[:n])
+		msg = msg[n:]
+	}
+	// Zero length chunk terminates the stream.
+	binary.BigEndian.PutUint32(size, 0)
+	w.Write(size)
+	if err := w.Flush(); err != nil {
+		return Result{}, fmt.Errorf("clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil {
+		return Result{}, fmt.Errorf("clamd: %v", err)
+	}
+
+	return r.parseReply(strings.TrimRight(reply, "\x00"))
+}
+
+// parseReply parses a reply such as "stream: OK" and "stream: Eicar-Signature FOUND".
+func (r *Clamd) parseReply(reply string) (Result, error) {
+	v := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case v == "OK":
+		return Result{Verdict: VerdictAccept}, nil
+	case strings.HasSuffix(v, " FOUND"):
+		return Result{
+			Verdict: r.config.Verdict,
+			Reason:  fmt.Sprintf("virus %v", strings.TrimSuffix(v, " FOUND")),
+		}, nil
+	default:
+		// E.g., "INSTREAM size limit exceeded. ERROR"
+		return Result{}, fmt.Errorf("clamd: %v", v)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeClamd accepts the zINSTREAM command, and replies with reply for the
+// received stream.
+type fakeClamd struct {
+	*fakeDaemon
+	reply func(stream []byte) string
+
+	mu      sync.Mutex
+	streams [][]byte
+	chunks  int
+}
+
+func startFakeClamd(t *testing.T, network string, reply func(stream []byte) string) *fakeClamd {
+	c := &fakeClamd{reply: reply}
+	c.fakeDaemon = startFakeDaemon(t, network, c.handle)
+
+	return c
+}
+
+func (r *fakeClamd) handle(reader *bufio.Reader, conn net.Conn) {
+	cmd, err := reader.ReadString('\x00')
+	if err != nil {
+		return
+	}
+	if cmd != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+
+	stream := &bytes.Buffer{}
+	size := make([]byte, 4)
+	chunks := 0
+	for {
+		if _, err := io.ReadFull(reader, size); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			break
+		}
+		if n > clamdChunkSize {
+			io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+			return
+		}
+		if _, err := io.CopyN(stream, reader, int64(n)); err != nil {
+			return
+		}
+		chunks++
+	}
+
+	r.mu.Lock()
+	r.streams = append(r.streams, stream.Bytes())
+	r.chunks += chunks
+	r.mu.Unlock()
+
+	io.WriteString(conn, r.reply(stream.Bytes()))
+}
+
+// clamdReply replies that a stream is infected if it contains "EICAR".
+func clamdReply(stream []byte) string {
+	if bytes.Contains(stream, []byte("EICAR")) {
+		return "stream: Eicar-Signature FOUND\x00"
+	}
+	return "stream: OK\x00"
+}
+
+func TestClamdScan(t *testing.T) {
+	virus := strings.Replace(testMessage, "Hello, world!", "EICAR test", 1)
+	tests := []struct {
+		name    string
+		network string
+		verdict Verdict
+		msg     string
+		result  Result
+	}{
+		{"clean", "tcp", 0, testMessage, Result{Verdict: VerdictAccept}},
+		{"virus", "tcp", 0, virus, Result{Verdict: VerdictReject, Reason: "virus Eicar-Signature"}},
+		{"quarantine", "tcp", VerdictQuarantine, virus, Result{Verdict: VerdictQuarantine, Reason: "virus Eicar-Signature"}},
+		{"unix clean", "unix", 0, testMessage, Result{Verdict: VerdictAccept}},
+		{"unix virus", "unix", VerdictReject, virus, Result{Verdict: VerdictReject, Reason: "virus Eicar-Signature"}},
+	}
+	for _, v := range tests {
+		d := startFakeClamd(t, v.network, clamdReply)
+		c, err := NewClamd(ClamdConfig{Address: d.address(), Verdict: v.verdict})
+		if err != nil {
+			t.Fatalf("%v: failed to create clamd: %v", v.name, err)
+		}
+		result, err := c.Scan([]byte(v.msg))
+		d.close()
+
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", v.name, err)
+			continue
+		}
+		if result != v.result {
+			t.Errorf("%v: expected %+v, got %+v", v.name, v.result, result)
+		}
+		if len(d.streams) != 1 || string(d.streams[0]) != v.msg {
+			t.Errorf("%v: unexpected streams: %q", v.name, d.streams)
+		}
+	}
+}
+
+func TestClamdChunks(t *testing.T) {
+	d := startFakeClamd(t, "tcp", clamdReply)
+	defer d.close()
+
+	c, err := NewClamd(ClamdConfig{Address: d.address()})
+	if err != nil {
+		t.Fatalf("failed to create clamd: %v", err)
+	}
+	msg := bytes.Repeat([]byte("0123456789abcdef"), clamdChunkSize*2/16+1)
+	result, err := c.Scan(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Verdict != VerdictAccept {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.chunks != 3 {
+		t.Errorf("expected 3 chunks, got %v", d.chunks)
+	}
+	if len(d.streams) != 1 || !bytes.Equal(d.streams[0], msg) {
+		t.Errorf("the stream is different from the message")
+	}
+}
+
+func TestClamdError(t *testing.T) {
+	replies := []func([]byte) string{
+		func([]byte) string { return "INSTREAM size limit exceeded. ERROR\x00" },
+		func([]byte) string { return "stream: Can't allocate memory ERROR\x00" },
+		// Closed without a reply.
+		func([]byte) string { return "" },
+	}
+	for i, reply := range replies {
+		d := startFakeClamd(t, "tcp", reply)
+		c, err := NewClamd(ClamdConfig{Address: d.address()})
+		if err != nil {
+			t.Fatalf("failed to create clamd: %v", err)
+		}
+		if result, err := c.Scan([]byte(testMessage)); err == nil {
+			t.Errorf("#%v: expected an error, got %+v", i, result)
+		}
+		d.close()
+	}
+
+	c, err := NewClamd(ClamdConfig{Address: closedAddress(t)})
+	if err != nil {
+		t.Fatalf("failed to create clamd: %v", err)
+	}
+	if _, err := c.Scan([]byte(testMessage)); err == nil {
+		t.Errorf("expected an error if clamd is not running")
+	}
+}
+
+func TestNewClamd(t *testing.T) {
+	if _, err := NewClamd(ClamdConfig{}); err == nil {
+		t.Errorf("expected an error for an empty address")
+	}
+	if _, err := NewClamd(ClamdConfig{Address: "127.0.0.1:3310", Verdict: VerdictJunk}); err == nil {
+		t.Errorf("expected an error for the junk verdict")
+	}
+}
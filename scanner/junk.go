@@ -0,0 +1,80 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package scanner
+
+import (
+	"fmt"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+)
+
+// Name of the Junk folder created on demand.
+const junkFolderName = "Junk"
+
+// Trainer learns from messages that users have classified by moving them into
+// or out of the Junk folder.
+type Trainer interface {
+	// Train teaches that msg is spam if spam is true, or ham otherwise.
+	Train(msg []byte, spam bool) error
+}
+
+// GetJunkFolder returns the ID of the Junk folder, which will be created under
+// the root folder if it does not exist.
+func GetJunkFolder(fm backend.FolderManager) (uint64, error) {
+	folders, err := fm.GetFolderByType(backend.EmailJunk, database.LockRead)
+	if err != nil {
+		return 0, err
+	}
+	if len(folders) > 0 {
+		return folders[0].ID, nil
+	}
+
+	name := junkFolderName
+	for i := 1; ; i++ {
+		id, err := fm.AddFolder(0, name, backend.EmailJunk)
+		if err == nil {
+			return id, nil
+		}
+		if !isDuplicated(err) || i >= 10 {
+			return 0, err
+		}
+		// Another transaction may have just created the Junk folder, or the user
+		// may already have a normal folder whose name is Junk.
+		folders, err := fm.GetFolderByType(backend.EmailJunk, database.LockRead)
+		if err != nil {
+			return 0, err
+		}
+		if len(folders) > 0 {
+			return folders[0].ID, nil
+		}
+		name = fmt.Sprintf("%v (%v)", junkFolderName, i)
+	}
+}
+
+func isDuplicated(err error) bool {
+	e, ok := err.(database.DuplicatedError)
+	if !ok {
+		return false
+	}
+
+	return e.IsDuplicated()
+}
@@ -0,0 +1,182 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package scanner
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/database"
+)
+
+// Verdict is the decision of a content scanner on a message. A larger value
+// is more severe.
+type Verdict int
+
+const (
+	// VerdictAccept means the message is clean.
+	VerdictAccept Verdict = iota
+	// VerdictJunk means the message is spam, which should be delivered into
+	// the Junk folder.
+	VerdictJunk
+	// VerdictQuarantine means the message should be accepted but held in the
+	// quarantine instead of being delivered or sent.
+	VerdictQuarantine
+	// VerdictReject means the message should be refused.
+	VerdictReject
+)
+
+func (r Verdict) String() string {
+	switch r {
+	case VerdictAccept:
+		return "accept"
+	case VerdictJunk:
+		return "junk"
+	case VerdictQuarantine:
+		return "quarantine"
+	case VerdictReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
+
+// ParseVerdict converts the name of a verdict, which is returned by String,
+// into the verdict.
+func ParseVerdict(s string) (Verdict, error) {
+	for _, v := range []Verdict{VerdictAccept, VerdictJunk, VerdictQuarantine, VerdictReject} {
+		if strings.EqualFold(s, v.String()) {
+			return v, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown verdict: %v", s)
+}
+
+type Result struct {
+	Verdict Verdict
+	// Reason describes the verdict, e.g., a spam score or a virus name.
+	Reason string
+}
+
+// ContentScanner inspects messages before they are stored or sent.
+type ContentScanner interface {
+	// Scan returns the verdict on msg, which is a raw message with CRLF line
+	// endings. An error means the message could not be scanned, which should
+	// be treated as a temporary failure by the caller.
+	Scan(msg []byte) (Result, error)
+}
+
+// Chain is a ContentScanner that runs scanners in order, and returns the most
+// severe verdict. Chain stops at the first reject verdict.
+type Chain []ContentScanner
+
+func (r Chain) Scan(msg []byte) (Result, error) {
+	result := Result{Verdict: VerdictAccept}
+	for _, v := range r {
+		res, err := v.Scan(msg)
+		if err != nil {
+			return Result{}, err
+		}
+		if res.Verdict > result.Verdict {
+			result = res
+		}
+		if result.Verdict == VerdictReject {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// Train implements the Trainer interface by training the scanners that
+// implement Trainer.
+func (r Chain) Train(msg []byte, spam bool) error {
+	for _, v := range r {
+		t, ok := v.(Trainer)
+		if !ok {
+			continue
+		}
+		if err := t.Train(msg, spam); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Direction is the direction of a message relative to this server.
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (r Direction) String() string {
+	if r == Outbound {
+		return "outbound"
+	}
+	return "inbound"
+}
+
+// QuarantinedMessage is a message held by a quarantine verdict.
+type QuarantinedMessage struct {
+	ID uint64
+	// UserUID is the unique identifier of the recipient of an inbound message
+	// or the sender of an outbound message.
+	UserUID   uint64
+	Direction Direction
+	// From and To are the envelope sender and recipients.
+	From    string
+	To      []string
+	Reason  string
+	Raw     []byte
+	Created time.Time
+}
+
+// NOTE: All methods of Storage should return database.TransactionError if an error occurrs.
+type Storage interface {
+	NewQuarantine(queryer database.Queryer) Quarantine
+}
+
+type Quarantine interface {
+	// AddMessage holds m in the quarantine.
+	AddMessage(m QuarantinedMessage) (id uint64, err error)
+}
+
+// dial connects to a daemon whose address is host:port or an absolute path of
+// a UNIX domain socket.
+func dial(address string, timeout time.Duration) (net.Conn, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	return conn, nil
+}
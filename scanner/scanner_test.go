@@ -0,0 +1,151 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package scanner
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeDaemon is a TCP or UNIX domain socket server that serves each connection
+// with handle, and closes the connection after handle returns.
+type fakeDaemon struct {
+	listener net.Listener
+	handle   func(r *bufio.Reader, conn net.Conn)
+	wg       sync.WaitGroup
+}
+
+func startFakeDaemon(t *testing.T, network string, handle func(r *bufio.Reader, conn net.Conn)) *fakeDaemon {
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "daemon.sock")
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	d := &fakeDaemon{listener: l, handle: handle}
+	d.wg.Add(1)
+	go d.serve()
+
+	return d
+}
+
+func (r *fakeDaemon) serve() {
+	defer r.wg.Done()
+
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer conn.Close()
+			r.handle(bufio.NewReader(conn), conn)
+		}()
+	}
+}
+
+func (r *fakeDaemon) address() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeDaemon) close() {
+	r.listener.Close()
+	r.wg.Wait()
+}
+
+// closedAddress returns an address that refuses connections.
+func closedAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+type fakeScanner struct {
+	result  Result
+	err     error
+	scanned bool
+}
+
+func (r *fakeScanner) Scan(msg []byte) (Result, error) {
+	r.scanned = true
+	return r.result, r.err
+}
+
+func TestChain(t *testing.T) {
+	accept := &fakeScanner{result: Result{Verdict: VerdictAccept}}
+	junk := &fakeScanner{result: Result{Verdict: VerdictJunk, Reason: "junk"}}
+	quarantine := &fakeScanner{result: Result{Verdict: VerdictQuarantine, Reason: "quarantine"}}
+	reject := &fakeScanner{result: Result{Verdict: VerdictReject, Reason: "reject"}}
+	last := &fakeScanner{result: Result{Verdict: VerdictJunk, Reason: "last"}}
+
+	result, err := Chain{accept, quarantine, junk}.Scan(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Verdict != VerdictQuarantine || result.Reason != "quarantine" {
+		t.Errorf("expected the most severe verdict, got %+v", result)
+	}
+
+	result, err = Chain{junk, reject, last}.Scan(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Verdict != VerdictReject || result.Reason != "reject" {
+		t.Errorf("expected the reject verdict, got %+v", result)
+	}
+	if last.scanned {
+		t.Errorf("the chain should stop at the reject verdict")
+	}
+
+	broken := &fakeScanner{err: errors.New("broken")}
+	if _, err := (Chain{accept, broken, junk}).Scan(nil); err == nil {
+		t.Errorf("expected an error of the broken scanner")
+	}
+}
+
+func TestParseVerdict(t *testing.T) {
+	for _, v := range []Verdict{VerdictAccept, VerdictJunk, VerdictQuarantine, VerdictReject} {
+		got, err := ParseVerdict(v.String())
+		if err != nil || got != v {
+			t.Errorf("%v: got %v, %v", v, got, err)
+		}
+	}
+	if v, err := ParseVerdict("JUNK"); err != nil || v != VerdictJunk {
+		t.Errorf("JUNK: got %v, %v", v, err)
+	}
+	if _, err := ParseVerdict("drop"); err == nil {
+		t.Errorf("drop: expected an error")
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package scanner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/superkkt/logger"
+)
+
+const (
+	defaultSpamdMaxSize = 512 * 1024
+	defaultTimeout      = 30 * time.Second
+)
+
+type SpamdConfig struct {
+	// Address is host:port or an absolute path of the UNIX domain socket of
+	// spamd of SpamAssassin.
+	Address string
+	// User is the name of the user whose preferences are used by spamd. Empty
+	// means the user that runs spamd.
+	User string
+	// RejectScore is the spam score from which messages are rejected instead of
+	// being delivered into the Junk folder. Zero disables the rejection.
+	RejectScore float64
+	// MaxSize is the maximum size of a message to scan in bytes. Larger
+	// messages are accepted without being scanned as spamc does. Zero means
+	// 512 KiB.
+	MaxSize int
+	// Timeout of a scan. Zero means 30 seconds.
+	Timeout time.Duration
+}
+
+// Spamd is a ContentScanner that asks spamd whether a message is spam using
+// the SPAMC/SPAMD protocol.
+type Spamd struct {
+	config SpamdConfig
+}
+
+func NewSpamd(conf SpamdConfig) (*Spamd, error) {
+	if len(conf.Address) == 0 {
+		return nil, errors.New("empty spamd address")
+	}
+	if conf.RejectScore < 0 {
+		return nil, fmt.Errorf("invalid reject score: %v", conf.RejectScore)
+	}
+	if conf.MaxSize == 0 {
+		conf.MaxSize = defaultSpamdMaxSize
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultTimeout
+	}
+
+	return &Spamd{config: conf}, nil
+}
+
+func (r *Spamd) Scan(msg []byte) (Result, error) {
+	if len(msg) > r.config.MaxSize {
+		return Result{Verdict: VerdictAccept, Reason: "too large to scan"}, nil
+	}
+
+	header, err := r.request("CHECK", nil, msg)
+	if err != nil {
+		return Result{}, err
+	}
+	spam, score, threshold, err := parseSpamHeader(header.Get("Spam"))
+	if err != nil {
+		return Result{}, err
+	}
+	result := Result{
+		Verdict: VerdictAccept,
+		Reason:  fmt.Sprintf("spam score %.1f / %.1f", score, threshold),
+	}
+	if spam {
+		result.Verdict = VerdictJunk
+		if r.config.RejectScore > 0 && score >= r.config.RejectScore {
+			result.Verdict = VerdictReject
+		}
+	}
+
+	return result, nil
+}
+
+// Train implements the Trainer interface using the TELL command, which requires
+// spamd to be run with the --allow-tell option.
+func (r *Spamd) Train(msg []byte, spam bool) error {
+	if len(msg) > r.config.MaxSize {
+		return nil
+	}
+
+	class := "ham"
+	if spam {
+		class = "spam"
+	}
+	header, err := r.request("TELL", map[string]string{"Message-class": class, "Set": "local"}, msg)
+	if err != nil {
+		return err
+	}
+	// DidSet is empty if the message has already been learned.
+	logger.Debug(fmt.Sprintf("spamd: learned a message as %v: DidSet=%v", class, header.Get("DidSet")))
+
+	return nil
+}
+
+// request sends a command with msg to spamd, and returns the headers of the
+// response.
+func (r *Spamd) request(command string, header map[string]string, msg []byte) (textproto.MIMEHeader, error) {
+	conn, err := dial(r.config.Address, r.config.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("spamd: %v", err)
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%v SPAMC/1.5\r\n", command)
+	fmt.Fprintf(w, "Content-length: %v\r\n", len(msg))
+	if len(r.config.User) > 0 {
+		fmt.Fprintf(w, "User: %v\r\n", r.config.User)
+	}
+	for k, v := range header {
+		fmt.Fprintf(w, "%v: %v\r\n", k, v)
+	}
+	w.WriteString("\r\n")
+	w.Write(msg)
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("spamd: %v", err)
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("spamd: %v", err)
+	}
+	// SPAMD/1.1 0 EX_OK
+	status := strings.Fields(line)
+	if len(status) < 3 || !strings.HasPrefix(status[0], "SPAMD/") {
+		return nil, fmt.Errorf("spamd: invalid response: %v", line)
+	}
+	if status[1] != "0" {
+		return nil, fmt.Errorf("spamd: %v", strings.Join(status[1:], " "))
+	}
+	resp, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("spamd: %v", err)
+	}
+
+	return resp, nil
+}
+
+// parseSpamHeader parses a Spam header of spamd such as "True ; 15.0 / 5.0".
+func parseSpamHeader(v string) (spam bool, score, threshold float64, err error) {
+	fields := strings.Split(v, ";")
+	if len(fields) != 2 {
+		return false, 0, 0, fmt.Errorf("spamd: invalid Spam header: %v", v)
+	}
+	switch strings.ToLower(strings.TrimSpace(fields[0])) {
+	case "true", "yes":
+		spam = true
+	case "false", "no":
+		spam = false
+	default:
+		return false, 0, 0, fmt.Errorf("spamd: invalid Spam header: %v", v)
+	}
+	scores := strings.Split(fields[1], "/")
+	if len(scores) != 2 {
+		return false, 0, 0, fmt.Errorf("spamd: invalid Spam header: %v", v)
+	}
+	if score, err = strconv.ParseFloat(strings.TrimSpace(scores[0]), 64); err != nil {
+		return false, 0, 0, fmt.Errorf("spamd: invalid Spam header: %v", v)
+	}
+	if threshold, err = strconv.ParseFloat(strings.TrimSpace(scores[1]), 64); err != nil {
+		return false, 0, 0, fmt.Errorf("spamd: invalid Spam header: %v", v)
+	}
+
+	return spam, score, threshold, nil
+}
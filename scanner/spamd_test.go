@@ -0,0 +1,244 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package scanner
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testMessage = "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: test\r\n\r\nHello, world!\r\n"
+
+// spamdRequest is a request received by fakeSpamd.
+type spamdRequest struct {
+	Command string
+	Header  textproto.MIMEHeader
+	Body    string
+}
+
+// fakeSpamd speaks the SPAMC/SPAMD protocol, and replies with reply for each
+// request.
+type fakeSpamd struct {
+	*fakeDaemon
+	reply func(req spamdRequest) string
+
+	mu       sync.Mutex
+	requests []spamdRequest
+}
+
+func startFakeSpamd(t *testing.T, reply func(req spamdRequest) string) *fakeSpamd {
+	s := &fakeSpamd{reply: reply}
+	s.fakeDaemon = startFakeDaemon(t, "tcp", s.handle)
+
+	return s
+}
+
+func (r *fakeSpamd) handle(reader *bufio.Reader, conn net.Conn) {
+	tr := textproto.NewReader(reader)
+	line, err := tr.ReadLine()
+	if err != nil {
+		return
+	}
+	header, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+	length, err := strconv.Atoi(header.Get("Content-length"))
+	if err != nil {
+		fmt.Fprintf(conn, "SPAMD/1.5 76 Bad header line: Content-length\r\n")
+		return
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return
+	}
+
+	req := spamdRequest{
+		Command: strings.TrimSuffix(line, " SPAMC/1.5"),
+		Header:  header,
+		Body:    string(body),
+	}
+	r.mu.Lock()
+	r.requests = append(r.requests, req)
+	r.mu.Unlock()
+
+	io.WriteString(conn, r.reply(req))
+}
+
+func (r *fakeSpamd) received() []spamdRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]spamdRequest(nil), r.requests...)
+}
+
+// spamdReply returns a successful reply with the Spam header.
+func spamdReply(spam string) func(spamdRequest) string {
+	return func(spamdRequest) string {
+		return fmt.Sprintf("SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\nSpam: %v\r\n\r\n", spam)
+	}
+}
+
+func TestSpamdScan(t *testing.T) {
+	tests := []struct {
+		name        string
+		reply       func(spamdRequest) string
+		rejectScore float64
+		verdict     Verdict
+		reason      string
+		err         bool
+	}{
+		{"ham", spamdReply("False ; 1.2 / 5.0"), 0, VerdictAccept, "spam score 1.2 / 5.0", false},
+		{"spam", spamdReply("True ; 7.5 / 5.0"), 0, VerdictJunk, "spam score 7.5 / 5.0", false},
+		{"spam below reject score", spamdReply("True ; 7.5 / 5.0"), 10, VerdictJunk, "spam score 7.5 / 5.0", false},
+		{"spam above reject score", spamdReply("Yes ; 15.0 / 5.0"), 10, VerdictReject, "spam score 15.0 / 5.0", false},
+		{"ham above reject score", spamdReply("False ; 15.0 / 20.0"), 10, VerdictAccept, "spam score 15.0 / 20.0", false},
+		{"error status", func(spamdRequest) string { return "SPAMD/1.0 76 Bad header line\r\n" }, 0, 0, "", true},
+		{"invalid status", func(spamdRequest) string { return "HTTP/1.1 200 OK\r\n\r\n" }, 0, 0, "", true},
+		{"invalid Spam header", spamdReply("Maybe ; 1.0 / 5.0"), 0, 0, "", true},
+		{"invalid score", spamdReply("True ; high / 5.0"), 0, 0, "", true},
+		{"no Spam header", func(spamdRequest) string { return "SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\n\r\n" }, 0, 0, "", true},
+		{"no reply", func(spamdRequest) string { return "" }, 0, 0, "", true},
+	}
+	for _, v := range tests {
+		d := startFakeSpamd(t, v.reply)
+		s, err := NewSpamd(SpamdConfig{Address: d.address(), User: "omega", RejectScore: v.rejectScore})
+		if err != nil {
+			t.Fatalf("%v: failed to create spamd: %v", v.name, err)
+		}
+		result, err := s.Scan([]byte(testMessage))
+		d.close()
+
+		if v.err {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %+v", v.name, result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", v.name, err)
+			continue
+		}
+		if result.Verdict != v.verdict || result.Reason != v.reason {
+			t.Errorf("%v: expected verdict=%v, reason=%q, got %+v", v.name, v.verdict, v.reason, result)
+		}
+
+		reqs := d.received()
+		if len(reqs) != 1 {
+			t.Errorf("%v: expected 1 request, got %v", v.name, len(reqs))
+			continue
+		}
+		if reqs[0].Command != "CHECK" || reqs[0].Header.Get("User") != "omega" || reqs[0].Body != testMessage {
+			t.Errorf("%v: unexpected request: %+v", v.name, reqs[0])
+		}
+	}
+}
+
+func TestSpamdMaxSize(t *testing.T) {
+	d := startFakeSpamd(t, spamdReply("True ; 15.0 / 5.0"))
+	defer d.close()
+
+	s, err := NewSpamd(SpamdConfig{Address: d.address(), MaxSize: len(testMessage) - 1})
+	if err != nil {
+		t.Fatalf("failed to create spamd: %v", err)
+	}
+	result, err := s.Scan([]byte(testMessage))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Verdict != VerdictAccept {
+		t.Errorf("expected a large message to be accepted, got %+v", result)
+	}
+	if err := s.Train([]byte(testMessage), true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := len(d.received()); n != 0 {
+		t.Errorf("expected no request for a large message, got %v", n)
+	}
+}
+
+func TestSpamdTrain(t *testing.T) {
+	d := startFakeSpamd(t, func(spamdRequest) string {
+		return "SPAMD/1.1 0 EX_OK\r\nDidSet: local\r\n\r\n"
+	})
+	defer d.close()
+
+	s, err := NewSpamd(SpamdConfig{Address: d.address()})
+	if err != nil {
+		t.Fatalf("failed to create spamd: %v", err)
+	}
+	if err := s.Train([]byte(testMessage), true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Train([]byte(testMessage), false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reqs := d.received()
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 requests, got %v", len(reqs))
+	}
+	for i, class := range []string{"spam", "ham"} {
+		req := reqs[i]
+		if req.Command != "TELL" || req.Header.Get("Message-class") != class || req.Header.Get("Set") != "local" {
+			t.Errorf("unexpected request: %+v", req)
+		}
+		if len(req.Header.Get("User")) > 0 {
+			t.Errorf("unexpected User header: %v", req.Header.Get("User"))
+		}
+	}
+
+	e := startFakeSpamd(t, func(spamdRequest) string { return "SPAMD/1.1 69 Service unavailable: TELL command is not enabled\r\n" })
+	defer e.close()
+	s, err = NewSpamd(SpamdConfig{Address: e.address()})
+	if err != nil {
+		t.Fatalf("failed to create spamd: %v", err)
+	}
+	if err := s.Train([]byte(testMessage), true); err == nil {
+		t.Errorf("expected an error if TELL is not enabled")
+	}
+}
+
+func TestSpamdUnavailable(t *testing.T) {
+	s, err := NewSpamd(SpamdConfig{Address: closedAddress(t)})
+	if err != nil {
+		t.Fatalf("failed to create spamd: %v", err)
+	}
+	if _, err := s.Scan([]byte(testMessage)); err == nil {
+		t.Errorf("expected an error if spamd is not running")
+	}
+}
+
+func TestNewSpamd(t *testing.T) {
+	if _, err := NewSpamd(SpamdConfig{}); err == nil {
+		t.Errorf("expected an error for an empty address")
+	}
+	if _, err := NewSpamd(SpamdConfig{Address: "127.0.0.1:783", RejectScore: -1}); err == nil {
+		t.Errorf("expected an error for a negative reject score")
+	}
+}
@@ -0,0 +1,511 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package sieve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// compiler converts the syntax tree into commands, and validates arguments
+// and required extensions.
+type compiler struct {
+	required map[string]bool
+}
+
+// arguments iterates over arguments of a node.
+type arguments struct {
+	node *node
+	pos  int
+}
+
+func (r *arguments) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %v: %v: %v", r.node.line, r.node.name, fmt.Sprintf(format, args...))
+}
+
+// tag returns the next argument if it is a tag.
+func (r *arguments) tag() (string, bool) {
+	if r.pos >= len(r.node.args) || r.node.args[r.pos].typ != tokenTag {
+		return "", false
+	}
+	r.pos++
+
+	return r.node.args[r.pos-1].tag, true
+}
+
+func (r *arguments) number() (int64, error) {
+	if r.pos >= len(r.node.args) || r.node.args[r.pos].typ != tokenNumber {
+		return 0, r.errorf("expected a number")
+	}
+	r.pos++
+
+	return r.node.args[r.pos-1].num, nil
+}
+
+func (r *arguments) string() (string, error) {
+	if r.pos >= len(r.node.args) || r.node.args[r.pos].typ != tokenString || r.node.args[r.pos].list {
+		return "", r.errorf("expected a string")
+	}
+	r.pos++
+
+	return r.node.args[r.pos-1].str[0], nil
+}
+
+// stringList returns the next argument that is a string or a string list.
+func (r *arguments) stringList() ([]string, error) {
+	if r.pos >= len(r.node.args) || r.node.args[r.pos].typ != tokenString {
+		return nil, r.errorf("expected a string list")
+	}
+	r.pos++
+
+	return r.node.args[r.pos-1].str, nil
+}
+
+func (r *arguments) end() error {
+	if r.pos < len(r.node.args) {
+		return r.errorf("unexpected argument")
+	}
+
+	return nil
+}
+
+func (r *compiler) require(n *node, ext string) error {
+	if !r.required[ext] {
+		return fmt.Errorf("line %v: %v: missing require %q", n.line, n.name, ext)
+	}
+
+	return nil
+}
+
+// commands compiles a list of commands. top is true for the commands that are
+// not in a block, where require can be used.
+func (r *compiler) commands(nodes []*node, top bool) ([]command, error) {
+	var result []command
+	// Commands other than require have appeared?
+	started := false
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+		if n.name != "require" {
+			started = true
+		}
+		if n.hasBlock != (n.name == "if" || n.name == "elsif" || n.name == "else") {
+			return nil, fmt.Errorf("line %v: %v: unexpected or missing block", n.line, n.name)
+		}
+		if len(n.tests) > 0 && n.name != "if" && n.name != "elsif" {
+			return nil, fmt.Errorf("line %v: %v: unexpected test", n.line, n.name)
+		}
+
+		var cmd command
+		var err error
+		switch n.name {
+		case "require":
+			if !top || started {
+				return nil, fmt.Errorf("line %v: require should be at the beginning of the script", n.line)
+			}
+			err = r.requireCommand(n)
+		case "if":
+			var next int
+			cmd, next, err = r.ifCommand(nodes, i)
+			i = next - 1
+		case "elsif", "else":
+			err = fmt.Errorf("line %v: %v without if", n.line, n.name)
+		case "stop":
+			cmd, err = &stopCommand{}, (&arguments{node: n}).end()
+		case "keep":
+			cmd, err = r.keepCommand(n)
+		case "discard":
+			cmd, err = &discardCommand{}, (&arguments{node: n}).end()
+		case "fileinto":
+			cmd, err = r.fileintoCommand(n)
+		case "redirect":
+			cmd, err = r.redirectCommand(n)
+		case "setflag", "addflag", "removeflag":
+			cmd, err = r.flagCommand(n)
+		case "vacation":
+			cmd, err = r.vacationCommand(n)
+		default:
+			err = fmt.Errorf("line %v: unknown command: %v", n.line, n.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cmd != nil {
+			result = append(result, cmd)
+		}
+	}
+
+	return result, nil
+}
+
+func (r *compiler) requireCommand(n *node) error {
+	args := &arguments{node: n}
+	exts, err := args.stringList()
+	if err != nil {
+		return err
+	}
+	if err := args.end(); err != nil {
+		return err
+	}
+	for _, v := range exts {
+		if !extensions[strings.ToLower(v)] {
+			return fmt.Errorf("line %v: unsupported extension: %v", n.line, v)
+		}
+		r.required[strings.ToLower(v)] = true
+	}
+
+	return nil
+}
+
+// ifCommand compiles the if command at nodes[i] and its following elsif and
+// else commands, and returns the index of the next command.
+func (r *compiler) ifCommand(nodes []*node, i int) (command, int, error) {
+	result := &ifCommand{}
+	for ; i < len(nodes); i++ {
+		n := nodes[i]
+		if n.name == "else" {
+			if len(result.branches) == 0 || len(n.tests) > 0 || len(n.args) > 0 {
+				return nil, 0, fmt.Errorf("line %v: invalid else", n.line)
+			}
+			block, err := r.commands(n.block, false)
+			if err != nil {
+				return nil, 0, err
+			}
+			result.elseBlock = block
+			return result, i + 1, nil
+		}
+		if (n.name == "if") != (len(result.branches) == 0) || (n.name != "if" && n.name != "elsif") {
+			break
+		}
+		if len(n.tests) != 1 || len(n.args) > 0 {
+			return nil, 0, fmt.Errorf("line %v: %v requires a test", n.line, n.name)
+		}
+		t, err := r.test(n.tests[0])
+		if err != nil {
+			return nil, 0, err
+		}
+		block, err := r.commands(n.block, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		result.branches = append(result.branches, branch{test: t, block: block})
+	}
+
+	return result, i, nil
+}
+
+// flagsTag reads the :flags tag of keep and fileinto.
+func (r *compiler) flagsTag(n *node, args *arguments) (flags []string, ok bool, err error) {
+	if err := r.require(n, "imap4flags"); err != nil {
+		return nil, false, err
+	}
+	list, err := args.stringList()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return splitFlags(list), true, nil
+}
+
+// splitFlags splits space separated flags.
+func splitFlags(list []string) []string {
+	result := []string{}
+	for _, v := range list {
+		result = addFlags(result, strings.Fields(v))
+	}
+
+	return result
+}
+
+func (r *compiler) keepCommand(n *node) (command, error) {
+	cmd := &keepCommand{}
+	args := &arguments{node: n}
+	for {
+		tag, ok := args.tag()
+		if !ok {
+			break
+		}
+		if tag != "flags" {
+			return nil, args.errorf("unknown tag: %v", tag)
+		}
+		var err error
+		if cmd.flags, cmd.hasFlags, err = r.flagsTag(n, args); err != nil {
+			return nil, err
+		}
+	}
+
+	return cmd, args.end()
+}
+
+func (r *compiler) fileintoCommand(n *node) (command, error) {
+	if err := r.require(n, "fileinto"); err != nil {
+		return nil, err
+	}
+	cmd := &fileintoCommand{}
+	args := &arguments{node: n}
+	for {
+		tag, ok := args.tag()
+		if !ok {
+			break
+		}
+		switch tag {
+		case "flags":
+			var err error
+			if cmd.flags, cmd.hasFlags, err = r.flagsTag(n, args); err != nil {
+				return nil, err
+			}
+		case "copy":
+			if err := r.require(n, "copy"); err != nil {
+				return nil, err
+			}
+			cmd.copy = true
+		default:
+			return nil, args.errorf("unknown tag: %v", tag)
+		}
+	}
+	folder, err := args.string()
+	if err != nil {
+		return nil, err
+	}
+	cmd.folder = strings.Trim(folder, "/")
+	if len(cmd.folder) == 0 {
+		return nil, args.errorf("empty folder name")
+	}
+
+	return cmd, args.end()
+}
+
+func (r *compiler) redirectCommand(n *node) (command, error) {
+	cmd := &redirectCommand{}
+	args := &arguments{node: n}
+	for {
+		tag, ok := args.tag()
+		if !ok {
+			break
+		}
+		if tag != "copy" {
+			return nil, args.errorf("unknown tag: %v", tag)
+		}
+		if err := r.require(n, "copy"); err != nil {
+			return nil, err
+		}
+		cmd.copy = true
+	}
+	address, err := args.string()
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.LastIndex(address, "@"); i <= 0 || i == len(address)-1 {
+		return nil, args.errorf("invalid address: %v", address)
+	}
+	cmd.address = address
+
+	return cmd, args.end()
+}
+
+func (r *compiler) flagCommand(n *node) (command, error) {
+	if err := r.require(n, "imap4flags"); err != nil {
+		return nil, err
+	}
+	args := &arguments{node: n}
+	list, err := args.stringList()
+	if err != nil {
+		return nil, err
+	}
+
+	return &flagCommand{op: n.name, flags: splitFlags(list)}, args.end()
+}
+
+func (r *compiler) vacationCommand(n *node) (command, error) {
+	if err := r.require(n, "vacation"); err != nil {
+		return nil, err
+	}
+	v := Vacation{Days: defaultVacationDays}
+	args := &arguments{node: n}
+	for {
+		tag, ok := args.tag()
+		if !ok {
+			break
+		}
+		var err error
+		switch tag {
+		case "days":
+			var days int64
+			days, err = args.number()
+			v.Days = int(days)
+			if v.Days < minVacationDays {
+				v.Days = minVacationDays
+			}
+			if v.Days > maxVacationDays {
+				v.Days = maxVacationDays
+			}
+		case "subject":
+			v.Subject, err = args.string()
+		case "from":
+			v.From, err = args.string()
+		case "addresses":
+			v.Addresses, err = args.stringList()
+		case "mime":
+			v.MIME = true
+		case "handle":
+			v.Handle, err = args.string()
+		default:
+			err = args.errorf("unknown tag: %v", tag)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	reason, err := args.string()
+	if err != nil {
+		return nil, err
+	}
+	v.Reason = reason
+	// The default handle is derived from the arguments, so a changed response
+	// is sent again.
+	if len(v.Handle) == 0 {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%v\x00%v\x00%v\x00%v", v.Subject, v.From, v.MIME, v.Reason)))
+		v.Handle = hex.EncodeToString(sum[:16])
+	}
+
+	return &vacationCommand{vacation: v}, args.end()
+}
+
+func (r *compiler) test(n *node) (test, error) {
+	args := &arguments{node: n}
+	if len(n.tests) > 0 && n.name != "allof" && n.name != "anyof" && n.name != "not" {
+		return nil, args.errorf("unexpected test")
+	}
+
+	switch n.name {
+	case "true", "false":
+		return boolTest(n.name == "true"), args.end()
+	case "not":
+		if len(n.tests) != 1 {
+			return nil, args.errorf("requires a test")
+		}
+		t, err := r.test(n.tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return &notTest{test: t}, args.end()
+	case "allof", "anyof":
+		if len(n.tests) == 0 {
+			return nil, args.errorf("requires a test list")
+		}
+		result := &allofTest{any: n.name == "anyof"}
+		for _, v := range n.tests {
+			t, err := r.test(v)
+			if err != nil {
+				return nil, err
+			}
+			result.tests = append(result.tests, t)
+		}
+		return result, args.end()
+	case "size":
+		tag, ok := args.tag()
+		if !ok || (tag != "over" && tag != "under") {
+			return nil, args.errorf("requires :over or :under")
+		}
+		limit, err := args.number()
+		if err != nil {
+			return nil, err
+		}
+		return &sizeTest{over: tag == "over", limit: limit}, args.end()
+	case "exists":
+		headers, err := args.stringList()
+		if err != nil {
+			return nil, err
+		}
+		return &existsTest{headers: headers}, args.end()
+	case "header", "address", "envelope":
+		return r.matchTest(n, args)
+	default:
+		return nil, fmt.Errorf("line %v: unknown test: %v", n.line, n.name)
+	}
+}
+
+// matchTest compiles the header, address, and envelope tests.
+func (r *compiler) matchTest(n *node, args *arguments) (test, error) {
+	if n.name == "envelope" {
+		if err := r.require(n, "envelope"); err != nil {
+			return nil, err
+		}
+	}
+
+	m := matcher{match: "is"}
+	part := "all"
+	for {
+		tag, ok := args.tag()
+		if !ok {
+			break
+		}
+		switch {
+		case tag == "is" || tag == "contains" || tag == "matches":
+			m.match = tag
+		case tag == "comparator":
+			c, err := args.string()
+			if err != nil {
+				return nil, err
+			}
+			switch strings.ToLower(c) {
+			case "i;octet":
+				if err := r.require(n, "comparator-i;octet"); err != nil {
+					return nil, err
+				}
+				m.octet = true
+			case "i;ascii-casemap":
+				m.octet = false
+			default:
+				return nil, args.errorf("unsupported comparator: %v", c)
+			}
+		case n.name != "header" && (tag == "all" || tag == "localpart" || tag == "domain"):
+			part = tag
+		default:
+			return nil, args.errorf("unknown tag: %v", tag)
+		}
+	}
+	headers, err := args.stringList()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := args.stringList()
+	if err != nil {
+		return nil, err
+	}
+	if err := args.end(); err != nil {
+		return nil, err
+	}
+
+	if n.name == "header" {
+		return &headerTest{matcher: m, headers: headers, keys: keys}, nil
+	}
+	if n.name == "envelope" {
+		for _, v := range headers {
+			if v = strings.ToLower(v); v != "from" && v != "to" {
+				return nil, args.errorf("unsupported envelope part: %v", v)
+			}
+		}
+	}
+
+	return &addressTest{matcher: m, part: part, headers: headers, keys: keys, envelope: n.name == "envelope"}, nil
+}
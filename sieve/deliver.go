@@ -0,0 +1,387 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package sieve
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/delivery"
+	"github.com/superkkt/omega/scanner"
+
+	"github.com/superkkt/logger"
+)
+
+// Outbox queues outgoing emails, which is implemented by outbox.Enqueuer.
+type Outbox interface {
+	// Enqueue should be called in a transaction that will be committed by
+	// the caller.
+	Enqueue(queryer database.Queryer, c backend.Credential, from string, to []string, msg []byte, saveInSent bool) error
+}
+
+type Config struct {
+	Backend backend.Storage
+	Storage Storage
+	// Outbox is used to send redirected emails and vacation responses.
+	Outbox Outbox
+	// Hostname is used to generate Message-IDs of vacation responses. Empty
+	// means the system hostname.
+	Hostname string
+}
+
+// Deliverer implements the delivery.Deliverer interface. It runs the Sieve
+// script of the user for each inbound email, and stores the email into the
+// Inbox if the user has no script or the script fails.
+type Deliverer struct {
+	config Config
+}
+
+func NewDeliverer(conf Config) (*Deliverer, error) {
+	if conf.Backend == nil || conf.Storage == nil || conf.Outbox == nil {
+		return nil, errors.New("nil backend storage, sieve storage, or outbox")
+	}
+	if len(conf.Hostname) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		conf.Hostname = hostname
+	}
+
+	return &Deliverer{config: conf}, nil
+}
+
+func (r *Deliverer) Deliver(queryer database.Queryer, c backend.Credential, rcpt string, msg *delivery.Message) error {
+	result, err := r.evaluate(queryer, c, rcpt, msg)
+	if err != nil {
+		return err
+	}
+
+	// Folder IDs that already have this email to avoid storing duplicates.
+	stored := make(map[uint64]bool)
+	if result.Keep {
+		if err := r.store(queryer, c, rcpt, msg, nil, result.KeepFlags, stored); err != nil {
+			return err
+		}
+	}
+	for _, v := range result.FileInto {
+		if err := r.store(queryer, c, rcpt, msg, strings.Split(v.Folder, "/"), v.Flags, stored); err != nil {
+			return err
+		}
+	}
+	if len(result.Redirect) > 0 {
+		if err := r.redirect(queryer, c, rcpt, msg, result.Redirect); err != nil {
+			return err
+		}
+	}
+	if result.Vacation != nil {
+		if err := r.vacation(queryer, c, rcpt, msg, result.Vacation); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// evaluate runs the script of the user, and returns a result that only keeps
+// the email if the user has no script or the script is broken. A broken script
+// should not make the email lost or bounced.
+func (r *Deliverer) evaluate(queryer database.Queryer, c backend.Credential, rcpt string, msg *delivery.Message) (*Result, error) {
+	keep := &Result{Keep: true}
+
+	src, err := r.config.Storage.NewScriptManager(queryer).GetScript(c.UserUID(), database.LockNone)
+	if err != nil {
+		if isNotFound(err) {
+			return keep, nil
+		}
+		return nil, err
+	}
+	script, err := Parse(src)
+	if err != nil {
+		logger.Warning(fmt.Sprintf("sieve: invalid script: user=%v, err=%v", c.UserID(), err))
+		return keep, nil
+	}
+	result, err := script.Evaluate(Message{
+		From:   msg.From,
+		To:     rcpt,
+		Header: msg.Header,
+		Size:   int64(len(msg.Raw)),
+	})
+	if err != nil {
+		logger.Warning(fmt.Sprintf("sieve: failed to run the script: user=%v, err=%v", c.UserID(), err))
+		return keep, nil
+	}
+	logger.Debug(fmt.Sprintf("sieve: evaluated the script: user=%v, rcpt=%v, keep=%v, fileinto=%v, redirect=%v, vacation=%v",
+		c.UserID(), rcpt, result.Keep, len(result.FileInto), result.Redirect, result.Vacation != nil))
+
+	return result, nil
+}
+
+// store adds the email into a folder whose path is path, or the default folder
+// if path is nil or not found.
+func (r *Deliverer) store(queryer database.Queryer, c backend.Credential, rcpt string, msg *delivery.Message, path []string, flags []string, stored map[uint64]bool) error {
+	folderID, err := r.getFolder(queryer, c, path, msg.Junk)
+	if err != nil {
+		return err
+	}
+	if stored[folderID] {
+		return nil
+	}
+	stored[folderID] = true
+
+	em := r.config.Backend.NewEmailManager(queryer, c, folderID)
+	email, err := em.AddEmail(delivery.Envelope(rcpt, msg))
+	if err != nil {
+		return fmt.Errorf("AddEmail: %v", err)
+	}
+	// The backend only keeps the seen flag. Other flags are ignored.
+	if hasFlag(flags, `\Seen`) {
+		if err := em.UpdateEmail(email.ID, true); err != nil {
+			return fmt.Errorf("UpdateEmail: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// getFolder returns the folder ID of path. The default folder, which is the
+// Junk folder for spam or the Inbox for others, is used if path is nil or not
+// found.
+func (r *Deliverer) getFolder(queryer database.Queryer, c backend.Credential, path []string, junk bool) (uint64, error) {
+	fm := r.config.Backend.NewFolderManager(queryer, c)
+	inbox := len(path) == 1 && strings.EqualFold(path[0], "INBOX")
+	if len(path) > 0 && !inbox {
+		folder, err := fm.GetFolderByPath(path, database.LockRead)
+		if err == nil {
+			return folder.ID, nil
+		}
+		if !isNotFound(err) {
+			return 0, err
+		}
+		// RFC 5228 Section 4.1: failing to store into the folder should not
+		// lose the email.
+		logger.Info(fmt.Sprintf("sieve: not found a fileinto folder, keeping the email in the default folder: user=%v, folder=%v", c.UserID(), strings.Join(path, "/")))
+	}
+	// An explicit fileinto "INBOX" overrides the junk verdict.
+	if junk && !inbox {
+		return scanner.GetJunkFolder(fm)
+	}
+
+	folders, err := fm.GetFolderByType(backend.EmailInbox, database.LockRead)
+	if err != nil {
+		return 0, err
+	}
+	if len(folders) == 0 {
+		return 0, fmt.Errorf("not found an inbox folder: user=%v", c.UserID())
+	}
+
+	return folders[0].ID, nil
+}
+
+// redirect forwards the email to addresses. The Delivered-To header of rcpt
+// is prepended to detect mail loops.
+func (r *Deliverer) redirect(queryer database.Queryer, c backend.Credential, rcpt string, msg *delivery.Message, addresses []string) error {
+	for _, v := range msg.Header["Delivered-To"] {
+		if strings.EqualFold(strings.TrimSpace(v), rcpt) {
+			logger.Info(fmt.Sprintf("sieve: mail loop detected, skipping the redirect: user=%v, rcpt=%v", c.UserID(), rcpt))
+			return nil
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Delivered-To: %v\r\n", rcpt)
+	buf.Write(msg.Raw)
+	// The envelope sender is rcpt, instead of the original sender, so that
+	// SPF checks of the destination pass and bounces come back to the user.
+	if err := r.config.Outbox.Enqueue(queryer, c, rcpt, addresses, buf.Bytes(), false); err != nil {
+		return fmt.Errorf("failed to enqueue a redirected email: %v", err)
+	}
+	logger.Debug(fmt.Sprintf("sieve: redirected an email: user=%v, to=%v", c.UserID(), addresses))
+
+	return nil
+}
+
+// vacation sends a vacation response (RFC 5230) to the sender of the email
+// unless the email should not be responded or a response has already been
+// sent to the sender in the period of v.Days.
+func (r *Deliverer) vacation(queryer database.Queryer, c backend.Credential, rcpt string, msg *delivery.Message, v *Vacation) error {
+	sender := msg.From
+	if !shouldRespond(msg, sender, append([]string{rcpt}, userAddresses(c, v)...)) {
+		logger.Debug(fmt.Sprintf("sieve: skipping a vacation response: user=%v, sender=%v", c.UserID(), sender))
+		return nil
+	}
+
+	period := time.Duration(v.Days) * 24 * time.Hour
+	ok, err := r.config.Storage.NewScriptManager(queryer).AddVacationResponse(c.UserUID(), v.Handle, strings.ToLower(sender), period)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		logger.Debug(fmt.Sprintf("sieve: already responded to the sender: user=%v, sender=%v", c.UserID(), sender))
+		return nil
+	}
+
+	from := rcpt
+	if ac, ok := c.(backend.AddressCredential); ok && len(ac.Address()) > 0 {
+		from = ac.Address()
+	}
+	// The envelope sender should be empty according to RFC 5230, but some
+	// relay hosts reject the null reverse-path. Bounces of the response will
+	// be delivered into the Inbox of the user instead.
+	if err := r.config.Outbox.Enqueue(queryer, c, from, []string{sender}, r.response(from, sender, msg, v), false); err != nil {
+		return fmt.Errorf("failed to enqueue a vacation response: %v", err)
+	}
+	logger.Debug(fmt.Sprintf("sieve: sent a vacation response: user=%v, to=%v", c.UserID(), sender))
+
+	return nil
+}
+
+func (r *Deliverer) response(from, to string, msg *delivery.Message, v *Vacation) []byte {
+	if len(v.From) > 0 {
+		from = v.From
+	}
+	subject := v.Subject
+	if len(subject) == 0 {
+		subject = "Auto: " + decodeHeader(msg.Header.Get("Subject"))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %v\r\n", from)
+	fmt.Fprintf(&buf, "To: <%v>\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", oneLine(subject)))
+	fmt.Fprintf(&buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%v@%v>\r\n", randomID(), r.config.Hostname)
+	if id := strings.TrimSpace(msg.Header.Get("Message-Id")); len(id) > 0 {
+		fmt.Fprintf(&buf, "In-Reply-To: %v\r\n", id)
+		fmt.Fprintf(&buf, "References: %v\r\n", oneLine(strings.TrimSpace(msg.Header.Get("References")+" "+id)))
+	}
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied (vacation)\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	if v.MIME {
+		// The reason is a MIME entity that starts with its own headers.
+		buf.WriteString(crlf(v.Reason))
+	} else {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+		buf.WriteString(crlf(v.Reason))
+	}
+
+	return buf.Bytes()
+}
+
+// userAddresses returns the email addresses of the user, which includes the
+// :addresses argument of the vacation action.
+func userAddresses(c backend.Credential, v *Vacation) []string {
+	addresses := append([]string{}, v.Addresses...)
+	if ac, ok := c.(backend.AddressCredential); ok {
+		addresses = append(addresses, ac.Address())
+		addresses = append(addresses, ac.Aliases()...)
+	}
+
+	return addresses
+}
+
+// shouldRespond returns whether a vacation response can be sent to sender
+// according to RFC 5230 Section 4.
+func shouldRespond(msg *delivery.Message, sender string, addresses []string) bool {
+	// Null reverse-path of bounces.
+	if len(sender) == 0 || msg.Junk {
+		return false
+	}
+	local := strings.ToLower(sender)
+	if i := strings.LastIndex(local, "@"); i >= 0 {
+		local = local[:i]
+	}
+	if local == "mailer-daemon" || local == "listserv" || local == "majordomo" ||
+		strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return false
+	}
+	if v := strings.ToLower(strings.TrimSpace(msg.Header.Get("Auto-Submitted"))); len(v) > 0 && !strings.HasPrefix(v, "no") {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(msg.Header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	if len(msg.Header.Get("List-Id")) > 0 {
+		return false
+	}
+	for _, v := range addresses {
+		if strings.EqualFold(v, sender) {
+			return false
+		}
+	}
+
+	// One of the user's addresses should be an explicit recipient.
+	for _, name := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		list, err := msg.Header.AddressList(name)
+		if err != nil {
+			continue
+		}
+		for _, a := range list {
+			for _, v := range addresses {
+				if strings.EqualFold(a.Address, v) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func crlf(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.Replace(s, "\n", "\r\n", -1)
+	if !strings.HasSuffix(s, "\r\n") {
+		s += "\r\n"
+	}
+
+	return s
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func randomID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(database.NotFoundError)
+	if !ok {
+		return false
+	}
+
+	return e.IsNotFound()
+}
@@ -0,0 +1,390 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+package sieve
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superkkt/omega/backend"
+	"github.com/superkkt/omega/database"
+	"github.com/superkkt/omega/delivery"
+)
+
+const (
+	inboxID = 1
+	junkID  = 2
+	workID  = 3
+)
+
+type notFoundError struct{}
+
+func (r notFoundError) Error() string    { return "not found" }
+func (r notFoundError) IsNotFound() bool { return true }
+
+type testCredential struct {
+	userID  string
+	uid     uint64
+	address string
+	aliases []string
+}
+
+func (r testCredential) IsAuthorized() bool { return r.uid > 0 }
+func (r testCredential) UserID() string     { return r.userID }
+func (r testCredential) UserUID() uint64    { return r.uid }
+func (r testCredential) Address() string    { return r.address }
+func (r testCredential) Aliases() []string  { return r.aliases }
+
+var alice = testCredential{userID: "alice", uid: 1, address: "alice@example.com", aliases: []string{"a@example.com"}}
+
+type storedEmail struct {
+	folderID uint64
+	seen     bool
+	raw      []byte
+}
+
+type enqueued struct {
+	from string
+	to   []string
+	msg  []byte
+}
+
+// testStorage implements the backend and the sieve storages, and the outbox
+// of a user who has the Inbox, Junk, and Work folders.
+type testStorage struct {
+	script    string
+	emails    []*storedEmail
+	vacations map[string]bool
+	outbox    []enqueued
+}
+
+func newTestStorage(script string) *testStorage {
+	return &testStorage{
+		script:    script,
+		vacations: make(map[string]bool),
+	}
+}
+
+func (r *testStorage) NewFolderManager(queryer database.Queryer, c backend.Credential) backend.FolderManager {
+	return &testFolderManager{}
+}
+
+func (r *testStorage) NewEmailManager(queryer database.Queryer, c backend.Credential, folderID uint64) backend.EmailManager {
+	return &testEmailManager{storage: r, folderID: folderID}
+}
+
+func (r *testStorage) NewScriptManager(queryer database.Queryer) ScriptManager {
+	return &testScriptManager{storage: r}
+}
+
+func (r *testStorage) Enqueue(queryer database.Queryer, c backend.Credential, from string, to []string, msg []byte, saveInSent bool) error {
+	r.outbox = append(r.outbox, enqueued{from: from, to: to, msg: msg})
+	return nil
+}
+
+// testFolderManager only implements the methods used by Deliverer.
+type testFolderManager struct {
+	backend.FolderManager
+}
+
+func (r *testFolderManager) GetFolderByPath(path []string, lock database.LockMode) (backend.Folder, error) {
+	if len(path) == 1 && strings.EqualFold(path[0], "Work") {
+		return backend.Folder{ID: workID, Name: "Work", Type: backend.EmailFolder}, nil
+	}
+
+	return backend.Folder{}, notFoundError{}
+}
+
+func (r *testFolderManager) GetFolderByType(t backend.FolderType, lock database.LockMode) ([]backend.Folder, error) {
+	switch t {
+	case backend.EmailInbox:
+		return []backend.Folder{{ID: inboxID, Name: "Inbox", Type: t}}, nil
+	case backend.EmailJunk:
+		return []backend.Folder{{ID: junkID, Name: "Junk", Type: t}}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// testEmailManager only implements the methods used by Deliverer.
+type testEmailManager struct {
+	backend.EmailManager
+	storage  *testStorage
+	folderID uint64
+}
+
+func (r *testEmailManager) AddEmail(raw []byte) (*backend.Email, error) {
+	r.storage.emails = append(r.storage.emails, &storedEmail{folderID: r.folderID, raw: raw})
+	return &backend.Email{ID: uint64(len(r.storage.emails))}, nil
+}
+
+func (r *testEmailManager) UpdateEmail(emailID uint64, seen bool) error {
+	r.storage.emails[emailID-1].seen = seen
+	return nil
+}
+
+type testScriptManager struct {
+	storage *testStorage
+}
+
+func (r *testScriptManager) GetScript(uid uint64, lock database.LockMode) (string, error) {
+	if len(r.storage.script) == 0 {
+		return "", notFoundError{}
+	}
+	return r.storage.script, nil
+}
+
+func (r *testScriptManager) SetScript(uid uint64, script string) error {
+	r.storage.script = script
+	return nil
+}
+
+func (r *testScriptManager) RemoveScript(uid uint64) error {
+	r.storage.script = ""
+	return nil
+}
+
+func (r *testScriptManager) AddVacationResponse(uid uint64, handle, sender string, period time.Duration) (bool, error) {
+	key := fmt.Sprintf("%v/%v/%v", uid, handle, sender)
+	if r.storage.vacations[key] {
+		return false, nil
+	}
+	r.storage.vacations[key] = true
+	return true, nil
+}
+
+func newTestDeliverer(t *testing.T, storage *testStorage) *Deliverer {
+	d, err := NewDeliverer(Config{
+		Backend:  storage,
+		Storage:  storage,
+		Outbox:   storage,
+		Hostname: "mx.example.com",
+	})
+	if err != nil {
+		t.Fatalf("NewDeliverer: %v", err)
+	}
+
+	return d
+}
+
+func newTestMessage(t *testing.T, from, header string) *delivery.Message {
+	raw := strings.Replace(header, "\n", "\r\n", -1) + "\r\n\r\nHello\r\n"
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+
+	return &delivery.Message{From: from, Header: msg.Header, Raw: []byte(raw)}
+}
+
+const testHeaders = `From: Bob <bob@example.org>
+To: Alice <alice@example.com>
+Subject: Meeting
+Message-Id: <1@example.org>`
+
+func deliver(t *testing.T, storage *testStorage, msg *delivery.Message) {
+	if err := newTestDeliverer(t, storage).Deliver(nil, alice, "alice@example.com", msg); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+}
+
+// folders returns the folder IDs of the stored emails, and the seen flags.
+func (r *testStorage) folders() (folders []uint64, seen []bool) {
+	for _, v := range r.emails {
+		folders = append(folders, v.folderID)
+		seen = append(seen, v.seen)
+	}
+
+	return folders, seen
+}
+
+func TestDeliverFileInto(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		junk    bool
+		folders []uint64
+		seen    []bool
+	}{
+		{"no script", "", false, []uint64{inboxID}, []bool{false}},
+		{"no script junk", "", true, []uint64{junkID}, []bool{false}},
+		{"invalid script", `fileinto "Work";`, false, []uint64{inboxID}, []bool{false}},
+		{"fileinto", `require "fileinto"; fileinto "Work";`, false, []uint64{workID}, []bool{false}},
+		{"fileinto junk", `require "fileinto"; fileinto "Work";`, true, []uint64{workID}, []bool{false}},
+		// RFC 5228 Section 4.1: a missing folder should not lose the email.
+		{"fileinto fallback", `require "fileinto"; fileinto "Missing/Folder";`, false, []uint64{inboxID}, []bool{false}},
+		{"fileinto fallback junk", `require "fileinto"; fileinto "Missing";`, true, []uint64{junkID}, []bool{false}},
+		{"fileinto inbox overrides junk", `require "fileinto"; fileinto "INBOX";`, true, []uint64{inboxID}, []bool{false}},
+		{"fileinto fallback once", `require "fileinto"; keep; fileinto "Missing";`, false, []uint64{inboxID}, []bool{false}},
+		{"fileinto copy", `require ["fileinto", "copy"]; fileinto :copy "Work";`, false, []uint64{inboxID, workID}, []bool{false, false}},
+		{"flags", `require ["fileinto", "imap4flags"]; fileinto :flags "\\Seen" "Work"; keep;`, false, []uint64{inboxID, workID}, []bool{false, true}},
+		{"discard", `discard;`, false, nil, nil},
+	}
+	for _, test := range tests {
+		storage := newTestStorage(test.script)
+		msg := newTestMessage(t, "bob@example.org", testHeaders)
+		msg.Junk = test.junk
+		deliver(t, storage, msg)
+
+		folders, seen := storage.folders()
+		if !reflect.DeepEqual(folders, test.folders) || !reflect.DeepEqual(seen, test.seen) {
+			t.Errorf("%v: expected folders=%v, seen=%v, got folders=%v, seen=%v", test.name, test.folders, test.seen, folders, seen)
+		}
+		for _, v := range storage.emails {
+			if !bytes.HasPrefix(v.raw, []byte("Return-Path: <bob@example.org>\r\nDelivered-To: alice@example.com\r\n")) {
+				t.Errorf("%v: missing envelope headers: %q", test.name, v.raw)
+			}
+		}
+	}
+}
+
+func TestDeliverRedirect(t *testing.T) {
+	storage := newTestStorage(`redirect "carol@example.net";`)
+	deliver(t, storage, newTestMessage(t, "bob@example.org", testHeaders))
+
+	if len(storage.emails) != 0 {
+		t.Fatalf("expected no stored email, got %v", len(storage.emails))
+	}
+	if len(storage.outbox) != 1 {
+		t.Fatalf("expected a redirected email, got %v", len(storage.outbox))
+	}
+	e := storage.outbox[0]
+	if e.from != "alice@example.com" || !reflect.DeepEqual(e.to, []string{"carol@example.net"}) {
+		t.Fatalf("unexpected envelope: from=%v, to=%v", e.from, e.to)
+	}
+	if !bytes.HasPrefix(e.msg, []byte("Delivered-To: alice@example.com\r\nFrom: Bob")) {
+		t.Fatalf("expected the Delivered-To header, got %q", e.msg)
+	}
+}
+
+func TestDeliverRedirectLoop(t *testing.T) {
+	// The email has come back through the redirect of another server.
+	storage := newTestStorage(`redirect "carol@example.net";`)
+	deliver(t, storage, newTestMessage(t, "alice@example.com", "Delivered-To: Alice@Example.com\n"+testHeaders))
+
+	if len(storage.outbox) != 0 {
+		t.Fatalf("expected no redirected email, got %v", len(storage.outbox))
+	}
+	// The implicit keep has been canceled by the redirect.
+	if len(storage.emails) != 0 {
+		t.Fatalf("expected no stored email, got %v", len(storage.emails))
+	}
+
+	// Delivered-To headers of other recipients are not loops.
+	storage = newTestStorage(`redirect "carol@example.net";`)
+	deliver(t, storage, newTestMessage(t, "bob@example.org", "Delivered-To: dave@example.com\n"+testHeaders))
+	if len(storage.outbox) != 1 {
+		t.Fatalf("expected a redirected email, got %v", len(storage.outbox))
+	}
+}
+
+const testVacation = `require "vacation"; vacation :subject "Out of office" "I am away.";`
+
+func TestDeliverVacation(t *testing.T) {
+	storage := newTestStorage(testVacation)
+	deliver(t, storage, newTestMessage(t, "bob@example.org", testHeaders))
+
+	if len(storage.emails) != 1 || storage.emails[0].folderID != inboxID {
+		t.Fatalf("expected the email in the Inbox, got %v", len(storage.emails))
+	}
+	if len(storage.outbox) != 1 {
+		t.Fatalf("expected a vacation response, got %v", len(storage.outbox))
+	}
+	e := storage.outbox[0]
+	if e.from != "alice@example.com" || !reflect.DeepEqual(e.to, []string{"bob@example.org"}) {
+		t.Fatalf("unexpected envelope: from=%v, to=%v", e.from, e.to)
+	}
+	response, err := mail.ReadMessage(bytes.NewReader(e.msg))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	expected := map[string]string{
+		"From":           "alice@example.com",
+		"To":             "<bob@example.org>",
+		"Subject":        "Out of office",
+		"In-Reply-To":    "<1@example.org>",
+		"References":     "<1@example.org>",
+		"Auto-Submitted": "auto-replied (vacation)",
+	}
+	for k, v := range expected {
+		if s := response.Header.Get(k); s != v {
+			t.Errorf("%v: expected %q, got %q", k, v, s)
+		}
+	}
+	if id := response.Header.Get("Message-Id"); !strings.HasSuffix(id, "@mx.example.com>") {
+		t.Errorf("unexpected Message-Id: %v", id)
+	}
+
+	// Only one response is sent to the sender in the period.
+	deliver(t, storage, newTestMessage(t, "Bob@Example.org", testHeaders))
+	if len(storage.outbox) != 1 {
+		t.Fatalf("expected no more vacation response, got %v", len(storage.outbox))
+	}
+	// But other senders get their responses.
+	deliver(t, storage, newTestMessage(t, "carol@example.net", testHeaders))
+	if len(storage.outbox) != 2 {
+		t.Fatalf("expected a vacation response to another sender, got %v", len(storage.outbox))
+	}
+}
+
+func TestDeliverVacationSuppressed(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   string
+		header string
+		junk   bool
+	}{
+		{"null sender", "", testHeaders, false},
+		{"mailer daemon", "MAILER-DAEMON@example.org", testHeaders, false},
+		{"owner", "owner-omega@lists.example.org", testHeaders, false},
+		{"request", "omega-request@lists.example.org", testHeaders, false},
+		{"auto submitted", "bob@example.org", "Auto-Submitted: auto-replied\n" + testHeaders, false},
+		{"bulk", "bob@example.org", "Precedence: bulk\n" + testHeaders, false},
+		{"list", "bob@example.org", "List-Id: <omega.lists.example.org>\n" + testHeaders, false},
+		{"junk", "bob@example.org", testHeaders, true},
+		{"own address", "a@example.com", testHeaders, false},
+		{"not a recipient", "bob@example.org", "From: bob@example.org\nTo: omega@lists.example.org\nSubject: Hi", false},
+	}
+	for _, test := range tests {
+		storage := newTestStorage(testVacation)
+		msg := newTestMessage(t, test.from, test.header)
+		msg.Junk = test.junk
+		deliver(t, storage, msg)
+		if len(storage.outbox) != 0 {
+			t.Errorf("%v: expected no vacation response", test.name)
+		}
+		if len(storage.emails) != 1 {
+			t.Errorf("%v: expected the email to be stored, got %v", test.name, len(storage.emails))
+		}
+	}
+
+	// Auto-Submitted: no is a human message, and aliases are recipients.
+	storage := newTestStorage(testVacation)
+	deliver(t, storage, newTestMessage(t, "bob@example.org", "Auto-Submitted: no\nFrom: bob@example.org\nCc: a@example.com\nSubject: Hi"))
+	if len(storage.outbox) != 1 {
+		t.Fatalf("expected a vacation response, got %v", len(storage.outbox))
+	}
+}
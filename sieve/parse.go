@@ -0,0 +1,476 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package sieve
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenLeftBracket
+	tokenRightBracket
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBrace
+	tokenRightBrace
+	tokenComma
+	tokenSemicolon
+)
+
+type token struct {
+	typ  tokenType
+	str  string
+	num  int64
+	line int
+}
+
+func (r token) String() string {
+	switch r.typ {
+	case tokenEOF:
+		return "end of script"
+	case tokenIdentifier:
+		return r.str
+	case tokenTag:
+		return ":" + r.str
+	case tokenNumber:
+		return fmt.Sprintf("%v", r.num)
+	case tokenString:
+		return fmt.Sprintf("%q", r.str)
+	default:
+		return r.str
+	}
+}
+
+// lexer splits a script into tokens (RFC 5228 section 8.1).
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (r *lexer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %v: %v", r.line, fmt.Sprintf(format, args...))
+}
+
+func (r *lexer) next() (token, error) {
+	if err := r.skipSpaces(); err != nil {
+		return token{}, err
+	}
+	if r.pos >= len(r.src) {
+		return token{typ: tokenEOF, line: r.line}, nil
+	}
+
+	c := r.src[r.pos]
+	line := r.line
+	if t, ok := map[byte]tokenType{
+		'[': tokenLeftBracket, ']': tokenRightBracket,
+		'(': tokenLeftParen, ')': tokenRightParen,
+		'{': tokenLeftBrace, '}': tokenRightBrace,
+		',': tokenComma, ';': tokenSemicolon,
+	}[c]; ok {
+		r.pos++
+		return token{typ: t, str: string(c), line: line}, nil
+	}
+
+	switch {
+	case c == '"':
+		s, err := r.quoted()
+		return token{typ: tokenString, str: s, line: line}, err
+	case c == ':':
+		r.pos++
+		id := r.identifier()
+		if len(id) == 0 {
+			return token{}, r.errorf("invalid tag")
+		}
+		return token{typ: tokenTag, str: strings.ToLower(id), line: line}, nil
+	case isDigit(c):
+		n, err := r.number()
+		return token{typ: tokenNumber, num: n, line: line}, err
+	case isAlpha(c) || c == '_':
+		id := r.identifier()
+		if strings.EqualFold(id, "text") && r.pos < len(r.src) && r.src[r.pos] == ':' {
+			r.pos++
+			s, err := r.multiline()
+			return token{typ: tokenString, str: s, line: line}, err
+		}
+		return token{typ: tokenIdentifier, str: strings.ToLower(id), line: line}, nil
+	default:
+		return token{}, r.errorf("unexpected character %q", c)
+	}
+}
+
+// skipSpaces skips white spaces and comments.
+func (r *lexer) skipSpaces() error {
+	for r.pos < len(r.src) {
+		switch c := r.src[r.pos]; {
+		case c == '\n':
+			r.line++
+			r.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			r.pos++
+		case c == '#':
+			for r.pos < len(r.src) && r.src[r.pos] != '\n' {
+				r.pos++
+			}
+		case c == '/' && strings.HasPrefix(r.src[r.pos:], "/*"):
+			end := strings.Index(r.src[r.pos+2:], "*/")
+			if end < 0 {
+				return r.errorf("unterminated comment")
+			}
+			r.line += strings.Count(r.src[r.pos:r.pos+2+end], "\n")
+			r.pos += end + 4
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (r *lexer) identifier() string {
+	start := r.pos
+	for r.pos < len(r.src) && (isAlpha(r.src[r.pos]) || isDigit(r.src[r.pos]) || r.src[r.pos] == '_') {
+		r.pos++
+	}
+
+	return r.src[start:r.pos]
+}
+
+func (r *lexer) number() (int64, error) {
+	var n int64
+	for r.pos < len(r.src) && isDigit(r.src[r.pos]) {
+		n = n*10 + int64(r.src[r.pos]-'0')
+		if n > 1<<40 {
+			return 0, r.errorf("too large number")
+		}
+		r.pos++
+	}
+	if r.pos < len(r.src) {
+		switch r.src[r.pos] {
+		case 'K', 'k':
+			n <<= 10
+			r.pos++
+		case 'M', 'm':
+			n <<= 20
+			r.pos++
+		case 'G', 'g':
+			n <<= 30
+			r.pos++
+		}
+	}
+
+	return n, nil
+}
+
+func (r *lexer) quoted() (string, error) {
+	var b bytes.Buffer
+	// Skip the opening quote.
+	r.pos++
+	for r.pos < len(r.src) {
+		c := r.src[r.pos]
+		r.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			// Only \" and \\ are defined, and others are the character itself.
+			if r.pos < len(r.src) {
+				c = r.src[r.pos]
+				r.pos++
+			}
+		case '\n':
+			r.line++
+		}
+		b.WriteByte(c)
+	}
+
+	return "", r.errorf("unterminated string")
+}
+
+// multiline reads a multi-line string after "text:", which ends with a line
+// that has a single dot. A leading dot of a line is escaped by another dot.
+func (r *lexer) multiline() (string, error) {
+	// Skip the rest of the "text:" line, which can have a comment.
+	end := strings.IndexByte(r.src[r.pos:], '\n')
+	if end < 0 {
+		return "", r.errorf("unterminated multi-line string")
+	}
+	if rest := strings.TrimSpace(r.src[r.pos : r.pos+end]); len(rest) > 0 && rest[0] != '#' {
+		return "", r.errorf("unexpected characters after text:")
+	}
+	r.pos += end + 1
+	r.line++
+
+	var lines []string
+	for {
+		end := strings.IndexByte(r.src[r.pos:], '\n')
+		if end < 0 {
+			return "", r.errorf("unterminated multi-line string")
+		}
+		line := strings.TrimSuffix(r.src[r.pos:r.pos+end], "\r")
+		r.pos += end + 1
+		r.line++
+		if line == "." {
+			break
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n", nil
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// node is a command or a test of the syntax tree.
+type node struct {
+	name string
+	args []argument
+	// tests are the test or the test list of the command, or the arguments
+	// of a test such as allof.
+	tests []*node
+	// block is the block of a control command.
+	block []*node
+	// hasBlock distinguishes an empty block from no block.
+	hasBlock bool
+	line     int
+}
+
+type argument struct {
+	typ tokenType // tokenTag, tokenNumber, or tokenString (including string lists)
+	tag string
+	num int64
+	str []string
+	// list is true if the argument is a string list rather than a string.
+	list bool
+}
+
+// parser builds a syntax tree from tokens (RFC 5228 section 8.2).
+type parser struct {
+	lexer *lexer
+	token token
+	// depth is the nesting level of blocks and tests.
+	depth int
+}
+
+const maxDepth = 32
+
+func parse(src string) ([]*node, error) {
+	p := &parser{lexer: &lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	commands, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.typ != tokenEOF {
+		return nil, p.errorf("unexpected %v", p.token)
+	}
+
+	return commands, nil
+}
+
+func (r *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %v: %v", r.token.line, fmt.Sprintf(format, args...))
+}
+
+func (r *parser) advance() (err error) {
+	r.token, err = r.lexer.next()
+	return err
+}
+
+func (r *parser) expect(t tokenType, desc string) error {
+	if r.token.typ != t {
+		return r.errorf("expected %v, but got %v", desc, r.token)
+	}
+
+	return r.advance()
+}
+
+func (r *parser) commands() ([]*node, error) {
+	var result []*node
+	for r.token.typ == tokenIdentifier {
+		cmd, err := r.command()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, cmd)
+	}
+
+	return result, nil
+}
+
+func (r *parser) command() (*node, error) {
+	cmd, err := r.arguments()
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.token.typ {
+	case tokenSemicolon:
+		return cmd, r.advance()
+	case tokenLeftBrace:
+		r.depth++
+		if r.depth > maxDepth {
+			return nil, r.errorf("too deeply nested")
+		}
+		if err := r.advance(); err != nil {
+			return nil, err
+		}
+		cmd.block, err = r.commands()
+		if err != nil {
+			return nil, err
+		}
+		cmd.hasBlock = true
+		if err := r.expect(tokenRightBrace, "}"); err != nil {
+			return nil, err
+		}
+		r.depth--
+		return cmd, nil
+	default:
+		return nil, r.errorf("expected ; or {, but got %v", r.token)
+	}
+}
+
+// arguments parses an identifier followed by its arguments and tests, which
+// is common to commands and tests.
+func (r *parser) arguments() (*node, error) {
+	if r.token.typ != tokenIdentifier {
+		return nil, r.errorf("expected an identifier, but got %v", r.token)
+	}
+	n := &node{name: r.token.str, line: r.token.line}
+	if err := r.advance(); err != nil {
+		return nil, err
+	}
+
+	for {
+		switch r.token.typ {
+		case tokenTag:
+			n.args = append(n.args, argument{typ: tokenTag, tag: r.token.str})
+		case tokenNumber:
+			n.args = append(n.args, argument{typ: tokenNumber, num: r.token.num})
+		case tokenString:
+			n.args = append(n.args, argument{typ: tokenString, str: []string{r.token.str}})
+		case tokenLeftBracket:
+			list, err := r.stringList()
+			if err != nil {
+				return nil, err
+			}
+			n.args = append(n.args, argument{typ: tokenString, str: list, list: true})
+			continue
+		case tokenIdentifier:
+			// A single test.
+			t, err := r.test()
+			if err != nil {
+				return nil, err
+			}
+			n.tests = []*node{t}
+			return n, nil
+		case tokenLeftParen:
+			tests, err := r.testList()
+			if err != nil {
+				return nil, err
+			}
+			n.tests = tests
+			return n, nil
+		default:
+			return n, nil
+		}
+		if err := r.advance(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *parser) stringList() ([]string, error) {
+	// Skip [.
+	if err := r.advance(); err != nil {
+		return nil, err
+	}
+	var result []string
+	for {
+		if r.token.typ != tokenString {
+			return nil, r.errorf("expected a string, but got %v", r.token)
+		}
+		result = append(result, r.token.str)
+		if err := r.advance(); err != nil {
+			return nil, err
+		}
+		if r.token.typ == tokenRightBracket {
+			return result, r.advance()
+		}
+		if err := r.expect(tokenComma, ", or ]"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *parser) test() (*node, error) {
+	r.depth++
+	if r.depth > maxDepth {
+		return nil, r.errorf("too deeply nested")
+	}
+	defer func() { r.depth-- }()
+
+	return r.arguments()
+}
+
+func (r *parser) testList() ([]*node, error) {
+	// Skip (.
+	if err := r.advance(); err != nil {
+		return nil, err
+	}
+	var result []*node
+	for {
+		t, err := r.test()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+		if r.token.typ == tokenRightParen {
+			return result, r.advance()
+		}
+		if err := r.expect(tokenComma, ", or )"); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+package sieve
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	src := `# A comment
+require ["fileinto", "imap4flags"];
+/* A bracket
+   comment */
+if header :contains "Subject" "[list]" {
+	fileinto "Lists/Omega";
+} elsif size :over 100K {
+	discard;
+}
+`
+	nodes, err := parse(src)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("expected 3 commands, got %v", len(nodes))
+	}
+
+	require := nodes[0]
+	if require.name != "require" || require.line != 2 || len(require.args) != 1 {
+		t.Fatalf("unexpected require: %+v", require)
+	}
+	if a := require.args[0]; !a.list || !reflect.DeepEqual(a.str, []string{"fileinto", "imap4flags"}) {
+		t.Fatalf("unexpected require argument: %+v", a)
+	}
+
+	ifNode := nodes[1]
+	if ifNode.name != "if" || ifNode.line != 5 || !ifNode.hasBlock || len(ifNode.tests) != 1 || len(ifNode.block) != 1 {
+		t.Fatalf("unexpected if: %+v", ifNode)
+	}
+	test := ifNode.tests[0]
+	if test.name != "header" || len(test.args) != 3 || test.args[0].typ != tokenTag || test.args[0].tag != "contains" {
+		t.Fatalf("unexpected header test: %+v", test)
+	}
+	if a := test.args[2]; a.list || a.str[0] != "[list]" {
+		t.Fatalf("unexpected header key: %+v", a)
+	}
+	if n := ifNode.block[0]; n.name != "fileinto" || n.line != 6 || n.args[0].str[0] != "Lists/Omega" {
+		t.Fatalf("unexpected fileinto: %+v", n)
+	}
+
+	elsif := nodes[2]
+	if elsif.name != "elsif" || elsif.line != 7 || len(elsif.tests) != 1 {
+		t.Fatalf("unexpected elsif: %+v", elsif)
+	}
+	if a := elsif.tests[0].args[1]; a.typ != tokenNumber || a.num != 100*1024 {
+		t.Fatalf("unexpected size limit: %+v", a)
+	}
+	if len(elsif.block) != 1 || elsif.block[0].name != "discard" {
+		t.Fatalf("unexpected elsif block: %+v", elsif.block)
+	}
+}
+
+func TestParseStrings(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{`keep "a\"b\\c\d";`, `a"b\cd`},
+		{"keep text:\r\nfirst\r\n..dot\r\n.\r\n;", "first\r\n.dot\r\n"},
+		{"keep text: # comment\nline\n.\n;", "line\r\n"},
+		{"keep text:\n.\n;", ""},
+	}
+	for _, test := range tests {
+		nodes, err := parse(test.src)
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		if s := nodes[0].args[0].str[0]; s != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.src, test.expected, s)
+		}
+	}
+}
+
+func TestParseNumbers(t *testing.T) {
+	tests := map[string]int64{
+		"10":  10,
+		"2k":  2 << 10,
+		"3M":  3 << 20,
+		"1G":  1 << 30,
+		"007": 7,
+	}
+	for src, expected := range tests {
+		nodes, err := parse("keep " + src + ";")
+		if err != nil {
+			t.Errorf("%v: %v", src, err)
+			continue
+		}
+		if n := nodes[0].args[0].num; n != expected {
+			t.Errorf("%v: expected %v, got %v", src, expected, n)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		src string
+		// err is a part of the expected error message.
+		err string
+	}{
+		{`keep`, "line 1"},
+		{"keep;\nkeep", "line 2"},
+		{`if true { keep;`, "line 1"},
+		{`keep "abc;`, "unterminated string"},
+		{"keep text: abc\n.\n;", "after text:"},
+		{"keep text:\nabc\n", "unterminated multi-line string"},
+		{`/* keep;`, "unterminated comment"},
+		{`keep :;`, "invalid tag"},
+		{`keep @;`, "unexpected character"},
+		{`keep 99999999999999;`, "too large number"},
+		{`keep [];`, "line 1"},
+		{`keep ["a" "b"];`, "line 1"},
+		{`} keep;`, "line 1"},
+		{strings.Repeat("if true {", maxDepth+1) + strings.Repeat("}", maxDepth+1), "too deeply nested"},
+		{"if " + strings.Repeat("not ", maxDepth+1) + "true {}", "too deeply nested"},
+	}
+	for _, test := range tests {
+		_, err := parse(test.src)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected %q in the error, got %v", test.src, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	// Maximum number of redirect actions in a script execution.
+	maxRedirects = 4
+	// Vacation :days is limited in this range.
+	minVacationDays     = 1
+	maxVacationDays     = 30
+	defaultVacationDays = 7
+)
+
+// extensions are the capabilities supported by this implementation.
+var extensions = map[string]bool{
+	"fileinto":                   true,
+	"envelope":                   true,
+	"copy":                       true,
+	"imap4flags":                 true,
+	"vacation":                   true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+// Extensions returns the names of the supported extensions.
+func Extensions() []string {
+	return []string{"fileinto", "envelope", "copy", "imap4flags", "vacation", "comparator-i;octet", "comparator-i;ascii-casemap"}
+}
+
+// Message is the information of an email that scripts can test.
+type Message struct {
+	// From and To are the envelope sender and recipient.
+	From string
+	To   string
+	// Header is the header of the message.
+	Header mail.Header
+	// Size is the size of the message in bytes.
+	Size int64
+}
+
+// Result is the actions that a script has decided for a message.
+type Result struct {
+	// Keep means the message should be stored in the Inbox, which is set by
+	// an explicit keep or the implicit keep.
+	Keep      bool
+	KeepFlags []string
+	FileInto  []FileInto
+	// Redirect is the addresses to forward the message.
+	Redirect []string
+	Vacation *Vacation
+}
+
+type FileInto struct {
+	// Folder is the path of the folder whose separator is "/".
+	Folder string
+	Flags  []string
+}
+
+type Vacation struct {
+	Days      int
+	Subject   string
+	From      string
+	Addresses []string
+	// MIME means Reason is a MIME entity including its headers.
+	MIME bool
+	// Handle identifies the vacation response to limit the number of
+	// responses to a sender.
+	Handle string
+	Reason string
+}
+
+// Script is a parsed Sieve (RFC 5228) script. The supported subset is the
+// control commands (require, if, elsif, else, and stop), the keep, discard,
+// and redirect actions, the address, envelope, header, exists, size, allof,
+// anyof, not, true, and false tests, and the extensions listed in Extensions.
+type Script struct {
+	commands []command
+}
+
+// Parse parses a script, and returns an error if the script has a syntax error
+// or uses unsupported commands.
+func Parse(src string) (*Script, error) {
+	nodes, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	c := &compiler{required: make(map[string]bool)}
+	commands, err := c.commands(nodes, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Script{commands: commands}, nil
+}
+
+// Evaluate runs the script for msg, and returns the decided actions.
+func (r *Script) Evaluate(msg Message) (*Result, error) {
+	s := &state{msg: msg, result: &Result{}, implicitKeep: true}
+	if err := s.run(r.commands); err != nil && err != errStop {
+		return nil, err
+	}
+	if s.implicitKeep && !s.result.Keep {
+		s.result.Keep = true
+		s.result.KeepFlags = s.flags
+	}
+
+	return s.result, nil
+}
+
+var errStop = errors.New("stop")
+
+type state struct {
+	msg          Message
+	result       *Result
+	implicitKeep bool
+	// flags is the internal variable of the imap4flags extension.
+	flags []string
+}
+
+func (r *state) run(commands []command) error {
+	for _, v := range commands {
+		if err := v.exec(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type command interface {
+	exec(s *state) error
+}
+
+type test interface {
+	eval(s *state) bool
+}
+
+type branch struct {
+	test  test
+	block []command
+}
+
+type ifCommand struct {
+	branches []branch
+	// elseBlock is nil if there is no else.
+	elseBlock []command
+}
+
+func (r *ifCommand) exec(s *state) error {
+	for _, v := range r.branches {
+		if v.test.eval(s) {
+			return s.run(v.block)
+		}
+	}
+
+	return s.run(r.elseBlock)
+}
+
+type stopCommand struct{}
+
+func (r *stopCommand) exec(s *state) error {
+	return errStop
+}
+
+type keepCommand struct {
+	flags    []string
+	hasFlags bool
+}
+
+func (r *keepCommand) exec(s *state) error {
+	s.result.Keep = true
+	s.result.KeepFlags = s.flags
+	if r.hasFlags {
+		s.result.KeepFlags = r.flags
+	}
+
+	return nil
+}
+
+type discardCommand struct{}
+
+func (r *discardCommand) exec(s *state) error {
+	s.implicitKeep = false
+	return nil
+}
+
+type fileintoCommand struct {
+	folder   string
+	flags    []string
+	hasFlags bool
+	copy     bool
+}
+
+func (r *fileintoCommand) exec(s *state) error {
+	if !r.copy {
+		s.implicitKeep = false
+	}
+	for _, v := range s.result.FileInto {
+		// Filing into the same folder twice is only once.
+		if v.Folder == r.folder {
+			return nil
+		}
+	}
+	flags := s.flags
+	if r.hasFlags {
+		flags = r.flags
+	}
+	s.result.FileInto = append(s.result.FileInto, FileInto{Folder: r.folder, Flags: flags})
+
+	return nil
+}
+
+type redirectCommand struct {
+	address string
+	copy    bool
+}
+
+func (r *redirectCommand) exec(s *state) error {
+	if !r.copy {
+		s.implicitKeep = false
+	}
+	for _, v := range s.result.Redirect {
+		if strings.EqualFold(v, r.address) {
+			return nil
+		}
+	}
+	if len(s.result.Redirect) >= maxRedirects {
+		return fmt.Errorf("too many redirect actions: %v", r.address)
+	}
+	s.result.Redirect = append(s.result.Redirect, r.address)
+
+	return nil
+}
+
+type flagCommand struct {
+	// op is one of "setflag", "addflag", and "removeflag".
+	op    string
+	flags []string
+}
+
+func (r *flagCommand) exec(s *state) error {
+	switch r.op {
+	case "setflag":
+		s.flags = addFlags(nil, r.flags)
+	case "addflag":
+		s.flags = addFlags(s.flags, r.flags)
+	case "removeflag":
+		result := []string{}
+		for _, v := range s.flags {
+			if !hasFlag(r.flags, v) {
+				result = append(result, v)
+			}
+		}
+		s.flags = result
+	}
+
+	return nil
+}
+
+func addFlags(flags, added []string) []string {
+	result := append([]string{}, flags...)
+	for _, v := range added {
+		if !hasFlag(result, v) {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, v := range flags {
+		if strings.EqualFold(v, flag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type vacationCommand struct {
+	vacation Vacation
+}
+
+func (r *vacationCommand) exec(s *state) error {
+	if s.result.Vacation != nil {
+		return errors.New("duplicated vacation actions")
+	}
+	v := r.vacation
+	s.result.Vacation = &v
+
+	return nil
+}
+
+type boolTest bool
+
+func (r boolTest) eval(s *state) bool {
+	return bool(r)
+}
+
+type notTest struct {
+	test test
+}
+
+func (r *notTest) eval(s *state) bool {
+	return !r.test.eval(s)
+}
+
+type allofTest struct {
+	tests []test
+	// any makes it anyof.
+	any bool
+}
+
+func (r *allofTest) eval(s *state) bool {
+	for _, v := range r.tests {
+		if v.eval(s) == r.any {
+			return r.any
+		}
+	}
+
+	return !r.any
+}
+
+type sizeTest struct {
+	over  bool
+	limit int64
+}
+
+func (r *sizeTest) eval(s *state) bool {
+	if r.over {
+		return s.msg.Size > r.limit
+	}
+	return s.msg.Size < r.limit
+}
+
+type existsTest struct {
+	headers []string
+}
+
+func (r *existsTest) eval(s *state) bool {
+	for _, v := range r.headers {
+		if len(s.msg.Header[textproto.CanonicalMIMEHeaderKey(v)]) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+type headerTest struct {
+	matcher matcher
+	headers []string
+	keys    []string
+}
+
+func (r *headerTest) eval(s *state) bool {
+	for _, name := range r.headers {
+		for _, v := range s.msg.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+			if r.matcher.matchAny(decodeHeader(v), r.keys) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type addressTest struct {
+	matcher matcher
+	// part is one of "all", "localpart", and "domain".
+	part    string
+	headers []string
+	keys    []string
+	// envelope makes it the envelope test whose headers are "from" and "to".
+	envelope bool
+}
+
+func (r *addressTest) eval(s *state) bool {
+	for _, name := range r.headers {
+		for _, v := range r.addresses(s, name) {
+			if r.matcher.matchAny(addressPart(v, r.part), r.keys) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (r *addressTest) addresses(s *state, name string) []string {
+	if r.envelope {
+		switch strings.ToLower(name) {
+		case "from":
+			return []string{s.msg.From}
+		case "to":
+			return []string{s.msg.To}
+		default:
+			return nil
+		}
+	}
+
+	var result []string
+	for _, v := range s.msg.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+		list, err := mail.ParseAddressList(v)
+		if err != nil {
+			continue
+		}
+		for _, addr := range list {
+			result = append(result, addr.Address)
+		}
+	}
+
+	return result
+}
+
+func addressPart(address, part string) string {
+	i := strings.LastIndex(address, "@")
+	switch part {
+	case "localpart":
+		if i < 0 {
+			return address
+		}
+		return address[:i]
+	case "domain":
+		if i < 0 {
+			return ""
+		}
+		return address[i+1:]
+	default:
+		return address
+	}
+}
+
+func decodeHeader(v string) string {
+	s, err := new(mime.WordDecoder).DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+
+	return s
+}
+
+type matcher struct {
+	// match is one of "is", "contains", and "matches".
+	match string
+	// octet is the i;octet comparator, which is case-sensitive. Otherwise, it
+	// is i;ascii-casemap.
+	octet bool
+}
+
+func (r matcher) matchAny(value string, keys []string) bool {
+	for _, v := range keys {
+		if r.matchOne(value, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r matcher) matchOne(value, key string) bool {
+	if !r.octet {
+		value, key = lowerASCII(value), lowerASCII(key)
+	}
+
+	switch r.match {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return glob([]rune(key), []rune(value))
+	default:
+		return value == key
+	}
+}
+
+func lowerASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+
+	return string(b)
+}
+
+// glob matches s with pattern that has wildcards, where * matches zero or more
+// characters, ? matches a single character, and \ escapes the next character.
+func glob(pattern, s []rune) bool {
+	// Positions to retry when a mismatch occurs after the last *.
+	star, retry := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; {
+			case c == '*':
+				star, retry = p, i
+				p++
+				continue
+			case c == '?':
+				p++
+				i++
+				continue
+			case c == '\\' && p+1 < len(pattern):
+				if pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			case c == s[i]:
+				p++
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last * match one more character.
+		retry++
+		p, i = star+1, retry
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
@@ -0,0 +1,230 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+package sieve
+
+import (
+	"bufio"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testHeader(t *testing.T, header string) mail.Header {
+	r := bufio.NewReader(strings.NewReader(strings.Replace(header, "\n", "\r\n", -1) + "\r\n\r\nBody\r\n"))
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+
+	return msg.Header
+}
+
+func evaluate(t *testing.T, src string, msg Message) *Result {
+	script, err := Parse(src)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	result, err := script.Evaluate(msg)
+	if err != nil {
+		t.Fatalf("Evaluate: %v", err)
+	}
+
+	return result
+}
+
+func TestCompileError(t *testing.T) {
+	tests := []struct {
+		src string
+		// err is a part of the expected error message.
+		err string
+	}{
+		{`fileinto "Work";`, `missing require "fileinto"`},
+		{`require "fileinto"; fileinto :copy "Work";`, `missing require "copy"`},
+		{`require "fileinto"; fileinto :flags "\\Seen" "Work";`, `missing require "imap4flags"`},
+		{`setflag "\\Seen";`, `missing require "imap4flags"`},
+		{`vacation "Away";`, `missing require "vacation"`},
+		{`if envelope "from" "a@example.com" { keep; }`, `missing require "envelope"`},
+		{`require "foo";`, "unsupported extension: foo"},
+		{`keep; require "fileinto";`, "require should be at the beginning"},
+		{`if true { require "fileinto"; }`, "require should be at the beginning"},
+		{`unknown;`, "unknown command: unknown"},
+		{`else { keep; }`, "else without if"},
+		{`if true { keep; } else true { keep; }`, "line 1"},
+		{`if { keep; }`, "if requires a test"},
+		{`if true;`, "unexpected or missing block"},
+		{`keep { discard; }`, "unexpected or missing block"},
+		{`keep true;`, "unexpected test"},
+		{`keep :copy;`, "unknown tag: copy"},
+		{`discard "x";`, "line 1"},
+		{`require "fileinto"; fileinto "/";`, "empty folder name"},
+		{`redirect "user";`, "invalid address: user"},
+		{`redirect "@example.com";`, "invalid address"},
+		{`if size 100 { keep; }`, "requires :over or :under"},
+		{`if unknown { keep; }`, "unknown test: unknown"},
+		{`if not true false { keep; }`, "line 1"},
+		{`if header :comparator "i;unknown" "Subject" "x" { keep; }`, "unsupported comparator"},
+		{`if header :comparator "i;octet" "Subject" "x" { keep; }`, `missing require "comparator-i;octet"`},
+		{`if header :domain "Subject" "x" { keep; }`, "unknown tag: domain"},
+		{`require "envelope"; if envelope "subject" "x" { keep; }`, "unsupported envelope part: subject"},
+		{`require "vacation"; vacation :unknown "Away";`, "unknown tag: unknown"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.src)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected %q in the error, got %v", test.src, test.err, err)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	msg := Message{
+		From: "bounce@lists.example.org",
+		To:   "alice@example.com",
+		Header: testHeader(t, `From: "Bob" <Bob@Example.org>
+To: alice@example.com, carol@example.net
+Subject: =?utf-8?q?[omega]_Caf=C3=A9?=
+List-Id: <omega.lists.example.org>`),
+		Size: 2048,
+	}
+	header := `require ["fileinto", "copy", "imap4flags", "envelope", "comparator-i;octet"];
+`
+	tests := []struct {
+		name     string
+		src      string
+		expected Result
+	}{
+		{"implicit keep", `if false { discard; }`, Result{Keep: true}},
+		{"discard", `discard;`, Result{}},
+		{"fileinto", `fileinto "Lists/Omega/";`, Result{FileInto: []FileInto{{Folder: "Lists/Omega"}}}},
+		{"fileinto once", `fileinto "Work"; fileinto "Work";`, Result{FileInto: []FileInto{{Folder: "Work"}}}},
+		{"fileinto copy", `fileinto :copy "Work";`, Result{Keep: true, FileInto: []FileInto{{Folder: "Work"}}}},
+		{"explicit keep", `keep; fileinto "Work";`, Result{Keep: true, FileInto: []FileInto{{Folder: "Work"}}}},
+		{"redirect", `redirect "carol@example.net"; redirect "Carol@Example.net";`, Result{Redirect: []string{"carol@example.net"}}},
+		{"redirect copy", `redirect :copy "carol@example.net";`, Result{Keep: true, Redirect: []string{"carol@example.net"}}},
+		{"stop", `fileinto "Work"; stop; fileinto "Other";`, Result{FileInto: []FileInto{{Folder: "Work"}}}},
+		{"flags", `setflag "\\Seen \\Flagged"; addflag "\\Seen"; removeflag "\\Flagged"; fileinto "Work"; keep :flags "$Label";`,
+			Result{Keep: true, KeepFlags: []string{"$Label"}, FileInto: []FileInto{{Folder: "Work", Flags: []string{`\Seen`}}}}},
+		{"implicit keep flags", `addflag "\\Seen";`, Result{Keep: true, KeepFlags: []string{`\Seen`}}},
+		{"header contains decoded", `if header :contains "subject" "café" { discard; }`, Result{}},
+		{"header is", `if header :is "Subject" "[omega]" { discard; }`, Result{Keep: true}},
+		{"header matches", `if header :matches "Subject" "[omega]*caf?" { discard; }`, Result{}},
+		{"header octet", `if header :comparator "i;octet" :contains "Subject" "CAFÉ" { discard; }`, Result{Keep: true}},
+		{"address all", `if address "from" "bob@example.org" { discard; }`, Result{}},
+		{"address localpart", `if address :localpart "to" "carol" { discard; }`, Result{}},
+		{"address domain", `if address :domain :is ["to", "cc"] "example.net" { discard; }`, Result{}},
+		{"address no match", `if address :domain "from" "example.com" { discard; }`, Result{Keep: true}},
+		{"envelope", `if envelope :domain "from" "lists.example.org" { fileinto "Lists"; }`, Result{FileInto: []FileInto{{Folder: "Lists"}}}},
+		{"exists", `if exists ["List-Id", "Subject"] { discard; }`, Result{}},
+		{"not exists", `if exists ["List-Id", "X-Spam"] { discard; }`, Result{Keep: true}},
+		{"size over", `if size :over 1K { discard; }`, Result{}},
+		{"size under", `if size :under 2K { discard; }`, Result{Keep: true}},
+		{"allof", `if allof (true, exists "List-Id") { discard; }`, Result{}},
+		{"allof false", `if allof (true, false) { discard; }`, Result{Keep: true}},
+		{"anyof", `if anyof (false, not false) { discard; }`, Result{}},
+		{"elsif", `if false { discard; } elsif true { fileinto "A"; } else { fileinto "B"; }`, Result{FileInto: []FileInto{{Folder: "A"}}}},
+		{"else", `if false { discard; } elsif false { fileinto "A"; } else { fileinto "B"; }`, Result{FileInto: []FileInto{{Folder: "B"}}}},
+	}
+	for _, test := range tests {
+		result := evaluate(t, header+test.src, msg)
+		if !reflect.DeepEqual(*result, test.expected) {
+			t.Errorf("%v: expected %+v, got %+v", test.name, test.expected, *result)
+		}
+	}
+}
+
+func TestEvaluateError(t *testing.T) {
+	tests := []string{
+		`redirect "a@example.com"; redirect "b@example.com"; redirect "c@example.com"; redirect "d@example.com"; redirect "e@example.com";`,
+		`require "vacation"; vacation "Away"; vacation "Away again";`,
+	}
+	for _, src := range tests {
+		script, err := Parse(src)
+		if err != nil {
+			t.Errorf("%q: %v", src, err)
+			continue
+		}
+		if _, err := script.Evaluate(Message{}); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestVacation(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected Vacation
+	}{
+		{`vacation :days 3 :subject "Out" :from "alice@example.com" :addresses ["a@example.com"] :handle "h" "Away";`,
+			Vacation{Days: 3, Subject: "Out", From: "alice@example.com", Addresses: []string{"a@example.com"}, Handle: "h", Reason: "Away"}},
+		{`vacation :days 0 :handle "h" "Away";`, Vacation{Days: minVacationDays, Handle: "h", Reason: "Away"}},
+		{`vacation :days 365 :handle "h" "Away";`, Vacation{Days: maxVacationDays, Handle: "h", Reason: "Away"}},
+		{"vacation :mime :handle \"h\" text:\nContent-Type: text/plain\n\nAway\n.\n;",
+			Vacation{Days: defaultVacationDays, MIME: true, Handle: "h", Reason: "Content-Type: text/plain\r\n\r\nAway\r\n"}},
+	}
+	for _, test := range tests {
+		result := evaluate(t, `require "vacation"; `+test.src, Message{})
+		if !result.Keep || result.Vacation == nil {
+			t.Errorf("%q: expected a vacation with keep, got %+v", test.src, result)
+			continue
+		}
+		if !reflect.DeepEqual(*result.Vacation, test.expected) {
+			t.Errorf("%q: expected %+v, got %+v", test.src, test.expected, *result.Vacation)
+		}
+	}
+
+	// The default handle changes with the response.
+	handle := func(src string) string {
+		return evaluate(t, `require "vacation"; `+src, Message{}).Vacation.Handle
+	}
+	if a, b := handle(`vacation "Away";`), handle(`vacation "Away";`); len(a) == 0 || a != b {
+		t.Errorf("expected the same handles, got %q and %q", a, b)
+	}
+	if a, b := handle(`vacation "Away";`), handle(`vacation "Back soon";`); a == b {
+		t.Errorf("expected different handles, got %q", a)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		expected   bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*b*b*", "abcbd", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{`a\?`, "a?", true},
+		{"caf?", "café", true},
+	}
+	for _, test := range tests {
+		if v := glob([]rune(test.pattern), []rune(test.s)); v != test.expected {
+			t.Errorf("glob(%q, %q): expected %v, got %v", test.pattern, test.s, test.expected, v)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package sieve
+
+import (
+	"time"
+
+	"github.com/superkkt/omega/database"
+)
+
+// NOTE: All methods of Storage should return database.TransactionError if an error occurrs.
+type Storage interface {
+	NewScriptManager(queryer database.Queryer) ScriptManager
+}
+
+type ScriptManager interface {
+	// GetScript returns the Sieve script of a user whose unique identifier is
+	// uid. GetScript returns database.ErrNotFound if the user has no script.
+	GetScript(uid uint64, lock database.LockMode) (string, error)
+	// SetScript sets the Sieve script of a user, which replaces the previous
+	// one if it exists.
+	SetScript(uid uint64, script string) error
+	// RemoveScript removes the Sieve script of a user. RemoveScript returns
+	// database.ErrNotFound if the user has no script.
+	RemoveScript(uid uint64) error
+	// AddVacationResponse records that a vacation response identified by
+	// handle is sent to sender, and returns true only if there is no such
+	// record that has not expired yet. The record expires after period.
+	AddVacationResponse(uid uint64, handle, sender string, period time.Duration) (ok bool, err error)
+}
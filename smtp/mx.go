@@ -0,0 +1,462 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsTimeout    = 5 * time.Second
+	resolvConf    = "/etc/resolv.conf"
+	defaultMXPort = 25
+)
+
+type MXConfig struct {
+	// Hostname is the name of this server sent with the EHLO command. Empty
+	// means the hostname of the system.
+	Hostname string
+	// Resolvers are the addresses (host:port) of recursive DNS servers to
+	// look up MX records. Empty means the name servers in /etc/resolv.conf.
+	Resolvers []string
+	// Port is the SMTP port of MX hosts. Zero means 25.
+	Port uint16
+	// VerifyTLS makes STARTTLS fail if the certificate of an MX host is not
+	// valid. Otherwise, STARTTLS is opportunistic: any certificate is
+	// accepted, and the email is sent in plain text if the TLS negotiation
+	// fails.
+	VerifyTLS bool
+	// Resolver looks up MX hosts and their addresses. Nil means a resolver
+	// that sends queries to Resolvers.
+	Resolver MXResolver
+	// Dialer connects to MX hosts. Nil means a net.Dialer with the default
+	// timeout.
+	Dialer Dialer
+}
+
+// MXResolver looks up the DNS records to deliver emails. Errors returned by
+// its methods are temporary unless they have the IsPermanent() method
+// returning true, e.g., for a domain that does not exist.
+type MXResolver interface {
+	// LookupMX returns the MX records of domain in any order. Empty records
+	// mean that domain has no MX record.
+	LookupMX(domain string) ([]*net.MX, error)
+	// LookupHost returns the IPv4 and IPv6 addresses of host.
+	LookupHost(host string) ([]string, error)
+}
+
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// MX delivers emails directly to the MX hosts of the recipient domains.
+type MX struct {
+	config MXConfig
+}
+
+func NewMX(conf MXConfig) (*MX, error) {
+	if len(conf.Hostname) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		conf.Hostname = hostname
+	}
+	if conf.Resolver == nil {
+		if len(conf.Resolvers) == 0 {
+			c, err := dns.ClientConfigFromFile(resolvConf)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range c.Servers {
+				conf.Resolvers = append(conf.Resolvers, net.JoinHostPort(v, c.Port))
+			}
+			if len(conf.Resolvers) == 0 {
+				return nil, fmt.Errorf("no name server in %v", resolvConf)
+			}
+		}
+		conf.Resolver = &dnsResolver{servers: conf.Resolvers}
+	}
+	if conf.Dialer == nil {
+		conf.Dialer = &net.Dialer{Timeout: timeout}
+	}
+	if conf.Port == 0 {
+		conf.Port = defaultMXPort
+	}
+
+	return &MX{
+		config: conf,
+	}, nil
+}
+
+// RecipientFailure is a recipient that an email has not been delivered to.
+type RecipientFailure struct {
+	Address string
+	Err     error
+}
+
+// DeliveryError is an error of MX that has failed to deliver an email to some
+// or all of the recipients.
+type DeliveryError struct {
+	Failures []RecipientFailure
+	// Total number of the recipients.
+	Total int
+}
+
+func (r *DeliveryError) Error() string {
+	s := make([]string, len(r.Failures))
+	for i, v := range r.Failures {
+		s[i] = fmt.Sprintf("%v: %v", v.Address, v.Err)
+	}
+
+	return fmt.Sprintf("failed to deliver to %v of %v recipients: %v", len(r.Failures), r.Total, strings.Join(s, "; "))
+}
+
+// IsPermanent returns whether all the failures are permanent.
+func (r *DeliveryError) IsPermanent() bool {
+	return len(r.TemporaryFailures()) == 0
+}
+
+func (r *DeliveryError) TemporaryFailures() []string {
+	result := []string{}
+	for _, v := range r.Failures {
+		if !isPermanent(v.Err) {
+			result = append(result, v.Address)
+		}
+	}
+
+	return result
+}
+
+func (r *DeliveryError) PermanentFailures() []string {
+	result := []string{}
+	for _, v := range r.Failures {
+		if isPermanent(v.Err) {
+			result = append(result, v.Address)
+		}
+	}
+
+	return result
+}
+
+func isPermanent(err error) bool {
+	if e, ok := err.(interface {
+		IsPermanent() bool
+	}); ok {
+		return e.IsPermanent()
+	}
+	if e, ok := err.(*textproto.Error); ok {
+		return e.Code >= 500
+	}
+
+	return false
+}
+
+// Send delivers msg to each recipient domain in turn. It returns a
+// *DeliveryError if the delivery has failed for any recipient.
+func (r *MX) Send(from string, to []string, msg []byte) error {
+	// Empty from is the null reverse-path for bounce messages.
+	if len(from) > 0 && !validateEmail(from) {
+		return permanentError{fmt.Errorf("invalid from address: %v", from)}
+	}
+	if len(to) == 0 {
+		return permanentError{errors.New("empty recipient address")}
+	}
+	if len(msg) == 0 {
+		return permanentError{errors.New("empty msg body")}
+	}
+
+	result := &DeliveryError{Total: len(to)}
+	domains, rcpts := []string{}, make(map[string][]string)
+	for _, v := range to {
+		if !validateEmail(v) {
+			result.Failures = append(result.Failures, RecipientFailure{v, permanentError{errors.New("invalid address")}})
+			continue
+		}
+		domain := strings.ToLower(v[strings.LastIndex(v, "@")+1:])
+		if _, ok := rcpts[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		rcpts[domain] = append(rcpts[domain], v)
+	}
+	for _, v := range domains {
+		result.Failures = append(result.Failures, r.deliver(v, from, rcpts[v], msg)...)
+	}
+	if len(result.Failures) > 0 {
+		return result
+	}
+
+	return nil
+}
+
+// deliver sends msg to rcpts whose domain is domain, and returns the failed recipients.
+func (r *MX) deliver(domain, from string, rcpts []string, msg []byte) []RecipientFailure {
+	fail := func(err error) []RecipientFailure {
+		result := make([]RecipientFailure, len(rcpts))
+		for i, v := range rcpts {
+			result[i] = RecipientFailure{v, err}
+		}
+		return result
+	}
+
+	hosts, err := r.lookupMX(domain)
+	if err != nil {
+		return fail(err)
+	}
+	var lastErr error
+	for _, host := range hosts {
+		addrs, err := r.lookupHost(host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, addr := range addrs {
+			failures, err := r.session(host, addr, from, rcpts, msg)
+			if err == nil {
+				return failures
+			}
+			// A 5xx reply to the session itself, e.g., MAIL FROM, will be
+			// the same on other hosts.
+			if isPermanent(err) {
+				return fail(err)
+			}
+			lastErr = fmt.Errorf("%v: %v", host, err)
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no MX host address: %v", domain)
+	}
+
+	return fail(lastErr)
+}
+
+// lookupMX returns the MX hosts of domain in order of preference.
+func (r *MX) lookupMX(domain string) ([]string, error) {
+	records, err := r.config.Resolver.LookupMX(domain)
+	if err != nil {
+		return nil, err
+	}
+	// Implicit MX (RFC 5321 section 5.1).
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+	// Null MX (RFC 7505).
+	if len(records) == 1 && records[0].Host == "." {
+		return nil, permanentError{fmt.Errorf("domain does not accept email: %v", domain)}
+	}
+	// Shuffle hosts of the same preference to distribute the load.
+	records = append([]*net.MX(nil), records...)
+	for i, v := range rand.Perm(len(records)) {
+		records[i], records[v] = records[v], records[i]
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pref < records[j].Pref })
+
+	hosts := make([]string, len(records))
+	for i, v := range records {
+		hosts[i] = strings.TrimSuffix(v.Host, ".")
+	}
+
+	return hosts, nil
+}
+
+// lookupHost returns the IPv4 and IPv6 addresses of host.
+func (r *MX) lookupHost(host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}, nil
+	}
+
+	return r.config.Resolver.LookupHost(host)
+}
+
+// dnsResolver is the default MXResolver that sends recursive queries to name servers.
+type dnsResolver struct {
+	servers []string
+}
+
+func (r *dnsResolver) LookupMX(domain string) ([]*net.MX, error) {
+	resp, err := r.query(domain, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*net.MX{}
+	for _, v := range resp.Answer {
+		if mx, ok := v.(*dns.MX); ok {
+			records = append(records, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+		}
+	}
+
+	return records, nil
+}
+
+func (r *dnsResolver) LookupHost(host string) ([]string, error) {
+	addrs := []string{}
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := r.query(host, t)
+		if err != nil {
+			// Not found errors are only meaningful if both have failed.
+			if isPermanent(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, v := range resp.Answer {
+			switch rr := v.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address of MX host: %v", host)
+	}
+
+	return addrs, nil
+}
+
+// query sends a recursive query to the name servers in turn until one of them answers.
+func (r *dnsResolver) query(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+
+	var lastErr error
+	for _, v := range r.servers {
+		resp, _, err := (&dns.Client{Timeout: dnsTimeout}).Exchange(m, v)
+		if err == nil && resp.Truncated {
+			resp, _, err = (&dns.Client{Net: "tcp", Timeout: dnsTimeout}).Exchange(m, v)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+			return resp, nil
+		case dns.RcodeNameError:
+			return nil, permanentError{fmt.Errorf("domain not found: %v", name)}
+		default:
+			lastErr = fmt.Errorf("DNS query of %v failed: %v", name, dns.RcodeToString[resp.Rcode])
+		}
+	}
+
+	return nil, lastErr
+}
+
+// session sends msg to rcpts through an SMTP session with addr, and returns
+// the failed recipients. It returns an error if the session has failed
+// before the recipients are accepted or rejected, and then another host can
+// be tried.
+func (r *MX) session(host, addr, from string, rcpts []string, msg []byte) ([]RecipientFailure, error) {
+	failures, err := r.dial(host, addr, from, rcpts, msg, true)
+	if err == errTLSFailed && !r.config.VerifyTLS {
+		failures, err = r.dial(host, addr, from, rcpts, msg, false)
+	}
+
+	return failures, err
+}
+
+var errTLSFailed = errors.New("STARTTLS negotiation failed")
+
+func (r *MX) dial(host, addr, from string, rcpts []string, msg []byte, startTLS bool) ([]RecipientFailure, error) {
+	conn, err := r.config.Dialer.Dial("tcp", net.JoinHostPort(addr, fmt.Sprintf("%v", r.config.Port)))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer c.Close()
+	if err := c.Hello(r.config.Hostname); err != nil {
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && startTLS {
+		tlsConf := &tls.Config{ServerName: host, InsecureSkipVerify: !r.config.VerifyTLS}
+		if err := c.StartTLS(tlsConf); err != nil {
+			if _, ok := err.(*textproto.Error); ok {
+				return nil, err
+			}
+			return nil, errTLSFailed
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return nil, err
+	}
+
+	failures, accepted := []RecipientFailure{}, []string{}
+	for _, v := range rcpts {
+		if err := c.Rcpt(v); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return nil, err
+			}
+			failures = append(failures, RecipientFailure{v, err})
+			continue
+		}
+		accepted = append(accepted, v)
+	}
+	if len(accepted) == 0 {
+		c.Quit()
+		return failures, nil
+	}
+
+	if err := data(c, msg); err != nil {
+		if _, ok := err.(*textproto.Error); !ok {
+			return nil, err
+		}
+		for _, v := range accepted {
+			failures = append(failures, RecipientFailure{v, err})
+		}
+	}
+	c.Quit()
+
+	return failures, nil
+}
+
+func data(c *smtp.Client, msg []byte) error {
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = wc.Write(msg); err != nil {
+		return err
+	}
+
+	return wc.Close()
+}
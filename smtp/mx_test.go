@@ -0,0 +1,350 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeResolver is an MXResolver whose records are given by the test.
+type fakeResolver struct {
+	// mx has the MX records by domain. Domains not in mx have no MX record.
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	// errs has the errors by domain or host.
+	errs map[string]error
+}
+
+func (r *fakeResolver) LookupMX(domain string) ([]*net.MX, error) {
+	if err, ok := r.errs[domain]; ok {
+		return nil, err
+	}
+	return r.mx[domain], nil
+}
+
+func (r *fakeResolver) LookupHost(host string) ([]string, error) {
+	if err, ok := r.errs[host]; ok {
+		return nil, err
+	}
+	v, ok := r.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no address of MX host: %v", host)
+	}
+	return v, nil
+}
+
+// fakeDialer connects to fake servers by their IP addresses instead of the
+// given ones. Addresses without a fake server are refused.
+type fakeDialer struct {
+	servers map[string]*fakeServer
+
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (r *fakeDialer) Dial(network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.dialed = append(r.dialed, host)
+	r.mu.Unlock()
+
+	s, ok := r.servers[host]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	return net.Dial(network, s.ln.Addr().String())
+}
+
+func (r *fakeDialer) dialedAddresses() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.dialed...)
+}
+
+func newTestMX(t *testing.T, resolver MXResolver, dialer Dialer, verifyTLS bool) *MX {
+	m, err := NewMX(MXConfig{Hostname: "mx.test", Resolver: resolver, Dialer: dialer, VerifyTLS: verifyTLS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func startServers(t *testing.T, servers map[string]*fakeServer) *fakeDialer {
+	for _, v := range servers {
+		v.start(t)
+	}
+	return &fakeDialer{servers: servers}
+}
+
+func closeServers(servers map[string]*fakeServer) {
+	for _, v := range servers {
+		v.close()
+	}
+}
+
+func sortedRecipients(mails []fakeMail) []string {
+	result := []string{}
+	for _, v := range mails {
+		result = append(result, v.To...)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestMXGroupByDomain(t *testing.T) {
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"one.test": {{Host: "mx.one.test.", Pref: 10}},
+			"two.test": {{Host: "mx.two.test.", Pref: 10}},
+		},
+		hosts: map[string][]string{
+			"mx.one.test": {"192.0.2.1"},
+			"mx.two.test": {"192.0.2.2"},
+		},
+	}
+	servers := map[string]*fakeServer{"192.0.2.1": {}, "192.0.2.2": {}}
+	dialer := startServers(t, servers)
+	defer closeServers(servers)
+
+	m := newTestMX(t, resolver, dialer, false)
+	if err := m.Send("alice@example.com", []string{"a@one.test", "b@two.test", "c@one.test"}, []byte(testMessage)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	one := servers["192.0.2.1"].received()
+	if len(one) != 1 || strings.Join(one[0].To, ",") != "a@one.test,c@one.test" {
+		t.Errorf("expected one email to both recipients of one.test, got %+v", one)
+	}
+	two := servers["192.0.2.2"].received()
+	if len(two) != 1 || strings.Join(two[0].To, ",") != "b@two.test" {
+		t.Errorf("expected one email to the recipient of two.test, got %+v", two)
+	}
+	if v := dialer.dialedAddresses(); len(v) != 2 {
+		t.Errorf("expected one session per domain, got %v", v)
+	}
+}
+
+func TestMXNullMX(t *testing.T) {
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"null.test": {{Host: ".", Pref: 0}},
+		},
+	}
+	dialer := &fakeDialer{}
+
+	m := newTestMX(t, resolver, dialer, false)
+	err := m.Send("alice@example.com", []string{"a@null.test"}, []byte(testMessage))
+	e, ok := err.(*DeliveryError)
+	if !ok {
+		t.Fatalf("expected a delivery error, got %v", err)
+	}
+	if !e.IsPermanent() || len(e.PermanentFailures()) != 1 {
+		t.Errorf("expected a permanent failure, got %v", e)
+	}
+	if v := dialer.dialedAddresses(); len(v) != 0 {
+		t.Errorf("expected no connection, got %v", v)
+	}
+}
+
+func TestMXImplicitMX(t *testing.T) {
+	resolver := &fakeResolver{
+		hosts: map[string][]string{
+			"implicit.test": {"192.0.2.3"},
+		},
+	}
+	servers := map[string]*fakeServer{"192.0.2.3": {}}
+	dialer := startServers(t, servers)
+	defer closeServers(servers)
+
+	m := newTestMX(t, resolver, dialer, false)
+	if err := m.Send("alice@example.com", []string{"a@implicit.test"}, []byte(testMessage)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := sortedRecipients(servers["192.0.2.3"].received()); strings.Join(v, ",") != "a@implicit.test" {
+		t.Errorf("expected the email to be delivered to the domain itself, got %v", v)
+	}
+}
+
+func TestMXPreference(t *testing.T) {
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"one.test": {
+				{Host: "backup.one.test.", Pref: 20},
+				{Host: "primary.one.test.", Pref: 10},
+			},
+		},
+		hosts: map[string][]string{
+			"primary.one.test": {"192.0.2.1"},
+			"backup.one.test":  {"192.0.2.2"},
+		},
+	}
+	// The primary host is down.
+	servers := map[string]*fakeServer{"192.0.2.2": {}}
+	dialer := startServers(t, servers)
+	defer closeServers(servers)
+
+	m := newTestMX(t, resolver, dialer, false)
+	if err := m.Send("alice@example.com", []string{"a@one.test"}, []byte(testMessage)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := dialer.dialedAddresses(); strings.Join(v, ",") != "192.0.2.1,192.0.2.2" {
+		t.Errorf("expected the primary host to be tried first, got %v", v)
+	}
+	if v := servers["192.0.2.2"].received(); len(v) != 1 {
+		t.Errorf("expected the email to be delivered to the backup host, got %+v", v)
+	}
+}
+
+func TestMXMixedReplies(t *testing.T) {
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"one.test": {{Host: "mx.one.test", Pref: 10}},
+		},
+		hosts: map[string][]string{
+			"mx.one.test": {"192.0.2.1"},
+		},
+		errs: map[string]error{
+			"missing.test": permanentError{errors.New("domain not found: missing.test")},
+			"broken.test":  errors.New("SERVFAIL"),
+		},
+	}
+	servers := map[string]*fakeServer{
+		"192.0.2.1": {
+			rcptReplies: map[string]string{
+				"busy@one.test":    "450 4.2.1 mailbox busy",
+				"unknown@one.test": "550 5.1.1 no such user",
+			},
+		},
+	}
+	dialer := startServers(t, servers)
+	defer closeServers(servers)
+
+	m := newTestMX(t, resolver, dialer, false)
+	to := []string{"ok@one.test", "busy@one.test", "unknown@one.test", "a@missing.test", "b@broken.test", "invalid"}
+	err := m.Send("alice@example.com", to, []byte(testMessage))
+	e, ok := err.(*DeliveryError)
+	if !ok {
+		t.Fatalf("expected a delivery error, got %v", err)
+	}
+	if e.Total != len(to) {
+		t.Errorf("expected %v recipients in total, got %v", len(to), e.Total)
+	}
+	if e.IsPermanent() {
+		t.Error("expected the delivery error to be temporary")
+	}
+	temporary := e.TemporaryFailures()
+	sort.Strings(temporary)
+	if v := strings.Join(temporary, ","); v != "b@broken.test,busy@one.test" {
+		t.Errorf("unexpected temporary failures: %v", v)
+	}
+	permanent := e.PermanentFailures()
+	sort.Strings(permanent)
+	if v := strings.Join(permanent, ","); v != "a@missing.test,invalid,unknown@one.test" {
+		t.Errorf("unexpected permanent failures: %v", v)
+	}
+	if v := sortedRecipients(servers["192.0.2.1"].received()); strings.Join(v, ",") != "ok@one.test" {
+		t.Errorf("expected the email to be delivered to the accepted recipient only, got %v", v)
+	}
+}
+
+func TestMXDataReply(t *testing.T) {
+	for _, reply := range []string{"451 4.3.0 try again later", "554 5.7.1 rejected"} {
+		resolver := &fakeResolver{
+			mx:    map[string][]*net.MX{"one.test": {{Host: "mx.one.test", Pref: 10}}},
+			hosts: map[string][]string{"mx.one.test": {"192.0.2.1"}},
+		}
+		servers := map[string]*fakeServer{"192.0.2.1": {dataReply: reply}}
+		dialer := startServers(t, servers)
+
+		m := newTestMX(t, resolver, dialer, false)
+		err := m.Send("alice@example.com", []string{"a@one.test", "b@one.test"}, []byte(testMessage))
+		closeServers(servers)
+		e, ok := err.(*DeliveryError)
+		if !ok {
+			t.Errorf("%v: expected a delivery error, got %v", reply, err)
+			continue
+		}
+		if len(e.Failures) != 2 {
+			t.Errorf("%v: expected both recipients to fail, got %v", reply, e)
+		}
+		if permanent := strings.HasPrefix(reply, "5"); e.IsPermanent() != permanent {
+			t.Errorf("%v: expected IsPermanent() to be %v", reply, permanent)
+		}
+	}
+}
+
+func TestMXStartTLS(t *testing.T) {
+	tests := []struct {
+		name      string
+		server    *fakeServer
+		verifyTLS bool
+		tls       bool
+		fail      bool
+	}{
+		{"no STARTTLS", &fakeServer{}, false, false, false},
+		{"opportunistic", &fakeServer{startTLS: true}, false, true, false},
+		{"fallback to plain text", &fakeServer{startTLS: true, brokenTLS: true}, false, false, false},
+		// The test certificate is not issued for the MX host.
+		{"verified", &fakeServer{startTLS: true}, true, false, true},
+		{"broken and verified", &fakeServer{startTLS: true, brokenTLS: true}, true, false, true},
+	}
+
+	for _, test := range tests {
+		resolver := &fakeResolver{
+			mx:    map[string][]*net.MX{"one.test": {{Host: "mx.one.test", Pref: 10}}},
+			hosts: map[string][]string{"mx.one.test": {"192.0.2.1"}},
+		}
+		servers := map[string]*fakeServer{"192.0.2.1": test.server}
+		dialer := startServers(t, servers)
+
+		m := newTestMX(t, resolver, dialer, test.verifyTLS)
+		err := m.Send("alice@example.com", []string{"a@one.test"}, []byte(testMessage))
+		closeServers(servers)
+		mails := test.server.received()
+		if test.fail {
+			e, ok := err.(*DeliveryError)
+			if !ok || e.IsPermanent() {
+				t.Errorf("%v: expected a temporary delivery error, got %v", test.name, err)
+			}
+			if len(mails) != 0 {
+				t.Errorf("%v: expected no email to be delivered", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(mails) != 1 || mails[0].TLS != test.tls {
+			t.Errorf("%v: expected one email with TLS=%v, got %+v", test.name, test.tls, mails)
+		}
+	}
+}
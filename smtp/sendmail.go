@@ -21,11 +21,13 @@
 package smtp
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/smtp"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -33,19 +35,60 @@ const (
 	timeout = 30 * time.Second
 )
 
+type Security int
+
+const (
+	// Plain SMTP without any encryption.
+	SecurityNone Security = iota
+	// Upgrade a plain SMTP connection to TLS using the STARTTLS command. The
+	// server should support STARTTLS.
+	SecurityStartTLS
+	// SMTP over TLS, which is also known as SMTPS (usually port 465).
+	SecurityTLS
+)
+
+type Config struct {
+	Host     string
+	Port     uint16
+	Security Security
+	// TLSConfig is used for the STARTTLS and TLS connections. Nil means the
+	// default configuration whose ServerName is Host.
+	TLSConfig *tls.Config
+	// Username and Password are the credential for SMTP AUTH. Empty Username
+	// disables the authentication.
+	Username string
+	Password string
+	// Mechanism is the SASL mechanism for SMTP AUTH, which is one of "PLAIN",
+	// "LOGIN", and "CRAM-MD5". Empty means the most secure one among the
+	// mechanisms advertised by the server. PLAIN and LOGIN are only allowed
+	// over TLS connections, or connections to localhost.
+	Mechanism string
+}
+
 type Sendmail struct {
-	host string
-	port uint16
+	config Config
 }
 
-// TODO: Add authentication
-func New(host string, port uint16) *Sendmail {
+func New(conf Config) *Sendmail {
+	if conf.TLSConfig == nil {
+		conf.TLSConfig = &tls.Config{ServerName: conf.Host}
+	}
+	conf.Mechanism = strings.ToUpper(conf.Mechanism)
+
 	return &Sendmail{
-		host: host,
-		port: port,
+		config: conf,
 	}
 }
 
+// permanentError is an error that will never succeed even if it is retried.
+type permanentError struct {
+	error
+}
+
+func (r permanentError) IsPermanent() bool {
+	return true
+}
+
 func validateEmail(email string) bool {
 	Re := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
 	return Re.MatchString(email)
@@ -53,28 +96,21 @@ func validateEmail(email string) bool {
 
 func (r *Sendmail) Send(from string, to []string, msg []byte) error {
 	if !validateEmail(from) {
-		return fmt.Errorf("invalid from address: %v", from)
+		return permanentError{fmt.Errorf("invalid from address: %v", from)}
 	}
 	if len(to) == 0 {
-		return errors.New("empty recipient address")
+		return permanentError{errors.New("empty recipient address")}
 	}
 	for _, v := range to {
 		if !validateEmail(v) {
-			return fmt.Errorf("invalid to address: %v", v)
+			return permanentError{fmt.Errorf("invalid to address: %v", v)}
 		}
 	}
 	if len(msg) == 0 {
-		return errors.New("empty msg body")
+		return permanentError{errors.New("empty msg body")}
 	}
 
-	d := net.Dialer{Timeout: timeout}
-	conn, err := d.Dial("tcp", fmt.Sprintf("%v:%v", r.host, r.port))
-	if err != nil {
-		return err
-	}
-	conn.SetDeadline(time.Now().Add(timeout))
-
-	c, err := smtp.NewClient(conn, r.host)
+	c, err := r.connect()
 	if err != nil {
 		return err
 	}
@@ -104,3 +140,130 @@ func (r *Sendmail) Send(from string, to []string, msg []byte) error {
 	// Send the QUIT command and close the connection.
 	return c.Quit()
 }
+
+// connect returns a new SMTP client that is ready to send an email, which has
+// done TLS negotiation and authentication according to the configuration.
+func (r *Sendmail) connect() (*smtp.Client, error) {
+	addr := net.JoinHostPort(r.config.Host, fmt.Sprintf("%v", r.config.Port))
+	d := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if r.config.Security == SecurityTLS {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, r.config.TLSConfig)
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, r.config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if r.config.Security == SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("%v does not support STARTTLS", addr)
+		}
+		if err := c.StartTLS(r.config.TLSConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if len(r.config.Username) > 0 {
+		if err := r.auth(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (r *Sendmail) auth(c *smtp.Client) error {
+	ok, params := c.Extension("AUTH")
+	if !ok {
+		return errors.New("SMTP server does not support AUTH")
+	}
+	advertised := strings.Fields(strings.ToUpper(params))
+
+	mechanism := r.config.Mechanism
+	if len(mechanism) == 0 {
+		mechanism = chooseMechanism(advertised)
+		if len(mechanism) == 0 {
+			return fmt.Errorf("no supported SMTP AUTH mechanism: %v", params)
+		}
+	}
+
+	var a smtp.Auth
+	switch mechanism {
+	case "PLAIN":
+		a = smtp.PlainAuth("", r.config.Username, r.config.Password, r.config.Host)
+	case "LOGIN":
+		a = &loginAuth{username: r.config.Username, password: r.config.Password, host: r.config.Host}
+	case "CRAM-MD5":
+		a = smtp.CRAMMD5Auth(r.config.Username, r.config.Password)
+	default:
+		return fmt.Errorf("unsupported SMTP AUTH mechanism: %v", mechanism)
+	}
+
+	return c.Auth(a)
+}
+
+// chooseMechanism returns the most preferred mechanism among advertised ones.
+// CRAM-MD5 does not send the password itself, and PLAIN is preferred to LOGIN
+// because it is standardized.
+func chooseMechanism(advertised []string) string {
+	for _, v := range []string{"CRAM-MD5", "PLAIN", "LOGIN"} {
+		for _, m := range advertised {
+			if v == m {
+				return v
+			}
+		}
+	}
+
+	return ""
+}
+
+// loginAuth implements the non-standard but widely used LOGIN mechanism.
+type loginAuth struct {
+	username, password string
+	host               string
+}
+
+func (r *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Same as smtp.PlainAuth, do not send the password over unencrypted connections.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != r.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (r *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	// Servers send the prompts in various forms, e.g., "Username:" and "User Name".
+	challenge := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(string(fromServer))), ":")
+	switch strings.TrimSpace(challenge) {
+	case "username", "user name":
+		return []byte(r.username), nil
+	case "password":
+		return []byte(r.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge: %v", string(fromServer))
+	}
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
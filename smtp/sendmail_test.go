@@ -0,0 +1,222 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+const testMessage = "Subject: test\r\n\r\nHello.\r\n"
+
+func newTestSendmail(t *testing.T, s *fakeServer, conf Config) *Sendmail {
+	_, pool := testCertificate(t)
+	conf.Host = "127.0.0.1"
+	conf.Port = s.port()
+	conf.TLSConfig = &tls.Config{ServerName: "127.0.0.1", RootCAs: pool}
+
+	return New(conf)
+}
+
+func TestSendmailSecurity(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   *fakeServer
+		security Security
+		tls      bool
+		fail     bool
+	}{
+		{"none", &fakeServer{}, SecurityNone, false, false},
+		{"none ignores STARTTLS", &fakeServer{startTLS: true}, SecurityNone, false, false},
+		{"starttls", &fakeServer{startTLS: true}, SecurityStartTLS, true, false},
+		{"starttls not supported", &fakeServer{}, SecurityStartTLS, false, true},
+		{"tls", &fakeServer{implicitTLS: true}, SecurityTLS, true, false},
+		{"tls to a plain server", &fakeServer{}, SecurityTLS, false, true},
+	}
+
+	for _, test := range tests {
+		s := test.server
+		s.start(t)
+		m := newTestSendmail(t, s, Config{Security: test.security})
+		err := m.Send("alice@example.com", []string{"bob@example.org", "carol@example.net"}, []byte(testMessage))
+		s.close()
+		if test.fail {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.name)
+			}
+			if len(s.received()) > 0 {
+				t.Errorf("%v: expected no email to be sent", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		mails := s.received()
+		if len(mails) != 1 {
+			t.Errorf("%v: expected 1 email, got %v", test.name, len(mails))
+			continue
+		}
+		v := mails[0]
+		if v.TLS != test.tls {
+			t.Errorf("%v: expected TLS=%v, got %v", test.name, test.tls, v.TLS)
+		}
+		if v.From != "alice@example.com" || strings.Join(v.To, ",") != "bob@example.org,carol@example.net" {
+			t.Errorf("%v: unexpected envelope: from=%v, to=%v", test.name, v.From, v.To)
+		}
+		if v.Body != strings.Replace(testMessage, "\r\n", "\n", -1) {
+			t.Errorf("%v: unexpected body: %q", test.name, v.Body)
+		}
+	}
+}
+
+func TestSendmailAuth(t *testing.T) {
+	all := []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+	tests := []struct {
+		name       string
+		advertised []string
+		prompts    []string
+		mechanism  string
+		password   string
+		fail       bool
+	}{
+		{"plain", all, nil, "PLAIN", "secret", false},
+		{"login", all, nil, "LOGIN", "secret", false},
+		{"login without colons", all, []string{"Username", "Password"}, "LOGIN", "secret", false},
+		{"login with user name", all, []string{"User Name", "Password:"}, "LOGIN", "secret", false},
+		{"login with user name and colon", all, []string{"User Name:", "password :"}, "LOGIN", "secret", false},
+		{"login with unknown prompt", all, []string{"Who are you?", "Password:"}, "LOGIN", "secret", true},
+		{"cram-md5", all, nil, "CRAM-MD5", "secret", false},
+		{"automatic", all, nil, "", "secret", false},
+		{"automatic plain", []string{"LOGIN", "PLAIN"}, nil, "", "secret", false},
+		{"automatic login", []string{"LOGIN"}, nil, "", "secret", false},
+		{"no common mechanism", []string{"XOAUTH2"}, nil, "", "secret", true},
+		{"no auth", nil, nil, "", "secret", true},
+		{"wrong password", all, nil, "PLAIN", "wrong", true},
+		{"wrong password cram-md5", all, nil, "CRAM-MD5", "wrong", true},
+	}
+
+	for _, test := range tests {
+		s := fakeServer{
+			startTLS:     true,
+			mechanisms:   test.advertised,
+			username:     "alice",
+			password:     "secret",
+			loginPrompts: test.prompts,
+		}
+		s.start(t)
+		m := newTestSendmail(t, &s, Config{
+			Security:  SecurityStartTLS,
+			Username:  "alice",
+			Password:  test.password,
+			Mechanism: strings.ToLower(test.mechanism),
+		})
+		err := m.Send("alice@example.com", []string{"bob@example.org"}, []byte(testMessage))
+		s.close()
+		if test.fail {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+		mails := s.received()
+		if len(mails) != 1 || mails[0].User != "alice" {
+			t.Errorf("%v: expected 1 email sent by the authenticated user, got %+v", test.name, mails)
+		}
+	}
+}
+
+func TestSendmailChooseMechanism(t *testing.T) {
+	tests := []struct {
+		advertised string
+		expected   string
+	}{
+		{"PLAIN LOGIN CRAM-MD5", "CRAM-MD5"},
+		{"LOGIN PLAIN", "PLAIN"},
+		{"LOGIN", "LOGIN"},
+		{"XOAUTH2 GSSAPI", ""},
+	}
+
+	for _, test := range tests {
+		if v := chooseMechanism(strings.Fields(test.advertised)); v != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.advertised, test.expected, v)
+		}
+	}
+}
+
+// TestSendmailRefuseAuth verifies that the password is not sent over an
+// unencrypted connection to a remote host.
+func TestSendmailRefuseAuth(t *testing.T) {
+	for _, mechanism := range []string{"PLAIN", "LOGIN"} {
+		s := fakeServer{mechanisms: []string{mechanism}, username: "alice", password: "secret"}
+		s.start(t)
+
+		conn, err := net.Dial("tcp", s.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The client thinks that the server is a remote host.
+		c, err := smtp.NewClient(conn, "mail.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := New(Config{Host: "mail.example.com", Username: "alice", Password: "secret", Mechanism: mechanism})
+		err = m.auth(c)
+		c.Close()
+		s.close()
+		if err == nil {
+			t.Errorf("%v: expected an error", mechanism)
+		}
+		if s.hasCommand("AUTH") {
+			t.Errorf("%v: AUTH has been sent over an unencrypted connection", mechanism)
+		}
+	}
+}
+
+func TestSendmailInvalidAddress(t *testing.T) {
+	m := New(Config{Host: "127.0.0.1", Port: 1})
+	tests := []struct {
+		from string
+		to   []string
+		msg  string
+	}{
+		{"invalid", []string{"bob@example.org"}, testMessage},
+		{"alice@example.com", nil, testMessage},
+		{"alice@example.com", []string{"invalid"}, testMessage},
+		{"alice@example.com", []string{"bob@example.org"}, ""},
+	}
+
+	for _, test := range tests {
+		err := m.Send(test.from, test.to, []byte(test.msg))
+		if !isPermanent(err) {
+			t.Errorf("from=%v, to=%v: expected a permanent error, got %v", test.from, test.to, err)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+/*
+ * Omega is an advanced email service that supports Microsoft ActiveSync.
+ *
+ * Copyright (C) 2016, 2017 Kitae Kim <superkkt@gmail.com>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+package smtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testCertOnce sync.Once
+	testCert     tls.Certificate
+	testCertPool *x509.CertPool
+)
+
+// testCertificate returns a self-signed certificate of localhost and 127.0.0.1,
+// and a pool that trusts it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	testCertOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "localhost"},
+			DNSNames:              []string{"localhost"},
+			IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:             time.Now().Add(-1 * time.Hour),
+			NotAfter:              time.Now().Add(1 * time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			panic(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			panic(err)
+		}
+		testCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+		testCertPool = x509.NewCertPool()
+		testCertPool.AddCert(cert)
+	})
+
+	return testCert, testCertPool
+}
+
+// fakeServer is an SMTP server for tests. Set the configuration fields before
+// calling start.
+type fakeServer struct {
+	// startTLS advertises STARTTLS, and implicitTLS accepts TLS connections only.
+	startTLS    bool
+	implicitTLS bool
+	// brokenTLS makes the TLS handshake after STARTTLS fail.
+	brokenTLS bool
+	// mechanisms are the advertised SASL mechanisms. Empty disables AUTH.
+	mechanisms []string
+	username   string
+	password   string
+	// loginPrompts are the challenges of the LOGIN mechanism. Nil means
+	// "Username:" and "Password:".
+	loginPrompts []string
+	// rcptReplies are the replies to RCPT TO by address. The default reply is 250.
+	rcptReplies map[string]string
+	// dataReply is the reply to the end of DATA. Empty means 250.
+	dataReply string
+
+	t  *testing.T
+	ln net.Listener
+
+	mu       sync.Mutex
+	commands []string
+	mails    []fakeMail
+}
+
+// fakeMail is an email received by fakeServer.
+type fakeMail struct {
+	TLS  bool
+	User string
+	From string
+	To   []string
+	Body string
+}
+
+func (r *fakeServer) start(t *testing.T) {
+	cert, _ := testCertificate(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.implicitTLS {
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	r.t = t
+	r.ln = ln
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+}
+
+func (r *fakeServer) close() {
+	r.ln.Close()
+}
+
+// port returns the listening port.
+func (r *fakeServer) port() uint16 {
+	return uint16(r.ln.Addr().(*net.TCPAddr).Port)
+}
+
+// received returns the emails received so far.
+func (r *fakeServer) received() []fakeMail {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]fakeMail(nil), r.mails...)
+}
+
+// hasCommand returns whether a command whose verb is verb has been received.
+func (r *fakeServer) hasCommand(verb string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range r.commands {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+type fakeSession struct {
+	conn net.Conn
+	text *textproto.Conn
+	tls  bool
+	user string
+	mail *fakeMail
+}
+
+func (r *fakeSession) reply(format string, args ...interface{}) {
+	r.text.PrintfLine(format, args...)
+}
+
+// challenge sends a 334 challenge and returns the decoded response.
+func (r *fakeSession) challenge(s string) (string, bool) {
+	r.reply("334 %v", base64.StdEncoding.EncodeToString([]byte(s)))
+	line, err := r.text.ReadLine()
+	if err != nil {
+		return "", false
+	}
+	// The client cancels the exchange with "*".
+	if line == "*" {
+		r.reply("501 canceled")
+		return "", false
+	}
+	v, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		r.reply("501 invalid base64")
+		return "", false
+	}
+
+	return string(v), true
+}
+
+func (r *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	s := &fakeSession{conn: conn, text: textproto.NewConn(conn), tls: r.implicitTLS}
+	s.reply("220 fake ESMTP")
+	for {
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		verb = strings.ToUpper(verb)
+		r.mu.Lock()
+		r.commands = append(r.commands, verb)
+		r.mu.Unlock()
+
+		switch verb {
+		case "EHLO":
+			lines := []string{"fake"}
+			if r.startTLS && !s.tls {
+				lines = append(lines, "STARTTLS")
+			}
+			if len(r.mechanisms) > 0 {
+				lines = append(lines, "AUTH "+strings.Join(r.mechanisms, " "))
+			}
+			for i, v := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				s.reply("250%v%v", sep, v)
+			}
+		case "HELO":
+			s.reply("250 fake")
+		case "STARTTLS":
+			if !r.startTLS || s.tls {
+				s.reply("502 not supported")
+				continue
+			}
+			s.reply("220 ready")
+			if r.brokenTLS {
+				// Garbage instead of the TLS handshake.
+				conn.Write([]byte("not a TLS record\r\n"))
+				return
+			}
+			cert, _ := testCertificate(r.t)
+			tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn = tc
+			s = &fakeSession{conn: tc, text: textproto.NewConn(tc), tls: true}
+		case "AUTH":
+			r.auth(s, arg)
+		case "MAIL":
+			s.mail = &fakeMail{TLS: s.tls, User: s.user, From: trimPath(arg[len("FROM:"):])}
+			s.reply("250 OK")
+		case "RCPT":
+			if s.mail == nil {
+				s.reply("503 need MAIL")
+				continue
+			}
+			addr := trimPath(arg[len("TO:"):])
+			if v, ok := r.rcptReplies[addr]; ok && !strings.HasPrefix(v, "2") {
+				s.reply("%v", v)
+				continue
+			}
+			s.mail.To = append(s.mail.To, addr)
+			s.reply("250 OK")
+		case "DATA":
+			if s.mail == nil || len(s.mail.To) == 0 {
+				s.reply("503 need RCPT")
+				continue
+			}
+			s.reply("354 go ahead")
+			body, err := s.text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			if len(r.dataReply) > 0 && !strings.HasPrefix(r.dataReply, "2") {
+				s.reply("%v", r.dataReply)
+				s.mail = nil
+				continue
+			}
+			s.mail.Body = string(body)
+			r.mu.Lock()
+			r.mails = append(r.mails, *s.mail)
+			r.mu.Unlock()
+			s.mail = nil
+			s.reply("250 OK")
+		case "RSET":
+			s.mail = nil
+			s.reply("250 OK")
+		case "NOOP":
+			s.reply("250 OK")
+		case "QUIT":
+			s.reply("221 bye")
+			return
+		default:
+			s.reply("500 unknown command")
+		}
+	}
+}
+
+func (r *fakeServer) auth(s *fakeSession, arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		s.reply("501 syntax error")
+		return
+	}
+
+	var username, password string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		var resp string
+		if len(fields) > 1 {
+			v, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				s.reply("501 invalid base64")
+				return
+			}
+			resp = string(v)
+		} else {
+			var ok bool
+			if resp, ok = s.challenge(""); !ok {
+				return
+			}
+		}
+		p := strings.Split(resp, "\x00")
+		if len(p) != 3 {
+			s.reply("501 invalid PLAIN response")
+			return
+		}
+		username, password = p[1], p[2]
+	case "LOGIN":
+		prompts := r.loginPrompts
+		if prompts == nil {
+			prompts = []string{"Username:", "Password:"}
+		}
+		var ok bool
+		if username, ok = s.challenge(prompts[0]); !ok {
+			return
+		}
+		if password, ok = s.challenge(prompts[1]); !ok {
+			return
+		}
+	case "CRAM-MD5":
+		challenge := "<1234.5678@fake>"
+		resp, ok := s.challenge(challenge)
+		if !ok {
+			return
+		}
+		p := strings.Fields(resp)
+		if len(p) != 2 {
+			s.reply("501 invalid CRAM-MD5 response")
+			return
+		}
+		h := hmac.New(md5.New, []byte(r.password))
+		h.Write([]byte(challenge))
+		username = p[0]
+		if p[1] == hex.EncodeToString(h.Sum(nil)) {
+			password = r.password
+		}
+	default:
+		s.reply("504 unsupported mechanism")
+		return
+	}
+
+	if username != r.username || password != r.password {
+		s.reply("535 authentication failed")
+		return
+	}
+	s.user = username
+	s.reply("235 authenticated")
+}
+
+// trimPath returns the address of an SMTP path, e.g., <user@example.com>.
+func trimPath(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, " "); i >= 0 {
+		s = s[:i]
+	}
+
+	return strings.Trim(s, "<>")
+}